@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultActivityWindow is how far back GetActivity looks without ?since=
+	defaultActivityWindow = 24 * time.Hour
+
+	// maxActivityWindow bounds one activity query, a month of minutes
+	maxActivityWindow = 31 * 24 * time.Hour
+)
+
+// IngestActivity stores the active minutes reported by a VM gateway, which
+// authenticates with the ingest token from its cloud-init
+func (h *Handlers) IngestActivity(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestBody)
+
+	var req models.IngestActivityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	_, err := h.vmManager.IngestActivity(c.Request.Context(), token, req.Samples)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "invalid ingest token")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err, "failed to store activity")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetActivity returns the caller's VM's active minutes and their totals.
+// Query parameters: since and until (RFC 3339), by default the last 24
+// hours, at most 31 days apart.
+func (h *Handlers) GetActivity(c *gin.Context) {
+	until := time.Now().UTC()
+	if raw := c.Query("until"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			respondQueryError(c, "until", "must be an RFC 3339 time")
+			return
+		}
+		until = t
+	}
+	since := until.Add(-defaultActivityWindow)
+	if raw := c.Query("since"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			respondQueryError(c, "since", "must be an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	if !since.Before(until) {
+		respondQueryError(c, "since", "must be before until")
+		return
+	}
+	if until.Sub(since) > maxActivityWindow {
+		respondQueryError(c, "since", "must be at most 31 days before until")
+		return
+	}
+
+	vm, err := h.vmManager.GetVM(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondInternalError(c, err, "failed to load VM")
+		return
+	}
+	if vm.UserID != c.GetHeader("X-User-ID") {
+		respondError(c, http.StatusForbidden, models.ErrorCodeForbidden, "access denied")
+		return
+	}
+
+	report, err := h.vmManager.GetActivity(c.Request.Context(), vm, since, until)
+	if err != nil {
+		respondInternalError(c, err, "failed to load activity")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
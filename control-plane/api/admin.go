@@ -0,0 +1,358 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devtail/control-plane/internal/console"
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/internal/vm"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// AdminHandlers serve the operator API under /api/v1/admin. Operators can
+// reach any user's VM, so the group must sit behind AdminAuth.
+type AdminHandlers struct {
+	vmManager *vm.Manager
+	ssh       *console.SSH
+	upgrader  websocket.Upgrader
+}
+
+// NewAdminHandlers creates the operator handlers. ssh may be nil, which
+// disables the SSH proxy.
+func NewAdminHandlers(vmManager *vm.Manager, ssh *console.SSH) *AdminHandlers {
+	return &AdminHandlers{
+		vmManager: vmManager,
+		ssh:       ssh,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			// Operators connect with CLI tools, not browsers, and
+			// authenticate with a bearer token rather than cookies
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// ListVMs lists every user's VMs, newest first. Query parameters: user_id,
+// status, labels, a selector as in the user API, and idle_for, a duration
+// such as 30m that only lists VMs without activity for that long. Terminated
+// VMs are only listed with status=terminated.
+func (h *AdminHandlers) ListVMs(c *gin.Context) {
+	filter := vm.VMFilter{UserID: c.Query("user_id")}
+
+	switch status := models.VMStatus(c.Query("status")); status {
+	case "", models.VMStatusProvisioning, models.VMStatusRunning, models.VMStatusSuspended,
+		models.VMStatusError, models.VMStatusTerminating, models.VMStatusTerminated:
+		filter.Status = status
+	default:
+		respondQueryError(c, "status", "is not a VM status")
+		return
+	}
+
+	selector, err := labels.ParseSelector(c.Query("labels"))
+	if err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+	filter.Selector = selector
+
+	if raw := c.Query("idle_for"); raw != "" {
+		idleFor, err := time.ParseDuration(raw)
+		if err != nil || idleFor <= 0 {
+			respondQueryError(c, "idle_for", "must be a positive duration such as 30m")
+			return
+		}
+		filter.IdleFor = idleFor
+	}
+
+	vms, err := h.vmManager.FindVMs(c.Request.Context(), filter)
+	if err != nil {
+		respondInternalError(c, err, "failed to list VMs")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ListVMsResponse{VMs: vms})
+}
+
+// GetVM returns any user's VM
+func (h *AdminHandlers) GetVM(c *gin.Context) {
+	vm, err := h.vmManager.GetVM(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondInternalError(c, err, "failed to load VM")
+		return
+	}
+
+	c.JSON(http.StatusOK, vm)
+}
+
+// DeleteVM deletes any user's VM, taking the same backup and immediate
+// query parameters as the user API
+func (h *AdminHandlers) DeleteVM(c *gin.Context) {
+	var opts vm.DeleteOptions
+	var ok bool
+	if opts.Backup, ok = queryBool(c, "backup"); !ok {
+		return
+	}
+	if opts.Immediate, ok = queryBool(c, "immediate"); !ok {
+		return
+	}
+
+	vm, ok := h.runningVM(c)
+	if !ok {
+		return
+	}
+
+	vm, err := h.vmManager.ScheduleDeletion(c.Request.Context(), vm, opts)
+	if err != nil {
+		respondInternalError(c, err, "failed to delete VM")
+		return
+	}
+
+	logger(c).Info().Str("vm_id", vm.ID).Str("remote_addr", c.ClientIP()).Msg("operator deleted VM")
+	c.JSON(http.StatusAccepted, vm)
+}
+
+// RetryJob runs the VM's failed provisioning or pending deletion again
+func (h *AdminHandlers) RetryJob(c *gin.Context) {
+	vm, ok := h.runningVM(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.vmManager.RetryJob(c.Request.Context(), vm)
+	if err != nil {
+		respondInternalError(c, err, "failed to retry job")
+		return
+	}
+
+	logger(c).Info().Str("vm_id", vm.ID).Str("job", string(resp.Job)).Str("remote_addr", c.ClientIP()).Msg("operator retried job")
+	c.JSON(http.StatusAccepted, resp)
+}
+
+// Reconcile repairs VMs whose jobs were lost, see vm.Manager.Reconcile
+func (h *AdminHandlers) Reconcile(c *gin.Context) {
+	report, err := h.vmManager.Reconcile(c.Request.Context())
+	if err != nil {
+		respondInternalError(c, err, "failed to reconcile VMs")
+		return
+	}
+
+	logger(c).Info().
+		Int("stuck_provisioning", len(report.StuckProvisioning)).
+		Int("deleted", len(report.Deleted)).
+		Int("errors", len(report.Errors)).
+		Str("remote_addr", c.ClientIP()).
+		Msg("operator reconciled VMs")
+	c.JSON(http.StatusOK, report)
+}
+
+// Watchdog reports the VMs the watchdog found stuck provisioning at its last
+// check, what it did about them, and its totals
+func (h *AdminHandlers) Watchdog(c *gin.Context) {
+	c.JSON(http.StatusOK, h.vmManager.WatchdogReport())
+}
+
+// Provisioning reports how long each stage of provisioning took in the
+// latest provisionings, and how many stayed within the SLO
+func (h *AdminHandlers) Provisioning(c *gin.Context) {
+	c.JSON(http.StatusOK, h.vmManager.ProvisioningStats())
+}
+
+// Pool reports how many warm pool VMs are ready to be claimed, how many
+// are provisioning, and the pool's totals
+func (h *AdminHandlers) Pool(c *gin.Context) {
+	report, err := h.vmManager.PoolReport(c.Request.Context())
+	if err != nil {
+		respondInternalError(c, err, "failed to report on the warm pool")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// SSH upgrades to a WebSocket carrying an interactive shell on the VM,
+// brokered over the tailnet. Binary frames are terminal input and output;
+// a text frame {"type":"resize","cols":120,"rows":40} resizes the terminal.
+func (h *AdminHandlers) SSH(c *gin.Context) {
+	if h.ssh == nil {
+		respondError(c, http.StatusNotImplemented, models.ErrorCodeInvalidRequest, "SSH proxy is not configured")
+		return
+	}
+
+	vm, ok := h.runningVM(c)
+	if !ok {
+		return
+	}
+	if vm.TailscaleIP == "" {
+		respondError(c, http.StatusConflict, models.ErrorCodeConflict, "VM has not joined the tailnet; use the console instead")
+		return
+	}
+
+	cols, rows := terminalSize(c)
+	log := logger(c).With().Str("vm_id", vm.ID).Str("remote_addr", c.ClientIP()).Logger()
+
+	session, err := h.ssh.Open(c.Request.Context(), vm.TailscaleIP, cols, rows)
+	if err != nil {
+		log.Warn().Err(err).Msg("operator SSH session failed")
+		respondError(c, http.StatusBadGateway, models.ErrorCodeProviderUnavailable, "failed to open SSH session to VM")
+		return
+	}
+	defer session.Close()
+
+	ws, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		log.Warn().Err(err).Msg("operator SSH upgrade failed")
+		return
+	}
+	defer ws.Close()
+
+	log.Info().Msg("operator SSH session started")
+	if err := session.Bridge(ws); err != nil {
+		log.Warn().Err(err).Msg("operator SSH session ended with error")
+		return
+	}
+	log.Info().Msg("operator SSH session ended")
+}
+
+// Console returns a provider console session for the VM, which works even
+// when its network is down
+func (h *AdminHandlers) Console(c *gin.Context) {
+	vm, ok := h.runningVM(c)
+	if !ok {
+		return
+	}
+	if vm.ProviderID == "" {
+		respondError(c, http.StatusConflict, models.ErrorCodeConflict, "VM has no machine yet")
+		return
+	}
+
+	resp, err := h.vmManager.Console(c.Request.Context(), vm)
+	if err != nil {
+		respondInternalError(c, err, "failed to open console")
+		return
+	}
+
+	logger(c).Info().Str("vm_id", vm.ID).Str("remote_addr", c.ClientIP()).Msg("operator console opened")
+	c.JSON(http.StatusOK, resp)
+}
+
+// Logs returns the log lines and panic reports the VM's gateway shipped,
+// newest first. Query parameters: kind (log or panic), since (RFC 3339) and
+// limit (at most 1000).
+func (h *AdminHandlers) Logs(c *gin.Context) {
+	var filter store.LogFilter
+
+	switch kind := models.LogKind(c.Query("kind")); kind {
+	case "", models.LogKindLog, models.LogKindPanic:
+		filter.Kind = kind
+	default:
+		respondQueryError(c, "kind", "must be log or panic")
+		return
+	}
+
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			respondQueryError(c, "since", "must be an RFC 3339 time")
+			return
+		}
+		filter.Since = t
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > 1000 {
+			respondQueryError(c, "limit", "must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+
+	vm, err := h.vmManager.GetVM(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondInternalError(c, err, "failed to load VM")
+		return
+	}
+
+	entries, err := h.vmManager.ListLogs(c.Request.Context(), vm.ID, filter)
+	if err != nil {
+		respondInternalError(c, err, "failed to list logs")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ListLogsResponse{Entries: entries})
+}
+
+// Broadcast sends an announcement, such as a maintenance window or a forced
+// upgrade, to the clients of every running VM, or of those matching the
+// labels selector. Gateways also show it to clients connecting until it
+// expires.
+func (h *AdminHandlers) Broadcast(c *gin.Context) {
+	var req models.BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if req.StartsAt != nil && req.EndsAt != nil && req.EndsAt.Before(*req.StartsAt) {
+		respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "ends_at is before starts_at",
+			map[string]interface{}{"fields": map[string]interface{}{"ends_at": "invalid"}})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "expires_at is in the past",
+			map[string]interface{}{"fields": map[string]interface{}{"expires_at": "invalid"}})
+		return
+	}
+
+	selector, err := labels.ParseSelector(req.Labels)
+	if err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+
+	resp, err := h.vmManager.Broadcast(c.Request.Context(), &req, selector)
+	if err != nil {
+		respondInternalError(c, err, "failed to broadcast announcement")
+		return
+	}
+
+	logger(c).Info().Str("announcement_id", resp.Announcement.ID).Str("remote_addr", c.ClientIP()).Msg("operator broadcast announcement")
+	c.JSON(http.StatusOK, resp)
+}
+
+// runningVM loads the VM named in the path for an operator, regardless of
+// owner. It writes the error response if the VM is gone.
+func (h *AdminHandlers) runningVM(c *gin.Context) (*models.VM, bool) {
+	vm, err := h.vmManager.GetVM(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondInternalError(c, err, "failed to load VM")
+		return nil, false
+	}
+
+	if vm.Status == models.VMStatusTerminated {
+		respondError(c, http.StatusConflict, models.ErrorCodeConflict, "VM is terminated")
+		return nil, false
+	}
+
+	return vm, true
+}
+
+// terminalSize reads the initial terminal size from the cols and rows query
+// parameters, defaulting to 80x24
+func terminalSize(c *gin.Context) (int, int) {
+	cols, err := strconv.Atoi(c.Query("cols"))
+	if err != nil || cols <= 0 || cols > 1000 {
+		cols = 80
+	}
+	rows, err := strconv.Atoi(c.Query("rows"))
+	if err != nil || rows <= 0 || rows > 1000 {
+		rows = 24
+	}
+	return cols, rows
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// StartBackup records a pending workspace backup for a VM gateway and
+// returns a presigned URL to upload the archive to. Gateways never hold
+// the bucket's credentials.
+func (h *Handlers) StartBackup(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	var req models.StartBackupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	resp, err := h.vmManager.StartBackup(c.Request.Context(), token, req.Workspace)
+	if err != nil {
+		respondContextError(c, err, "failed to start backup")
+		return
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// CompleteBackup marks an uploaded backup restorable and applies the
+// retention policy to the workspace's older backups
+func (h *Handlers) CompleteBackup(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+	id, ok := backupID(c)
+	if !ok {
+		return
+	}
+
+	var req models.CompleteBackupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	backup, err := h.vmManager.CompleteBackup(c.Request.Context(), token, id, &req)
+	if err != nil {
+		respondContextError(c, err, "failed to complete backup")
+		return
+	}
+	c.JSON(http.StatusOK, backup)
+}
+
+// DownloadBackup returns a presigned URL for one of the backups of the
+// owner of the gateway's VM, so a new VM can restore it
+func (h *Handlers) DownloadBackup(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+	id, ok := backupID(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.vmManager.BackupDownload(c.Request.Context(), token, id)
+	if err != nil {
+		respondContextError(c, err, "failed to prepare backup download")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListBackups lists the user's restorable workspace backups, newest first.
+// Their IDs can be passed as restore_backup_id when creating a VM.
+func (h *Handlers) ListBackups(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	backups, err := h.vmManager.ListBackups(c.Request.Context(), userID)
+	if err != nil {
+		respondInternalError(c, err, "failed to list backups")
+		return
+	}
+	c.JSON(http.StatusOK, models.ListBackupsResponse{Backups: backups})
+}
+
+// backupID parses the :id path parameter, or answers 400
+func backupID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "invalid backup ID",
+			map[string]interface{}{"fields": map[string]interface{}{"id": "invalid"}})
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// MaxContextBody bounds one saved conversation context. Gateways skip
+// bigger ones rather than sending them.
+const MaxContextBody = 4 << 20
+
+// SaveContext stores a conversation context uploaded by a VM gateway. The
+// body is the gateway's context file; it is kept for the VM's owner so a VM
+// they create later can restore it.
+func (h *Handlers) SaveContext(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+	if len(c.Param("workspace")) > 255 || len(c.Param("session")) > 255 {
+		respondError(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "workspace and session must be at most 255 characters")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxContextBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondTooLarge(c, tooLarge.Limit)
+		return
+	}
+	if err != nil || !json.Valid(data) {
+		respondError(c, http.StatusBadRequest, models.ErrorCodeInvalidRequest, "invalid request body")
+		return
+	}
+
+	snapshot := &models.ContextSnapshot{
+		Workspace: c.Param("workspace"),
+		SessionID: c.Param("session"),
+		Data:      data,
+	}
+	if err := h.vmManager.SaveContext(c.Request.Context(), token, snapshot); err != nil {
+		respondContextError(c, err, "failed to save context")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListContexts lists the contexts saved for the owner of the gateway's VM,
+// without their data, most recently updated first
+func (h *Handlers) ListContexts(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	var limit int
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			respondQueryError(c, "limit", "must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	snapshots, err := h.vmManager.ListContexts(c.Request.Context(), token, limit)
+	if err != nil {
+		respondContextError(c, err, "failed to list contexts")
+		return
+	}
+	c.JSON(http.StatusOK, models.ListContextSnapshotsResponse{Snapshots: snapshots})
+}
+
+// GetContext returns one saved context with its data
+func (h *Handlers) GetContext(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	snapshot, err := h.vmManager.GetContext(c.Request.Context(), token, c.Param("workspace"), c.Param("session"))
+	if errors.Is(err, store.ErrNotFound) {
+		respondError(c, http.StatusNotFound, models.ErrorCodeNotFound, "context not found")
+		return
+	}
+	if err != nil {
+		respondContextError(c, err, "failed to load context")
+		return
+	}
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// respondContextError answers an invalid ingest token with 401 and anything
+// else as respondInternalError does
+func respondContextError(c *gin.Context, err error, message string) {
+	if errors.Is(err, auth.ErrInvalidToken) {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "invalid ingest token")
+		return
+	}
+	respondInternalError(c, err, message)
+}
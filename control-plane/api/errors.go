@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/devtail/control-plane/internal/catalog"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/internal/vm"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// respondError writes the error envelope with the request ID
+func respondError(c *gin.Context, status int, code models.ErrorCode, message string) {
+	respondErrorDetails(c, status, code, message, nil)
+}
+
+func respondErrorDetails(c *gin.Context, status int, code models.ErrorCode, message string, details map[string]interface{}) {
+	c.AbortWithStatusJSON(status, models.ErrorResponse{
+		Error: &models.APIError{
+			Code:      code,
+			Message:   message,
+			Details:   details,
+			RequestID: requestid.FromContext(c.Request.Context()),
+		},
+	})
+}
+
+// respondBindError answers a request body that failed to parse or validate.
+// Validation failures list the offending fields in details.
+func respondBindError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondTooLarge(c, tooLarge.Limit)
+		return
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		respondError(c, http.StatusBadRequest, models.ErrorCodeInvalidRequest, "invalid request body")
+		return
+	}
+
+	fields := make(map[string]interface{}, len(verrs))
+	for _, fe := range verrs {
+		fields[jsonField(fe.Namespace())] = fe.Tag()
+	}
+	respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "request validation failed",
+		map[string]interface{}{"fields": fields})
+}
+
+// respondTooLarge answers a request body over its route's limit
+func respondTooLarge(c *gin.Context, limit int64) {
+	respondErrorDetails(c, http.StatusRequestEntityTooLarge, models.ErrorCodePayloadTooLarge, "request body too large",
+		map[string]interface{}{"max_bytes": limit})
+}
+
+// respondSpecError answers a VM spec that is not in the catalog, listing the
+// allowed values so clients can correct it
+func respondSpecError(c *gin.Context, err error) {
+	var verr *catalog.ValidationError
+	if !errors.As(err, &verr) {
+		respondInternalError(c, err, "failed to validate VM spec")
+		return
+	}
+
+	respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, verr.Error(),
+		map[string]interface{}{
+			"fields":  map[string]interface{}{verr.Field: "unavailable"},
+			"allowed": map[string]interface{}{verr.Field: verr.Allowed},
+		})
+}
+
+// respondLabelsError answers labels that break the naming rules
+func respondLabelsError(c *gin.Context, err error) {
+	respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, err.Error(),
+		map[string]interface{}{"fields": map[string]interface{}{"labels": "invalid"}})
+}
+
+// respondQueryError answers an invalid query parameter
+func respondQueryError(c *gin.Context, param, problem string) {
+	respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, param+" "+problem,
+		map[string]interface{}{"fields": map[string]interface{}{param: "invalid"}})
+}
+
+// respondInternalError maps an error from the VM manager to a response.
+// message describes the failed operation and is used for errors that have
+// no more specific mapping; the cause is logged, not returned.
+func respondInternalError(c *gin.Context, err error, message string) {
+	var perr *vm.ProviderError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		respondError(c, http.StatusNotFound, models.ErrorCodeNotFound, "VM not found")
+	case errors.Is(err, vm.ErrConsoleUnsupported), errors.Is(err, vm.ErrBackupsDisabled), errors.Is(err, vm.ErrSuspendUnsupported),
+		errors.Is(err, vm.ErrNotificationsDisabled):
+		respondError(c, http.StatusNotImplemented, models.ErrorCodeInvalidRequest, err.Error())
+	case errors.Is(err, vm.ErrBackupNotFound):
+		respondError(c, http.StatusNotFound, models.ErrorCodeNotFound, err.Error())
+	case errors.Is(err, vm.ErrNotTerminating), errors.Is(err, vm.ErrDeletionInProgress), errors.Is(err, vm.ErrNoGateway),
+		errors.Is(err, vm.ErrNotRebuildable), errors.Is(err, vm.ErrNoFailedJob),
+		errors.Is(err, vm.ErrNotSuspendable), errors.Is(err, vm.ErrSuspendScheduled), errors.Is(err, vm.ErrNotSuspended):
+		respondError(c, http.StatusConflict, models.ErrorCodeConflict, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		logger(c).Warn().Err(err).Msg(message)
+		respondError(c, http.StatusGatewayTimeout, models.ErrorCodeTimeout, message+": timed out")
+	case errors.As(err, &perr) && perr.QuotaExceeded():
+		logger(c).Warn().Err(err).Msg(message)
+		respondErrorDetails(c, http.StatusTooManyRequests, models.ErrorCodeQuotaExceeded,
+			fmt.Sprintf("%s: provider quota exceeded", message),
+			map[string]interface{}{"provider": perr.Provider})
+	case errors.As(err, &perr):
+		logger(c).Error().Err(err).Msg(message)
+		respondErrorDetails(c, http.StatusBadGateway, models.ErrorCodeProviderUnavailable,
+			fmt.Sprintf("%s: provider request failed", message),
+			map[string]interface{}{"provider": perr.Provider})
+	default:
+		logger(c).Error().Err(err).Msg(message)
+		respondError(c, http.StatusInternalServerError, models.ErrorCodeInternal, message)
+	}
+}
+
+// jsonField turns a validator namespace such as CreateVMRequest.Spec.Type
+// into the JSON path clients sent, spec.type
+func jsonField(namespace string) string {
+	parts := strings.Split(namespace, ".")
+	if len(parts) > 1 {
+		parts = parts[1:]
+	}
+	for i, p := range parts {
+		parts[i] = toSnake(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+func toSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 && !(s[i-1] >= 'A' && s[i-1] <= 'Z') {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -1,91 +1,344 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/catalog"
+	"github.com/devtail/control-plane/internal/health"
+	"github.com/devtail/control-plane/internal/labels"
 	"github.com/devtail/control-plane/internal/vm"
 	"github.com/devtail/control-plane/pkg/models"
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
 )
 
 type Handlers struct {
 	vmManager *vm.Manager
+	catalog   *catalog.Service
+	health    *health.Checker
 }
 
-func NewHandlers(vmManager *vm.Manager) *Handlers {
+func NewHandlers(vmManager *vm.Manager, catalog *catalog.Service, checker *health.Checker) *Handlers {
 	return &Handlers{
 		vmManager: vmManager,
+		catalog:   catalog,
+		health:    checker,
 	}
 }
 
 func (h *Handlers) CreateVM(c *gin.Context) {
 	var req models.CreateVMRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
 	// Get user ID from auth context (simplified for now)
 	userID := c.GetHeader("X-User-ID")
 	if userID == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing user ID"})
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
 		return
 	}
 	req.UserID = userID
 
+	if err := labels.Validate(req.Labels); err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+
+	if err := h.catalog.Validate(c.Request.Context(), &req.Spec); err != nil {
+		respondSpecError(c, err)
+		return
+	}
+
 	resp, err := h.vmManager.CreateVM(c.Request.Context(), &req)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create VM")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create VM"})
+		respondInternalError(c, err, "failed to create VM")
 		return
 	}
 
 	c.JSON(http.StatusCreated, resp)
 }
 
+// GetCatalog lists the server types, locations and disk sizes accepted by
+// CreateVM
+func (h *Handlers) GetCatalog(c *gin.Context) {
+	c.JSON(http.StatusOK, h.catalog.Get(c.Request.Context()))
+}
+
 func (h *Handlers) GetVM(c *gin.Context) {
 	vmID := c.Param("id")
 	
 	vm, err := h.vmManager.GetVM(c.Request.Context(), vmID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "VM not found"})
+		respondInternalError(c, err, "failed to load VM")
 		return
 	}
 
 	// Check user authorization
 	userID := c.GetHeader("X-User-ID")
 	if vm.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		respondError(c, http.StatusForbidden, models.ErrorCodeForbidden, "access denied")
+		return
+	}
+
+	c.JSON(http.StatusOK, vm)
+}
+
+// ListVMs lists the caller's VMs, optionally filtered by a label selector
+// such as ?labels=project=devtail,branch!=main
+func (h *Handlers) ListVMs(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	selector, err := labels.ParseSelector(c.Query("labels"))
+	if err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+
+	vms, err := h.vmManager.ListVMs(c.Request.Context(), userID, selector)
+	if err != nil {
+		respondInternalError(c, err, "failed to list VMs")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ListVMsResponse{VMs: vms})
+}
+
+// ListGateways lists connection descriptors for the caller's VMs: a signed
+// WebSocket URL, the workspaces each gateway serves and how healthy it is.
+// It takes the same ?labels= selector as ListVMs.
+func (h *Handlers) ListGateways(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	selector, err := labels.ParseSelector(c.Query("labels"))
+	if err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+
+	gateways, err := h.vmManager.ListGateways(c.Request.Context(), userID, selector)
+	if err != nil {
+		respondInternalError(c, err, "failed to list gateways")
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ListGatewaysResponse{Gateways: gateways})
+}
+
+// UpdateLabels replaces a VM's labels
+func (h *Handlers) UpdateLabels(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateLabelsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	if err := labels.Validate(req.Labels); err != nil {
+		respondLabelsError(c, err)
+		return
+	}
+
+	if err := h.vmManager.UpdateLabels(c.Request.Context(), vm, req.Labels); err != nil {
+		respondInternalError(c, err, "failed to update labels")
 		return
 	}
 
 	c.JSON(http.StatusOK, vm)
 }
 
+// DeleteVM marks a VM terminating and deletes its machine once the grace
+// period ends; ?immediate=true skips it and ?backup=true backs up every
+// workspace first. It answers with the VM, which is terminated if its
+// machine is already gone.
 func (h *Handlers) DeleteVM(c *gin.Context) {
-	vmID := c.Param("id")
-	
-	vm, err := h.vmManager.GetVM(c.Request.Context(), vmID)
+	var opts vm.DeleteOptions
+	var ok bool
+	if opts.Backup, ok = queryBool(c, "backup"); !ok {
+		return
+	}
+	if opts.Immediate, ok = queryBool(c, "immediate"); !ok {
+		return
+	}
+
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	vm, err := h.vmManager.ScheduleDeletion(c.Request.Context(), vm, opts)
+	if err != nil {
+		respondInternalError(c, err, "failed to delete VM")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, vm)
+}
+
+// CancelDeletion keeps a VM that is terminating but whose machine has not
+// been deleted yet
+func (h *Handlers) CancelDeletion(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	vm, err := h.vmManager.CancelDeletion(c.Request.Context(), vm)
+	if err != nil {
+		respondInternalError(c, err, "failed to cancel deletion")
+		return
+	}
+
+	c.JSON(http.StatusOK, vm)
+}
+
+// RebuildVM replaces a VM's machine with a freshly provisioned one that keeps
+// the VM's identity
+func (h *Handlers) RebuildVM(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	var req models.RebuildVMRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	vm, err := h.vmManager.RebuildVM(c.Request.Context(), vm, &req)
+	if err != nil {
+		respondInternalError(c, err, "failed to rebuild VM")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, vm)
+}
+
+// RefreshConnectURL signs a new short-lived WebSocket URL for a VM, so
+// clients can reconnect after the one returned by CreateVM expires. With
+// read_only=true the URL only lets its sessions watch.
+func (h *Handlers) RefreshConnectURL(c *gin.Context) {
+	readOnly, ok := queryBool(c, "read_only")
+	if !ok {
+		return
+	}
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	connectURL := h.vmManager.ConnectURL
+	if readOnly {
+		connectURL = h.vmManager.ReadOnlyConnectURL
+	}
+	resp, err := connectURL(vm)
+	if err != nil {
+		respondInternalError(c, err, "failed to sign connect URL")
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// RotateToken revokes every connect token issued for a VM and returns a new
+// WebSocket URL; sessions opened with the old tokens are ended
+func (h *Handlers) RotateToken(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.vmManager.RotateToken(c.Request.Context(), vm)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "VM not found"})
+		respondInternalError(c, err, "failed to rotate token")
 		return
 	}
 
+	c.JSON(http.StatusOK, resp)
+}
+
+// RevokeToken revokes one connect token, or all of a VM's tokens when no
+// token ID is given, e.g. after a device is lost
+func (h *Handlers) RevokeToken(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	var req models.RevokeTokenRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	resp, err := h.vmManager.RevokeTokens(c.Request.Context(), vm, req.TokenID, time.Now())
+	if err != nil {
+		respondInternalError(c, err, "failed to revoke token")
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// queryBool parses an optional true/false query parameter. It writes the
+// error response if the value is neither.
+func queryBool(c *gin.Context, param string) (bool, bool) {
+	raw := c.Query(param)
+	if raw == "" {
+		return false, true
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		respondQueryError(c, param, "must be true or false")
+		return false, false
+	}
+	return v, true
+}
+
+// activeVM loads the VM named in the path, checking that it belongs to the
+// caller and has not been terminated. It writes the error response if not.
+func (h *Handlers) activeVM(c *gin.Context) (*models.VM, bool) {
+	vm, err := h.vmManager.GetVM(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondInternalError(c, err, "failed to load VM")
+		return nil, false
+	}
+
 	// Check user authorization
 	userID := c.GetHeader("X-User-ID")
 	if vm.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-		return
+		respondError(c, http.StatusForbidden, models.ErrorCodeForbidden, "access denied")
+		return nil, false
 	}
 
-	if err := h.vmManager.DeleteVM(c.Request.Context(), vmID); err != nil {
-		log.Error().Err(err).Msg("Failed to delete VM")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete VM"})
-		return
+	if vm.Status == models.VMStatusTerminated {
+		respondError(c, http.StatusConflict, models.ErrorCodeConflict, "VM is terminated")
+		return nil, false
 	}
 
-	c.JSON(http.StatusNoContent, nil)
+	return vm, true
 }
 
 func (h *Handlers) VMCallback(c *gin.Context) {
@@ -96,11 +349,11 @@ func (h *Handlers) VMCallback(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&callback); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindError(c, err)
 		return
 	}
 
-	log.Info().
+	logger(c).Info().
 		Str("vm_id", callback.VMID).
 		Str("tailscale_ip", callback.TailscaleIP).
 		Str("status", callback.Status).
@@ -110,9 +363,106 @@ func (h *Handlers) VMCallback(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
-func (h *Handlers) HealthCheck(c *gin.Context) {
+// maxIngestBody bounds one batch of shipped logs
+const maxIngestBody = 1 << 20
+
+// IngestLogs stores log lines and panic reports shipped by a VM gateway. The
+// gateway authenticates with the ingest token from its cloud-init, which
+// also names the VM.
+func (h *Handlers) IngestLogs(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestBody)
+
+	var req models.IngestLogsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	vmID, err := h.vmManager.IngestLogs(c.Request.Context(), token, req.Entries)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "invalid ingest token")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err, "failed to store logs")
+		return
+	}
+
+	for _, entry := range req.Entries {
+		if entry.Kind == models.LogKindPanic {
+			logger(c).Error().Str("vm_id", vmID).Str("message", entry.Message).Msg("gateway panic reported")
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ingestToken returns the bearer ingest token, or answers 401 without one
+func ingestToken(c *gin.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing ingest token")
+	}
+	return token, ok
+}
+
+// Liveness answers /healthz: the process is up and serving HTTP. It checks
+// nothing else, so a database outage does not get the process restarted.
+func (h *Handlers) Liveness(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"status": "healthy",
+		"status":  "alive",
 		"service": "control-plane",
 	})
+}
+
+// Readiness answers /readyz: 503 while the database is unreachable or the
+// server is draining for shutdown
+func (h *Handlers) Readiness(c *gin.Context) {
+	report := h.health.Ready(c.Request.Context())
+
+	status := http.StatusOK
+	if report.Status != health.StatusHealthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// HealthCheck reports the reachability of each dependency. It answers 503
+// when a critical dependency (the database) is down; provider outages only
+// mark the service degraded, since existing VMs keep working.
+func (h *Handlers) HealthCheck(c *gin.Context) {
+	report := h.health.Run(c.Request.Context())
+
+	status := http.StatusOK
+	if report.Status == health.StatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// Metrics answers /metrics with counts for monitoring: the VMs stuck
+// provisioning at the watchdog's last check, what it has done about them,
+// and how long provisioning takes
+func (h *Handlers) Metrics(c *gin.Context) {
+	report := h.vmManager.WatchdogReport()
+	stats := h.vmManager.ProvisioningStats()
+
+	metrics := models.Metrics{
+		StuckVMs:            map[models.StuckStage]int{models.StuckQueued: 0, models.StuckMachine: 0, models.StuckTailnet: 0},
+		Watchdog:            report.Totals,
+		ProvisionP95Seconds: make(map[models.ProvisionStage]float64, len(stats.Stages)),
+		Provisioning:        stats.Totals,
+	}
+	for _, vm := range report.Stuck {
+		metrics.StuckVMs[vm.Stage]++
+	}
+	for stage, s := range stats.Stages {
+		metrics.ProvisionP95Seconds[stage] = s.P95Seconds
+	}
+	c.JSON(http.StatusOK, metrics)
 }
\ No newline at end of file
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// RequestID tags each request with an ID, reusing a valid X-Request-ID from
+// the client or generating one. The ID is echoed in the response header,
+// included in error responses, and attached to the request's logger, so
+// every log line for a request (including provisioning it starts) can be
+// found with it.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+
+		c.Request = c.Request.WithContext(requestid.WithContext(c.Request.Context(), id))
+		c.Header(requestid.Header, id)
+		c.Next()
+	}
+}
+
+// AdminAuth requires the operator token as a bearer token. Operator routes
+// act on every user's VMs, so they are only mounted when a token is set.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		presented, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "invalid operator token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// RouteLimit bounds a request's body and how long its handler may run. Zero
+// fields fall back to the defaults given to Limits; a negative Timeout
+// removes the deadline, for long-lived streams such as the SSH proxy.
+type RouteLimit struct {
+	MaxBodyBytes int64
+	Timeout      time.Duration
+}
+
+// Limits applies defaults to every request, with overrides keyed by method
+// and route pattern, e.g. "GET /api/v1/admin/vms/:id/ssh". The deadline is
+// set on the request context, so provider, Tailscale and store calls made
+// with it are cancelled when it passes instead of piling up behind a hung
+// API.
+func Limits(defaults RouteLimit, routes map[string]RouteLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := defaults
+		if override, ok := routes[c.Request.Method+" "+c.FullPath()]; ok {
+			if override.MaxBodyBytes != 0 {
+				limit.MaxBodyBytes = override.MaxBodyBytes
+			}
+			if override.Timeout != 0 {
+				limit.Timeout = override.Timeout
+			}
+		}
+
+		if limit.MaxBodyBytes > 0 {
+			if c.Request.ContentLength > limit.MaxBodyBytes {
+				respondTooLarge(c, limit.MaxBodyBytes)
+				return
+			}
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit.MaxBodyBytes)
+		}
+
+		if limit.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), limit.Timeout)
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		c.Next()
+
+		// Handlers that passed the context down report the error themselves;
+		// this covers those that gave up without answering
+		if !c.Writer.Written() && errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+			respondError(c, http.StatusGatewayTimeout, models.ErrorCodeTimeout, "request timed out")
+		}
+	}
+}
+
+// logger returns the request-scoped logger
+func logger(c *gin.Context) *zerolog.Logger {
+	return requestid.Logger(c.Request.Context())
+}
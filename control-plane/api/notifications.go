@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterNotificationTarget adds a device token or email address the
+// caller is notified at. Registering a device token another user had moves
+// it to the caller, as the device changed hands.
+func (h *Handlers) RegisterNotificationTarget(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	var req models.CreateNotificationTargetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+	if !validTargetAddress(req.Kind, req.Address) {
+		respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "invalid "+string(req.Kind)+" address",
+			map[string]interface{}{"fields": map[string]interface{}{"address": "invalid"}})
+		return
+	}
+
+	target, err := h.vmManager.RegisterNotificationTarget(c.Request.Context(), userID, &req)
+	if err != nil {
+		respondInternalError(c, err, "failed to register notification target")
+		return
+	}
+	c.JSON(http.StatusCreated, target)
+}
+
+// ListNotificationTargets lists the caller's notification targets
+func (h *Handlers) ListNotificationTargets(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	targets, err := h.vmManager.ListNotificationTargets(c.Request.Context(), userID)
+	if err != nil {
+		respondInternalError(c, err, "failed to list notification targets")
+		return
+	}
+	c.JSON(http.StatusOK, models.ListNotificationTargetsResponse{Targets: targets})
+}
+
+// DeleteNotificationTarget stops notifying the caller at a target, e.g.
+// when they sign out on the device
+func (h *Handlers) DeleteNotificationTarget(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "invalid notification target ID",
+			map[string]interface{}{"fields": map[string]interface{}{"id": "invalid"}})
+		return
+	}
+
+	err = h.vmManager.DeleteNotificationTarget(c.Request.Context(), userID, id)
+	if errors.Is(err, store.ErrNotFound) {
+		respondError(c, http.StatusNotFound, models.ErrorCodeNotFound, "notification target not found")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err, "failed to delete notification target")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// TestNotification sends the caller a test notification through every
+// notifier and reports which failed, so they can check their targets
+func (h *Handlers) TestNotification(c *gin.Context) {
+	userID := c.GetHeader("X-User-ID")
+	if userID == "" {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "missing user ID")
+		return
+	}
+
+	resp, err := h.vmManager.TestNotification(c.Request.Context(), userID)
+	if err != nil {
+		respondInternalError(c, err, "failed to send test notification")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// IngestEvent notifies the owner of a VM about an event its gateway
+// reported, such as an AI reply that finished with no client connected
+func (h *Handlers) IngestEvent(c *gin.Context) {
+	token, ok := ingestToken(c)
+	if !ok {
+		return
+	}
+
+	var req models.IngestEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	err := h.vmManager.IngestEvent(c.Request.Context(), token, &req)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		respondError(c, http.StatusUnauthorized, models.ErrorCodeUnauthenticated, "invalid ingest token")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err, "failed to ingest event")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// validTargetAddress checks an address has the form its kind's service
+// expects, so typos are caught at registration rather than at delivery
+func validTargetAddress(kind models.NotificationTargetKind, address string) bool {
+	switch kind {
+	case models.TargetEmail:
+		addr, err := mail.ParseAddress(address)
+		return err == nil && addr.Name == ""
+	case models.TargetAPNs:
+		// APNs device tokens are hex-encoded bytes
+		_, err := hex.DecodeString(address)
+		return err == nil
+	default:
+		return true
+	}
+}
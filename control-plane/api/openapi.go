@@ -0,0 +1,478 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/devtail/control-plane/internal/health"
+	"github.com/devtail/control-plane/internal/openapi"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Security scheme names used in the OpenAPI document
+const (
+	securityUser   = "userID"
+	securityIngest = "ingestToken"
+	securityAdmin  = "adminToken"
+)
+
+// OpenAPI describes every control-plane route, built from the request and
+// response types the handlers use. Add new routes here as well as to the
+// router; the server warns at startup about any it is missing.
+func OpenAPI() *openapi.Document {
+	b := openapi.NewBuilder(openapi.Info{
+		Title:       "devtail control plane",
+		Description: "Creates and manages devtail VMs, and receives logs, activity, contexts and backups from their gateways.",
+		Version:     "v1",
+	}, models.ErrorResponse{})
+
+	b.Enum(models.VMStatusProvisioning, models.VMStatusRunning, models.VMStatusSuspended,
+		models.VMStatusError, models.VMStatusTerminating, models.VMStatusTerminated)
+	b.Enum(models.BackupStatusPending, models.BackupStatusComplete, models.BackupStatusDeleted)
+	b.Enum(models.LogKindLog, models.LogKindPanic)
+	b.Enum(models.TargetFCM, models.TargetAPNs, models.TargetEmail)
+	b.Enum(models.JobProvision, models.JobDeletion)
+	b.Enum(models.AnnouncementInfo, models.AnnouncementMaintenance, models.AnnouncementUpgrade)
+	b.Enum(models.GatewayHealthy, models.GatewayDegraded, models.GatewayUnavailable,
+		models.GatewayUnreachable, models.GatewayUnknown)
+	b.Enum(health.StatusHealthy, health.StatusDegraded, health.StatusUnhealthy)
+	b.Enum(models.ErrorCodeInvalidRequest, models.ErrorCodeValidationFailed, models.ErrorCodeUnauthenticated,
+		models.ErrorCodeForbidden, models.ErrorCodeNotFound, models.ErrorCodeConflict, models.ErrorCodePayloadTooLarge,
+		models.ErrorCodeQuotaExceeded, models.ErrorCodeProviderUnavailable, models.ErrorCodeTimeout,
+		models.ErrorCodeInternal)
+
+	b.Security(securityUser, &openapi.SecurityScheme{
+		Type: "apiKey", In: "header", Name: "X-User-ID",
+		Description: "The calling user, set by the authenticating proxy in front of the control plane",
+	})
+	b.Security(securityIngest, &openapi.SecurityScheme{
+		Type: "http", Scheme: "bearer",
+		Description: "A VM's ingest token, passed to its gateway in cloud-init",
+	})
+	b.Security(securityAdmin, &openapi.SecurityScheme{
+		Type: "http", Scheme: "bearer",
+		Description: "The operator token, admin.token",
+	})
+
+	// Statuses most routes can answer with
+	var (
+		bad      = http.StatusBadRequest
+		unauth   = http.StatusUnauthorized
+		denied   = http.StatusForbidden
+		missing  = http.StatusNotFound
+		conflict = http.StatusConflict
+		tooLarge = http.StatusRequestEntityTooLarge
+		failed   = http.StatusInternalServerError
+		timeout  = http.StatusGatewayTimeout
+	)
+	limit := &openapi.Parameter{
+		Name: "limit", In: "query", Description: "At most this many results",
+		Schema: &openapi.Schema{Type: "integer", Minimum: float(1), Maximum: float(1000)},
+	}
+
+	// VMs
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms", ID: "createVM", Tag: "vms", Security: securityUser,
+		Summary: "Create a VM; it is provisioned in the background",
+		Request: models.CreateVMRequest{}, Status: http.StatusCreated, Response: models.CreateVMResponse{},
+		Errors: []int{bad, unauth, tooLarge, http.StatusTooManyRequests, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/vms", ID: "listVMs", Tag: "vms", Security: securityUser,
+		Summary: "List the caller's VMs",
+		Query: []*openapi.Parameter{{
+			Name: "labels", In: "query", Description: "Label selector, e.g. project=devtail,branch!=main",
+			Schema: &openapi.Schema{Type: "string"},
+		}},
+		Response: models.ListVMsResponse{},
+		Errors:   []int{bad, unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/vms/:id", ID: "getVM", Tag: "vms", Security: securityUser,
+		Summary:  "Get a VM",
+		Response: models.VM{},
+		Errors:   []int{denied, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodDelete, Path: "/api/v1/vms/:id", ID: "deleteVM", Tag: "vms", Security: securityUser,
+		Summary: "Delete a VM; its machine is kept, and the deletion can be cancelled, until the grace period ends",
+		Query: []*openapi.Parameter{{
+			Name: "backup", In: "query", Description: "Back up every workspace before the machine is deleted",
+			Schema: &openapi.Schema{Type: "boolean"},
+		}, {
+			Name: "immediate", In: "query", Description: "Skip the grace period",
+			Schema: &openapi.Schema{Type: "boolean"},
+		}},
+		Status: http.StatusAccepted, Response: models.VM{},
+		Errors: []int{bad, denied, missing, conflict, http.StatusNotImplemented, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/deletion/cancel", ID: "cancelDeletion", Tag: "vms", Security: securityUser,
+		Summary:  "Keep a terminating VM whose machine has not been deleted yet",
+		Response: models.VM{},
+		Errors:   []int{denied, missing, conflict, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/rebuild", ID: "rebuildVM", Tag: "vms", Security: securityUser,
+		Summary: "Replace a VM's machine with a fresh one that keeps the VM's ID, tokens and hostname",
+		Request: models.RebuildVMRequest{}, OptionalRequest: true, Status: http.StatusAccepted, Response: models.VM{},
+		Errors: []int{bad, denied, missing, conflict, tooLarge, http.StatusNotImplemented, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/resume", ID: "resumeVM", Tag: "vms", Security: securityUser,
+		Summary:  "Start a suspended VM again",
+		Response: models.VM{},
+		Errors:   []int{denied, missing, conflict, http.StatusNotImplemented, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPut, Path: "/api/v1/vms/:id/labels", ID: "updateLabels", Tag: "vms", Security: securityUser,
+		Summary: "Replace a VM's labels",
+		Request: models.UpdateLabelsRequest{}, Response: models.VM{},
+		Errors: []int{bad, denied, missing, conflict, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/connect", ID: "refreshConnectURL", Tag: "vms", Security: securityUser,
+		Summary: "Sign a new WebSocket URL for a VM",
+		Query: []*openapi.Parameter{{
+			Name: "read_only", In: "query", Description: "Only let the URL's sessions watch, for sharing with viewers",
+			Schema: &openapi.Schema{Type: "boolean"},
+		}},
+		Response: models.ConnectResponse{},
+		Errors:   []int{bad, denied, missing, conflict, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/token/rotate", ID: "rotateToken", Tag: "vms", Security: securityUser,
+		Summary:  "Revoke every connect token of a VM and sign a new URL",
+		Response: models.TokenRevocationResponse{},
+		Errors:   []int{denied, missing, conflict, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/vms/:id/token/revoke", ID: "revokeToken", Tag: "vms", Security: securityUser,
+		Summary: "Revoke one connect token, or all of them without a token ID",
+		Request: models.RevokeTokenRequest{}, OptionalRequest: true, Response: models.TokenRevocationResponse{},
+		Errors: []int{bad, denied, missing, conflict, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/vms/:id/activity", ID: "getActivity", Tag: "vms", Security: securityUser,
+		Summary: "Get a VM's active minutes and their totals",
+		Query: []*openapi.Parameter{
+			{Name: "since", In: "query", Description: "Default 24 hours before until", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			{Name: "until", In: "query", Description: "Default now; at most 31 days after since", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+		},
+		Response: models.ActivityReport{},
+		Errors:   []int{bad, denied, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/gateways", ID: "listGateways", Tag: "vms", Security: securityUser,
+		Summary: "List connection descriptors for the caller's VMs, with workspaces and gateway health",
+		Query: []*openapi.Parameter{{
+			Name: "labels", In: "query", Description: "Label selector, e.g. project=devtail,branch!=main",
+			Schema: &openapi.Schema{Type: "string"},
+		}},
+		Response: models.ListGatewaysResponse{},
+		Errors:   []int{bad, unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/catalog", ID: "getCatalog", Tag: "vms",
+		Summary:  "List the server types, locations, disk sizes and images VMs can use",
+		Response: models.Catalog{},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/backups", ID: "listBackups", Tag: "backups", Security: securityUser,
+		Summary:  "List the caller's restorable workspace backups",
+		Response: models.ListBackupsResponse{},
+		Errors:   []int{unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/notifications/targets", ID: "registerNotificationTarget", Tag: "notifications", Security: securityUser,
+		Summary: "Register a device token or email address to be notified at",
+		Request: models.CreateNotificationTargetRequest{}, Status: http.StatusCreated, Response: models.NotificationTarget{},
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/notifications/targets", ID: "listNotificationTargets", Tag: "notifications", Security: securityUser,
+		Summary:  "List the caller's notification targets",
+		Response: models.ListNotificationTargetsResponse{},
+		Errors:   []int{unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodDelete, Path: "/api/v1/notifications/targets/:id", ID: "deleteNotificationTarget", Tag: "notifications", Security: securityUser,
+		Summary: "Stop notifying the caller at a target",
+		Status:  http.StatusNoContent,
+		Errors:  []int{bad, unauth, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/notifications/test", ID: "testNotification", Tag: "notifications", Security: securityUser,
+		Summary:  "Send the caller a test notification through every notifier",
+		Response: models.TestNotificationResponse{},
+		Errors:   []int{unauth, http.StatusNotImplemented, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/callbacks/vm", ID: "vmCallback", Tag: "gateway",
+		Summary: "Report a VM's status from cloud-init",
+		Request: struct {
+			VMID        string `json:"vm_id"`
+			TailscaleIP string `json:"tailscale_ip"`
+			Status      string `json:"status"`
+		}{},
+		Response: map[string]string{},
+		Errors:   []int{bad, tooLarge},
+	})
+
+	// Gateway ingest
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/ingest/logs", ID: "ingestLogs", Tag: "gateway", Security: securityIngest,
+		Summary: "Store log lines and panic reports shipped by a gateway",
+		Request: models.IngestLogsRequest{}, Status: http.StatusNoContent,
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/ingest/activity", ID: "ingestActivity", Tag: "gateway", Security: securityIngest,
+		Summary: "Store the active minutes reported by a gateway",
+		Request: models.IngestActivityRequest{}, Status: http.StatusNoContent,
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/ingest/events", ID: "ingestEvent", Tag: "gateway", Security: securityIngest,
+		Summary: "Notify the VM's owner of an event, such as an AI reply finishing while they were away",
+		Request: models.IngestEventRequest{}, Status: http.StatusNoContent,
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/ingest/contexts", ID: "listContexts", Tag: "gateway", Security: securityIngest,
+		Summary:  "List the conversation contexts saved for the VM's owner",
+		Query:    []*openapi.Parameter{limit},
+		Response: models.ListContextSnapshotsResponse{},
+		Errors:   []int{bad, unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/ingest/contexts/:workspace/:session", ID: "getContext", Tag: "gateway", Security: securityIngest,
+		Summary:  "Get a saved conversation context with its data",
+		Response: models.ContextSnapshot{},
+		Errors:   []int{unauth, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPut, Path: "/api/v1/ingest/contexts/:workspace/:session", ID: "saveContext", Tag: "gateway", Security: securityIngest,
+		Summary: "Save a conversation context; the body is the gateway's JSON",
+		Request: json.RawMessage{}, Status: http.StatusNoContent,
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/ingest/backups", ID: "startBackup", Tag: "gateway", Security: securityIngest,
+		Summary: "Record a pending backup and get a URL to upload it to",
+		Request: models.StartBackupRequest{}, Status: http.StatusCreated, Response: models.StartBackupResponse{},
+		Errors: []int{bad, unauth, tooLarge, http.StatusNotImplemented, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/ingest/backups/:id/complete", ID: "completeBackup", Tag: "gateway", Security: securityIngest,
+		Summary: "Mark an uploaded backup restorable",
+		Request: models.CompleteBackupRequest{}, Response: models.WorkspaceBackup{},
+		Errors: []int{bad, unauth, missing, tooLarge, http.StatusNotImplemented, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/ingest/backups/:id/download", ID: "downloadBackup", Tag: "gateway", Security: securityIngest,
+		Summary:  "Get a URL to download one of the VM owner's backups",
+		Response: models.BackupDownloadResponse{},
+		Errors:   []int{bad, unauth, missing, http.StatusNotImplemented, failed, timeout},
+	})
+
+	// Operators
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/vms", ID: "adminListVMs", Tag: "admin", Security: securityAdmin,
+		Summary: "List every user's VMs; terminated ones only with status=terminated",
+		Query: []*openapi.Parameter{
+			{Name: "user_id", In: "query", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "status", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []interface{}{models.VMStatusProvisioning, models.VMStatusRunning,
+				models.VMStatusSuspended, models.VMStatusError, models.VMStatusTerminating, models.VMStatusTerminated}}},
+			{Name: "labels", In: "query", Description: "Label selector, e.g. project=devtail,branch!=main", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "idle_for", In: "query", Description: "Only VMs without activity for this long, e.g. 30m", Schema: &openapi.Schema{Type: "string"}},
+		},
+		Response: models.ListVMsResponse{},
+		Errors:   []int{bad, unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/vms/:id", ID: "adminGetVM", Tag: "admin", Security: securityAdmin,
+		Summary:  "Get any user's VM",
+		Response: models.VM{},
+		Errors:   []int{unauth, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodDelete, Path: "/api/v1/admin/vms/:id", ID: "adminDeleteVM", Tag: "admin", Security: securityAdmin,
+		Summary: "Delete any user's VM, as deleteVM",
+		Query: []*openapi.Parameter{
+			{Name: "backup", In: "query", Description: "Back up every workspace before the machine is deleted", Schema: &openapi.Schema{Type: "boolean"}},
+			{Name: "immediate", In: "query", Description: "Skip the grace period", Schema: &openapi.Schema{Type: "boolean"}},
+		},
+		Status: http.StatusAccepted, Response: models.VM{},
+		Errors: []int{bad, unauth, missing, conflict, http.StatusNotImplemented, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/admin/vms/:id/retry", ID: "adminRetryJob", Tag: "admin", Security: securityAdmin,
+		Summary: "Provision a VM in error again, or delete a terminating VM's machine now",
+		Status:  http.StatusAccepted, Response: models.RetryJobResponse{},
+		Errors: []int{unauth, missing, conflict, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/admin/vms/:id/suspend", ID: "adminSuspendVM", Tag: "admin", Security: securityAdmin,
+		Summary: "Warn a running VM's clients and suspend it when the warning is over, unless a client keeps it running",
+		Request: models.SuspendVMRequest{}, OptionalRequest: true, Status: http.StatusAccepted, Response: models.SuspendVMResponse{},
+		Errors: []int{bad, unauth, missing, conflict, tooLarge, http.StatusNotImplemented, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/admin/reconcile", ID: "adminReconcile", Tag: "admin", Security: securityAdmin,
+		Summary:  "Fail VMs stuck provisioning, carry out due deletions and republish DNS records",
+		Response: models.ReconcileReport{},
+		Errors:   []int{unauth, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/watchdog", ID: "adminWatchdog", Tag: "admin", Security: securityAdmin,
+		Summary:  "List the VMs the watchdog found stuck provisioning at its last check, and what it did about them",
+		Response: models.WatchdogReport{},
+		Errors:   []int{unauth},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/provisioning", ID: "adminProvisioning", Tag: "admin", Security: securityAdmin,
+		Summary:  "Summarise how long each stage of the latest provisionings took, with p50 and p95, against the provisioning SLO",
+		Response: models.ProvisioningStats{},
+		Errors:   []int{unauth},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/pool", ID: "adminPool", Tag: "admin", Security: securityAdmin,
+		Summary:  "Count the warm pool's ready and provisioning VMs, and what the pool has done",
+		Response: models.PoolReport{},
+		Errors:   []int{unauth, failed},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/vms/:id/ssh", ID: "adminSSH", Tag: "admin", Security: securityAdmin,
+		Summary: "Open an interactive shell on a VM over a WebSocket",
+		Query: []*openapi.Parameter{
+			{Name: "cols", In: "query", Description: "Terminal width, 80 by default", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "rows", In: "query", Description: "Terminal height, 24 by default", Schema: &openapi.Schema{Type: "integer"}},
+		},
+		Status: http.StatusSwitchingProtocols,
+		Errors: []int{unauth, missing, conflict, http.StatusNotImplemented, failed},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/admin/vms/:id/console", ID: "adminConsole", Tag: "admin", Security: securityAdmin,
+		Summary:  "Get the provider's web console for a VM",
+		Response: models.ConsoleResponse{},
+		Errors:   []int{unauth, missing, conflict, http.StatusNotImplemented, http.StatusBadGateway, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/admin/vms/:id/logs", ID: "adminLogs", Tag: "admin", Security: securityAdmin,
+		Summary: "List the logs and panic reports a VM's gateway shipped, newest first",
+		Query: []*openapi.Parameter{
+			{Name: "kind", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []interface{}{models.LogKindLog, models.LogKindPanic}}},
+			{Name: "since", In: "query", Schema: &openapi.Schema{Type: "string", Format: "date-time"}},
+			limit,
+		},
+		Response: models.ListLogsResponse{},
+		Errors:   []int{bad, unauth, missing, failed, timeout},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodPost, Path: "/api/v1/admin/broadcasts", ID: "adminBroadcast", Tag: "admin", Security: securityAdmin,
+		Summary: "Announce something to the clients of every running VM, such as a maintenance window",
+		Request: models.BroadcastRequest{}, Response: models.BroadcastResponse{},
+		Errors: []int{bad, unauth, tooLarge, failed, timeout},
+	})
+
+	// Service
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/api/v1/openapi.json", ID: "getOpenAPI", Tag: "service",
+		Summary:  "This document",
+		Response: map[string]interface{}{},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/health", ID: "health", Tag: "service",
+		Summary:  "Reachability of each dependency; 503 when the database is down",
+		Response: health.Report{},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/metrics", ID: "metrics", Tag: "service",
+		Summary:  "Counts for monitoring, such as VMs stuck provisioning",
+		Response: models.Metrics{},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/healthz", ID: "liveness", Tag: "service",
+		Summary:  "Liveness: the process is serving HTTP",
+		Response: map[string]string{},
+	})
+	b.Add(openapi.Route{
+		Method: http.MethodGet, Path: "/readyz", ID: "readiness", Tag: "service",
+		Summary:  "Readiness: 503 while the database is down or the server is draining",
+		Response: health.Report{},
+	})
+
+	return b.Document()
+}
+
+// ServeOpenAPI answers with the OpenAPI document
+func ServeOpenAPI(doc *openapi.Document) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// ValidateRequests checks query parameters and JSON bodies against the
+// route's operation in doc before the handler runs, answering 400 with the
+// offending fields as respondBindError does. Routes missing from doc pass
+// through. Bodies are read whole, so Limits must run first.
+func ValidateRequests(doc *openapi.Document) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		op, ok := doc.Operation(c.Request.Method + " " + c.FullPath())
+		if !ok {
+			c.Next()
+			return
+		}
+
+		if err := doc.ValidateQuery(op, c.GetQuery); err != nil {
+			respondSchemaError(c, err)
+			return
+		}
+
+		if op.RequestBody != nil {
+			body, err := io.ReadAll(c.Request.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondTooLarge(c, tooLarge.Limit)
+				return
+			}
+			if err != nil {
+				respondError(c, http.StatusBadRequest, models.ErrorCodeInvalidRequest, "invalid request body")
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+			if err := doc.ValidateBody(op, body); err != nil {
+				respondSchemaError(c, err)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// respondSchemaError answers a request that does not match the document
+func respondSchemaError(c *gin.Context, err error) {
+	var fields openapi.FieldErrors
+	if !errors.As(err, &fields) {
+		respondError(c, http.StatusBadRequest, models.ErrorCodeInvalidRequest, "invalid request body")
+		return
+	}
+
+	details := make(map[string]interface{}, len(fields))
+	for path, rule := range fields {
+		details[path] = rule
+	}
+	respondErrorDetails(c, http.StatusBadRequest, models.ErrorCodeValidationFailed, "request validation failed",
+		map[string]interface{}{"fields": details})
+}
+
+func float(v float64) *float64 {
+	return &v
+}
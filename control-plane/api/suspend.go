@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/gin-gonic/gin"
+)
+
+// SuspendVM warns a running VM's clients and suspends it once the warning is
+// over, unless a client keeps it running
+func (h *AdminHandlers) SuspendVM(c *gin.Context) {
+	var req models.SuspendVMRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindError(c, err)
+			return
+		}
+	}
+
+	vm, ok := h.runningVM(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.vmManager.SuspendVM(c.Request.Context(), vm, &req)
+	if err != nil {
+		respondInternalError(c, err, "failed to suspend VM")
+		return
+	}
+
+	logger(c).Info().Str("vm_id", vm.ID).Str("suspend_id", resp.SuspendID).Str("remote_addr", c.ClientIP()).Msg("operator suspended VM")
+	c.JSON(http.StatusAccepted, resp)
+}
+
+// ResumeVM starts a suspended VM again
+func (h *Handlers) ResumeVM(c *gin.Context) {
+	vm, ok := h.activeVM(c)
+	if !ok {
+		return
+	}
+
+	vm, err := h.vmManager.ResumeVM(c.Request.Context(), vm)
+	if err != nil {
+		respondInternalError(c, err, "failed to resume VM")
+		return
+	}
+
+	c.JSON(http.StatusOK, vm)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,11 +11,30 @@ import (
 	"time"
 
 	"github.com/devtail/control-plane/api"
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/catalog"
+	"github.com/devtail/control-plane/internal/console"
+	"github.com/devtail/control-plane/internal/dns"
+	"github.com/devtail/control-plane/internal/health"
 	"github.com/devtail/control-plane/internal/hetzner"
+	"github.com/devtail/control-plane/internal/notify"
+	"github.com/devtail/control-plane/internal/objectstore"
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/provider/chaos"
+	"github.com/devtail/control-plane/internal/provider/docker"
+	"github.com/devtail/control-plane/internal/provider/libvirt"
+	"github.com/devtail/control-plane/internal/provider/mock"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/secrets"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/internal/store/postgres"
+	"github.com/devtail/control-plane/internal/store/sqlite"
 	"github.com/devtail/control-plane/internal/tailscale"
 	"github.com/devtail/control-plane/internal/vm"
+	"github.com/devtail/control-plane/pkg/models"
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
+	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -28,22 +48,45 @@ func main() {
 		Run:   run,
 	}
 
+	buildImageCmd := &cobra.Command{
+		Use:   "build-image",
+		Short: "Build a golden Hetzner image with the gateway and tools preinstalled",
+		Run:   buildImage,
+	}
+	buildImageCmd.Flags().String("name", "devtail-golden", "catalog name of the image")
+	buildImageCmd.Flags().String("server-type", "cx21", "server type to build on")
+	buildImageCmd.Flags().String("location", "nbg1", "location to build in")
+	buildImageCmd.Flags().String("base-image", hetzner.DefaultImage, "system image to start from")
+	buildImageCmd.Flags().Duration("timeout", 30*time.Minute, "maximum build time")
+	rootCmd.AddCommand(buildImageCmd)
+
+	rotateKeysCmd := &cobra.Command{
+		Use:   "rotate-keys",
+		Short: "Re-encrypt sensitive database columns with the current encryption key",
+		Run:   rotateKeys,
+	}
+	rotateKeysCmd.Flags().Bool("generate", false, "print a new random key for encryption.keys and exit")
+	rootCmd.AddCommand(rotateKeysCmd)
+	addOperationsCommands(rootCmd)
+
 	rootCmd.PersistentFlags().String("config", "", "config file path")
 	rootCmd.PersistentFlags().String("port", "8081", "HTTP port")
 	rootCmd.PersistentFlags().String("log-level", "info", "log level")
+	rootCmd.PersistentFlags().Bool("dev", false, "run locally with SQLite and mock provider and Tailscale clients, no cloud credentials needed")
 
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 	viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("dev", rootCmd.PersistentFlags().Lookup("dev"))
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal().Err(err).Msg("failed to execute command")
 	}
 }
 
-func run(cmd *cobra.Command, args []string) {
-	// Setup logging
-	setupLogging()
-
+// loadConfig reads the config file and applies defaults and environment
+// overrides
+func loadConfig() {
 	// Load configuration
 	if configFile := viper.GetString("config"); configFile != "" {
 		viper.SetConfigFile(configFile)
@@ -53,70 +96,277 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	// Set defaults
+	viper.SetDefault("database.driver", "postgres")
 	viper.SetDefault("database.url", "postgres://localhost/devtail?sslmode=disable")
+	viper.SetDefault("database.path", "devtail.db")
+	viper.SetDefault("database.max_open_conns", 25)
+	viper.SetDefault("database.max_idle_conns", 5)
+	viper.SetDefault("database.conn_max_lifetime", 30*time.Minute)
+	viper.SetDefault("database.conn_max_idle_time", 5*time.Minute)
+	viper.SetDefault("health.timeout", health.DefaultTimeout)
+	viper.SetDefault("http.timeout", 30*time.Second)
+	viper.SetDefault("http.delete_timeout", 2*time.Minute)
+	viper.SetDefault("http.broadcast_timeout", 2*time.Minute)
+	viper.SetDefault("http.reconcile_timeout", 5*time.Minute)
+	viper.SetDefault("http.max_body_bytes", 1<<20)
+	viper.SetDefault("provision.timeout", vm.DefaultProvisionTimeout)
+	viper.SetDefault("provision.attempts", vm.DefaultProvisionAttempts)
+	viper.SetDefault("provision.retry_delay", vm.DefaultProvisionRetryDelay)
+	viper.SetDefault("provision.poll_interval", vm.DefaultOutboxInterval)
+	viper.SetDefault("provision.slo", vm.DefaultProvisionSLO)
+	viper.SetDefault("watchdog.stuck_after", vm.DefaultStuckAfter)
+	viper.SetDefault("watchdog.retries", 1)
+	viper.SetDefault("watchdog.interval", vm.DefaultWatchdogInterval)
+	viper.SetDefault("suspend.idle_after", 0)
+	viper.SetDefault("suspend.warning", vm.DefaultSuspendWarning)
+	viper.SetDefault("suspend.interval", vm.DefaultSuspendInterval)
+	viper.SetDefault("suspend.resume_hint", vm.DefaultResumeHint)
+	viper.SetDefault("pool.size", 0)
+	viper.SetDefault("pool.interval", vm.DefaultPoolInterval)
+	viper.SetDefault("shutdown.drain_delay", 5*time.Second)
+	viper.SetDefault("catalog.source", "static")
+	viper.SetDefault("catalog.refresh_interval", catalog.DefaultRefreshInterval)
+	viper.SetDefault("provider.type", hetzner.Name)
 	viper.SetDefault("hetzner.ssh_key_id", 0)
+	viper.SetDefault("libvirt.uri", "qemu:///system")
+	viper.SetDefault("libvirt.storage_pool", "default")
+	viper.SetDefault("libvirt.network", "default")
+	viper.SetDefault("libvirt.os_variant", "ubuntu22.04")
+	viper.SetDefault("libvirt.location", "local")
+	viper.SetDefault("docker.image", "devtail/gateway:latest")
+	viper.SetDefault("docker.tailscale_image", "tailscale/tailscale:stable")
+	viper.SetDefault("docker.location", "local")
 	viper.SetDefault("hetzner.network_id", 0)
+	viper.SetDefault("hetzner.public_network", string(hetzner.PublicNetworkDualStack))
+	viper.SetDefault("dns.target", string(dns.TargetTailscale))
+	viper.SetDefault("dns.ttl", dns.DefaultTTL)
 	viper.SetDefault("gateway.url", "https://github.com/devtail/gateway/releases/latest/download/gateway-linux-amd64")
 	viper.SetDefault("callback.url", "http://localhost:8081/api/v1/callbacks/vm")
 	viper.SetDefault("websocket.base_url", "ws://localhost:8080")
+	viper.SetDefault("auth.token_ttl", auth.DefaultTokenTTL)
+	viper.SetDefault("gateway.port", "8080")
+	viper.SetDefault("ssh.user", console.DefaultUser)
+	viper.SetDefault("mock.gateway_ip", "127.0.0.1")
+	viper.SetDefault("mock.boot_delay", mock.DefaultBootDelay)
+	viper.SetDefault("backups.interval", 24*time.Hour)
+	viper.SetDefault("backups.keep", 7)
+	viper.SetDefault("deletion.grace_period", vm.DefaultDeletionGracePeriod)
+	viper.SetDefault("deletion.sweep_interval", vm.DefaultDeletionSweepInterval)
+	viper.SetDefault("retention.archive_after", vm.DefaultArchiveAfter)
+	viper.SetDefault("retention.purge_after", vm.DefaultPurgeAfter)
+	viper.SetDefault("retention.interval", vm.DefaultRetentionInterval)
+
+	// Development defaults need no database server or cloud accounts;
+	// the config file and environment still override them
+	if viper.GetBool("dev") {
+		viper.SetDefault("database.driver", "sqlite")
+		viper.SetDefault("database.path", "devtail-dev.db")
+		viper.SetDefault("provider.type", mock.Name)
+		viper.SetDefault("shutdown.drain_delay", 0)
+	}
 
 	// Environment variables
 	viper.AutomaticEnv()
+}
+
+func run(cmd *cobra.Command, args []string) {
+	// Setup logging
+	setupLogging()
+
+	loadConfig()
 
 	// Database connection
-	db, err := sql.Open("postgres", viper.GetString("database.url"))
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to connect to database")
-	}
-	defer db.Close()
+	vmStore, closeStore := openStore()
+	defer closeStore()
 
-	if err := db.Ping(); err != nil {
-		log.Fatal().Err(err).Msg("failed to ping database")
-	}
+	signer := newTokenSigner()
+	log.Info().Str("public_key", signer.PublicKey()).Msg("connect tokens enabled")
 
 	// Initialize clients
-	hetznerClient := hetzner.NewClient(
-		viper.GetString("hetzner.token"),
-		viper.GetInt64("hetzner.ssh_key_id"),
-		viper.GetInt64("hetzner.network_id"),
-	)
+	vmProvider, specCatalog := newProvider(signer)
+	tailscaleClient := newTailnet(vmProvider)
+	vmProvider = withChaos(vmProvider)
 
-	tailscaleClient := tailscale.NewClient(
-		viper.GetString("tailscale.api_key"),
-		viper.GetString("tailscale.tailnet"),
-	)
+	backups, backupStore := newBackupConfig()
+	notifier := newNotifier(vmStore)
 
 	// Initialize VM manager
-	vmManager := vm.NewManager(db, hetznerClient, tailscaleClient, vm.Config{
-		SSHPublicKey:     viper.GetString("ssh.public_key"),
-		GatewayURL:       viper.GetString("gateway.url"),
-		CallbackURL:      viper.GetString("callback.url"),
-		WebSocketBaseURL: viper.GetString("websocket.base_url"),
+	vmManager := vm.NewManager(vmStore, vmProvider, tailscaleClient, vm.Config{
+		SSHPublicKey:        viper.GetString("ssh.public_key"),
+		GatewayURL:          viper.GetString("gateway.url"),
+		CallbackURL:         viper.GetString("callback.url"),
+		WebSocketBaseURL:    viper.GetString("websocket.base_url"),
+		TokenSigner:         signer,
+		GatewayPort:         viper.GetString("gateway.port"),
+		Catalog:             specCatalog,
+		DNS:                 newDNSRecords(),
+		Notifier:            notifier,
+		LogIngestURL:        viper.GetString("logs.ingest_url"),
+		ContextSyncURL:      viper.GetString("contexts.sync_url"),
+		ActivityURL:         viper.GetString("activity.ingest_url"),
+		EventsURL:           viper.GetString("events.ingest_url"),
+		Backups:             backups,
+		ProvisionTimeout:    viper.GetDuration("provision.timeout"),
+		ProvisionAttempts:   viper.GetInt("provision.attempts"),
+		ProvisionRetryDelay: viper.GetDuration("provision.retry_delay"),
+		ProvisionSLO:        viper.GetDuration("provision.slo"),
+		Watchdog: vm.WatchdogConfig{
+			StuckAfter: viper.GetDuration("watchdog.stuck_after"),
+			Retries:    viper.GetInt("watchdog.retries"),
+		},
+		Suspend: vm.SuspendConfig{
+			IdleAfter:  viper.GetDuration("suspend.idle_after"),
+			Warning:    viper.GetDuration("suspend.warning"),
+			ResumeHint: viper.GetString("suspend.resume_hint"),
+		},
+		Pool: vm.PoolConfig{
+			Size: viper.GetInt("pool.size"),
+			Spec: models.VMSpec{
+				Type:     viper.GetString("pool.spec.type"),
+				Location: viper.GetString("pool.spec.location"),
+				DiskSize: viper.GetInt("pool.spec.disk_size"),
+				Image:    viper.GetString("pool.spec.image"),
+			},
+		},
+		DeletionGracePeriod: viper.GetDuration("deletion.grace_period"),
+		Retention: vm.RetentionPolicy{
+			ArchiveAfter: viper.GetDuration("retention.archive_after"),
+			PurgeAfter:   viper.GetDuration("retention.purge_after"),
+		},
 	})
 
+	// Provisioning runs from the operations outbox, so work recorded before
+	// a restart is picked up again, and the watchdog steps in when it gets
+	// stuck. Idle VMs are suspended after their clients are warned, and the
+	// warm pool keeps VMs ready for CreateVM to hand out. Deleted VMs keep
+	// their machine until the grace period ends, and their record until
+	// retention removes it. Notifications are delivered in the background
+	// too, so a slow mail server holds up nothing.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if notifier != nil {
+		go notifier.Run(background)
+	}
+	go vmManager.RunOutbox(background, viper.GetDuration("provision.poll_interval"))
+	go vmManager.RunWatchdog(background, viper.GetDuration("watchdog.interval"))
+	go vmManager.RunSuspender(background, viper.GetDuration("suspend.interval"))
+	go vmManager.RunPool(background, viper.GetDuration("pool.interval"))
+	go vmManager.RunDeletions(background, viper.GetDuration("deletion.sweep_interval"))
+	go vmManager.RunRetention(background, viper.GetDuration("retention.interval"))
+
 	// Initialize handlers
-	handlers := api.NewHandlers(vmManager)
+	checks := []health.Check{
+		{Name: "database", Critical: true, Check: vmStore.Ping},
+		{Name: vmProvider.Name(), Check: vmProvider.Ping},
+		{Name: "tailscale", Check: tailscaleClient.Ping},
+	}
+	if backupStore != nil {
+		checks = append(checks, health.Check{Name: "backups", Check: backupStore.Ping})
+	}
+	checker := health.NewChecker("control-plane", viper.GetDuration("health.timeout"), checks...)
+	handlers := api.NewHandlers(vmManager, specCatalog, checker)
+	adminHandlers := api.NewAdminHandlers(vmManager, newSSHConsole())
 
 	// Setup routes
 	router := gin.New()
 	router.Use(gin.Recovery())
+	router.Use(api.RequestID())
 	router.Use(ginLogger())
 
-	// API routes
-	v1 := router.Group("/api/v1")
+	// API routes. Requests are checked against the OpenAPI document, which
+	// clients can fetch from /api/v1/openapi.json.
+	spec := api.OpenAPI()
+	v1 := router.Group("/api/v1", api.Limits(api.RouteLimit{
+		MaxBodyBytes: viper.GetInt64("http.max_body_bytes"),
+		Timeout:      viper.GetDuration("http.timeout"),
+	}, map[string]api.RouteLimit{
+		// Deleting immediately waits for the provider to tear the machine
+		// down, as suspending without a warning and resuming wait for it to
+		// stop and start
+		"DELETE /api/v1/vms/:id":                          {Timeout: viper.GetDuration("http.delete_timeout")},
+		"DELETE /api/v1/admin/vms/:id":                    {Timeout: viper.GetDuration("http.delete_timeout")},
+		"POST /api/v1/admin/vms/:id/retry":                {Timeout: viper.GetDuration("http.delete_timeout")},
+		"POST /api/v1/admin/vms/:id/suspend":              {Timeout: viper.GetDuration("http.delete_timeout")},
+		"POST /api/v1/vms/:id/resume":                     {Timeout: viper.GetDuration("http.delete_timeout")},
+		"PUT /api/v1/ingest/contexts/:workspace/:session": {MaxBodyBytes: api.MaxContextBody},
+		// The SSH proxy streams for as long as the operator is connected
+		"GET /api/v1/admin/vms/:id/ssh": {Timeout: -1},
+		// Broadcasts wait for every gateway, a few at a time
+		"POST /api/v1/admin/broadcasts": {Timeout: viper.GetDuration("http.broadcast_timeout")},
+		// Reconciling deletes due machines one by one
+		"POST /api/v1/admin/reconcile": {Timeout: viper.GetDuration("http.reconcile_timeout")},
+	}), api.ValidateRequests(spec))
 	{
+		v1.GET("/openapi.json", api.ServeOpenAPI(spec))
 		v1.POST("/vms", handlers.CreateVM)
+		v1.GET("/vms", handlers.ListVMs)
+		v1.GET("/gateways", handlers.ListGateways)
+		v1.GET("/catalog", handlers.GetCatalog)
+		v1.GET("/backups", handlers.ListBackups)
+		v1.POST("/notifications/targets", handlers.RegisterNotificationTarget)
+		v1.GET("/notifications/targets", handlers.ListNotificationTargets)
+		v1.DELETE("/notifications/targets/:id", handlers.DeleteNotificationTarget)
+		v1.POST("/notifications/test", handlers.TestNotification)
 		v1.GET("/vms/:id", handlers.GetVM)
+		v1.GET("/vms/:id/activity", handlers.GetActivity)
 		v1.DELETE("/vms/:id", handlers.DeleteVM)
+		v1.POST("/vms/:id/deletion/cancel", handlers.CancelDeletion)
+		v1.POST("/vms/:id/rebuild", handlers.RebuildVM)
+		v1.POST("/vms/:id/resume", handlers.ResumeVM)
+		v1.PUT("/vms/:id/labels", handlers.UpdateLabels)
+		v1.POST("/vms/:id/connect", handlers.RefreshConnectURL)
+		v1.POST("/vms/:id/token/rotate", handlers.RotateToken)
+		v1.POST("/vms/:id/token/revoke", handlers.RevokeToken)
 		v1.POST("/callbacks/vm", handlers.VMCallback)
+		v1.POST("/ingest/logs", handlers.IngestLogs)
+		v1.POST("/ingest/activity", handlers.IngestActivity)
+		v1.POST("/ingest/events", handlers.IngestEvent)
+		v1.GET("/ingest/contexts", handlers.ListContexts)
+		v1.GET("/ingest/contexts/:workspace/:session", handlers.GetContext)
+		v1.PUT("/ingest/contexts/:workspace/:session", handlers.SaveContext)
+		v1.POST("/ingest/backups", handlers.StartBackup)
+		v1.POST("/ingest/backups/:id/complete", handlers.CompleteBackup)
+		v1.GET("/ingest/backups/:id/download", handlers.DownloadBackup)
+	}
+
+	// Operator routes reach every user's VMs, so they only exist with a token
+	if token := viper.GetString("admin.token"); token != "" {
+		admin := v1.Group("/admin", api.AdminAuth(token))
+		admin.GET("/vms", adminHandlers.ListVMs)
+		admin.GET("/vms/:id", adminHandlers.GetVM)
+		admin.DELETE("/vms/:id", adminHandlers.DeleteVM)
+		admin.POST("/vms/:id/retry", adminHandlers.RetryJob)
+		admin.POST("/vms/:id/suspend", adminHandlers.SuspendVM)
+		admin.GET("/vms/:id/ssh", adminHandlers.SSH)
+		admin.POST("/vms/:id/console", adminHandlers.Console)
+		admin.GET("/vms/:id/logs", adminHandlers.Logs)
+		admin.POST("/broadcasts", adminHandlers.Broadcast)
+		admin.POST("/reconcile", adminHandlers.Reconcile)
+		admin.GET("/watchdog", adminHandlers.Watchdog)
+		admin.GET("/provisioning", adminHandlers.Provisioning)
+		admin.GET("/pool", adminHandlers.Pool)
+	} else {
+		log.Info().Msg("no admin.token configured, operator API disabled")
 	}
 
 	router.GET("/health", handlers.HealthCheck)
+	router.GET("/healthz", handlers.Liveness)
+	router.GET("/readyz", handlers.Readiness)
+	router.GET("/metrics", handlers.Metrics)
+
+	var routes []string
+	for _, route := range router.Routes() {
+		routes = append(routes, route.Method+" "+route.Path)
+	}
+	if missing := spec.Undocumented(routes); len(missing) > 0 {
+		log.Warn().Strs("routes", missing).Msg("routes missing from the OpenAPI document")
+	}
 
 	// Start server
 	srv := &http.Server{
-		Addr:    ":" + viper.GetString("port"),
-		Handler: router,
+		Addr:              ":" + viper.GetString("port"),
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
 	}
 
 	go func() {
@@ -131,6 +381,13 @@ func run(cmd *cobra.Command, args []string) {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// Fail readiness and keep serving briefly so load balancers drain us
+	checker.SetDraining()
+	if delay := viper.GetDuration("shutdown.drain_delay"); delay > 0 {
+		log.Info().Dur("delay", delay).Msg("draining before shutdown")
+		time.Sleep(delay)
+	}
+
 	log.Info().Msg("shutting down server")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -141,6 +398,507 @@ func run(cmd *cobra.Command, args []string) {
 	}
 }
 
+// buildImage provisions a Hetzner server, runs the full cloud-init install,
+// snapshots it as a golden image and prints how to offer it. VMs then boot
+// it by name, skipping the install.
+func buildImage(cmd *cobra.Command, args []string) {
+	setupLogging()
+	loadConfig()
+
+	flags := cmd.Flags()
+	name, _ := flags.GetString("name")
+	serverType, _ := flags.GetString("server-type")
+	location, _ := flags.GetString("location")
+	baseImage, _ := flags.GetString("base-image")
+	timeout, _ := flags.GetDuration("timeout")
+
+	userData, err := vm.GenerateImageCloudInit(vm.CloudInitData{
+		SSHPublicKey: viper.GetString("ssh.public_key"),
+		GatewayURL:   viper.GetString("gateway.url"),
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to generate cloud-init")
+	}
+
+	hetznerClient := hetzner.NewClient(
+		viper.GetString("hetzner.token"),
+		viper.GetInt64("hetzner.ssh_key_id"),
+		viper.GetInt64("hetzner.network_id"),
+		// The build server downloads everything over the internet
+		hetzner.PublicNetworkDualStack,
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Str("image", name).Str("base_image", baseImage).Msg("building golden image, this takes several minutes")
+
+	image, err := hetznerClient.BuildImage(ctx, hetzner.BuildImageOpts{
+		Name:       name,
+		ServerType: serverType,
+		Location:   location,
+		BaseImage:  baseImage,
+		UserData:   userData,
+		Timeout:    timeout,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("image build failed")
+	}
+
+	fmt.Printf("Built image %d, labeled %s=%s.\n", image.ID, hetzner.ImageLabel, name)
+	fmt.Printf("With catalog.source hetzner it is offered automatically; otherwise add to catalog.images:\n")
+	fmt.Printf("  - {name: %s, golden: true}\n", name)
+}
+
+// openStore connects to the database selected by database.driver: Postgres
+// (database.url) or, for single-node installs, a SQLite file (database.path)
+func openStore() (store.Store, func()) {
+	switch driver := viper.GetString("database.driver"); driver {
+	case "postgres":
+		db, err := sql.Open("postgres", viper.GetString("database.url"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to database")
+		}
+
+		configurePool(db)
+
+		if err := db.Ping(); err != nil {
+			log.Fatal().Err(err).Msg("failed to ping database")
+		}
+		return postgres.New(db, newKeyring()), func() { db.Close() }
+
+	case "sqlite":
+		path := viper.GetString("database.path")
+		s, err := sqlite.Open(context.Background(), path, newKeyring())
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("failed to open sqlite database")
+		}
+		log.Info().Str("path", path).Msg("using sqlite database")
+		return s, func() { s.Close() }
+
+	default:
+		log.Fatal().Str("driver", driver).Msg("unsupported database.driver, use postgres or sqlite")
+		return nil, nil
+	}
+}
+
+// newKeyring loads the keys that seal sensitive columns, newest first, from
+// encryption.keys or, written by a KMS or secret manager agent,
+// encryption.key_file. Without keys the columns are stored in plaintext.
+func newKeyring() *secrets.Keyring {
+	var keys []secrets.Key
+
+	var configured []struct {
+		ID  string `mapstructure:"id"`
+		Key string `mapstructure:"key"`
+	}
+	if err := viper.UnmarshalKey("encryption.keys", &configured); err != nil {
+		log.Fatal().Err(err).Msg("invalid encryption.keys")
+	}
+	for _, c := range configured {
+		key, err := secrets.ParseKey(c.ID, c.Key)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid encryption.keys")
+		}
+		keys = append(keys, key)
+	}
+
+	if path := viper.GetString("encryption.key_file"); path != "" {
+		fileKeys, err := secrets.ReadKeyFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read encryption.key_file")
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	if len(keys) == 0 {
+		if !viper.GetBool("dev") {
+			log.Warn().Msg("no encryption.keys configured, sensitive columns are stored in plaintext")
+		}
+		return nil
+	}
+
+	keyring, err := secrets.NewKeyring(keys...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid encryption keys")
+	}
+	log.Info().Str("key_id", keys[0].ID).Int("keys", len(keys)).Msg("column encryption enabled")
+	return keyring
+}
+
+// rotateKeys re-encrypts sensitive columns with the current key, after a
+// new key was put first in encryption.keys. Older keys can be removed once
+// it has run.
+func rotateKeys(cmd *cobra.Command, args []string) {
+	if generate, _ := cmd.Flags().GetBool("generate"); generate {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate key")
+		}
+		fmt.Println(key)
+		return
+	}
+
+	setupLogging()
+	loadConfig()
+
+	vmStore, closeStore := openStore()
+	defer closeStore()
+
+	rotated, err := vmStore.RotateSecrets(cmd.Context())
+	if err != nil {
+		log.Fatal().Err(err).Int("rotated", rotated).Msg("key rotation failed")
+	}
+	fmt.Printf("Re-encrypted %d values with the current key.\n", rotated)
+}
+
+// newProvider creates the VM provider selected by provider.type (Hetzner
+// Cloud, a self-hosted libvirt host, containers on a Docker host or the
+// in-memory mock) and the catalog of specs it accepts
+func newProvider(signer *auth.Signer) (provider.Provider, *catalog.Service) {
+	switch kind := viper.GetString("provider.type"); kind {
+	case hetzner.Name:
+		publicNet, err := hetzner.ParsePublicNetwork(viper.GetString("hetzner.public_network"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid hetzner.public_network")
+		}
+		if publicNet == hetzner.PublicNetworkNone && viper.GetInt64("hetzner.network_id") == 0 {
+			log.Fatal().Msg("hetzner.public_network none requires hetzner.network_id")
+		}
+
+		client := hetzner.NewClient(
+			viper.GetString("hetzner.token"),
+			viper.GetInt64("hetzner.ssh_key_id"),
+			viper.GetInt64("hetzner.network_id"),
+			publicNet,
+		)
+		return client, newCatalog(nil, client.Catalog)
+
+	case libvirt.Name:
+		if viper.GetString("libvirt.base_image") == "" {
+			log.Fatal().Msg("libvirt.base_image is required with provider.type libvirt")
+		}
+
+		client := libvirt.New(libvirt.Config{
+			URI:         viper.GetString("libvirt.uri"),
+			BaseImage:   viper.GetString("libvirt.base_image"),
+			Images:      viper.GetStringMapString("libvirt.images"),
+			StoragePool: viper.GetString("libvirt.storage_pool"),
+			Network:     viper.GetString("libvirt.network"),
+			OSVariant:   viper.GetString("libvirt.os_variant"),
+			Location:    viper.GetString("libvirt.location"),
+			ServerTypes: catalogOptions[models.ServerTypeOption]("libvirt.server_types"),
+		})
+		log.Info().Str("uri", viper.GetString("libvirt.uri")).Msg("provisioning VMs with libvirt")
+		return client, newCatalog(client.Catalog(), nil)
+
+	case docker.Name:
+		client := docker.New(docker.Config{
+			Host:           viper.GetString("docker.host"),
+			Image:          viper.GetString("docker.image"),
+			Images:         viper.GetStringMapString("docker.images"),
+			TailscaleImage: viper.GetString("docker.tailscale_image"),
+			AuthPublicKey:  signer.PublicKey(),
+			GatewayPort:    viper.GetString("gateway.port"),
+			Location:       viper.GetString("docker.location"),
+			ServerTypes:    catalogOptions[models.ServerTypeOption]("docker.server_types"),
+		})
+		log.Info().Str("image", viper.GetString("docker.image")).Msg("provisioning VMs as docker containers")
+		return client, newCatalog(client.Catalog(), nil)
+
+	case mock.Name:
+		client := mock.New(mock.Config{
+			GatewayIP: viper.GetString("mock.gateway_ip"),
+			BootDelay: viper.GetDuration("mock.boot_delay"),
+		})
+		log.Warn().Str("gateway_ip", viper.GetString("mock.gateway_ip")).Msg("using the mock provider, VMs are not real")
+		return client, newCatalog(client.Catalog(), nil)
+
+	default:
+		log.Fatal().Str("type", kind).Msg("unsupported provider.type, use hetzner, libvirt, docker or mock")
+		return nil, nil
+	}
+}
+
+// newTailnet returns the Tailscale API client, or the mock provider's fake
+// tailnet, which is the only one its machines can join
+func newTailnet(vmProvider provider.Provider) vm.Tailnet {
+	if mockProvider, ok := vmProvider.(*mock.Provider); ok {
+		return mockProvider.Tailnet()
+	}
+	return tailscale.NewClient(
+		viper.GetString("tailscale.api_key"),
+		viper.GetString("tailscale.tailnet"),
+	)
+}
+
+// withChaos wraps the provider with the random failures and delays set by
+// chaos.failure_rate and chaos.max_delay, for exercising retry paths
+func withChaos(next provider.Provider) provider.Provider {
+	config := chaos.Config{
+		FailureRate: viper.GetFloat64("chaos.failure_rate"),
+		MaxDelay:    viper.GetDuration("chaos.max_delay"),
+		Seed:        viper.GetInt64("chaos.seed"),
+	}
+	if config.FailureRate == 0 && config.MaxDelay == 0 {
+		return next
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid chaos configuration")
+	}
+
+	log.Warn().
+		Str("provider", next.Name()).
+		Float64("failure_rate", config.FailureRate).
+		Dur("max_delay", config.MaxDelay).
+		Msg("CHAOS MODE: injecting provider faults, do not use in production")
+	return chaos.Wrap(next, config)
+}
+
+// catalogOptions reads a list of catalog entries (server types, images)
+// from the config, using the catalog's JSON field names
+func catalogOptions[T any](key string) []T {
+	var options []T
+	if err := viper.UnmarshalKey(key, &options, func(c *mapstructure.DecoderConfig) {
+		c.TagName = "json"
+	}); err != nil {
+		log.Fatal().Err(err).Str("key", key).Msg("invalid catalog options")
+	}
+	return options
+}
+
+// newDNSRecords sets up VM DNS records with dns.provider (cloudflare or
+// route53), or returns nil when no provider is configured
+func newDNSRecords() *dns.Records {
+	var provider dns.Provider
+	switch kind := viper.GetString("dns.provider"); kind {
+	case "":
+		return nil
+	case "cloudflare":
+		provider = dns.NewCloudflare(
+			viper.GetString("dns.cloudflare.api_token"),
+			viper.GetString("dns.cloudflare.zone_id"),
+		)
+	case "route53":
+		provider = dns.NewRoute53(
+			viper.GetString("dns.route53.access_key_id"),
+			viper.GetString("dns.route53.secret_access_key"),
+			viper.GetString("dns.route53.hosted_zone_id"),
+		)
+	default:
+		log.Fatal().Str("provider", kind).Msg("unsupported dns.provider, use cloudflare or route53")
+	}
+
+	domain := viper.GetString("dns.domain")
+	if domain == "" {
+		log.Fatal().Msg("dns.domain is required with dns.provider")
+	}
+	target, err := dns.ParseTarget(viper.GetString("dns.target"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid dns.target")
+	}
+
+	log.Info().Str("provider", provider.Name()).Str("domain", domain).Msg("publishing VM DNS records")
+	return dns.NewRecords(provider, dns.Config{
+		Domain: domain,
+		Target: target,
+		TTL:    viper.GetInt("dns.ttl"),
+	})
+}
+
+// newNotifier sets up the notifiers under notifications, each delivering
+// the events in its events list or every event, or returns nil when none
+// is configured
+func newNotifier(targets notify.Targets) *notify.Dispatcher {
+	dispatcher := notify.NewDispatcher(targets)
+	add := func(key string, notifier notify.Notifier) {
+		var events []models.NotificationEvent
+		for _, event := range viper.GetStringSlice("notifications." + key + ".events") {
+			switch kind := models.NotificationEvent(event); kind {
+			case models.NotifyVMReady, models.NotifyProvisioningFailed, models.NotifyAITaskFinished:
+				events = append(events, kind)
+			default:
+				log.Fatal().Str("event", event).Msgf("unknown event in notifications.%s.events", key)
+			}
+		}
+		dispatcher.Add(notifier, events)
+		log.Info().Str("notifier", notifier.Name()).Strs("events", viper.GetStringSlice("notifications."+key+".events")).Msg("notifications enabled")
+	}
+
+	if webhook := viper.GetString("notifications.slack.webhook_url"); webhook != "" {
+		add("slack", notify.NewSlack(webhook))
+	}
+
+	if host := viper.GetString("notifications.smtp.host"); host != "" {
+		smtp, err := notify.NewSMTP(notify.SMTPConfig{
+			Host:     host,
+			Port:     viper.GetInt("notifications.smtp.port"),
+			Username: viper.GetString("notifications.smtp.username"),
+			Password: viper.GetString("notifications.smtp.password"),
+			From:     viper.GetString("notifications.smtp.from"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid notifications.smtp")
+		}
+		add("smtp", smtp)
+	}
+
+	if path := viper.GetString("notifications.fcm.credentials_file"); path != "" {
+		credentials, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read notifications.fcm.credentials_file")
+		}
+		fcm, err := notify.NewFCM(credentials)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid notifications.fcm.credentials_file")
+		}
+		add("fcm", fcm)
+	}
+
+	if path := viper.GetString("notifications.apns.key_file"); path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read notifications.apns.key_file")
+		}
+		apns, err := notify.NewAPNs(notify.APNsConfig{
+			Key:     key,
+			KeyID:   viper.GetString("notifications.apns.key_id"),
+			TeamID:  viper.GetString("notifications.apns.team_id"),
+			Topic:   viper.GetString("notifications.apns.topic"),
+			Sandbox: viper.GetBool("notifications.apns.sandbox"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid notifications.apns")
+		}
+		add("apns", apns)
+	}
+
+	if len(dispatcher.Notifiers()) == 0 {
+		return nil
+	}
+	return dispatcher
+}
+
+// newBackupConfig configures workspace backups when a bucket is set. The
+// bucket is returned too, for the health check.
+func newBackupConfig() (*vm.BackupConfig, *objectstore.S3) {
+	bucket := viper.GetString("backups.s3.bucket")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	endpoint := viper.GetString("backups.s3.endpoint")
+	if endpoint == "" {
+		log.Fatal().Msg("backups.s3.endpoint is required with backups.s3.bucket")
+	}
+	backupURL := viper.GetString("backups.url")
+	if backupURL == "" {
+		log.Fatal().Msg("backups.url is required with backups.s3.bucket")
+	}
+
+	s3 := objectstore.NewS3(objectstore.Config{
+		Endpoint:        endpoint,
+		Region:          viper.GetString("backups.s3.region"),
+		Bucket:          bucket,
+		AccessKeyID:     viper.GetString("backups.s3.access_key_id"),
+		SecretAccessKey: viper.GetString("backups.s3.secret_access_key"),
+	})
+
+	log.Info().Str("bucket", bucket).Int("keep", viper.GetInt("backups.keep")).Msg("workspace backups enabled")
+	return &vm.BackupConfig{
+		Store:    s3,
+		URL:      backupURL,
+		Prefix:   viper.GetString("backups.prefix"),
+		Interval: viper.GetDuration("backups.interval"),
+		Keep:     viper.GetInt("backups.keep"),
+	}, s3
+}
+
+// newSSHConsole loads the key the SSH proxy logs in to VMs with. Without
+// ssh.private_key_file the proxy is disabled.
+func newSSHConsole() *console.SSH {
+	path := viper.GetString("ssh.private_key_file")
+	if path == "" {
+		return nil
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read ssh.private_key_file")
+	}
+
+	ssh, err := console.NewSSH(console.Config{
+		User:       viper.GetString("ssh.user"),
+		PrivateKey: key,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ssh.private_key_file")
+	}
+	return ssh
+}
+
+// newCatalog builds the VM spec catalog over base (nil for the default
+// catalog). With catalog.source "hetzner" the server types and locations are
+// fetched from the Hetzner API and cached.
+func newCatalog(base *models.Catalog, fetch catalog.FetchFunc) *catalog.Service {
+	config := catalog.Config{
+		Base:            base,
+		ServerTypes:     viper.GetStringSlice("catalog.server_types"),
+		Locations:       viper.GetStringSlice("catalog.locations"),
+		DiskSizes:       viper.GetIntSlice("catalog.disk_sizes"),
+		Images:          catalogOptions[models.ImageOption]("catalog.images"),
+		RefreshInterval: viper.GetDuration("catalog.refresh_interval"),
+	}
+
+	switch source := viper.GetString("catalog.source"); source {
+	case "static":
+		return catalog.NewService(config, nil)
+	case "hetzner":
+		if fetch == nil {
+			log.Fatal().Msg("catalog.source hetzner requires provider.type hetzner")
+		}
+		return catalog.NewService(config, fetch)
+	default:
+		log.Fatal().Str("source", source).Msg("unsupported catalog.source, use static or hetzner")
+		return nil
+	}
+}
+
+// configurePool applies the database.* pool settings. The defaults suit a
+// single control plane instance against a small Postgres server.
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(viper.GetInt("database.max_open_conns"))
+	db.SetMaxIdleConns(viper.GetInt("database.max_idle_conns"))
+	db.SetConnMaxLifetime(viper.GetDuration("database.conn_max_lifetime"))
+	db.SetConnMaxIdleTime(viper.GetDuration("database.conn_max_idle_time"))
+}
+
+// newTokenSigner loads the connect token signing key. Development setups may
+// run without one; a random key is used and tokens stop verifying on restart.
+func newTokenSigner() *auth.Signer {
+	ttl := viper.GetDuration("auth.token_ttl")
+
+	encoded := viper.GetString("auth.signing_key")
+	if encoded == "" {
+		if os.Getenv("CONTROL_PLANE_ENV") != "development" && !viper.GetBool("dev") {
+			log.Fatal().Msg("auth.signing_key is required outside development")
+		}
+
+		key, err := auth.GenerateKey()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to generate signing key")
+		}
+		log.Warn().Msg("no auth.signing_key configured, using a temporary key")
+		return auth.NewSigner(key, ttl)
+	}
+
+	key, err := auth.ParsePrivateKey(encoded)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid auth.signing_key")
+	}
+	return auth.NewSigner(key, ttl)
+}
+
 func setupLogging() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
@@ -169,6 +927,7 @@ func ginLogger() gin.HandlerFunc {
 		}
 
 		log.Info().
+			Str("request_id", requestid.FromContext(c.Request.Context())).
 			Str("method", c.Request.Method).
 			Str("path", path).
 			Int("status", c.Writer.Status()).
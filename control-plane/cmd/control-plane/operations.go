@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// adminTokenEnv holds the operator token for the subcommands that call the
+// admin API, when it is not passed with --admin-token
+const adminTokenEnv = "DEVTAIL_ADMIN_TOKEN"
+
+// addOperationsCommands adds the subcommands operators use for routine
+// tasks. They call the admin API of a running control plane, so they work
+// the same against any database and provider.
+func addOperationsCommands(rootCmd *cobra.Command) {
+	vmCmd := &cobra.Command{
+		Use:   "vm",
+		Short: "List, inspect and delete any user's VMs",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List VMs, newest first; terminated ones only with --status terminated",
+		Args:  cobra.NoArgs,
+		RunE:  listVMs,
+	}
+	listCmd.Flags().String("user", "", "only this user's VMs")
+	listCmd.Flags().String("status", "", "only VMs with this status")
+	listCmd.Flags().String("labels", "", "label selector, e.g. project=devtail,branch!=main")
+	listCmd.Flags().Bool("json", false, "print the API response")
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect <vm-id>",
+		Short: "Print a VM's record",
+		Args:  cobra.ExactArgs(1),
+		RunE:  inspectVM,
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <vm-id>",
+		Short: "Delete a VM after the grace period, as its owner would",
+		Args:  cobra.ExactArgs(1),
+		RunE:  deleteVM,
+	}
+	deleteCmd.Flags().Bool("backup", false, "back up every workspace before the machine is deleted")
+	deleteCmd.Flags().Bool("immediate", false, "skip the grace period")
+
+	vmCmd.AddCommand(listCmd, inspectCmd, deleteCmd)
+
+	jobsCmd := &cobra.Command{
+		Use:   "jobs",
+		Short: "Manage the provisioning and deletion jobs of VMs",
+	}
+	jobsCmd.AddCommand(&cobra.Command{
+		Use:   "retry <vm-id>",
+		Short: "Provision a VM in error again, or delete a terminating VM's machine now",
+		Args:  cobra.ExactArgs(1),
+		RunE:  retryJob,
+	})
+
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Fail VMs stuck provisioning, carry out due deletions and republish DNS records",
+		Args:  cobra.NoArgs,
+		RunE:  reconcile,
+	}
+
+	watchdogCmd := &cobra.Command{
+		Use:   "watchdog",
+		Short: "Show the VMs the watchdog found stuck provisioning at its last check",
+		Args:  cobra.NoArgs,
+		RunE:  watchdog,
+	}
+
+	provisioningCmd := &cobra.Command{
+		Use:   "provisioning",
+		Short: "Show how long each stage of the latest provisionings took",
+		Args:  cobra.NoArgs,
+		RunE:  provisioning,
+	}
+
+	for _, cmd := range []*cobra.Command{vmCmd, jobsCmd, reconcileCmd, watchdogCmd, provisioningCmd} {
+		cmd.PersistentFlags().String("url", "", "control plane URL (default http://localhost:<port>)")
+		cmd.PersistentFlags().String("admin-token", "", "operator token (default $"+adminTokenEnv+", then admin.token from --config)")
+		cmd.PersistentFlags().Duration("timeout", 5*time.Minute, "maximum time to wait for the control plane")
+		rootCmd.AddCommand(cmd)
+	}
+}
+
+func listVMs(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	query := url.Values{}
+	for param, flag := range map[string]string{"user_id": "user", "status": "status", "labels": "labels"} {
+		if v, _ := flags.GetString(flag); v != "" {
+			query.Set(param, v)
+		}
+	}
+
+	var resp models.ListVMsResponse
+	if err := adminCall(cmd, http.MethodGet, "/vms?"+query.Encode(), http.StatusOK, &resp); err != nil {
+		return err
+	}
+
+	if asJSON, _ := flags.GetBool("json"); asJSON {
+		return printJSON(resp)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tSTATUS\tTYPE\tLOCATION\tTAILSCALE IP\tCREATED")
+	for _, vm := range resp.VMs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", vm.ID, vm.UserID, vm.Status, vm.Spec.Type, vm.Spec.Location,
+			orDash(vm.TailscaleIP), vm.CreatedAt.Local().Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func inspectVM(cmd *cobra.Command, args []string) error {
+	var vm models.VM
+	if err := adminCall(cmd, http.MethodGet, "/vms/"+url.PathEscape(args[0]), http.StatusOK, &vm); err != nil {
+		return err
+	}
+	return printJSON(vm)
+}
+
+func deleteVM(cmd *cobra.Command, args []string) error {
+	query := url.Values{}
+	for _, flag := range []string{"backup", "immediate"} {
+		if v, _ := cmd.Flags().GetBool(flag); v {
+			query.Set(flag, "true")
+		}
+	}
+
+	var vm models.VM
+	if err := adminCall(cmd, http.MethodDelete, "/vms/"+url.PathEscape(args[0])+"?"+query.Encode(), http.StatusAccepted, &vm); err != nil {
+		return err
+	}
+
+	switch {
+	case vm.Status == models.VMStatusTerminated:
+		fmt.Printf("VM %s deleted.\n", vm.ID)
+	case vm.DeleteAt != nil && vm.BackupOnDelete:
+		fmt.Printf("VM %s is terminating; its machine is deleted after %s, once its workspaces are backed up.\n",
+			vm.ID, vm.DeleteAt.Local().Format(time.DateTime))
+	case vm.DeleteAt != nil:
+		fmt.Printf("VM %s is terminating; its machine is deleted after %s.\n", vm.ID, vm.DeleteAt.Local().Format(time.DateTime))
+	default:
+		fmt.Printf("VM %s is %s.\n", vm.ID, vm.Status)
+	}
+	return nil
+}
+
+func retryJob(cmd *cobra.Command, args []string) error {
+	var resp models.RetryJobResponse
+	if err := adminCall(cmd, http.MethodPost, "/vms/"+url.PathEscape(args[0])+"/retry", http.StatusAccepted, &resp); err != nil {
+		return err
+	}
+
+	fmt.Printf("Retried %s job of VM %s; it is %s.\n", resp.Job, resp.VM.ID, resp.VM.Status)
+	return nil
+}
+
+func reconcile(cmd *cobra.Command, args []string) error {
+	var report models.ReconcileReport
+	if err := adminCall(cmd, http.MethodPost, "/reconcile", http.StatusOK, &report); err != nil {
+		return err
+	}
+
+	fmt.Printf("Stuck provisioning, now in error: %s\n", listOrNone(report.StuckProvisioning))
+	fmt.Printf("Deleted:                          %s\n", listOrNone(report.Deleted))
+	fmt.Printf("DNS records published:            %d\n", report.DNSPublished)
+	for _, e := range report.Errors {
+		fmt.Printf("Failed %s of VM %s: %s\n", e.Step, e.VMID, e.Error)
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d VMs could not be reconciled", len(report.Errors))
+	}
+	return nil
+}
+
+func watchdog(cmd *cobra.Command, args []string) error {
+	var report models.WatchdogReport
+	if err := adminCall(cmd, http.MethodGet, "/watchdog", http.StatusOK, &report); err != nil {
+		return err
+	}
+
+	if report.CheckedAt == nil {
+		fmt.Println("The watchdog has not checked yet.")
+	} else {
+		fmt.Printf("Last checked %s.\n", report.CheckedAt.Local().Format(time.DateTime))
+	}
+	fmt.Printf("Since start: %d stuck, %d retried, %d rolled back, %d failed.\n",
+		report.Totals.Stuck, report.Totals.Retried, report.Totals.RolledBack, report.Totals.Failed)
+	if len(report.Stuck) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nID\tUSER\tSTAGE\tSINCE\tRETRIES\tACTION\tERROR")
+	for _, vm := range report.Stuck {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", vm.VMID, vm.UserID, vm.Stage,
+			vm.Since.Local().Format(time.DateTime), vm.Retries, vm.Action, orDash(vm.Error))
+	}
+	return w.Flush()
+}
+
+func provisioning(cmd *cobra.Command, args []string) error {
+	var stats models.ProvisioningStats
+	if err := adminCall(cmd, http.MethodGet, "/provisioning", http.StatusOK, &stats); err != nil {
+		return err
+	}
+
+	slo := time.Duration(stats.SLOSeconds * float64(time.Second))
+	fmt.Printf("Since start: %d provisioned, %d over the %s SLO, %d failed.\n",
+		stats.Totals.Completed, stats.Totals.OverSLO, slo, stats.Totals.Failed)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\nSTAGE\tCOUNT\tP50\tP95\tMAX\tFAILED\n")
+	for _, stage := range models.ProvisionStages {
+		s := stats.Stages[stage]
+		fmt.Fprintf(w, "%s\t%d\t%.1fs\t%.1fs\t%.1fs\t%d\n", stage, s.Count, s.P50Seconds, s.P95Seconds, s.MaxSeconds, s.Failed)
+	}
+	return w.Flush()
+}
+
+// adminCall makes an admin API request, path relative to /api/v1/admin, and
+// decodes the response into out. A status other than wantStatus returns the
+// API's error message.
+func adminCall(cmd *cobra.Command, method, path string, wantStatus int, out interface{}) error {
+	// Errors from here on are the control plane's, not the command line's
+	cmd.SilenceUsage = true
+
+	flags := cmd.Flags()
+	baseURL, _ := flags.GetString("url")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + viper.GetString("port")
+	}
+	token, err := adminToken(cmd)
+	if err != nil {
+		return err
+	}
+	timeout, _ := flags.GetDuration("timeout")
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+"/api/v1/admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != wantStatus {
+		var apiErr models.ErrorResponse
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != nil {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// adminToken finds the operator token: --admin-token, the environment, or
+// the config file the control plane itself reads
+func adminToken(cmd *cobra.Command) (string, error) {
+	if token, _ := cmd.Flags().GetString("admin-token"); token != "" {
+		return token, nil
+	}
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		return token, nil
+	}
+
+	loadConfig()
+	if token := viper.GetString("admin.token"); token != "" {
+		return token, nil
+	}
+	return "", errors.New("no operator token: pass --admin-token, set " + adminTokenEnv + " or --config a file with admin.token")
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func listOrNone(ids []string) string {
+	if len(ids) == 0 {
+		return "none"
+	}
+	return strings.Join(ids, ", ")
+}
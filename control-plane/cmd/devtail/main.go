@@ -0,0 +1,374 @@
+// Command devtail holds developer tooling. `devtail dev` runs the whole
+// stack locally: a control plane on SQLite with the mock provider and a
+// gateway with mock Aider, wired together with a fresh signing key.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/spf13/cobra"
+)
+
+// startTimeout covers compiling both binaries with go run on first start
+const startTimeout = 3 * time.Minute
+
+var (
+	controlPlaneDir  string
+	gatewayDir       string
+	dataDir          string
+	controlPlanePort string
+	gatewayPort      string
+	userID           string
+	createVM         bool
+)
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "devtail",
+		Short: "DevTail developer tools",
+	}
+
+	devCmd := &cobra.Command{
+		Use:   "dev",
+		Short: "Run a local control plane and gateway with mock cloud, Tailscale and Aider",
+		RunE:  runDev,
+	}
+	devCmd.Flags().StringVar(&controlPlaneDir, "control-plane-dir", ".", "control plane module directory")
+	devCmd.Flags().StringVar(&gatewayDir, "gateway-dir", "../gateway", "gateway module directory")
+	devCmd.Flags().StringVar(&dataDir, "data-dir", "", "directory for the database, config and gateway workspace (default: a temporary directory removed on exit)")
+	devCmd.Flags().StringVar(&controlPlanePort, "control-plane-port", "8081", "control plane HTTP port")
+	devCmd.Flags().StringVar(&gatewayPort, "gateway-port", "8080", "gateway port")
+	devCmd.Flags().StringVar(&userID, "user", "dev", "user ID for the VM created at startup")
+	devCmd.Flags().BoolVar(&createVM, "create-vm", true, "create a VM at startup and print its connect URL")
+	rootCmd.AddCommand(devCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func runDev(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	dir := dataDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "devtail-dev-")
+		if err != nil {
+			return fmt.Errorf("create data directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	workspace := filepath.Join(dir, "workspace")
+	if err := os.MkdirAll(workspace, 0o755); err != nil {
+		return fmt.Errorf("create gateway workspace: %w", err)
+	}
+
+	key, err := auth.GenerateKey()
+	if err != nil {
+		return err
+	}
+	publicKey := auth.NewSigner(key, 0).PublicKey()
+
+	configPath := filepath.Join(dir, "control-plane.yaml")
+	if err := writeConfig(configPath, dir, base64.StdEncoding.EncodeToString(key.Seed())); err != nil {
+		return err
+	}
+
+	controlPlaneURL := "http://localhost:" + controlPlanePort
+	gatewayURL := "http://localhost:" + gatewayPort
+
+	processes := []*process{
+		startProcess("control-plane", controlPlaneDir,
+			"go", "run", "./cmd/control-plane",
+			"--dev", "--config", configPath, "--port", controlPlanePort),
+		startProcess("gateway", gatewayDir,
+			"go", "run", "./cmd/gateway",
+			"--mock", "--port", gatewayPort, "--workdir", workspace, "--drain-delay", "0s",
+			"--auth-public-key", publicKey),
+	}
+	defer func() {
+		for _, p := range processes {
+			p.stop()
+		}
+	}()
+
+	exited := make(chan *process, len(processes))
+	for _, p := range processes {
+		if p.err != nil {
+			return fmt.Errorf("start %s: %w", p.name, p.err)
+		}
+		go func(p *process) {
+			<-p.done
+			exited <- p
+		}(p)
+	}
+
+	startCtx, cancelStart := context.WithTimeout(ctx, startTimeout)
+	defer cancelStart()
+	go func() {
+		// A process that dies while starting fails the wait
+		select {
+		case p := <-exited:
+			exited <- p
+			cancelStart()
+		case <-startCtx.Done():
+		}
+	}()
+
+	for _, url := range []string{controlPlaneURL + "/healthz", gatewayURL + "/healthz"} {
+		if err := waitHealthy(startCtx, url); err != nil {
+			return startError(ctx, exited, err)
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("DevTail dev stack is running")
+	fmt.Printf("  control plane  %s\n", controlPlaneURL)
+	fmt.Printf("  gateway        %s (mock Aider, workspace %s)\n", gatewayURL, workspace)
+	fmt.Printf("  data           %s\n", dir)
+
+	if createVM {
+		vm, err := createDevVM(startCtx, controlPlaneURL)
+		if err != nil {
+			return startError(ctx, exited, fmt.Errorf("create VM: %w", err))
+		}
+		fmt.Printf("  VM             %s (user %s)\n", vm.VM.ID, userID)
+		fmt.Printf("  connect URL    %s\n", vm.WebsocketURL)
+	}
+	fmt.Println()
+	fmt.Printf("Create more VMs with:\n  curl -X POST %s/api/v1/vms -H 'X-User-ID: %s' -d '{\"user_id\":\"%s\",\"spec\":{\"type\":\"small\",\"location\":\"local\"}}'\n", controlPlaneURL, userID, userID)
+	fmt.Println("Press Ctrl-C to stop.")
+	fmt.Println()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case p := <-exited:
+		return fmt.Errorf("%s exited: %v", p.name, p.exitErr)
+	}
+}
+
+// startError prefers the reason a process died over the wait that noticed it
+func startError(ctx context.Context, exited chan *process, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	select {
+	case p := <-exited:
+		return fmt.Errorf("%s exited while starting: %v", p.name, p.exitErr)
+	default:
+		return err
+	}
+}
+
+// writeConfig writes the control plane config; --dev supplies the rest
+func writeConfig(path, dir, signingKey string) error {
+	config := fmt.Sprintf(`database:
+  driver: sqlite
+  path: %q
+auth:
+  signing_key: %q
+websocket:
+  base_url: "ws://localhost:%s"
+gateway:
+  port: %q
+callback:
+  url: "http://localhost:%s/api/v1/callbacks/vm"
+mock:
+  gateway_ip: "127.0.0.1"
+  boot_delay: 1s
+`, filepath.Join(dir, "devtail.db"), signingKey, gatewayPort, gatewayPort, controlPlanePort)
+
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		return fmt.Errorf("write control plane config: %w", err)
+	}
+	return nil
+}
+
+// waitHealthy polls url until it answers 200
+func waitHealthy(ctx context.Context, url string) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not become healthy: %w", url, ctx.Err())
+		}
+	}
+}
+
+// createDevVM creates a VM and waits for it to be running, so its connect
+// URL works right away
+func createDevVM(ctx context.Context, baseURL string) (*models.CreateVMResponse, error) {
+	body, err := json.Marshal(models.CreateVMRequest{
+		UserID: userID,
+		Spec:   models.VMSpec{Type: "small", Location: "local"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var created models.CreateVMResponse
+	if err := call(ctx, http.MethodPost, baseURL+"/api/v1/vms", body, http.StatusCreated, &created); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		var vm models.VM
+		if err := call(ctx, http.MethodGet, baseURL+"/api/v1/vms/"+created.VM.ID, nil, http.StatusOK, &vm); err != nil {
+			return nil, err
+		}
+		switch vm.Status {
+		case models.VMStatusRunning:
+			return &created, nil
+		case models.VMStatusError:
+			return nil, errors.New("VM provisioning failed, see the control plane log")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// call makes a control plane API request as the dev user
+func call(ctx context.Context, method, url string, body []byte, wantStatus int, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", userID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != wantStatus {
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// process is a child command whose output is prefixed with its name
+type process struct {
+	name    string
+	cmd     *exec.Cmd
+	err     error // from starting
+	exitErr error // from waiting, once done is closed
+	done    chan struct{}
+}
+
+func startProcess(name, dir string, command string, args ...string) *process {
+	p := &process{name: name, done: make(chan struct{})}
+
+	out := prefixWriter(name)
+	p.cmd = exec.Command(command, args...)
+	p.cmd.Dir = dir
+	p.cmd.Stdout = out
+	p.cmd.Stderr = out
+	// go run starts the binary as a child; a process group stops both
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	p.cmd.WaitDelay = 5 * time.Second
+
+	if p.err = p.cmd.Start(); p.err != nil {
+		close(p.done)
+		return p
+	}
+
+	go func() {
+		p.exitErr = p.cmd.Wait()
+		close(p.done)
+	}()
+	return p
+}
+
+// stop interrupts the process group and kills it if it has not exited
+// after a few seconds
+func (p *process) stop() {
+	if p.err != nil {
+		return
+	}
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	pgid := -p.cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGINT)
+
+	select {
+	case <-p.done:
+	case <-time.After(10 * time.Second):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// outputMu keeps lines from the two processes from interleaving
+var outputMu sync.Mutex
+
+// prefixWriter prints each line written to it tagged with name
+func prefixWriter(name string) io.Writer {
+	r, w := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			outputMu.Lock()
+			fmt.Printf("%-15s %s\n", "["+name+"]", scanner.Text())
+			outputMu.Unlock()
+		}
+		io.Copy(io.Discard, r)
+	}()
+	return w
+}
@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// Issuer and Audience bind connect tokens to DevTail gateways
+	Issuer   = "devtail-control-plane"
+	Audience = "devtail-gateway"
+
+	// RevocationAudience marks revocation notices sent to gateways
+	RevocationAudience = "devtail-gateway-revocation"
+
+	// AnnouncementAudience marks operator announcements sent to gateways
+	AnnouncementAudience = "devtail-gateway-announcement"
+
+	// BackupAudience marks requests for a gateway to back up its
+	// workspaces before its VM is deleted
+	BackupAudience = "devtail-gateway-backup"
+
+	// SuspendAudience marks the notices that take a gateway through
+	// suspending its VM
+	SuspendAudience = "devtail-gateway-suspend"
+
+	// IngestAudience marks tokens gateways present when shipping logs to
+	// the control plane
+	IngestAudience = "devtail-control-plane-ingest"
+
+	// revocationTTL bounds how long a revocation notice, announcement,
+	// suspension notice or backup request can be replayed
+	revocationTTL = 5 * time.Minute
+
+	DefaultTokenTTL = 15 * time.Minute
+)
+
+// ErrInvalidToken is returned for ingest tokens that fail verification
+var ErrInvalidToken = errors.New("invalid token")
+
+// ConnectClaims authorize one user to open WebSocket sessions to one VM's
+// gateway until the token expires
+type ConnectClaims struct {
+	VMID string `json:"vm"`
+
+	// ReadOnly makes the sessions opened with the token read-only
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// RevocationClaims tell a gateway to reject one connect token, or all tokens
+// for the VM issued before IssuedBefore
+type RevocationClaims struct {
+	VMID         string           `json:"vm"`
+	TokenID      string           `json:"token_id,omitempty"`
+	IssuedBefore *jwt.NumericDate `json:"issued_before,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// AnnouncementClaims carry an operator announcement for a gateway to pass
+// on to its clients
+type AnnouncementClaims struct {
+	VMID         string              `json:"vm"`
+	Announcement models.Announcement `json:"announcement"`
+	jwt.RegisteredClaims
+}
+
+// SuspendClaims carry one step of suspending a VM for its gateway to carry
+// out
+type SuspendClaims struct {
+	VMID   string               `json:"vm"`
+	Notice models.SuspendNotice `json:"suspend"`
+	jwt.RegisteredClaims
+}
+
+// Signer issues short-lived connect tokens signed with an Ed25519 key.
+// Gateways only hold the public key, so a compromised VM cannot mint tokens
+// for other VMs.
+type Signer struct {
+	key ed25519.PrivateKey
+	ttl time.Duration
+}
+
+func NewSigner(key ed25519.PrivateKey, ttl time.Duration) *Signer {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &Signer{
+		key: key,
+		ttl: ttl,
+	}
+}
+
+// ParsePrivateKey decodes a base64 Ed25519 seed (32 bytes) or private key (64 bytes)
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode signing key: %w", err)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	default:
+		return nil, fmt.Errorf("signing key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+}
+
+// GenerateKey creates a new random signing key
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+	return key, nil
+}
+
+// PublicKey returns the base64 verification key to configure on gateways
+func (s *Signer) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Issue signs a connect token for userID on vmID. A readOnly token only
+// lets its sessions watch, for demos and viewers.
+func (s *Signer) Issue(vmID, userID string, readOnly bool) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+
+	claims := ConnectClaims{
+		VMID:     vmID,
+		ReadOnly: readOnly,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    Issuer,
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sign connect token: %w", err)
+	}
+	return token, expiresAt, nil
+}
+
+// SignRevocation signs a notice revoking tokenID on vmID, or every token for
+// vmID issued before issuedBefore when tokenID is empty
+func (s *Signer) SignRevocation(vmID, tokenID string, issuedBefore time.Time) (string, error) {
+	now := time.Now()
+
+	claims := RevocationClaims{
+		VMID:    vmID,
+		TokenID: tokenID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{RevocationAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(revocationTTL)),
+		},
+	}
+	if tokenID == "" {
+		claims.IssuedBefore = jwt.NewNumericDate(issuedBefore)
+	}
+
+	notice, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("sign revocation: %w", err)
+	}
+	return notice, nil
+}
+
+// SignAnnouncement signs a notice asking vmID's gateway to deliver an
+// announcement. Like revocations it is only accepted briefly, so it can't be
+// replayed later.
+func (s *Signer) SignAnnouncement(vmID string, announcement models.Announcement) (string, error) {
+	now := time.Now()
+
+	claims := AnnouncementClaims{
+		VMID:         vmID,
+		Announcement: announcement,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{AnnouncementAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(revocationTTL)),
+		},
+	}
+
+	notice, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("sign announcement: %w", err)
+	}
+	return notice, nil
+}
+
+// SignSuspendNotice signs a step of suspending vmID for its gateway. Like
+// announcements it is only accepted briefly.
+func (s *Signer) SignSuspendNotice(vmID string, notice models.SuspendNotice) (string, error) {
+	now := time.Now()
+
+	claims := SuspendClaims{
+		VMID:   vmID,
+		Notice: notice,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{SuspendAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(revocationTTL)),
+		},
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("sign suspension notice: %w", err)
+	}
+	return signed, nil
+}
+
+// SignBackupRequest signs a request for vmID's gateway to back up every
+// workspace now. It carries only the VM, like a connect token for no one.
+func (s *Signer) SignBackupRequest(vmID string) (string, error) {
+	now := time.Now()
+
+	claims := ConnectClaims{
+		VMID: vmID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{BackupAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(revocationTTL)),
+		},
+	}
+
+	request, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("sign backup request: %w", err)
+	}
+	return request, nil
+}
+
+// IssueIngest signs the token a VM's gateway ships its logs, syncs its
+// conversation contexts and arranges workspace backups with, and returns it
+// with its ID. It is handed to the VM in cloud-init and lives as long as the
+// VM's machine, so it carries no expiry; the caller records the ID, and only
+// the VM's latest token is accepted. It only grants writing that VM's logs
+// and backups and reading its owner's contexts and backups.
+func (s *Signer) IssueIngest(vmID string) (string, string, error) {
+	tokenID := uuid.New().String()
+	claims := jwt.RegisteredClaims{
+		ID:       tokenID,
+		Issuer:   Issuer,
+		Subject:  vmID,
+		Audience: jwt.ClaimStrings{IngestAudience},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(s.key)
+	if err != nil {
+		return "", "", fmt.Errorf("sign ingest token: %w", err)
+	}
+	return token, tokenID, nil
+}
+
+// VerifyIngest checks an ingest token and returns the VM it was issued for
+// and the token's ID
+func (s *Signer) VerifyIngest(token string) (string, string, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return s.key.Public(), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(IngestAudience),
+	)
+	if err != nil || claims.Subject == "" {
+		return "", "", ErrInvalidToken
+	}
+	return claims.Subject, claims.ID, nil
+}
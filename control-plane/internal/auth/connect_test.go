@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testSigner(t *testing.T) *Signer {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSigner(key, time.Minute)
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr string
+	}{
+		{"seed", base64.StdEncoding.EncodeToString(key.Seed()), ""},
+		{"private key", base64.StdEncoding.EncodeToString(key), ""},
+		{"not base64", "not base64!", "decode signing key"},
+		{"wrong length", base64.StdEncoding.EncodeToString([]byte("short")), "must be 32 or 64 bytes, got 5"},
+		{"empty", "", "got 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParsePrivateKey(tt.encoded)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Equal(key) {
+				t.Fatal("expected the key back")
+			}
+		})
+	}
+}
+
+func TestIssueConnectToken(t *testing.T) {
+	s := testSigner(t)
+	raw, err := base64.StdEncoding.DecodeString(s.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		token, expiresAt, err := s.Issue("vm-1", "user-1", readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Until(expiresAt); d <= 0 || d > time.Minute {
+			t.Fatalf("expected the token to expire within the signer's TTL, got %v", d)
+		}
+
+		var claims ConnectClaims
+		_, err = jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+			return ed25519.PublicKey(raw), nil
+		},
+			jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+			jwt.WithIssuer(Issuer),
+			jwt.WithAudience(Audience),
+		)
+		if err != nil {
+			t.Fatalf("expected the token to verify with the public key: %v", err)
+		}
+		if claims.VMID != "vm-1" || claims.Subject != "user-1" || claims.ID == "" || claims.ReadOnly != readOnly {
+			t.Fatalf("expected a token for user-1 on vm-1 with an ID, read-only %v, got %+v", readOnly, claims)
+		}
+	}
+}
+
+func TestVerifyIngest(t *testing.T) {
+	s := testSigner(t)
+	other := testSigner(t)
+
+	ingest, ingestID, err := s.IssueIngest("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect, _, err := s.Issue("vm-1", "user-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := s.SignBackupRequest("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _, err := other.IssueIngest("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noVM, _, err := s.IssueIngest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		wantVM string
+		wantID string
+	}{
+		{"ingest token", ingest, "vm-1", ingestID},
+		{"connect token", connect, "", ""},
+		{"backup request", backup, "", ""},
+		{"signed by another key", forged, "", ""},
+		{"no VM", noVM, "", ""},
+		{"garbage", "not.a.token", "", ""},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmID, tokenID, err := s.VerifyIngest(tt.token)
+			if tt.wantVM == "" {
+				if err != ErrInvalidToken {
+					t.Fatalf("expected ErrInvalidToken, got %q, %v", vmID, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vmID != tt.wantVM || tokenID != tt.wantID {
+				t.Fatalf("expected %s with token %s, got %s with %s", tt.wantVM, tt.wantID, vmID, tokenID)
+			}
+		})
+	}
+}
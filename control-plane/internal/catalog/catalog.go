@@ -0,0 +1,269 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRefreshInterval is how long a catalog fetched from the provider is cached
+const DefaultRefreshInterval = time.Hour
+
+// Default is used when no catalog is configured
+var Default = models.Catalog{
+	ServerTypes: []models.ServerTypeOption{
+		{Name: "cx11", Cores: 1, MemoryGB: 2, DiskGB: 20},
+		{Name: "cx21", Cores: 2, MemoryGB: 4, DiskGB: 40},
+		{Name: "cx31", Cores: 2, MemoryGB: 8, DiskGB: 80},
+		{Name: "cx41", Cores: 4, MemoryGB: 16, DiskGB: 160},
+		{Name: "cpx11", Cores: 2, MemoryGB: 2, DiskGB: 40},
+		{Name: "cpx21", Cores: 3, MemoryGB: 4, DiskGB: 80},
+		{Name: "cpx31", Cores: 4, MemoryGB: 8, DiskGB: 160},
+	},
+	Locations: []models.LocationOption{
+		{Name: "nbg1", City: "Nuremberg", Country: "DE"},
+		{Name: "fsn1", City: "Falkenstein", Country: "DE"},
+		{Name: "hel1", City: "Helsinki", Country: "FI"},
+		{Name: "ash", City: "Ashburn, VA", Country: "US"},
+		{Name: "hil", City: "Hillsboro, OR", Country: "US"},
+	},
+	DiskSizes: []int{20, 40, 80, 160},
+	Images: []models.ImageOption{
+		{Name: "ubuntu-22.04", Description: "Ubuntu 22.04"},
+		{Name: "ubuntu-24.04", Description: "Ubuntu 24.04"},
+		{Name: "debian-12", Description: "Debian 12"},
+	},
+}
+
+// FetchFunc loads the server types and locations offered by the provider
+type FetchFunc func(ctx context.Context) (*models.Catalog, error)
+
+// ValidationError describes a VMSpec field that is not in the catalog
+type ValidationError struct {
+	Field   string
+	Value   string
+	Allowed []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %q is not available; choose one of: %s", e.Field, e.Value, strings.Join(e.Allowed, ", "))
+}
+
+// Config restricts the catalog offered by this deployment
+type Config struct {
+	// Base replaces the default catalog, for providers such as a local
+	// hypervisor that offer their own server types
+	Base *models.Catalog
+
+	// ServerTypes and Locations are allowlists; empty allows everything
+	// the provider (or the default catalog) offers
+	ServerTypes []string
+	Locations   []string
+
+	// DiskSizes replaces the default disk sizes when set
+	DiskSizes []int
+
+	// Images replaces the default images when set, e.g. to add golden
+	// images with the gateway preinstalled. The first is the default.
+	Images []models.ImageOption
+
+	// RefreshInterval is how long a fetched catalog is cached
+	RefreshInterval time.Duration
+}
+
+// Service serves the catalog and validates VM specs against it. With a
+// fetch function the server types and locations come from the provider and
+// are refreshed at most once per interval; the default catalog is used until
+// the first successful fetch and whenever the provider is unreachable.
+type Service struct {
+	config Config
+	base   models.Catalog
+	static models.Catalog
+	fetch  FetchFunc
+
+	mu      sync.Mutex
+	current *models.Catalog
+}
+
+// NewService creates a catalog service. fetch may be nil to serve only the
+// default (or configured base) catalog.
+func NewService(config Config, fetch FetchFunc) *Service {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	base := Default
+	if config.Base != nil {
+		base = *config.Base
+	}
+	if len(config.DiskSizes) == 0 {
+		config.DiskSizes = base.DiskSizes
+	}
+
+	s := &Service{
+		config: config,
+		base:   base,
+		fetch:  fetch,
+	}
+	s.static = s.restrict(base)
+	s.static.Source = "static"
+	return s
+}
+
+// restrict applies the configured allowlists, disk sizes and images to cat
+func (s *Service) restrict(cat models.Catalog) models.Catalog {
+	restricted := models.Catalog{
+		DiskSizes: s.config.DiskSizes,
+		Images:    s.config.Images,
+	}
+	if len(restricted.Images) == 0 {
+		restricted.Images = cat.Images
+	}
+
+	for _, l := range cat.Locations {
+		if len(s.config.Locations) == 0 || contains(s.config.Locations, l.Name) {
+			restricted.Locations = append(restricted.Locations, l)
+		}
+	}
+
+	for _, t := range cat.ServerTypes {
+		if len(s.config.ServerTypes) > 0 && !contains(s.config.ServerTypes, t.Name) {
+			continue
+		}
+		if len(t.Locations) > 0 && len(s.config.Locations) > 0 {
+			var locations []string
+			for _, l := range t.Locations {
+				if contains(s.config.Locations, l) {
+					locations = append(locations, l)
+				}
+			}
+			if len(locations) == 0 {
+				continue
+			}
+			t.Locations = locations
+		}
+		restricted.ServerTypes = append(restricted.ServerTypes, t)
+	}
+
+	return restricted
+}
+
+// Get returns the current catalog
+func (s *Service) Get(ctx context.Context) *models.Catalog {
+	if s.fetch == nil {
+		return &s.static
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && time.Since(s.current.UpdatedAt) < s.config.RefreshInterval {
+		return s.current
+	}
+
+	fetched, err := s.fetch(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to refresh catalog from provider")
+		if s.current != nil {
+			return s.current
+		}
+		return &s.static
+	}
+
+	// The provider lists golden images; the base images stay available
+	// and remain the default
+	fetched.Images = append(append([]models.ImageOption(nil), s.base.Images...), fetched.Images...)
+
+	restricted := s.restrict(*fetched)
+	restricted.Source = "hetzner"
+	restricted.UpdatedAt = time.Now()
+	s.current = &restricted
+	return s.current
+}
+
+// Image returns the catalog entry for the named image, or nil
+func (s *Service) Image(ctx context.Context, name string) *models.ImageOption {
+	cat := s.Get(ctx)
+	for i := range cat.Images {
+		if cat.Images[i].Name == name {
+			return &cat.Images[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks spec against the catalog. An unset disk size is allowed
+// and means the server type's default disk; an unset image is set to the
+// catalog's default.
+func (s *Service) Validate(ctx context.Context, spec *models.VMSpec) error {
+	cat := s.Get(ctx)
+
+	var serverType *models.ServerTypeOption
+	for i := range cat.ServerTypes {
+		if cat.ServerTypes[i].Name == spec.Type {
+			serverType = &cat.ServerTypes[i]
+			break
+		}
+	}
+	if serverType == nil {
+		names := make([]string, 0, len(cat.ServerTypes))
+		for _, t := range cat.ServerTypes {
+			names = append(names, t.Name)
+		}
+		return &ValidationError{Field: "spec.type", Value: spec.Type, Allowed: names}
+	}
+
+	locations := append([]string(nil), serverType.Locations...)
+	if len(locations) == 0 {
+		for _, l := range cat.Locations {
+			locations = append(locations, l.Name)
+		}
+	}
+	if !contains(locations, spec.Location) {
+		sort.Strings(locations)
+		return &ValidationError{Field: "spec.location", Value: spec.Location, Allowed: locations}
+	}
+
+	if spec.DiskSize != 0 && len(cat.DiskSizes) > 0 {
+		sizes := make([]string, 0, len(cat.DiskSizes))
+		found := false
+		for _, size := range cat.DiskSizes {
+			sizes = append(sizes, strconv.Itoa(size))
+			found = found || size == spec.DiskSize
+		}
+		if !found {
+			return &ValidationError{Field: "spec.disk_size", Value: strconv.Itoa(spec.DiskSize), Allowed: sizes}
+		}
+	}
+
+	if len(cat.Images) > 0 {
+		if spec.Image == "" {
+			spec.Image = cat.Images[0].Name
+		}
+
+		names := make([]string, 0, len(cat.Images))
+		for _, image := range cat.Images {
+			names = append(names, image.Name)
+		}
+		if !contains(names, spec.Image) {
+			return &ValidationError{Field: "spec.image", Value: spec.Image, Allowed: names}
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
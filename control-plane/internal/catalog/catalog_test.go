@@ -0,0 +1,110 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+func TestValidate(t *testing.T) {
+	s := NewService(Config{
+		ServerTypes: []string{"cx11", "cx21", "ccx13"},
+		Locations:   []string{"nbg1", "fsn1"},
+		Base: &models.Catalog{
+			ServerTypes: []models.ServerTypeOption{
+				{Name: "cx11"},
+				{Name: "cx21"},
+				{Name: "cx31"},
+				{Name: "ccx13", Locations: []string{"fsn1", "ash"}},
+			},
+			Locations: []models.LocationOption{{Name: "nbg1"}, {Name: "fsn1"}, {Name: "ash"}},
+			DiskSizes: []int{20, 40},
+			Images:    []models.ImageOption{{Name: "ubuntu-22.04"}, {Name: "debian-12"}},
+		},
+	}, nil)
+
+	tests := []struct {
+		name      string
+		spec      models.VMSpec
+		wantField string // of the ValidationError; empty for a valid spec
+		wantImage string
+	}{
+		{"valid", models.VMSpec{Type: "cx21", Location: "nbg1", DiskSize: 40, Image: "debian-12"}, "", "debian-12"},
+		{"default disk and image", models.VMSpec{Type: "cx11", Location: "fsn1"}, "", "ubuntu-22.04"},
+		{"type restricted to its locations", models.VMSpec{Type: "ccx13", Location: "fsn1"}, "", "ubuntu-22.04"},
+		{"unknown type", models.VMSpec{Type: "cx99", Location: "nbg1"}, "spec.type", ""},
+		{"type not allowed", models.VMSpec{Type: "cx31", Location: "nbg1"}, "spec.type", ""},
+		{"location not allowed", models.VMSpec{Type: "cx21", Location: "ash"}, "spec.location", ""},
+		{"location the type is not offered in", models.VMSpec{Type: "ccx13", Location: "nbg1"}, "spec.location", ""},
+		{"no location", models.VMSpec{Type: "cx21"}, "spec.location", ""},
+		{"disk size", models.VMSpec{Type: "cx21", Location: "nbg1", DiskSize: 30}, "spec.disk_size", ""},
+		{"image", models.VMSpec{Type: "cx21", Location: "nbg1", Image: "windows"}, "spec.image", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			err := s.Validate(context.Background(), &spec)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if spec.Image != tt.wantImage {
+					t.Fatalf("expected image %s, got %s", tt.wantImage, spec.Image)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a ValidationError, got %v", err)
+			}
+			if verr.Field != tt.wantField || len(verr.Allowed) == 0 {
+				t.Fatalf("expected %s rejected with the allowed values, got %+v", tt.wantField, verr)
+			}
+		})
+	}
+}
+
+func TestGetFallsBackToStaticCatalog(t *testing.T) {
+	fetches := 0
+	var fail bool
+	s := NewService(Config{Images: []models.ImageOption{{Name: "golden"}}}, func(ctx context.Context) (*models.Catalog, error) {
+		fetches++
+		if fail {
+			return nil, errors.New("provider unreachable")
+		}
+		return &models.Catalog{
+			ServerTypes: []models.ServerTypeOption{{Name: "cx22"}},
+			Locations:   []models.LocationOption{{Name: "nbg1"}},
+		}, nil
+	})
+	ctx := context.Background()
+
+	fail = true
+	if got := s.Get(ctx); got.Source != "static" {
+		t.Fatalf("expected the static catalog while the provider is unreachable, got %q", got.Source)
+	}
+
+	fail = false
+	got := s.Get(ctx)
+	if got.Source != "hetzner" || len(got.ServerTypes) != 1 || got.ServerTypes[0].Name != "cx22" {
+		t.Fatalf("expected the fetched catalog, got %+v", got)
+	}
+	if len(got.Images) != 1 || got.Images[0].Name != "golden" {
+		t.Fatalf("expected the configured images, got %+v", got.Images)
+	}
+
+	// Cached until the refresh interval, and kept when a refresh fails
+	fail = true
+	s.Get(ctx)
+	if fetches != 2 {
+		t.Fatalf("expected the fetched catalog cached, fetched %d times", fetches)
+	}
+	s.current.UpdatedAt = time.Now().Add(-2 * DefaultRefreshInterval)
+	if got := s.Get(ctx); got.Source != "hetzner" {
+		t.Fatalf("expected the last fetched catalog kept, got %q", got.Source)
+	}
+}
@@ -0,0 +1,243 @@
+package console
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultUser is the account cloud-init creates on every VM
+const DefaultUser = "devtail"
+
+// DefaultTimeout bounds dialing the VM and the SSH handshake
+const DefaultTimeout = 15 * time.Second
+
+// Config selects how the control plane logs in to VMs
+type Config struct {
+	// User defaults to DefaultUser
+	User string
+
+	// PrivateKey is the PEM private key matching ssh.public_key, which
+	// cloud-init authorizes for the VM user
+	PrivateKey []byte
+
+	// Port defaults to 22
+	Port string
+
+	Timeout time.Duration
+}
+
+// SSH opens shells on VMs over the tailnet for operators. It goes around
+// the gateway, so it keeps working when the gateway is what broke.
+type SSH struct {
+	config  *ssh.ClientConfig
+	port    string
+	timeout time.Duration
+}
+
+func NewSSH(cfg Config) (*SSH, error) {
+	signer, err := ssh.ParsePrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	if cfg.User == "" {
+		cfg.User = DefaultUser
+	}
+	if cfg.Port == "" {
+		cfg.Port = "22"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	return &SSH{
+		config: &ssh.ClientConfig{
+			User: cfg.User,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			// VMs regenerate their host keys on first boot, so there is
+			// nothing to pin; the tailnet already authenticates the peer
+			// by its node key.
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         cfg.Timeout,
+		},
+		port:    cfg.Port,
+		timeout: cfg.Timeout,
+	}, nil
+}
+
+// Session is an interactive shell on a VM
+type Session struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	output  *wsWriter
+}
+
+// Open logs in to host and starts a shell on a cols x rows terminal
+func (s *SSH) Open(ctx context.Context, host string, cols, rows int) (*Session, error) {
+	addr := net.JoinHostPort(host, s.port)
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, s.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s: %w", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("open session: %w", err)
+	}
+
+	out := &wsWriter{}
+	session.Stdout = out
+	session.Stderr = out
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("stdin pipe: %w", err)
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("request pty: %w", err)
+	}
+	if err := session.Shell(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("start shell: %w", err)
+	}
+
+	return &Session{
+		client:  client,
+		session: session,
+		stdin:   stdin,
+		output:  out,
+	}, nil
+}
+
+// controlMessage is sent as a text frame; binary frames are terminal input
+type controlMessage struct {
+	Type string `json:"type"` // "resize"
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// Bridge relays terminal output to ws as binary frames and ws input to the
+// shell until either side closes. It returns when the shell exits.
+func (s *Session) Bridge(ws *websocket.Conn) error {
+	s.output.attach(ws)
+
+	go func() {
+		defer s.stdin.Close()
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				// The client went away; ending the session makes Wait
+				// return
+				s.client.Close()
+				return
+			}
+
+			switch msgType {
+			case websocket.BinaryMessage:
+				if _, err := s.stdin.Write(data); err != nil {
+					return
+				}
+			case websocket.TextMessage:
+				var msg controlMessage
+				if json.Unmarshal(data, &msg) == nil && msg.Type == "resize" && msg.Cols > 0 && msg.Rows > 0 {
+					s.session.WindowChange(msg.Rows, msg.Cols)
+				}
+			}
+		}
+	}()
+
+	err := s.session.Wait()
+
+	var exitErr *ssh.ExitError
+	code := 0
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitStatus()
+		err = nil
+	}
+	s.output.close(fmt.Sprintf("shell exited with status %d", code))
+	return err
+}
+
+// Close ends the session and the SSH connection
+func (s *Session) Close() error {
+	s.session.Close()
+	return s.client.Close()
+}
+
+// pendingLimit caps output buffered before the WebSocket is attached
+const pendingLimit = 64 << 10
+
+// wsWriter forwards stdout and stderr, which the SSH library copies from
+// separate goroutines, to a WebSocket that allows one writer at a time.
+// Output produced before the socket is attached, such as the login banner,
+// is buffered and sent first.
+type wsWriter struct {
+	mu      sync.Mutex
+	ws      *websocket.Conn
+	pending []byte
+}
+
+func (w *wsWriter) attach(ws *websocket.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ws = ws
+	if len(w.pending) > 0 {
+		ws.WriteMessage(websocket.BinaryMessage, w.pending)
+		w.pending = nil
+	}
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ws == nil {
+		if len(w.pending)+len(p) <= pendingLimit {
+			w.pending = append(w.pending, p...)
+		}
+		return len(p), nil
+	}
+	if err := w.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsWriter) close(reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ws == nil {
+		return
+	}
+	w.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+		time.Now().Add(time.Second))
+}
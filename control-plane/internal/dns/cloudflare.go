@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Cloudflare manages records through the Cloudflare API with a token that
+// has DNS edit permission on the zone
+type Cloudflare struct {
+	apiToken string
+	zoneID   string
+	baseURL  string
+	http     *http.Client
+}
+
+var _ Provider = (*Cloudflare)(nil)
+
+func NewCloudflare(apiToken, zoneID string) *Cloudflare {
+	return &Cloudflare{
+		apiToken: apiToken,
+		zoneID:   zoneID,
+		baseURL:  "https://api.cloudflare.com/client/v4",
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Cloudflare) Name() string {
+	return "cloudflare"
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (c *Cloudflare) Upsert(ctx context.Context, record Record) error {
+	existing, err := c.find(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	body := cloudflareRecord{
+		Type:    record.Type,
+		Name:    record.Name,
+		Content: record.Value,
+		TTL:     record.TTL,
+	}
+
+	if len(existing) == 0 {
+		return c.do(ctx, "POST", fmt.Sprintf("/zones/%s/dns_records", c.zoneID), body, nil)
+	}
+	return c.do(ctx, "PUT", fmt.Sprintf("/zones/%s/dns_records/%s", c.zoneID, existing[0].ID), body, nil)
+}
+
+func (c *Cloudflare) Delete(ctx context.Context, record Record) error {
+	existing, err := c.find(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range existing {
+		if err := c.do(ctx, "DELETE", fmt.Sprintf("/zones/%s/dns_records/%s", c.zoneID, r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find lists the records with the record's name and type
+func (c *Cloudflare) find(ctx context.Context, record Record) ([]cloudflareRecord, error) {
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+
+	var records []cloudflareRecord
+	if err := c.do(ctx, "GET", fmt.Sprintf("/zones/%s/dns_records?%s", c.zoneID, query.Encode()), nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (c *Cloudflare) do(ctx context.Context, method, path string, payload, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal payload: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var decoded cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decoded); err != nil {
+		return fmt.Errorf("cloudflare API error: %s", resp.Status)
+	}
+
+	if !decoded.Success {
+		if len(decoded.Errors) > 0 {
+			return fmt.Errorf("cloudflare API error: %s - %s", resp.Status, decoded.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare API error: %s", resp.Status)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(decoded.Result, result); err != nil {
+			return fmt.Errorf("unmarshal response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// DefaultTTL is used when dns.ttl is not set
+const DefaultTTL = 300
+
+// Target selects which of a VM's addresses its record points at
+type Target string
+
+const (
+	// TargetTailscale points at the tailnet address, so the name only
+	// resolves to something reachable from inside the tailnet
+	TargetTailscale Target = "tailscale"
+	// TargetPublic points at the public IPv4
+	TargetPublic Target = "public"
+)
+
+// Record is one A or AAAA record
+type Record struct {
+	Name  string // fully qualified, without the trailing dot
+	Type  string // "A" or "AAAA"
+	Value string
+	TTL   int
+}
+
+// Provider manages records in one DNS zone
+type Provider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+
+	// Upsert creates the record or replaces the value of an existing one
+	Upsert(ctx context.Context, record Record) error
+
+	// Delete removes the record. A record that does not exist is not an
+	// error.
+	Delete(ctx context.Context, record Record) error
+}
+
+// Config selects the names and addresses of VM records
+type Config struct {
+	// Domain is the zone VM names live under, e.g. dev.example.com
+	Domain string
+
+	Target Target
+	TTL    int
+}
+
+// Records publishes <vm-id>.<domain> for each running VM
+type Records struct {
+	provider Provider
+	config   Config
+}
+
+func NewRecords(provider Provider, config Config) *Records {
+	config.Domain = strings.TrimSuffix(config.Domain, ".")
+	if config.Target == "" {
+		config.Target = TargetTailscale
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+	return &Records{
+		provider: provider,
+		config:   config,
+	}
+}
+
+// ParseTarget validates a record target, defaulting to the tailnet address
+func ParseTarget(target string) (Target, error) {
+	switch Target(target) {
+	case "", TargetTailscale:
+		return TargetTailscale, nil
+	case TargetPublic:
+		return TargetPublic, nil
+	default:
+		return "", fmt.Errorf("unknown dns target %q, use tailscale or public", target)
+	}
+}
+
+// Hostname is the name published for the VM
+func (r *Records) Hostname(vmID string) string {
+	return vmID + "." + r.config.Domain
+}
+
+// Publish creates or updates the VM's record. It is a no-op when the VM has
+// no address of the configured kind.
+func (r *Records) Publish(ctx context.Context, vm *models.VM) error {
+	record, ok := r.record(vm)
+	if !ok {
+		return nil
+	}
+	if err := r.provider.Upsert(ctx, record); err != nil {
+		return fmt.Errorf("%s: upsert %s: %w", r.provider.Name(), record.Name, err)
+	}
+	return nil
+}
+
+// Remove deletes the VM's record
+func (r *Records) Remove(ctx context.Context, vm *models.VM) error {
+	record, ok := r.record(vm)
+	if !ok {
+		return nil
+	}
+	if err := r.provider.Delete(ctx, record); err != nil {
+		return fmt.Errorf("%s: delete %s: %w", r.provider.Name(), record.Name, err)
+	}
+	return nil
+}
+
+func (r *Records) record(vm *models.VM) (Record, bool) {
+	value := vm.TailscaleIP
+	if r.config.Target == TargetPublic {
+		value = vm.PublicIP
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return Record{}, false
+	}
+
+	recordType := "AAAA"
+	if ip.To4() != nil {
+		recordType = "A"
+	}
+
+	return Record{
+		Name:  r.Hostname(vm.ID),
+		Type:  recordType,
+		Value: ip.String(),
+		TTL:   r.config.TTL,
+	}, true
+}
@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// route53Region is where the global Route 53 API signs requests
+const route53Region = "us-east-1"
+
+// Route53 manages records in a Route 53 hosted zone. Requests are signed
+// with AWS Signature Version 4 directly rather than through the AWS SDK,
+// since two API calls do not justify the dependency.
+type Route53 struct {
+	accessKeyID     string
+	secretAccessKey string
+	hostedZoneID    string
+	endpoint        string
+	http            *http.Client
+	now             func() time.Time
+}
+
+var _ Provider = (*Route53)(nil)
+
+func NewRoute53(accessKeyID, secretAccessKey, hostedZoneID string) *Route53 {
+	return &Route53{
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		hostedZoneID:    strings.TrimPrefix(hostedZoneID, "/hostedzone/"),
+		endpoint:        "https://route53.amazonaws.com",
+		http:            &http.Client{Timeout: 30 * time.Second},
+		now:             time.Now,
+	}
+}
+
+func (r *Route53) Name() string {
+	return "route53"
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action string   `xml:"Action"`
+	Name   string   `xml:"ResourceRecordSet>Name"`
+	Type   string   `xml:"ResourceRecordSet>Type"`
+	TTL    int      `xml:"ResourceRecordSet>TTL"`
+	Values []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+func (r *Route53) Upsert(ctx context.Context, record Record) error {
+	return r.change(ctx, "UPSERT", record)
+}
+
+// Delete must match the record exactly, so it uses the same value and TTL
+// the record was published with
+func (r *Route53) Delete(ctx context.Context, record Record) error {
+	err := r.change(ctx, "DELETE", record)
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
+
+func (r *Route53) change(ctx context.Context, action string, record Record) error {
+	body, err := xml.Marshal(route53ChangeRequest{
+		Changes: []route53Change{{
+			Action: action,
+			Name:   record.Name,
+			Type:   record.Type,
+			TTL:    record.TTL,
+			Values: []string{record.Value},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal change: %w", err)
+	}
+	body = append([]byte(xml.Header), body...)
+
+	path := fmt.Sprintf("/2013-04-01/hostedzone/%s/rrset/", r.hostedZoneID)
+	req, err := http.NewRequestWithContext(ctx, "POST", r.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	r.sign(req, body)
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("route53 API error: %s - %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header
+func (r *Route53) sign(req *http.Request, body []byte) {
+	now := r.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := sha256Hex(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" + "x-amz-date:" + amzDate + "\n",
+		"host;x-amz-date",
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + route53Region + "/route53/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+r.secretAccessKey), day)
+	key = hmacSHA256(key, route53Region)
+	key = hmacSHA256(key, "route53")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-date, Signature=%s",
+		r.accessKeyID, scope, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,145 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTimeout bounds each dependency check
+const DefaultTimeout = 3 * time.Second
+
+// Status of one dependency or of the service as a whole
+type Status string
+
+const (
+	StatusHealthy   Status = "healthy"
+	StatusDegraded  Status = "degraded"
+	StatusUnhealthy Status = "unhealthy"
+)
+
+// CheckFunc reports whether a dependency is reachable
+type CheckFunc func(ctx context.Context) error
+
+// Check is one dependency of the service. A failing critical check makes the
+// service unhealthy; any other failing check only degrades it.
+type Check struct {
+	Name     string
+	Critical bool
+	Check    CheckFunc
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Status    Status `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Report is the outcome of all checks
+type Report struct {
+	Status       Status            `json:"status"`
+	Service      string            `json:"service"`
+	Draining     bool              `json:"draining,omitempty"`
+	Dependencies map[string]Result `json:"dependencies"`
+}
+
+// Checker runs dependency checks concurrently
+type Checker struct {
+	service  string
+	timeout  time.Duration
+	checks   []Check
+	draining atomic.Bool
+}
+
+func NewChecker(service string, timeout time.Duration, checks ...Check) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{
+		service: service,
+		timeout: timeout,
+		checks:  checks,
+	}
+}
+
+// SetDraining marks the service as shutting down, so Ready fails and load
+// balancers stop sending it traffic
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Run executes every check and aggregates the results
+func (c *Checker) Run(ctx context.Context) *Report {
+	return c.run(ctx, c.checks)
+}
+
+// Ready runs only the critical checks. The service is ready when they all
+// pass and it is not draining.
+func (c *Checker) Ready(ctx context.Context) *Report {
+	var critical []Check
+	for _, check := range c.checks {
+		if check.Critical {
+			critical = append(critical, check)
+		}
+	}
+
+	report := c.run(ctx, critical)
+	if c.draining.Load() {
+		report.Draining = true
+		report.Status = StatusUnhealthy
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, checks []Check) *Report {
+	report := &Report{
+		Status:       StatusHealthy,
+		Service:      c.service,
+		Dependencies: make(map[string]Result, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			result := c.check(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[check.Name] = result
+			if result.Status == StatusHealthy {
+				return
+			}
+			if check.Critical {
+				report.Status = StatusUnhealthy
+			} else if report.Status == StatusHealthy {
+				report.Status = StatusDegraded
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func (c *Checker) check(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Check(ctx)
+	result := Result{
+		Status:    StatusHealthy,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = StatusUnhealthy
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -3,49 +3,196 @@ package hetzner
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/devtail/control-plane/internal/provider"
 	"github.com/devtail/control-plane/pkg/models"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
-	"github.com/rs/zerolog/log"
+	"github.com/devtail/control-plane/internal/requestid"
+)
+
+// Name is the provider name stored with Hetzner VMs
+const Name = "hetzner"
+
+// DefaultImage is used for VMs created before images were selectable
+const DefaultImage = "ubuntu-22.04"
+
+// ImageLabel names the snapshots that back golden images, so the catalog
+// can refer to them by name rather than by ID
+const ImageLabel = "devtail-image"
+
+// PublicNetwork selects the public addresses VMs get. VMs are reached over
+// Tailscale, so a public IPv4 is only needed for outbound traffic.
+type PublicNetwork string
+
+const (
+	// PublicNetworkDualStack assigns a public IPv4 and IPv6 (the default)
+	PublicNetworkDualStack PublicNetwork = "dual-stack"
+	// PublicNetworkIPv6 assigns only a public IPv6, which is free
+	PublicNetworkIPv6 PublicNetwork = "ipv6"
+	// PublicNetworkNone assigns no public address; VMs need the private
+	// network and a NAT gateway on it for outbound traffic
+	PublicNetworkNone PublicNetwork = "none"
+)
+
+// ParsePublicNetwork validates a public network mode, defaulting to dual stack
+func ParsePublicNetwork(mode string) (PublicNetwork, error) {
+	switch PublicNetwork(mode) {
+	case "", PublicNetworkDualStack:
+		return PublicNetworkDualStack, nil
+	case PublicNetworkIPv6, PublicNetworkNone:
+		return PublicNetwork(mode), nil
+	default:
+		return "", fmt.Errorf("unknown public network mode %q, use dual-stack, ipv6 or none", mode)
+	}
+}
+
+// How often the client polls for servers and actions to be ready; tests
+// shorten them
+var (
+	ipPollInterval     = 2 * time.Second
+	actionPollInterval = time.Second
+	statusPollInterval = 10 * time.Second
 )
 
 type Client struct {
 	client    *hcloud.Client
 	sshKeyID  int64
 	networkID int64
+	publicNet PublicNetwork
 }
 
-func NewClient(token string, sshKeyID, networkID int64) *Client {
+func NewClient(token string, sshKeyID, networkID int64, publicNet PublicNetwork) *Client {
 	return &Client{
-		client:    hcloud.NewClient(hcloud.WithToken(token)),
+		client: hcloud.NewClient(
+			hcloud.WithToken(token),
+			// Callers bound whole operations with their context; this stops
+			// a single stalled request from holding one open forever
+			hcloud.WithHTTPClient(&http.Client{Timeout: 30 * time.Second}),
+		),
 		sshKeyID:  sshKeyID,
 		networkID: networkID,
+		publicNet: publicNet,
+	}
+}
+
+var (
+	_ provider.Provider = (*Client)(nil)
+	_ provider.Console  = (*Client)(nil)
+)
+
+func (c *Client) Name() string {
+	return Name
+}
+
+// Ping checks that the Hetzner API is reachable and accepts the token
+func (c *Client) Ping(ctx context.Context) error {
+	_, _, err := c.client.Location.List(ctx, hcloud.LocationListOpts{
+		ListOpts: hcloud.ListOpts{PerPage: 1},
+	})
+	if err != nil {
+		return fmt.Errorf("list locations: %w", err)
+	}
+	return nil
+}
+
+// Catalog lists the server types and locations currently offered, skipping
+// deprecated server types, and the golden images built with BuildImage
+func (c *Client) Catalog(ctx context.Context) (*models.Catalog, error) {
+	serverTypes, err := c.client.ServerType.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list server types: %w", err)
+	}
+
+	locations, err := c.client.Location.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list locations: %w", err)
+	}
+
+	cat := &models.Catalog{}
+	for _, st := range serverTypes {
+		if st.IsDeprecated() {
+			continue
+		}
+
+		option := models.ServerTypeOption{
+			Name:        st.Name,
+			Description: st.Description,
+			Cores:       st.Cores,
+			MemoryGB:    st.Memory,
+			DiskGB:      st.Disk,
+		}
+		for _, pricing := range st.Pricings {
+			if pricing.Location != nil {
+				option.Locations = append(option.Locations, pricing.Location.Name)
+			}
+		}
+		cat.ServerTypes = append(cat.ServerTypes, option)
+	}
+
+	for _, l := range locations {
+		cat.Locations = append(cat.Locations, models.LocationOption{
+			Name:    l.Name,
+			City:    l.City,
+			Country: l.Country,
+		})
+	}
+
+	snapshots, err := c.client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: ImageLabel},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		Sort:     []string{"created:desc"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list golden images: %w", err)
 	}
+
+	seen := map[string]bool{}
+	for _, image := range snapshots {
+		name := image.Labels[ImageLabel]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		cat.Images = append(cat.Images, models.ImageOption{
+			Name:        name,
+			Description: image.Description,
+			Golden:      true,
+		})
+	}
+
+	return cat, nil
 }
 
 func (c *Client) CreateVM(ctx context.Context, vm *models.VM, cloudInitScript string) error {
-	serverType, err := c.client.ServerType.GetByName(ctx, vm.Spec.Type)
+	serverType, _, err := c.client.ServerType.GetByName(ctx, vm.Spec.Type)
 	if err != nil {
 		return fmt.Errorf("get server type: %w", err)
 	}
 
-	location, err := c.client.Location.GetByName(ctx, vm.Spec.Location)
+	location, _, err := c.client.Location.GetByName(ctx, vm.Spec.Location)
 	if err != nil {
 		return fmt.Errorf("get location: %w", err)
 	}
 
-	image, err := c.client.Image.GetByName(ctx, "ubuntu-22.04")
+	imageName := vm.Spec.Image
+	if imageName == "" {
+		imageName = DefaultImage
+	}
+
+	image, err := c.findImage(ctx, imageName, serverType.Architecture)
 	if err != nil {
 		return fmt.Errorf("get image: %w", err)
 	}
 
-	sshKey, err := c.client.SSHKey.GetByID(ctx, c.sshKeyID)
+	sshKey, _, err := c.client.SSHKey.GetByID(ctx, c.sshKeyID)
 	if err != nil {
 		return fmt.Errorf("get ssh key: %w", err)
 	}
 
-	network, err := c.client.Network.GetByID(ctx, c.networkID)
+	network, _, err := c.client.Network.GetByID(ctx, c.networkID)
 	if err != nil && c.networkID != 0 {
 		return fmt.Errorf("get network: %w", err)
 	}
@@ -57,28 +204,41 @@ func (c *Client) CreateVM(ctx context.Context, vm *models.VM, cloudInitScript st
 		Location:   location,
 		SSHKeys:    []*hcloud.SSHKey{sshKey},
 		UserData:   cloudInitScript,
-		Labels: map[string]string{
-			"user_id":    vm.UserID,
-			"vm_id":      vm.ID,
-			"created_at": vm.CreatedAt.Format(time.RFC3339),
-		},
+		Labels:     serverLabels(vm),
 	}
 
 	if network != nil {
 		opts.Networks = []*hcloud.Network{network}
 	}
 
+	switch c.publicNet {
+	case PublicNetworkIPv6:
+		opts.PublicNet = &hcloud.ServerCreatePublicNet{EnableIPv6: true}
+	case PublicNetworkNone:
+		if network == nil {
+			return fmt.Errorf("public network mode none requires a private network")
+		}
+		opts.PublicNet = &hcloud.ServerCreatePublicNet{}
+	}
+
 	result, _, err := c.client.Server.Create(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("create server: %w", err)
 	}
 
-	vm.HetznerID = result.Server.ID
+	vm.ProviderID = strconv.FormatInt(result.Server.ID, 10)
 	
-	log.Info().
+	requestid.Logger(ctx).Info().
 		Int64("hetzner_id", result.Server.ID).
 		Str("vm_id", vm.ID).
 		Msg("VM created in Hetzner")
+	provider.MachineCreated(ctx)
+
+	// Without a public IPv4 there is nothing to wait for; the VM is
+	// reachable once it joins the tailnet
+	if c.publicNet != PublicNetworkDualStack {
+		return nil
+	}
 
 	// Wait for the server to get an IP
 	server, err := c.waitForIP(ctx, result.Server.ID)
@@ -86,16 +246,86 @@ func (c *Client) CreateVM(ctx context.Context, vm *models.VM, cloudInitScript st
 		return fmt.Errorf("wait for IP: %w", err)
 	}
 
-	log.Info().
-		Str("public_ip", server.PublicNet.IPv4.IP.String()).
+	vm.PublicIP = server.PublicNet.IPv4.IP.String()
+
+	requestid.Logger(ctx).Info().
+		Str("public_ip", vm.PublicIP).
 		Str("vm_id", vm.ID).
 		Msg("VM received public IP")
 
 	return nil
 }
 
+// findImage resolves a system image name, a snapshot labeled with
+// ImageLabel (the newest wins) or an image ID
+func (c *Client) findImage(ctx context.Context, name string, arch hcloud.Architecture) (*hcloud.Image, error) {
+	image, _, err := c.client.Image.GetForArchitecture(ctx, name, arch)
+	if err != nil {
+		return nil, err
+	}
+	if image != nil {
+		return image, nil
+	}
+
+	snapshots, err := c.client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+		ListOpts:     hcloud.ListOpts{LabelSelector: ImageLabel + "=" + name},
+		Type:         []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		Architecture: []hcloud.Architecture{arch},
+		Sort:         []string{"created:desc"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("image %q not found", name)
+	}
+	return snapshots[0], nil
+}
+
+// UpdateLabels replaces the user labels on the VM's server
+func (c *Client) UpdateLabels(ctx context.Context, vm *models.VM) error {
+	id, err := serverID(vm)
+	if err != nil {
+		return err
+	}
+	server := &hcloud.Server{ID: id}
+	if _, _, err := c.client.Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: serverLabels(vm)}); err != nil {
+		return fmt.Errorf("update server labels: %w", err)
+	}
+	return nil
+}
+
+// serverLabels combines the labels the control plane relies on with the
+// user's labels, which cannot use the same keys
+func serverLabels(vm *models.VM) map[string]string {
+	labels := map[string]string{
+		"user_id":    vm.UserID,
+		"vm_id":      vm.ID,
+		"created_at": vm.CreatedAt.Format(time.RFC3339),
+	}
+	for key, value := range vm.Labels {
+		if !isSystemLabel(key) {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+func isSystemLabel(key string) bool {
+	return key == "user_id" || key == "vm_id" || key == "created_at"
+}
+
+// serverID parses the Hetzner server ID stored as the VM's provider ID
+func serverID(vm *models.VM) (int64, error) {
+	id, err := strconv.ParseInt(vm.ProviderID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hetzner server id %q", vm.ProviderID)
+	}
+	return id, nil
+}
+
 func (c *Client) waitForIP(ctx context.Context, serverID int64) (*hcloud.Server, error) {
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(ipPollInterval)
 	defer ticker.Stop()
 
 	timeout := time.NewTimer(60 * time.Second)
@@ -109,7 +339,7 @@ func (c *Client) waitForIP(ctx context.Context, serverID int64) (*hcloud.Server,
 				return nil, err
 			}
 			
-			if server.PublicNet.IPv4 != nil && server.PublicNet.IPv4.IP != nil {
+			if !server.PublicNet.IPv4.IsUnspecified() {
 				return server, nil
 			}
 			
@@ -121,7 +351,12 @@ func (c *Client) waitForIP(ctx context.Context, serverID int64) (*hcloud.Server,
 	}
 }
 
-func (c *Client) DeleteVM(ctx context.Context, hetznerID int64) error {
+func (c *Client) DeleteVM(ctx context.Context, vm *models.VM) error {
+	hetznerID, err := serverID(vm)
+	if err != nil {
+		return err
+	}
+
 	server, _, err := c.client.Server.GetByID(ctx, hetznerID)
 	if err != nil {
 		return fmt.Errorf("get server: %w", err)
@@ -131,18 +366,45 @@ func (c *Client) DeleteVM(ctx context.Context, hetznerID int64) error {
 		return nil // Already deleted
 	}
 
-	_, _, err = c.client.Server.Delete(ctx, server)
+	_, _, err = c.client.Server.DeleteWithResult(ctx, server)
 	if err != nil {
 		return fmt.Errorf("delete server: %w", err)
 	}
 
-	log.Info().
+	requestid.Logger(ctx).Info().
 		Int64("hetzner_id", hetznerID).
 		Msg("VM deleted from Hetzner")
 
 	return nil
 }
 
+// Console requests a VNC console on the server. The URL and password are
+// valid for one minute.
+func (c *Client) Console(ctx context.Context, vm *models.VM) (*models.ConsoleResponse, error) {
+	hetznerID, err := serverID(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	server, _, err := c.client.Server.GetByID(ctx, hetznerID)
+	if err != nil {
+		return nil, fmt.Errorf("get server: %w", err)
+	}
+	if server == nil {
+		return nil, fmt.Errorf("server %d not found", hetznerID)
+	}
+
+	result, _, err := c.client.Server.RequestConsole(ctx, server)
+	if err != nil {
+		return nil, fmt.Errorf("request console: %w", err)
+	}
+
+	return &models.ConsoleResponse{
+		URL:      result.WSSURL,
+		Password: result.Password,
+	}, nil
+}
+
 func (c *Client) GetVM(ctx context.Context, hetznerID int64) (*hcloud.Server, error) {
 	server, _, err := c.client.Server.GetByID(ctx, hetznerID)
 	if err != nil {
@@ -188,10 +450,14 @@ func (c *Client) PowerOnVM(ctx context.Context, hetznerID int64) error {
 }
 
 func (c *Client) waitForAction(ctx context.Context, action *hcloud.Action) error {
-	ticker := time.NewTicker(1 * time.Second)
+	return c.waitForActionTimeout(ctx, action, 5*time.Minute)
+}
+
+func (c *Client) waitForActionTimeout(ctx context.Context, action *hcloud.Action, limit time.Duration) error {
+	ticker := time.NewTicker(actionPollInterval)
 	defer ticker.Stop()
 
-	timeout := time.NewTimer(5 * time.Minute)
+	timeout := time.NewTimer(limit)
 	defer timeout.Stop()
 
 	for {
@@ -216,4 +482,134 @@ func (c *Client) waitForAction(ctx context.Context, action *hcloud.Action) error
 			return ctx.Err()
 		}
 	}
-}
\ No newline at end of file
+}
+
+// BuildImageOpts describes a golden image build
+type BuildImageOpts struct {
+	// Name is the image's catalog name, stored in ImageLabel
+	Name string
+
+	ServerType string
+	Location   string
+
+	// BaseImage is the system image the build starts from
+	BaseImage string
+
+	// UserData installs everything and powers the server off when done
+	UserData string
+
+	// Timeout bounds the whole build
+	Timeout time.Duration
+}
+
+// BuildImage boots a temporary server with opts.UserData, waits for it to
+// power itself off, snapshots it and deletes the server. The snapshot is
+// labeled with ImageLabel so VMs can boot it by name.
+func (c *Client) BuildImage(ctx context.Context, opts BuildImageOpts) (*hcloud.Image, error) {
+	logger := requestid.Logger(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	serverType, _, err := c.client.ServerType.GetByName(ctx, opts.ServerType)
+	if err != nil {
+		return nil, fmt.Errorf("get server type: %w", err)
+	}
+	if serverType == nil {
+		return nil, fmt.Errorf("server type %q not found", opts.ServerType)
+	}
+
+	location, _, err := c.client.Location.GetByName(ctx, opts.Location)
+	if err != nil {
+		return nil, fmt.Errorf("get location: %w", err)
+	}
+	if location == nil {
+		return nil, fmt.Errorf("location %q not found", opts.Location)
+	}
+
+	baseImage, err := c.findImage(ctx, opts.BaseImage, serverType.Architecture)
+	if err != nil {
+		return nil, fmt.Errorf("get base image: %w", err)
+	}
+
+	createOpts := hcloud.ServerCreateOpts{
+		Name:       fmt.Sprintf("devtail-image-%s-%d", opts.Name, time.Now().Unix()),
+		ServerType: serverType,
+		Image:      baseImage,
+		Location:   location,
+		UserData:   opts.UserData,
+		Labels:     map[string]string{"devtail-image-build": opts.Name},
+	}
+	if c.sshKeyID != 0 {
+		createOpts.SSHKeys = []*hcloud.SSHKey{{ID: c.sshKeyID}}
+	}
+
+	result, _, err := c.client.Server.Create(ctx, createOpts)
+	if err != nil {
+		return nil, fmt.Errorf("create build server: %w", err)
+	}
+	server := result.Server
+
+	// The build server is always removed, even when the build fails or
+	// times out
+	defer func() {
+		if _, _, err := c.client.Server.DeleteWithResult(context.Background(), server); err != nil {
+			logger.Error().Err(err).Int64("hetzner_id", server.ID).Msg("Failed to delete image build server")
+		}
+	}()
+
+	logger.Info().
+		Int64("hetzner_id", server.ID).
+		Str("image", opts.Name).
+		Msg("Image build server created, waiting for cloud-init to finish")
+
+	if err := c.waitForStatus(ctx, server.ID, hcloud.ServerStatusOff); err != nil {
+		return nil, fmt.Errorf("wait for build to finish: %w", err)
+	}
+
+	description := fmt.Sprintf("devtail golden image %s (%s)", opts.Name, opts.BaseImage)
+	image, _, err := c.client.Server.CreateImage(ctx, server, &hcloud.ServerCreateImageOpts{
+		Type:        hcloud.ImageTypeSnapshot,
+		Description: &description,
+		Labels:      map[string]string{ImageLabel: opts.Name},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create snapshot: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.waitForActionTimeout(ctx, image.Action, time.Until(deadline)); err != nil {
+		return nil, fmt.Errorf("wait for snapshot: %w", err)
+	}
+
+	logger.Info().
+		Int64("image_id", image.Image.ID).
+		Str("image", opts.Name).
+		Msg("Golden image created")
+
+	return image.Image, nil
+}
+
+// waitForStatus polls until the server reaches status
+func (c *Client) waitForStatus(ctx context.Context, serverID int64, status hcloud.ServerStatus) error {
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			server, _, err := c.client.Server.GetByID(ctx, serverID)
+			if err != nil {
+				return err
+			}
+			if server == nil {
+				return fmt.Errorf("server %d disappeared", serverID)
+			}
+			if server.Status == status {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package hetzner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// fakeHetzner serves the parts of the Hetzner API the client uses, keeping
+// servers and snapshots in memory. Servers come up with their public IPv4,
+// if they have one, and powered off, as an image build leaves them, the
+// first time they are fetched.
+type fakeHetzner struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	nextID    int64
+	servers   map[int64]*schema.Server
+	created   []schema.ServerCreateRequest
+	deleted   []int64
+	snapshots []schema.Image
+
+	// failCreateImage makes snapshots fail, as when the build broke the
+	// server
+	failCreateImage bool
+}
+
+// fakeNetworkID is the private network the fake knows of
+const fakeNetworkID = 7
+
+func newFakeHetzner(t *testing.T) *fakeHetzner {
+	return &fakeHetzner{t: t, nextID: 100, servers: make(map[int64]*schema.Server)}
+}
+
+// client returns a Client talking to the fake, polling without delay
+func (f *fakeHetzner) client(networkID int64, publicNet PublicNetwork) *Client {
+	srv := httptest.NewServer(f)
+	f.t.Cleanup(srv.Close)
+
+	for _, interval := range []*time.Duration{&ipPollInterval, &actionPollInterval, &statusPollInterval} {
+		saved := *interval
+		*interval = time.Millisecond
+		f.t.Cleanup(func() { *interval = saved })
+	}
+
+	return &Client{
+		client:    hcloud.NewClient(hcloud.WithToken("test"), hcloud.WithEndpoint(srv.URL)),
+		sshKeyID:  1,
+		networkID: networkID,
+		publicNet: publicNet,
+	}
+}
+
+func (f *fakeHetzner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && path[0] == "server_types":
+		f.reply(w, schema.ServerTypeListResponse{ServerTypes: []schema.ServerType{
+			{ID: 1, Name: query.Get("name"), Architecture: string(hcloud.ArchitectureX86)},
+		}})
+	case r.Method == http.MethodGet && path[0] == "locations":
+		f.reply(w, schema.LocationListResponse{Locations: []schema.Location{{ID: 1, Name: query.Get("name")}}})
+	case r.Method == http.MethodGet && path[0] == "images":
+		f.reply(w, schema.ImageListResponse{Images: f.images(query.Get("name"), query.Get("label_selector"))})
+	case r.Method == http.MethodGet && path[0] == "ssh_keys":
+		f.reply(w, schema.SSHKeyGetResponse{SSHKey: schema.SSHKey{ID: 1, Name: "devtail"}})
+	case r.Method == http.MethodGet && path[0] == "networks":
+		if path[1] != strconv.Itoa(fakeNetworkID) {
+			f.notFound(w)
+			return
+		}
+		f.reply(w, schema.NetworkGetResponse{Network: schema.Network{ID: fakeNetworkID, Name: "devtail"}})
+	case r.Method == http.MethodPost && len(path) == 1 && path[0] == "servers":
+		f.createServer(w, r)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "servers":
+		server := f.server(path[1])
+		if server == nil {
+			f.notFound(w)
+			return
+		}
+		f.reply(w, schema.ServerGetResponse{Server: *server})
+	case r.Method == http.MethodDelete && len(path) == 2 && path[0] == "servers":
+		server := f.server(path[1])
+		if server == nil {
+			f.notFound(w)
+			return
+		}
+		delete(f.servers, server.ID)
+		f.deleted = append(f.deleted, server.ID)
+		f.reply(w, schema.ServerDeleteResponse{Action: f.action("delete_server")})
+	case r.Method == http.MethodPost && len(path) == 4 && path[3] == "create_image":
+		f.createImage(w, r, path[1])
+	case r.Method == http.MethodGet && path[0] == "actions":
+		id, _ := strconv.ParseInt(path[1], 10, 64)
+		f.reply(w, schema.ActionGetResponse{Action: schema.Action{ID: id, Status: string(hcloud.ActionStatusSuccess)}})
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		f.notFound(w)
+	}
+}
+
+// images returns the system image called name, or the snapshots matching
+// the label selector
+func (f *fakeHetzner) images(name, selector string) []schema.Image {
+	if name != "" {
+		if name != DefaultImage {
+			return nil
+		}
+		return []schema.Image{{ID: 10, Name: &name, Type: string(hcloud.ImageTypeSystem), Architecture: string(hcloud.ArchitectureX86)}}
+	}
+
+	var images []schema.Image
+	for _, image := range f.snapshots {
+		key, value, _ := strings.Cut(selector, "=")
+		if label, ok := image.Labels[key]; ok && (value == "" || label == value) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+func (f *fakeHetzner) createServer(w http.ResponseWriter, r *http.Request) {
+	var req schema.ServerCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("decode server: %v", err)
+	}
+	f.created = append(f.created, req)
+
+	f.nextID++
+	server := &schema.Server{ID: f.nextID, Name: req.Name, Status: string(hcloud.ServerStatusInitializing)}
+	f.servers[server.ID] = server
+	f.reply(w, schema.ServerCreateResponse{Server: *server, Action: f.action("create_server")})
+
+	// Fetched from now on, the server is up
+	if req.PublicNet == nil || req.PublicNet.EnableIPv4 {
+		server.PublicNet.IPv4.IP = "203.0.113.10"
+	}
+	server.Status = string(hcloud.ServerStatusOff)
+}
+
+func (f *fakeHetzner) createImage(w http.ResponseWriter, r *http.Request, serverID string) {
+	if f.server(serverID) == nil {
+		f.notFound(w)
+		return
+	}
+	if f.failCreateImage {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(schema.ErrorResponse{Error: schema.Error{Code: "server_error", Message: "snapshot failed"}})
+		return
+	}
+
+	var req schema.ServerActionCreateImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("decode image: %v", err)
+	}
+	f.nextID++
+	image := schema.Image{ID: f.nextID, Type: *req.Type, Description: *req.Description, Architecture: string(hcloud.ArchitectureX86)}
+	if req.Labels != nil {
+		image.Labels = *req.Labels
+	}
+	f.snapshots = append(f.snapshots, image)
+
+	action := f.action("create_image")
+	f.reply(w, schema.ServerActionCreateImageResponse{Image: image, Action: action})
+}
+
+func (f *fakeHetzner) server(id string) *schema.Server {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return f.servers[n]
+}
+
+func (f *fakeHetzner) action(command string) schema.Action {
+	f.nextID++
+	return schema.Action{ID: f.nextID, Command: command, Status: string(hcloud.ActionStatusRunning)}
+}
+
+func (f *fakeHetzner) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeHetzner) notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(schema.ErrorResponse{Error: schema.Error{Code: string(hcloud.ErrorCodeNotFound), Message: "not found"}})
+}
+
+func TestBuildImage(t *testing.T) {
+	fake := newFakeHetzner(t)
+	c := fake.client(0, PublicNetworkDualStack)
+
+	image, err := c.BuildImage(context.Background(), BuildImageOpts{
+		Name:       "node20",
+		ServerType: "cx22",
+		Location:   "fsn1",
+		BaseImage:  DefaultImage,
+		UserData:   "#cloud-config\n",
+		Timeout:    10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.created) != 1 || fake.created[0].Image != float64(10) || fake.created[0].UserData != "#cloud-config\n" {
+		t.Fatalf("expected one build server from the base image, got %+v", fake.created)
+	}
+	if len(fake.snapshots) != 1 || fake.snapshots[0].Labels[ImageLabel] != "node20" || fake.snapshots[0].Type != string(hcloud.ImageTypeSnapshot) {
+		t.Fatalf("expected a snapshot labeled node20, got %+v", fake.snapshots)
+	}
+	if image.ID != fake.snapshots[0].ID {
+		t.Errorf("expected image %d, got %d", fake.snapshots[0].ID, image.ID)
+	}
+	if len(fake.servers) != 0 || len(fake.deleted) != 1 {
+		t.Errorf("expected the build server deleted, still have %d", len(fake.servers))
+	}
+}
+
+func TestBuildImageFailureDeletesServer(t *testing.T) {
+	fake := newFakeHetzner(t)
+	fake.failCreateImage = true
+	c := fake.client(0, PublicNetworkDualStack)
+
+	_, err := c.BuildImage(context.Background(), BuildImageOpts{
+		Name:       "node20",
+		ServerType: "cx22",
+		Location:   "fsn1",
+		BaseImage:  DefaultImage,
+		Timeout:    10 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.servers) != 0 || len(fake.deleted) != 1 {
+		t.Errorf("expected the build server deleted after a failed build, still have %d", len(fake.servers))
+	}
+}
+
+func TestBuildImageUnknownBaseImage(t *testing.T) {
+	fake := newFakeHetzner(t)
+	c := fake.client(0, PublicNetworkDualStack)
+
+	_, err := c.BuildImage(context.Background(), BuildImageOpts{
+		Name:       "node20",
+		ServerType: "cx22",
+		Location:   "fsn1",
+		BaseImage:  "debian-99",
+		Timeout:    10 * time.Second,
+	})
+	if err == nil || !strings.Contains(err.Error(), "debian-99") {
+		t.Fatalf("expected the unknown base image to be reported, got %v", err)
+	}
+	if len(fake.created) != 0 {
+		t.Errorf("expected no build server, got %+v", fake.created)
+	}
+}
+
+func TestCreateVMPublicNetwork(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicNet PublicNetwork
+		networkID int64
+
+		// want is the public network asked for, nil for Hetzner's default
+		// of both families
+		want     *schema.ServerCreatePublicNet
+		publicIP string
+		fails    bool
+	}{
+		{name: "dual stack", publicNet: PublicNetworkDualStack, publicIP: "203.0.113.10"},
+		{name: "dual stack on private network", publicNet: PublicNetworkDualStack, networkID: fakeNetworkID, publicIP: "203.0.113.10"},
+		{name: "ipv6 only", publicNet: PublicNetworkIPv6, want: &schema.ServerCreatePublicNet{EnableIPv6: true}},
+		{name: "ipv6 only on private network", publicNet: PublicNetworkIPv6, networkID: fakeNetworkID, want: &schema.ServerCreatePublicNet{EnableIPv6: true}},
+		{name: "none", publicNet: PublicNetworkNone, networkID: fakeNetworkID, want: &schema.ServerCreatePublicNet{}},
+		{name: "none without private network", publicNet: PublicNetworkNone, fails: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeHetzner(t)
+			c := fake.client(tt.networkID, tt.publicNet)
+
+			vm := &models.VM{ID: "vm-1", UserID: "user-1", Spec: models.VMSpec{Type: "cx22", Location: "fsn1"}}
+			err := c.CreateVM(context.Background(), vm, "#cloud-config\n")
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if tt.fails {
+				if err == nil {
+					t.Fatal("expected the VM to be refused")
+				}
+				if len(fake.created) != 0 {
+					t.Errorf("expected no server created, got %+v", fake.created)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fake.created) != 1 {
+				t.Fatalf("expected one server created, got %d", len(fake.created))
+			}
+			req := fake.created[0]
+			switch {
+			case tt.want == nil && req.PublicNet != nil:
+				t.Errorf("expected the default public network, got %+v", *req.PublicNet)
+			case tt.want != nil && (req.PublicNet == nil || *req.PublicNet != *tt.want):
+				t.Errorf("expected public network %+v, got %+v", *tt.want, req.PublicNet)
+			}
+			if tt.networkID != 0 && (len(req.Networks) != 1 || req.Networks[0] != tt.networkID) {
+				t.Errorf("expected network %d attached, got %v", tt.networkID, req.Networks)
+			}
+			if tt.networkID == 0 && len(req.Networks) != 0 {
+				t.Errorf("expected no network attached, got %v", req.Networks)
+			}
+
+			if vm.PublicIP != tt.publicIP {
+				t.Errorf("expected public IP %q, got %q", tt.publicIP, vm.PublicIP)
+			}
+			if vm.ProviderID == "" {
+				t.Error("expected the server ID stored as the provider ID")
+			}
+		})
+	}
+}
+
+func TestParsePublicNetwork(t *testing.T) {
+	for mode, want := range map[string]PublicNetwork{
+		"":           PublicNetworkDualStack,
+		"dual-stack": PublicNetworkDualStack,
+		"ipv6":       PublicNetworkIPv6,
+		"none":       PublicNetworkNone,
+	} {
+		got, err := ParsePublicNetwork(mode)
+		if err != nil || got != want {
+			t.Errorf("%q: expected %s, got %s, %v", mode, want, got, err)
+		}
+	}
+	if _, err := ParsePublicNetwork("ipv4"); err == nil {
+		t.Error("expected an unknown mode to be refused")
+	}
+}
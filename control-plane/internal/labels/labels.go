@@ -0,0 +1,158 @@
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxLabels caps the labels on one VM
+	MaxLabels = 32
+
+	maxNameLength  = 63
+	maxValueLength = 63
+)
+
+// reserved keys are set by the control plane on provider resources
+var reserved = map[string]bool{
+	"user_id":    true,
+	"vm_id":      true,
+	"created_at": true,
+}
+
+// Names and values follow Hetzner's label rules, so labels can be pushed to
+// servers unchanged: alphanumerics with - _ . inside, and keys may carry a
+// DNS prefix such as example.com/team
+var (
+	namePattern  = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]*[a-zA-Z0-9])?$`)
+	valuePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9._-]*[a-zA-Z0-9])?)?$`)
+)
+
+// Validate checks user-supplied labels
+func Validate(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("at most %d labels are allowed", MaxLabels)
+	}
+	for key, value := range labels {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		if len(value) > maxValueLength || !valuePattern.MatchString(value) {
+			return fmt.Errorf("label %q has invalid value %q", key, value)
+		}
+	}
+	return nil
+}
+
+func validateKey(key string) error {
+	if reserved[key] {
+		return fmt.Errorf("label key %q is reserved", key)
+	}
+
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > 253 || !namePattern.MatchString(strings.ReplaceAll(prefix, ".", "-")) {
+			return fmt.Errorf("label key %q has invalid prefix", key)
+		}
+	}
+	if len(name) > maxNameLength || !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+	return nil
+}
+
+// operator of one selector requirement
+type operator int
+
+const (
+	opEquals operator = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key   string
+	op    operator
+	value string
+}
+
+// Selector filters VMs by label. The syntax is a comma-separated list of
+// requirements, all of which must hold:
+//
+//	project=devtail    label equals value
+//	branch!=main       label is absent or differs
+//	ticket             label is present
+//	!archived          label is absent
+type Selector []requirement
+
+// ParseSelector parses a selector; an empty string matches everything
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = requirement{key: kv[0], op: opNotEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = requirement{key: kv[0], op: opEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = requirement{key: part[1:], op: opNotExists}
+		default:
+			req = requirement{key: part, op: opExists}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", part)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch req.op {
+		case opEquals:
+			if !ok || value != req.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && value == req.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Copy returns a copy of labels, never nil
+func Copy(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
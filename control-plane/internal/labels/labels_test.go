@@ -0,0 +1,122 @@
+package labels
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxLabels; i++ {
+		tooMany[fmt.Sprintf("label-%d", i)] = "x"
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"simple", map[string]string{"team": "platform", "env": "dev"}, false},
+		{"punctuation inside", map[string]string{"app.tier_1-a": "v1.2_3-rc"}, false},
+		{"prefixed key", map[string]string{"example.com/team": "a"}, false},
+		{"empty value", map[string]string{"ticket": ""}, false},
+		{"longest name and value", map[string]string{strings.Repeat("k", 63): strings.Repeat("v", 63)}, false},
+		{"too many", tooMany, true},
+		{"reserved key", map[string]string{"user_id": "someone-else"}, true},
+		{"empty key", map[string]string{"": "a"}, true},
+		{"key with space", map[string]string{"my team": "a"}, true},
+		{"key ending in punctuation", map[string]string{"team-": "a"}, true},
+		{"name too long", map[string]string{strings.Repeat("k", 64): "a"}, true},
+		{"empty prefix", map[string]string{"/team": "a"}, true},
+		{"empty name after prefix", map[string]string{"example.com/": "a"}, true},
+		{"prefix with slash", map[string]string{"a/b/team": "a"}, true},
+		{"value with space", map[string]string{"team": "a b"}, true},
+		{"value starting with punctuation", map[string]string{"team": ".a"}, true},
+		{"value too long", map[string]string{"team": strings.Repeat("v", 64)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%v) = %v, want error %v", tt.labels, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     Selector
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{" , ", nil, false},
+		{"project=devtail", Selector{{key: "project", op: opEquals, value: "devtail"}}, false},
+		{"branch!=main", Selector{{key: "branch", op: opNotEquals, value: "main"}}, false},
+		{"ticket", Selector{{key: "ticket", op: opExists}}, false},
+		{"!archived", Selector{{key: "archived", op: opNotExists}}, false},
+		{" project = devtail , !archived ", Selector{
+			{key: "project", op: opEquals, value: "devtail"},
+			{key: "archived", op: opNotExists},
+		}, false},
+		{"note=a=b", Selector{{key: "note", op: opEquals, value: "a=b"}}, false},
+		{"ticket=", Selector{{key: "ticket", op: opEquals}}, false},
+		{"=devtail", nil, true},
+		{"!=main", nil, true},
+		{"!", nil, true},
+		{"project=devtail,=x", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	vmLabels := map[string]string{"project": "devtail", "branch": "feature", "ticket": ""}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"project=devtail", true},
+		{"project=other", false},
+		{"branch!=main", true},
+		{"branch!=feature", false},
+		{"owner!=someone", true},
+		{"ticket", true},
+		{"owner", false},
+		{"!archived", true},
+		{"!ticket", false},
+		{"project=devtail,branch!=main,!archived", true},
+		{"project=devtail,owner", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Matches(vmLabels); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
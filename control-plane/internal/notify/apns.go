@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+
+	// apnsTokenTTL is how long a provider token is reused. Apple rejects
+	// tokens older than an hour, and ones refreshed more often than every
+	// 20 minutes.
+	apnsTokenTTL = 50 * time.Minute
+)
+
+// APNsConfig authenticates with Apple Push Notification service using a
+// token signing key from the Apple developer account
+type APNsConfig struct {
+	// Key is the contents of the .p8 signing key, KeyID its ID
+	Key   []byte
+	KeyID string
+
+	TeamID string
+
+	// Topic is the app's bundle ID
+	Topic string
+
+	// Sandbox sends to development builds of the app
+	Sandbox bool
+}
+
+// APNs pushes events to the user's Apple device tokens over HTTP/2
+type APNs struct {
+	config  APNsConfig
+	key     *ecdsa.PrivateKey
+	baseURL string
+	http    *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+var _ Notifier = (*APNs)(nil)
+
+func NewAPNs(config APNsConfig) (*APNs, error) {
+	if config.KeyID == "" || config.TeamID == "" || config.Topic == "" {
+		return nil, errors.New("key ID, team ID and topic are required")
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key: %w", err)
+	}
+
+	baseURL := apnsProductionURL
+	if config.Sandbox {
+		baseURL = apnsSandboxURL
+	}
+	return &APNs{
+		config:  config,
+		key:     key,
+		baseURL: baseURL,
+		// The default transport negotiates HTTP/2, which APNs requires
+		http: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (a *APNs) Name() string {
+	return "apns"
+}
+
+func (a *APNs) Notify(ctx context.Context, event Event, targets []models.NotificationTarget) error {
+	targets = targetsOf(targets, models.TargetAPNs)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	token, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, target := range targets {
+		if err := a.send(ctx, token, event, target.Address); err != nil {
+			errs = append(errs, &TargetError{Target: target, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *APNs) send(ctx context.Context, token string, event Event, device string) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{
+				"title": event.Title,
+				"body":  event.Body,
+			},
+			"sound": "default",
+		},
+		"event": event.Kind,
+		"vm_id": event.VMID,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/3/device/"+device, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", a.config.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("send notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = json.Unmarshal(msg, &reason)
+
+	// 410 Gone: the app was uninstalled or the token expired
+	if resp.StatusCode == http.StatusGone || reason.Reason == "BadDeviceToken" || reason.Reason == "Unregistered" {
+		return fmt.Errorf("%w: %s %s", ErrUnregistered, resp.Status, reason.Reason)
+	}
+	return fmt.Errorf("apns: %s - %s", resp.Status, reason.Reason)
+}
+
+// providerToken returns the signed token APNs requests are authorized
+// with, signing a new one when the last is due to be replaced
+func (a *APNs) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Since(a.issuedAt) < apnsTokenTTL {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": a.config.TeamID,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = a.config.KeyID
+	signed, err := token.SignedString(a.key)
+	if err != nil {
+		return "", fmt.Errorf("sign provider token: %w", err)
+	}
+
+	a.token, a.issuedAt = signed, now
+	return signed, nil
+}
@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fcmScope   = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmBaseURL = "https://fcm.googleapis.com/v1"
+)
+
+// FCM pushes events to the user's Firebase Cloud Messaging registration
+// tokens with the HTTP v1 API, authenticating as a service account
+type FCM struct {
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	baseURL     string
+	http        *http.Client
+
+	// The OAuth access token exchanged for a signed assertion, reused
+	// until shortly before it expires
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+var _ Notifier = (*FCM)(nil)
+
+// NewFCM reads a service account key file's contents, as downloaded from
+// the Firebase console
+func NewFCM(credentials []byte) (*FCM, error) {
+	var account struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(credentials, &account); err != nil {
+		return nil, fmt.Errorf("parse service account: %w", err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("service account is missing project_id, client_email or token_uri")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse service account key: %w", err)
+	}
+
+	return &FCM{
+		projectID:   account.ProjectID,
+		clientEmail: account.ClientEmail,
+		tokenURI:    account.TokenURI,
+		key:         key,
+		baseURL:     fcmBaseURL,
+		http:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (f *FCM) Name() string {
+	return "fcm"
+}
+
+func (f *FCM) Notify(ctx context.Context, event Event, targets []models.NotificationTarget) error {
+	targets = targetsOf(targets, models.TargetFCM)
+	if len(targets) == 0 {
+		return nil
+	}
+
+	token, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, target := range targets {
+		if err := f.send(ctx, token, event, target.Address); err != nil {
+			errs = append(errs, &TargetError{Target: target, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *FCM) send(ctx context.Context, accessToken string, event Event, registration string) error {
+	message := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": registration,
+			"notification": map[string]string{
+				"title": event.Title,
+				"body":  event.Body,
+			},
+			"data": map[string]string{
+				"event": string(event.Kind),
+				"vm_id": event.VMID,
+			},
+		},
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/projects/%s/messages:send", f.baseURL, f.projectID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("send message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	// A token the app no longer holds is reported as UNREGISTERED, with
+	// 404 Not Found
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(msg, []byte("UNREGISTERED")) {
+		return fmt.Errorf("%w: %s", ErrUnregistered, resp.Status)
+	}
+	return fmt.Errorf("fcm: %s - %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// token returns an access token for the FCM scope, signing a fresh
+// assertion for the service account when the last token is about to expire
+func (f *FCM) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.accessToken != "" && time.Until(f.expiresAt) > time.Minute {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.clientEmail,
+		"scope": fcmScope,
+		"aud":   f.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(f.key)
+	if err != nil {
+		return "", fmt.Errorf("sign assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("get access token: %s - %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decode access token: %w", err)
+	}
+
+	f.accessToken = token.AccessToken
+	f.expiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return f.accessToken, nil
+}
@@ -0,0 +1,204 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// queueSize bounds the events waiting for delivery; more are dropped
+	queueSize = 256
+
+	// sendTimeout bounds delivering one event through every notifier
+	sendTimeout = 30 * time.Second
+)
+
+// ErrUnregistered is wrapped by errors for a target that will never accept
+// a notification again, such as the push token of an uninstalled app
+var ErrUnregistered = errors.New("target is no longer registered")
+
+// Event is something a user is told about
+type Event struct {
+	Kind   models.NotificationEvent
+	UserID string
+	VMID   string
+	Title  string
+	Body   string
+	At     time.Time
+}
+
+// Notifier delivers events through one channel, such as a Slack webhook,
+// email or a push service
+type Notifier interface {
+	// Name identifies the notifier in config, logs and errors
+	Name() string
+
+	// Notify delivers event to those of the user's targets that the
+	// notifier handles; notifiers that post to a shared channel ignore
+	// them. Failures for one target are returned as a *TargetError,
+	// joined with errors.Join.
+	Notify(ctx context.Context, event Event, targets []models.NotificationTarget) error
+}
+
+// TargetError is a failure to notify one target
+type TargetError struct {
+	Target models.NotificationTarget
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("%s target %d: %v", e.Target.Kind, e.Target.ID, e.Err)
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// Targets looks up where users want notifications delivered, and forgets
+// targets that stopped accepting them
+type Targets interface {
+	ListNotificationTargets(ctx context.Context, userID string) ([]models.NotificationTarget, error)
+	DeleteNotificationTarget(ctx context.Context, userID string, id int64) error
+}
+
+type route struct {
+	notifier Notifier
+	events   map[models.NotificationEvent]bool // every event when empty
+}
+
+// Dispatcher hands events to every notifier configured for them
+type Dispatcher struct {
+	routes  []route
+	targets Targets
+	queue   chan Event
+}
+
+func NewDispatcher(targets Targets) *Dispatcher {
+	return &Dispatcher{
+		targets: targets,
+		queue:   make(chan Event, queueSize),
+	}
+}
+
+// Add has notifier deliver the given events, or every event if none are
+// given
+func (d *Dispatcher) Add(notifier Notifier, events []models.NotificationEvent) {
+	r := route{notifier: notifier, events: make(map[models.NotificationEvent]bool, len(events))}
+	for _, event := range events {
+		r.events[event] = true
+	}
+	d.routes = append(d.routes, r)
+}
+
+// Notifiers lists the names of the configured notifiers
+func (d *Dispatcher) Notifiers() []string {
+	names := make([]string, 0, len(d.routes))
+	for _, r := range d.routes {
+		names = append(names, r.notifier.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Notify queues event for delivery by Run, dropping it if the queue is full
+func (d *Dispatcher) Notify(ctx context.Context, event Event) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	select {
+	case d.queue <- event:
+	default:
+		requestid.Logger(ctx).Warn().Str("event", string(event.Kind)).Str("vm_id", event.VMID).Msg("Notification queue full, event dropped")
+	}
+}
+
+// Run delivers queued events until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.queue:
+			sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			for name, err := range d.Send(sendCtx, event) {
+				requestid.Logger(ctx).Warn().Err(err).Str("notifier", name).Str("event", string(event.Kind)).Str("vm_id", event.VMID).Msg("Failed to deliver notification")
+			}
+			cancel()
+		}
+	}
+}
+
+// Send delivers event through every notifier configured for it now, and
+// returns the failures by notifier. Test events go through every notifier.
+// Targets that are no longer registered are deleted.
+func (d *Dispatcher) Send(ctx context.Context, event Event) map[string]error {
+	errs := make(map[string]error)
+
+	var targets []models.NotificationTarget
+	if event.UserID != "" {
+		var err error
+		targets, err = d.targets.ListNotificationTargets(ctx, event.UserID)
+		if err != nil {
+			errs["targets"] = fmt.Errorf("list notification targets: %w", err)
+			return errs
+		}
+	}
+
+	for _, r := range d.routes {
+		if event.Kind != models.NotifyTest && len(r.events) > 0 && !r.events[event.Kind] {
+			continue
+		}
+
+		err := r.notifier.Notify(ctx, event, targets)
+		if err == nil {
+			continue
+		}
+		errs[r.notifier.Name()] = err
+
+		for _, target := range unregistered(err) {
+			if err := d.targets.DeleteNotificationTarget(ctx, target.UserID, target.ID); err != nil {
+				requestid.Logger(ctx).Warn().Err(err).Int64("target_id", target.ID).Msg("Failed to delete unregistered notification target")
+				continue
+			}
+			requestid.Logger(ctx).Info().Int64("target_id", target.ID).Str("kind", string(target.Kind)).Msg("Unregistered notification target deleted")
+		}
+	}
+	return errs
+}
+
+// unregistered finds the targets err reports as no longer registered
+func unregistered(err error) []models.NotificationTarget {
+	var targets []models.NotificationTarget
+	var walk func(error)
+	walk = func(err error) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				walk(e)
+			}
+			return
+		}
+		var terr *TargetError
+		if errors.As(err, &terr) && errors.Is(terr.Err, ErrUnregistered) {
+			targets = append(targets, terr.Target)
+		}
+	}
+	walk(err)
+	return targets
+}
+
+// targetsOf returns the targets of the given kind
+func targetsOf(targets []models.NotificationTarget, kind models.NotificationTargetKind) []models.NotificationTarget {
+	var matched []models.NotificationTarget
+	for _, t := range targets {
+		if t.Kind == kind {
+			matched = append(matched, t)
+		}
+	}
+	return matched
+}
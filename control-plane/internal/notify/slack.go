@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Slack posts every event to the channel of an incoming webhook, for
+// operators rather than the VM's owner
+type Slack struct {
+	webhookURL string
+	http       *http.Client
+}
+
+var _ Notifier = (*Slack)(nil)
+
+func NewSlack(webhookURL string) *Slack {
+	return &Slack{
+		webhookURL: webhookURL,
+		http:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+func (s *Slack) Notify(ctx context.Context, event Event, targets []models.NotificationTarget) error {
+	text := fmt.Sprintf("*%s*\n%s", event.Title, event.Body)
+	if event.VMID != "" {
+		text += fmt.Sprintf("\nVM `%s`, user `%s`", event.VMID, event.UserID)
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("slack webhook: %s - %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
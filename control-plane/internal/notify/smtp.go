@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// DefaultSMTPPort is the submission port, which upgrades to TLS with
+// STARTTLS
+const DefaultSMTPPort = 587
+
+// SMTPConfig is the mail server notifications are submitted to
+type SMTPConfig struct {
+	Host string
+	Port int
+
+	// Username and Password authenticate with PLAIN, which net/smtp only
+	// sends over TLS or to localhost; no username skips authentication
+	Username string
+	Password string
+
+	// From is the sender, e.g. "devtail <noreply@example.com>"
+	From string
+}
+
+// SMTP emails events to the user's email targets
+type SMTP struct {
+	config SMTPConfig
+	from   *mail.Address
+}
+
+var _ Notifier = (*SMTP)(nil)
+
+func NewSMTP(config SMTPConfig) (*SMTP, error) {
+	if config.Port == 0 {
+		config.Port = DefaultSMTPPort
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", config.From, err)
+	}
+	return &SMTP{config: config, from: from}, nil
+}
+
+func (s *SMTP) Name() string {
+	return "smtp"
+}
+
+func (s *SMTP) Notify(ctx context.Context, event Event, targets []models.NotificationTarget) error {
+	var errs []error
+	for _, target := range targetsOf(targets, models.TargetEmail) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.send(event, target.Address); err != nil {
+			errs = append(errs, &TargetError{Target: target, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SMTP) send(event Event, address string) error {
+	to, err := mail.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnregistered, err)
+	}
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		// Values come from events and targets, so no header can be
+		// smuggled in through them
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	header("From", s.from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", event.Title))
+	header("Date", event.At.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(event.Body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+	}
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	if err := smtp.SendMail(addr, auth, s.from.Address, []string{to.Address}, msg.Bytes()); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Package openapi builds an OpenAPI 3 document for the control-plane API
+// from the Go types its handlers bind and return, and validates requests
+// against it. Schemas follow the json and binding struct tags, so the
+// document cannot drift from what the handlers accept.
+package openapi
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is the OpenAPI version of generated documents
+const Version = "3.0.3"
+
+// Document is the subset of an OpenAPI 3 document the control plane uses
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	// operations maps gin routes, e.g. "GET /api/v1/vms/:id", to operations
+	operations map[string]*Operation
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+// PathItem holds a path's operations by lower-case method
+type PathItem map[string]*Operation
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Route describes one handler. Request and Response are values of the types
+// the handler binds and returns, e.g. models.CreateVMRequest{}; nil means
+// no body.
+type Route struct {
+	Method   string
+	Path     string // gin syntax, e.g. /api/v1/vms/:id
+	ID       string
+	Summary  string
+	Tag      string
+	Security string // a security scheme name, or "" for none
+	Query    []*Parameter
+	Request  interface{}
+	// Optional bodies may be empty, as for token revocation
+	OptionalRequest bool
+	Status          int
+	Response        interface{}
+	// Errors lists the error statuses the route can answer with
+	Errors []int
+}
+
+// Builder assembles a Document from routes
+type Builder struct {
+	doc   *Document
+	enums map[reflect.Type][]interface{}
+	// errorRef is the schema of every error response
+	errorRef *Schema
+}
+
+// NewBuilder starts a document whose error responses carry errorType, e.g.
+// models.ErrorResponse{}
+func NewBuilder(info Info, errorType interface{}) *Builder {
+	b := &Builder{
+		doc: &Document{
+			OpenAPI: Version,
+			Info:    info,
+			Paths:   make(map[string]*PathItem),
+			Components: Components{
+				Schemas:         make(map[string]*Schema),
+				SecuritySchemes: make(map[string]*SecurityScheme),
+			},
+			operations: make(map[string]*Operation),
+		},
+		enums: make(map[reflect.Type][]interface{}),
+	}
+	b.errorRef = b.schema(reflect.TypeOf(errorType))
+	return b
+}
+
+// Enum lists the allowed values of a named string type, e.g.
+// Enum(models.VMStatusRunning, models.VMStatusError, ...). Go has no enums,
+// so they cannot be found by reflection.
+func (b *Builder) Enum(values ...interface{}) *Builder {
+	if len(values) > 0 {
+		b.enums[reflect.TypeOf(values[0])] = values
+	}
+	return b
+}
+
+// Security registers a security scheme under name
+func (b *Builder) Security(name string, scheme *SecurityScheme) *Builder {
+	b.doc.Components.SecuritySchemes[name] = scheme
+	return b
+}
+
+// Add documents a route
+func (b *Builder) Add(r Route) *Builder {
+	op := &Operation{
+		OperationID: r.ID,
+		Summary:     r.Summary,
+		Responses:   make(map[string]*Response),
+	}
+	if r.Tag != "" {
+		op.Tags = []string{r.Tag}
+	}
+	if r.Security != "" {
+		op.Security = []map[string][]string{{r.Security: {}}}
+	}
+
+	path, params := openAPIPath(r.Path)
+	for _, name := range params {
+		op.Parameters = append(op.Parameters, &Parameter{
+			Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	op.Parameters = append(op.Parameters, r.Query...)
+
+	if r.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: !r.OptionalRequest,
+			Content:  jsonContent(b.schema(reflect.TypeOf(r.Request))),
+		}
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := &Response{Description: http.StatusText(status)}
+	if r.Response != nil {
+		resp.Content = jsonContent(b.schema(reflect.TypeOf(r.Response)))
+	}
+	op.Responses[strconv.Itoa(status)] = resp
+
+	for _, code := range r.Errors {
+		op.Responses[strconv.Itoa(code)] = &Response{
+			Description: http.StatusText(code),
+			Content:     jsonContent(b.errorRef),
+		}
+	}
+
+	item, ok := b.doc.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		b.doc.Paths[path] = item
+	}
+	(*item)[strings.ToLower(r.Method)] = op
+	b.doc.operations[r.Method+" "+r.Path] = op
+	return b
+}
+
+// Document returns the assembled document
+func (b *Builder) Document() *Document {
+	return b.doc
+}
+
+// Operation returns the operation documented for a gin route, e.g.
+// "GET /api/v1/vms/:id"
+func (d *Document) Operation(route string) (*Operation, bool) {
+	op, ok := d.operations[route]
+	return op, ok
+}
+
+// Undocumented returns the routes, in gin's "METHOD /path" form, that have
+// no operation in d
+func (d *Document) Undocumented(routes []string) []string {
+	var missing []string
+	for _, route := range routes {
+		if _, ok := d.operations[route]; !ok {
+			missing = append(missing, route)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Resolve follows a $ref to its schema in d
+func (d *Document) Resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// openAPIPath turns /vms/:id into /vms/{id} and returns the parameter names
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if name, ok := strings.CutPrefix(part, ":"); ok {
+			params = append(params, name)
+			parts[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(parts, "/"), params
+}
+
+func jsonContent(s *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: s}}
+}
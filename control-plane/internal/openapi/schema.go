@@ -0,0 +1,202 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of an OpenAPI 3.0 schema object the control plane
+// uses
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	// omitEmpty skips the rules for a zero value, as the validator's
+	// omitempty does; OpenAPI 3.0 has no way to say so
+	omitEmpty bool
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema for t. Named structs are registered as
+// components and referenced, so each appears once in the document.
+func (b *Builder) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawType, t.Kind() == reflect.Interface:
+		// Any JSON value
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		s := &Schema{Type: "string"}
+		s.Enum = b.enums[t]
+		return s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: b.schema(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.schema(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		ref := &Schema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := b.doc.Components.Schemas[t.Name()]; !ok {
+			// Registered before its fields, so recursive types terminate
+			b.doc.Components.Schemas[t.Name()] = &Schema{}
+			*b.doc.Components.Schemas[t.Name()] = *b.object(t)
+		}
+		return ref
+	}
+	return &Schema{}
+}
+
+// object builds the schema of a struct from its json and binding tags.
+// Embedded structs without a json name are flattened, as encoding/json does.
+func (b *Builder) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded := b.object(ft)
+				for prop, ps := range embedded.Properties {
+					s.Properties[prop] = ps
+				}
+				s.Required = append(s.Required, embedded.Required...)
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := b.schema(f.Type)
+		if applyBinding(prop, f.Tag.Get("binding")) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = prop
+	}
+	return s
+}
+
+// applyBinding copies the validator rules the control plane uses into
+// schema keywords and reports whether the field is required. Rules after
+// dive apply to the elements of a slice.
+func applyBinding(s *Schema, tag string) bool {
+	if tag == "" || s.Ref != "" {
+		return strings.HasPrefix(tag, "required")
+	}
+
+	required := false
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "omitempty":
+			s.omitEmpty = true
+		case "dive":
+			if s.Items != nil {
+				applyBinding(s.Items, strings.Join(rules[i+1:], ","))
+			}
+			return required
+		case "min", "max", "len":
+			limit(s, name, param)
+		case "oneof":
+			// Narrows any values registered for the type
+			s.Enum = nil
+			for _, v := range strings.Fields(param) {
+				s.Enum = append(s.Enum, v)
+			}
+		case "hexadecimal":
+			s.Pattern = "^(0[xX])?[0-9a-fA-F]+$"
+		}
+	}
+	return required
+}
+
+// limit applies min, max or len, which bound a string's length, a number's
+// value or an array's size depending on the field
+func limit(s *Schema, rule, param string) {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	setMin := rule == "min" || rule == "len"
+	setMax := rule == "max" || rule == "len"
+
+	switch s.Type {
+	case "string":
+		v := int(n)
+		if setMin {
+			s.MinLength = &v
+		}
+		if setMax {
+			s.MaxLength = &v
+		}
+	case "array":
+		v := int(n)
+		if setMin {
+			s.MinItems = &v
+		}
+		if setMax {
+			s.MaxItems = &v
+		}
+	case "integer", "number":
+		if setMin {
+			s.Minimum = &n
+		}
+		if setMax {
+			s.Maximum = &n
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldErrors maps the JSON path of each invalid field, e.g. spec.type or
+// entries[0].time, to the schema keyword it broke, e.g. required or
+// maxLength
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for path := range e {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b bytes.Buffer
+	b.WriteString("invalid fields:")
+	for _, path := range paths {
+		fmt.Fprintf(&b, " %s (%s)", path, e[path])
+	}
+	return b.String()
+}
+
+// ErrInvalidJSON is returned for a body that is not JSON at all
+var ErrInvalidJSON = errors.New("invalid JSON")
+
+// ValidateBody checks a JSON request body against the operation's schema.
+// It returns ErrInvalidJSON, FieldErrors, or nil.
+func (d *Document) ValidateBody(op *Operation, body []byte) error {
+	if op.RequestBody == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return FieldErrors{"body": "required"}
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return ErrInvalidJSON
+	}
+
+	errs := make(FieldErrors)
+	d.validate(op.RequestBody.Content["application/json"].Schema, v, "", errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateQuery checks the operation's query parameters, given by get, e.g.
+// gin's Context.GetQuery. It returns FieldErrors or nil.
+func (d *Document) ValidateQuery(op *Operation, get func(string) (string, bool)) error {
+	errs := make(FieldErrors)
+	for _, p := range op.Parameters {
+		if p.In != "query" {
+			continue
+		}
+		raw, ok := get(p.Name)
+		if !ok {
+			if p.Required {
+				errs[p.Name] = "required"
+			}
+			continue
+		}
+
+		var v interface{} = raw
+		switch p.Schema.Type {
+		case "integer", "number":
+			v = json.Number(raw)
+		case "boolean":
+			if b, err := strconv.ParseBool(raw); err == nil {
+				v = b
+			}
+		}
+		d.validate(p.Schema, v, p.Name, errs)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate records the first rule v breaks for each path in errs. v is a
+// value decoded with json.Decoder.UseNumber.
+func (d *Document) validate(s *Schema, v interface{}, path string, errs FieldErrors) {
+	s = d.Resolve(s)
+	if s == nil || s.Type == "" {
+		return
+	}
+	fail := func(rule string) {
+		if path == "" {
+			path = "body"
+		}
+		errs[path] = rule
+	}
+
+	if v == nil {
+		if !s.Nullable {
+			fail("type")
+		}
+		return
+	}
+	if s.omitEmpty && (v == "" || v == json.Number("0")) {
+		return
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("type")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs[join(path, name)] = "required"
+			}
+		}
+		for name, value := range obj {
+			if prop, ok := s.Properties[name]; ok {
+				d.validate(prop, value, join(path, name), errs)
+			} else if s.AdditionalProperties != nil {
+				d.validate(s.AdditionalProperties, value, join(path, name), errs)
+			}
+		}
+
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			fail("type")
+			return
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			fail("minItems")
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			fail("maxItems")
+			return
+		}
+		for i, item := range items {
+			d.validate(s.Items, item, path+"["+strconv.Itoa(i)+"]", errs)
+		}
+
+	case "string":
+		str, ok := v.(string)
+		switch {
+		case !ok:
+			fail("type")
+		case s.MinLength != nil && utf8.RuneCountInString(str) < *s.MinLength:
+			fail("minLength")
+		case s.MaxLength != nil && utf8.RuneCountInString(str) > *s.MaxLength:
+			fail("maxLength")
+		case s.Format == "date-time" && !isDateTime(str):
+			fail("format")
+		case s.Pattern != "" && !pattern(s.Pattern).MatchString(str):
+			fail("pattern")
+		case len(s.Enum) > 0 && !inEnum(s.Enum, str):
+			fail("enum")
+		}
+
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			fail("type")
+			return
+		}
+		f, err := num.Float64()
+		if err != nil {
+			fail("type")
+			return
+		}
+		if _, err := num.Int64(); s.Type == "integer" && err != nil {
+			fail("type")
+			return
+		}
+		switch {
+		case s.Minimum != nil && f < *s.Minimum:
+			fail("minimum")
+		case s.Maximum != nil && f > *s.Maximum:
+			fail("maximum")
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("type")
+		}
+	}
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func isDateTime(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+func inEnum(enum []interface{}, s string) bool {
+	for _, v := range enum {
+		if fmt.Sprint(v) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// patterns caches compiled schema patterns; documents are built from a
+// fixed set of struct tags, so it stays small
+var patterns sync.Map
+
+func pattern(expr string) *regexp.Regexp {
+	if re, ok := patterns.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(expr)
+	patterns.Store(expr, re)
+	return re
+}
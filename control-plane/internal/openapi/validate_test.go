@@ -0,0 +1,154 @@
+package openapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testKind string
+
+type testSpec struct {
+	Type string   `json:"type" binding:"required,min=2,max=8"`
+	Size int      `json:"size" binding:"omitempty,min=20,max=160"`
+	Kind testKind `json:"kind,omitempty"`
+}
+
+type testRequest struct {
+	Name   string            `json:"name" binding:"required"`
+	Spec   testSpec          `json:"spec" binding:"required"`
+	Tags   []string          `json:"tags" binding:"max=2,dive,min=1"`
+	At     *time.Time        `json:"at,omitempty"`
+	Hash   string            `json:"hash,omitempty" binding:"omitempty,hexadecimal"`
+	Labels map[string]string `json:"labels"`
+	Force  bool              `json:"force"`
+}
+
+type testError struct {
+	Error string `json:"error"`
+}
+
+func testDocument(t *testing.T) (*Document, *Operation, *Operation) {
+	t.Helper()
+	minLimit, maxLimit := 1.0, 100.0
+	doc := NewBuilder(Info{Title: "test", Version: "1"}, testError{}).
+		Enum(testKind("small"), testKind("large")).
+		Add(Route{Method: "POST", Path: "/things", Request: testRequest{}}).
+		Add(Route{Method: "GET", Path: "/things/:id", Query: []*Parameter{
+			{Name: "limit", In: "query", Schema: &Schema{Type: "integer", Minimum: &minLimit, Maximum: &maxLimit}},
+			{Name: "all", In: "query", Schema: &Schema{Type: "boolean"}},
+			{Name: "owner", In: "query", Required: true, Schema: &Schema{Type: "string"}},
+		}}).
+		Document()
+
+	create, ok := doc.Operation("POST /things")
+	if !ok {
+		t.Fatal("expected POST /things documented")
+	}
+	get, ok := doc.Operation("GET /things/:id")
+	if !ok {
+		t.Fatal("expected GET /things/:id documented")
+	}
+	return doc, create, get
+}
+
+func TestValidateBody(t *testing.T) {
+	doc, op, _ := testDocument(t)
+
+	tests := []struct {
+		name string
+		body string
+		want FieldErrors // nil for a valid body
+	}{
+		{"valid", `{"name":"a","spec":{"type":"cx21","size":40,"kind":"small"},"tags":["x"],"at":"2024-01-02T03:04:05Z","hash":"0xBEEF","labels":{"a":"b"},"force":true}`, nil},
+		{"minimal", `{"name":"a","spec":{"type":"cx21"}}`, nil},
+		{"zero size skips its limits", `{"name":"a","spec":{"type":"cx21","size":0}}`, nil},
+		{"null slice and map", `{"name":"a","spec":{"type":"cx21"},"tags":null,"labels":null}`, nil},
+		{"empty", ``, FieldErrors{"body": "required"}},
+		{"not an object", `[]`, FieldErrors{"body": "type"}},
+		{"missing fields", `{}`, FieldErrors{"name": "required", "spec": "required"}},
+		{"nested missing field", `{"name":"a","spec":{}}`, FieldErrors{"spec.type": "required"}},
+		{"wrong type", `{"name":1,"spec":{"type":"cx21"}}`, FieldErrors{"name": "type"}},
+		{"null object", `{"name":"a","spec":null}`, FieldErrors{"spec": "type"}},
+		{"too short", `{"name":"a","spec":{"type":"c"}}`, FieldErrors{"spec.type": "minLength"}},
+		{"too long", `{"name":"a","spec":{"type":"cx21-large"}}`, FieldErrors{"spec.type": "maxLength"}},
+		{"below minimum", `{"name":"a","spec":{"type":"cx21","size":10}}`, FieldErrors{"spec.size": "minimum"}},
+		{"above maximum", `{"name":"a","spec":{"type":"cx21","size":200}}`, FieldErrors{"spec.size": "maximum"}},
+		{"fractional integer", `{"name":"a","spec":{"type":"cx21","size":40.5}}`, FieldErrors{"spec.size": "type"}},
+		{"not in enum", `{"name":"a","spec":{"type":"cx21","kind":"medium"}}`, FieldErrors{"spec.kind": "enum"}},
+		{"too many items", `{"name":"a","spec":{"type":"cx21"},"tags":["x","y","z"]}`, FieldErrors{"tags": "maxItems"}},
+		{"invalid item", `{"name":"a","spec":{"type":"cx21"},"tags":["x",""]}`, FieldErrors{"tags[1]": "minLength"}},
+		{"date-time", `{"name":"a","spec":{"type":"cx21"},"at":"yesterday"}`, FieldErrors{"at": "format"}},
+		{"pattern", `{"name":"a","spec":{"type":"cx21"},"hash":"xyz"}`, FieldErrors{"hash": "pattern"}},
+		{"map value", `{"name":"a","spec":{"type":"cx21"},"labels":{"a":1}}`, FieldErrors{"labels.a": "type"}},
+		{"boolean", `{"name":"a","spec":{"type":"cx21"},"force":"yes"}`, FieldErrors{"force": "type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := doc.ValidateBody(op, []byte(tt.body))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var got FieldErrors
+			if !errors.As(err, &got) {
+				t.Fatalf("expected FieldErrors, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if err := doc.ValidateBody(op, []byte(`{"name":`)); err != ErrInvalidJSON {
+		t.Fatalf("expected ErrInvalidJSON for a truncated body, got %v", err)
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	doc, _, op := testDocument(t)
+
+	tests := []struct {
+		name  string
+		query map[string]string
+		want  FieldErrors
+	}{
+		{"valid", map[string]string{"owner": "u", "limit": "10", "all": "true"}, nil},
+		{"only required", map[string]string{"owner": "u"}, nil},
+		{"missing required", map[string]string{"limit": "10"}, FieldErrors{"owner": "required"}},
+		{"not a number", map[string]string{"owner": "u", "limit": "ten"}, FieldErrors{"limit": "type"}},
+		{"out of range", map[string]string{"owner": "u", "limit": "1000"}, FieldErrors{"limit": "maximum"}},
+		{"not a boolean", map[string]string{"owner": "u", "all": "maybe"}, FieldErrors{"all": "type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := doc.ValidateQuery(op, func(name string) (string, bool) {
+				v, ok := tt.query[name]
+				return v, ok
+			})
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var got FieldErrors
+			if !errors.As(err, &got) {
+				t.Fatalf("expected FieldErrors, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFieldErrorsMessageIsSorted(t *testing.T) {
+	err := FieldErrors{"spec.type": "required", "name": "maxLength"}
+	if got, want := err.Error(), "invalid fields: name (maxLength) spec.type (required)"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,237 @@
+// Package chaos wraps a provider with random failures and delays, so the
+// VM manager's retry and cleanup paths can be exercised without waiting for
+// a real provider outage. It is enabled by the chaos.* config keys and is
+// meant for development and staging, typically on top of a mock provider.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrInjected is wrapped by every failure the chaos provider makes up
+var ErrInjected = errors.New("injected fault")
+
+// Config sets how often provider calls misbehave
+type Config struct {
+	// FailureRate is the chance each call fails without reaching the
+	// provider, between 0 and 1
+	FailureRate float64
+
+	// MaxDelay bounds a random delay added before each call
+	MaxDelay time.Duration
+
+	// Seed makes the faults repeatable; zero picks a random seed
+	Seed int64
+}
+
+// Validate checks the config's ranges
+func (c Config) Validate() error {
+	if c.FailureRate < 0 || c.FailureRate > 1 {
+		return fmt.Errorf("chaos failure rate must be between 0 and 1, got %g", c.FailureRate)
+	}
+	if c.MaxDelay < 0 {
+		return fmt.Errorf("chaos max delay must not be negative, got %s", c.MaxDelay)
+	}
+	return nil
+}
+
+// Provider injects faults into calls to another provider
+type Provider struct {
+	next   provider.Provider
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// consoleProvider also forwards consoles, for wrapped providers that have them
+type consoleProvider struct {
+	*Provider
+	console provider.Console
+}
+
+// rebuildProvider also forwards rebuilds, for wrapped providers that have them
+type rebuildProvider struct {
+	*Provider
+	rebuilder provider.Rebuilder
+}
+
+// consoleRebuildProvider forwards both
+type consoleRebuildProvider struct {
+	*consoleProvider
+	rebuilder provider.Rebuilder
+}
+
+// suspending forwards suspends and resumes, for wrapped providers that have
+// them; it is embedded alongside each of the types above
+type suspending struct {
+	chaos     *Provider
+	suspender provider.Suspender
+}
+
+type suspendProvider struct {
+	*Provider
+	suspending
+}
+
+type consoleSuspendProvider struct {
+	*consoleProvider
+	suspending
+}
+
+type rebuildSuspendProvider struct {
+	*rebuildProvider
+	suspending
+}
+
+type consoleRebuildSuspendProvider struct {
+	*consoleRebuildProvider
+	suspending
+}
+
+// Wrap returns next with faults injected as config describes. The result
+// implements provider.Console, provider.Rebuilder and provider.Suspender
+// when next does.
+func Wrap(next provider.Provider, config Config) provider.Provider {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	p := &Provider{
+		next:   next,
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+
+	console, hasConsole := next.(provider.Console)
+	rebuilder, hasRebuilder := next.(provider.Rebuilder)
+	suspender, hasSuspender := next.(provider.Suspender)
+	if !hasSuspender {
+		switch {
+		case hasConsole && hasRebuilder:
+			return &consoleRebuildProvider{consoleProvider: &consoleProvider{Provider: p, console: console}, rebuilder: rebuilder}
+		case hasConsole:
+			return &consoleProvider{Provider: p, console: console}
+		case hasRebuilder:
+			return &rebuildProvider{Provider: p, rebuilder: rebuilder}
+		}
+		return p
+	}
+
+	s := suspending{chaos: p, suspender: suspender}
+	switch {
+	case hasConsole && hasRebuilder:
+		return &consoleRebuildSuspendProvider{
+			consoleRebuildProvider: &consoleRebuildProvider{consoleProvider: &consoleProvider{Provider: p, console: console}, rebuilder: rebuilder},
+			suspending:             s,
+		}
+	case hasConsole:
+		return &consoleSuspendProvider{consoleProvider: &consoleProvider{Provider: p, console: console}, suspending: s}
+	case hasRebuilder:
+		return &rebuildSuspendProvider{rebuildProvider: &rebuildProvider{Provider: p, rebuilder: rebuilder}, suspending: s}
+	}
+	return &suspendProvider{Provider: p, suspending: s}
+}
+
+// Name reports the wrapped provider's name, since it is stored with VMs
+func (p *Provider) Name() string {
+	return p.next.Name()
+}
+
+func (p *Provider) CreateVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	if err := p.inject(ctx, "CreateVM"); err != nil {
+		return err
+	}
+	return p.next.CreateVM(ctx, vm, cloudInit)
+}
+
+func (p *Provider) DeleteVM(ctx context.Context, vm *models.VM) error {
+	if err := p.inject(ctx, "DeleteVM"); err != nil {
+		return err
+	}
+	return p.next.DeleteVM(ctx, vm)
+}
+
+func (p *Provider) UpdateLabels(ctx context.Context, vm *models.VM) error {
+	if err := p.inject(ctx, "UpdateLabels"); err != nil {
+		return err
+	}
+	return p.next.UpdateLabels(ctx, vm)
+}
+
+func (p *Provider) Ping(ctx context.Context) error {
+	if err := p.inject(ctx, "Ping"); err != nil {
+		return err
+	}
+	return p.next.Ping(ctx)
+}
+
+func (p *consoleProvider) Console(ctx context.Context, vm *models.VM) (*models.ConsoleResponse, error) {
+	if err := p.inject(ctx, "Console"); err != nil {
+		return nil, err
+	}
+	return p.console.Console(ctx, vm)
+}
+
+func (p *rebuildProvider) RebuildVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	return p.rebuild(ctx, p.rebuilder, vm, cloudInit)
+}
+
+func (p *consoleRebuildProvider) RebuildVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	return p.rebuild(ctx, p.rebuilder, vm, cloudInit)
+}
+
+func (p *Provider) rebuild(ctx context.Context, next provider.Rebuilder, vm *models.VM, cloudInit string) error {
+	if err := p.inject(ctx, "RebuildVM"); err != nil {
+		return err
+	}
+	return next.RebuildVM(ctx, vm, cloudInit)
+}
+
+func (p *suspending) SuspendVM(ctx context.Context, vm *models.VM) error {
+	if err := p.chaos.inject(ctx, "SuspendVM"); err != nil {
+		return err
+	}
+	return p.suspender.SuspendVM(ctx, vm)
+}
+
+func (p *suspending) ResumeVM(ctx context.Context, vm *models.VM) error {
+	if err := p.chaos.inject(ctx, "ResumeVM"); err != nil {
+		return err
+	}
+	return p.suspender.ResumeVM(ctx, vm)
+}
+
+// inject delays the call and decides whether it fails
+func (p *Provider) inject(ctx context.Context, call string) error {
+	p.mu.Lock()
+	var delay time.Duration
+	if p.config.MaxDelay > 0 {
+		delay = time.Duration(p.rand.Int63n(int64(p.config.MaxDelay)))
+	}
+	fail := p.config.FailureRate > 0 && p.rand.Float64() < p.config.FailureRate
+	p.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if fail {
+		log.Warn().Str("provider", p.next.Name()).Str("call", call).Msg("chaos: failing provider call")
+		return fmt.Errorf("%s %s: %w", p.next.Name(), call, ErrInjected)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Name is the provider name stored with Docker VMs
+const Name = "docker"
+
+// labelPrefix namespaces devtail's container labels
+const labelPrefix = "dev.devtail."
+
+// DefaultServerTypes are offered when docker.server_types is not configured.
+// Disk sizes are not enforced; workspaces live in a named volume.
+var DefaultServerTypes = []models.ServerTypeOption{
+	{Name: "small", Cores: 1, MemoryGB: 2},
+	{Name: "medium", Cores: 2, MemoryGB: 4},
+	{Name: "large", Cores: 4, MemoryGB: 8},
+}
+
+// Config describes the Docker host environments run on
+type Config struct {
+	// Host is the Docker daemon, e.g. unix:///var/run/docker.sock or
+	// ssh://user@host; empty uses the docker CLI's own default
+	Host string
+
+	// Image runs the gateway and is offered as the "default" image;
+	// Images maps further image names to image references.
+	// TailscaleImage joins the container to the tailnet.
+	Image          string
+	Images         map[string]string
+	TailscaleImage string
+
+	// AuthPublicKey and GatewayPort are passed to the gateway, as
+	// cloud-init does on VMs
+	AuthPublicKey string
+	GatewayPort   string
+
+	// Location is the single location this host offers
+	Location string
+
+	// ServerTypes maps spec types to CPU and memory limits
+	ServerTypes []models.ServerTypeOption
+}
+
+// Client runs environments as containers instead of VMs, for short-lived
+// experiments and CI. Each environment is a Tailscale container with the
+// gateway container sharing its network namespace, plus a workspace volume.
+// Cloud-init is not used: the image must already contain the gateway and
+// the tools sessions need.
+type Client struct {
+	config Config
+	run    func(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+var (
+	_ provider.Provider  = (*Client)(nil)
+	_ provider.Rebuilder = (*Client)(nil)
+)
+
+func New(config Config) *Client {
+	if config.Image == "" {
+		config.Image = "devtail/gateway:latest"
+	}
+	if config.TailscaleImage == "" {
+		config.TailscaleImage = "tailscale/tailscale:stable"
+	}
+	if config.GatewayPort == "" {
+		config.GatewayPort = "8080"
+	}
+	if config.Location == "" {
+		config.Location = "local"
+	}
+	if len(config.ServerTypes) == 0 {
+		config.ServerTypes = DefaultServerTypes
+	}
+
+	return &Client{
+		config: config,
+		run:    provider.RunCommand,
+	}
+}
+
+func (c *Client) Name() string {
+	return Name
+}
+
+// Ping checks that the Docker daemon accepts connections
+func (c *Client) Ping(ctx context.Context) error {
+	if _, err := c.docker(ctx, "version", "--format", "{{.Server.Version}}"); err != nil {
+		return fmt.Errorf("connect to docker: %w", err)
+	}
+	return nil
+}
+
+// Catalog lists the configured server types and images at the host's
+// location. There are no disk sizes to choose from. Every image runs the
+// gateway directly, so all are golden.
+func (c *Client) Catalog() *models.Catalog {
+	names := make([]string, 0, len(c.config.Images))
+	for name := range c.config.Images {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	images := []models.ImageOption{{Name: "default", Golden: true}}
+	for _, name := range names {
+		images = append(images, models.ImageOption{Name: name, Golden: true})
+	}
+
+	return &models.Catalog{
+		ServerTypes: c.config.ServerTypes,
+		Locations:   []models.LocationOption{{Name: c.config.Location}},
+		Images:      images,
+	}
+}
+
+func (c *Client) CreateVM(ctx context.Context, vm *models.VM, cloudInitScript string) error {
+	serverType, err := c.serverType(vm.Spec.Type)
+	if err != nil {
+		return err
+	}
+
+	image, err := c.image(vm.Spec.Image)
+	if err != nil {
+		return err
+	}
+
+	name := containerName(vm)
+	labels := containerLabels(vm)
+
+	// The Tailscale container owns the network namespace. In userspace
+	// mode it needs no TUN device and forwards tailnet connections to
+	// localhost, where the gateway listens.
+	args := []string{"run", "--detach",
+		"--name", name + "-tailscale",
+		"--hostname", name,
+		"--restart", "unless-stopped",
+		"--env", "TS_AUTHKEY=" + vm.TailscaleAuthKey,
+		"--env", "TS_HOSTNAME=" + name,
+		"--env", "TS_USERSPACE=true",
+		"--env", "TS_STATE_DIR=/var/lib/tailscale",
+		"--volume", name + "-tailscale:/var/lib/tailscale",
+	}
+	args = append(args, labels...)
+	args = append(args, c.config.TailscaleImage)
+	if _, err := c.docker(ctx, args...); err != nil {
+		return fmt.Errorf("run tailscale container: %w", err)
+	}
+
+	args = []string{"run", "--detach",
+		"--name", name,
+		"--network", "container:" + name + "-tailscale",
+		"--restart", "unless-stopped",
+		"--cpus", strconv.Itoa(serverType.Cores),
+		"--memory", fmt.Sprintf("%dm", int(serverType.MemoryGB*1024)),
+		"--volume", name + "-workspace:/workspace",
+	}
+	args = append(args, labels...)
+	args = append(args, image,
+		"gateway",
+		"--port", c.config.GatewayPort,
+		"--workdir", "/workspace",
+		"--vm-id", vm.ID,
+		"--auth-public-key", c.config.AuthPublicKey,
+	)
+	if _, err := c.docker(ctx, args...); err != nil {
+		c.remove(ctx, name)
+		return fmt.Errorf("run gateway container: %w", err)
+	}
+
+	vm.ProviderID = name
+
+	requestid.Logger(ctx).Info().
+		Str("container", name).
+		Str("vm_id", vm.ID).
+		Msg("VM created in docker")
+
+	return nil
+}
+
+func (c *Client) DeleteVM(ctx context.Context, vm *models.VM) error {
+	if err := c.remove(ctx, vm.ProviderID); err != nil {
+		return err
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("container", vm.ProviderID).
+		Msg("VM deleted from docker")
+
+	return nil
+}
+
+// RebuildVM recreates the VM's containers from the current image, keeping its
+// workspace volume. The Tailscale state is discarded, so the new container
+// joins the tailnet as a new device with the same hostname.
+func (c *Client) RebuildVM(ctx context.Context, vm *models.VM, cloudInitScript string) error {
+	name := containerName(vm)
+	if _, err := c.docker(ctx, "rm", "--force", name, name+"-tailscale"); err != nil && !notFound(err) {
+		return fmt.Errorf("remove containers: %w", err)
+	}
+	if _, err := c.docker(ctx, "volume", "rm", "--force", name+"-tailscale"); err != nil {
+		return fmt.Errorf("remove tailscale volume: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("container", name).
+		Str("vm_id", vm.ID).
+		Msg("VM containers removed for rebuild")
+
+	return c.CreateVM(ctx, vm, cloudInitScript)
+}
+
+// SuspendVM stops the VM's containers, keeping their volumes
+func (c *Client) SuspendVM(ctx context.Context, vm *models.VM) error {
+	name := containerName(vm)
+	if _, err := c.docker(ctx, "stop", name, name+"-tailscale"); err != nil {
+		return fmt.Errorf("stop containers: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("container", name).
+		Msg("VM suspended in docker")
+
+	return nil
+}
+
+// ResumeVM starts the VM's containers again, the Tailscale one first since
+// the gateway uses its network
+func (c *Client) ResumeVM(ctx context.Context, vm *models.VM) error {
+	name := containerName(vm)
+	if _, err := c.docker(ctx, "start", name+"-tailscale"); err != nil {
+		return fmt.Errorf("start tailscale container: %w", err)
+	}
+	if _, err := c.docker(ctx, "start", name); err != nil {
+		return fmt.Errorf("start gateway container: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("container", name).
+		Msg("VM resumed in docker")
+
+	return nil
+}
+
+// UpdateLabels is a no-op: container labels are fixed when the container is
+// created, so later changes are only kept in the database
+func (c *Client) UpdateLabels(ctx context.Context, vm *models.VM) error {
+	return nil
+}
+
+// remove deletes an environment's containers and volumes, ignoring any that
+// are already gone
+func (c *Client) remove(ctx context.Context, name string) error {
+	if _, err := c.docker(ctx, "rm", "--force", name, name+"-tailscale"); err != nil && !notFound(err) {
+		return fmt.Errorf("remove containers: %w", err)
+	}
+	if _, err := c.docker(ctx, "volume", "rm", "--force", name+"-workspace", name+"-tailscale"); err != nil {
+		return fmt.Errorf("remove volumes: %w", err)
+	}
+	return nil
+}
+
+// containerLabels tags both containers with the VM's identity and labels so
+// they can be found with `docker ps --filter label=...`
+func containerLabels(vm *models.VM) []string {
+	keys := make([]string, 0, len(vm.Labels))
+	for key := range vm.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{
+		"--label", labelPrefix + "vm_id=" + vm.ID,
+		"--label", labelPrefix + "user_id=" + vm.UserID,
+	}
+	for _, key := range keys {
+		args = append(args, "--label", labelPrefix+"label."+key+"="+vm.Labels[key])
+	}
+	return args
+}
+
+func (c *Client) serverType(name string) (*models.ServerTypeOption, error) {
+	for i := range c.config.ServerTypes {
+		if c.config.ServerTypes[i].Name == name {
+			return &c.config.ServerTypes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown server type %q", name)
+}
+
+// image returns the image reference of the named image
+func (c *Client) image(name string) (string, error) {
+	if name == "" || name == "default" {
+		return c.config.Image, nil
+	}
+	if ref, ok := c.config.Images[name]; ok {
+		return ref, nil
+	}
+	return "", fmt.Errorf("unknown image %q", name)
+}
+
+func (c *Client) docker(ctx context.Context, args ...string) ([]byte, error) {
+	if c.config.Host != "" {
+		args = append([]string{"--host", c.config.Host}, args...)
+	}
+	return c.run(ctx, "docker", args...)
+}
+
+func containerName(vm *models.VM) string {
+	return fmt.Sprintf("devtail-%s", vm.ID)
+}
+
+func notFound(err error) bool {
+	return strings.Contains(err.Error(), "No such container")
+}
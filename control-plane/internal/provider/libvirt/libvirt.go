@@ -0,0 +1,341 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Name is the provider name stored with libvirt VMs
+const Name = "libvirt"
+
+// metadataURI namespaces the labels devtail stores in the domain XML
+const metadataURI = "https://devtail.dev/xmlns/labels/1.0"
+
+// DefaultServerTypes are offered when libvirt.server_types is not configured
+var DefaultServerTypes = []models.ServerTypeOption{
+	{Name: "small", Cores: 2, MemoryGB: 4, DiskGB: 40},
+	{Name: "medium", Cores: 4, MemoryGB: 8, DiskGB: 80},
+	{Name: "large", Cores: 8, MemoryGB: 16, DiskGB: 160},
+}
+
+// Config describes the hypervisor VMs are created on
+type Config struct {
+	// URI is the libvirt connection URI, e.g. qemu:///system or
+	// qemu+ssh://user@host/system for a remote hypervisor
+	URI string
+
+	// BaseImage is a qcow2 cloud image with cloud-init, offered as the
+	// "default" image. Each VM gets a copy-on-write overlay on top of its
+	// image.
+	BaseImage string
+
+	// Images maps further image names to qcow2 paths
+	Images map[string]string
+
+	// StoragePool and Network are the libvirt pool for VM disks and the
+	// network VMs attach to
+	StoragePool string
+	Network     string
+
+	// OSVariant is passed to virt-install to pick device defaults
+	OSVariant string
+
+	// Location is the single location this hypervisor offers
+	Location string
+
+	// ServerTypes maps spec types to vCPUs, memory and default disk size
+	ServerTypes []models.ServerTypeOption
+}
+
+// Client provisions VMs on a libvirt host (KVM/QEMU) with virt-install and
+// virsh, so no cgo bindings are needed. The control plane must run where
+// both tools are installed and URI is reachable.
+type Client struct {
+	config Config
+	run    func(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+func New(config Config) *Client {
+	if config.URI == "" {
+		config.URI = "qemu:///system"
+	}
+	if config.StoragePool == "" {
+		config.StoragePool = "default"
+	}
+	if config.Network == "" {
+		config.Network = "default"
+	}
+	if config.OSVariant == "" {
+		config.OSVariant = "ubuntu22.04"
+	}
+	if config.Location == "" {
+		config.Location = "local"
+	}
+	if len(config.ServerTypes) == 0 {
+		config.ServerTypes = DefaultServerTypes
+	}
+
+	return &Client{
+		config: config,
+		run:    provider.RunCommand,
+	}
+}
+
+func (c *Client) Name() string {
+	return Name
+}
+
+// Ping checks that the hypervisor accepts connections
+func (c *Client) Ping(ctx context.Context) error {
+	if _, err := c.virsh(ctx, "version"); err != nil {
+		return fmt.Errorf("connect to %s: %w", c.config.URI, err)
+	}
+	return nil
+}
+
+// Catalog lists the configured server types at the hypervisor's location
+func (c *Client) Catalog() *models.Catalog {
+	cat := &models.Catalog{
+		ServerTypes: c.config.ServerTypes,
+		Locations:   []models.LocationOption{{Name: c.config.Location}},
+		Images:      catalogImages(c.config.Images),
+	}
+
+	sizes := map[int]bool{}
+	for _, t := range c.config.ServerTypes {
+		if t.DiskGB > 0 && !sizes[t.DiskGB] {
+			sizes[t.DiskGB] = true
+			cat.DiskSizes = append(cat.DiskSizes, t.DiskGB)
+		}
+	}
+	sort.Ints(cat.DiskSizes)
+
+	return cat
+}
+
+func (c *Client) CreateVM(ctx context.Context, vm *models.VM, cloudInitScript string) error {
+	serverType, err := c.serverType(vm.Spec.Type)
+	if err != nil {
+		return err
+	}
+
+	diskGB := vm.Spec.DiskSize
+	if diskGB == 0 {
+		diskGB = serverType.DiskGB
+	}
+
+	baseImage, err := c.image(vm.Spec.Image)
+	if err != nil {
+		return err
+	}
+
+	// virt-install reads user-data from a file and attaches it as a
+	// NoCloud seed; it is no longer needed once the domain is defined
+	userData, err := os.CreateTemp("", "devtail-user-data-*")
+	if err != nil {
+		return fmt.Errorf("create user-data file: %w", err)
+	}
+	defer os.Remove(userData.Name())
+
+	if _, err := userData.WriteString(cloudInitScript); err != nil {
+		userData.Close()
+		return fmt.Errorf("write user-data: %w", err)
+	}
+	if err := userData.Close(); err != nil {
+		return fmt.Errorf("write user-data: %w", err)
+	}
+
+	name := domainName(vm)
+	_, err = c.run(ctx, "virt-install",
+		"--connect", c.config.URI,
+		"--name", name,
+		"--vcpus", strconv.Itoa(serverType.Cores),
+		"--memory", strconv.Itoa(int(serverType.MemoryGB*1024)),
+		"--disk", fmt.Sprintf("pool=%s,size=%d,backing_store=%s,backing_format=qcow2", c.config.StoragePool, diskGB, baseImage),
+		"--network", "network="+c.config.Network,
+		"--os-variant", c.config.OSVariant,
+		"--cloud-init", "user-data="+userData.Name(),
+		"--import",
+		"--noautoconsole",
+	)
+	if err != nil {
+		return fmt.Errorf("virt-install: %w", err)
+	}
+
+	vm.ProviderID = name
+
+	requestid.Logger(ctx).Info().
+		Str("domain", name).
+		Str("vm_id", vm.ID).
+		Msg("VM created in libvirt")
+
+	if err := c.UpdateLabels(ctx, vm); err != nil {
+		requestid.Logger(ctx).Warn().Err(err).Str("vm_id", vm.ID).Msg("Failed to set VM labels")
+	}
+
+	return nil
+}
+
+func (c *Client) DeleteVM(ctx context.Context, vm *models.VM) error {
+	if _, err := c.virsh(ctx, "destroy", vm.ProviderID); err != nil && !notRunning(err) {
+		if notFound(err) {
+			return nil // Already deleted
+		}
+		return fmt.Errorf("destroy domain: %w", err)
+	}
+
+	if _, err := c.virsh(ctx, "undefine", vm.ProviderID, "--remove-all-storage"); err != nil {
+		if notFound(err) {
+			return nil
+		}
+		return fmt.Errorf("undefine domain: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("domain", vm.ProviderID).
+		Msg("VM deleted from libvirt")
+
+	return nil
+}
+
+// SuspendVM saves the domain's memory to disk and stops it, so it resumes
+// where it left off
+func (c *Client) SuspendVM(ctx context.Context, vm *models.VM) error {
+	if _, err := c.virsh(ctx, "managedsave", vm.ProviderID); err != nil {
+		return fmt.Errorf("save domain: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("domain", vm.ProviderID).
+		Msg("VM suspended in libvirt")
+
+	return nil
+}
+
+// ResumeVM starts the domain from the state SuspendVM saved
+func (c *Client) ResumeVM(ctx context.Context, vm *models.VM) error {
+	if _, err := c.virsh(ctx, "start", vm.ProviderID); err != nil {
+		return fmt.Errorf("start domain: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("domain", vm.ProviderID).
+		Msg("VM resumed in libvirt")
+
+	return nil
+}
+
+// UpdateLabels stores the VM's labels as metadata in the domain definition,
+// where `virsh metadata` can read them
+func (c *Client) UpdateLabels(ctx context.Context, vm *models.VM) error {
+	metadata, err := labelsXML(vm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.virsh(ctx, "metadata", vm.ProviderID,
+		"--uri", metadataURI,
+		"--key", "devtail",
+		"--set", metadata,
+		"--config",
+	); err != nil {
+		return fmt.Errorf("set domain metadata: %w", err)
+	}
+	return nil
+}
+
+type labelsElement struct {
+	XMLName xml.Name       `xml:"labels"`
+	VMID    string         `xml:"vm_id,attr"`
+	UserID  string         `xml:"user_id,attr"`
+	Labels  []labelElement `xml:"label"`
+}
+
+type labelElement struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func labelsXML(vm *models.VM) (string, error) {
+	keys := make([]string, 0, len(vm.Labels))
+	for key := range vm.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	el := labelsElement{VMID: vm.ID, UserID: vm.UserID}
+	for _, key := range keys {
+		el.Labels = append(el.Labels, labelElement{Key: key, Value: vm.Labels[key]})
+	}
+
+	out, err := xml.Marshal(el)
+	if err != nil {
+		return "", fmt.Errorf("marshal labels: %w", err)
+	}
+	return string(out), nil
+}
+
+func (c *Client) serverType(name string) (*models.ServerTypeOption, error) {
+	for i := range c.config.ServerTypes {
+		if c.config.ServerTypes[i].Name == name {
+			return &c.config.ServerTypes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown server type %q", name)
+}
+
+// image returns the qcow2 path of the named image
+func (c *Client) image(name string) (string, error) {
+	if name == "" || name == "default" {
+		return c.config.BaseImage, nil
+	}
+	if path, ok := c.config.Images[name]; ok {
+		return path, nil
+	}
+	return "", fmt.Errorf("unknown image %q", name)
+}
+
+// catalogImages lists "default" followed by the named images
+func catalogImages(images map[string]string) []models.ImageOption {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	options := []models.ImageOption{{Name: "default"}}
+	for _, name := range names {
+		options = append(options, models.ImageOption{Name: name})
+	}
+	return options
+}
+
+func (c *Client) virsh(ctx context.Context, args ...string) ([]byte, error) {
+	return c.run(ctx, "virsh", append([]string{"--connect", c.config.URI}, args...)...)
+}
+
+func domainName(vm *models.VM) string {
+	return fmt.Sprintf("devtail-%s", vm.ID)
+}
+
+func notFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Domain not found") || strings.Contains(msg, "failed to get domain")
+}
+
+func notRunning(err error) bool {
+	return strings.Contains(err.Error(), "domain is not running")
+}
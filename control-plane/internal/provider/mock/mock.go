@@ -0,0 +1,259 @@
+// Package mock fakes a cloud provider and Tailscale in memory, so the
+// control plane runs locally without cloud credentials. Its machines cost
+// nothing and run nothing: each "joins the tailnet" after a short boot delay
+// at the address of a gateway the developer runs themselves.
+package mock
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/tailscale"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/google/uuid"
+)
+
+// Name is the provider name stored with mock VMs
+const Name = "mock"
+
+// DefaultBootDelay is how long a mock machine takes to join the tailnet
+const DefaultBootDelay = 3 * time.Second
+
+// hostnamePrefix matches the Tailscale hostnames the VM manager waits for
+const hostnamePrefix = "devtail-"
+
+// DefaultServerTypes are offered by the mock catalog
+var DefaultServerTypes = []models.ServerTypeOption{
+	{Name: "small", Cores: 1, MemoryGB: 2, DiskGB: 20},
+	{Name: "medium", Cores: 2, MemoryGB: 4, DiskGB: 40},
+	{Name: "large", Cores: 4, MemoryGB: 8, DiskGB: 80},
+}
+
+// Config describes the fake machines
+type Config struct {
+	// GatewayIP is the tailnet address every machine reports; point it at
+	// a locally running gateway, usually 127.0.0.1
+	GatewayIP string
+
+	// BootDelay is how long machines take to come online
+	BootDelay time.Duration
+}
+
+// Provider keeps fake machines in memory
+type Provider struct {
+	config Config
+
+	mu       sync.Mutex
+	machines map[string]*machine // by VM ID
+}
+
+type machine struct {
+	id        string
+	labels    map[string]string
+	createdAt time.Time // or when it was last resumed
+	suspended bool
+}
+
+// New creates a mock provider
+func New(config Config) *Provider {
+	if config.GatewayIP == "" {
+		config.GatewayIP = "127.0.0.1"
+	}
+	return &Provider{
+		config:   config,
+		machines: make(map[string]*machine),
+	}
+}
+
+func (p *Provider) Name() string {
+	return Name
+}
+
+// Ping always succeeds
+func (p *Provider) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Catalog offers the default server types at a single "local" location.
+// The gateway is assumed to be running already, so every image is golden.
+func (p *Provider) Catalog() *models.Catalog {
+	return &models.Catalog{
+		ServerTypes: DefaultServerTypes,
+		Locations:   []models.LocationOption{{Name: "local"}},
+		Images:      []models.ImageOption{{Name: "default", Golden: true}},
+	}
+}
+
+func (p *Provider) CreateVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	m := &machine{
+		id:        "mock-" + uuid.New().String()[:8],
+		labels:    vm.Labels,
+		createdAt: time.Now(),
+	}
+
+	p.mu.Lock()
+	p.machines[vm.ID] = m
+	p.mu.Unlock()
+
+	vm.ProviderID = m.id
+
+	requestid.Logger(ctx).Info().
+		Str("vm_id", vm.ID).
+		Str("machine", m.id).
+		Dur("boot_delay", p.config.BootDelay).
+		Msg("mock machine created")
+	return nil
+}
+
+func (p *Provider) DeleteVM(ctx context.Context, vm *models.VM) error {
+	p.mu.Lock()
+	delete(p.machines, vm.ID)
+	p.mu.Unlock()
+
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Str("machine", vm.ProviderID).Msg("mock machine deleted")
+	return nil
+}
+
+// RebuildVM reboots the VM's machine, which then takes the boot delay to
+// rejoin the tailnet; there is no workspace to keep
+func (p *Provider) RebuildVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	p.mu.Lock()
+	m, ok := p.machines[vm.ID]
+	if ok {
+		m.createdAt = time.Now()
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return p.CreateVM(ctx, vm, cloudInit)
+	}
+
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Str("machine", m.id).Msg("mock machine rebuilt")
+	return nil
+}
+
+// SuspendVM marks the VM's machine stopped. The developer's gateway keeps
+// running, since it is not the provider's to stop.
+func (p *Provider) SuspendVM(ctx context.Context, vm *models.VM) error {
+	p.mu.Lock()
+	m, ok := p.machines[vm.ID]
+	if ok {
+		m.suspended = true
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("mock machine for VM %s not found", vm.ID)
+	}
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Str("machine", m.id).Msg("mock machine suspended")
+	return nil
+}
+
+// ResumeVM starts the VM's machine again, which takes the boot delay to
+// rejoin the tailnet
+func (p *Provider) ResumeVM(ctx context.Context, vm *models.VM) error {
+	p.mu.Lock()
+	m, ok := p.machines[vm.ID]
+	if ok {
+		m.suspended = false
+		m.createdAt = time.Now()
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("mock machine for VM %s not found", vm.ID)
+	}
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Str("machine", m.id).Msg("mock machine resumed")
+	return nil
+}
+
+func (p *Provider) UpdateLabels(ctx context.Context, vm *models.VM) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.machines[vm.ID]
+	if !ok {
+		return fmt.Errorf("mock machine for VM %s not found", vm.ID)
+	}
+	m.labels = vm.Labels
+	return nil
+}
+
+// online reports whether the VM's machine exists, is not suspended and has
+// finished booting
+func (p *Provider) online(vmID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := p.machines[vmID]
+	return ok && !m.suspended && time.Since(m.createdAt) >= p.config.BootDelay
+}
+
+// Tailnet returns a fake tailnet that the provider's machines join
+func (p *Provider) Tailnet() *Tailnet {
+	return &Tailnet{provider: p}
+}
+
+// Tailnet stands in for the Tailscale API
+type Tailnet struct {
+	provider *Provider
+}
+
+// Ping always succeeds
+func (t *Tailnet) Ping(ctx context.Context) error {
+	return nil
+}
+
+// CreateAuthKey returns a key that only the mock tailnet accepts
+func (t *Tailnet) CreateAuthKey(ctx context.Context, description string) (*tailscale.AuthKey, error) {
+	now := time.Now()
+	return &tailscale.AuthKey{
+		ID:      "mock-" + uuid.New().String()[:8],
+		Key:     "tskey-auth-mock-" + uuid.New().String(),
+		Created: now,
+		Expires: now.Add(time.Hour),
+	}, nil
+}
+
+// DeleteDevice does nothing; a machine leaves the mock tailnet when it is
+// deleted
+func (t *Tailnet) DeleteDevice(ctx context.Context, hostname string) error {
+	return nil
+}
+
+// WaitForDevice returns the machine once it has booted, with the gateway
+// address from the provider's config
+func (t *Tailnet) WaitForDevice(ctx context.Context, hostname string, timeout time.Duration) (*tailscale.Device, error) {
+	vmID := strings.TrimPrefix(hostname, hostnamePrefix)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+
+	for {
+		if t.provider.online(vmID) {
+			return &tailscale.Device{
+				ID:        "mock-" + vmID,
+				Name:      hostname,
+				Hostname:  hostname,
+				Addresses: []string{t.provider.config.GatewayIP},
+				Online:    true,
+				LastSeen:  time.Now().Format(time.RFC3339),
+			}, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeoutTimer.C:
+			return nil, fmt.Errorf("timeout waiting for device %s", hostname)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Provider creates and destroys the machines that back VMs. Hetzner Cloud
+// is the default; self-hosted deployments run on their own hypervisor.
+type Provider interface {
+	// Name identifies the provider in the database, logs and errors
+	Name() string
+
+	// CreateVM boots a machine running cloudInit and sets vm.ProviderID,
+	// and vm.PublicIP if the machine has a public IPv4
+	CreateVM(ctx context.Context, vm *models.VM, cloudInit string) error
+
+	// DeleteVM destroys the VM's machine. A machine that is already gone
+	// is not an error.
+	DeleteVM(ctx context.Context, vm *models.VM) error
+
+	// UpdateLabels mirrors the VM's labels onto its machine
+	UpdateLabels(ctx context.Context, vm *models.VM) error
+
+	// Ping checks that the provider is reachable
+	Ping(ctx context.Context) error
+}
+
+// Console is implemented by providers that can open a console on a machine
+// without going through its network, for operators to reach VMs whose
+// gateway or tailnet connection is broken
+type Console interface {
+	Console(ctx context.Context, vm *models.VM) (*models.ConsoleResponse, error)
+}
+
+// Rebuilder is implemented by providers that can replace a VM's machine
+// while keeping its workspace storage. For other providers the machine is
+// deleted and created again, and the workspace starts empty.
+type Rebuilder interface {
+	// RebuildVM replaces the VM's machine with a fresh one booted from
+	// cloudInit, setting vm.ProviderID and vm.PublicIP like CreateVM
+	RebuildVM(ctx context.Context, vm *models.VM, cloudInit string) error
+}
+
+// Suspender is implemented by providers that can stop a VM's machine while
+// keeping its disk, so an idle VM stops using compute until it is resumed.
+// Hetzner Cloud bills stopped servers in full, so it does not implement it.
+type Suspender interface {
+	// SuspendVM stops the VM's machine
+	SuspendVM(ctx context.Context, vm *models.VM) error
+
+	// ResumeVM starts a machine SuspendVM stopped. Its gateway rejoins the
+	// tailnet at the same address.
+	ResumeVM(ctx context.Context, vm *models.VM) error
+}
+
+// machineCreatedKey carries the callback MachineCreated calls
+type machineCreatedKey struct{}
+
+// WithMachineCreated returns a context under which a provider's CreateVM
+// calls created once the machine exists, if it goes on to wait for it
+// after that, so the wait can be timed apart from creating the machine
+func WithMachineCreated(ctx context.Context, created func()) context.Context {
+	return context.WithValue(ctx, machineCreatedKey{}, created)
+}
+
+// MachineCreated is called by providers whose CreateVM waits for the new
+// machine, such as for its public IP, once it exists
+func MachineCreated(ctx context.Context) {
+	if created, ok := ctx.Value(machineCreatedKey{}).(func()); ok {
+		created()
+	}
+}
+
+// RunCommand runs a command and includes its output in the error, since CLI
+// tools such as virsh and docker report failures on stderr
+func RunCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if msg := bytes.TrimSpace(out); len(msg) > 0 {
+			return out, fmt.Errorf("%w: %s", err, msg)
+		}
+		return out, err
+	}
+	return out, nil
+}
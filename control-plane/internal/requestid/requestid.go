@@ -0,0 +1,69 @@
+package requestid
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Header carries the request ID in requests and responses
+const Header = "X-Request-ID"
+
+// maxLength bounds client-supplied IDs so they cannot bloat log lines
+const maxLength = 128
+
+type contextKey struct{}
+
+// New generates a request ID
+func New() string {
+	return uuid.New().String()
+}
+
+// Valid reports whether a client-supplied ID can be reused: non-empty,
+// bounded, and printable ASCII without spaces
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithContext returns a context carrying id and a logger that tags every
+// line with it
+func WithContext(ctx context.Context, id string) context.Context {
+	logger := Logger(ctx).With().Str("request_id", id).Logger()
+	ctx = context.WithValue(ctx, contextKey{}, id)
+	return logger.WithContext(ctx)
+}
+
+// FromContext returns the request ID carried by ctx, or ""
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns the request-scoped logger carried by ctx, or the global
+// logger outside a request
+func Logger(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
+
+// Detach returns a background context carrying ctx's request ID and logger,
+// for work such as provisioning that outlives the request
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if id := FromContext(ctx); id != "" {
+		detached = context.WithValue(detached, contextKey{}, id)
+	}
+	return Logger(ctx).WithContext(detached)
+}
@@ -0,0 +1,65 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"uuid", New(), true},
+		{"printable ASCII", "req-42_abc.DEF~!", true},
+		{"longest", strings.Repeat("a", maxLength), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", maxLength+1), false},
+		{"space", "req 42", false},
+		{"newline", "req-42\nforged=1", false},
+		{"tab", "req\t42", false},
+		{"delete", "req\x7f", false},
+		{"non-ASCII", "réq-42", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.id); got != tt.want {
+				t.Fatalf("Valid(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextCarriesIDAndLogger(t *testing.T) {
+	var buf bytes.Buffer
+	base := zerolog.New(&buf).WithContext(context.Background())
+
+	ctx := WithContext(base, "req-1")
+	if got := FromContext(ctx); got != "req-1" {
+		t.Fatalf("expected req-1, got %q", got)
+	}
+	Logger(ctx).Info().Msg("hello")
+	if !strings.Contains(buf.String(), `"request_id":"req-1"`) {
+		t.Fatalf("expected the log line tagged with the request ID, got %s", buf.String())
+	}
+
+	// Detached work keeps the ID but not the request's cancellation
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	detached := Detach(cancelled)
+	if detached.Err() != nil {
+		t.Fatal("expected the detached context not to be cancelled")
+	}
+	if got := FromContext(detached); got != "req-1" {
+		t.Fatalf("expected req-1 after detaching, got %q", got)
+	}
+
+	if got := FromContext(context.Background()); got != "" {
+		t.Fatalf("expected no ID outside a request, got %q", got)
+	}
+}
@@ -0,0 +1,189 @@
+// Package secrets encrypts sensitive database columns with AES-256-GCM, so
+// a leaked database dump or backup does not leak the credentials in it.
+package secrets
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeySize is the length of column keys: AES-256
+const KeySize = 32
+
+// prefix marks sealed values; values without it are legacy plaintext
+const prefix = "enc:v1:"
+
+// ErrUnknownKey is returned when opening a value sealed with a key that is
+// not in the keyring, or a sealed value without a keyring
+var ErrUnknownKey = errors.New("value is sealed with an unknown key")
+
+// Key is one column encryption key. IDs are stored with each value, so keys
+// can be rotated without re-encrypting everything at once.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring seals values with its current key and opens values sealed with
+// any of its keys. A nil Keyring stores values in plaintext.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring. The first key is current; the others are
+// kept to open values sealed before a rotation.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one key")
+	}
+
+	k := &Keyring{current: keys[0].ID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("key ID %q must be non-empty and contain no colon", key.ID)
+		}
+		if _, dup := k.aeads[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		if len(key.Secret) != KeySize {
+			return nil, fmt.Errorf("key %s is %d bytes, want %d", key.ID, len(key.Secret), KeySize)
+		}
+
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[key.ID] = aead
+	}
+	return k, nil
+}
+
+// ParseKey decodes a base64 key
+func ParseKey(id, encoded string) (Key, error) {
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return Key{}, fmt.Errorf("decode key %s: %w", id, err)
+	}
+	return Key{ID: id, Secret: secret}, nil
+}
+
+// ReadKeyFile reads keys from a file of "id=base64-key" lines, newest
+// first, such as one rendered by a KMS or secret manager agent. Blank lines
+// and lines starting with # are skipped.
+func ReadKeyFile(path string) ([]Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []Key
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want id=base64-key", path, line)
+		}
+		key, err := ParseKey(strings.TrimSpace(id), encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// GenerateKey returns a random key, base64 encoded as ParseKey expects
+func GenerateKey() (string, error) {
+	secret := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// Seal encrypts plaintext with the current key. binding names where the
+// value is stored, such as the table, column and row ID; Open needs the same
+// binding, so a sealed value copied to another row does not open. Empty
+// values stay empty.
+func (k *Keyring) Seal(plaintext, binding string) (string, error) {
+	if k == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(binding))
+	return prefix + k.current + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed with any key in the keyring. Values that
+// were never sealed are returned as they are, so columns written before
+// encryption was enabled still read.
+func (k *Keyring) Open(value, binding string) (string, error) {
+	keyID, encoded, sealed := parse(value)
+	if !sealed {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrUnknownKey
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(binding))
+	if err != nil {
+		return "", fmt.Errorf("open sealed value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Current reports whether value is empty or already sealed with the
+// current key, so rotation can leave it alone
+func (k *Keyring) Current(value string) bool {
+	if value == "" {
+		return true
+	}
+	keyID, _, sealed := parse(value)
+	if k == nil {
+		return !sealed
+	}
+	return sealed && keyID == k.current
+}
+
+// parse splits a sealed value into its key ID and payload
+func parse(value string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return "", "", false
+	}
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	return keyID, encoded, ok
+}
@@ -0,0 +1,205 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, id string) Key {
+	t.Helper()
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKey(id, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k, err := NewKeyring(testKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := k.Seal("hcloud-token", "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, prefix+"k1:") || strings.Contains(sealed, "hcloud-token") {
+		t.Fatalf("expected a value sealed with k1, got %q", sealed)
+	}
+	if !k.Current(sealed) {
+		t.Error("expected a value sealed with the current key to be current")
+	}
+
+	opened, err := k.Open(sealed, "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != "hcloud-token" {
+		t.Fatalf("expected hcloud-token, got %q", opened)
+	}
+
+	if empty, _ := k.Seal("", "vms:api_token:vm-1"); empty != "" {
+		t.Errorf("expected empty values to stay empty, got %q", empty)
+	}
+}
+
+func TestKeyringOpenWrongBinding(t *testing.T) {
+	k, err := NewKeyring(testKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := k.Seal("hcloud-token", "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copied to another row, the value does not open
+	if _, err := k.Open(sealed, "vms:api_token:vm-2"); err == nil {
+		t.Fatal("expected a value opened with another binding to fail")
+	}
+}
+
+func TestKeyringOpenTampered(t *testing.T) {
+	k, err := NewKeyring(testKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := k.Seal("hcloud-token", "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, encoded, _ := parse(sealed)
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []string{
+		// A flipped ciphertext bit
+		prefix + keyID + ":" + base64.RawStdEncoding.EncodeToString(flip(data, len(data)-1)),
+		// A flipped nonce bit
+		prefix + keyID + ":" + base64.RawStdEncoding.EncodeToString(flip(data, 0)),
+		// Truncated to less than a nonce
+		prefix + keyID + ":" + base64.RawStdEncoding.EncodeToString(data[:4]),
+		prefix + keyID + ":not base64!",
+	}
+	for _, value := range tampered {
+		if _, err := k.Open(value, "vms:api_token:vm-1"); err == nil {
+			t.Errorf("expected tampered value %q to be refused", value)
+		}
+	}
+}
+
+func flip(data []byte, i int) []byte {
+	data = bytes.Clone(data)
+	data[i] ^= 0x01
+	return data
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, current := testKey(t, "k1"), testKey(t, "k2")
+
+	before, err := NewKeyring(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := before.Seal("hcloud-token", "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := NewKeyring(current, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := after.Open(sealed, "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatalf("expected a value sealed before the rotation to open, got %v", err)
+	}
+	if opened != "hcloud-token" {
+		t.Fatalf("expected hcloud-token, got %q", opened)
+	}
+	if after.Current(sealed) {
+		t.Error("expected a value sealed with the old key to need resealing")
+	}
+
+	resealed, err := after.Seal(opened, "vms:api_token:vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resealed, prefix+"k2:") || !after.Current(resealed) {
+		t.Errorf("expected new values sealed with k2, got %q", resealed)
+	}
+
+	// Once the old key is dropped, its values no longer open
+	dropped, err := NewKeyring(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dropped.Open(sealed, "vms:api_token:vm-1"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestKeyringLegacyPlaintext(t *testing.T) {
+	k, err := NewKeyring(testKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Columns written before encryption was enabled still read
+	opened, err := k.Open("hcloud-token", "vms:api_token:vm-1")
+	if err != nil || opened != "hcloud-token" {
+		t.Fatalf("expected plaintext returned as it is, got %q, %v", opened, err)
+	}
+	if k.Current("hcloud-token") {
+		t.Error("expected plaintext to need sealing")
+	}
+
+	// Without a keyring values are stored as they are, and sealed ones
+	// cannot be read
+	var none *Keyring
+	if value, _ := none.Seal("hcloud-token", "vms:api_token:vm-1"); value != "hcloud-token" {
+		t.Errorf("expected plaintext without a keyring, got %q", value)
+	}
+	sealed, _ := k.Seal("hcloud-token", "vms:api_token:vm-1")
+	if _, err := none.Open(sealed, "vms:api_token:vm-1"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey without a keyring, got %v", err)
+	}
+}
+
+func TestNewKeyringRejectsBadKeys(t *testing.T) {
+	valid := testKey(t, "k1")
+
+	tests := []struct {
+		name string
+		keys []Key
+	}{
+		{"no keys", nil},
+		{"short key", []Key{{ID: "k1", Secret: make([]byte, 16)}}},
+		{"long key", []Key{{ID: "k1", Secret: make([]byte, 64)}}},
+		{"empty ID", []Key{{ID: "", Secret: valid.Secret}}},
+		{"colon in ID", []Key{{ID: "k:1", Secret: valid.Secret}}},
+		{"duplicate ID", []Key{valid, valid}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.keys...); err == nil {
+				t.Fatal("expected the keyring to be refused")
+			}
+		})
+	}
+
+	if _, err := ParseKey("k1", "not base64!"); err == nil {
+		t.Error("expected a key that is not base64 to be refused")
+	}
+}
@@ -0,0 +1,768 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Store is an in-memory store.Store for tests and local development.
+// Records are copied on the way in and out, as they would be by a database.
+type Store struct {
+	mu          sync.RWMutex
+	vms         map[string]models.VM
+	ingest      map[string]string // ingest token IDs by VM
+	revocations []store.TokenRevocation
+	logs        map[string][]models.LogEntry
+	nextLogID   int64
+	activity    map[string]map[int64]models.ActivitySample // by VM, then Unix minute
+	contexts    map[contextKey]contextSnapshot
+	backups     []models.WorkspaceBackup
+	archive     map[string]models.VM
+	ops         []operation
+	nextOpID    int64
+	targets     []models.NotificationTarget
+	nextTarget  int64
+}
+
+type operation struct {
+	store.Operation
+	leasedUntil time.Time
+}
+
+type contextKey struct {
+	userID, workspace, sessionID string
+}
+
+type contextSnapshot struct {
+	vmID      string
+	data      []byte
+	updatedAt time.Time
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{
+		vms:      make(map[string]models.VM),
+		ingest:   make(map[string]string),
+		contexts: make(map[contextKey]contextSnapshot),
+		archive:  make(map[string]models.VM),
+	}
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *Store) CreateVM(ctx context.Context, vm *models.VM, op *store.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *vm
+	stored.Labels = labels.Copy(vm.Labels)
+	s.vms[vm.ID] = stored
+	if op != nil {
+		s.createOperation(vm.ID, op)
+	}
+	return nil
+}
+
+func (s *Store) GetVM(ctx context.Context, id string) (*models.VM, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	vm, ok := s.vms[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	vm.Labels = labels.Copy(vm.Labels)
+	return &vm, nil
+}
+
+func (s *Store) ListVMsByUser(ctx context.Context, userID string) ([]*models.VM, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var vms []*models.VM
+	for _, vm := range s.vms {
+		if vm.UserID == userID {
+			vm := vm
+			vm.Labels = labels.Copy(vm.Labels)
+			vms = append(vms, &vm)
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].CreatedAt.After(vms[j].CreatedAt)
+	})
+	return vms, nil
+}
+
+func (s *Store) ListVMsByStatus(ctx context.Context, status models.VMStatus) ([]*models.VM, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var vms []*models.VM
+	for _, vm := range s.vms {
+		if vm.Status == status {
+			vm := vm
+			vm.Labels = labels.Copy(vm.Labels)
+			vms = append(vms, &vm)
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].CreatedAt.After(vms[j].CreatedAt)
+	})
+	return vms, nil
+}
+
+func (s *Store) UpdateVMLabels(ctx context.Context, id string, vmLabels map[string]string) error {
+	return s.update(id, func(vm *models.VM) {
+		vm.Labels = labels.Copy(vmLabels)
+	})
+}
+
+func (s *Store) ClaimPoolVM(ctx context.Context, id, userID string, vmLabels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok || vm.UserID != models.PoolUserID || vm.Status != models.VMStatusRunning {
+		return store.ErrNotFound
+	}
+	vm.UserID = userID
+	vm.Labels = labels.Copy(vmLabels)
+	vm.LastActivity = time.Now()
+	vm.UpdatedAt = vm.LastActivity
+	s.vms[id] = vm
+	return nil
+}
+
+func (s *Store) UpdateVMStatus(ctx context.Context, id string, status models.VMStatus) error {
+	return s.update(id, func(vm *models.VM) {
+		vm.Status = status
+	})
+}
+
+func (s *Store) UpdateVMMachine(ctx context.Context, id string, providerID, publicIP string) error {
+	return s.update(id, func(vm *models.VM) {
+		vm.ProviderID = providerID
+		vm.PublicIP = publicIP
+	})
+}
+
+func (s *Store) SetVMIngestToken(ctx context.Context, id, tokenID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.vms[id]; !ok {
+		return store.ErrNotFound
+	}
+	s.ingest[id] = tokenID
+	return nil
+}
+
+func (s *Store) GetVMIngestToken(ctx context.Context, id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.vms[id]; !ok {
+		return "", store.ErrNotFound
+	}
+	return s.ingest[id], nil
+}
+
+func (s *Store) StartVMOperation(ctx context.Context, id string, status models.VMStatus, op *store.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	vm.Status = status
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	s.cancelOperations(id)
+	s.createOperation(id, op)
+	return nil
+}
+
+func (s *Store) RetryVMOperation(ctx context.Context, id string, op *store.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok || vm.Status != models.VMStatusProvisioning {
+		return store.ErrNotFound
+	}
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	s.cancelOperations(id)
+	s.createOperation(id, op)
+	return nil
+}
+
+func (s *Store) AbandonVMOperations(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok || vm.Status != models.VMStatusProvisioning {
+		return store.ErrNotFound
+	}
+	vm.Status = models.VMStatusError
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	s.cancelOperations(id)
+	return nil
+}
+
+func (s *Store) LeaseVMOperations(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*store.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leased []*store.Operation
+	for i := range s.ops {
+		op := &s.ops[i]
+		if len(leased) == limit {
+			break
+		}
+		if op.Status != store.OperationPending || op.RunAfter.After(now) || op.leasedUntil.After(now) {
+			continue
+		}
+		op.Attempts++
+		op.leasedUntil = now.Add(lease)
+		leased = append(leased, copyOperation(op.Operation))
+	}
+	return leased, nil
+}
+
+func (s *Store) CompleteVMOperation(ctx context.Context, leased *store.Operation, result store.OperationResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var op *operation
+	for i := range s.ops {
+		if s.ops[i].ID == leased.ID {
+			op = &s.ops[i]
+		}
+	}
+	if op == nil || op.Status != store.OperationPending || op.Attempts != leased.Attempts {
+		return store.ErrNotFound
+	}
+	op.Status = result.Status
+	op.LastError = result.Error
+	op.leasedUntil = time.Time{}
+	if result.Status == store.OperationPending {
+		op.RunAfter = result.RetryAt
+	}
+
+	vm, ok := s.vms[op.VMID]
+	if !ok || vm.Status != models.VMStatusProvisioning {
+		return nil
+	}
+	switch result.VMStatus {
+	case models.VMStatusRunning:
+		vm.Status = models.VMStatusRunning
+		vm.TailscaleIP = result.TailscaleIP
+	case models.VMStatusError:
+		vm.Status = models.VMStatusError
+	default:
+		return nil
+	}
+	vm.UpdatedAt = time.Now()
+	s.vms[op.VMID] = vm
+	return nil
+}
+
+func (s *Store) ListPendingVMOperations(ctx context.Context) ([]*store.Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ops []*store.Operation
+	for _, op := range s.ops {
+		if op.Status == store.OperationPending {
+			ops = append(ops, copyOperation(op.Operation))
+		}
+	}
+	return ops, nil
+}
+
+func (s *Store) ListVMOperations(ctx context.Context, vmID string, limit int) ([]*store.Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ops []*store.Operation
+	for i := len(s.ops) - 1; i >= 0 && len(ops) < limit; i-- {
+		if s.ops[i].VMID == vmID {
+			ops = append(ops, copyOperation(s.ops[i].Operation))
+		}
+	}
+	return ops, nil
+}
+
+// cancelOperations cancels the VM's pending operations; the caller holds
+// s.mu
+func (s *Store) cancelOperations(vmID string) {
+	for i := range s.ops {
+		if s.ops[i].VMID == vmID && s.ops[i].Status == store.OperationPending {
+			s.ops[i].Status = store.OperationCancelled
+			s.ops[i].leasedUntil = time.Time{}
+		}
+	}
+}
+
+// createOperation records op for the VM; the caller holds s.mu
+func (s *Store) createOperation(vmID string, op *store.Operation) {
+	now := time.Now().UTC()
+	if op.RunAfter.IsZero() {
+		op.RunAfter = now
+	}
+	if op.Source == "" {
+		op.Source = store.SourceAPI
+	}
+	s.nextOpID++
+	op.ID = s.nextOpID
+	op.VMID, op.Status, op.CreatedAt = vmID, store.OperationPending, now
+	s.ops = append(s.ops, operation{Operation: *op})
+}
+
+func copyOperation(op store.Operation) *store.Operation {
+	return &op
+}
+
+func (s *Store) ScheduleVMDeletion(ctx context.Context, id string, deleteAt time.Time, backup bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok || vm.Status == models.VMStatusTerminated {
+		return store.ErrNotFound
+	}
+	deleteAt = deleteAt.UTC()
+	vm.Status = models.VMStatusTerminating
+	vm.DeleteAt = &deleteAt
+	vm.BackupOnDelete = backup
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	return nil
+}
+
+func (s *Store) CancelVMDeletion(ctx context.Context, id string, status models.VMStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok || vm.Status != models.VMStatusTerminating {
+		return store.ErrNotFound
+	}
+	vm.Status = status
+	vm.DeleteAt = nil
+	vm.BackupOnDelete = false
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	return nil
+}
+
+func (s *Store) TerminateVM(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	at = at.UTC()
+	vm.Status = models.VMStatusTerminated
+	vm.TailscaleAuthKey = ""
+	delete(s.ingest, id)
+	vm.DeleteAt = nil
+	vm.BackupOnDelete = false
+	vm.TerminatedAt = &at
+	vm.UpdatedAt = at
+	s.vms[id] = vm
+	return nil
+}
+
+func (s *Store) ArchiveVMs(ctx context.Context, terminatedBefore, archivedAt time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var archived int64
+	for id, vm := range s.vms {
+		if vm.Status != models.VMStatusTerminated || vm.TerminatedAt == nil || !vm.TerminatedAt.Before(terminatedBefore) {
+			continue
+		}
+		s.archive[id] = vm
+		delete(s.vms, id)
+		delete(s.logs, id)
+		delete(s.activity, id)
+		archived++
+	}
+
+	revocations := s.revocations[:0]
+	for _, rev := range s.revocations {
+		if _, ok := s.archive[rev.VMID]; !ok {
+			revocations = append(revocations, rev)
+		}
+	}
+	s.revocations = revocations
+
+	ops := s.ops[:0]
+	for _, op := range s.ops {
+		if _, ok := s.archive[op.VMID]; !ok {
+			ops = append(ops, op)
+		}
+	}
+	s.ops = ops
+	return archived, nil
+}
+
+func (s *Store) PurgeArchivedVMs(ctx context.Context, terminatedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for id, vm := range s.archive {
+		if vm.TerminatedAt.Before(terminatedBefore) {
+			delete(s.archive, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// RotateSecrets has nothing to do: records never leave memory
+func (s *Store) RotateSecrets(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *Store) CreateTokenRevocation(ctx context.Context, rev *store.TokenRevocation) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.vms[rev.VMID]; !ok {
+		return 0, store.ErrNotFound
+	}
+
+	stored := *rev
+	stored.ID = int64(len(s.revocations) + 1)
+	s.revocations = append(s.revocations, stored)
+	return stored.ID, nil
+}
+
+func (s *Store) MarkTokenRevocationPropagated(ctx context.Context, id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || int(id) > len(s.revocations) {
+		return store.ErrNotFound
+	}
+	s.revocations[id-1].PropagatedAt = at
+	return nil
+}
+
+func (s *Store) AppendVMLogs(ctx context.Context, vmID string, entries []models.LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.vms[vmID]; !ok {
+		return store.ErrNotFound
+	}
+	if s.logs == nil {
+		s.logs = make(map[string][]models.LogEntry)
+	}
+
+	for _, entry := range entries {
+		s.nextLogID++
+		entry.ID = s.nextLogID
+		s.logs[vmID] = append(s.logs[vmID], entry)
+	}
+	return nil
+}
+
+func (s *Store) ListVMLogs(ctx context.Context, vmID string, filter store.LogFilter) ([]models.LogEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if filter.Limit <= 0 {
+		filter.Limit = store.DefaultLogLimit
+	}
+
+	var entries []models.LogEntry
+	for _, entry := range s.logs[vmID] {
+		if filter.Kind != "" && entry.Kind != filter.Kind {
+			continue
+		}
+		if entry.Time.Before(filter.Since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].ID > entries[j].ID
+		}
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+func (s *Store) RecordVMActivity(ctx context.Context, vmID string, samples []models.ActivitySample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[vmID]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if s.activity == nil {
+		s.activity = make(map[string]map[int64]models.ActivitySample)
+	}
+	if s.activity[vmID] == nil {
+		s.activity[vmID] = make(map[int64]models.ActivitySample)
+	}
+
+	for _, sample := range samples {
+		s.activity[vmID][sample.Minute.Unix()] = sample
+		if end := sample.Minute.Add(time.Minute); end.After(vm.LastActivity) {
+			vm.LastActivity = end
+		}
+	}
+	s.vms[vmID] = vm
+	return nil
+}
+
+func (s *Store) ListVMActivity(ctx context.Context, vmID string, since, until time.Time) ([]models.ActivitySample, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	samples := []models.ActivitySample{}
+	for _, sample := range s.activity[vmID] {
+		if !sample.Minute.Before(since) && sample.Minute.Before(until) {
+			samples = append(samples, sample)
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Minute.Before(samples[j].Minute) })
+	return samples, nil
+}
+
+func (s *Store) PutContextSnapshot(ctx context.Context, userID string, snapshot *models.ContextSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.contexts[contextKey{userID, snapshot.Workspace, snapshot.SessionID}] = contextSnapshot{
+		vmID:      snapshot.VMID,
+		data:      append([]byte(nil), snapshot.Data...),
+		updatedAt: snapshot.UpdatedAt,
+	}
+	return nil
+}
+
+func (s *Store) ListContextSnapshots(ctx context.Context, userID string, limit int) ([]models.ContextSnapshot, error) {
+	if limit <= 0 {
+		limit = store.DefaultContextSnapshotLimit
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := []models.ContextSnapshot{}
+	for key, snap := range s.contexts {
+		if key.userID != userID {
+			continue
+		}
+		snapshots = append(snapshots, models.ContextSnapshot{
+			Workspace: key.workspace,
+			SessionID: key.sessionID,
+			VMID:      snap.vmID,
+			Size:      int64(len(snap.data)),
+			UpdatedAt: snap.updatedAt,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].UpdatedAt.After(snapshots[j].UpdatedAt)
+	})
+	if len(snapshots) > limit {
+		snapshots = snapshots[:limit]
+	}
+	return snapshots, nil
+}
+
+func (s *Store) GetContextSnapshot(ctx context.Context, userID, workspace, sessionID string) (*models.ContextSnapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap, ok := s.contexts[contextKey{userID, workspace, sessionID}]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return &models.ContextSnapshot{
+		Workspace: workspace,
+		SessionID: sessionID,
+		VMID:      snap.vmID,
+		Size:      int64(len(snap.data)),
+		UpdatedAt: snap.updatedAt,
+		Data:      append([]byte(nil), snap.data...),
+	}, nil
+}
+
+func (s *Store) CreateBackup(ctx context.Context, backup *models.WorkspaceBackup) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *backup
+	stored.ID = int64(len(s.backups) + 1)
+	s.backups = append(s.backups, stored)
+	return stored.ID, nil
+}
+
+func (s *Store) CompleteBackup(ctx context.Context, id int64, vmID string, sizeBytes int64, sha256 string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > int64(len(s.backups)) {
+		return store.ErrNotFound
+	}
+	backup := &s.backups[id-1]
+	if backup.VMID != vmID || backup.Status != models.BackupStatusPending {
+		return store.ErrNotFound
+	}
+	backup.Status = models.BackupStatusComplete
+	backup.SizeBytes = sizeBytes
+	backup.SHA256 = sha256
+	backup.CompletedAt = &at
+	return nil
+}
+
+func (s *Store) GetBackup(ctx context.Context, id int64) (*models.WorkspaceBackup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > int64(len(s.backups)) {
+		return nil, store.ErrNotFound
+	}
+	backup := s.backups[id-1]
+	return &backup, nil
+}
+
+func (s *Store) ListBackupsByUser(ctx context.Context, userID string) ([]models.WorkspaceBackup, error) {
+	return s.listBackups(func(b *models.WorkspaceBackup) bool { return b.UserID == userID }), nil
+}
+
+func (s *Store) ListVMBackups(ctx context.Context, vmID, workspace string) ([]models.WorkspaceBackup, error) {
+	return s.listBackups(func(b *models.WorkspaceBackup) bool {
+		return b.VMID == vmID && b.Workspace == workspace
+	}), nil
+}
+
+// listBackups returns the complete backups match accepts, newest first
+func (s *Store) listBackups(match func(b *models.WorkspaceBackup) bool) []models.WorkspaceBackup {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	backups := []models.WorkspaceBackup{}
+	for i := len(s.backups) - 1; i >= 0; i-- {
+		if b := s.backups[i]; b.Status == models.BackupStatusComplete && match(&b) {
+			backups = append(backups, b)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups
+}
+
+func (s *Store) MarkBackupDeleted(ctx context.Context, id int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > int64(len(s.backups)) {
+		return store.ErrNotFound
+	}
+	s.backups[id-1].Status = models.BackupStatusDeleted
+	return nil
+}
+
+func (s *Store) PutNotificationTarget(ctx context.Context, target *models.NotificationTarget) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.targets {
+		if t.Kind == target.Kind && t.Address == target.Address {
+			s.targets[i].UserID = target.UserID
+			target.ID, target.CreatedAt = t.ID, t.CreatedAt
+			return nil
+		}
+	}
+
+	s.nextTarget++
+	target.ID, target.CreatedAt = s.nextTarget, time.Now()
+	s.targets = append(s.targets, *target)
+	return nil
+}
+
+func (s *Store) ListNotificationTargets(ctx context.Context, userID string) ([]models.NotificationTarget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	targets := []models.NotificationTarget{}
+	for _, t := range s.targets {
+		if t.UserID == userID {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+func (s *Store) DeleteNotificationTarget(ctx context.Context, userID string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, t := range s.targets {
+		if t.ID == id && t.UserID == userID {
+			s.targets = append(s.targets[:i], s.targets[i+1:]...)
+			return nil
+		}
+	}
+	return store.ErrNotFound
+}
+
+// TokenRevocations returns the revocations recorded for a VM, oldest first
+func (s *Store) TokenRevocations(vmID string) []store.TokenRevocation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var revs []store.TokenRevocation
+	for _, rev := range s.revocations {
+		if rev.VMID == vmID {
+			revs = append(revs, rev)
+		}
+	}
+	return revs
+}
+
+func (s *Store) update(id string, fn func(vm *models.VM)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vm, ok := s.vms[id]
+	if !ok {
+		return store.ErrNotFound
+	}
+	fn(&vm)
+	vm.UpdatedAt = time.Now()
+	s.vms[id] = vm
+	return nil
+}
@@ -0,0 +1,871 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/secrets"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/internal/store/postgres/db"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// Store is the Postgres store.Store. Queries live in queries/*.sql and are
+// compiled to the db package with `make sqlc`.
+type Store struct {
+	conn *sql.DB
+	q    *db.Queries
+	keys *secrets.Keyring
+}
+
+var _ store.Store = (*Store)(nil)
+
+// New creates a store on conn. Sensitive columns are sealed with keys; nil
+// stores them in plaintext.
+func New(conn *sql.DB, keys *secrets.Keyring) *Store {
+	return &Store{
+		conn: conn,
+		q:    db.New(conn),
+		keys: keys,
+	}
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return s.conn.PingContext(ctx)
+}
+
+func (s *Store) CreateVM(ctx context.Context, vm *models.VM, op *store.Operation) error {
+	specJSON, err := json.Marshal(vm.Spec)
+	if err != nil {
+		return fmt.Errorf("marshal spec: %w", err)
+	}
+	labelsJSON, err := json.Marshal(labels.Copy(vm.Labels))
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+	authKey, err := s.keys.Seal(vm.TailscaleAuthKey, store.AuthKeyBinding(vm.ID))
+	if err != nil {
+		return fmt.Errorf("seal tailscale auth key: %w", err)
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	err = q.CreateVM(ctx, db.CreateVMParams{
+		ID:               vm.ID,
+		UserID:           vm.UserID,
+		Status:           string(vm.Status),
+		Spec:             specJSON,
+		Labels:           labelsJSON,
+		Provider:         vm.Provider,
+		TailscaleAuthKey: nullString(authKey),
+		CreatedAt:        vm.CreatedAt,
+		UpdatedAt:        vm.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if op != nil {
+		if err := createOperation(ctx, q, vm.ID, op); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetVM(ctx context.Context, id string) (*models.VM, error) {
+	row, err := s.q.GetVM(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.vmFromRow(row)
+}
+
+func (s *Store) ListVMsByUser(ctx context.Context, userID string) ([]*models.VM, error) {
+	rows, err := s.q.ListVMsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]*models.VM, 0, len(rows))
+	for _, row := range rows {
+		vm, err := s.vmFromRow(db.GetVMRow(row))
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+func (s *Store) ListVMsByStatus(ctx context.Context, status models.VMStatus) ([]*models.VM, error) {
+	rows, err := s.q.ListVMsByStatus(ctx, string(status))
+	if err != nil {
+		return nil, err
+	}
+
+	vms := make([]*models.VM, 0, len(rows))
+	for _, row := range rows {
+		vm, err := s.vmFromRow(db.GetVMRow(row))
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+func (s *Store) vmFromRow(row db.GetVMRow) (*models.VM, error) {
+	vm := &models.VM{
+		ID:             row.ID,
+		UserID:         row.UserID,
+		Provider:       row.Provider,
+		ProviderID:     row.ProviderID.String,
+		PublicIP:       row.PublicIp.String,
+		TailscaleIP:    row.TailscaleIp.String,
+		Status:         models.VMStatus(row.Status),
+		LastActivity:   row.LastActivity.Time,
+		CreatedAt:      row.CreatedAt,
+		UpdatedAt:      row.UpdatedAt,
+		BackupOnDelete: row.BackupOnDelete,
+	}
+	if row.DeleteAt.Valid {
+		vm.DeleteAt = &row.DeleteAt.Time
+	}
+	if row.TerminatedAt.Valid {
+		vm.TerminatedAt = &row.TerminatedAt.Time
+	}
+	authKey, err := s.keys.Open(row.TailscaleAuthKey.String, store.AuthKeyBinding(row.ID))
+	if err != nil {
+		return nil, fmt.Errorf("vm %s: open tailscale auth key: %w", row.ID, err)
+	}
+	vm.TailscaleAuthKey = authKey
+	if err := json.Unmarshal(row.Spec, &vm.Spec); err != nil {
+		return nil, fmt.Errorf("unmarshal spec: %w", err)
+	}
+	if err := json.Unmarshal(row.Labels, &vm.Labels); err != nil {
+		return nil, fmt.Errorf("unmarshal labels: %w", err)
+	}
+	return vm, nil
+}
+
+func (s *Store) UpdateVMStatus(ctx context.Context, id string, status models.VMStatus) error {
+	return affected(s.q.UpdateVMStatus(ctx, db.UpdateVMStatusParams{
+		Status:    string(status),
+		UpdatedAt: time.Now(),
+		ID:        id,
+	}))
+}
+
+func (s *Store) UpdateVMLabels(ctx context.Context, id string, vmLabels map[string]string) error {
+	labelsJSON, err := json.Marshal(labels.Copy(vmLabels))
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+
+	return affected(s.q.UpdateVMLabels(ctx, db.UpdateVMLabelsParams{
+		Labels:    labelsJSON,
+		UpdatedAt: time.Now(),
+		ID:        id,
+	}))
+}
+
+func (s *Store) ClaimPoolVM(ctx context.Context, id, userID string, vmLabels map[string]string) error {
+	labelsJSON, err := json.Marshal(labels.Copy(vmLabels))
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+
+	now := time.Now()
+	return affected(s.q.ClaimPoolVM(ctx, db.ClaimPoolVMParams{
+		UserID:       userID,
+		Labels:       labelsJSON,
+		LastActivity: sql.NullTime{Time: now, Valid: true},
+		UpdatedAt:    now,
+		ID:           id,
+	}))
+}
+
+func (s *Store) UpdateVMMachine(ctx context.Context, id string, providerID, publicIP string) error {
+	return affected(s.q.UpdateVMMachine(ctx, db.UpdateVMMachineParams{
+		ProviderID: sql.NullString{String: providerID, Valid: true},
+		PublicIp:   sql.NullString{String: publicIP, Valid: publicIP != ""},
+		UpdatedAt:  time.Now(),
+		ID:         id,
+	}))
+}
+
+func (s *Store) SetVMIngestToken(ctx context.Context, id, tokenID string) error {
+	return affected(s.q.SetVMIngestToken(ctx, db.SetVMIngestTokenParams{
+		IngestTokenID: sql.NullString{String: tokenID, Valid: tokenID != ""},
+		ID:            id,
+	}))
+}
+
+func (s *Store) GetVMIngestToken(ctx context.Context, id string) (string, error) {
+	tokenID, err := s.q.GetVMIngestToken(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", store.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return tokenID.String, nil
+}
+
+func (s *Store) StartVMOperation(ctx context.Context, id string, status models.VMStatus, op *store.Operation) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	if err := affected(q.UpdateVMStatus(ctx, db.UpdateVMStatusParams{
+		Status:    string(status),
+		UpdatedAt: time.Now(),
+		ID:        id,
+	})); err != nil {
+		return err
+	}
+	if err := q.CancelVMOperations(ctx, db.CancelVMOperationsParams{UpdatedAt: time.Now().UTC(), VmID: id}); err != nil {
+		return err
+	}
+	if err := createOperation(ctx, q, id, op); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) RetryVMOperation(ctx context.Context, id string, op *store.Operation) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	if err := affected(q.TouchProvisioningVM(ctx, db.TouchProvisioningVMParams{
+		UpdatedAt: time.Now(),
+		ID:        id,
+	})); err != nil {
+		return err
+	}
+	if err := q.CancelVMOperations(ctx, db.CancelVMOperationsParams{UpdatedAt: time.Now().UTC(), VmID: id}); err != nil {
+		return err
+	}
+	if err := createOperation(ctx, q, id, op); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) AbandonVMOperations(ctx context.Context, id string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	if err := affected(q.FailVMProvisioning(ctx, db.FailVMProvisioningParams{
+		UpdatedAt: time.Now(),
+		ID:        id,
+	})); err != nil {
+		return err
+	}
+	if err := q.CancelVMOperations(ctx, db.CancelVMOperationsParams{UpdatedAt: time.Now().UTC(), VmID: id}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) LeaseVMOperations(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*store.Operation, error) {
+	rows, err := s.q.ListDueVMOperations(ctx, db.ListDueVMOperationsParams{
+		Now:           now.UTC(),
+		MaxOperations: int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	leased := make([]*store.Operation, 0, len(rows))
+	for _, row := range rows {
+		n, err := s.q.LeaseVMOperation(ctx, db.LeaseVMOperationParams{
+			LeasedUntil: sql.NullTime{Time: now.Add(lease).UTC(), Valid: true},
+			Now:         now.UTC(),
+			ID:          row.ID,
+			Attempts:    row.Attempts,
+		})
+		if err != nil {
+			return leased, err
+		}
+		if n == 0 {
+			// Another worker leased it first
+			continue
+		}
+		op := operationFromRow(db.ListPendingVMOperationsRow(row))
+		op.Attempts++
+		leased = append(leased, op)
+	}
+	return leased, nil
+}
+
+func (s *Store) CompleteVMOperation(ctx context.Context, op *store.Operation, result store.OperationResult) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	runAfter := op.RunAfter
+	if result.Status == store.OperationPending {
+		runAfter = result.RetryAt
+	}
+	if err := affected(q.FinishVMOperation(ctx, db.FinishVMOperationParams{
+		Status:    string(result.Status),
+		LastError: result.Error,
+		RunAfter:  runAfter.UTC(),
+		UpdatedAt: time.Now().UTC(),
+		ID:        op.ID,
+		Attempts:  int32(op.Attempts),
+	})); err != nil {
+		return err
+	}
+
+	switch result.VMStatus {
+	case models.VMStatusRunning:
+		_, err = q.MarkVMReady(ctx, db.MarkVMReadyParams{
+			TailscaleIp: sql.NullString{String: result.TailscaleIP, Valid: true},
+			UpdatedAt:   time.Now(),
+			ID:          op.VMID,
+		})
+	case models.VMStatusError:
+		_, err = q.FailVMProvisioning(ctx, db.FailVMProvisioningParams{
+			UpdatedAt: time.Now(),
+			ID:        op.VMID,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListPendingVMOperations(ctx context.Context) ([]*store.Operation, error) {
+	rows, err := s.q.ListPendingVMOperations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]*store.Operation, 0, len(rows))
+	for _, row := range rows {
+		ops = append(ops, operationFromRow(row))
+	}
+	return ops, nil
+}
+
+func (s *Store) ListVMOperations(ctx context.Context, vmID string, limit int) ([]*store.Operation, error) {
+	rows, err := s.q.ListVMOperations(ctx, db.ListVMOperationsParams{
+		VmID:          vmID,
+		MaxOperations: int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]*store.Operation, 0, len(rows))
+	for _, row := range rows {
+		ops = append(ops, operationFromRow(db.ListPendingVMOperationsRow(row)))
+	}
+	return ops, nil
+}
+
+// createOperation records op for the VM within the caller's transaction
+func createOperation(ctx context.Context, q *db.Queries, vmID string, op *store.Operation) error {
+	now := time.Now().UTC()
+	if op.RunAfter.IsZero() {
+		op.RunAfter = now
+	}
+	if op.Source == "" {
+		op.Source = store.SourceAPI
+	}
+
+	id, err := q.CreateVMOperation(ctx, db.CreateVMOperationParams{
+		VmID:            vmID,
+		Kind:            string(op.Kind),
+		RestoreBackupID: op.RestoreBackupID,
+		RequestID:       op.RequestID,
+		Source:          string(op.Source),
+		RunAfter:        op.RunAfter.UTC(),
+		CreatedAt:       now,
+	})
+	if err != nil {
+		return fmt.Errorf("create operation: %w", err)
+	}
+	op.ID, op.VMID, op.Status, op.CreatedAt = id, vmID, store.OperationPending, now
+	return nil
+}
+
+func operationFromRow(row db.ListPendingVMOperationsRow) *store.Operation {
+	return &store.Operation{
+		ID:              row.ID,
+		VMID:            row.VmID,
+		Kind:            store.OperationKind(row.Kind),
+		RestoreBackupID: row.RestoreBackupID,
+		RequestID:       row.RequestID,
+		Source:          store.OperationSource(row.Source),
+		Status:          store.OperationStatus(row.Status),
+		Attempts:        int(row.Attempts),
+		LastError:       row.LastError,
+		RunAfter:        row.RunAfter,
+		CreatedAt:       row.CreatedAt,
+	}
+}
+
+func (s *Store) ScheduleVMDeletion(ctx context.Context, id string, deleteAt time.Time, backup bool) error {
+	return affected(s.q.ScheduleVMDeletion(ctx, db.ScheduleVMDeletionParams{
+		DeleteAt:       sql.NullTime{Time: deleteAt.UTC(), Valid: true},
+		BackupOnDelete: backup,
+		UpdatedAt:      time.Now(),
+		ID:             id,
+	}))
+}
+
+func (s *Store) CancelVMDeletion(ctx context.Context, id string, status models.VMStatus) error {
+	return affected(s.q.CancelVMDeletion(ctx, db.CancelVMDeletionParams{
+		Status:    string(status),
+		UpdatedAt: time.Now(),
+		ID:        id,
+	}))
+}
+
+func (s *Store) TerminateVM(ctx context.Context, id string, at time.Time) error {
+	return affected(s.q.TerminateVM(ctx, db.TerminateVMParams{
+		TerminatedAt: sql.NullTime{Time: at, Valid: true},
+		ID:           id,
+	}))
+}
+
+func (s *Store) ArchiveVMs(ctx context.Context, terminatedBefore, archivedAt time.Time) (int64, error) {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	before := sql.NullTime{Time: terminatedBefore, Valid: true}
+	if err := q.ArchiveTerminatedVMs(ctx, db.ArchiveTerminatedVMsParams{
+		ArchivedAt:       archivedAt,
+		TerminatedBefore: before,
+	}); err != nil {
+		return 0, fmt.Errorf("archive vms: %w", err)
+	}
+	for _, drop := range []func(context.Context, sql.NullTime) error{
+		q.DeleteTerminatedVMLogs,
+		q.DeleteTerminatedVMTokenRevocations,
+		q.DeleteTerminatedVMOperations,
+		q.DeleteTerminatedVMActivity,
+		q.DeleteTerminatedVMActivityMinutes,
+	} {
+		if err := drop(ctx, before); err != nil {
+			return 0, fmt.Errorf("drop vm records: %w", err)
+		}
+	}
+	archived, err := q.DeleteTerminatedVMs(ctx, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete vms: %w", err)
+	}
+	return archived, tx.Commit()
+}
+
+func (s *Store) PurgeArchivedVMs(ctx context.Context, terminatedBefore time.Time) (int64, error) {
+	return s.q.PurgeArchivedVMs(ctx, terminatedBefore)
+}
+
+func (s *Store) RotateSecrets(ctx context.Context) (int, error) {
+	rows, err := s.q.ListVMAuthKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, row := range rows {
+		if s.keys.Current(row.TailscaleAuthKey.String) {
+			continue
+		}
+		binding := store.AuthKeyBinding(row.ID)
+		authKey, err := s.keys.Open(row.TailscaleAuthKey.String, binding)
+		if err != nil {
+			return rotated, fmt.Errorf("vm %s: open tailscale auth key: %w", row.ID, err)
+		}
+		if authKey, err = s.keys.Seal(authKey, binding); err != nil {
+			return rotated, fmt.Errorf("vm %s: seal tailscale auth key: %w", row.ID, err)
+		}
+		if err := s.q.SetVMAuthKey(ctx, db.SetVMAuthKeyParams{
+			TailscaleAuthKey: nullString(authKey),
+			ID:               row.ID,
+		}); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (s *Store) CreateTokenRevocation(ctx context.Context, rev *store.TokenRevocation) (int64, error) {
+	params := db.CreateTokenRevocationParams{
+		VmID:      rev.VMID,
+		CreatedAt: rev.CreatedAt,
+	}
+	if rev.TokenID != "" {
+		params.TokenID = sql.NullString{String: rev.TokenID, Valid: true}
+	} else {
+		params.IssuedBefore = sql.NullTime{Time: rev.IssuedBefore, Valid: true}
+	}
+
+	id, err := s.q.CreateTokenRevocation(ctx, params)
+	if err != nil {
+		return 0, err
+	}
+	return int64(id), nil
+}
+
+func (s *Store) MarkTokenRevocationPropagated(ctx context.Context, id int64, at time.Time) error {
+	return affected(s.q.MarkTokenRevocationPropagated(ctx, db.MarkTokenRevocationPropagatedParams{
+		PropagatedAt: sql.NullTime{Time: at, Valid: true},
+		ID:           int32(id),
+	}))
+}
+
+func (s *Store) AppendVMLogs(ctx context.Context, vmID string, entries []models.LogEntry) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	received := time.Now()
+	for _, entry := range entries {
+		err := q.CreateVMLog(ctx, db.CreateVMLogParams{
+			VmID:       vmID,
+			Kind:       string(entry.Kind),
+			Level:      entry.Level,
+			Message:    entry.Message,
+			Fields:     entry.Fields,
+			LoggedAt:   entry.Time,
+			ReceivedAt: received,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListVMLogs(ctx context.Context, vmID string, filter store.LogFilter) ([]models.LogEntry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = store.DefaultLogLimit
+	}
+
+	rows, err := s.q.ListVMLogs(ctx, db.ListVMLogsParams{
+		VmID:       vmID,
+		Kind:       string(filter.Kind),
+		Since:      filter.Since,
+		MaxEntries: int32(filter.Limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.LogEntry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, models.LogEntry{
+			ID:      row.ID,
+			Kind:    models.LogKind(row.Kind),
+			Level:   row.Level,
+			Message: row.Message,
+			Fields:  row.Fields,
+			Time:    row.LoggedAt,
+		})
+	}
+	return entries, nil
+}
+
+func (s *Store) RecordVMActivity(ctx context.Context, vmID string, samples []models.ActivitySample) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	received := time.Now()
+	var latest time.Time
+	for _, sample := range samples {
+		err := q.UpsertVMActivityMinute(ctx, db.UpsertVMActivityMinuteParams{
+			VmID:       vmID,
+			Minute:     sample.Minute,
+			Keystrokes: sample.Keystrokes,
+			AiRequests: sample.AIRequests,
+			CpuSeconds: sample.CPUSeconds,
+			ReceivedAt: received,
+		})
+		if err != nil {
+			return err
+		}
+		if sample.Minute.After(latest) {
+			latest = sample.Minute
+		}
+	}
+	if !latest.IsZero() {
+		err := q.TouchVMLastActivity(ctx, db.TouchVMLastActivityParams{
+			At: sql.NullTime{Time: latest.Add(time.Minute), Valid: true},
+			ID: vmID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ListVMActivity(ctx context.Context, vmID string, since, until time.Time) ([]models.ActivitySample, error) {
+	rows, err := s.q.ListVMActivityMinutes(ctx, db.ListVMActivityMinutesParams{
+		VmID:  vmID,
+		Since: since,
+		Until: until,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]models.ActivitySample, 0, len(rows))
+	for _, row := range rows {
+		samples = append(samples, models.ActivitySample{
+			Minute:     row.Minute,
+			Keystrokes: row.Keystrokes,
+			AIRequests: row.AiRequests,
+			CPUSeconds: row.CpuSeconds,
+		})
+	}
+	return samples, nil
+}
+
+func (s *Store) PutContextSnapshot(ctx context.Context, userID string, snapshot *models.ContextSnapshot) error {
+	return s.q.UpsertContextSnapshot(ctx, db.UpsertContextSnapshotParams{
+		UserID:    userID,
+		Workspace: snapshot.Workspace,
+		SessionID: snapshot.SessionID,
+		VmID:      snapshot.VMID,
+		Data:      snapshot.Data,
+		UpdatedAt: snapshot.UpdatedAt,
+	})
+}
+
+func (s *Store) ListContextSnapshots(ctx context.Context, userID string, limit int) ([]models.ContextSnapshot, error) {
+	if limit <= 0 {
+		limit = store.DefaultContextSnapshotLimit
+	}
+
+	rows, err := s.q.ListContextSnapshots(ctx, db.ListContextSnapshotsParams{
+		UserID:       userID,
+		MaxSnapshots: int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]models.ContextSnapshot, 0, len(rows))
+	for _, row := range rows {
+		snapshots = append(snapshots, models.ContextSnapshot{
+			Workspace: row.Workspace,
+			SessionID: row.SessionID,
+			VMID:      row.VmID,
+			Size:      int64(row.Size),
+			UpdatedAt: row.UpdatedAt,
+		})
+	}
+	return snapshots, nil
+}
+
+func (s *Store) GetContextSnapshot(ctx context.Context, userID, workspace, sessionID string) (*models.ContextSnapshot, error) {
+	row, err := s.q.GetContextSnapshot(ctx, db.GetContextSnapshotParams{
+		UserID:    userID,
+		Workspace: workspace,
+		SessionID: sessionID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ContextSnapshot{
+		Workspace: row.Workspace,
+		SessionID: row.SessionID,
+		VMID:      row.VmID,
+		Size:      int64(len(row.Data)),
+		UpdatedAt: row.UpdatedAt,
+		Data:      row.Data,
+	}, nil
+}
+
+func (s *Store) CreateBackup(ctx context.Context, backup *models.WorkspaceBackup) (int64, error) {
+	return s.q.CreateWorkspaceBackup(ctx, db.CreateWorkspaceBackupParams{
+		VmID:      backup.VMID,
+		UserID:    backup.UserID,
+		Workspace: backup.Workspace,
+		ObjectKey: backup.ObjectKey,
+		Status:    string(backup.Status),
+		CreatedAt: backup.CreatedAt,
+	})
+}
+
+func (s *Store) CompleteBackup(ctx context.Context, id int64, vmID string, sizeBytes int64, sha256 string, at time.Time) error {
+	return affected(s.q.CompleteWorkspaceBackup(ctx, db.CompleteWorkspaceBackupParams{
+		SizeBytes:   sizeBytes,
+		Sha256:      sha256,
+		CompletedAt: sql.NullTime{Time: at, Valid: true},
+		ID:          id,
+		VmID:        vmID,
+	}))
+}
+
+func (s *Store) GetBackup(ctx context.Context, id int64) (*models.WorkspaceBackup, error) {
+	row, err := s.q.GetWorkspaceBackup(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	backup := backupFromRow(row)
+	return &backup, nil
+}
+
+func (s *Store) ListBackupsByUser(ctx context.Context, userID string) ([]models.WorkspaceBackup, error) {
+	rows, err := s.q.ListWorkspaceBackupsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]models.WorkspaceBackup, 0, len(rows))
+	for _, row := range rows {
+		backups = append(backups, backupFromRow(db.GetWorkspaceBackupRow(row)))
+	}
+	return backups, nil
+}
+
+func (s *Store) ListVMBackups(ctx context.Context, vmID, workspace string) ([]models.WorkspaceBackup, error) {
+	rows, err := s.q.ListVMWorkspaceBackups(ctx, db.ListVMWorkspaceBackupsParams{
+		VmID:      vmID,
+		Workspace: workspace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]models.WorkspaceBackup, 0, len(rows))
+	for _, row := range rows {
+		backups = append(backups, backupFromRow(db.GetWorkspaceBackupRow(row)))
+	}
+	return backups, nil
+}
+
+func (s *Store) MarkBackupDeleted(ctx context.Context, id int64, at time.Time) error {
+	return affected(s.q.MarkWorkspaceBackupDeleted(ctx, db.MarkWorkspaceBackupDeletedParams{
+		DeletedAt: sql.NullTime{Time: at, Valid: true},
+		ID:        id,
+	}))
+}
+
+func (s *Store) PutNotificationTarget(ctx context.Context, target *models.NotificationTarget) error {
+	row, err := s.q.UpsertNotificationTarget(ctx, db.UpsertNotificationTargetParams{
+		UserID:    target.UserID,
+		Kind:      string(target.Kind),
+		Address:   target.Address,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	target.ID, target.CreatedAt = row.ID, row.CreatedAt
+	return nil
+}
+
+func (s *Store) ListNotificationTargets(ctx context.Context, userID string) ([]models.NotificationTarget, error) {
+	rows, err := s.q.ListNotificationTargetsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]models.NotificationTarget, 0, len(rows))
+	for _, row := range rows {
+		targets = append(targets, models.NotificationTarget{
+			ID:        row.ID,
+			UserID:    row.UserID,
+			Kind:      models.NotificationTargetKind(row.Kind),
+			Address:   row.Address,
+			CreatedAt: row.CreatedAt,
+		})
+	}
+	return targets, nil
+}
+
+func (s *Store) DeleteNotificationTarget(ctx context.Context, userID string, id int64) error {
+	return affected(s.q.DeleteNotificationTarget(ctx, db.DeleteNotificationTargetParams{
+		ID:     id,
+		UserID: userID,
+	}))
+}
+
+func backupFromRow(row db.GetWorkspaceBackupRow) models.WorkspaceBackup {
+	backup := models.WorkspaceBackup{
+		ID:        row.ID,
+		VMID:      row.VmID,
+		UserID:    row.UserID,
+		Workspace: row.Workspace,
+		ObjectKey: row.ObjectKey,
+		Status:    models.BackupStatus(row.Status),
+		SizeBytes: row.SizeBytes,
+		SHA256:    row.Sha256,
+		CreatedAt: row.CreatedAt,
+	}
+	if row.CompletedAt.Valid {
+		backup.CompletedAt = &row.CompletedAt.Time
+	}
+	return backup
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// affected maps an update that matched no rows to store.ErrNotFound
+func affected(rows int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
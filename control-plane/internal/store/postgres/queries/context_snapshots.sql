@@ -0,0 +1,17 @@
+-- name: UpsertContextSnapshot :exec
+INSERT INTO context_snapshots (user_id, workspace, session_id, vm_id, data, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (user_id, workspace, session_id)
+DO UPDATE SET vm_id = EXCLUDED.vm_id, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at;
+
+-- name: ListContextSnapshots :many
+SELECT workspace, session_id, vm_id, octet_length(data) AS size, updated_at
+FROM context_snapshots
+WHERE user_id = sqlc.arg(user_id)
+ORDER BY updated_at DESC
+LIMIT sqlc.arg(max_snapshots);
+
+-- name: GetContextSnapshot :one
+SELECT workspace, session_id, vm_id, data, updated_at
+FROM context_snapshots
+WHERE user_id = $1 AND workspace = $2 AND session_id = $3;
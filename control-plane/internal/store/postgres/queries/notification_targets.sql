@@ -0,0 +1,14 @@
+-- name: UpsertNotificationTarget :one
+INSERT INTO notification_targets (user_id, kind, address, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $4)
+ON CONFLICT (kind, address) DO UPDATE SET user_id = excluded.user_id, updated_at = excluded.updated_at
+RETURNING id, created_at;
+
+-- name: ListNotificationTargetsByUser :many
+SELECT id, user_id, kind, address, created_at
+FROM notification_targets
+WHERE user_id = $1
+ORDER BY id;
+
+-- name: DeleteNotificationTarget :execrows
+DELETE FROM notification_targets WHERE id = $1 AND user_id = $2;
@@ -0,0 +1,7 @@
+-- name: CreateTokenRevocation :one
+INSERT INTO vm_token_revocations (vm_id, token_id, issued_before, created_at)
+VALUES ($1, $2, $3, $4)
+RETURNING id;
+
+-- name: MarkTokenRevocationPropagated :execrows
+UPDATE vm_token_revocations SET propagated_at = $1 WHERE id = $2;
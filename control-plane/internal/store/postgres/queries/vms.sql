@@ -0,0 +1,82 @@
+-- name: CreateVM :exec
+INSERT INTO vms (
+    id, user_id, status, spec, labels, provider, tailscale_auth_key,
+    created_at, updated_at
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+
+-- name: GetVM :one
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE id = $1;
+
+-- name: ListVMsByUser :many
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: ListVMsByStatus :many
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE status = $1
+ORDER BY created_at DESC;
+
+-- name: UpdateVMStatus :execrows
+UPDATE vms SET status = $1, updated_at = $2 WHERE id = $3;
+
+-- name: UpdateVMMachine :execrows
+UPDATE vms SET provider_id = $1, public_ip = $2, updated_at = $3 WHERE id = $4;
+
+-- name: MarkVMReady :execrows
+UPDATE vms
+SET status = 'running', tailscale_ip = $1, updated_at = $2
+WHERE id = $3 AND status = 'provisioning';
+
+-- name: FailVMProvisioning :execrows
+UPDATE vms
+SET status = 'error', updated_at = $1
+WHERE id = $2 AND status = 'provisioning';
+
+-- name: TouchProvisioningVM :execrows
+UPDATE vms
+SET updated_at = $1
+WHERE id = $2 AND status = 'provisioning';
+
+-- name: UpdateVMLabels :execrows
+UPDATE vms SET labels = $1, updated_at = $2 WHERE id = $3;
+
+-- name: ClaimPoolVM :execrows
+UPDATE vms
+SET user_id = $1, labels = $2, last_activity = $3, updated_at = $4
+WHERE id = $5 AND user_id = '_pool' AND status = 'running';
+
+-- name: ScheduleVMDeletion :execrows
+UPDATE vms
+SET status = 'terminating', delete_at = $1, backup_on_delete = $2, updated_at = $3
+WHERE id = $4 AND status <> 'terminated';
+
+-- name: CancelVMDeletion :execrows
+UPDATE vms
+SET status = $1, delete_at = NULL, backup_on_delete = FALSE, updated_at = $2
+WHERE id = $3 AND status = 'terminating';
+
+-- name: TerminateVM :execrows
+UPDATE vms
+SET status = 'terminated', tailscale_auth_key = NULL, ingest_token_id = NULL, delete_at = NULL,
+    backup_on_delete = FALSE, terminated_at = $1, updated_at = $1
+WHERE id = $2;
+
+-- name: ListVMAuthKeys :many
+SELECT id, tailscale_auth_key FROM vms WHERE tailscale_auth_key IS NOT NULL;
+
+-- name: SetVMAuthKey :exec
+UPDATE vms SET tailscale_auth_key = $1 WHERE id = $2;
+
+-- name: GetVMIngestToken :one
+SELECT ingest_token_id FROM vms WHERE id = $1;
+
+-- name: SetVMIngestToken :execrows
+UPDATE vms SET ingest_token_id = $1 WHERE id = $2;
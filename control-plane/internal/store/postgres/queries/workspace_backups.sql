@@ -0,0 +1,29 @@
+-- name: CreateWorkspaceBackup :one
+INSERT INTO workspace_backups (vm_id, user_id, workspace, object_key, status, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id;
+
+-- name: CompleteWorkspaceBackup :execrows
+UPDATE workspace_backups
+SET status = 'complete', size_bytes = $1, sha256 = $2, completed_at = $3
+WHERE id = $4 AND vm_id = $5 AND status = 'pending';
+
+-- name: GetWorkspaceBackup :one
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE id = $1;
+
+-- name: ListWorkspaceBackupsByUser :many
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE user_id = $1 AND status = 'complete'
+ORDER BY created_at DESC;
+
+-- name: ListVMWorkspaceBackups :many
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE vm_id = $1 AND workspace = $2 AND status = 'complete'
+ORDER BY created_at DESC;
+
+-- name: MarkWorkspaceBackupDeleted :execrows
+UPDATE workspace_backups SET status = 'deleted', deleted_at = $1 WHERE id = $2;
@@ -0,0 +1,17 @@
+-- name: UpsertContextSnapshot :exec
+INSERT INTO context_snapshots (user_id, workspace, session_id, vm_id, data, updated_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (user_id, workspace, session_id)
+DO UPDATE SET vm_id = excluded.vm_id, data = excluded.data, updated_at = excluded.updated_at;
+
+-- name: ListContextSnapshots :many
+SELECT workspace, session_id, vm_id, length(data) AS size, updated_at
+FROM context_snapshots
+WHERE user_id = sqlc.arg(user_id)
+ORDER BY updated_at DESC
+LIMIT sqlc.arg(max_snapshots);
+
+-- name: GetContextSnapshot :one
+SELECT workspace, session_id, vm_id, data, updated_at
+FROM context_snapshots
+WHERE user_id = ? AND workspace = ? AND session_id = ?;
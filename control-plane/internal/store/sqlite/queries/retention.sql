@@ -0,0 +1,39 @@
+-- Archiving moves terminated VMs to vm_archive and drops their logs,
+-- revocations, operations and activity. The statements run in one transaction and all
+-- select the same VMs.
+
+-- name: ArchiveTerminatedVMs :exec
+INSERT INTO vm_archive (
+    id, user_id, provider, provider_id, spec, labels,
+    created_at, terminated_at, archived_at
+)
+SELECT v.id, v.user_id, v.provider, v.provider_id, v.spec, v.labels,
+       v.created_at, v.terminated_at, sqlc.arg(archived_at)
+FROM vms v
+WHERE v.status = 'terminated' AND v.terminated_at < sqlc.arg(terminated_before);
+
+-- name: DeleteTerminatedVMLogs :exec
+DELETE FROM vm_logs
+WHERE vm_id IN (SELECT id FROM vms WHERE status = 'terminated' AND terminated_at < ?);
+
+-- name: DeleteTerminatedVMTokenRevocations :exec
+DELETE FROM vm_token_revocations
+WHERE vm_id IN (SELECT id FROM vms WHERE status = 'terminated' AND terminated_at < ?);
+
+-- name: DeleteTerminatedVMOperations :exec
+DELETE FROM vm_operations
+WHERE vm_id IN (SELECT id FROM vms WHERE status = 'terminated' AND terminated_at < ?);
+
+-- name: DeleteTerminatedVMActivity :exec
+DELETE FROM vm_activity
+WHERE vm_id IN (SELECT id FROM vms WHERE status = 'terminated' AND terminated_at < ?);
+
+-- name: DeleteTerminatedVMActivityMinutes :exec
+DELETE FROM vm_activity_minutes
+WHERE vm_id IN (SELECT id FROM vms WHERE status = 'terminated' AND terminated_at < ?);
+
+-- name: DeleteTerminatedVMs :execrows
+DELETE FROM vms WHERE status = 'terminated' AND terminated_at < ?;
+
+-- name: PurgeArchivedVMs :execrows
+DELETE FROM vm_archive WHERE terminated_at < ?;
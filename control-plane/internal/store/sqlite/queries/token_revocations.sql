@@ -0,0 +1,7 @@
+-- name: CreateTokenRevocation :one
+INSERT INTO vm_token_revocations (vm_id, token_id, issued_before, created_at)
+VALUES (?, ?, ?, ?)
+RETURNING id;
+
+-- name: MarkTokenRevocationPropagated :execrows
+UPDATE vm_token_revocations SET propagated_at = ? WHERE id = ?;
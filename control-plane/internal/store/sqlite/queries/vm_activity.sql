@@ -0,0 +1,16 @@
+-- name: UpsertVMActivityMinute :exec
+INSERT INTO vm_activity_minutes (vm_id, minute, keystrokes, ai_requests, cpu_seconds, received_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (vm_id, minute)
+DO UPDATE SET keystrokes = excluded.keystrokes, ai_requests = excluded.ai_requests,
+              cpu_seconds = excluded.cpu_seconds, received_at = excluded.received_at;
+
+-- name: ListVMActivityMinutes :many
+SELECT minute, keystrokes, ai_requests, cpu_seconds
+FROM vm_activity_minutes
+WHERE vm_id = sqlc.arg(vm_id) AND minute >= sqlc.arg(since) AND minute < sqlc.arg(until)
+ORDER BY minute;
+
+-- name: TouchVMLastActivity :exec
+UPDATE vms SET last_activity = sqlc.arg(at)
+WHERE id = sqlc.arg(id) AND (last_activity IS NULL OR last_activity < sqlc.arg(at));
@@ -0,0 +1,12 @@
+-- name: CreateVMLog :exec
+INSERT INTO vm_logs (vm_id, kind, level, message, fields, logged_at, received_at)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: ListVMLogs :many
+SELECT id, kind, level, message, fields, logged_at
+FROM vm_logs
+WHERE vm_id = sqlc.arg(vm_id)
+  AND (CAST(sqlc.arg(kind) AS TEXT) = '' OR kind = sqlc.arg(kind))
+  AND logged_at >= sqlc.arg(since)
+ORDER BY logged_at DESC, id DESC
+LIMIT sqlc.arg(max_entries);
@@ -0,0 +1,42 @@
+-- name: CreateVMOperation :one
+INSERT INTO vm_operations (
+    vm_id, kind, restore_backup_id, request_id, source, status, run_after, created_at, updated_at
+) VALUES (?1, ?2, ?3, ?4, ?5, 'pending', ?6, ?7, ?7)
+RETURNING id;
+
+-- name: ListDueVMOperations :many
+SELECT id, vm_id, kind, restore_backup_id, request_id, source, status, attempts, last_error, run_after, created_at
+FROM vm_operations
+WHERE status = 'pending' AND run_after <= sqlc.arg(now)
+  AND (leased_until IS NULL OR leased_until < sqlc.arg(now))
+ORDER BY id
+LIMIT sqlc.arg(max_operations);
+
+-- name: ListPendingVMOperations :many
+SELECT id, vm_id, kind, restore_backup_id, request_id, source, status, attempts, last_error, run_after, created_at
+FROM vm_operations
+WHERE status = 'pending'
+ORDER BY id;
+
+-- name: LeaseVMOperation :execrows
+UPDATE vm_operations
+SET attempts = attempts + 1, leased_until = sqlc.arg(leased_until), updated_at = sqlc.arg(now)
+WHERE id = sqlc.arg(id) AND status = 'pending' AND attempts = sqlc.arg(attempts)
+  AND (leased_until IS NULL OR leased_until < sqlc.arg(now));
+
+-- name: FinishVMOperation :execrows
+UPDATE vm_operations
+SET status = ?, last_error = ?, run_after = ?, leased_until = NULL, updated_at = ?
+WHERE id = ? AND status = 'pending' AND attempts = ?;
+
+-- name: ListVMOperations :many
+SELECT id, vm_id, kind, restore_backup_id, request_id, source, status, attempts, last_error, run_after, created_at
+FROM vm_operations
+WHERE vm_id = sqlc.arg(vm_id)
+ORDER BY id DESC
+LIMIT sqlc.arg(max_operations);
+
+-- name: CancelVMOperations :exec
+UPDATE vm_operations
+SET status = 'cancelled', leased_until = NULL, updated_at = sqlc.arg(updated_at)
+WHERE vm_id = sqlc.arg(vm_id) AND status = 'pending';
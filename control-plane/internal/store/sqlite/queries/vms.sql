@@ -0,0 +1,82 @@
+-- name: CreateVM :exec
+INSERT INTO vms (
+    id, user_id, status, spec, labels, provider, tailscale_auth_key,
+    created_at, updated_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetVM :one
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE id = ?;
+
+-- name: ListVMsByUser :many
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE user_id = ?
+ORDER BY created_at DESC;
+
+-- name: ListVMsByStatus :many
+SELECT id, user_id, provider, provider_id, public_ip, tailscale_ip, tailscale_auth_key, status, spec, labels,
+       last_activity, created_at, updated_at, delete_at, backup_on_delete, terminated_at
+FROM vms
+WHERE status = ?
+ORDER BY created_at DESC;
+
+-- name: UpdateVMStatus :execrows
+UPDATE vms SET status = ?, updated_at = ? WHERE id = ?;
+
+-- name: UpdateVMMachine :execrows
+UPDATE vms SET provider_id = ?, public_ip = ?, updated_at = ? WHERE id = ?;
+
+-- name: MarkVMReady :execrows
+UPDATE vms
+SET status = 'running', tailscale_ip = ?, updated_at = ?
+WHERE id = ? AND status = 'provisioning';
+
+-- name: FailVMProvisioning :execrows
+UPDATE vms
+SET status = 'error', updated_at = ?
+WHERE id = ? AND status = 'provisioning';
+
+-- name: TouchProvisioningVM :execrows
+UPDATE vms
+SET updated_at = ?
+WHERE id = ? AND status = 'provisioning';
+
+-- name: UpdateVMLabels :execrows
+UPDATE vms SET labels = ?, updated_at = ? WHERE id = ?;
+
+-- name: ClaimPoolVM :execrows
+UPDATE vms
+SET user_id = ?, labels = ?, last_activity = ?, updated_at = ?
+WHERE id = ? AND user_id = '_pool' AND status = 'running';
+
+-- name: ScheduleVMDeletion :execrows
+UPDATE vms
+SET status = 'terminating', delete_at = ?, backup_on_delete = ?, updated_at = ?
+WHERE id = ? AND status <> 'terminated';
+
+-- name: CancelVMDeletion :execrows
+UPDATE vms
+SET status = ?, delete_at = NULL, backup_on_delete = 0, updated_at = ?
+WHERE id = ? AND status = 'terminating';
+
+-- name: TerminateVM :execrows
+UPDATE vms
+SET status = 'terminated', tailscale_auth_key = NULL, ingest_token_id = NULL, delete_at = NULL,
+    backup_on_delete = 0, terminated_at = ?1, updated_at = ?1
+WHERE id = ?2;
+
+-- name: ListVMAuthKeys :many
+SELECT id, tailscale_auth_key FROM vms WHERE tailscale_auth_key IS NOT NULL;
+
+-- name: SetVMAuthKey :exec
+UPDATE vms SET tailscale_auth_key = ? WHERE id = ?;
+
+-- name: GetVMIngestToken :one
+SELECT ingest_token_id FROM vms WHERE id = ?;
+
+-- name: SetVMIngestToken :execrows
+UPDATE vms SET ingest_token_id = ? WHERE id = ?;
@@ -0,0 +1,29 @@
+-- name: CreateWorkspaceBackup :one
+INSERT INTO workspace_backups (vm_id, user_id, workspace, object_key, status, created_at)
+VALUES (?, ?, ?, ?, ?, ?)
+RETURNING id;
+
+-- name: CompleteWorkspaceBackup :execrows
+UPDATE workspace_backups
+SET status = 'complete', size_bytes = ?, sha256 = ?, completed_at = ?
+WHERE id = ? AND vm_id = ? AND status = 'pending';
+
+-- name: GetWorkspaceBackup :one
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE id = ?;
+
+-- name: ListWorkspaceBackupsByUser :many
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE user_id = ? AND status = 'complete'
+ORDER BY created_at DESC;
+
+-- name: ListVMWorkspaceBackups :many
+SELECT id, vm_id, user_id, workspace, object_key, status, size_bytes, sha256, created_at, completed_at
+FROM workspace_backups
+WHERE vm_id = ? AND workspace = ? AND status = 'complete'
+ORDER BY created_at DESC;
+
+-- name: MarkWorkspaceBackupDeleted :execrows
+UPDATE workspace_backups SET status = 'deleted', deleted_at = ? WHERE id = ?;
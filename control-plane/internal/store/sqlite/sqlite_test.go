@@ -0,0 +1,227 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/devtail/control-plane/internal/secrets"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+func testKeyring(t *testing.T) *secrets.Keyring {
+	t.Helper()
+	encoded, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := secrets.ParseKey("k1", encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := secrets.NewKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func openTestStore(t *testing.T, path string, keys *secrets.Keyring) *Store {
+	t.Helper()
+	s, err := Open(context.Background(), path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testVM(id string) *models.VM {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &models.VM{
+		ID:        id,
+		UserID:    "user-1",
+		Status:    models.VMStatusProvisioning,
+		Spec:      models.VMSpec{Type: "cx21", Location: "nbg1", DiskSize: 40, Image: "ubuntu-22.04"},
+		Provider:  "hetzner",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func TestOpenMigratesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devtail.db")
+	ctx := context.Background()
+
+	s := openTestStore(t, path, nil)
+	if err := s.CreateVM(ctx, testVM("vm-1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopening finds every migration applied and keeps the data
+	s = openTestStore(t, path, nil)
+	if _, err := s.GetVM(ctx, "vm-1"); err != nil {
+		t.Fatalf("expected the VM kept across reopening: %v", err)
+	}
+}
+
+func TestVMRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    bool
+		labels  map[string]string
+		authKey string
+	}{
+		{"plaintext", false, map[string]string{"team": "a", "env": "dev"}, "tskey-auth-1"},
+		{"sealed", true, map[string]string{"team": "a"}, "tskey-auth-1"},
+		{"no labels", true, nil, "tskey-auth-1"},
+		{"no auth key", true, map[string]string{"team": "a"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys *secrets.Keyring
+			if tt.keys {
+				keys = testKeyring(t)
+			}
+			s := openTestStore(t, filepath.Join(t.TempDir(), "devtail.db"), keys)
+			ctx := context.Background()
+
+			vm := testVM("vm-1")
+			vm.Labels = tt.labels
+			vm.TailscaleAuthKey = tt.authKey
+			if err := s.CreateVM(ctx, vm, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.GetVM(ctx, vm.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Spec != vm.Spec || got.Status != vm.Status || got.UserID != vm.UserID || got.Provider != vm.Provider {
+				t.Errorf("expected %+v, got %+v", vm, got)
+			}
+			if got.TailscaleAuthKey != tt.authKey {
+				t.Errorf("expected auth key %q, got %q", tt.authKey, got.TailscaleAuthKey)
+			}
+			if len(tt.labels) == 0 && len(got.Labels) != 0 || len(tt.labels) > 0 && !reflect.DeepEqual(got.Labels, tt.labels) {
+				t.Errorf("expected labels %v, got %v", tt.labels, got.Labels)
+			}
+
+			var stored string
+			if err := s.conn.QueryRowContext(ctx, `SELECT COALESCE(tailscale_auth_key, '') FROM vms WHERE id = ?`, vm.ID).Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.keys && tt.authKey != "" && stored == tt.authKey:
+				t.Errorf("expected the auth key sealed, stored %q", stored)
+			case !tt.keys && stored != tt.authKey:
+				t.Errorf("expected the auth key in plaintext, stored %q", stored)
+			}
+		})
+	}
+}
+
+func TestMissingVMIsNotFound(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "devtail.db"), nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"get", func() error { _, err := s.GetVM(ctx, "missing"); return err }},
+		{"update status", func() error { return s.UpdateVMStatus(ctx, "missing", models.VMStatusRunning) }},
+		{"update labels", func() error { return s.UpdateVMLabels(ctx, "missing", map[string]string{"a": "b"}) }},
+		{"terminate", func() error { return s.TerminateVM(ctx, "missing", time.Now()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, store.ErrNotFound) {
+				t.Fatalf("expected store.ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOperationLease(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "devtail.db"), nil)
+	ctx := context.Background()
+
+	vm := testVM("vm-1")
+	if err := s.CreateVM(ctx, vm, &store.Operation{Kind: store.OperationProvision}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	first, err := s.LeaseVMOperations(ctx, now, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0].VMID != vm.ID || first[0].Attempts != 1 {
+		t.Fatalf("expected the operation leased for its first attempt, got %+v", first)
+	}
+	if again, _ := s.LeaseVMOperations(ctx, now, time.Minute, 10); len(again) != 0 {
+		t.Fatalf("expected a leased operation not to be leased again, got %+v", again)
+	}
+
+	second, err := s.LeaseVMOperations(ctx, now.Add(2*time.Minute), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || second[0].Attempts != 2 {
+		t.Fatalf("expected the operation leased again once its lease ran out, got %+v", second)
+	}
+
+	done := store.OperationResult{Status: store.OperationDone, VMStatus: models.VMStatusRunning, TailscaleIP: "100.64.0.1"}
+	if err := s.CompleteVMOperation(ctx, first[0], done); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected the attempt that lost its lease to be refused, got %v", err)
+	}
+	if err := s.CompleteVMOperation(ctx, second[0], done); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetVM(ctx, vm.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.VMStatusRunning || got.TailscaleIP != "100.64.0.1" {
+		t.Fatalf("expected the VM running at 100.64.0.1, got %s at %q", got.Status, got.TailscaleIP)
+	}
+	if pending, _ := s.ListPendingVMOperations(ctx); len(pending) != 0 {
+		t.Fatalf("expected no pending operations, got %+v", pending)
+	}
+}
+
+func TestIngestTokenClearedOnTermination(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "devtail.db"), nil)
+	ctx := context.Background()
+
+	if err := s.CreateVM(ctx, testVM("vm-1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if tokenID, err := s.GetVMIngestToken(ctx, "vm-1"); err != nil || tokenID != "" {
+		t.Fatalf("expected no ingest token yet, got %q, %v", tokenID, err)
+	}
+	if err := s.SetVMIngestToken(ctx, "vm-1", "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if tokenID, err := s.GetVMIngestToken(ctx, "vm-1"); err != nil || tokenID != "token-1" {
+		t.Fatalf("expected token-1, got %q, %v", tokenID, err)
+	}
+
+	if err := s.TerminateVM(ctx, "vm-1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if tokenID, err := s.GetVMIngestToken(ctx, "vm-1"); err != nil || tokenID != "" {
+		t.Fatalf("expected the ingest token cleared, got %q, %v", tokenID, err)
+	}
+
+	if err := s.SetVMIngestToken(ctx, "missing", "token-1"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected store.ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// ErrNotFound is returned when a record does not exist
+var ErrNotFound = errors.New("not found")
+
+// Store persists VMs and their connect token revocations. The Postgres
+// implementation is used in production; the in-memory one lets the VM
+// manager be exercised without a database.
+type Store interface {
+	// Ping checks that the database is reachable
+	Ping(ctx context.Context) error
+
+	// CreateVM inserts a new VM record and, unless op is nil, the operation
+	// that provisions it, in one transaction
+	CreateVM(ctx context.Context, vm *models.VM, op *Operation) error
+
+	// GetVM returns the VM with the given ID, or ErrNotFound
+	GetVM(ctx context.Context, id string) (*models.VM, error)
+
+	// ListVMsByUser returns the user's VMs, newest first
+	ListVMsByUser(ctx context.Context, userID string) ([]*models.VM, error)
+
+	// ListVMsByStatus returns every user's VMs with the given status,
+	// newest first
+	ListVMsByStatus(ctx context.Context, status models.VMStatus) ([]*models.VM, error)
+
+	// UpdateVMLabels replaces the VM's user labels
+	UpdateVMLabels(ctx context.Context, id string, labels map[string]string) error
+
+	// ClaimPoolVM hands a running warm pool VM to userID with the given
+	// labels, counting it active from now. It returns ErrNotFound if the VM
+	// is no longer running in the pool, such as when another request
+	// claimed it first.
+	ClaimPoolVM(ctx context.Context, id, userID string, labels map[string]string) error
+
+	// UpdateVMStatus sets the VM's lifecycle status
+	UpdateVMStatus(ctx context.Context, id string, status models.VMStatus) error
+
+	// UpdateVMMachine records the provider's ID and the public IP (empty
+	// for none) of the machine backing the VM
+	UpdateVMMachine(ctx context.Context, id string, providerID, publicIP string) error
+
+	// SetVMIngestToken records the ID of the ingest token last issued to
+	// the VM's gateway; only that token is accepted from then on
+	SetVMIngestToken(ctx context.Context, id, tokenID string) error
+
+	// GetVMIngestToken returns the ID of the VM's current ingest token,
+	// empty if none was recorded, or ErrNotFound
+	GetVMIngestToken(ctx context.Context, id string) (string, error)
+
+	// StartVMOperation sets the VM's status and records op in place of the
+	// VM's pending operations, in one transaction
+	StartVMOperation(ctx context.Context, id string, status models.VMStatus, op *Operation) error
+
+	// RetryVMOperation records op in place of a provisioning VM's pending
+	// operations, in one transaction. It returns ErrNotFound if the VM is not
+	// provisioning.
+	RetryVMOperation(ctx context.Context, id string, op *Operation) error
+
+	// AbandonVMOperations puts a provisioning VM in error and cancels its
+	// pending operations, in one transaction. It returns ErrNotFound if the
+	// VM is not provisioning.
+	AbandonVMOperations(ctx context.Context, id string) error
+
+	// LeaseVMOperations leases up to limit pending operations that are due
+	// and not leased by another worker, counting an attempt for each
+	LeaseVMOperations(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Operation, error)
+
+	// CompleteVMOperation records the outcome of the attempt at op and
+	// applies the VM state change that goes with it, in one transaction. It
+	// returns ErrNotFound if the attempt lost its lease.
+	CompleteVMOperation(ctx context.Context, op *Operation, result OperationResult) error
+
+	// ListPendingVMOperations returns every operation yet to complete
+	ListPendingVMOperations(ctx context.Context) ([]*Operation, error)
+
+	// ListVMOperations returns the VM's latest operations, newest first
+	ListVMOperations(ctx context.Context, vmID string, limit int) ([]*Operation, error)
+
+	// ScheduleVMDeletion marks the VM terminating until deleteAt, or
+	// returns ErrNotFound if it is already terminated
+	ScheduleVMDeletion(ctx context.Context, id string, deleteAt time.Time, backup bool) error
+
+	// CancelVMDeletion returns a terminating VM to status, or returns
+	// ErrNotFound if it is not terminating
+	CancelVMDeletion(ctx context.Context, id string, status models.VMStatus) error
+
+	// TerminateVM marks the VM terminated at the given time and scrubs what
+	// only a live VM needs, such as its Tailscale auth key and ingest token
+	TerminateVM(ctx context.Context, id string, at time.Time) error
+
+	// ArchiveVMs moves the VMs terminated before the given time to the
+	// archive, dropping their logs, token revocations and activity, and
+	// returns how many it moved
+	ArchiveVMs(ctx context.Context, terminatedBefore, archivedAt time.Time) (int64, error)
+
+	// PurgeArchivedVMs deletes the archived VMs terminated before the given
+	// time and returns how many it deleted
+	PurgeArchivedVMs(ctx context.Context, terminatedBefore time.Time) (int64, error)
+
+	// RotateSecrets re-encrypts the sensitive columns not yet sealed with
+	// the current column key, including values written before encryption
+	// was enabled, and returns how many it rewrote
+	RotateSecrets(ctx context.Context) (int, error)
+
+	// CreateTokenRevocation records a connect token revocation and returns its ID
+	CreateTokenRevocation(ctx context.Context, rev *TokenRevocation) (int64, error)
+
+	// MarkTokenRevocationPropagated records that the VM's gateway applied a revocation
+	MarkTokenRevocationPropagated(ctx context.Context, id int64, at time.Time) error
+
+	// AppendVMLogs stores log entries shipped by the VM's gateway
+	AppendVMLogs(ctx context.Context, vmID string, entries []models.LogEntry) error
+
+	// ListVMLogs returns the VM's log entries matching filter, newest first
+	ListVMLogs(ctx context.Context, vmID string, filter LogFilter) ([]models.LogEntry, error)
+
+	// RecordVMActivity stores active minutes reported by the VM's gateway,
+	// replacing earlier reports of the same minutes, and moves the VM's last
+	// activity up to the end of the latest one, in one transaction
+	RecordVMActivity(ctx context.Context, vmID string, samples []models.ActivitySample) error
+
+	// ListVMActivity returns the VM's active minutes in [since, until),
+	// oldest first
+	ListVMActivity(ctx context.Context, vmID string, since, until time.Time) ([]models.ActivitySample, error)
+
+	// PutContextSnapshot stores a user's conversation context, replacing
+	// any earlier snapshot of the same workspace and session
+	PutContextSnapshot(ctx context.Context, userID string, snapshot *models.ContextSnapshot) error
+
+	// ListContextSnapshots returns up to limit of the user's snapshots
+	// without their data, most recently updated first
+	ListContextSnapshots(ctx context.Context, userID string, limit int) ([]models.ContextSnapshot, error)
+
+	// GetContextSnapshot returns one snapshot with its data, or ErrNotFound
+	GetContextSnapshot(ctx context.Context, userID, workspace, sessionID string) (*models.ContextSnapshot, error)
+
+	// CreateBackup records a pending workspace backup and returns its ID
+	CreateBackup(ctx context.Context, backup *models.WorkspaceBackup) (int64, error)
+
+	// CompleteBackup marks the VM's pending backup complete, or returns
+	// ErrNotFound if it has none with that ID
+	CompleteBackup(ctx context.Context, id int64, vmID string, sizeBytes int64, sha256 string, at time.Time) error
+
+	// GetBackup returns the backup with the given ID, or ErrNotFound
+	GetBackup(ctx context.Context, id int64) (*models.WorkspaceBackup, error)
+
+	// ListBackupsByUser returns the user's complete backups, newest first
+	ListBackupsByUser(ctx context.Context, userID string) ([]models.WorkspaceBackup, error)
+
+	// ListVMBackups returns the complete backups of one of the VM's
+	// workspaces, newest first
+	ListVMBackups(ctx context.Context, vmID, workspace string) ([]models.WorkspaceBackup, error)
+
+	// MarkBackupDeleted records that a backup's archive was removed
+	MarkBackupDeleted(ctx context.Context, id int64, at time.Time) error
+
+	// PutNotificationTarget registers a target for the user's
+	// notifications, setting its ID and creation time. A target already
+	// registered, by anyone, is moved to the user.
+	PutNotificationTarget(ctx context.Context, target *models.NotificationTarget) error
+
+	// ListNotificationTargets returns the user's targets, oldest first
+	ListNotificationTargets(ctx context.Context, userID string) ([]models.NotificationTarget, error)
+
+	// DeleteNotificationTarget removes one of the user's targets, or returns
+	// ErrNotFound if the user has none with that ID
+	DeleteNotificationTarget(ctx context.Context, userID string, id int64) error
+}
+
+// LogFilter selects VM log entries. Zero fields match everything except
+// Limit, which defaults to DefaultLogLimit.
+type LogFilter struct {
+	Kind  models.LogKind
+	Since time.Time
+	Limit int
+}
+
+// DefaultLogLimit bounds ListVMLogs when the filter sets no limit
+const DefaultLogLimit = 200
+
+// DefaultContextSnapshotLimit bounds ListContextSnapshots when no limit is
+// given
+const DefaultContextSnapshotLimit = 100
+
+// TokenRevocation revokes one connect token (TokenID), or every token for the
+// VM issued before IssuedBefore
+type TokenRevocation struct {
+	ID           int64
+	VMID         string
+	TokenID      string
+	IssuedBefore time.Time
+	PropagatedAt time.Time
+	CreatedAt    time.Time
+}
+
+// OperationKind is the provider side effect an operation carries out
+type OperationKind string
+
+const (
+	OperationProvision OperationKind = "provision" // create the VM's machine
+	OperationRebuild   OperationKind = "rebuild"   // replace the VM's machine
+	OperationJoin      OperationKind = "join"      // wait for the VM's machine to join the tailnet
+)
+
+// OperationSource is who recorded an operation
+type OperationSource string
+
+const (
+	SourceAPI      OperationSource = "api"      // a user's or operator's request
+	SourceWatchdog OperationSource = "watchdog" // the stuck VM watchdog
+)
+
+// OperationStatus is where an operation is in its life
+type OperationStatus string
+
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationDone      OperationStatus = "done"
+	OperationFailed    OperationStatus = "failed"    // out of attempts
+	OperationCancelled OperationStatus = "cancelled" // the VM moved on before it ran
+)
+
+// Operation is an outbox entry: a side effect a VM state change called for,
+// recorded with that change and run by a worker until it completes
+type Operation struct {
+	ID              int64
+	VMID            string
+	Kind            OperationKind
+	RestoreBackupID int64
+	RequestID       string // of the API request that called for it, for logs
+	Source          OperationSource
+	Status          OperationStatus
+	Attempts        int
+	LastError       string
+	RunAfter        time.Time
+	CreatedAt       time.Time
+}
+
+// OperationResult is the outcome of an attempt at an operation
+type OperationResult struct {
+	// Status ends the operation, or with OperationPending runs it again
+	// at RetryAt
+	Status  OperationStatus
+	Error   string
+	RetryAt time.Time
+
+	// VMStatus, if running or error, moves the VM out of provisioning;
+	// running records TailscaleIP. VMs no longer provisioning are left as
+	// they are.
+	VMStatus    models.VMStatus
+	TailscaleIP string
+}
+
+// AuthKeyBinding ties a VM's sealed Tailscale auth key to the VM, so it
+// cannot be moved to another row; see secrets.Keyring.Seal
+func AuthKeyBinding(vmID string) string {
+	return "vms.tailscale_auth_key:" + vmID
+}
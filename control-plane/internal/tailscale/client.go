@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/devtail/control-plane/internal/requestid"
 )
 
+// ErrDeviceNotFound is returned for a hostname no device in the tailnet has
+var ErrDeviceNotFound = errors.New("device not found")
+
 type Client struct {
 	apiKey  string
 	tailnet string
@@ -47,6 +51,29 @@ func NewClient(apiKey, tailnet string) *Client {
 	}
 }
 
+// Ping checks that the Tailscale API is reachable and accepts the API key
+func (c *Client) Ping(ctx context.Context) error {
+	url := fmt.Sprintf("%s/tailnet/%s/keys", c.baseURL, c.tailnet)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tailscale API error: %s", resp.Status)
+	}
+	return nil
+}
+
 func (c *Client) CreateAuthKey(ctx context.Context, description string) (*AuthKey, error) {
 	payload := map[string]interface{}{
 		"capabilities": map[string]interface{}{
@@ -97,7 +124,7 @@ func (c *Client) CreateAuthKey(ctx context.Context, description string) (*AuthKe
 		return nil, fmt.Errorf("unmarshal response: %w", err)
 	}
 
-	log.Info().
+	requestid.Logger(ctx).Info().
 		Str("key_id", authKey.ID).
 		Str("description", description).
 		Msg("Tailscale auth key created")
@@ -125,7 +152,7 @@ func (c *Client) DeleteAuthKey(ctx context.Context, keyID string) error {
 		return fmt.Errorf("tailscale API error: %s - %s", resp.Status, string(body))
 	}
 
-	log.Info().
+	requestid.Logger(ctx).Info().
 		Str("key_id", keyID).
 		Msg("Tailscale auth key deleted")
 
@@ -143,6 +170,63 @@ type Device struct {
 }
 
 func (c *Client) GetDeviceByHostname(ctx context.Context, hostname string) (*Device, error) {
+	devices, err := c.listDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		if device.Hostname == hostname {
+			return &device, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, hostname)
+}
+
+// DeleteDevice removes every device with the hostname from the tailnet, so
+// a replacement machine can join under it. A hostname no device has is not
+// an error.
+func (c *Client) DeleteDevice(ctx context.Context, hostname string) error {
+	devices, err := c.listDevices(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if device.Hostname != hostname {
+			continue
+		}
+
+		url := fmt.Sprintf("%s/device/%s", c.baseURL, device.ID)
+		req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		if err != nil {
+			return fmt.Errorf("create request: %w", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return fmt.Errorf("do request: %w", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("tailscale API error: %s - %s", resp.Status, string(body))
+		}
+
+		requestid.Logger(ctx).Info().
+			Str("device_id", device.ID).
+			Str("hostname", hostname).
+			Msg("Tailscale device deleted")
+	}
+
+	return nil
+}
+
+func (c *Client) listDevices(ctx context.Context) ([]Device, error) {
 	url := fmt.Sprintf("%s/tailnet/%s/devices", c.baseURL, c.tailnet)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -170,13 +254,7 @@ func (c *Client) GetDeviceByHostname(ctx context.Context, hostname string) (*Dev
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	for _, device := range response.Devices {
-		if device.Hostname == hostname {
-			return &device, nil
-		}
-	}
-
-	return nil, fmt.Errorf("device not found: %s", hostname)
+	return response.Devices, nil
 }
 
 func (c *Client) WaitForDevice(ctx context.Context, hostname string, timeout time.Duration) (*Device, error) {
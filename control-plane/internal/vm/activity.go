@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// activityMaxAge is how late a gateway may report a minute, covering a
+	// control plane outage of a few days. Older minutes are dropped.
+	activityMaxAge = 7 * 24 * time.Hour
+
+	// activityMaxSkew is how far ahead of the control plane's clock a
+	// gateway's may run
+	activityMaxSkew = 5 * time.Minute
+)
+
+// IngestActivity stores the active minutes reported by the gateway of the VM
+// the ingest token was issued for, and moves the VM's last activity up to the
+// end of the latest. Minutes too old or too far in the future are dropped.
+func (m *Manager) IngestActivity(ctx context.Context, token string, samples []models.ActivitySample) (string, error) {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	kept := samples[:0]
+	for _, sample := range samples {
+		sample.Minute = sample.Minute.UTC().Truncate(time.Minute)
+		if sample.Minute.Before(now.Add(-activityMaxAge)) || sample.Minute.After(now.Add(activityMaxSkew)) {
+			continue
+		}
+		kept = append(kept, sample)
+	}
+	if len(kept) == 0 {
+		return vm.ID, nil
+	}
+
+	if err := m.store.RecordVMActivity(ctx, vm.ID, kept); err != nil {
+		return vm.ID, fmt.Errorf("record activity: %w", err)
+	}
+	return vm.ID, nil
+}
+
+// GetActivity returns the VM's active minutes in [since, until) with their
+// totals
+func (m *Manager) GetActivity(ctx context.Context, vm *models.VM, since, until time.Time) (*models.ActivityReport, error) {
+	samples, err := m.store.ListVMActivity(ctx, vm.ID, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("list activity: %w", err)
+	}
+
+	report := &models.ActivityReport{
+		VMID:          vm.ID,
+		Since:         since,
+		Until:         until,
+		ActiveMinutes: len(samples),
+		LastActivity:  vm.LastActivity,
+		Samples:       samples,
+	}
+	for _, sample := range samples {
+		report.Keystrokes += sample.Keystrokes
+		report.AIRequests += sample.AIRequests
+		report.CPUSeconds += sample.CPUSeconds
+	}
+	return report, nil
+}
+
+// idleSince reports whether the VM has had no activity since the given
+// time. VMs never active count from their creation.
+func idleSince(vm *models.VM, t time.Time) bool {
+	last := vm.LastActivity
+	if last.Before(vm.CreatedAt) {
+		last = vm.CreatedAt
+	}
+	return last.Before(t)
+}
@@ -0,0 +1,186 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// backupURLTTL is how long presigned upload and download URLs work. It
+// covers archiving and transferring a large workspace.
+const backupURLTTL = time.Hour
+
+// BackupStore holds backup archives. *objectstore.S3 implements it.
+type BackupStore interface {
+	PresignPut(key string, ttl time.Duration) (string, error)
+	PresignGet(key string, ttl time.Duration) (string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// BackupConfig configures workspace backups
+type BackupConfig struct {
+	Store BackupStore
+
+	// URL is the public URL of /api/v1/ingest/backups that gateways use
+	URL string
+
+	// Prefix is prepended to every object key
+	Prefix string
+
+	// Interval is how often gateways back up their workspaces; zero leaves
+	// only on-demand backups
+	Interval time.Duration
+
+	// Keep is how many complete backups of each VM workspace are kept;
+	// zero keeps all of them
+	Keep int
+}
+
+// StartBackup records a pending backup of one of the workspaces of the VM
+// the ingest token was issued for and returns where to upload it. Archives
+// are stored under the owner's ID, so they outlive the VM.
+func (m *Manager) StartBackup(ctx context.Context, token, workspace string) (*models.StartBackupResponse, error) {
+	if m.config.Backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+	vm, err := m.ingestVM(ctx, token, true)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	backup := &models.WorkspaceBackup{
+		VMID:      vm.ID,
+		UserID:    vm.UserID,
+		Workspace: workspace,
+		ObjectKey: fmt.Sprintf("%s%s/%s/%s/%s.tar.zst", m.config.Backups.Prefix, vm.UserID, vm.ID, workspace, now.Format("20060102T150405Z")),
+		Status:    models.BackupStatusPending,
+		CreatedAt: now,
+	}
+	uploadURL, err := m.config.Backups.Store.PresignPut(backup.ObjectKey, backupURLTTL)
+	if err != nil {
+		return nil, fmt.Errorf("presign upload: %w", err)
+	}
+	if backup.ID, err = m.store.CreateBackup(ctx, backup); err != nil {
+		return nil, fmt.Errorf("create backup: %w", err)
+	}
+
+	return &models.StartBackupResponse{
+		Backup:    backup,
+		UploadURL: uploadURL,
+		ExpiresAt: now.Add(backupURLTTL),
+	}, nil
+}
+
+// CompleteBackup marks an uploaded backup complete and removes the VM
+// workspace's backups beyond the retention limit
+func (m *Manager) CompleteBackup(ctx context.Context, token string, id int64, req *models.CompleteBackupRequest) (*models.WorkspaceBackup, error) {
+	if m.config.Backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+	vm, err := m.ingestVM(ctx, token, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.store.CompleteBackup(ctx, id, vm.ID, req.SizeBytes, req.SHA256, time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("complete backup: %w", err)
+	}
+
+	backup, err := m.store.GetBackup(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("load backup: %w", err)
+	}
+	m.pruneBackups(ctx, vm.ID, backup.Workspace)
+	return backup, nil
+}
+
+// pruneBackups deletes the oldest backups of a VM workspace beyond the
+// retention limit. Failures are logged; the next backup retries them.
+func (m *Manager) pruneBackups(ctx context.Context, vmID, workspace string) {
+	keep := m.config.Backups.Keep
+	if keep <= 0 {
+		return
+	}
+	logger := requestid.Logger(ctx)
+
+	backups, err := m.store.ListVMBackups(ctx, vmID, workspace)
+	if err != nil {
+		logger.Error().Err(err).Str("vm_id", vmID).Msg("Failed to list backups for retention")
+		return
+	}
+	if len(backups) <= keep {
+		return
+	}
+
+	for _, backup := range backups[keep:] {
+		if err := m.config.Backups.Store.Delete(ctx, backup.ObjectKey); err != nil {
+			logger.Error().Err(err).Int64("backup_id", backup.ID).Msg("Failed to delete expired backup")
+			continue
+		}
+		if err := m.store.MarkBackupDeleted(ctx, backup.ID, time.Now()); err != nil {
+			logger.Error().Err(err).Int64("backup_id", backup.ID).Msg("Failed to mark backup deleted")
+		}
+	}
+}
+
+// BackupDownload returns a URL for one of the backups of the owner of the
+// VM the ingest token was issued for, so a new VM can restore it
+func (m *Manager) BackupDownload(ctx context.Context, token string, id int64) (*models.BackupDownloadResponse, error) {
+	if m.config.Backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return nil, err
+	}
+
+	backup, err := m.restorableBackup(ctx, vm.UserID, id)
+	if err != nil {
+		return nil, err
+	}
+	downloadURL, err := m.config.Backups.Store.PresignGet(backup.ObjectKey, backupURLTTL)
+	if err != nil {
+		return nil, fmt.Errorf("presign download: %w", err)
+	}
+	return &models.BackupDownloadResponse{
+		DownloadURL: downloadURL,
+		ExpiresAt:   time.Now().Add(backupURLTTL),
+	}, nil
+}
+
+// ListBackups returns the user's complete backups, newest first
+func (m *Manager) ListBackups(ctx context.Context, userID string) ([]models.WorkspaceBackup, error) {
+	if m.config.Backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+	return m.store.ListBackupsByUser(ctx, userID)
+}
+
+// restorableBackup returns the user's complete backup with the given ID
+func (m *Manager) restorableBackup(ctx context.Context, userID string, id int64) (*models.WorkspaceBackup, error) {
+	if m.config.Backups == nil {
+		return nil, ErrBackupsDisabled
+	}
+
+	backup, err := m.store.GetBackup(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load backup: %w", err)
+	}
+	if backup.UserID != userID || backup.Status != models.BackupStatusComplete {
+		return nil, ErrBackupNotFound
+	}
+	return backup, nil
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// broadcastConcurrency bounds how many gateways an announcement is
+	// pushed to at once
+	broadcastConcurrency = 16
+
+	// DefaultAnnouncementTTL is how long gateways announce a broadcast that
+	// has neither an expiry nor an end
+	DefaultAnnouncementTTL = time.Hour
+)
+
+// Broadcast pushes an announcement to the gateways of every running VM
+// matching selector, which deliver it to their clients. Unreachable gateways
+// are reported rather than retried; an announcement that arrives late is
+// rarely worth having.
+func (m *Manager) Broadcast(ctx context.Context, req *models.BroadcastRequest, selector labels.Selector) (*models.BroadcastResponse, error) {
+	announcement := models.Announcement{
+		ID:               uuid.New().String(),
+		Kind:             req.Kind,
+		Message:          req.Message,
+		URL:              req.URL,
+		StartsAt:         req.StartsAt,
+		EndsAt:           req.EndsAt,
+		MinClientVersion: req.MinClientVersion,
+	}
+	switch {
+	case req.ExpiresAt != nil:
+		announcement.ExpiresAt = *req.ExpiresAt
+	case req.EndsAt != nil:
+		announcement.ExpiresAt = *req.EndsAt
+	default:
+		announcement.ExpiresAt = time.Now().Add(DefaultAnnouncementTTL)
+	}
+
+	vms, err := m.store.ListVMsByStatus(ctx, models.VMStatusRunning)
+	if err != nil {
+		return nil, fmt.Errorf("list vms: %w", err)
+	}
+
+	resp := &models.BroadcastResponse{Announcement: announcement}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, broadcastConcurrency)
+	)
+	for _, vm := range vms {
+		if !selector.Matches(vm.Labels) {
+			continue
+		}
+		resp.VMs++
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(vm *models.VM) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			sessions, err := m.announce(ctx, vm, announcement)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				resp.Failures = append(resp.Failures, models.BroadcastFailure{VMID: vm.ID, Error: err.Error()})
+				return
+			}
+			resp.Delivered++
+			resp.Sessions += sessions
+		}(vm)
+	}
+	wg.Wait()
+
+	sort.Slice(resp.Failures, func(i, j int) bool {
+		return resp.Failures[i].VMID < resp.Failures[j].VMID
+	})
+
+	requestid.Logger(ctx).Info().
+		Str("announcement_id", announcement.ID).
+		Str("kind", string(announcement.Kind)).
+		Int("vms", resp.VMs).
+		Int("delivered", resp.Delivered).
+		Int("sessions", resp.Sessions).
+		Msg("Announcement broadcast")
+	return resp, nil
+}
+
+// announce delivers a signed announcement to the VM's gateway and returns
+// how many sessions it reached
+func (m *Manager) announce(ctx context.Context, vm *models.VM, announcement models.Announcement) (int, error) {
+	if vm.TailscaleIP == "" {
+		return 0, fmt.Errorf("vm has not joined the tailnet")
+	}
+
+	notice, err := m.config.TokenSigner.SignAnnouncement(vm.ID, announcement)
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Sessions int `json:"sessions"`
+	}
+	if err := m.postGateway(ctx, vm, "/announce", map[string]string{"announcement": notice}, &result); err != nil {
+		return 0, err
+	}
+	return result.Sessions, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"text/template"
+	"time"
 )
 
 const cloudInitTemplate = `#cloud-config
@@ -16,19 +17,9 @@ users:
     ssh_authorized_keys:
       - {{.SSHPublicKey}}
 
-package_update: true
-package_upgrade: true
-
-packages:
-  - curl
-  - git
-  - tmux
-  - python3-pip
-  - nodejs
-  - npm
-  - build-essential
-  - tmate
-  - jq
+{{- if not .Golden}}
+{{template "packages"}}
+{{- end}}
 
 write_files:
   - path: /etc/systemd/system/gateway.service
@@ -41,7 +32,7 @@ write_files:
       Type=simple
       User=devtail
       WorkingDirectory=/home/devtail/workspace
-      ExecStart=/usr/local/bin/gateway --port 8080 --workdir /home/devtail/workspace
+      ExecStart=/usr/local/bin/gateway --port {{.GatewayPort}} --workdir /home/devtail/workspace --vm-id {{.VMID}} --auth-public-key {{.AuthPublicKey}}{{if .LogIngestURL}} --log-endpoint {{.LogIngestURL}}{{end}}{{if .ContextSyncURL}} --context-endpoint {{.ContextSyncURL}}{{end}}{{if .ActivityURL}} --activity-endpoint {{.ActivityURL}}{{end}}{{if .EventsURL}} --events-endpoint {{.EventsURL}}{{end}}{{if .BackupURL}} --backup-endpoint {{.BackupURL}} --backup-interval {{.BackupInterval}}{{end}}{{if .RestoreBackupID}} --restore-backup {{.RestoreBackupID}}{{end}}{{if .LogIngestToken}} --log-token {{.LogIngestToken}}{{end}}
       Restart=always
       RestartSec=10
       Environment="PATH=/usr/local/bin:/usr/bin:/bin:/home/devtail/.local/bin"
@@ -58,28 +49,11 @@ write_files:
     owner: devtail:devtail
 
 runcmd:
-  # Install Tailscale
-  - curl -fsSL https://tailscale.com/install.sh | sh
+{{- if not .Golden}}
+{{template "install" .}}
+{{- end}}
   - tailscale up --authkey={{.TailscaleAuthKey}} --ssh --hostname=devtail-{{.VMID}}
   
-  # Install gateway binary
-  - |
-    curl -fsSL https://github.com/devtail/gateway/releases/latest/download/gateway-linux-amd64 \
-      -o /usr/local/bin/gateway || \
-    curl -fsSL {{.GatewayURL}} -o /usr/local/bin/gateway
-  - chmod +x /usr/local/bin/gateway
-  
-  # Install aider
-  - sudo -u devtail pip3 install --user aider-chat
-  
-  # Install openvscode-server
-  - |
-    sudo -u devtail bash -c "
-      curl -fsSL https://github.com/gitpod-io/openvscode-server/releases/download/openvscode-server-v1.84.2/openvscode-server-v1.84.2-linux-x64.tar.gz | \
-      tar -xz -C /home/devtail
-      mv /home/devtail/openvscode-server-* /home/devtail/openvscode-server
-    "
-  
   # Create workspace directory
   - mkdir -p /home/devtail/workspace
   - chown -R devtail:devtail /home/devtail
@@ -99,16 +73,128 @@ runcmd:
 final_message: "DevTail VM ready in $UPTIME seconds"
 `
 
+// imageCloudInitTemplate builds a golden image: it installs everything
+// golden VMs skip, resets the instance state and powers the server off to be
+// snapshotted. The power-off only happens if the gateway was installed, so a
+// failed build times out instead of producing a broken image.
+const imageCloudInitTemplate = `#cloud-config
+users:
+  - name: devtail
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+{{- if .SSHPublicKey}}
+    ssh_authorized_keys:
+      - {{.SSHPublicKey}}
+{{- end}}
+
+{{template "packages"}}
+
+runcmd:
+{{template "install" .}}
+  
+  # Reset instance state so VMs booted from the snapshot run cloud-init afresh
+  - cloud-init clean --logs
+  - rm -f /etc/ssh/ssh_host_*
+  - truncate -s 0 /etc/machine-id
+
+power_state:
+  mode: poweroff
+  condition: test -x /usr/local/bin/gateway
+  message: "DevTail image build complete"
+`
+
+// installTemplates are shared by VM and image build cloud-init: the packages
+// and tools that golden images have preinstalled
+const installTemplates = `{{define "packages" -}}
+package_update: true
+package_upgrade: true
+
+packages:
+  - curl
+  - git
+  - tmux
+  - python3-pip
+  - nodejs
+  - npm
+  - build-essential
+  - tmate
+  - jq
+{{- end}}
+
+{{define "install" -}}
+  # Install Tailscale
+  - curl -fsSL https://tailscale.com/install.sh | sh
+  
+  # Install gateway binary
+  - |
+    curl -fsSL https://github.com/devtail/gateway/releases/latest/download/gateway-linux-amd64 \
+      -o /usr/local/bin/gateway || \
+    curl -fsSL {{.GatewayURL}} -o /usr/local/bin/gateway
+  - chmod +x /usr/local/bin/gateway
+  
+  # Install aider
+  - sudo -u devtail pip3 install --user aider-chat
+  
+  # Install openvscode-server
+  - |
+    sudo -u devtail bash -c "
+      curl -fsSL https://github.com/gitpod-io/openvscode-server/releases/download/openvscode-server-v1.84.2/openvscode-server-v1.84.2-linux-x64.tar.gz | \
+      tar -xz -C /home/devtail
+      mv /home/devtail/openvscode-server-* /home/devtail/openvscode-server
+    "
+{{- end}}`
+
 type CloudInitData struct {
 	VMID             string
 	TailscaleAuthKey string
 	SSHPublicKey     string
 	GatewayURL       string
 	CallbackURL      string
+	AuthPublicKey    string
+	GatewayPort      string
+
+	// LogIngestURL is where the gateway ships its logs, authenticated with
+	// LogIngestToken; empty disables shipping
+	LogIngestURL   string
+	LogIngestToken string
+
+	// ContextSyncURL is where the gateway saves AI conversation contexts,
+	// also authenticated with LogIngestToken; empty disables syncing
+	ContextSyncURL string
+
+	// ActivityURL is where the gateway reports per-minute activity, also
+	// authenticated with LogIngestToken; empty disables reporting
+	ActivityURL string
+
+	// EventsURL is where the gateway reports events the VM's owner is
+	// notified of, also authenticated with LogIngestToken; empty disables
+	// them
+	EventsURL string
+
+	// BackupURL is where the gateway arranges workspace backups, every
+	// BackupInterval and on demand; empty disables backups.
+	// RestoreBackupID, if set, is the backup the workspace starts from.
+	BackupURL       string
+	BackupInterval  time.Duration
+	RestoreBackupID int64
+
+	// Golden skips installing packages, Tailscale, the gateway and tools,
+	// which golden images already contain
+	Golden bool
 }
 
 func GenerateCloudInit(data CloudInitData) (string, error) {
-	tmpl, err := template.New("cloudinit").Parse(cloudInitTemplate)
+	return generate(cloudInitTemplate, data)
+}
+
+// GenerateImageCloudInit renders the cloud-init that builds a golden image.
+// Only SSHPublicKey and GatewayURL are used.
+func GenerateImageCloudInit(data CloudInitData) (string, error) {
+	return generate(imageCloudInitTemplate, data)
+}
+
+func generate(text string, data CloudInitData) (string, error) {
+	tmpl, err := template.New("cloudinit").Parse(text + installTemplates)
 	if err != nil {
 		return "", fmt.Errorf("parse template: %w", err)
 	}
@@ -0,0 +1,271 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// DefaultDeletionGracePeriod is how long a deleted VM's machine is kept,
+	// so a mistaken delete can be cancelled
+	DefaultDeletionGracePeriod = 24 * time.Hour
+
+	// DefaultDeletionSweepInterval is how often due deletions are carried out
+	DefaultDeletionSweepInterval = time.Minute
+
+	// finalBackupTimeout is how long a gateway has to finish a final backup
+	// before it is asked again; it matches the upload URL's lifetime
+	finalBackupTimeout = backupURLTTL
+)
+
+// DeleteOptions control how a VM is deleted
+type DeleteOptions struct {
+	// Backup backs up every workspace before the machine is deleted. The
+	// machine is kept until the backup completes.
+	Backup bool
+
+	// Immediate skips the grace period
+	Immediate bool
+}
+
+// pendingDeletion is what the sweep tracks for a terminating VM
+type pendingDeletion struct {
+	backupRequested time.Time // zero until the gateway was asked for a final backup
+	workspaces      []string  // the workspaces it is backing up
+	deleting        bool      // the machine is being deleted; too late to cancel
+}
+
+// ScheduleDeletion deletes the VM after the grace period. Until then it is
+// terminating: its machine and gateway keep running, and the deletion can be
+// cancelled. Without a grace period, or with opts.Immediate, the machine is
+// deleted now, unless a final backup has to be taken first.
+func (m *Manager) ScheduleDeletion(ctx context.Context, vm *models.VM, opts DeleteOptions) (*models.VM, error) {
+	// A VM that never finished provisioning holds no work worth keeping
+	if vm.Status == models.VMStatusProvisioning {
+		opts = DeleteOptions{Immediate: true}
+	}
+	if opts.Backup {
+		if m.config.Backups == nil {
+			return nil, ErrBackupsDisabled
+		}
+		if vm.TailscaleIP == "" {
+			return nil, ErrNoGateway
+		}
+	}
+
+	immediate := opts.Immediate || m.config.DeletionGracePeriod <= 0
+	if immediate && !opts.Backup {
+		if err := m.DeleteVM(ctx, vm.ID); err != nil {
+			return nil, err
+		}
+		return m.GetVM(ctx, vm.ID)
+	}
+
+	deleteAt := time.Now()
+	if !immediate {
+		deleteAt = deleteAt.Add(m.config.DeletionGracePeriod)
+	}
+	if err := m.store.ScheduleVMDeletion(ctx, vm.ID, deleteAt, opts.Backup); err != nil {
+		return nil, fmt.Errorf("schedule deletion: %w", err)
+	}
+
+	requestid.Logger(ctx).Info().
+		Str("vm_id", vm.ID).
+		Time("delete_at", deleteAt).
+		Bool("backup", opts.Backup).
+		Msg("VM scheduled for deletion")
+
+	return m.GetVM(ctx, vm.ID)
+}
+
+// CancelDeletion keeps a terminating VM. It returns to running, or to error
+// if it never joined the tailnet.
+func (m *Manager) CancelDeletion(ctx context.Context, vm *models.VM) (*models.VM, error) {
+	if vm.Status != models.VMStatusTerminating {
+		return nil, ErrNotTerminating
+	}
+	status := models.VMStatusRunning
+	if vm.TailscaleIP == "" {
+		status = models.VMStatusError
+	}
+
+	// Held across the update so the sweep cannot start deleting the
+	// machine in between
+	m.deletionMu.Lock()
+	defer m.deletionMu.Unlock()
+
+	if d := m.deletions[vm.ID]; d != nil && d.deleting {
+		return nil, ErrDeletionInProgress
+	}
+	err := m.store.CancelVMDeletion(ctx, vm.ID, status)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNotTerminating
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cancel deletion: %w", err)
+	}
+	delete(m.deletions, vm.ID)
+
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Msg("VM deletion cancelled")
+	return m.GetVM(ctx, vm.ID)
+}
+
+// RunDeletions deletes the machines of terminating VMs once they are due,
+// every interval until ctx is done
+func (m *Manager) RunDeletions(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultDeletionSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.sweepDeletions(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepDeletions carries out the deletions that are due. Failures are
+// logged and retried on the next sweep; the machine is kept meanwhile.
+func (m *Manager) sweepDeletions(ctx context.Context) {
+	logger := requestid.Logger(ctx)
+
+	vms, err := m.store.ListVMsByStatus(ctx, models.VMStatusTerminating)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list VMs scheduled for deletion")
+		return
+	}
+
+	now := time.Now()
+	for _, vm := range vms {
+		if vm.DeleteAt != nil && now.Before(*vm.DeleteAt) {
+			continue
+		}
+		if _, err := m.completeDeletion(ctx, vm); err != nil && ctx.Err() == nil {
+			logger.Warn().Err(err).Str("vm_id", vm.ID).Msg("VM deletion postponed")
+		}
+	}
+}
+
+// completeDeletion deletes a due VM's machine, once its final backup, if it
+// asked for one, is complete. It reports whether the machine was deleted.
+func (m *Manager) completeDeletion(ctx context.Context, vm *models.VM) (bool, error) {
+	if vm.BackupOnDelete {
+		done, err := m.finalBackup(ctx, vm)
+		if err != nil || !done {
+			return false, err
+		}
+	}
+
+	m.deletionMu.Lock()
+	d := m.deletion(vm.ID)
+	if d.deleting {
+		m.deletionMu.Unlock()
+		return false, ErrDeletionInProgress
+	}
+	d.deleting = true
+	m.deletionMu.Unlock()
+
+	defer func() {
+		m.deletionMu.Lock()
+		delete(m.deletions, vm.ID)
+		m.deletionMu.Unlock()
+	}()
+
+	// The deletion may have been cancelled since the sweep listed the VM
+	current, err := m.store.GetVM(ctx, vm.ID)
+	if err != nil {
+		return false, err
+	}
+	if current.Status != models.VMStatusTerminating {
+		return false, nil
+	}
+
+	if err := m.DeleteVM(ctx, vm.ID); err != nil {
+		return false, err
+	}
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Msg("VM deleted")
+	return true, nil
+}
+
+// finalBackup reports whether every workspace of the VM has been backed up
+// since its gateway was asked to, asking it first if it has not been, or if
+// its last attempt should long have finished
+func (m *Manager) finalBackup(ctx context.Context, vm *models.VM) (bool, error) {
+	m.deletionMu.Lock()
+	d := m.deletion(vm.ID)
+	requested, workspaces := d.backupRequested, d.workspaces
+	m.deletionMu.Unlock()
+
+	if !requested.IsZero() {
+		done, err := m.backedUpSince(ctx, vm.ID, workspaces, requested)
+		if err != nil || done {
+			return done, err
+		}
+		if time.Since(requested) < finalBackupTimeout {
+			return false, nil
+		}
+		requestid.Logger(ctx).Warn().Str("vm_id", vm.ID).Msg("Final backup did not complete, asking again")
+	}
+
+	request, err := m.config.TokenSigner.SignBackupRequest(vm.ID)
+	if err != nil {
+		return false, err
+	}
+	var result struct {
+		Workspaces []string `json:"workspaces"`
+	}
+	requested = time.Now()
+	if err := m.postGateway(ctx, vm, "/backup", map[string]string{"request": request}, &result); err != nil {
+		return false, fmt.Errorf("request final backup: %w", err)
+	}
+
+	m.deletionMu.Lock()
+	d = m.deletion(vm.ID)
+	d.backupRequested, d.workspaces = requested, result.Workspaces
+	m.deletionMu.Unlock()
+
+	requestid.Logger(ctx).Info().
+		Str("vm_id", vm.ID).
+		Strs("workspaces", result.Workspaces).
+		Msg("Final backup requested")
+	return false, nil
+}
+
+// backedUpSince reports whether each workspace has a complete backup
+// started after since
+func (m *Manager) backedUpSince(ctx context.Context, vmID string, workspaces []string, since time.Time) (bool, error) {
+	for _, workspace := range workspaces {
+		backups, err := m.store.ListVMBackups(ctx, vmID, workspace)
+		if err != nil {
+			return false, fmt.Errorf("list backups: %w", err)
+		}
+		if len(backups) == 0 || backups[0].CreatedAt.Before(since) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deletion returns the VM's pending deletion, adding it if needed. The
+// caller holds deletionMu.
+func (m *Manager) deletion(vmID string) *pendingDeletion {
+	d, ok := m.deletions[vmID]
+	if !ok {
+		d = &pendingDeletion{}
+		m.deletions[vmID] = d
+	}
+	return d
+}
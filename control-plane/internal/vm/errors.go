@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// ErrConsoleUnsupported is returned for VMs whose provider cannot open an
+// out-of-band console
+var ErrConsoleUnsupported = errors.New("provider does not support consoles")
+
+// ErrBackupsDisabled is returned for backup operations when no object
+// storage is configured
+var ErrBackupsDisabled = errors.New("workspace backups are not configured")
+
+// ErrBackupNotFound is returned for backups that do not exist, belong to
+// another user or are not complete
+var ErrBackupNotFound = errors.New("backup not found")
+
+// ErrNotTerminating is returned when cancelling the deletion of a VM that is
+// not waiting to be deleted
+var ErrNotTerminating = errors.New("vm is not scheduled for deletion")
+
+// ErrDeletionInProgress is returned when cancelling or retrying a deletion
+// whose machine is already being deleted
+var ErrDeletionInProgress = errors.New("vm is already being deleted")
+
+// ErrNoGateway is returned for a final backup of a VM whose gateway never
+// joined the tailnet
+var ErrNoGateway = errors.New("vm has no gateway to back up")
+
+// ErrNotRebuildable is returned when rebuilding a VM that is still being
+// provisioned or is being deleted
+var ErrNotRebuildable = errors.New("vm cannot be rebuilt while it is provisioning or being deleted")
+
+// ErrNoFailedJob is returned when retrying the job of a VM that is neither in
+// error nor waiting to be deleted
+var ErrNoFailedJob = errors.New("vm has no job to retry")
+
+// ErrSuspendUnsupported is returned for VMs whose provider cannot suspend
+// machines
+var ErrSuspendUnsupported = errors.New("provider does not support suspending VMs")
+
+// ErrNotSuspendable is returned when suspending a VM that is not running
+var ErrNotSuspendable = errors.New("vm can only be suspended while running")
+
+// ErrSuspendScheduled is returned when suspending a VM whose clients have
+// already been warned of a suspension
+var ErrSuspendScheduled = errors.New("vm is already scheduled to be suspended")
+
+// ErrNotSuspended is returned when resuming a VM that is not suspended
+var ErrNotSuspended = errors.New("vm is not suspended")
+
+// ProviderError reports a failed call to a cloud or network provider, so the
+// API can tell provider outages and quota limits apart from internal bugs
+type ProviderError struct {
+	Provider string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Provider, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// QuotaExceeded reports whether the provider refused the call because an
+// account limit was reached
+func (e *ProviderError) QuotaExceeded() bool {
+	var herr hcloud.Error
+	if errors.As(e.Err, &herr) {
+		return herr.Code == hcloud.ErrorCodeResourceLimitExceeded
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// gatewayProbeTimeout bounds probing one gateway, so one unreachable VM
+	// does not hold up the whole list
+	gatewayProbeTimeout = 3 * time.Second
+
+	// gatewayProbeTTL is how long a probe is reused; clients list gateways
+	// on every launch and reconnect
+	gatewayProbeTTL = 30 * time.Second
+
+	// probeConcurrency bounds how many gateways are probed at once
+	probeConcurrency = 8
+)
+
+// gatewayProbe is what a probe learned about a gateway
+type gatewayProbe struct {
+	health     models.GatewayHealth
+	workspaces []string
+	checkedAt  time.Time
+}
+
+// ListGateways describes the gateways of the user's VMs matching selector,
+// newest first, so clients can tell which URL serves which workspace and
+// pick the healthiest. Terminated VMs are left out; VMs that are not running
+// are listed without a URL.
+func (m *Manager) ListGateways(ctx context.Context, userID string, selector labels.Selector) ([]models.GatewayDescriptor, error) {
+	vms, err := m.ListVMs(ctx, userID, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	gateways := make([]models.GatewayDescriptor, 0, len(vms))
+	var running []*models.VM
+	for _, vm := range vms {
+		if vm.Status == models.VMStatusTerminated {
+			continue
+		}
+		gateway := models.GatewayDescriptor{
+			VMID:       vm.ID,
+			VMStatus:   vm.Status,
+			Hostname:   vm.Hostname,
+			Location:   vm.Spec.Location,
+			Labels:     vm.Labels,
+			Workspaces: []string{},
+			Health:     models.GatewayHealth{Status: models.GatewayUnknown},
+		}
+		if vm.Status == models.VMStatusRunning {
+			connect, err := m.ConnectURL(vm)
+			if err != nil {
+				return nil, err
+			}
+			gateway.WebsocketURL = connect.WebsocketURL
+			gateway.ExpiresAt = &connect.ExpiresAt
+			running = append(running, vm)
+		}
+		gateways = append(gateways, gateway)
+	}
+
+	probes := make(map[string]*gatewayProbe, len(running))
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, probeConcurrency)
+	)
+	for _, vm := range running {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(vm *models.VM) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			probe := m.probeGateway(ctx, vm)
+
+			mu.Lock()
+			probes[vm.ID] = probe
+			mu.Unlock()
+		}(vm)
+	}
+	wg.Wait()
+
+	for i := range gateways {
+		if probe, ok := probes[gateways[i].VMID]; ok {
+			gateways[i].Health = probe.health
+			gateways[i].Workspaces = probe.workspaces
+		}
+	}
+	return gateways, nil
+}
+
+// probeGateway returns the VM's gateway health and workspaces, probing it
+// over the tailnet unless a recent probe can be reused
+func (m *Manager) probeGateway(ctx context.Context, vm *models.VM) *gatewayProbe {
+	m.probeMu.Lock()
+	cached, ok := m.probes[vm.ID]
+	m.probeMu.Unlock()
+	if ok && time.Since(cached.checkedAt) < gatewayProbeTTL {
+		return cached
+	}
+
+	probe := m.probe(ctx, vm)
+
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	for id, p := range m.probes {
+		if time.Since(p.checkedAt) >= gatewayProbeTTL {
+			delete(m.probes, id)
+		}
+	}
+	m.probes[vm.ID] = probe
+	return probe
+}
+
+func (m *Manager) probe(ctx context.Context, vm *models.VM) *gatewayProbe {
+	now := time.Now()
+	probe := &gatewayProbe{
+		health:     models.GatewayHealth{Status: models.GatewayUnreachable, CheckedAt: &now},
+		workspaces: []string{},
+		checkedAt:  now,
+	}
+	if vm.TailscaleIP == "" {
+		probe.health.Detail = "vm has not joined the tailnet"
+		return probe
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, gatewayProbeTimeout)
+	defer cancel()
+
+	// /readyz is cheap and says whether new sessions are accepted, so its
+	// round trip is the latency
+	var ready struct {
+		Checks map[string]string `json:"checks"`
+	}
+	status, err := m.getGateway(ctx, vm, "/readyz", &ready)
+	if err != nil {
+		probe.health.Detail = err.Error()
+		return probe
+	}
+	probe.health.LatencyMS = time.Since(now).Milliseconds()
+
+	var health struct {
+		Workspaces  []string `json:"workspaces"`
+		Diagnostics *struct {
+			Status string `json:"status"`
+		} `json:"diagnostics"`
+	}
+	if _, err := m.getGateway(ctx, vm, "/health", &health); err == nil && health.Workspaces != nil {
+		probe.workspaces = health.Workspaces
+	}
+
+	switch {
+	case status != http.StatusOK:
+		probe.health.Status = models.GatewayUnavailable
+		probe.health.Detail = failedChecks(ready.Checks)
+	case health.Diagnostics != nil && health.Diagnostics.Status == "fail":
+		probe.health.Status = models.GatewayDegraded
+		probe.health.Detail = "self-check failed"
+	default:
+		probe.health.Status = models.GatewayHealthy
+	}
+	return probe
+}
+
+// failedChecks lists a /readyz answer's failing checks, e.g.
+// "connections: limit reached"
+func failedChecks(checks map[string]string) string {
+	var failed []string
+	for name, result := range checks {
+		if result != "ok" {
+			failed = append(failed, name+": "+result)
+		}
+	}
+	sort.Strings(failed)
+	return strings.Join(failed, ", ")
+}
+
+// getGateway fetches a JSON document from the VM's gateway over the tailnet
+// and decodes it into result. Health endpoints answer with JSON whatever
+// their status, so the status is returned rather than treated as an error.
+func (m *Manager) getGateway(ctx context.Context, vm *models.VM, path string, result interface{}) (int, error) {
+	endpoint := fmt.Sprintf("http://%s%s", net.JoinHostPort(vm.TailscaleIP, m.config.GatewayPort), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("get %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return resp.StatusCode, fmt.Errorf("gateway returned %s: %w", resp.Status, err)
+	}
+	return resp.StatusCode, nil
+}
@@ -1,25 +1,80 @@
 package vm
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/devtail/control-plane/internal/hetzner"
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/catalog"
+	"github.com/devtail/control-plane/internal/dns"
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/notify"
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
 	"github.com/devtail/control-plane/internal/tailscale"
 	"github.com/devtail/control-plane/pkg/models"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// Tailnet issues the auth keys new VMs join the tailnet with, finds them
+// once they have, and removes the devices of rebuilt ones. *tailscale.Client talks to the Tailscale API; the
+// mock provider has an in-memory one for local development.
+type Tailnet interface {
+	CreateAuthKey(ctx context.Context, description string) (*tailscale.AuthKey, error)
+	WaitForDevice(ctx context.Context, hostname string, timeout time.Duration) (*tailscale.Device, error)
+	DeleteDevice(ctx context.Context, hostname string) error
+	Ping(ctx context.Context) error
+}
+
 type Manager struct {
-	db             *sql.DB
-	hetznerClient  *hetzner.Client
-	tailscaleClient *tailscale.Client
+	store          store.Store
+	provider       provider.Provider
+	tailscaleClient Tailnet
+	httpClient     *http.Client
 	config         Config
+
+	// Recent gateway probes by VM ID, see ListGateways
+	probeMu sync.Mutex
+	probes  map[string]*gatewayProbe
+
+	// Terminating VMs the deletion sweep is working on, by VM ID
+	deletionMu sync.Mutex
+	deletions  map[string]*pendingDeletion
+
+	// Signals RunOutbox that an operation was recorded
+	outboxWake chan struct{}
+
+	// What the watchdog found at its last check, and its totals
+	watchdogMu     sync.Mutex
+	watchdogReport models.WatchdogReport
+
+	// How long the latest provisionings took, stage by stage
+	provisionStats *provisionStats
+
+	// Suspensions clients have been warned of, and when VMs that were kept
+	// running count as idle from, by VM ID
+	suspendMu   sync.Mutex
+	suspensions map[string]*pendingSuspension
+	idleFrom    map[string]time.Time
+
+	// The warm pool's spec once RunPool has checked it against the catalog,
+	// and what the pool has done; poolWake signals RunPool that a VM was
+	// claimed
+	poolMu     sync.Mutex
+	poolSpec   *models.VMSpec
+	poolTotals models.PoolTotals
+	poolWake   chan struct{}
 }
 
 type Config struct {
@@ -27,215 +82,699 @@ type Config struct {
 	GatewayURL   string
 	CallbackURL  string
 	WebSocketBaseURL string
+
+	// TokenSigner issues the connect tokens embedded in WebSocket URLs
+	TokenSigner *auth.Signer
+
+	// GatewayPort is where VM gateways listen on the tailnet
+	GatewayPort string
+
+	// Catalog tells golden images, which need a shorter cloud-init, from
+	// stock ones
+	Catalog *catalog.Service
+
+	// DNS publishes a record for each running VM; nil disables it
+	DNS *dns.Records
+
+	// LogIngestURL is where gateways ship their logs; empty disables it
+	LogIngestURL string
+
+	// ContextSyncURL is where gateways save and restore AI conversation
+	// contexts; empty disables it
+	ContextSyncURL string
+
+	// ActivityURL is where gateways report per-minute activity; empty
+	// disables it, leaving VMs' last activity at their creation
+	ActivityURL string
+
+	// EventsURL is where gateways report events their VM's owner is
+	// notified of, such as an AI reply finishing while no client is
+	// connected; empty disables them
+	EventsURL string
+
+	// Backups stores workspace backups; nil disables them
+	Backups *BackupConfig
+
+	// ProvisionTimeout bounds the provider, Tailscale and DNS calls that
+	// provision a VM; zero means DefaultProvisionTimeout
+	ProvisionTimeout time.Duration
+
+	// DeletionGracePeriod is how long deleted VMs are kept terminating
+	// before their machine is deleted; zero deletes them at once
+	DeletionGracePeriod time.Duration
+
+	// Retention says how long the records of terminated VMs are kept
+	Retention RetentionPolicy
+
+	// ProvisionAttempts is how many times a provisioning operation is tried
+	// before its VM is put in error; zero means DefaultProvisionAttempts
+	ProvisionAttempts int
+
+	// ProvisionSLO is how long provisioning a VM may take, from its
+	// operation being recorded to its gateway accepting sessions; zero
+	// means DefaultProvisionSLO
+	ProvisionSLO time.Duration
+
+	// ProvisionRetryDelay is the wait before the second attempt, growing
+	// with each one after; zero means DefaultProvisionRetryDelay
+	ProvisionRetryDelay time.Duration
+
+	// Watchdog retries or rolls back VMs stuck provisioning
+	Watchdog WatchdogConfig
+
+	// Suspend says when idle VMs are suspended
+	Suspend SuspendConfig
+
+	// Pool keeps VMs provisioned ahead of CreateVM
+	Pool PoolConfig
+
+	// Notifier tells users their VM is ready or failed; nil disables
+	// notifications
+	Notifier *notify.Dispatcher
 }
 
-func NewManager(db *sql.DB, hetznerClient *hetzner.Client, tailscaleClient *tailscale.Client, config Config) *Manager {
+// DefaultProvisionTimeout covers creating a server, booting it and waiting
+// for it to join the tailnet
+const DefaultProvisionTimeout = 15 * time.Minute
+
+func NewManager(store store.Store, provider provider.Provider, tailscaleClient Tailnet, config Config) *Manager {
+	if config.ProvisionTimeout <= 0 {
+		config.ProvisionTimeout = DefaultProvisionTimeout
+	}
+	if config.ProvisionAttempts <= 0 {
+		config.ProvisionAttempts = DefaultProvisionAttempts
+	}
+	if config.ProvisionRetryDelay <= 0 {
+		config.ProvisionRetryDelay = DefaultProvisionRetryDelay
+	}
+	if config.ProvisionSLO <= 0 {
+		config.ProvisionSLO = DefaultProvisionSLO
+	}
+	if config.Watchdog.StuckAfter <= 0 {
+		config.Watchdog.StuckAfter = DefaultStuckAfter
+	}
+	if config.Suspend.Warning <= 0 {
+		config.Suspend.Warning = DefaultSuspendWarning
+	}
+	if config.Suspend.ResumeHint == "" {
+		config.Suspend.ResumeHint = DefaultResumeHint
+	}
 	return &Manager{
-		db:              db,
-		hetznerClient:   hetznerClient,
+		store:           store,
+		provider:        provider,
 		tailscaleClient: tailscaleClient,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
 		config:          config,
+		probes:          make(map[string]*gatewayProbe),
+		deletions:       make(map[string]*pendingDeletion),
+		outboxWake:      make(chan struct{}, 1),
+		provisionStats:  newProvisionStats(),
+		suspensions:     make(map[string]*pendingSuspension),
+		idleFrom:        make(map[string]time.Time),
+		poolWake:        make(chan struct{}, 1),
 	}
 }
 
 func (m *Manager) CreateVM(ctx context.Context, req *models.CreateVMRequest) (*models.CreateVMResponse, error) {
+	if req.RestoreBackupID != 0 {
+		if _, err := m.restorableBackup(ctx, req.UserID, req.RestoreBackupID); err != nil {
+			return nil, err
+		}
+	} else if vm := m.claimPoolVM(ctx, req); vm != nil {
+		connect, err := m.ConnectURL(vm)
+		if err != nil {
+			return nil, err
+		}
+		return &models.CreateVMResponse{
+			VM:                    vm,
+			WebsocketURL:          connect.WebsocketURL,
+			WebsocketURLExpiresAt: connect.ExpiresAt,
+			Pooled:                true,
+		}, nil
+	}
+
+	vm, err := m.createVM(ctx, req.UserID, req.Spec, req.Labels, req.RestoreBackupID)
+	if err != nil {
+		return nil, err
+	}
+
+	connect, err := m.ConnectURL(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CreateVMResponse{
+		VM:                    vm,
+		WebsocketURL:          connect.WebsocketURL,
+		WebsocketURLExpiresAt: connect.ExpiresAt,
+		EstimatedReady:        60,
+	}, nil
+}
+
+// createVM records a VM for userID with the operation that provisions it,
+// and wakes the outbox to start on it
+func (m *Manager) createVM(ctx context.Context, userID string, spec models.VMSpec, vmLabels map[string]string, restoreBackupID int64) (*models.VM, error) {
 	// Create VM record
 	vm := &models.VM{
 		ID:             uuid.New().String(),
-		UserID:         req.UserID,
+		UserID:         userID,
 		Status:         models.VMStatusProvisioning,
-		Spec:           req.Spec,
-		WebsocketToken: m.generateToken(),
+		Spec:           spec,
+		Labels:         labels.Copy(vmLabels),
+		Provider:       m.provider.Name(),
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
 
-	// Start transaction
-	tx, err := m.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, fmt.Errorf("begin transaction: %w", err)
+	// Insert VM record, with the operation that provisions it
+	op := &store.Operation{
+		Kind:            store.OperationProvision,
+		RestoreBackupID: restoreBackupID,
+		RequestID:       requestid.FromContext(ctx),
 	}
-	defer tx.Rollback()
-
-	// Insert VM record
-	if err := m.insertVM(ctx, tx, vm); err != nil {
+	if err := m.store.CreateVM(ctx, vm, op); err != nil {
 		return nil, fmt.Errorf("insert vm: %w", err)
 	}
-
-	// Commit early to make VM visible
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("commit transaction: %w", err)
-	}
+	m.setHostname(vm)
 
 	// Start async provisioning
-	go m.provisionVM(context.Background(), vm)
+	m.wakeOutbox()
+	return vm, nil
+}
 
-	return &models.CreateVMResponse{
-		VM:             vm,
-		WebsocketURL:   fmt.Sprintf("%s/ws?token=%s", m.config.WebSocketBaseURL, vm.WebsocketToken),
-		EstimatedReady: 60,
+// ConnectURL signs a short-lived WebSocket URL for the VM's owner
+func (m *Manager) ConnectURL(vm *models.VM) (*models.ConnectResponse, error) {
+	return m.connectURL(vm, false)
+}
+
+// ReadOnlyConnectURL signs a short-lived WebSocket URL whose sessions can
+// only watch the VM, for sharing with viewers
+func (m *Manager) ReadOnlyConnectURL(vm *models.VM) (*models.ConnectResponse, error) {
+	return m.connectURL(vm, true)
+}
+
+func (m *Manager) connectURL(vm *models.VM, readOnly bool) (*models.ConnectResponse, error) {
+	token, expiresAt, err := m.config.TokenSigner.Issue(vm.ID, vm.UserID, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("issue connect token: %w", err)
+	}
+
+	return &models.ConnectResponse{
+		WebsocketURL: fmt.Sprintf("%s/ws?token=%s", m.config.WebSocketBaseURL, url.QueryEscape(token)),
+		ExpiresAt:    expiresAt,
 	}, nil
 }
 
-func (m *Manager) provisionVM(ctx context.Context, vm *models.VM) {
-	log.Info().Str("vm_id", vm.ID).Msg("Starting VM provisioning")
+// provisionVM boots a machine for the VM and waits for it to join the
+// tailnet, returning its Tailscale IP. With rebuild set, the VM's existing
+// machine is replaced. The VM's status is left to the operation that runs it.
+// Stages are timed on clock.
+func (m *Manager) provisionVM(ctx context.Context, vm *models.VM, restoreBackupID int64, rebuild bool, clock *stageClock) (string, error) {
+	// Outside calls give up together once provisioning has taken too long
+	ctx, cancel := context.WithTimeout(ctx, m.config.ProvisionTimeout)
+	defer cancel()
 
 	// Create Tailscale auth key
 	authKey, err := m.tailscaleClient.CreateAuthKey(ctx, fmt.Sprintf("devtail-%s", vm.ID))
 	if err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to create Tailscale auth key")
-		m.updateVMStatus(ctx, vm.ID, models.VMStatusError)
-		return
+		return "", fmt.Errorf("create tailscale auth key: %w", err)
 	}
 
 	vm.TailscaleAuthKey = authKey.Key
 
+	var ingestToken string
+	if m.config.LogIngestURL != "" || m.config.ContextSyncURL != "" || m.config.ActivityURL != "" || m.config.EventsURL != "" || m.config.Backups != nil {
+		var tokenID string
+		ingestToken, tokenID, err = m.config.TokenSigner.IssueIngest(vm.ID)
+		if err != nil {
+			return "", fmt.Errorf("issue ingest token: %w", err)
+		}
+		// Only the latest token is accepted, so a rebuilt VM's old machine
+		// loses access
+		if err := m.store.SetVMIngestToken(ctx, vm.ID, tokenID); err != nil {
+			return "", fmt.Errorf("record ingest token: %w", err)
+		}
+	}
+
 	// Generate cloud-init script
-	cloudInit, err := GenerateCloudInit(CloudInitData{
+	data := CloudInitData{
 		VMID:             vm.ID,
 		TailscaleAuthKey: authKey.Key,
 		SSHPublicKey:     m.config.SSHPublicKey,
 		GatewayURL:       m.config.GatewayURL,
 		CallbackURL:      m.config.CallbackURL,
-	})
+		AuthPublicKey:    m.config.TokenSigner.PublicKey(),
+		GatewayPort:      m.config.GatewayPort,
+		LogIngestURL:     m.config.LogIngestURL,
+		LogIngestToken:   ingestToken,
+		ContextSyncURL:   m.config.ContextSyncURL,
+		ActivityURL:      m.config.ActivityURL,
+		EventsURL:        m.config.EventsURL,
+		RestoreBackupID:  restoreBackupID,
+		Golden:           m.goldenImage(ctx, vm.Spec.Image),
+	}
+	if m.config.Backups != nil {
+		data.BackupURL = m.config.Backups.URL
+		data.BackupInterval = m.config.Backups.Interval
+	}
+	cloudInit, err := GenerateCloudInit(data)
 	if err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to generate cloud-init")
-		m.updateVMStatus(ctx, vm.ID, models.VMStatusError)
-		return
+		return "", fmt.Errorf("generate cloud-init: %w", err)
 	}
 
-	// Create Hetzner VM
-	if err := m.hetznerClient.CreateVM(ctx, vm, cloudInit); err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to create Hetzner VM")
-		m.updateVMStatus(ctx, vm.ID, models.VMStatusError)
-		return
+	// Create the machine
+	create := m.provider.CreateVM
+	if rebuild {
+		create = m.replaceMachine
 	}
+	created := provider.WithMachineCreated(ctx, func() { clock.next(models.StageIPWait) })
+	if err := create(created, vm, cloudInit); err != nil {
+		return "", fmt.Errorf("create machine: %w", err)
+	}
+	// Ends creating the machine, or the wait for its IP after that
+	clock.next(models.StageTailnetJoin)
 
-	// Update VM with Hetzner ID
-	if err := m.updateVMHetznerID(ctx, vm.ID, vm.HetznerID); err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to update VM Hetzner ID")
-		return
+	// Update VM with the provider's ID and public IP, so a retry replaces
+	// this machine rather than leaking it
+	if err := m.store.UpdateVMMachine(ctx, vm.ID, vm.ProviderID, vm.PublicIP); err != nil {
+		return "", fmt.Errorf("record machine: %w", err)
 	}
 
+	return m.joinTailnet(ctx, vm)
+}
+
+// joinTailnet waits for the VM's machine to join the tailnet and returns its
+// Tailscale IP
+func (m *Manager) joinTailnet(ctx context.Context, vm *models.VM) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.ProvisionTimeout)
+	defer cancel()
+
 	// Wait for Tailscale device to appear
 	device, err := m.tailscaleClient.WaitForDevice(ctx, fmt.Sprintf("devtail-%s", vm.ID), 5*time.Minute)
 	if err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to wait for Tailscale device")
-		m.updateVMStatus(ctx, vm.ID, models.VMStatusError)
-		return
+		return "", fmt.Errorf("wait for tailnet device: %w", err)
 	}
 
 	// Extract Tailscale IP
 	if len(device.Addresses) == 0 {
-		log.Error().Str("vm_id", vm.ID).Msg("No Tailscale addresses found")
-		m.updateVMStatus(ctx, vm.ID, models.VMStatusError)
-		return
+		return "", errors.New("tailnet device has no addresses")
 	}
+	return device.Addresses[0], nil
+}
 
-	vm.TailscaleIP = device.Addresses[0]
+// setHostname fills in the VM's DNS name when records are enabled
+func (m *Manager) setHostname(vm *models.VM) {
+	if m.config.DNS != nil {
+		vm.Hostname = m.config.DNS.Hostname(vm.ID)
+	}
+}
 
-	// Update VM with Tailscale IP and mark as running
-	if err := m.updateVMReady(ctx, vm.ID, vm.TailscaleIP); err != nil {
-		log.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to update VM as ready")
-		return
+// goldenImage reports whether the named image has the gateway preinstalled
+func (m *Manager) goldenImage(ctx context.Context, name string) bool {
+	if m.config.Catalog == nil {
+		return false
 	}
+	image := m.config.Catalog.Image(ctx, name)
+	return image != nil && image.Golden
+}
 
-	log.Info().
-		Str("vm_id", vm.ID).
-		Str("tailscale_ip", vm.TailscaleIP).
-		Msg("VM provisioning completed")
+func (m *Manager) updateVMStatus(ctx context.Context, vmID string, status models.VMStatus) error {
+	return m.store.UpdateVMStatus(ctx, vmID, status)
 }
 
-func (m *Manager) generateToken() string {
-	token := uuid.New().String()
-	hash, _ := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
-	return string(hash)
+func (m *Manager) GetVM(ctx context.Context, vmID string) (*models.VM, error) {
+	vm, err := m.store.GetVM(ctx, vmID)
+	if err != nil {
+		return nil, err
+	}
+	m.setHostname(vm)
+	return vm, nil
 }
 
-func (m *Manager) insertVM(ctx context.Context, tx *sql.Tx, vm *models.VM) error {
-	query := `
-		INSERT INTO vms (
-			id, user_id, status, spec, websocket_token, 
-			created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`
-	
-	specJSON, err := json.Marshal(vm.Spec)
+// ListVMs returns the user's VMs matching selector, newest first
+func (m *Manager) ListVMs(ctx context.Context, userID string, selector labels.Selector) ([]*models.VM, error) {
+	vms, err := m.store.ListVMsByUser(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("marshal spec: %w", err)
+		return nil, fmt.Errorf("list vms: %w", err)
 	}
 
-	_, err = tx.ExecContext(ctx, query,
-		vm.ID, vm.UserID, vm.Status, specJSON, vm.WebsocketToken,
-		vm.CreatedAt, vm.UpdatedAt,
-	)
-	return err
+	matched := make([]*models.VM, 0, len(vms))
+	for _, vm := range vms {
+		if selector.Matches(vm.Labels) {
+			m.setHostname(vm)
+			matched = append(matched, vm)
+		}
+	}
+	return matched, nil
 }
 
-func (m *Manager) updateVMStatus(ctx context.Context, vmID string, status models.VMStatus) error {
-	query := `UPDATE vms SET status = $1, updated_at = $2 WHERE id = $3`
-	_, err := m.db.ExecContext(ctx, query, status, time.Now(), vmID)
-	return err
-}
+// VMFilter narrows an operator's VM listing. Zero fields match everything,
+// except that terminated VMs are only listed when Status asks for them.
+type VMFilter struct {
+	UserID   string
+	Status   models.VMStatus
+	Selector labels.Selector
 
-func (m *Manager) updateVMHetznerID(ctx context.Context, vmID string, hetznerID int64) error {
-	query := `UPDATE vms SET hetzner_id = $1, updated_at = $2 WHERE id = $3`
-	_, err := m.db.ExecContext(ctx, query, hetznerID, time.Now(), vmID)
-	return err
+	// IdleFor, if set, only matches VMs without activity for this long
+	IdleFor time.Duration
 }
 
-func (m *Manager) updateVMReady(ctx context.Context, vmID string, tailscaleIP string) error {
-	query := `
-		UPDATE vms 
-		SET status = $1, tailscale_ip = $2, updated_at = $3 
-		WHERE id = $4
-	`
-	_, err := m.db.ExecContext(ctx, query, 
-		models.VMStatusRunning, tailscaleIP, time.Now(), vmID,
-	)
-	return err
-}
+// FindVMs lists every user's VMs matching the filter, newest first
+func (m *Manager) FindVMs(ctx context.Context, filter VMFilter) ([]*models.VM, error) {
+	var vms []*models.VM
+	switch {
+	case filter.UserID != "":
+		userVMs, err := m.store.ListVMsByUser(ctx, filter.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("list vms: %w", err)
+		}
+		vms = userVMs
+	case filter.Status != "":
+		statusVMs, err := m.store.ListVMsByStatus(ctx, filter.Status)
+		if err != nil {
+			return nil, fmt.Errorf("list vms: %w", err)
+		}
+		vms = statusVMs
+	default:
+		for _, status := range []models.VMStatus{models.VMStatusProvisioning, models.VMStatusRunning,
+			models.VMStatusSuspended, models.VMStatusError, models.VMStatusTerminating} {
+			statusVMs, err := m.store.ListVMsByStatus(ctx, status)
+			if err != nil {
+				return nil, fmt.Errorf("list vms: %w", err)
+			}
+			vms = append(vms, statusVMs...)
+		}
+		sort.Slice(vms, func(i, j int) bool { return vms[i].CreatedAt.After(vms[j].CreatedAt) })
+	}
 
-func (m *Manager) GetVM(ctx context.Context, vmID string) (*models.VM, error) {
-	query := `
-		SELECT id, user_id, hetzner_id, tailscale_ip, status, spec,
-		       websocket_token, last_activity, created_at, updated_at
-		FROM vms
-		WHERE id = $1
-	`
-
-	var vm models.VM
-	var specJSON []byte
-
-	err := m.db.QueryRowContext(ctx, query, vmID).Scan(
-		&vm.ID, &vm.UserID, &vm.HetznerID, &vm.TailscaleIP,
-		&vm.Status, &specJSON, &vm.WebsocketToken,
-		&vm.LastActivity, &vm.CreatedAt, &vm.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
+	matched := make([]*models.VM, 0, len(vms))
+	for _, vm := range vms {
+		if filter.Status != "" && vm.Status != filter.Status {
+			continue
+		}
+		if filter.Status == "" && vm.Status == models.VMStatusTerminated {
+			continue
+		}
+		if filter.IdleFor > 0 && !idleSince(vm, time.Now().Add(-filter.IdleFor)) {
+			continue
+		}
+		if filter.Selector.Matches(vm.Labels) {
+			m.setHostname(vm)
+			matched = append(matched, vm)
+		}
 	}
+	return matched, nil
+}
 
-	if err := json.Unmarshal(specJSON, &vm.Spec); err != nil {
-		return nil, fmt.Errorf("unmarshal spec: %w", err)
+// UpdateLabels replaces the VM's labels and mirrors them onto its machine.
+// The database is authoritative: if the provider cannot be updated the
+// change is kept and pushed again with the next update.
+func (m *Manager) UpdateLabels(ctx context.Context, vm *models.VM, vmLabels map[string]string) error {
+	logger := requestid.Logger(ctx)
+
+	if err := m.store.UpdateVMLabels(ctx, vm.ID, vmLabels); err != nil {
+		return fmt.Errorf("update labels: %w", err)
 	}
+	vm.Labels = labels.Copy(vmLabels)
 
-	return &vm, nil
+	if vm.ProviderID != "" && vm.Provider == m.provider.Name() {
+		if err := m.provider.UpdateLabels(ctx, vm); err != nil {
+			logger.Warn().Err(err).Str("vm_id", vm.ID).Str("provider", vm.Provider).Msg("Failed to push labels to provider")
+		}
+	}
+	return nil
 }
 
 func (m *Manager) DeleteVM(ctx context.Context, vmID string) error {
+	logger := requestid.Logger(ctx)
+
 	vm, err := m.GetVM(ctx, vmID)
 	if err != nil {
 		return fmt.Errorf("get vm: %w", err)
 	}
 
-	// Delete from Hetzner
-	if vm.HetznerID != 0 {
-		if err := m.hetznerClient.DeleteVM(ctx, vm.HetznerID); err != nil {
-			log.Error().Err(err).Str("vm_id", vmID).Msg("Failed to delete Hetzner VM")
+	// Delete the machine. The VM stays active on failure so the delete can
+	// be retried instead of leaving a billed server behind.
+	if vm.ProviderID != "" {
+		if vm.Provider != m.provider.Name() {
+			return &ProviderError{Provider: vm.Provider, Err: fmt.Errorf("provider is not configured on this control plane (using %s)", m.provider.Name())}
+		}
+		if err := m.provider.DeleteVM(ctx, vm); err != nil {
+			logger.Error().Err(err).Str("vm_id", vmID).Str("provider", vm.Provider).Msg("Failed to delete VM")
+			return &ProviderError{Provider: vm.Provider, Err: err}
+		}
+	}
+
+	// A stale record would point at an address the tailnet may hand to
+	// another machine, but it must not keep the VM alive either
+	if m.config.DNS != nil {
+		if err := m.config.DNS.Remove(ctx, vm); err != nil {
+			logger.Error().Err(err).Str("vm_id", vmID).Msg("Failed to remove DNS record")
 		}
 	}
 
-	// Update status to terminated
-	return m.updateVMStatus(ctx, vmID, models.VMStatusTerminated)
-}
\ No newline at end of file
+	// Likewise the tailnet device, whose node key stays authorized until
+	// it is removed
+	if err := m.tailscaleClient.DeleteDevice(ctx, fmt.Sprintf("devtail-%s", vm.ID)); err != nil {
+		logger.Error().Err(err).Str("vm_id", vmID).Msg("Failed to remove tailnet device")
+	}
+
+	// Mark terminated, scrubbing what only the live VM needed
+	return m.store.TerminateVM(ctx, vmID, time.Now())
+}
+
+// IngestLogs stores a batch of log entries shipped by the gateway of the VM
+// the ingest token was issued for
+func (m *Manager) IngestLogs(ctx context.Context, token string, entries []models.LogEntry) (string, error) {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range entries {
+		if entries[i].Kind == "" {
+			entries[i].Kind = models.LogKindLog
+		}
+	}
+
+	if err := m.store.AppendVMLogs(ctx, vm.ID, entries); err != nil {
+		return vm.ID, fmt.Errorf("append logs: %w", err)
+	}
+	return vm.ID, nil
+}
+
+// SaveContext stores a conversation context uploaded by the gateway of the
+// VM the ingest token was issued for. It is saved for the VM's owner, so
+// their next VM can restore it.
+func (m *Manager) SaveContext(ctx context.Context, token string, snapshot *models.ContextSnapshot) error {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return err
+	}
+
+	snapshot.VMID = vm.ID
+	snapshot.Size = int64(len(snapshot.Data))
+	snapshot.UpdatedAt = time.Now()
+	if err := m.store.PutContextSnapshot(ctx, vm.UserID, snapshot); err != nil {
+		return fmt.Errorf("save context: %w", err)
+	}
+	return nil
+}
+
+// ListContexts returns the conversation contexts saved by any of the VM
+// owner's gateways, without their data
+func (m *Manager) ListContexts(ctx context.Context, token string, limit int) ([]models.ContextSnapshot, error) {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return nil, err
+	}
+	return m.store.ListContextSnapshots(ctx, vm.UserID, limit)
+}
+
+// GetContext returns one of the VM owner's saved conversation contexts
+func (m *Manager) GetContext(ctx context.Context, token, workspace, sessionID string) (*models.ContextSnapshot, error) {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return nil, err
+	}
+	return m.store.GetContextSnapshot(ctx, vm.UserID, workspace, sessionID)
+}
+
+// ingestVM returns the VM an ingest token was issued for. Tokens are
+// treated as invalid unless they are the latest one issued for the VM, and
+// the VM is live: not deleted, terminated or terminating. With finalBackup
+// set, a terminating VM may still upload the backup taken before its
+// machine is deleted. VMs provisioned before token IDs were recorded accept
+// any of their tokens until they are rebuilt.
+func (m *Manager) ingestVM(ctx context.Context, token string, finalBackup bool) (*models.VM, error) {
+	vmID, tokenID, err := m.config.TokenSigner.VerifyIngest(token)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := m.store.GetVM(ctx, vmID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch vm.Status {
+	case models.VMStatusTerminated:
+		return nil, auth.ErrInvalidToken
+	case models.VMStatusTerminating:
+		if !finalBackup || !vm.BackupOnDelete {
+			return nil, auth.ErrInvalidToken
+		}
+	}
+
+	current, err := m.store.GetVMIngestToken(ctx, vmID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current != "" && current != tokenID {
+		return nil, auth.ErrInvalidToken
+	}
+	return vm, nil
+}
+
+// ListLogs returns the log entries the VM's gateway shipped
+func (m *Manager) ListLogs(ctx context.Context, vmID string, filter store.LogFilter) ([]models.LogEntry, error) {
+	return m.store.ListVMLogs(ctx, vmID, filter)
+}
+
+// Console opens an out-of-band console on the VM's machine for operators
+func (m *Manager) Console(ctx context.Context, vm *models.VM) (*models.ConsoleResponse, error) {
+	if vm.Provider != m.provider.Name() {
+		return nil, &ProviderError{Provider: vm.Provider, Err: fmt.Errorf("provider is not configured on this control plane (using %s)", m.provider.Name())}
+	}
+
+	console, ok := m.provider.(provider.Console)
+	if !ok {
+		return nil, ErrConsoleUnsupported
+	}
+
+	resp, err := console.Console(ctx, vm)
+	if err != nil {
+		return nil, &ProviderError{Provider: vm.Provider, Err: err}
+	}
+	return resp, nil
+}
+
+// RotateToken revokes every connect token issued for the VM so far and signs
+// a replacement URL
+func (m *Manager) RotateToken(ctx context.Context, vm *models.VM) (*models.TokenRevocationResponse, error) {
+	// Token issue times have one second precision
+	resp, err := m.RevokeTokens(ctx, vm, "", time.Now().Truncate(time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	resp.ConnectResponse, err = m.ConnectURL(vm)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RevokeTokens revokes one connect token, or all tokens issued before
+// issuedBefore when tokenID is empty, and tells the VM's gateway to end the
+// sessions opened with them. The revocation is recorded even if the gateway
+// cannot be reached; tokens are short-lived, so it lapses on its own.
+func (m *Manager) RevokeTokens(ctx context.Context, vm *models.VM, tokenID string, issuedBefore time.Time) (*models.TokenRevocationResponse, error) {
+	revocationID, err := m.store.CreateTokenRevocation(ctx, &store.TokenRevocation{
+		VMID:         vm.ID,
+		TokenID:      tokenID,
+		IssuedBefore: issuedBefore,
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("record revocation: %w", err)
+	}
+
+	notice, err := m.config.TokenSigner.SignRevocation(vm.ID, tokenID, issuedBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := requestid.Logger(ctx)
+
+	resp := &models.TokenRevocationResponse{}
+	if vm.Status != models.VMStatusRunning || vm.TailscaleIP == "" {
+		resp.Error = "vm is not running"
+		return resp, nil
+	}
+
+	closed, err := m.pushRevocation(ctx, vm, notice)
+	if err != nil {
+		logger.Warn().Err(err).Str("vm_id", vm.ID).Msg("Failed to propagate token revocation")
+		resp.Error = "gateway unreachable"
+		return resp, nil
+	}
+
+	if err := m.store.MarkTokenRevocationPropagated(ctx, revocationID, time.Now()); err != nil {
+		logger.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to mark revocation propagated")
+	}
+
+	resp.Propagated = true
+	resp.SessionsClosed = closed
+	return resp, nil
+}
+
+// pushRevocation delivers a signed revocation notice to the VM's gateway over
+// the tailnet and returns how many sessions it ended
+func (m *Manager) pushRevocation(ctx context.Context, vm *models.VM, notice string) (int, error) {
+	var result struct {
+		SessionsClosed int `json:"sessions_closed"`
+	}
+	if err := m.postGateway(ctx, vm, "/auth/revoke", map[string]string{"revocation": notice}, &result); err != nil {
+		return 0, err
+	}
+	return result.SessionsClosed, nil
+}
+
+// gatewayError is a gateway's answer to a request it did not carry out
+type gatewayError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *gatewayError) Error() string {
+	return fmt.Sprintf("gateway returned %s: %s", e.Status, e.Message)
+}
+
+// postGateway posts a JSON request to the VM's gateway over the tailnet and
+// decodes its JSON answer into result
+func (m *Manager) postGateway(ctx context.Context, vm *models.VM, path string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("http://%s%s", net.JoinHostPort(vm.TailscaleIP, m.config.GatewayPort), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &gatewayError{StatusCode: resp.StatusCode, Status: resp.Status, Message: string(bytes.TrimSpace(msg))}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decode gateway response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/control-plane/internal/auth"
+	"github.com/devtail/control-plane/internal/provider/mock"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/internal/store/memory"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+var testSpec = models.VMSpec{Type: "small", Location: "local", Image: "default"}
+
+// testProvider is the mock provider, keeping the cloud-init each VM's
+// latest machine was created with
+type testProvider struct {
+	*mock.Provider
+
+	mu         sync.Mutex
+	cloudInits map[string]string
+}
+
+func (p *testProvider) CreateVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	p.record(vm.ID, cloudInit)
+	return p.Provider.CreateVM(ctx, vm, cloudInit)
+}
+
+func (p *testProvider) RebuildVM(ctx context.Context, vm *models.VM, cloudInit string) error {
+	p.record(vm.ID, cloudInit)
+	return p.Provider.RebuildVM(ctx, vm, cloudInit)
+}
+
+func (p *testProvider) record(vmID, cloudInit string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cloudInits[vmID] = cloudInit
+}
+
+var ingestTokenFlag = regexp.MustCompile(`--log-token (\S+)`)
+
+// ingestToken returns the ingest token handed to the VM's latest machine
+func (p *testProvider) ingestToken(t *testing.T, vmID string) string {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	match := ingestTokenFlag.FindStringSubmatch(p.cloudInits[vmID])
+	if match == nil {
+		t.Fatalf("expected an ingest token in the cloud-init of VM %s", vmID)
+	}
+	return match[1]
+}
+
+// newTestManager returns a manager on the in-memory store and the mock
+// provider, whose machines boot at once and run a fake gateway that is
+// always ready and has no sessions
+func newTestManager(t *testing.T, config Config) (*Manager, *memory.Store) {
+	t.Helper()
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"sessions": 0})
+	}))
+	t.Cleanup(gateway.Close)
+	_, port, err := net.SplitHostPort(gateway.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := auth.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TokenSigner = auth.NewSigner(key, 0)
+	config.WebSocketBaseURL = "ws://gateway.test"
+	config.GatewayPort = port
+
+	st := memory.New()
+	p := &testProvider{
+		Provider:   mock.New(mock.Config{GatewayIP: "127.0.0.1"}),
+		cloudInits: make(map[string]string),
+	}
+	return NewManager(st, p, p.Tailnet(), config), st
+}
+
+// runOutbox runs the manager's outbox until the test ends
+func runOutbox(t *testing.T, m *Manager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go m.RunOutbox(ctx, 10*time.Millisecond)
+}
+
+// waitForStatus waits for the VM to reach status and returns it
+func waitForStatus(t *testing.T, m *Manager, vmID string, status models.VMStatus) *models.VM {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		vm, err := m.GetVM(context.Background(), vmID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vm.Status == status {
+			return vm
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected VM %s to be %s, it is %s", vmID, status, vm.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCreateVMProvisionsThroughTheOutbox(t *testing.T) {
+	m, st := newTestManager(t, Config{})
+	ctx := context.Background()
+
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: testSpec, Labels: map[string]string{"team": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.VM.Status != models.VMStatusProvisioning || resp.Pooled {
+		t.Fatalf("expected a new provisioning VM, got %s (pooled %v)", resp.VM.Status, resp.Pooled)
+	}
+	if resp.WebsocketURL == "" || resp.WebsocketURLExpiresAt.Before(time.Now()) {
+		t.Fatalf("expected a connect URL, got %q expiring %v", resp.WebsocketURL, resp.WebsocketURLExpiresAt)
+	}
+
+	runOutbox(t, m)
+	vm := waitForStatus(t, m, resp.VM.ID, models.VMStatusRunning)
+	if vm.TailscaleIP != "127.0.0.1" || vm.ProviderID == "" {
+		t.Errorf("expected the machine and its tailnet address recorded, got provider ID %q at %q", vm.ProviderID, vm.TailscaleIP)
+	}
+	if vm.Labels["team"] != "a" {
+		t.Errorf("expected the request's labels, got %v", vm.Labels)
+	}
+
+	ops, err := st.ListVMOperations(ctx, vm.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Kind != store.OperationProvision || ops[0].Status != store.OperationDone || ops[0].Attempts != 1 {
+		t.Fatalf("expected one provisioning operation done at the first attempt, got %+v", ops)
+	}
+}
+
+func TestSuspendResumeAndDeleteVM(t *testing.T) {
+	m, _ := newTestManager(t, Config{})
+	ctx := context.Background()
+	runOutbox(t, m)
+
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: testSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := waitForStatus(t, m, resp.VM.ID, models.VMStatusRunning)
+
+	noWarning := 0
+	suspended, err := m.SuspendVM(ctx, vm, &models.SuspendVMRequest{WarningSeconds: &noWarning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !suspended.Suspended {
+		t.Fatal("expected a suspension without warning to suspend the VM at once")
+	}
+	vm = waitForStatus(t, m, vm.ID, models.VMStatusSuspended)
+	if _, err := m.SuspendVM(ctx, vm, &models.SuspendVMRequest{WarningSeconds: &noWarning}); !errors.Is(err, ErrNotSuspendable) {
+		t.Errorf("expected a suspended VM not to be suspended again, got %v", err)
+	}
+
+	if _, err := m.ResumeVM(ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	vm = waitForStatus(t, m, vm.ID, models.VMStatusRunning)
+	if _, err := m.ResumeVM(ctx, vm); !errors.Is(err, ErrNotSuspended) {
+		t.Errorf("expected a running VM not to be resumed, got %v", err)
+	}
+
+	if err := m.DeleteVM(ctx, vm.ID); err != nil {
+		t.Fatal(err)
+	}
+	vm = waitForStatus(t, m, vm.ID, models.VMStatusTerminated)
+	if vm.TerminatedAt == nil {
+		t.Error("expected the termination time recorded")
+	}
+	if _, err := m.ResumeVM(ctx, vm); !errors.Is(err, ErrNotSuspended) {
+		t.Errorf("expected a terminated VM not to be resumed, got %v", err)
+	}
+}
+
+func TestScheduledDeletionCanBeCancelled(t *testing.T) {
+	m, _ := newTestManager(t, Config{DeletionGracePeriod: time.Hour})
+	ctx := context.Background()
+	runOutbox(t, m)
+
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: testSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := waitForStatus(t, m, resp.VM.ID, models.VMStatusRunning)
+
+	vm, err = m.ScheduleDeletion(ctx, vm, DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Status != models.VMStatusTerminating {
+		t.Fatalf("expected the VM terminating during the grace period, got %s", vm.Status)
+	}
+
+	vm, err = m.CancelDeletion(ctx, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Status != models.VMStatusRunning {
+		t.Fatalf("expected a cancelled deletion to leave the VM running, got %s", vm.Status)
+	}
+	if _, err := m.CancelDeletion(ctx, vm); !errors.Is(err, ErrNotTerminating) {
+		t.Errorf("expected nothing to cancel, got %v", err)
+	}
+
+	vm, err = m.ScheduleDeletion(ctx, vm, DeleteOptions{Immediate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.Status != models.VMStatusTerminated {
+		t.Fatalf("expected an immediate deletion to terminate the VM, got %s", vm.Status)
+	}
+}
+
+func TestOutboxDiscardsResultsOfLostLeases(t *testing.T) {
+	m, st := newTestManager(t, Config{})
+	ctx := context.Background()
+
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: testSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	first, err := st.LeaseVMOperations(ctx, now, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0].VMID != resp.VM.ID {
+		t.Fatalf("expected the provisioning operation leased, got %+v", first)
+	}
+	if again, _ := st.LeaseVMOperations(ctx, now, time.Minute, 10); len(again) != 0 {
+		t.Fatalf("expected a leased operation not to be leased again, got %+v", again)
+	}
+
+	// The first attempt stalls past its lease and another one takes over
+	second, err := st.LeaseVMOperations(ctx, now.Add(2*time.Minute), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || second[0].Attempts != 2 {
+		t.Fatalf("expected the operation leased again once its lease ran out, got %+v", second)
+	}
+
+	m.runOperation(ctx, first[0])
+	if vm, _ := m.GetVM(ctx, resp.VM.ID); vm.Status != models.VMStatusProvisioning {
+		t.Fatalf("expected the attempt that lost its lease not to finish the VM, got %s", vm.Status)
+	}
+
+	m.runOperation(ctx, second[0])
+	vm := waitForStatus(t, m, resp.VM.ID, models.VMStatusRunning)
+	if vm.ProviderID == "" {
+		t.Error("expected the machine recorded")
+	}
+	ops, err := st.ListVMOperations(ctx, vm.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Status != store.OperationDone || ops[0].Attempts != 2 {
+		t.Fatalf("expected the operation done by the second attempt, got %+v", ops)
+	}
+}
+
+func TestCreateVMClaimsAWarmPoolVM(t *testing.T) {
+	m, st := newTestManager(t, Config{Pool: PoolConfig{Size: 1, Spec: testSpec}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runOutbox(t, m)
+	go m.RunPool(ctx, 10*time.Millisecond)
+
+	pooled := waitForPool(t, st, 1)
+
+	// Another spec is provisioned from scratch
+	other := testSpec
+	other.Type = "large"
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Pooled || resp.VM.ID == pooled[0].ID {
+		t.Fatal("expected a VM with another spec not to come from the pool")
+	}
+
+	resp, err = m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-2", Spec: testSpec, Labels: map[string]string{"team": "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Pooled || resp.VM.ID != pooled[0].ID {
+		t.Fatalf("expected pool VM %s claimed, got %s (pooled %v)", pooled[0].ID, resp.VM.ID, resp.Pooled)
+	}
+	if resp.VM.Status != models.VMStatusRunning || resp.WebsocketURL == "" {
+		t.Errorf("expected a running VM to connect to, got %s at %q", resp.VM.Status, resp.WebsocketURL)
+	}
+
+	vm, err := m.GetVM(ctx, resp.VM.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.UserID != "user-2" || vm.Labels["team"] != "b" {
+		t.Errorf("expected the VM handed to user-2 with their labels, got %s with %v", vm.UserID, vm.Labels)
+	}
+
+	// The pool is topped up with another VM
+	refilled := waitForPool(t, st, 1)
+	if refilled[0].ID == pooled[0].ID {
+		t.Fatal("expected the claimed VM to leave the pool")
+	}
+
+	report, err := m.PoolReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Totals.Claimed != 1 || report.Totals.Created != 2 {
+		t.Errorf("expected one VM claimed and two created, got %+v", report.Totals)
+	}
+}
+
+// waitForPool waits for n running pool VMs and returns them
+func waitForPool(t *testing.T, st *memory.Store, n int) []*models.VM {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		vms, err := st.ListVMsByUser(context.Background(), models.PoolUserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var running []*models.VM
+		for _, vm := range vms {
+			if vm.Status == models.VMStatusRunning {
+				running = append(running, vm)
+			}
+		}
+		if len(running) == n {
+			return running
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d running pool VMs, got %d", n, len(running))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIngestTokensEndWithTheMachine(t *testing.T) {
+	m, st := newTestManager(t, Config{LogIngestURL: "http://control-plane.test/api/v1/ingest/logs"})
+	p := m.provider.(*testProvider)
+	ctx := context.Background()
+	runOutbox(t, m)
+
+	resp, err := m.CreateVM(ctx, &models.CreateVMRequest{UserID: "user-1", Spec: testSpec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := waitForStatus(t, m, resp.VM.ID, models.VMStatusRunning)
+	entries := []models.LogEntry{{Message: "hello", Time: time.Now()}}
+
+	first := p.ingestToken(t, vm.ID)
+	if _, err := m.IngestLogs(ctx, first, entries); err != nil {
+		t.Fatalf("expected the VM's token accepted: %v", err)
+	}
+
+	// Signed with the right key for the right VM, but never handed to it
+	unissued, _, err := m.config.TokenSigner.IssueIngest(vm.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.IngestLogs(ctx, unissued, entries); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected a token the VM was not given rejected, got %v", err)
+	}
+
+	if _, err := m.RebuildVM(ctx, vm, &models.RebuildVMRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	vm = waitForStatus(t, m, vm.ID, models.VMStatusRunning)
+	second := p.ingestToken(t, vm.ID)
+	if second == first {
+		t.Fatal("expected the rebuilt machine to get a new token")
+	}
+	if _, err := m.IngestLogs(ctx, first, entries); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected the old machine's token rejected after the rebuild, got %v", err)
+	}
+	if _, err := m.IngestLogs(ctx, second, entries); err != nil {
+		t.Fatalf("expected the new machine's token accepted: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		backup      bool // the deletion waits for a final backup
+		finalBackup bool
+		wantErr     bool
+	}{
+		{"terminating", false, false, true},
+		{"terminating, final backup not wanted", false, true, true},
+		{"terminating for a final backup", true, false, true},
+		{"final backup", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := st.ScheduleVMDeletion(ctx, vm.ID, time.Now().Add(time.Hour), tt.backup); err != nil {
+				t.Fatal(err)
+			}
+			_, err := m.ingestVM(ctx, second, tt.finalBackup)
+			switch {
+			case tt.wantErr && !errors.Is(err, auth.ErrInvalidToken):
+				t.Fatalf("expected the token rejected, got %v", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("expected the token accepted: %v", err)
+			}
+		})
+	}
+
+	if err := m.DeleteVM(ctx, vm.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ingestVM(ctx, second, true); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("expected the token rejected once the VM is terminated, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/notify"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// ErrNotificationsDisabled is returned for a test notification when no
+// notifier is configured
+var ErrNotificationsDisabled = errors.New("no notifiers are configured")
+
+// RegisterNotificationTarget adds a device or address for the user's
+// notifications
+func (m *Manager) RegisterNotificationTarget(ctx context.Context, userID string, req *models.CreateNotificationTargetRequest) (*models.NotificationTarget, error) {
+	target := &models.NotificationTarget{
+		UserID:  userID,
+		Kind:    req.Kind,
+		Address: req.Address,
+	}
+	if err := m.store.PutNotificationTarget(ctx, target); err != nil {
+		return nil, fmt.Errorf("put notification target: %w", err)
+	}
+	return target, nil
+}
+
+// ListNotificationTargets returns the user's notification targets
+func (m *Manager) ListNotificationTargets(ctx context.Context, userID string) ([]models.NotificationTarget, error) {
+	targets, err := m.store.ListNotificationTargets(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list notification targets: %w", err)
+	}
+	return targets, nil
+}
+
+// DeleteNotificationTarget removes one of the user's notification targets
+func (m *Manager) DeleteNotificationTarget(ctx context.Context, userID string, id int64) error {
+	return m.store.DeleteNotificationTarget(ctx, userID, id)
+}
+
+// TestNotification sends the user a test notification through every
+// notifier at once, and reports how each did
+func (m *Manager) TestNotification(ctx context.Context, userID string) (*models.TestNotificationResponse, error) {
+	if m.config.Notifier == nil {
+		return nil, ErrNotificationsDisabled
+	}
+
+	errs := m.config.Notifier.Send(ctx, notify.Event{
+		Kind:   models.NotifyTest,
+		UserID: userID,
+		Title:  "Test notification",
+		Body:   "Notifications from devtail reach you here.",
+	})
+
+	resp := &models.TestNotificationResponse{Notifiers: m.config.Notifier.Notifiers()}
+	for name, err := range errs {
+		if resp.Errors == nil {
+			resp.Errors = make(map[string]string, len(errs))
+		}
+		resp.Errors[name] = err.Error()
+	}
+	return resp, nil
+}
+
+// IngestEvent notifies the owner of the VM whose gateway reported the
+// event. Events from pool VMs, which nobody owns yet, are dropped.
+func (m *Manager) IngestEvent(ctx context.Context, token string, req *models.IngestEventRequest) error {
+	vm, err := m.ingestVM(ctx, token, false)
+	if err != nil {
+		return err
+	}
+	if vm.UserID == models.PoolUserID {
+		return nil
+	}
+
+	workspace := req.Workspace
+	if workspace == "" {
+		workspace = "default"
+	}
+	took := time.Duration(req.DurationSeconds * float64(time.Second)).Round(time.Second)
+	m.notify(ctx, vm, req.Kind, "AI task finished",
+		fmt.Sprintf("The AI finished replying in workspace %s after %s. Review its changes.", workspace, took))
+	return nil
+}
+
+// notify queues a notification about the VM for its owner, if notifiers
+// are configured
+func (m *Manager) notify(ctx context.Context, vm *models.VM, kind models.NotificationEvent, title, body string) {
+	if m.config.Notifier == nil {
+		return
+	}
+	m.config.Notifier.Notify(ctx, notify.Event{
+		Kind:   kind,
+		UserID: vm.UserID,
+		VMID:   vm.ID,
+		Title:  title,
+		Body:   body,
+	})
+}
@@ -0,0 +1,183 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// DefaultProvisionAttempts tries provisioning three times before the VM
+	// is put in error
+	DefaultProvisionAttempts = 3
+
+	// DefaultProvisionRetryDelay is the wait before the second attempt
+	DefaultProvisionRetryDelay = 30 * time.Second
+
+	// DefaultOutboxInterval is how often RunOutbox looks for due operations
+	// it was not woken for, such as retries and those left by a restart
+	DefaultOutboxInterval = 10 * time.Second
+
+	// outboxWorkers bounds the operations run at once
+	outboxWorkers = 16
+)
+
+// RunOutbox carries out the operations that VM state changes record, such
+// as provisioning a new VM, every interval and whenever one is recorded,
+// until ctx is done. An operation is leased for longer than an attempt can
+// take, so an operation interrupted by a restart runs again once its lease
+// runs out, and only an attempt that still holds the lease can apply its
+// result. Attempts replace any machine an earlier one left behind.
+func (m *Manager) RunOutbox(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultOutboxInterval
+	}
+	lease := m.config.ProvisionTimeout + time.Minute
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slots := make(chan struct{}, outboxWorkers)
+	for {
+		if free := cap(slots) - len(slots); free > 0 {
+			ops, err := m.store.LeaseVMOperations(ctx, time.Now(), lease, free)
+			if err != nil && ctx.Err() == nil {
+				requestid.Logger(ctx).Error().Err(err).Msg("Failed to lease VM operations")
+			}
+			for _, op := range ops {
+				op := op
+				slots <- struct{}{}
+				go func() {
+					defer func() { <-slots }()
+					m.runOperation(ctx, op)
+				}()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.outboxWake:
+		}
+	}
+}
+
+// wakeOutbox has RunOutbox look for due operations now
+func (m *Manager) wakeOutbox() {
+	select {
+	case m.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// runOperation makes an attempt at a leased operation and records how it
+// went
+func (m *Manager) runOperation(ctx context.Context, op *store.Operation) {
+	ctx = requestid.WithContext(ctx, op.RequestID)
+	logger := requestid.Logger(ctx)
+
+	complete := func(result store.OperationResult) bool {
+		err := m.store.CompleteVMOperation(ctx, op, result)
+		if errors.Is(err, store.ErrNotFound) {
+			logger.Warn().Str("vm_id", op.VMID).Int64("operation_id", op.ID).Msg("VM operation lease lost; result discarded")
+			return false
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("vm_id", op.VMID).Int64("operation_id", op.ID).Msg("Failed to complete VM operation")
+			return false
+		}
+		return true
+	}
+
+	vm, err := m.store.GetVM(ctx, op.VMID)
+	if err != nil {
+		logger.Error().Err(err).Str("vm_id", op.VMID).Msg("Failed to load VM for operation")
+		return
+	}
+	if vm.Status != models.VMStatusProvisioning {
+		// Deleted, or given up on by Reconcile, before the operation ran
+		complete(store.OperationResult{Status: store.OperationCancelled})
+		return
+	}
+	m.setHostname(vm)
+
+	// A machine recorded by an earlier attempt is replaced, not leaked
+	rebuild := op.Kind == store.OperationRebuild || vm.ProviderID != ""
+
+	logger.Info().
+		Str("vm_id", vm.ID).
+		Str("operation", string(op.Kind)).
+		Int("attempt", op.Attempts).
+		Msg("Starting VM provisioning")
+
+	clock := newStageClock(op)
+	var tailscaleIP string
+	if op.Kind == store.OperationJoin {
+		tailscaleIP, err = m.joinTailnet(ctx, vm)
+	} else {
+		tailscaleIP, err = m.provisionVM(ctx, vm, op.RestoreBackupID, rebuild, clock)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down; the operation runs again once its lease runs out
+			return
+		}
+		m.provisionStats.fail(clock.stage())
+
+		if op.Attempts < m.config.ProvisionAttempts {
+			retryAt := time.Now().Add(time.Duration(op.Attempts) * m.config.ProvisionRetryDelay)
+			logger.Warn().Err(err).Str("vm_id", vm.ID).Int("attempt", op.Attempts).Time("retry_at", retryAt).Msg("VM provisioning failed; will retry")
+			complete(store.OperationResult{Status: store.OperationPending, Error: err.Error(), RetryAt: retryAt})
+			return
+		}
+
+		logger.Error().Err(err).Str("vm_id", vm.ID).Int("attempts", op.Attempts).Msg("VM provisioning failed")
+		if complete(store.OperationResult{Status: store.OperationFailed, Error: err.Error(), VMStatus: models.VMStatusError}) {
+			m.notify(ctx, vm, models.NotifyProvisioningFailed, "VM provisioning failed",
+				fmt.Sprintf("VM %s could not be provisioned after %d attempts and is in error. Retry it or create another.", vm.ID, op.Attempts))
+		}
+		return
+	}
+
+	if !complete(store.OperationResult{Status: store.OperationDone, VMStatus: models.VMStatusRunning, TailscaleIP: tailscaleIP}) {
+		return
+	}
+	vm.Status, vm.TailscaleIP = models.VMStatusRunning, tailscaleIP
+
+	// The VM works without its record, so a DNS failure is only logged
+	if m.config.DNS != nil {
+		if err := m.config.DNS.Publish(ctx, vm); err != nil {
+			logger.Warn().Err(err).Str("vm_id", vm.ID).Msg("Failed to publish DNS record")
+		}
+	}
+
+	logger.Info().
+		Str("vm_id", vm.ID).
+		Str("tailscale_ip", vm.TailscaleIP).
+		Msg("VM provisioning completed")
+
+	// The VM is usable once its gateway is, which the operation does not
+	// wait for, so its worker is free for the next one
+	clock.next(models.StageGatewayReady)
+	go m.awaitGateway(ctx, vm, clock)
+}
+
+// pendingOperations returns the IDs of VMs with an operation yet to
+// complete
+func (m *Manager) pendingOperations(ctx context.Context) (map[string]bool, error) {
+	ops, err := m.store.ListPendingVMOperations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list operations: %w", err)
+	}
+	pending := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		pending[op.VMID] = true
+	}
+	return pending, nil
+}
@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/labels"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// DefaultPoolInterval is how often the warm pool is topped up when no VM
+// is claimed from it
+const DefaultPoolInterval = 30 * time.Second
+
+// PoolConfig says how many VMs are kept provisioned ahead of CreateVM and
+// what they run
+type PoolConfig struct {
+	// Size is how many unclaimed VMs are kept running or provisioning; zero
+	// disables the pool
+	Size int
+
+	// Spec is what pool VMs are created with. CreateVM only claims one for
+	// a request whose spec, once the catalog fills in its defaults, is the
+	// same.
+	Spec models.VMSpec
+}
+
+// RunPool keeps the warm pool topped up every interval, and whenever a VM
+// is claimed from it, until ctx is done. Pool VMs are ordinary VMs owned by
+// models.PoolUserID: they are provisioned through the outbox like any
+// other, and join the tailnet under their own ID, which no user is tied
+// to, so a claimed VM only needs its record handed over. Pool VMs that
+// fail, or were created with an earlier pool.spec, are deleted.
+func (m *Manager) RunPool(ctx context.Context, interval time.Duration) {
+	size := m.config.Pool.Size
+	if size <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultPoolInterval
+	}
+
+	spec := m.config.Pool.Spec
+	if m.config.Catalog != nil {
+		if err := m.config.Catalog.Validate(ctx, &spec); err != nil {
+			requestid.Logger(ctx).Error().Err(err).Msg("Warm pool spec is not in the catalog, pool disabled")
+			return
+		}
+	}
+	m.poolMu.Lock()
+	m.poolSpec = &spec
+	m.poolMu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.fillPool(ctx, spec, size); err != nil && ctx.Err() == nil {
+			requestid.Logger(ctx).Error().Err(err).Msg("Failed to fill the warm pool")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.poolWake:
+		}
+	}
+}
+
+// wakePool has RunPool top up the pool now
+func (m *Manager) wakePool() {
+	select {
+	case m.poolWake <- struct{}{}:
+	default:
+	}
+}
+
+// fillPool deletes the pool VMs that cannot be claimed and creates VMs
+// until size of them are running or provisioning
+func (m *Manager) fillPool(ctx context.Context, spec models.VMSpec, size int) error {
+	logger := requestid.Logger(ctx)
+
+	vms, err := m.store.ListVMsByUser(ctx, models.PoolUserID)
+	if err != nil {
+		return fmt.Errorf("list pool vms: %w", err)
+	}
+
+	live := 0
+	for _, vm := range vms {
+		switch {
+		case vm.Status == models.VMStatusError,
+			vm.Status == models.VMStatusRunning && vm.Spec != spec:
+			if err := m.DeleteVM(ctx, vm.ID); err != nil {
+				logger.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to delete pool VM")
+				continue
+			}
+			m.countPool(func(t *models.PoolTotals) { t.Deleted++ })
+			logger.Info().Str("vm_id", vm.ID).Str("status", string(vm.Status)).Msg("Pool VM deleted")
+		case vm.Spec != spec:
+			// Still provisioning with an earlier spec; deleted once running
+		case vm.Status == models.VMStatusRunning, vm.Status == models.VMStatusProvisioning:
+			live++
+		}
+	}
+
+	for ; live < size; live++ {
+		vm, err := m.createVM(ctx, models.PoolUserID, spec, nil, 0)
+		if err != nil {
+			return fmt.Errorf("create pool vm: %w", err)
+		}
+		m.countPool(func(t *models.PoolTotals) { t.Created++ })
+		logger.Info().Str("vm_id", vm.ID).Msg("Pool VM created")
+	}
+	return nil
+}
+
+// claimPoolVM hands the oldest running pool VM with the requested spec to
+// the requesting user, or returns nil when there is none. Requests racing
+// for the same VM each move on to the next one.
+func (m *Manager) claimPoolVM(ctx context.Context, req *models.CreateVMRequest) *models.VM {
+	m.poolMu.Lock()
+	spec := m.poolSpec
+	m.poolMu.Unlock()
+	if spec == nil || *spec != req.Spec {
+		return nil
+	}
+	logger := requestid.Logger(ctx)
+
+	// A VM can be provisioned from scratch instead, so the pool is never
+	// why CreateVM fails
+	running, err := m.store.ListVMsByStatus(ctx, models.VMStatusRunning)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list pool VMs")
+		return nil
+	}
+
+	for i := len(running) - 1; i >= 0; i-- {
+		vm := running[i]
+		if vm.UserID != models.PoolUserID || vm.Spec != *spec || vm.Provider != m.provider.Name() {
+			continue
+		}
+
+		err := m.store.ClaimPoolVM(ctx, vm.ID, req.UserID, req.Labels)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to claim pool VM")
+			return nil
+		}
+
+		vm.UserID = req.UserID
+		vm.Labels = labels.Copy(req.Labels)
+		vm.LastActivity = time.Now()
+		vm.UpdatedAt = vm.LastActivity
+		m.setHostname(vm)
+
+		m.countPool(func(t *models.PoolTotals) { t.Claimed++ })
+		m.wakePool()
+		logger.Info().Str("vm_id", vm.ID).Str("user_id", req.UserID).Msg("Pool VM claimed")
+		return vm
+	}
+
+	m.countPool(func(t *models.PoolTotals) { t.Missed++ })
+	m.wakePool()
+	return nil
+}
+
+// PoolReport counts the warm pool's VMs and what the pool has done
+func (m *Manager) PoolReport(ctx context.Context) (*models.PoolReport, error) {
+	m.poolMu.Lock()
+	report := &models.PoolReport{Totals: m.poolTotals}
+	spec := m.poolSpec
+	m.poolMu.Unlock()
+	if spec == nil {
+		return report, nil
+	}
+	report.Size = m.config.Pool.Size
+	report.Spec = *spec
+
+	vms, err := m.store.ListVMsByUser(ctx, models.PoolUserID)
+	if err != nil {
+		return nil, fmt.Errorf("list pool vms: %w", err)
+	}
+	for _, vm := range vms {
+		if vm.Spec != *spec {
+			continue
+		}
+		switch vm.Status {
+		case models.VMStatusRunning:
+			report.Ready++
+		case models.VMStatusProvisioning:
+			report.Provisioning++
+		}
+	}
+	return report, nil
+}
+
+func (m *Manager) countPool(fn func(*models.PoolTotals)) {
+	m.poolMu.Lock()
+	fn(&m.poolTotals)
+	m.poolMu.Unlock()
+}
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// RebuildVM replaces a VM's machine with a freshly provisioned one, for when
+// its environment is broken beyond repair. The VM keeps its ID, so its
+// connect tokens, Tailscale hostname and DNS name carry over; providers that
+// implement provider.Rebuilder keep its workspace too. A backup can be
+// restored into the new machine's empty workspace. The VM is provisioning
+// until the new machine joins the tailnet.
+func (m *Manager) RebuildVM(ctx context.Context, vm *models.VM, req *models.RebuildVMRequest) (*models.VM, error) {
+	switch vm.Status {
+	case models.VMStatusProvisioning, models.VMStatusTerminating:
+		return nil, ErrNotRebuildable
+	}
+	if req.RestoreBackupID != 0 {
+		if _, err := m.restorableBackup(ctx, vm.UserID, req.RestoreBackupID); err != nil {
+			return nil, err
+		}
+	}
+
+	op := &store.Operation{
+		Kind:            store.OperationRebuild,
+		RestoreBackupID: req.RestoreBackupID,
+		RequestID:       requestid.FromContext(ctx),
+	}
+	if err := m.store.StartVMOperation(ctx, vm.ID, models.VMStatusProvisioning, op); err != nil {
+		return nil, fmt.Errorf("update status: %w", err)
+	}
+	vm.Status = models.VMStatusProvisioning
+
+	requestid.Logger(ctx).Info().
+		Str("vm_id", vm.ID).
+		Int64("restore_backup_id", req.RestoreBackupID).
+		Msg("VM rebuild requested")
+
+	m.wakeOutbox()
+
+	return vm, nil
+}
+
+// replaceMachine stands in for the provider's CreateVM when a VM is rebuilt.
+// The old machine's tailnet device goes first, so the new machine joins
+// under the same hostname and WaitForDevice cannot find the old one.
+func (m *Manager) replaceMachine(ctx context.Context, vm *models.VM, cloudInit string) error {
+	if vm.Provider != m.provider.Name() {
+		return &ProviderError{Provider: vm.Provider, Err: fmt.Errorf("provider is not configured on this control plane (using %s)", m.provider.Name())}
+	}
+
+	if err := m.tailscaleClient.DeleteDevice(ctx, fmt.Sprintf("devtail-%s", vm.ID)); err != nil {
+		return fmt.Errorf("remove tailnet device: %w", err)
+	}
+
+	if rebuilder, ok := m.provider.(provider.Rebuilder); ok {
+		return rebuilder.RebuildVM(ctx, vm, cloudInit)
+	}
+
+	if vm.ProviderID != "" {
+		if err := m.provider.DeleteVM(ctx, vm); err != nil {
+			return fmt.Errorf("delete old machine: %w", err)
+		}
+	}
+	vm.ProviderID, vm.PublicIP = "", ""
+	return m.provider.CreateVM(ctx, vm, cloudInit)
+}
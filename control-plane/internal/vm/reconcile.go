@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+// RetryJob runs a VM's failed job again: a VM in error is provisioned anew,
+// replacing whatever machine it has, and a terminating VM's machine is
+// deleted now rather than after its grace period. A deletion waiting for its
+// final backup asks the gateway for it and returns; the sweep deletes the
+// machine once it completes.
+func (m *Manager) RetryJob(ctx context.Context, vm *models.VM) (*models.RetryJobResponse, error) {
+	switch vm.Status {
+	case models.VMStatusError:
+		vm, err := m.RebuildVM(ctx, vm, &models.RebuildVMRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return &models.RetryJobResponse{Job: models.JobProvision, VM: vm}, nil
+
+	case models.VMStatusTerminating:
+		if _, err := m.completeDeletion(ctx, vm); err != nil {
+			return nil, err
+		}
+		vm, err := m.GetVM(ctx, vm.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &models.RetryJobResponse{Job: models.JobDeletion, VM: vm}, nil
+	}
+
+	return nil, ErrNoFailedJob
+}
+
+// Reconcile brings VM records back in line with the jobs that should be
+// running for them, for after an outage or a restart lost some: VMs left
+// provisioning without a provisioning operation are put in error, so they
+// can be retried; due deletions are carried out; and running VMs' DNS
+// records are published again. Failures for one VM are reported and do not
+// stop the others.
+func (m *Manager) Reconcile(ctx context.Context) (*models.ReconcileReport, error) {
+	report := &models.ReconcileReport{
+		StuckProvisioning: []string{},
+		Deleted:           []string{},
+	}
+	fail := func(vmID, step string, err error) {
+		report.Errors = append(report.Errors, models.ReconcileError{VMID: vmID, Step: step, Error: err.Error()})
+	}
+
+	// Provisioning gives up after ProvisionTimeout, so a VM that has made
+	// no progress for longer, and has no operation left to run, has nothing
+	// working on it
+	provisioning, err := m.store.ListVMsByStatus(ctx, models.VMStatusProvisioning)
+	if err != nil {
+		return nil, fmt.Errorf("list vms: %w", err)
+	}
+	pending, err := m.pendingOperations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stuckBefore := time.Now().Add(-m.config.ProvisionTimeout)
+	for _, vm := range provisioning {
+		if vm.UpdatedAt.After(stuckBefore) || pending[vm.ID] {
+			continue
+		}
+		if err := m.updateVMStatus(ctx, vm.ID, models.VMStatusError); err != nil {
+			fail(vm.ID, "provision", err)
+			continue
+		}
+		report.StuckProvisioning = append(report.StuckProvisioning, vm.ID)
+	}
+
+	terminating, err := m.store.ListVMsByStatus(ctx, models.VMStatusTerminating)
+	if err != nil {
+		return nil, fmt.Errorf("list vms: %w", err)
+	}
+	now := time.Now()
+	for _, vm := range terminating {
+		if vm.DeleteAt != nil && now.Before(*vm.DeleteAt) {
+			continue
+		}
+		deleted, err := m.completeDeletion(ctx, vm)
+		if err != nil {
+			fail(vm.ID, "deletion", err)
+			continue
+		}
+		if deleted {
+			report.Deleted = append(report.Deleted, vm.ID)
+		}
+	}
+
+	if m.config.DNS != nil {
+		running, err := m.store.ListVMsByStatus(ctx, models.VMStatusRunning)
+		if err != nil {
+			return nil, fmt.Errorf("list vms: %w", err)
+		}
+		for _, vm := range running {
+			if err := m.config.DNS.Publish(ctx, vm); err != nil {
+				fail(vm.ID, "dns", err)
+				continue
+			}
+			report.DNSPublished++
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+)
+
+const (
+	// DefaultArchiveAfter keeps a terminated VM's logs and revocations for a
+	// month, for support questions about it
+	DefaultArchiveAfter = 30 * 24 * time.Hour
+
+	// DefaultPurgeAfter keeps the archived record of a VM for a year
+	DefaultPurgeAfter = 365 * 24 * time.Hour
+
+	// DefaultRetentionInterval is how often retention is applied
+	DefaultRetentionInterval = time.Hour
+)
+
+// RetentionPolicy says how long the records of terminated VMs are kept.
+// Both periods count from termination.
+type RetentionPolicy struct {
+	// ArchiveAfter is when a VM's record moves to the archive, and its
+	// logs, token revocations and activity are dropped; zero leaves them
+	// until the record is purged
+	ArchiveAfter time.Duration
+
+	// PurgeAfter is when a VM's record is deleted for good; zero keeps
+	// archived records forever
+	PurgeAfter time.Duration
+}
+
+// RunRetention archives and purges the records of terminated VMs according
+// to the retention policy, every interval until ctx is done
+func (m *Manager) RunRetention(ctx context.Context, interval time.Duration) {
+	policy := m.config.Retention
+	if policy.ArchiveAfter <= 0 && policy.PurgeAfter <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.applyRetention(ctx); err != nil && ctx.Err() == nil {
+			requestid.Logger(ctx).Error().Err(err).Msg("Failed to apply VM retention")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyRetention archives and purges the records that are due
+func (m *Manager) applyRetention(ctx context.Context) error {
+	logger := requestid.Logger(ctx)
+	policy := m.config.Retention
+	now := time.Now()
+
+	archive := func(after time.Duration) error {
+		archived, err := m.store.ArchiveVMs(ctx, now.Add(-after), now)
+		if err != nil {
+			return fmt.Errorf("archive vms: %w", err)
+		}
+		if archived > 0 {
+			logger.Info().Int64("vms", archived).Msg("Archived terminated VMs")
+		}
+		return nil
+	}
+
+	if policy.ArchiveAfter > 0 {
+		if err := archive(policy.ArchiveAfter); err != nil {
+			return err
+		}
+	}
+
+	if policy.PurgeAfter > 0 {
+		// Records due for purging go through the archive, which drops
+		// their logs and revocations, even if they were never archived
+		if policy.ArchiveAfter <= 0 || policy.ArchiveAfter > policy.PurgeAfter {
+			if err := archive(policy.PurgeAfter); err != nil {
+				return err
+			}
+		}
+
+		purged, err := m.store.PurgeArchivedVMs(ctx, now.Add(-policy.PurgeAfter))
+		if err != nil {
+			return fmt.Errorf("purge vms: %w", err)
+		}
+		if purged > 0 {
+			logger.Info().Int64("vms", purged).Msg("Purged archived VMs")
+		}
+	}
+
+	return nil
+}
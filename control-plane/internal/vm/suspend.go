@@ -0,0 +1,378 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devtail/control-plane/internal/provider"
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/pkg/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultSuspendWarning is how long clients are warned before their VM
+	// is suspended
+	DefaultSuspendWarning = 5 * time.Minute
+
+	// DefaultSuspendInterval is how often idle VMs and due suspensions are
+	// looked for
+	DefaultSuspendInterval = time.Minute
+
+	// DefaultResumeHint is what clients are told when their VM is suspended;
+	// {id} is replaced with the VM's ID
+	DefaultResumeHint = "Resume the VM to reconnect: POST /api/v1/vms/{id}/resume"
+)
+
+// SuspendConfig says when idle VMs are suspended and what their clients are
+// told
+type SuspendConfig struct {
+	// IdleAfter is how long a running VM may go without activity before it
+	// is suspended; zero leaves idle VMs running
+	IdleAfter time.Duration
+
+	// Warning is how long clients are warned first, and have to keep the VM
+	// running; zero means DefaultSuspendWarning
+	Warning time.Duration
+
+	// ResumeHint is sent to clients with the suspension; empty means
+	// DefaultResumeHint
+	ResumeHint string
+}
+
+// pendingSuspension is a suspension whose clients have been warned
+type pendingSuspension struct {
+	id          string
+	reason      models.SuspendReason
+	scheduledAt time.Time
+	suspendAt   time.Time
+	resumeHint  string
+	running     bool // being carried out
+}
+
+// SuspendVM suspends a running VM for an operator, after warning its clients
+// for req.WarningSeconds, or suspend.warning without it
+func (m *Manager) SuspendVM(ctx context.Context, vm *models.VM, req *models.SuspendVMRequest) (*models.SuspendVMResponse, error) {
+	warning := m.config.Suspend.Warning
+	if req.WarningSeconds != nil {
+		warning = time.Duration(*req.WarningSeconds) * time.Second
+	}
+	return m.scheduleSuspension(ctx, vm, models.SuspendOperator, warning)
+}
+
+// scheduleSuspension warns the VM's clients that it will be suspended after
+// warning, and suspends it then unless one of them keeps it running. With no
+// warning the VM is suspended now.
+func (m *Manager) scheduleSuspension(ctx context.Context, vm *models.VM, reason models.SuspendReason, warning time.Duration) (*models.SuspendVMResponse, error) {
+	if vm.Status != models.VMStatusRunning {
+		return nil, ErrNotSuspendable
+	}
+	if _, err := m.suspender(vm); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := &pendingSuspension{
+		id:          uuid.New().String(),
+		reason:      reason,
+		scheduledAt: now,
+		suspendAt:   now.Add(warning),
+		resumeHint:  strings.ReplaceAll(m.config.Suspend.ResumeHint, "{id}", vm.ID),
+	}
+
+	m.suspendMu.Lock()
+	if _, ok := m.suspensions[vm.ID]; ok {
+		m.suspendMu.Unlock()
+		return nil, ErrSuspendScheduled
+	}
+	m.suspensions[vm.ID] = p
+	m.suspendMu.Unlock()
+
+	resp := &models.SuspendVMResponse{
+		VMID:      vm.ID,
+		SuspendID: p.id,
+		Reason:    reason,
+		SuspendAt: p.suspendAt,
+	}
+
+	// Clients are warned even when there is no time to keep the VM running,
+	// so they learn how to resume it
+	sessions, err := m.notifySuspension(ctx, vm, p, models.SuspendSchedule)
+	if err != nil {
+		// The VM is suspended all the same; its clients learn why when they
+		// reconnect
+		requestid.Logger(ctx).Warn().Err(err).Str("vm_id", vm.ID).Msg("Failed to warn gateway of suspension")
+	}
+	resp.Sessions = sessions
+
+	requestid.Logger(ctx).Info().
+		Str("vm_id", vm.ID).
+		Str("suspend_id", p.id).
+		Str("reason", string(reason)).
+		Time("suspend_at", p.suspendAt).
+		Int("sessions", sessions).
+		Msg("VM suspension scheduled")
+
+	if warning <= 0 {
+		done, err := m.completeSuspension(ctx, vm, p)
+		if err != nil {
+			return nil, err
+		}
+		resp.Suspended = done
+	}
+	return resp, nil
+}
+
+// ResumeVM starts a suspended VM's machine again. The VM counts as active
+// from now, so it is not suspended again until it has been idle for
+// suspend.idle_after.
+func (m *Manager) ResumeVM(ctx context.Context, vm *models.VM) (*models.VM, error) {
+	if vm.Status != models.VMStatusSuspended {
+		return nil, ErrNotSuspended
+	}
+	suspender, err := m.suspender(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := suspender.ResumeVM(ctx, vm); err != nil {
+		return nil, &ProviderError{Provider: vm.Provider, Err: err}
+	}
+	if err := m.updateVMStatus(ctx, vm.ID, models.VMStatusRunning); err != nil {
+		return nil, fmt.Errorf("update status: %w", err)
+	}
+	vm.Status = models.VMStatusRunning
+
+	m.suspendMu.Lock()
+	m.idleFrom[vm.ID] = time.Now()
+	m.suspendMu.Unlock()
+
+	requestid.Logger(ctx).Info().Str("vm_id", vm.ID).Msg("VM resumed")
+	return vm, nil
+}
+
+// RunSuspender carries out due suspensions and schedules suspensions of
+// idle VMs every interval until ctx is done
+func (m *Manager) RunSuspender(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSuspendInterval
+	}
+
+	idleAfter := m.config.Suspend.IdleAfter
+	if idleAfter > 0 {
+		switch {
+		case !m.canSuspend():
+			requestid.Logger(ctx).Warn().Str("provider", m.provider.Name()).Msg("Provider cannot suspend VMs, idle VMs are left running")
+			idleAfter = 0
+		case m.config.ActivityURL == "":
+			requestid.Logger(ctx).Warn().Msg("Activity reporting is off, idle VMs are left running")
+			idleAfter = 0
+		}
+	}
+
+	// Activity reported while the control plane was down is not lost, but
+	// a suspension it had scheduled is; nothing counts as idle for longer
+	// than the control plane has been watching
+	started := time.Now()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.completeDueSuspensions(ctx)
+		if idleAfter > 0 {
+			if err := m.suspendIdleVMs(ctx, idleAfter, started); err != nil && ctx.Err() == nil {
+				requestid.Logger(ctx).Error().Err(err).Msg("Failed to look for idle VMs")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// suspendIdleVMs schedules the suspension of every running VM that has had
+// no activity for idleAfter
+func (m *Manager) suspendIdleVMs(ctx context.Context, idleAfter time.Duration, started time.Time) error {
+	running, err := m.store.ListVMsByStatus(ctx, models.VMStatusRunning)
+	if err != nil {
+		return fmt.Errorf("list vms: %w", err)
+	}
+
+	cutoff := time.Now().Add(-idleAfter)
+	for _, vm := range running {
+		m.suspendMu.Lock()
+		_, pending := m.suspensions[vm.ID]
+		from := m.idleFrom[vm.ID]
+		m.suspendMu.Unlock()
+
+		// Pool VMs are idle until claimed, and must stay ready to be
+		if pending || vm.UserID == models.PoolUserID || !idleSince(vm, cutoff) || from.After(cutoff) || started.After(cutoff) {
+			continue
+		}
+
+		_, err := m.scheduleSuspension(ctx, vm, models.SuspendIdle, m.config.Suspend.Warning)
+		if err != nil && !errors.Is(err, ErrSuspendScheduled) {
+			requestid.Logger(ctx).Error().Err(err).Str("vm_id", vm.ID).Msg("Failed to schedule suspension")
+		}
+	}
+	return nil
+}
+
+// completeDueSuspensions carries out every suspension whose warning is over
+func (m *Manager) completeDueSuspensions(ctx context.Context) {
+	now := time.Now()
+	due := make(map[string]*pendingSuspension)
+	m.suspendMu.Lock()
+	for vmID, p := range m.suspensions {
+		if !p.running && !p.suspendAt.After(now) {
+			due[vmID] = p
+		}
+	}
+	m.suspendMu.Unlock()
+
+	for vmID, p := range due {
+		vm, err := m.store.GetVM(ctx, vmID)
+		if err == nil {
+			_, err = m.completeSuspension(ctx, vm, p)
+		} else {
+			m.dropSuspension(vmID, p, false)
+		}
+		if err != nil && ctx.Err() == nil {
+			requestid.Logger(ctx).Error().Err(err).Str("vm_id", vmID).Msg("Failed to suspend VM")
+		}
+	}
+}
+
+// completeSuspension suspends the VM, unless it was active during the
+// warning or one of its clients kept it running. It reports whether the VM
+// was suspended. Either way the suspension is over; an idle VM that could
+// not be suspended is tried again once it has been idle for
+// suspend.idle_after.
+func (m *Manager) completeSuspension(ctx context.Context, vm *models.VM, p *pendingSuspension) (bool, error) {
+	m.suspendMu.Lock()
+	if m.suspensions[vm.ID] != p || p.running {
+		m.suspendMu.Unlock()
+		return false, nil
+	}
+	p.running = true
+	m.suspendMu.Unlock()
+
+	if vm.Status != models.VMStatusRunning {
+		m.dropSuspension(vm.ID, p, false)
+		return false, nil
+	}
+
+	logger := requestid.Logger(ctx).With().Str("vm_id", vm.ID).Str("suspend_id", p.id).Logger()
+
+	// Activity the gateway reported, such as a build, counts as much as a
+	// keep_alive. Operators' suspensions go ahead regardless.
+	if p.reason == models.SuspendIdle && !idleSince(vm, p.scheduledAt) {
+		m.dropSuspension(vm.ID, p, true)
+		if _, err := m.notifySuspension(ctx, vm, p, models.SuspendCancel); err != nil {
+			logger.Warn().Err(err).Msg("Failed to tell gateway the suspension is off")
+		}
+		logger.Info().Time("last_activity", vm.LastActivity).Msg("VM suspension cancelled, VM was active")
+		return false, nil
+	}
+
+	// The gateway ends every session, or answers 409 if a client called the
+	// suspension off. A gateway that cannot be reached has no clients to
+	// lose work.
+	sessions, err := m.notifySuspension(ctx, vm, p, models.SuspendNow)
+	var gerr *gatewayError
+	switch {
+	case errors.As(err, &gerr) && gerr.StatusCode == http.StatusConflict:
+		m.dropSuspension(vm.ID, p, true)
+		logger.Info().Msg("VM suspension cancelled, kept alive by a client")
+		return false, nil
+	case err != nil:
+		logger.Warn().Err(err).Msg("Failed to end gateway sessions, suspending anyway")
+	}
+
+	suspender, err := m.suspender(vm)
+	if err == nil {
+		err = suspender.SuspendVM(ctx, vm)
+		if err != nil {
+			err = &ProviderError{Provider: vm.Provider, Err: err}
+		}
+	}
+	if err == nil {
+		err = m.updateVMStatus(ctx, vm.ID, models.VMStatusSuspended)
+	}
+	m.dropSuspension(vm.ID, p, err != nil)
+	if err != nil {
+		return false, err
+	}
+	vm.Status = models.VMStatusSuspended
+
+	logger.Info().Str("reason", string(p.reason)).Int("sessions", sessions).Msg("VM suspended")
+	return true, nil
+}
+
+// dropSuspension forgets a suspension that is over. If the VM stays running,
+// keep restarts its idle time, so it is not warned again straight away.
+func (m *Manager) dropSuspension(vmID string, p *pendingSuspension, keep bool) {
+	m.suspendMu.Lock()
+	defer m.suspendMu.Unlock()
+
+	if m.suspensions[vmID] == p {
+		delete(m.suspensions, vmID)
+	}
+	if keep {
+		m.idleFrom[vmID] = time.Now()
+	}
+}
+
+// notifySuspension sends a step of the suspension to the VM's gateway and
+// returns how many sessions it reached
+func (m *Manager) notifySuspension(ctx context.Context, vm *models.VM, p *pendingSuspension, action models.SuspendAction) (int, error) {
+	if vm.TailscaleIP == "" {
+		return 0, fmt.Errorf("vm has not joined the tailnet")
+	}
+
+	notice, err := m.config.TokenSigner.SignSuspendNotice(vm.ID, models.SuspendNotice{
+		ID:         p.id,
+		Action:     action,
+		Reason:     p.reason,
+		SuspendAt:  p.suspendAt,
+		ResumeHint: p.resumeHint,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Sessions int `json:"sessions"`
+	}
+	if err := m.postGateway(ctx, vm, "/suspend", map[string]string{"notice": notice}, &result); err != nil {
+		return 0, err
+	}
+	return result.Sessions, nil
+}
+
+// canSuspend reports whether the configured provider can suspend VMs
+func (m *Manager) canSuspend() bool {
+	_, ok := m.provider.(provider.Suspender)
+	return ok
+}
+
+// suspender returns the provider of the VM if it can suspend VMs
+func (m *Manager) suspender(vm *models.VM) (provider.Suspender, error) {
+	if vm.Provider != m.provider.Name() {
+		return nil, &ProviderError{Provider: vm.Provider, Err: fmt.Errorf("provider is not configured on this control plane (using %s)", m.provider.Name())}
+	}
+
+	suspender, ok := m.provider.(provider.Suspender)
+	if !ok {
+		return nil, ErrSuspendUnsupported
+	}
+	return suspender, nil
+}
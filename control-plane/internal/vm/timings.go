@@ -0,0 +1,228 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// DefaultProvisionSLO is how long provisioning a VM may take, from its
+	// operation being recorded to its gateway accepting sessions
+	DefaultProvisionSLO = 3 * time.Minute
+
+	// provisionWindow is how many of each stage's latest durations the
+	// percentiles are taken over
+	provisionWindow = 500
+
+	// gatewayReadyTimeout bounds the wait for a new VM's gateway once the
+	// VM has joined the tailnet, and gatewayReadyPoll spaces the probes
+	gatewayReadyTimeout = 5 * time.Minute
+	gatewayReadyPoll    = 2 * time.Second
+)
+
+// stageClock times the stages of one provisioning attempt. Each stage ends
+// when the next starts; the stage under way when an attempt fails is the
+// one it failed at.
+type stageClock struct {
+	mu       sync.Mutex
+	recorded time.Time // when the operation was recorded
+	last     time.Time
+	current  models.ProvisionStage
+	stages   map[models.ProvisionStage]time.Duration
+}
+
+// newStageClock starts timing an attempt at op, which has been waiting for
+// a worker since it was due
+func newStageClock(op *store.Operation) *stageClock {
+	now := time.Now()
+	c := &stageClock{
+		recorded: op.CreatedAt,
+		last:     now,
+		current:  models.StageMachineCreate,
+		stages:   make(map[models.ProvisionStage]time.Duration),
+	}
+	if op.Kind == store.OperationJoin {
+		c.current = models.StageTailnetJoin
+	}
+
+	due := op.RunAfter
+	if due.IsZero() || due.Before(op.CreatedAt) {
+		due = op.CreatedAt
+	}
+	if queued := now.Sub(due); queued > 0 {
+		c.stages[models.StageQueued] = queued
+	}
+	return c
+}
+
+// next ends the stage under way and starts the given one
+func (c *stageClock) next(stage models.ProvisionStage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.stages[c.current] = now.Sub(c.last)
+	c.last, c.current = now, stage
+}
+
+// stage returns the stage under way
+func (c *stageClock) stage() models.ProvisionStage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// finish ends the last stage and returns every stage's duration, with the
+// total since the operation was recorded
+func (c *stageClock) finish() map[models.ProvisionStage]time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	stages := make(map[models.ProvisionStage]time.Duration, len(c.stages)+2)
+	for stage, d := range c.stages {
+		stages[stage] = d
+	}
+	stages[c.current] = now.Sub(c.last)
+	stages[models.StageTotal] = now.Sub(c.recorded)
+	return stages
+}
+
+// provisionStats keeps the latest durations of each provisioning stage and
+// counts outcomes since the control plane started
+type provisionStats struct {
+	mu        sync.Mutex
+	durations map[models.ProvisionStage][]time.Duration
+	failed    map[models.ProvisionStage]int64
+	totals    models.ProvisioningTotals
+}
+
+func newProvisionStats() *provisionStats {
+	return &provisionStats{
+		durations: make(map[models.ProvisionStage][]time.Duration),
+		failed:    make(map[models.ProvisionStage]int64),
+	}
+}
+
+// complete records the stages of a provisioning that ended with the
+// gateway ready
+func (s *provisionStats) complete(stages map[models.ProvisionStage]time.Duration, slo time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stage, d := range stages {
+		latest := append(s.durations[stage], d)
+		if len(latest) > provisionWindow {
+			latest = latest[len(latest)-provisionWindow:]
+		}
+		s.durations[stage] = latest
+	}
+	s.totals.Completed++
+	if stages[models.StageTotal] > slo {
+		s.totals.OverSLO++
+	}
+}
+
+// fail counts an attempt that failed at stage
+func (s *provisionStats) fail(stage models.ProvisionStage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed[stage]++
+	s.totals.Failed++
+}
+
+// report summarises every stage, including those with no durations yet
+func (s *provisionStats) report(slo time.Duration) *models.ProvisioningStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &models.ProvisioningStats{
+		SLOSeconds: slo.Seconds(),
+		Window:     provisionWindow,
+		Stages:     make(map[models.ProvisionStage]models.StageStats, len(models.ProvisionStages)),
+		Totals:     s.totals,
+	}
+	for _, stage := range models.ProvisionStages {
+		sorted := append([]time.Duration(nil), s.durations[stage]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats := models.StageStats{Count: len(sorted), Failed: s.failed[stage]}
+		if len(sorted) > 0 {
+			stats.P50Seconds = percentile(sorted, 50).Seconds()
+			stats.P95Seconds = percentile(sorted, 95).Seconds()
+			stats.MaxSeconds = sorted[len(sorted)-1].Seconds()
+		}
+		report.Stages[stage] = stats
+	}
+	return report
+}
+
+// percentile returns the nearest-rank pth percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ProvisioningStats summarises how long each stage of provisioning took in
+// the latest provisionings, and counts outcomes against the SLO
+func (m *Manager) ProvisioningStats() *models.ProvisioningStats {
+	return m.provisionStats.report(m.config.ProvisionSLO)
+}
+
+// awaitGateway waits for a VM that joined the tailnet to have a gateway
+// accepting sessions, and records how long the attempt's stages took
+func (m *Manager) awaitGateway(ctx context.Context, vm *models.VM, clock *stageClock) {
+	logger := requestid.Logger(ctx)
+	ctx, cancel := context.WithTimeout(ctx, gatewayReadyTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(gatewayReadyPoll)
+	defer ticker.Stop()
+
+	for {
+		probe, cancelProbe := context.WithTimeout(ctx, gatewayProbeTimeout)
+		status, err := m.getGateway(probe, vm, "/readyz", &struct{}{})
+		cancelProbe()
+		if err == nil && status == http.StatusOK {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				m.provisionStats.fail(models.StageGatewayReady)
+				logger.Warn().Str("vm_id", vm.ID).Dur("timeout", gatewayReadyTimeout).Msg("VM gateway never became ready")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+
+	stages := clock.finish()
+	m.provisionStats.complete(stages, m.config.ProvisionSLO)
+
+	event := logger.Info().Str("vm_id", vm.ID)
+	for _, stage := range models.ProvisionStages {
+		if d, ok := stages[stage]; ok {
+			event = event.Dur(string(stage), d)
+		}
+	}
+	event.Bool("over_slo", stages[models.StageTotal] > m.config.ProvisionSLO).Msg("VM gateway ready")
+
+	// Nobody is waiting for a pool VM
+	if vm.UserID != models.PoolUserID {
+		m.notify(ctx, vm, models.NotifyVMReady, "Your VM is ready", fmt.Sprintf("VM %s is running and accepts sessions.", vm.ID))
+	}
+}
@@ -0,0 +1,232 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devtail/control-plane/internal/requestid"
+	"github.com/devtail/control-plane/internal/store"
+	"github.com/devtail/control-plane/pkg/models"
+)
+
+const (
+	// DefaultStuckAfter is longer than every attempt the outbox makes at a
+	// provisioning operation, with the default provision settings
+	DefaultStuckAfter = time.Hour
+
+	// DefaultWatchdogInterval is how often the watchdog looks for stuck VMs
+	DefaultWatchdogInterval = time.Minute
+)
+
+// WatchdogConfig says when a VM counts as stuck provisioning and how hard
+// the watchdog tries to unstick it
+type WatchdogConfig struct {
+	// StuckAfter is how long a VM may be provisioning since its latest
+	// operation was recorded; zero means DefaultStuckAfter. It should be
+	// longer than the provision lease, so no attempt is still running when
+	// the watchdog steps in.
+	StuckAfter time.Duration
+
+	// Retries is how many times the stuck stage is started again before the
+	// VM is rolled back to error; zero rolls it back at once
+	Retries int
+}
+
+// RunWatchdog looks for VMs stuck provisioning every interval until ctx is
+// done, see CheckStuckVMs
+func (m *Manager) RunWatchdog(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultWatchdogInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := m.CheckStuckVMs(ctx); err != nil && ctx.Err() == nil {
+			requestid.Logger(ctx).Error().Err(err).Msg("Failed to check for stuck VMs")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckStuckVMs finds VMs that have been provisioning for longer than
+// StuckAfter. A stuck VM has the stage it stopped at started again, up to
+// Retries times: a machine that never joined the tailnet is waited for
+// once more, and otherwise the VM is provisioned anew. After that it is
+// rolled back: put in error, with its machine and tailnet device deleted.
+func (m *Manager) CheckStuckVMs(ctx context.Context) (*models.WatchdogReport, error) {
+	provisioning, err := m.store.ListVMsByStatus(ctx, models.VMStatusProvisioning)
+	if err != nil {
+		return nil, fmt.Errorf("list vms: %w", err)
+	}
+
+	cfg := m.config.Watchdog
+	now := time.Now()
+	stuck := []models.StuckVM{}
+	for _, vm := range provisioning {
+		ops, err := m.store.ListVMOperations(ctx, vm.ID, cfg.Retries+1)
+		if err != nil {
+			return nil, fmt.Errorf("list operations: %w", err)
+		}
+
+		since := vm.UpdatedAt
+		if len(ops) > 0 {
+			since = ops[0].CreatedAt
+		}
+		if now.Sub(since) < cfg.StuckAfter {
+			continue
+		}
+
+		found := models.StuckVM{
+			VMID:    vm.ID,
+			UserID:  vm.UserID,
+			Stage:   stuckStage(vm, ops),
+			Since:   since,
+			Retries: watchdogRetries(ops),
+		}
+		if found.Retries < cfg.Retries {
+			found.Action = models.WatchdogRetried
+			err = m.retryStuckVM(ctx, vm, found.Stage, ops)
+		} else {
+			found.Action = models.WatchdogRolledBack
+			err = m.rollBackStuckVM(ctx, vm)
+		}
+		if errors.Is(err, store.ErrNotFound) {
+			// No longer provisioning, so no longer stuck
+			continue
+		}
+
+		event := requestid.Logger(ctx).Warn()
+		if err != nil {
+			found.Error = err.Error()
+			event = requestid.Logger(ctx).Error().Err(err)
+		}
+		event.
+			Str("vm_id", vm.ID).
+			Str("stage", string(found.Stage)).
+			Time("since", since).
+			Str("action", string(found.Action)).
+			Msg("VM stuck provisioning")
+
+		stuck = append(stuck, found)
+	}
+
+	m.watchdogMu.Lock()
+	defer m.watchdogMu.Unlock()
+
+	report := &m.watchdogReport
+	report.CheckedAt = &now
+	report.Stuck = stuck
+	for _, found := range stuck {
+		report.Totals.Stuck++
+		switch {
+		case found.Error != "":
+			report.Totals.Failed++
+		case found.Action == models.WatchdogRetried:
+			report.Totals.Retried++
+		case found.Action == models.WatchdogRolledBack:
+			report.Totals.RolledBack++
+		}
+	}
+	return m.copyWatchdogReport(), nil
+}
+
+// WatchdogReport returns what the watchdog found at its last check
+func (m *Manager) WatchdogReport() *models.WatchdogReport {
+	m.watchdogMu.Lock()
+	defer m.watchdogMu.Unlock()
+
+	return m.copyWatchdogReport()
+}
+
+// copyWatchdogReport copies the last report; the caller holds watchdogMu
+func (m *Manager) copyWatchdogReport() *models.WatchdogReport {
+	report := m.watchdogReport
+	report.Stuck = append([]models.StuckVM{}, report.Stuck...)
+	return &report
+}
+
+// retryStuckVM records an operation that starts the stuck stage again, in
+// place of the VM's pending ones
+func (m *Manager) retryStuckVM(ctx context.Context, vm *models.VM, stage models.StuckStage, ops []*store.Operation) error {
+	op := &store.Operation{
+		Kind:      store.OperationProvision,
+		RequestID: requestid.New(),
+		Source:    store.SourceWatchdog,
+	}
+	if stage == models.StuckTailnet {
+		op.Kind = store.OperationJoin
+	}
+	if len(ops) > 0 {
+		op.RestoreBackupID = ops[0].RestoreBackupID
+	}
+
+	if err := m.store.RetryVMOperation(ctx, vm.ID, op); err != nil {
+		return err
+	}
+	m.wakeOutbox()
+	return nil
+}
+
+// rollBackStuckVM puts the VM in error, cancelling its operations, and
+// deletes whatever machine and tailnet device provisioning left, so it can
+// be retried from scratch
+func (m *Manager) rollBackStuckVM(ctx context.Context, vm *models.VM) error {
+	if err := m.store.AbandonVMOperations(ctx, vm.ID); err != nil {
+		return err
+	}
+	m.notify(ctx, vm, models.NotifyProvisioningFailed, "VM provisioning failed",
+		fmt.Sprintf("VM %s was stuck provisioning and is in error. Retry it or create another.", vm.ID))
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.ProvisionTimeout)
+	defer cancel()
+
+	var errs []error
+	if vm.ProviderID != "" {
+		if vm.Provider != m.provider.Name() {
+			errs = append(errs, &ProviderError{Provider: vm.Provider, Err: fmt.Errorf("provider is not configured on this control plane (using %s)", m.provider.Name())})
+		} else if err := m.provider.DeleteVM(ctx, vm); err != nil {
+			errs = append(errs, fmt.Errorf("delete machine: %w", err))
+		} else if err := m.store.UpdateVMMachine(ctx, vm.ID, "", ""); err != nil {
+			errs = append(errs, fmt.Errorf("clear machine: %w", err))
+		}
+	}
+	if err := m.tailscaleClient.DeleteDevice(ctx, fmt.Sprintf("devtail-%s", vm.ID)); err != nil {
+		errs = append(errs, fmt.Errorf("remove tailnet device: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// stuckStage tells where provisioning stopped from the VM's record and its
+// latest operation
+func stuckStage(vm *models.VM, ops []*store.Operation) models.StuckStage {
+	switch {
+	case len(ops) > 0 && ops[0].Status == store.OperationPending && ops[0].Attempts == 0:
+		return models.StuckQueued
+	case vm.ProviderID == "":
+		return models.StuckMachine
+	default:
+		return models.StuckTailnet
+	}
+}
+
+// watchdogRetries counts the watchdog's retries since the VM's latest
+// operation from the API
+func watchdogRetries(ops []*store.Operation) int {
+	n := 0
+	for _, op := range ops {
+		if op.Source != store.SourceWatchdog {
+			break
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,11 @@
+// Package migrations embeds the schema migrations applied by the control
+// plane itself. Postgres migrations under postgres/ are applied with
+// `make migrate`; SQLite ones are applied when the database is opened.
+package migrations
+
+import "embed"
+
+// SQLite holds the migrations under sqlite/, applied in name order
+//
+//go:embed sqlite/*.sql
+var SQLite embed.FS
@@ -0,0 +1,3 @@
+-- Gateways now validate short-lived signed connect tokens, so the stored
+-- websocket token is no longer used
+ALTER TABLE vms DROP COLUMN IF EXISTS websocket_token;
@@ -0,0 +1,12 @@
+-- Connect token revocations. Either token_id (one token) or issued_before
+-- (every token issued for the VM before that time) is set.
+CREATE TABLE IF NOT EXISTS vm_token_revocations (
+    id SERIAL PRIMARY KEY,
+    vm_id VARCHAR(36) NOT NULL REFERENCES vms(id),
+    token_id VARCHAR(36),
+    issued_before TIMESTAMP WITH TIME ZONE,
+    propagated_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_vm_token_revocations_vm_id ON vm_token_revocations(vm_id);
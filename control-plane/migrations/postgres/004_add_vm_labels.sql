@@ -0,0 +1,4 @@
+-- User labels (project, branch, ticket, ...) as a flat string map
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS idx_vms_labels ON vms USING GIN (labels);
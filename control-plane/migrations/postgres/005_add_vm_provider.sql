@@ -0,0 +1,7 @@
+-- The provider that created the VM and its ID there. hetzner_id is kept for
+-- rows written before providers were pluggable and is no longer updated.
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS provider VARCHAR(32) NOT NULL DEFAULT 'hetzner';
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS provider_id VARCHAR(255);
+
+UPDATE vms SET provider_id = hetzner_id::TEXT
+WHERE provider_id IS NULL AND hetzner_id IS NOT NULL;
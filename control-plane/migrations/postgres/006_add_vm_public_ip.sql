@@ -0,0 +1,2 @@
+-- The VM's public IPv4, if it has one, for DNS records
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS public_ip VARCHAR(45);
@@ -0,0 +1,13 @@
+-- Structured log lines and panic reports shipped by VM gateways
+CREATE TABLE IF NOT EXISTS vm_logs (
+    id BIGSERIAL PRIMARY KEY,
+    vm_id VARCHAR(36) NOT NULL REFERENCES vms(id),
+    kind VARCHAR(16) NOT NULL,
+    level VARCHAR(16) NOT NULL,
+    message TEXT NOT NULL,
+    fields JSONB,
+    logged_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_vm_logs_vm_id_logged_at ON vm_logs(vm_id, logged_at);
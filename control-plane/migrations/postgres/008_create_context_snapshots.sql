@@ -0,0 +1,13 @@
+-- AI conversation contexts saved by VM gateways. They are kept per user, not
+-- per VM, so a user who recreates their VM can resume earlier sessions.
+CREATE TABLE IF NOT EXISTS context_snapshots (
+    user_id VARCHAR(255) NOT NULL,
+    workspace VARCHAR(255) NOT NULL,
+    session_id VARCHAR(255) NOT NULL,
+    vm_id VARCHAR(36) NOT NULL,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, workspace, session_id)
+);
+
+CREATE INDEX idx_context_snapshots_user_id_updated_at ON context_snapshots(user_id, updated_at);
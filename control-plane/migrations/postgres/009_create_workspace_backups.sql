@@ -0,0 +1,18 @@
+-- Workspace archives gateways upload to object storage. A backup is pending
+-- until its upload completes and deleted once retention removes the object.
+CREATE TABLE IF NOT EXISTS workspace_backups (
+    id BIGSERIAL PRIMARY KEY,
+    vm_id VARCHAR(36) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    workspace VARCHAR(255) NOT NULL,
+    object_key TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    sha256 VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    deleted_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_workspace_backups_user_id_created_at ON workspace_backups(user_id, created_at);
+CREATE INDEX idx_workspace_backups_vm_id_workspace ON workspace_backups(vm_id, workspace);
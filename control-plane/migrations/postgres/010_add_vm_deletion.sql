@@ -0,0 +1,4 @@
+-- When a terminating VM's machine is deleted, and whether its workspaces are
+-- backed up first
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS delete_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS backup_on_delete BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,25 @@
+-- When a VM was terminated, for retention. Terminated VMs no longer keep
+-- their Tailscale auth key.
+ALTER TABLE vms ADD COLUMN IF NOT EXISTS terminated_at TIMESTAMP WITH TIME ZONE;
+
+UPDATE vms
+SET terminated_at = updated_at, tailscale_auth_key = NULL
+WHERE status = 'terminated';
+
+CREATE INDEX IF NOT EXISTS idx_vms_terminated_at ON vms(terminated_at);
+
+-- Terminated VMs past retention.archive_after, kept without their logs,
+-- revocations or activity until retention.purge_after
+CREATE TABLE IF NOT EXISTS vm_archive (
+    id VARCHAR(36) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    provider_id VARCHAR(255),
+    spec JSONB NOT NULL,
+    labels JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    terminated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    archived_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_archive_terminated_at ON vm_archive(terminated_at);
@@ -0,0 +1,21 @@
+-- Outbox of provider side effects. An operation is written in the same
+-- transaction as the VM state change that calls for it, and workers lease,
+-- run and complete it, applying the resulting state change in the same
+-- transaction as the completion.
+CREATE TABLE IF NOT EXISTS vm_operations (
+    id BIGSERIAL PRIMARY KEY,
+    vm_id VARCHAR(36) NOT NULL REFERENCES vms(id),
+    kind VARCHAR(16) NOT NULL,
+    restore_backup_id BIGINT NOT NULL DEFAULT 0,
+    request_id VARCHAR(64) NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    leased_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_operations_status_run_after ON vm_operations(status, run_after);
+CREATE INDEX IF NOT EXISTS idx_vm_operations_vm_id ON vm_operations(vm_id);
@@ -0,0 +1,11 @@
+-- Per-minute activity reported by VM gateways. Only active minutes are
+-- reported; a minute reported again replaces the earlier report.
+CREATE TABLE IF NOT EXISTS vm_activity_minutes (
+    vm_id VARCHAR(36) NOT NULL REFERENCES vms(id),
+    minute TIMESTAMP WITH TIME ZONE NOT NULL,
+    keystrokes BIGINT NOT NULL DEFAULT 0,
+    ai_requests BIGINT NOT NULL DEFAULT 0,
+    cpu_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (vm_id, minute)
+);
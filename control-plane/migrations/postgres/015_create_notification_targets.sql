@@ -0,0 +1,14 @@
+-- Where a user wants notifications delivered: a mobile push token or an
+-- email address. A push token registered by another user moves to them,
+-- since it belongs to whoever is signed in on the device.
+CREATE TABLE IF NOT EXISTS notification_targets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    address TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    UNIQUE (kind, address)
+);
+
+CREATE INDEX idx_notification_targets_user_id ON notification_targets(user_id);
@@ -0,0 +1,30 @@
+-- SQLite schema for single-node deployments. Mirrors the Postgres
+-- migrations up to 002; JSON is stored as TEXT and timestamps as DATETIME.
+CREATE TABLE IF NOT EXISTS vms (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    hetzner_id INTEGER,
+    tailscale_ip TEXT,
+    tailscale_auth_key TEXT,
+    status TEXT NOT NULL,
+    spec TEXT NOT NULL,
+    last_activity DATETIME DEFAULT CURRENT_TIMESTAMP,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vms_user_id ON vms(user_id);
+CREATE INDEX IF NOT EXISTS idx_vms_status ON vms(status);
+CREATE INDEX IF NOT EXISTS idx_vms_created_at ON vms(created_at);
+
+-- VM activity tracking table
+CREATE TABLE IF NOT EXISTS vm_activity (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id TEXT NOT NULL REFERENCES vms(id),
+    activity_type TEXT NOT NULL,
+    details TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_activity_vm_id ON vm_activity(vm_id);
+CREATE INDEX IF NOT EXISTS idx_vm_activity_created_at ON vm_activity(created_at);
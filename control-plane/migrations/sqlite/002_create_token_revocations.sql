@@ -0,0 +1,12 @@
+-- Connect token revocations. Either token_id (one token) or issued_before
+-- (every token issued for the VM before that time) is set.
+CREATE TABLE IF NOT EXISTS vm_token_revocations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id TEXT NOT NULL REFERENCES vms(id),
+    token_id TEXT,
+    issued_before DATETIME,
+    propagated_at DATETIME,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_token_revocations_vm_id ON vm_token_revocations(vm_id);
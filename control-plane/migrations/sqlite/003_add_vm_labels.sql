@@ -0,0 +1,2 @@
+-- User labels (project, branch, ticket, ...) as a flat string map
+ALTER TABLE vms ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,7 @@
+-- The provider that created the VM and its ID there. hetzner_id is kept for
+-- rows written before providers were pluggable and is no longer updated.
+ALTER TABLE vms ADD COLUMN provider TEXT NOT NULL DEFAULT 'hetzner';
+ALTER TABLE vms ADD COLUMN provider_id TEXT;
+
+UPDATE vms SET provider_id = CAST(hetzner_id AS TEXT)
+WHERE provider_id IS NULL AND hetzner_id IS NOT NULL;
@@ -0,0 +1,13 @@
+-- Structured log lines and panic reports shipped by VM gateways
+CREATE TABLE IF NOT EXISTS vm_logs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id TEXT NOT NULL REFERENCES vms(id),
+    kind TEXT NOT NULL,
+    level TEXT NOT NULL,
+    message TEXT NOT NULL,
+    fields TEXT,
+    logged_at DATETIME NOT NULL,
+    received_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_logs_vm_id_logged_at ON vm_logs(vm_id, logged_at);
@@ -0,0 +1,13 @@
+-- AI conversation contexts saved by VM gateways. They are kept per user, not
+-- per VM, so a user who recreates their VM can resume earlier sessions.
+CREATE TABLE IF NOT EXISTS context_snapshots (
+    user_id TEXT NOT NULL,
+    workspace TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    vm_id TEXT NOT NULL,
+    data BLOB NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, workspace, session_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_context_snapshots_user_id_updated_at ON context_snapshots(user_id, updated_at);
@@ -0,0 +1,18 @@
+-- Workspace archives gateways upload to object storage. A backup is pending
+-- until its upload completes and deleted once retention removes the object.
+CREATE TABLE IF NOT EXISTS workspace_backups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    workspace TEXT NOT NULL,
+    object_key TEXT NOT NULL,
+    status TEXT NOT NULL,
+    size_bytes INTEGER NOT NULL DEFAULT 0,
+    sha256 TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    completed_at DATETIME,
+    deleted_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_workspace_backups_user_id_created_at ON workspace_backups(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_workspace_backups_vm_id_workspace ON workspace_backups(vm_id, workspace);
@@ -0,0 +1,4 @@
+-- When a terminating VM's machine is deleted, and whether its workspaces are
+-- backed up first
+ALTER TABLE vms ADD COLUMN delete_at DATETIME;
+ALTER TABLE vms ADD COLUMN backup_on_delete BOOLEAN NOT NULL DEFAULT 0;
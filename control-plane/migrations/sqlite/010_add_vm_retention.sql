@@ -0,0 +1,25 @@
+-- When a VM was terminated, for retention. Terminated VMs no longer keep
+-- their Tailscale auth key.
+ALTER TABLE vms ADD COLUMN terminated_at DATETIME;
+
+UPDATE vms
+SET terminated_at = updated_at, tailscale_auth_key = NULL
+WHERE status = 'terminated';
+
+CREATE INDEX IF NOT EXISTS idx_vms_terminated_at ON vms(terminated_at);
+
+-- Terminated VMs past retention.archive_after, kept without their logs,
+-- revocations or activity until retention.purge_after
+CREATE TABLE IF NOT EXISTS vm_archive (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    provider_id TEXT,
+    spec TEXT NOT NULL,
+    labels TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    terminated_at DATETIME NOT NULL,
+    archived_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_archive_terminated_at ON vm_archive(terminated_at);
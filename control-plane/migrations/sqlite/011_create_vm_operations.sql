@@ -0,0 +1,21 @@
+-- Outbox of provider side effects. An operation is written in the same
+-- transaction as the VM state change that calls for it, and workers lease,
+-- run and complete it, applying the resulting state change in the same
+-- transaction as the completion.
+CREATE TABLE IF NOT EXISTS vm_operations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    vm_id TEXT NOT NULL REFERENCES vms(id),
+    kind TEXT NOT NULL,
+    restore_backup_id INTEGER NOT NULL DEFAULT 0,
+    request_id TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_after DATETIME NOT NULL,
+    leased_until DATETIME,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_operations_status_run_after ON vm_operations(status, run_after);
+CREATE INDEX IF NOT EXISTS idx_vm_operations_vm_id ON vm_operations(vm_id);
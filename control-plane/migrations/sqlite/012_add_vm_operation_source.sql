@@ -0,0 +1,4 @@
+-- Who recorded an operation: the API, for a user's or operator's request,
+-- or the watchdog, retrying a VM stuck provisioning. The watchdog counts its
+-- own retries to know when to give up on a VM.
+ALTER TABLE vm_operations ADD COLUMN source TEXT NOT NULL DEFAULT 'api';
@@ -0,0 +1,11 @@
+-- Per-minute activity reported by VM gateways. Only active minutes are
+-- reported; a minute reported again replaces the earlier report.
+CREATE TABLE IF NOT EXISTS vm_activity_minutes (
+    vm_id TEXT NOT NULL REFERENCES vms(id),
+    minute DATETIME NOT NULL,
+    keystrokes INTEGER NOT NULL DEFAULT 0,
+    ai_requests INTEGER NOT NULL DEFAULT 0,
+    cpu_seconds REAL NOT NULL DEFAULT 0,
+    received_at DATETIME NOT NULL,
+    PRIMARY KEY (vm_id, minute)
+);
@@ -0,0 +1,14 @@
+-- Where a user wants notifications delivered: a mobile push token or an
+-- email address. A push token registered by another user moves to them,
+-- since it belongs to whoever is signed in on the device.
+CREATE TABLE IF NOT EXISTS notification_targets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    address TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    UNIQUE (kind, address)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notification_targets_user_id ON notification_targets(user_id);
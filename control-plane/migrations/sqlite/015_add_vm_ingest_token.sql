@@ -0,0 +1,5 @@
+-- The ID of the ingest token the VM's gateway was last given. Only that
+-- token is accepted, so the one issued on rebuild revokes the one before,
+-- and terminated VMs drop it. VMs provisioned before it was recorded have
+-- none until they are rebuilt.
+ALTER TABLE vms ADD COLUMN ingest_token_id TEXT;
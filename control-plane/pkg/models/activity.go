@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// ActivitySample is one active minute of a VM, as counted by its gateway. A
+// minute is active when a client typed into a terminal, sent the AI a
+// request, or the VM's tasks used more CPU than the gateway's threshold;
+// idle minutes are not reported. Keystrokes counts bytes of terminal input
+// and CPUSeconds the CPU time used outside the gateway itself.
+type ActivitySample struct {
+	Minute     time.Time `json:"minute" binding:"required"`
+	Keystrokes int64     `json:"keystrokes" binding:"min=0"`
+	AIRequests int64     `json:"ai_requests" binding:"min=0"`
+	CPUSeconds float64   `json:"cpu_seconds" binding:"min=0"`
+}
+
+// IngestActivityRequest is a batch of active minutes sent by a gateway to
+// POST /api/v1/ingest/activity. Minutes sent again replace the earlier
+// report, so gateways can retry a batch whole.
+type IngestActivityRequest struct {
+	Samples []ActivitySample `json:"samples" binding:"required,max=1440,dive"`
+}
+
+// ActivityReport is returned by GET /api/v1/vms/{id}/activity: the VM's
+// active minutes in [Since, Until) and their totals
+type ActivityReport struct {
+	VMID          string           `json:"vm_id"`
+	Since         time.Time        `json:"since"`
+	Until         time.Time        `json:"until"`
+	ActiveMinutes int              `json:"active_minutes"`
+	Keystrokes    int64            `json:"keystrokes"`
+	AIRequests    int64            `json:"ai_requests"`
+	CPUSeconds    float64          `json:"cpu_seconds"`
+	LastActivity  time.Time        `json:"last_activity"`
+	Samples       []ActivitySample `json:"samples"`
+}
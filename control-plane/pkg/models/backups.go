@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// BackupStatus is where a workspace backup is in its life
+type BackupStatus string
+
+const (
+	// BackupStatusPending backups have an upload URL but no archive yet
+	BackupStatusPending BackupStatus = "pending"
+
+	// BackupStatusComplete backups can be restored
+	BackupStatusComplete BackupStatus = "complete"
+
+	// BackupStatusDeleted backups were removed by the retention policy
+	BackupStatusDeleted BackupStatus = "deleted"
+)
+
+// WorkspaceBackup is a tar + zstd archive of one of a VM's workspaces in
+// object storage. Backups belong to the VM's owner and outlive the VM, so a
+// new VM can be provisioned from one.
+type WorkspaceBackup struct {
+	ID          int64        `json:"id"`
+	VMID        string       `json:"vm_id"`
+	UserID      string       `json:"user_id"`
+	Workspace   string       `json:"workspace"`
+	ObjectKey   string       `json:"object_key"`
+	Status      BackupStatus `json:"status"`
+	SizeBytes   int64        `json:"size_bytes,omitempty"`
+	SHA256      string       `json:"sha256,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+}
+
+// StartBackupRequest is sent by a gateway to POST /api/v1/ingest/backups
+// before it uploads an archive
+type StartBackupRequest struct {
+	Workspace string `json:"workspace" binding:"required,max=255"`
+}
+
+// StartBackupResponse tells the gateway where to upload the archive
+type StartBackupResponse struct {
+	Backup    *WorkspaceBackup `json:"backup"`
+	UploadURL string           `json:"upload_url"`
+	ExpiresAt time.Time        `json:"expires_at"`
+}
+
+// CompleteBackupRequest is sent by a gateway to
+// POST /api/v1/ingest/backups/{id}/complete once the upload succeeded
+type CompleteBackupRequest struct {
+	SizeBytes int64  `json:"size_bytes" binding:"required,min=1"`
+	SHA256    string `json:"sha256" binding:"required,len=64,hexadecimal"`
+}
+
+// BackupDownloadResponse is returned by
+// GET /api/v1/ingest/backups/{id}/download
+type BackupDownloadResponse struct {
+	DownloadURL string    `json:"download_url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ListBackupsResponse is returned by GET /api/v1/backups, newest first
+type ListBackupsResponse struct {
+	Backups []WorkspaceBackup `json:"backups"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+)
+
+// AnnouncementKind tells clients how to present an announcement
+type AnnouncementKind string
+
+const (
+	AnnouncementInfo        AnnouncementKind = "info"
+	AnnouncementMaintenance AnnouncementKind = "maintenance" // StartsAt and EndsAt bound the window
+	AnnouncementUpgrade     AnnouncementKind = "upgrade"     // clients older than MinClientVersion must update
+)
+
+// Announcement is a notice from the operators to every connected client.
+// Gateways deliver it to their live sessions, and to sessions that open
+// until ExpiresAt. Its ID is the same on every gateway, so a client that
+// reaches several shows it once.
+type Announcement struct {
+	ID               string           `json:"id"`
+	Kind             AnnouncementKind `json:"kind"`
+	Message          string           `json:"message"`
+	URL              string           `json:"url,omitempty"`
+	StartsAt         *time.Time       `json:"starts_at,omitempty"`
+	EndsAt           *time.Time       `json:"ends_at,omitempty"`
+	MinClientVersion string           `json:"min_client_version,omitempty"`
+	ExpiresAt        time.Time        `json:"expires_at"`
+}
+
+// BroadcastRequest is sent by operators to POST /api/v1/admin/broadcasts.
+// ExpiresAt defaults to EndsAt, or an hour from now without one.
+type BroadcastRequest struct {
+	Kind             AnnouncementKind `json:"kind" binding:"required,oneof=info maintenance upgrade"`
+	Message          string           `json:"message" binding:"required,max=1000"`
+	URL              string           `json:"url" binding:"omitempty,url,max=2048"`
+	StartsAt         *time.Time       `json:"starts_at"`
+	EndsAt           *time.Time       `json:"ends_at"`
+	MinClientVersion string           `json:"min_client_version" binding:"max=32"`
+	ExpiresAt        *time.Time       `json:"expires_at"`
+
+	// Labels limits the broadcast to VMs matching a label selector, e.g.
+	// region=eu; every running VM by default
+	Labels string `json:"labels"`
+}
+
+// BroadcastFailure names a VM whose gateway did not take an announcement
+type BroadcastFailure struct {
+	VMID  string `json:"vm_id"`
+	Error string `json:"error"`
+}
+
+// BroadcastResponse reports how far a broadcast reached
+type BroadcastResponse struct {
+	Announcement Announcement       `json:"announcement"`
+	VMs          int                `json:"vms"`       // running VMs targeted
+	Delivered    int                `json:"delivered"` // gateways that took it
+	Sessions     int                `json:"sessions"`  // live sessions it reached
+	Failures     []BroadcastFailure `json:"failures,omitempty"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Catalog lists the VM specs the control plane accepts. GET /api/v1/catalog
+// returns it so clients can offer only valid choices.
+type Catalog struct {
+	ServerTypes []ServerTypeOption `json:"server_types"`
+	Locations   []LocationOption   `json:"locations"`
+	DiskSizes   []int              `json:"disk_sizes"` // in GB
+	Images      []ImageOption      `json:"images"`     // the first is the default
+	Source      string             `json:"source"`     // "static" or "hetzner"
+	UpdatedAt   time.Time          `json:"updated_at"`
+}
+
+type ServerTypeOption struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Cores       int     `json:"cores"`
+	MemoryGB    float32 `json:"memory_gb"`
+	DiskGB      int     `json:"disk_gb"`
+
+	// Locations the type is available in; empty means all
+	Locations []string `json:"locations,omitempty"`
+}
+
+// ImageOption is an image VMs can boot from
+type ImageOption struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Golden images have the gateway and tools preinstalled, so
+	// provisioning skips installing them
+	Golden bool `json:"golden,omitempty"`
+}
+
+type LocationOption struct {
+	Name    string `json:"name"`
+	City    string `json:"city,omitempty"`
+	Country string `json:"country,omitempty"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ContextSnapshot is an AI conversation context saved by a VM's gateway.
+// Snapshots belong to the user rather than the VM, so a recreated VM can
+// restore them. Data is the context file as the gateway wrote it; it is left
+// out of listings.
+type ContextSnapshot struct {
+	Workspace string          `json:"workspace"`
+	SessionID string          `json:"session_id"`
+	VMID      string          `json:"vm_id"`
+	Size      int64           `json:"size"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// ListContextSnapshotsResponse is returned by GET /api/v1/ingest/contexts,
+// most recently updated first
+type ListContextSnapshotsResponse struct {
+	Snapshots []ContextSnapshot `json:"snapshots"`
+}
@@ -0,0 +1,33 @@
+package models
+
+// ErrorCode is a stable, machine-readable error identifier. Clients should
+// branch on the code; messages are for humans and may change.
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidRequest      ErrorCode = "invalid_request"
+	ErrorCodeValidationFailed    ErrorCode = "validation_failed"
+	ErrorCodeUnauthenticated     ErrorCode = "unauthenticated"
+	ErrorCodeForbidden           ErrorCode = "forbidden"
+	ErrorCodeNotFound            ErrorCode = "not_found"
+	ErrorCodeConflict            ErrorCode = "conflict"
+	ErrorCodePayloadTooLarge     ErrorCode = "payload_too_large"
+	ErrorCodeQuotaExceeded       ErrorCode = "quota_exceeded"
+	ErrorCodeProviderUnavailable ErrorCode = "provider_unavailable"
+	ErrorCodeTimeout             ErrorCode = "timeout"
+	ErrorCodeInternal            ErrorCode = "internal_error"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	Code      ErrorCode              `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// ErrorResponse wraps an APIError, e.g.
+// {"error": {"code": "not_found", "message": "VM not found", "request_id": "..."}}
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+)
+
+// GatewayStatus summarizes whether a VM's gateway can take a new session
+type GatewayStatus string
+
+const (
+	GatewayHealthy     GatewayStatus = "healthy"
+	GatewayDegraded    GatewayStatus = "degraded"    // terminals work, but its self-check failed (e.g. chat)
+	GatewayUnavailable GatewayStatus = "unavailable" // answering, but draining or at its connection limit
+	GatewayUnreachable GatewayStatus = "unreachable"
+	GatewayUnknown     GatewayStatus = "unknown" // the VM is not running, so it was not probed
+)
+
+// GatewayHealth is the outcome of the control plane's last probe of a
+// gateway. LatencyMS is the round trip from the control plane over the
+// tailnet; it ranks gateways, but is not the client's own latency.
+type GatewayHealth struct {
+	Status    GatewayStatus `json:"status"`
+	LatencyMS int64         `json:"latency_ms"`
+	Detail    string        `json:"detail,omitempty"`
+	CheckedAt *time.Time    `json:"checked_at,omitempty"`
+}
+
+// GatewayDescriptor tells a client how to reach one of its VMs' gateways
+// and which workspaces it serves. Chat and terminal messages name the
+// workspace; the URL is the same for all of them.
+type GatewayDescriptor struct {
+	VMID         string            `json:"vm_id"`
+	VMStatus     VMStatus          `json:"vm_status"`
+	Hostname     string            `json:"hostname,omitempty"`
+	Location     string            `json:"location"`
+	Labels       map[string]string `json:"labels"`
+	WebsocketURL string            `json:"websocket_url,omitempty"` // only for running VMs
+	ExpiresAt    *time.Time        `json:"expires_at,omitempty"`
+	Workspaces   []string          `json:"workspaces"`
+	Health       GatewayHealth     `json:"health"`
+}
+
+// ListGatewaysResponse is returned by GET /api/v1/gateways
+type ListGatewaysResponse struct {
+	Gateways []GatewayDescriptor `json:"gateways"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// LogKind tells ordinary log lines from panic reports
+type LogKind string
+
+const (
+	LogKindLog   LogKind = "log"
+	LogKindPanic LogKind = "panic"
+)
+
+// LogEntry is one structured log line or panic report shipped by a VM's
+// gateway. Fields holds the remaining structured fields of the line; panic
+// reports carry the stack trace there.
+type LogEntry struct {
+	ID      int64           `json:"id,omitempty"`
+	Kind    LogKind         `json:"kind" binding:"omitempty,oneof=log panic"`
+	Level   string          `json:"level" binding:"max=16"`
+	Message string          `json:"message"`
+	Fields  json.RawMessage `json:"fields,omitempty"`
+	Time    time.Time       `json:"time" binding:"required"`
+}
+
+// IngestLogsRequest is a batch of entries sent by a gateway to
+// POST /api/v1/ingest/logs
+type IngestLogsRequest struct {
+	Entries []LogEntry `json:"entries" binding:"required,max=1000,dive"`
+}
+
+// ListLogsResponse is returned by GET /api/v1/admin/vms/{id}/logs, newest
+// entry first
+type ListLogsResponse struct {
+	Entries []LogEntry `json:"entries"`
+}
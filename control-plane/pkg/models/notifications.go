@@ -0,0 +1,64 @@
+package models
+
+import "time"
+
+// NotificationEvent is what a notification tells a user about
+type NotificationEvent string
+
+const (
+	NotifyVMReady            NotificationEvent = "vm_ready"            // a new VM's gateway accepts sessions
+	NotifyProvisioningFailed NotificationEvent = "provisioning_failed" // a VM was put in error
+	NotifyAITaskFinished     NotificationEvent = "ai_task_finished"    // an AI reply finished with no client connected
+	NotifyTest               NotificationEvent = "test"                // sent on request, to check delivery
+)
+
+// NotificationTargetKind says how a notification target is reached
+type NotificationTargetKind string
+
+const (
+	TargetFCM   NotificationTargetKind = "fcm"   // Firebase Cloud Messaging registration token
+	TargetAPNs  NotificationTargetKind = "apns"  // Apple Push Notification service device token
+	TargetEmail NotificationTargetKind = "email" // email address
+)
+
+// NotificationTarget is a device or address one of a user's notifications
+// are delivered to
+type NotificationTarget struct {
+	ID        int64                  `json:"id"`
+	UserID    string                 `json:"user_id"`
+	Kind      NotificationTargetKind `json:"kind"`
+	Address   string                 `json:"address"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// CreateNotificationTargetRequest is sent to POST
+// /api/v1/notifications/targets. Registering a push token again, such as
+// after signing in as another user on the device, moves it to the caller.
+type CreateNotificationTargetRequest struct {
+	Kind    NotificationTargetKind `json:"kind" binding:"required,oneof=fcm apns email"`
+	Address string                 `json:"address" binding:"required,max=4096"`
+}
+
+// ListNotificationTargetsResponse is returned by GET
+// /api/v1/notifications/targets
+type ListNotificationTargetsResponse struct {
+	Targets []NotificationTarget `json:"targets"`
+}
+
+// IngestEventRequest is sent by a gateway to POST /api/v1/ingest/events
+// about something its VM's owner should be told of, such as an AI reply
+// that finished while no client was connected
+type IngestEventRequest struct {
+	Kind      NotificationEvent `json:"kind" binding:"required,oneof=ai_task_finished"`
+	Workspace string            `json:"workspace" binding:"max=255"`
+	// DurationSeconds is how long the task took
+	DurationSeconds float64 `json:"duration_seconds" binding:"min=0"`
+}
+
+// TestNotificationResponse is returned by POST /api/v1/notifications/test
+type TestNotificationResponse struct {
+	// Notifiers lists the configured notifiers the test was delivered by
+	Notifiers []string `json:"notifiers"`
+	// Errors lists delivery failures, by notifier
+	Errors map[string]string `json:"errors,omitempty"`
+}
@@ -0,0 +1,104 @@
+package models
+
+import "time"
+
+// JobKind names the background work the control plane does for a VM
+type JobKind string
+
+const (
+	JobProvision JobKind = "provision" // boot a machine and wait for it to join the tailnet
+	JobDeletion  JobKind = "deletion"  // delete a terminating VM's machine
+)
+
+// RetryJobResponse is returned by POST /api/v1/admin/vms/:id/retry
+type RetryJobResponse struct {
+	Job JobKind `json:"job"`
+	VM  *VM     `json:"vm"`
+}
+
+// ReconcileReport is returned by POST /api/v1/admin/reconcile. VM IDs are
+// listed by what was done to them.
+type ReconcileReport struct {
+	// StuckProvisioning VMs were provisioning for longer than the provision
+	// timeout, so no provisioning job was left for them, and are now in error
+	StuckProvisioning []string `json:"stuck_provisioning"`
+
+	// Deleted VMs were terminating past their grace period
+	Deleted []string `json:"deleted"`
+
+	// DNSPublished counts the running VMs whose record was published again
+	DNSPublished int `json:"dns_published"`
+
+	Errors []ReconcileError `json:"errors,omitempty"`
+}
+
+// ReconcileError is a step of reconciliation that failed for a VM
+type ReconcileError struct {
+	VMID  string `json:"vm_id"`
+	Step  string `json:"step"`
+	Error string `json:"error"`
+}
+
+// StuckStage is where a VM stuck provisioning stopped making progress
+type StuckStage string
+
+const (
+	StuckQueued  StuckStage = "queued"  // its provisioning operation never started
+	StuckMachine StuckStage = "machine" // no machine was recorded for it
+	StuckTailnet StuckStage = "tailnet" // its machine never joined the tailnet
+)
+
+// WatchdogAction is what the watchdog did about a stuck VM
+type WatchdogAction string
+
+const (
+	WatchdogRetried    WatchdogAction = "retried"     // the stuck stage was started again
+	WatchdogRolledBack WatchdogAction = "rolled_back" // the VM was put in error and its machine deleted
+)
+
+// StuckVM is a VM the watchdog found stuck provisioning
+type StuckVM struct {
+	VMID   string     `json:"vm_id"`
+	UserID string     `json:"user_id"`
+	Stage  StuckStage `json:"stage"`
+	Since  time.Time  `json:"since"`
+	// Retries counts the watchdog's earlier retries of the VM
+	Retries int            `json:"retries"`
+	Action  WatchdogAction `json:"action"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// WatchdogTotals counts what the watchdog has done since the control plane
+// started
+type WatchdogTotals struct {
+	Stuck      int64 `json:"stuck"`
+	Retried    int64 `json:"retried"`
+	RolledBack int64 `json:"rolled_back"`
+	// Failed counts retries and rollbacks that returned an error
+	Failed int64 `json:"failed"`
+}
+
+// WatchdogReport is returned by GET /api/v1/admin/watchdog
+type WatchdogReport struct {
+	// CheckedAt is when the watchdog last looked; absent before its first
+	// check or when it is disabled
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+
+	// Stuck lists the VMs found stuck at the last check
+	Stuck []StuckVM `json:"stuck"`
+
+	Totals WatchdogTotals `json:"totals"`
+}
+
+// Metrics is returned by GET /metrics
+type Metrics struct {
+	// StuckVMs counts, by stage, the VMs the watchdog found stuck at its
+	// last check
+	StuckVMs map[StuckStage]int `json:"stuck_vms"`
+	Watchdog WatchdogTotals     `json:"watchdog"`
+
+	// ProvisionP95Seconds is the 95th percentile of each provisioning
+	// stage over the latest provisionings, see ProvisioningStats
+	ProvisionP95Seconds map[ProvisionStage]float64 `json:"provision_p95_seconds"`
+	Provisioning        ProvisioningTotals         `json:"provisioning"`
+}
@@ -0,0 +1,32 @@
+package models
+
+// PoolUserID owns the warm pool's VMs until CreateVM hands one to a user
+const PoolUserID = "_pool"
+
+// PoolTotals counts what the warm pool has done since the control plane
+// started
+type PoolTotals struct {
+	// Claimed counts VMs handed to users straight from the pool
+	Claimed int64 `json:"claimed"`
+	// Missed counts CreateVM calls with the pool's spec that found no VM
+	// ready and provisioned one from scratch
+	Missed int64 `json:"missed"`
+	// Created and Deleted count pool VMs provisioned to refill the pool,
+	// and those deleted because they failed or no longer match pool.spec
+	Created int64 `json:"created"`
+	Deleted int64 `json:"deleted"`
+}
+
+// PoolReport is returned by GET /api/v1/admin/pool
+type PoolReport struct {
+	// Size is how many unclaimed VMs the pool keeps; zero when it is
+	// disabled
+	Size int    `json:"size"`
+	Spec VMSpec `json:"spec"`
+
+	// Ready VMs are running and can be claimed; Provisioning ones will be
+	Ready        int `json:"ready"`
+	Provisioning int `json:"provisioning"`
+
+	Totals PoolTotals `json:"totals"`
+}
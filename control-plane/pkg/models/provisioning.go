@@ -0,0 +1,51 @@
+package models
+
+// ProvisionStage is a step of provisioning a VM that is timed on its own
+type ProvisionStage string
+
+const (
+	StageQueued        ProvisionStage = "queued"         // due, waiting for an outbox worker
+	StageMachineCreate ProvisionStage = "machine_create" // the provider creating the machine
+	StageIPWait        ProvisionStage = "ip_wait"        // waiting for its public IP, where the provider does
+	StageTailnetJoin   ProvisionStage = "tailnet_join"   // waiting for it to join the tailnet
+	StageGatewayReady  ProvisionStage = "gateway_ready"  // waiting for its gateway to accept sessions
+	StageTotal         ProvisionStage = "total"          // from the operation being recorded to the gateway being ready
+)
+
+// ProvisionStages lists the stages in the order they happen
+var ProvisionStages = []ProvisionStage{StageQueued, StageMachineCreate, StageIPWait, StageTailnetJoin, StageGatewayReady, StageTotal}
+
+// StageStats summarises how long a stage took in the latest provisionings
+type StageStats struct {
+	// Count is how many durations are summarised, at most the window
+	Count      int     `json:"count"`
+	P50Seconds float64 `json:"p50_seconds"`
+	P95Seconds float64 `json:"p95_seconds"`
+	MaxSeconds float64 `json:"max_seconds"`
+
+	// Failed counts attempts that failed at this stage since the control
+	// plane started
+	Failed int64 `json:"failed"`
+}
+
+// ProvisioningTotals counts provisionings since the control plane started
+type ProvisioningTotals struct {
+	// Completed VMs have a gateway accepting sessions; OverSLO of them
+	// took longer than the SLO in total
+	Completed int64 `json:"completed"`
+	OverSLO   int64 `json:"over_slo"`
+
+	// Failed counts attempts that failed, and gateways that were never ready
+	Failed int64 `json:"failed"`
+}
+
+// ProvisioningStats is returned by GET /api/v1/admin/provisioning
+type ProvisioningStats struct {
+	SLOSeconds float64 `json:"slo_seconds"`
+
+	// Window is how many of each stage's latest durations are summarised
+	Window int                           `json:"window"`
+	Stages map[ProvisionStage]StageStats `json:"stages"`
+
+	Totals ProvisioningTotals `json:"totals"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// SuspendAction is one step of suspending a VM, carried out by its gateway
+type SuspendAction string
+
+const (
+	SuspendSchedule SuspendAction = "schedule" // warn clients the VM will be suspended at SuspendAt
+	SuspendCancel   SuspendAction = "cancel"   // the VM was active after all
+	SuspendNow      SuspendAction = "suspend"  // end every session; the machine stops next
+)
+
+// SuspendReason says why a VM is suspended
+type SuspendReason string
+
+const (
+	SuspendIdle     SuspendReason = "idle"     // no activity for suspend.idle_after
+	SuspendOperator SuspendReason = "operator" // an operator asked for it
+)
+
+// SuspendNotice is what the control plane signs for a VM's gateway at each
+// step of a suspension. Every step carries the same ID, so the gateway can
+// tell whether its clients called that suspension off.
+type SuspendNotice struct {
+	ID         string        `json:"id"`
+	Action     SuspendAction `json:"action"`
+	Reason     SuspendReason `json:"reason"`
+	SuspendAt  time.Time     `json:"suspend_at"`
+	ResumeHint string        `json:"resume_hint,omitempty"`
+}
+
+// SuspendVMRequest is sent by operators to POST
+// /api/v1/admin/vms/{id}/suspend. WarningSeconds defaults to
+// suspend.warning; zero suspends the VM without warning its clients.
+type SuspendVMRequest struct {
+	WarningSeconds *int `json:"warning_seconds" binding:"omitempty,min=0,max=3600"`
+}
+
+// SuspendVMResponse describes a scheduled suspension
+type SuspendVMResponse struct {
+	VMID      string        `json:"vm_id"`
+	SuspendID string        `json:"suspend_id"`
+	Reason    SuspendReason `json:"reason"`
+	SuspendAt time.Time     `json:"suspend_at"`
+	Sessions  int           `json:"sessions"`  // live sessions warned
+	Suspended bool          `json:"suspended"` // suspended already, without a warning
+}
@@ -11,36 +11,105 @@ const (
 	VMStatusRunning      VMStatus = "running"
 	VMStatusSuspended    VMStatus = "suspended"
 	VMStatusError        VMStatus = "error"
+	VMStatusTerminating  VMStatus = "terminating" // deleted, but its machine is kept until DeleteAt
 	VMStatusTerminated   VMStatus = "terminated"
 )
 
 type VMSpec struct {
-	Type     string `json:"type"`     // e.g., "cx11", "cx21"
-	Location string `json:"location"` // e.g., "nbg1", "fsn1"
+	Type     string `json:"type"`      // e.g., "cx11", "cx21"
+	Location string `json:"location"`  // e.g., "nbg1", "fsn1"
 	DiskSize int    `json:"disk_size"` // in GB
+	Image    string `json:"image"`     // e.g., "ubuntu-22.04"; the catalog default when empty
 }
 
 type VM struct {
-	ID               string    `json:"id" db:"id"`
-	UserID           string    `json:"user_id" db:"user_id"`
-	HetznerID        int64     `json:"hetzner_id" db:"hetzner_id"`
-	TailscaleIP      string    `json:"tailscale_ip" db:"tailscale_ip"`
-	TailscaleAuthKey string    `json:"-" db:"tailscale_auth_key"`
-	Status           VMStatus  `json:"status" db:"status"`
-	Spec             VMSpec    `json:"spec" db:"spec"`
-	WebsocketToken   string    `json:"websocket_token" db:"websocket_token"`
-	LastActivity     time.Time `json:"last_activity" db:"last_activity"`
-	CreatedAt        time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+	ID               string            `json:"id" db:"id"`
+	UserID           string            `json:"user_id" db:"user_id"`
+	Provider         string            `json:"provider" db:"provider"`
+	ProviderID       string            `json:"provider_id,omitempty" db:"provider_id"`
+	PublicIP         string            `json:"public_ip,omitempty" db:"public_ip"`
+	Hostname         string            `json:"hostname,omitempty" db:"-"` // set when DNS records are enabled
+	TailscaleIP      string            `json:"tailscale_ip" db:"tailscale_ip"`
+	TailscaleAuthKey string            `json:"-" db:"tailscale_auth_key"`
+	Status           VMStatus          `json:"status" db:"status"`
+	Spec             VMSpec            `json:"spec" db:"spec"`
+	Labels           map[string]string `json:"labels" db:"labels"`
+	LastActivity     time.Time         `json:"last_activity" db:"last_activity"`
+	CreatedAt        time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at" db:"updated_at"`
+
+	// DeleteAt is when a terminating VM's machine is deleted, after its
+	// workspaces are backed up if BackupOnDelete is set
+	DeleteAt       *time.Time `json:"delete_at,omitempty" db:"delete_at"`
+	BackupOnDelete bool       `json:"backup_on_delete,omitempty" db:"backup_on_delete"`
+
+	// TerminatedAt is when the VM's machine was deleted; retention
+	// archives and purges the record some time after
+	TerminatedAt *time.Time `json:"terminated_at,omitempty" db:"terminated_at"`
 }
 
 type CreateVMRequest struct {
-	UserID string `json:"user_id" binding:"required"`
-	Spec   VMSpec `json:"spec" binding:"required"`
+	UserID string            `json:"user_id" binding:"required"`
+	Spec   VMSpec            `json:"spec" binding:"required"`
+	Labels map[string]string `json:"labels"`
+
+	// RestoreBackupID provisions the VM's workspace from one of the user's
+	// backups
+	RestoreBackupID int64 `json:"restore_backup_id,omitempty" binding:"omitempty,min=1"`
+}
+
+// RebuildVMRequest is the optional body of POST /api/v1/vms/:id/rebuild
+type RebuildVMRequest struct {
+	// RestoreBackupID restores one of the user's backups into the new
+	// machine's workspace, if it starts empty
+	RestoreBackupID int64 `json:"restore_backup_id,omitempty" binding:"omitempty,min=1"`
+}
+
+// UpdateLabelsRequest replaces all of a VM's labels
+type UpdateLabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// ListVMsResponse is returned by GET /api/v1/vms
+type ListVMsResponse struct {
+	VMs []*VM `json:"vms"`
 }
 
 type CreateVMResponse struct {
-	VM             *VM    `json:"vm"`
-	WebsocketURL   string `json:"websocket_url"`
-	EstimatedReady int    `json:"estimated_ready_seconds"`
-}
\ No newline at end of file
+	VM                    *VM       `json:"vm"`
+	WebsocketURL          string    `json:"websocket_url"`
+	WebsocketURLExpiresAt time.Time `json:"websocket_url_expires_at"`
+	EstimatedReady        int       `json:"estimated_ready_seconds"`
+	// Pooled is set when the VM was claimed from the warm pool, running
+	// already
+	Pooled bool `json:"pooled,omitempty"`
+}
+
+// ConnectResponse carries a freshly signed gateway URL. The token in it is
+// checked when connecting, so clients refresh before reconnecting.
+type ConnectResponse struct {
+	WebsocketURL string    `json:"websocket_url"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// RevokeTokenRequest revokes one connect token by its ID (the JWT "jti").
+// Without a token ID every token issued for the VM so far is revoked.
+type RevokeTokenRequest struct {
+	TokenID string `json:"token_id"`
+}
+
+// TokenRevocationResponse reports whether the VM's gateway applied a
+// revocation. Rotation also returns the replacement URL.
+type TokenRevocationResponse struct {
+	*ConnectResponse
+	Propagated     bool   `json:"propagated"`
+	SessionsClosed int    `json:"sessions_closed"`
+	Error          string `json:"error,omitempty"`
+}
+
+// ConsoleResponse grants access to a VM's out-of-band console. For Hetzner
+// it is a VNC session over a WebSocket, authenticated with the password.
+type ConsoleResponse struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+}
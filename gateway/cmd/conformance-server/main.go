@@ -0,0 +1,46 @@
+// Command conformance-server runs the protocol conformance scenarios for
+// client implementations. See package conformance for the rules a client
+// must follow.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol/conformance"
+)
+
+func main() {
+	var addr string
+	var stepTimeout, ackTimeout time.Duration
+	flag.StringVar(&addr, "addr", ":8090", "listen address")
+	flag.DurationVar(&stepTimeout, "step-timeout", conformance.DefaultStepTimeout, "how long a client has for each step")
+	flag.DurationVar(&ackTimeout, "ack-timeout", conformance.DefaultAckTimeout, "how long a client has to acknowledge before messages are retransmitted")
+	flag.Parse()
+
+	server, err := conformance.NewServer(
+		conformance.WithStepTimeout(stepTimeout),
+		conformance.WithAckTimeout(ackTimeout),
+		conformance.WithResultHandler(func(result conformance.Result) {
+			if result.Passed {
+				log.Printf("PASS %s/%s (session %s)", result.Encoding, result.Scenario, result.SessionID)
+				return
+			}
+			log.Printf("FAIL %s/%s (session %s): %s", result.Encoding, result.Scenario, result.SessionID,
+				strings.Join(result.Failures, "; "))
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.Handle("/ws", server)
+
+	log.Printf("Conformance server listening on %s", addr)
+	log.Printf("Scenarios: %s", strings.Join(conformance.Scenarios, ", "))
+	log.Printf("Connect to ws://<host>%s/ws?scenario=<name>&encoding=<json|protobuf>", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
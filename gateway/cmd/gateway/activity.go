@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/devtail/gateway/internal/activity"
+)
+
+// Per-minute activity reporting for auto-suspend and usage, authenticated
+// with the log ingest token. Set by flag in main.
+var (
+	activityEndpoint     string
+	activityCPUThreshold float64
+)
+
+// newActivityReporter returns the reporter for terminal and chat activity,
+// or nil when reporting is not configured
+func newActivityReporter() *activity.Reporter {
+	if activityEndpoint == "" || logToken == "" {
+		return nil
+	}
+	return activity.New(activityEndpoint, logToken, activity.WithCPUThreshold(activityCPUThreshold))
+}
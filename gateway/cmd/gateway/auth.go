@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/internal/auth"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// Connect token and session expiry settings, set by flags in main
+var (
+	authPublicKey      string
+	vmID               string
+	enforceTokenExpiry bool
+	maxSessionLifetime time.Duration
+
+	// Bearer token operators present on /metrics
+	adminToken string
+)
+
+type grantKey struct{}
+
+// buildVerifier returns the connect token verifier, or nil when no control
+// plane key is configured and any client may connect
+func buildVerifier() (*auth.Verifier, error) {
+	if authPublicKey == "" {
+		if os.Getenv("GATEWAY_ENV") != "development" {
+			log.Warn().Msg("no --auth-public-key set: clients connect without a token")
+		}
+		return nil, nil
+	}
+
+	key, err := auth.ParsePublicKey(authPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --auth-public-key: %w", err)
+	}
+
+	log.Info().Str("vm_id", vmID).Msg("connect tokens required")
+	return auth.NewVerifier(key, vmID), nil
+}
+
+// authenticator adapts the verifier to the transports; nil if there is none
+func authenticator(verifier *auth.Verifier) ws.Authenticator {
+	if verifier == nil {
+		return nil
+	}
+
+	return func(token string) (ws.Grant, error) {
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			return ws.Grant{}, err
+		}
+
+		grant := ws.Grant{TokenID: claims.ID, Subject: claims.Subject, ReadOnly: claims.ReadOnly}
+		if claims.IssuedAt != nil {
+			grant.IssuedAt = claims.IssuedAt.Time
+		}
+		if claims.ExpiresAt != nil {
+			grant.ExpiresAt = claims.ExpiresAt.Time
+		}
+		return grant, nil
+	}
+}
+
+// sessionExpiry returns the handler options that end sessions at their
+// maximum lifetime, or when their token expires, as configured
+func sessionExpiry(authenticate ws.Authenticator) []ws.UnifiedHandlerOption {
+	var opts []ws.UnifiedHandlerOption
+	if maxSessionLifetime > 0 {
+		opts = append(opts, ws.WithMaxLifetime(maxSessionLifetime))
+	}
+	if enforceTokenExpiry {
+		if authenticate == nil {
+			log.Fatal().Msg("--enforce-token-expiry requires --auth-public-key")
+		}
+		opts = append(opts, ws.WithTokenExpiry(authenticate))
+	}
+	if len(opts) > 0 {
+		log.Info().
+			Bool("enforce_token_expiry", enforceTokenExpiry).
+			Dur("max_session_lifetime", maxSessionLifetime).
+			Msg("session expiry enabled")
+	}
+	return opts
+}
+
+// requireToken rejects requests without a valid connect token and passes the
+// grant on to the handler in the request context
+func requireToken(authenticate ws.Authenticator, next http.Handler) http.Handler {
+	if authenticate == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grant, err := authenticate(ws.RequestToken(r))
+		if err != nil {
+			log.Warn().Err(err).Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("rejected connection without valid token")
+			ws.RejectUnauthorized(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grantKey{}, grant)))
+	})
+}
+
+// requireAdmin lets through requests presenting token as a bearer token.
+// Connect tokens are for clients and grant nothing here.
+func requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			log.Warn().Str("remote", r.RemoteAddr).Str("path", r.URL.Path).Msg("rejected request without admin token")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestGrant returns the grant stored by requireToken
+func requestGrant(r *http.Request) ws.Grant {
+	grant, _ := r.Context().Value(grantKey{}).(ws.Grant)
+	return grant
+}
+
+// handleRevoke applies a revocation notice signed by the control plane: the
+// tokens it names stop verifying and sessions opened with them are ended
+func handleRevoke(verifier *auth.Verifier, sessions *ws.SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Revocation string `json:"revocation"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		revocation, err := verifier.ParseRevocation(req.Revocation)
+		if err != nil {
+			log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected revocation notice")
+			ws.RejectUnauthorized(w, err)
+			return
+		}
+
+		verifier.Revoke(revocation)
+		closed := sessions.Revoke(func(g ws.Grant) bool {
+			return revocation.Matches(g.TokenID, g.IssuedAt)
+		}, "connect token revoked")
+
+		log.Info().
+			Str("token_id", revocation.TokenID).
+			Time("issued_before", revocation.IssuedBefore).
+			Int("sessions_closed", closed).
+			Msg("connect tokens revoked")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"sessions_closed": closed})
+	}
+}
+
+// handleAnnounce passes an operator announcement signed by the control plane
+// on to every session, and to sessions opened until it expires
+func handleAnnounce(verifier *auth.Verifier, sessions *ws.SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Announcement string `json:"announcement"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		announcement, err := verifier.ParseAnnouncement(req.Announcement)
+		if err != nil {
+			log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected announcement")
+			ws.RejectUnauthorized(w, err)
+			return
+		}
+
+		delivered := sessions.Announce(announcement)
+
+		log.Info().
+			Str("announcement_id", announcement.ID).
+			Str("kind", string(announcement.Kind)).
+			Time("expires_at", announcement.ExpiresAt).
+			Int("sessions", delivered).
+			Msg("announcement sent")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"sessions": delivered})
+	}
+}
+
+// handleSuspend carries out a suspension notice signed by the control plane:
+// warning every session, calling the suspension off, or ending the sessions
+// just before the VM stops. A suspension a client already called off is
+// answered with 409, and the control plane leaves the VM running; one that
+// is no longer pending otherwise goes ahead, so notices can be retried.
+func handleSuspend(verifier *auth.Verifier, sessions *ws.SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Notice string `json:"notice"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		notice, err := verifier.ParseSuspendNotice(req.Notice)
+		if err != nil {
+			log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected suspension notice")
+			ws.RejectUnauthorized(w, err)
+			return
+		}
+
+		var (
+			count int
+			ok    = true
+		)
+		switch notice.Action {
+		case auth.SuspendSchedule:
+			count = sessions.ScheduleSuspend(protocol.SuspendScheduled{
+				ID:         notice.ID,
+				Reason:     notice.Reason,
+				SuspendAt:  notice.SuspendAt,
+				ResumeHint: notice.ResumeHint,
+			})
+		case auth.SuspendCancel:
+			count, _ = sessions.CancelSuspend(notice.ID, protocol.SuspendCancelledControlPlane)
+		case auth.SuspendNow:
+			count, ok = sessions.Suspend(protocol.VMSuspended{
+				ID:         notice.ID,
+				Reason:     notice.Reason,
+				ResumeHint: notice.ResumeHint,
+			})
+		}
+
+		if !ok {
+			log.Info().Str("suspend_id", notice.ID).Msg("suspension already called off")
+			http.Error(w, "suspension was called off", http.StatusConflict)
+			return
+		}
+
+		log.Info().
+			Str("suspend_id", notice.ID).
+			Str("action", notice.Action).
+			Str("reason", notice.Reason).
+			Int("sessions", count).
+			Msg("suspension notice applied")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"sessions": count})
+	}
+}
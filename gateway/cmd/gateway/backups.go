@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/internal/auth"
+	"github.com/devtail/gateway/internal/backup"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/rs/zerolog/log"
+)
+
+// Workspace backup settings, authenticated with the log ingest token. Set by
+// flag in main.
+var (
+	backupEndpoint string
+	backupInterval time.Duration
+	restoreBackup  int64
+)
+
+// backupRestoreTimeout bounds how long startup waits for a workspace backup
+// to download and unpack
+const backupRestoreTimeout = 30 * time.Minute
+
+// newBackupService returns the workspace backup service, or nil when backups
+// are not configured
+func newBackupService(workspaces *workspace.Registry) *backup.Service {
+	if backupEndpoint == "" || logToken == "" {
+		return nil
+	}
+	return backup.New(backupEndpoint, logToken, workspaces.List(), backup.WithInterval(backupInterval))
+}
+
+// restoreWorkspace unpacks the backup the VM was created from into the
+// default workspace before anything reads it. A workspace that already holds
+// files, as after a gateway restart, is left alone.
+func restoreWorkspace(ctx context.Context, service *backup.Service, workspaces *workspace.Registry) {
+	if restoreBackup == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backupRestoreTimeout)
+	defer cancel()
+
+	root := workspaces.Default().Root
+	restored, err := service.Restore(ctx, restoreBackup, root)
+	if err != nil {
+		log.Error().Err(err).Int64("backupID", restoreBackup).Msg("failed to restore workspace backup")
+		return
+	}
+	if restored {
+		log.Info().Int64("backupID", restoreBackup).Str("root", root).Msg("restored workspace from backup")
+	}
+}
+
+// handleBackup starts a backup of every workspace when the control plane,
+// about to delete the VM, asks for one. It answers at once with the
+// workspaces being backed up; the control plane waits for their backups to
+// be recorded before it deletes the machine. A request while a backup is
+// running does not start another.
+func handleBackup(ctx context.Context, verifier *auth.Verifier, service *backup.Service, workspaces *workspace.Registry) http.HandlerFunc {
+	var running atomic.Bool
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Request string `json:"request"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := verifier.ParseBackupRequest(req.Request); err != nil {
+			log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected backup request")
+			ws.RejectUnauthorized(w, err)
+			return
+		}
+
+		names := []string{}
+		for _, info := range workspaces.List() {
+			names = append(names, info.Name)
+		}
+
+		if running.CompareAndSwap(false, true) {
+			log.Info().Strs("workspaces", names).Msg("final workspace backup requested")
+			go func() {
+				defer running.Store(false)
+				if _, err := service.BackupAll(ctx); err != nil {
+					log.Error().Err(err).Msg("final workspace backup failed")
+				}
+			}()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"workspaces": names})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	"github.com/devtail/gateway/internal/chaos"
+	"github.com/rs/zerolog/log"
+)
+
+// Fault injection for resilience testing. Set by flags in main.
+var (
+	chaosSpec string
+	chaosSeed int64
+)
+
+// newChaos returns the fault injector described by --chaos, or nil when
+// chaos mode is off
+func newChaos() (*chaos.Injector, error) {
+	if chaosSpec == "" {
+		return nil, nil
+	}
+
+	config, err := chaos.ParseConfig(chaosSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	injector := chaos.New(config, seed)
+
+	log.Warn().
+		Str("faults", injector.String()).
+		Int64("seed", seed).
+		Msg("CHAOS MODE: injecting faults, do not use in production")
+	return injector, nil
+}
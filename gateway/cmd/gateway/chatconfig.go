@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// chatConfigFile is a JSON file overriding the chat backend configuration
+// from the environment; it is read again on SIGHUP. Set by flag in main.
+var chatConfigFile string
+
+// warmChat starts aider for every workspace at startup rather than on the
+// first chat. Set by flag in main.
+var warmChat bool
+
+// chatOptions returns the options for the chat backend
+func chatOptions() []chat.ReloadableOption {
+	if !warmChat {
+		return nil
+	}
+	return []chat.ReloadableOption{chat.WithWarmStart()}
+}
+
+// loadChatConfig returns the chat configuration from the environment with
+// chatConfigFile applied on top
+func loadChatConfig() (protocol.ChatConfig, error) {
+	config := chat.ConfigFromEnv(useMock)
+	if chatConfigFile == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(chatConfigFile)
+	if err != nil {
+		return config, err
+	}
+	var file protocol.ChatConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return config, fmt.Errorf("parse %s: %w", chatConfigFile, err)
+	}
+
+	if file.Backend != "" {
+		config.Backend = file.Backend
+	}
+	if file.Model != "" {
+		config.Model = file.Model
+	}
+	config.Parallelism = file.Parallelism
+	config.PlannerModel = file.PlannerModel
+	for key, val := range file.APIKeys {
+		config.APIKeys[key] = val
+	}
+	return config, nil
+}
+
+// reloadChatOnHangup reloads the chat backend on SIGHUP, without dropping
+// connections or terminals
+func reloadChatOnHangup(ctx context.Context, backend *chat.Reloadable) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	for {
+		select {
+		case <-hupCh:
+		case <-ctx.Done():
+			return
+		}
+
+		config, err := loadChatConfig()
+		if err != nil {
+			log.Error().Err(err).Msg("chat config reload failed, keeping the current backend")
+			continue
+		}
+		if _, err := backend.Reload(config); err != nil {
+			log.Error().Err(err).Msg("chat config reload failed, keeping the current backend")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/internal/contextsync"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// contextEndpoint is where conversation contexts are synced, authenticated
+// with the log ingest token. Set by flag in main.
+var contextEndpoint string
+
+// contextRestoreTimeout bounds how long startup waits for the control plane
+// to hand back saved contexts
+const contextRestoreTimeout = 15 * time.Second
+
+// newContextSyncer returns the syncer for the workspaces' conversation
+// contexts, or nil when syncing is not configured
+func newContextSyncer(workspaces *workspace.Registry) *contextsync.Syncer {
+	if contextEndpoint == "" || logToken == "" {
+		return nil
+	}
+
+	var synced []contextsync.Workspace
+	for _, info := range workspaces.List() {
+		synced = append(synced, contextsync.Workspace{Name: info.Name, Dir: chat.ContextDir(info.Root)})
+	}
+	return contextsync.New(contextEndpoint, logToken, synced)
+}
+
+// restoreContexts fetches the contexts saved by the user's earlier VMs before
+// chat starts, so it resumes the latest one. A control plane that cannot be
+// reached delays startup by at most contextRestoreTimeout.
+func restoreContexts(ctx context.Context, syncer *contextsync.Syncer) {
+	ctx, cancel := context.WithTimeout(ctx, contextRestoreTimeout)
+	defer cancel()
+
+	restored, err := syncer.Restore(ctx)
+	if err != nil {
+		log.Warn().Err(err).Int("restored", restored).Msg("failed to restore conversation contexts")
+		return
+	}
+	log.Info().Int("restored", restored).Str("endpoint", contextEndpoint).Msg("syncing conversation contexts with control plane")
+}
+
+// exportTranscripts answers chat_export requests with the conversations saved
+// in workspaces
+func exportTranscripts(workspaces *workspace.Registry) func(ctx context.Context, export protocol.ChatExport) (protocol.ChatTranscript, error) {
+	return func(ctx context.Context, export protocol.ChatExport) (protocol.ChatTranscript, error) {
+		return chat.ExportTranscript(ctx, workspaces, export)
+	}
+}
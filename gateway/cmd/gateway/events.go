@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/devtail/gateway/internal/notify"
+)
+
+// Reporting AI replies that finish while no client is connected, so the
+// control plane can push the user a notification. Authenticated with the
+// log ingest token. Set by flag in main.
+var eventsEndpoint string
+
+// newNotifier returns the notifier for events the user is told of while
+// away, or nil when reporting is not configured
+func newNotifier(connected func() bool) *notify.Notifier {
+	if eventsEndpoint == "" || logToken == "" {
+		return nil
+	}
+	return notify.New(eventsEndpoint, logToken, connected)
+}
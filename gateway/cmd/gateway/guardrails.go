@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/devtail/gateway/internal/guard"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Guardrails for destructive shell commands. Set by flags in main.
+var (
+	guardrails     bool
+	guardrailsFile string
+)
+
+// newGuardrails returns the guardrails --guardrails and --guardrails-file
+// describe, or nil when they are off
+func newGuardrails(sessions *ws.SessionRegistry) (*ws.Guardrails, error) {
+	if !guardrails && guardrailsFile == "" {
+		return nil, nil
+	}
+
+	policy := guard.Default()
+	if guardrailsFile != "" {
+		var err error
+		if policy, err = guard.Load(guardrailsFile); err != nil {
+			return nil, err
+		}
+	}
+	log.Info().
+		Int("deny", len(policy.Deny)).
+		Int("allow", len(policy.Allow)).
+		Int("confirm", len(policy.Confirm)).
+		Msg("guarding shell commands")
+	return ws.NewGuardrails(policy, sessions), nil
+}
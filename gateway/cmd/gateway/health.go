@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/internal/diagnostics"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// drainDelay is how long the gateway keeps serving after SIGTERM with
+// /readyz failing, so load balancers stop routing new clients first. Set by
+// flag in main.
+var drainDelay time.Duration
+
+// readiness tracks whether the gateway should receive new connections
+type readiness struct {
+	draining atomic.Bool
+	limiter  *ws.ConnLimiter
+}
+
+// handleHealth answers /health with the latest self-check and the names of
+// the workspaces served, which the control plane lists for clients. It never
+// fails the request: a gateway without a working AI backend still serves
+// terminals, and /readyz is what load balancers act on.
+func handleHealth(checker *diagnostics.Checker, workspaces *workspace.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for _, info := range workspaces.List() {
+			names = append(names, info.Name)
+		}
+		body := map[string]interface{}{
+			"status":     "healthy",
+			"service":    "gateway",
+			"workspaces": names,
+		}
+		if report, ok := checker.Latest(); ok {
+			body["diagnostics"] = report
+		}
+		writeHealth(w, http.StatusOK, body)
+	}
+}
+
+// logDiagnostics logs a self-check, one line per check that is not ok
+func logDiagnostics(report protocol.Diagnostics) {
+	for _, check := range report.Checks {
+		switch check.Status {
+		case protocol.DiagnosticFail:
+			log.Error().Str("check", check.Name).Str("detail", check.Detail).Msg("self-check failed")
+		case protocol.DiagnosticWarn:
+			log.Warn().Str("check", check.Name).Str("detail", check.Detail).Msg("self-check warning")
+		}
+	}
+	log.Info().Str("status", report.Status).Msg("self-check complete")
+}
+
+// handleLiveness answers /healthz: the process is up and serving HTTP
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]interface{}{
+		"status":  "alive",
+		"service": "gateway",
+	})
+}
+
+// handleReadiness answers /readyz: 503 while draining, when the working
+// directory is unusable or when the connection limit is reached
+func (rd *readiness) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	if rd.draining.Load() {
+		fail("draining", "shutting down")
+	}
+
+	if info, err := os.Stat(workDir); err != nil {
+		fail("workdir", err.Error())
+	} else if !info.IsDir() {
+		fail("workdir", "not a directory")
+	} else {
+		checks["workdir"] = "ok"
+	}
+
+	if maxConnections > 0 && rd.limiter.Count() >= maxConnections {
+		fail("connections", "limit reached")
+	} else {
+		checks["connections"] = "ok"
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, map[string]interface{}{
+		"status":  status,
+		"service": "gateway",
+		"checks":  checks,
+	})
+}
+
+func writeHealth(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
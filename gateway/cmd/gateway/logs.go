@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/devtail/gateway/internal/logship"
+)
+
+// Log shipping to the control plane. Set by flags in main.
+var (
+	logEndpoint string
+	logToken    string
+)
+
+// newLogShipper returns the shipper for the control plane's ingest endpoint,
+// or nil when shipping is not configured
+func newLogShipper() *logship.Shipper {
+	if logEndpoint == "" || logToken == "" {
+		return nil
+	}
+	return logship.New(logEndpoint, logToken)
+}
+
+// reportPanics reports panics in request handlers before net/http recovers
+// them, so a crashing connection shows up in the control plane
+func reportPanics(shipper *logship.Shipper, next http.Handler) http.Handler {
+	if shipper == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer shipper.Recover()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+
+	"github.com/devtail/gateway/internal/queue"
+)
+
+// Where and how much the gateway keeps for clients that disconnected
+// mid-reply. Set by flag in main.
+var (
+	mailboxDir   string
+	mailboxBytes int
+	mailboxTTL   time.Duration
+)
+
+// openMailboxes loads the messages kept for disconnected clients, on disk
+// with --mailbox-dir or in memory without
+func openMailboxes() (*queue.Mailboxes, error) {
+	return queue.OpenMailboxes(mailboxDir, mailboxBytes, mailboxTTL)
+}
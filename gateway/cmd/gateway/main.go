@@ -2,34 +2,76 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/devtail/gateway/internal/activity"
+	"github.com/devtail/gateway/internal/audit"
 	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/internal/diagnostics"
+	"github.com/devtail/gateway/internal/logship"
+	"github.com/devtail/gateway/internal/queue"
+	"github.com/devtail/gateway/internal/redact"
+	"github.com/devtail/gateway/internal/tasks"
 	"github.com/devtail/gateway/internal/terminal"
 	ws "github.com/devtail/gateway/internal/websocket"
+	pb "github.com/devtail/gateway/pkg/protocol/pb"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 )
 
 var (
-	port     string
-	workDir  string
-	logLevel string
-	useMock  bool
+	port        string
+	workDir     string
+	logLevel    string
+	useMock     bool
+	auditLog    string
+	dedupWindow time.Duration
+	reapGrace   time.Duration
+
+	// Patterns redacted on top of redact.Defaults
+	redactPatterns []string
+
+	// TLS and experimental WebTransport
+	tlsCert          string
+	tlsKey           string
+	webTransportAddr string
+	grpcAddr         string
+
+	allowedOrigins []string
+
+	maxConnections          int
+	maxConnectionsPerClient int
+
+	terminalOutputRate int
+	terminalRecording  int
+	terminalTmux       string
+	terminalPrompt     bool
+	previewURL         string
+
+	// Sessions may only watch, for demos
+	readOnly bool
+
+	// Relay mode
+	relayUpstreams        map[string]string
+	relayUpstreamTemplate string
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
 }
 
 func main() {
@@ -40,9 +82,59 @@ func main() {
 	}
 
 	rootCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to listen on")
-	rootCmd.Flags().StringVarP(&workDir, "workdir", "w", ".", "Working directory for Aider")
+	rootCmd.Flags().StringVarP(&workDir, "workdir", "w", ".", "Root of the default workspace, where chats and terminals start")
+	rootCmd.Flags().StringToStringVar(&extraWorkspaces, "workspace", nil, "Additional project root clients can choose by name, e.g. api=/home/dev/api (repeatable)")
 	rootCmd.Flags().StringVarP(&logLevel, "log-level", "l", "info", "Log level (debug, info, warn, error)")
 	rootCmd.Flags().BoolVar(&useMock, "mock", false, "Use mock Aider implementation")
+	rootCmd.Flags().StringVar(&auditLog, "audit-log", "", "Record terminal commands to this audit log file (disabled if empty)")
+	rootCmd.Flags().StringArrayVar(&redactPatterns, "redact-pattern", nil, "Regular expression for secrets to scrub from logs, the audit log, saved chat contexts and AI prompts, on top of the built-in API key, token and private key patterns; only the first group is replaced if it has one (repeatable)")
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	rootCmd.Flags().StringSliceVar(&acmeDomains, "acme-domain", nil, "Obtain certificates from Let's Encrypt for these domains (repeatable)")
+	rootCmd.Flags().StringVar(&acmeEmail, "acme-email", "", "Contact email for the ACME account")
+	rootCmd.Flags().StringVar(&acmeCacheDir, "acme-cache", "/var/lib/devtail/acme", "Directory for ACME account keys and certificates")
+	rootCmd.Flags().StringVar(&acmeHTTPAddr, "acme-http-addr", ":80", "Address for ACME HTTP-01 challenges (empty to rely on TLS-ALPN on port 443)")
+	rootCmd.Flags().BoolVar(&requireTLS, "require-tls", false, "Reject ws:// and http:// client connections unless a proxy reports X-Forwarded-Proto: https")
+	rootCmd.Flags().StringVar(&webTransportAddr, "webtransport-addr", "", "Experimental: serve WebTransport over HTTP/3 on this UDP address, e.g. :4433 (requires --tls-cert and --tls-key)")
+	rootCmd.Flags().StringVar(&grpcAddr, "grpc-addr", "", "Serve the gateway protocol over gRPC on this address, e.g. :9090 (disabled if empty)")
+	rootCmd.Flags().StringSliceVar(&allowedOrigins, "allowed-origins", nil, "Browser origins allowed to connect, e.g. https://app.devtail.dev or https://*.devtail.dev; \"*\" allows all (default: same origin only)")
+	rootCmd.Flags().DurationVar(&drainDelay, "drain-delay", 5*time.Second, "How long to keep serving with /readyz failing after SIGTERM")
+	rootCmd.Flags().IntVar(&maxConnections, "max-connections", 64, "Maximum concurrent client sessions across all transports (0 for no limit)")
+	rootCmd.Flags().IntVar(&maxConnectionsPerClient, "max-connections-per-client", 8, "Maximum concurrent sessions per token, or per IP for clients without one (0 for no limit)")
+	rootCmd.Flags().IntVar(&terminalOutputRate, "terminal-output-rate", terminal.DefaultOutputRate, "Maximum output per terminal in bytes per second; output past it is dropped with a marker saying how much (0 for no limit)")
+	rootCmd.Flags().IntVar(&terminalRecording, "terminal-recording-size", terminal.DefaultRecordingSize, "Bytes of each terminal's latest output kept for terminal_export (0 to record nothing)")
+	rootCmd.Flags().StringVar(&terminalTmux, "terminal-tmux-socket", "", "Run terminals in sessions of the tmux server on this socket (tmux -L), so shells survive restarts and can be attached over SSH (empty to run shells directly)")
+	rootCmd.Flags().BoolVar(&terminalPrompt, "terminal-prompt", true, "Give bash terminals a prompt showing the directory and git branch")
+	rootCmd.Flags().StringVar(&previewURL, "preview-url", "", "URL a port in the VM is previewed at, with {port} for the port, e.g. https://{port}-vm.preview.devtail.dev; terminals get devtail_preview PORT to print it")
+	rootCmd.Flags().StringVar(&authPublicKey, "auth-public-key", "", "Control plane public key (base64 Ed25519); when set, clients must present a signed connect token")
+	rootCmd.Flags().StringVar(&vmID, "vm-id", "", "ID of the VM this gateway runs on; connect tokens for other VMs are rejected")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token operators present to read /metrics (not served if empty)")
+	rootCmd.Flags().BoolVar(&enforceTokenExpiry, "enforce-token-expiry", false, "End sessions when their connect token expires unless the client sends a fresh one when asked (requires --auth-public-key)")
+	rootCmd.Flags().DurationVar(&maxSessionLifetime, "max-session-lifetime", 0, "End sessions this long after they start, even if they re-authenticate (0 for no limit)")
+	rootCmd.Flags().StringToStringVar(&relayUpstreams, "relay-upstream", nil, "Relay mode: gateway URL for a VM, e.g. vm-1=ws://100.64.0.2:8080/ws (repeatable)")
+	rootCmd.Flags().StringVar(&relayUpstreamTemplate, "relay-upstream-template", "", "Relay mode: gateway URL for any VM, %s is replaced by the VM ID, e.g. ws://devtail-%s:8080/ws")
+	rootCmd.Flags().StringVar(&logEndpoint, "log-endpoint", "", "Ship logs and panic reports to this control plane URL, e.g. https://control.devtail.com/api/v1/ingest/logs (disabled if empty)")
+	rootCmd.Flags().StringVar(&logToken, "log-token", "", "Ingest token the control plane issued for this VM, required with --log-endpoint, --context-endpoint, --backup-endpoint, --activity-endpoint and --events-endpoint")
+	rootCmd.Flags().StringVar(&contextEndpoint, "context-endpoint", "", "Sync AI conversation contexts with this control plane URL so a recreated VM resumes them, e.g. https://control.devtail.com/api/v1/ingest/contexts (disabled if empty)")
+	rootCmd.Flags().StringVar(&backupEndpoint, "backup-endpoint", "", "Back up workspaces through this control plane URL, e.g. https://control.devtail.com/api/v1/ingest/backups (disabled if empty)")
+	rootCmd.Flags().DurationVar(&backupInterval, "backup-interval", 24*time.Hour, "How often to back up every workspace with --backup-endpoint (0 for on-demand only)")
+	rootCmd.Flags().StringVar(&activityEndpoint, "activity-endpoint", "", "Report per-minute terminal, AI and task CPU activity to this control plane URL for auto-suspend and usage, e.g. https://control.devtail.com/api/v1/ingest/activity (disabled if empty)")
+	rootCmd.Flags().StringVar(&eventsEndpoint, "events-endpoint", "", "Report AI replies that finish while no client is connected to this control plane URL, which notifies the user, e.g. https://control.devtail.com/api/v1/ingest/events (disabled if empty)")
+	rootCmd.Flags().Float64Var(&activityCPUThreshold, "activity-cpu-threshold", activity.DefaultCPUThreshold, "Share of a CPU core tasks outside the gateway must use over a minute for it to count as activity (0 counts only keystrokes and AI requests)")
+	rootCmd.Flags().Int64Var(&restoreBackup, "restore-backup", 0, "ID of a backup to unpack into the default workspace at startup if it is empty")
+	rootCmd.Flags().IntVar(&timelineSessions, "timeline-sessions", 100, "How many ended sessions keep their timeline for GET /sessions")
+	rootCmd.Flags().StringVar(&chaosSpec, "chaos", "", "Testing only: inject faults, e.g. drop=0.05,chat-delay=3s,kill=0.1,kill-every=30s (disabled if empty)")
+	rootCmd.Flags().Int64Var(&chaosSeed, "chaos-seed", 0, "Seed for --chaos, to replay the same faults (default: random)")
+	rootCmd.Flags().DurationVar(&dedupWindow, "dedup-window", 5*time.Minute, "How long to remember inbound message IDs for duplicate detection (0 disables)")
+	rootCmd.Flags().StringVar(&chatConfigFile, "chat-config", "", "JSON file overriding the chat backend, model and API keys from the environment; reloaded on SIGHUP")
+	rootCmd.Flags().StringVar(&mailboxDir, "mailbox-dir", "", "Directory keeping chat replies and reliable messages for disconnected clients, so they survive a gateway restart (in memory if empty)")
+	rootCmd.Flags().IntVar(&mailboxBytes, "mailbox-bytes", queue.DefaultMailboxBytes, "Most bytes of messages kept per disconnected session; the oldest are dropped first")
+	rootCmd.Flags().DurationVar(&mailboxTTL, "mailbox-ttl", queue.DefaultMailboxTTL, "How long messages are kept for a disconnected session after the last one")
+	rootCmd.Flags().BoolVar(&warmChat, "warm-chat", false, "Start aider for every workspace at startup and after each chat backend reload, so the first message of a session streams without waiting for it")
+	rootCmd.Flags().BoolVar(&guardrails, "guardrails", false, "Ask the user to confirm destructive shell commands, such as rm -rf, git push --force and curl | sh, typed into terminals or run by chats and tasks")
+	rootCmd.Flags().StringVar(&guardrailsFile, "guardrails-file", "", "JSON policy of commands to deny, allow and confirm, added to the --guardrails defaults unless it replaces them; implies --guardrails")
+	rootCmd.Flags().BoolVar(&readOnly, "read-only", false, "Make every session read-only, for demos: terminals can be watched but not typed into, chats may only /ask, and nothing else that changes the workspace is accepted")
+	rootCmd.Flags().DurationVar(&reapGrace, "reap-grace", ws.DefaultReapGrace, "How long past the 60s pong timeout a session without heartbeats is kept before its resources are reaped")
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal().Err(err).Msg("failed to execute command")
@@ -50,45 +142,365 @@ func main() {
 }
 
 func run(cmd *cobra.Command, args []string) {
-	setupLogging()
+	redactor, err := redact.New(append(append([]string(nil), redact.Defaults...), redactPatterns...))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --redact-pattern")
+	}
+	redact.SetDefault(redactor)
+
+	shipper := newLogShipper()
+	setupLogging(shipper)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if shipper != nil {
+		defer shipper.Recover()
+
+		shipCtx, stopShipping := context.WithCancel(context.Background())
+		shipped := make(chan struct{})
+		go func() {
+			shipper.Run(shipCtx)
+			close(shipped)
+		}()
+		// Runs after the server has shut down, so its last lines are sent
+		defer func() {
+			stopShipping()
+			<-shipped
+		}()
+		log.Info().Str("endpoint", logEndpoint).Msg("shipping logs to control plane")
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	chatHandler := chat.NewHandler(workDir, useMock)
+	injector, err := newChaos()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid chaos configuration")
+	}
+
+	workspaces, err := buildWorkspaces()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid workspace configuration")
+	}
+	for _, info := range workspaces.List() {
+		log.Info().Str("name", info.Name).Str("root", info.Root).Bool("default", info.Default).Msg("serving workspace")
+	}
+
+	// Self-check in the background; the API key check is a network call
+	checker := diagnostics.New(workspaces.Default().Root, diagnostics.WithMock(useMock))
+	go logDiagnostics(checker.Run(ctx))
+
+	// The workspace is restored before anything reads it
+	backups := newBackupService(workspaces)
+	if backups != nil {
+		restoreWorkspace(ctx, backups, workspaces)
+		go backups.Run(ctx)
+	}
+
+	// Restored contexts must be on disk before chat picks the one to resume.
+	// The last sync runs after chat has closed and saved its contexts.
+	if syncer := newContextSyncer(workspaces); syncer != nil {
+		restoreContexts(ctx, syncer)
+
+		syncCtx, stopSyncing := context.WithCancel(context.Background())
+		synced := make(chan struct{})
+		go func() {
+			syncer.Run(syncCtx)
+			close(synced)
+		}()
+		defer func() {
+			stopSyncing()
+			<-synced
+		}()
+	}
+
+	chatConfig, err := loadChatConfig()
+	if err != nil {
+		log.Fatal().Err(err).Str("path", chatConfigFile).Msg("invalid chat configuration")
+	}
+	chatHandler, err := chat.NewReloadable(workspaces, chatConfig, chatOptions()...)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", chatConfigFile).Msg("invalid chat configuration")
+	}
 	defer chatHandler.Close()
+	go reloadChatOnHangup(ctx, chatHandler)
+
+	// Activity of the last minute is sent after the server has shut down
+	reporter := newActivityReporter()
+	if reporter != nil {
+		reportCtx, stopReporting := context.WithCancel(context.Background())
+		reported := make(chan struct{})
+		go func() {
+			reporter.Run(reportCtx)
+			close(reported)
+		}()
+		defer func() {
+			stopReporting()
+			<-reported
+		}()
+		log.Info().Str("endpoint", activityEndpoint).Msg("reporting activity to control plane")
+	}
+
+	// Replies that finish while every client is away are reported, so the
+	// user is notified to come back to them
+	sessions := ws.NewSessionRegistry()
+	go sessions.RunReaper(ctx, reapGrace)
+	notifier := newNotifier(func() bool { return sessions.Count() > 0 })
+	if notifier != nil {
+		log.Info().Str("endpoint", eventsEndpoint).Msg("reporting finished AI tasks to control plane")
+	}
+	sessionChat := injector.Chat(notifier.Chat(reporter.Chat(chatHandler)))
+
+	// Destructive commands wait for the user's approval
+	guards, err := newGuardrails(sessions)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", guardrailsFile).Msg("invalid guardrails policy")
+	}
+
+	shellInit := terminal.ShellInit{Prompt: terminalPrompt, PreviewURL: previewURL}
+	if err := shellInit.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid terminal shell setup")
+	}
 
 	// Create terminal manager
-	terminalManager := terminal.NewManager(
+	terminalOpts := []terminal.ManagerOption{
 		terminal.WithMaxSessions(20),
 		terminal.WithSessionTimeout(30*time.Minute),
-		terminal.WithDefaultShell("/bin/bash"),
-	)
+		terminal.WithDefaultShell(terminal.DefaultShell),
+		terminal.WithWorkspaces(workspaces),
+		terminal.WithOutputRate(terminalOutputRate),
+		terminal.WithRecordingSize(terminalRecording),
+		terminal.WithShellInit(shellInit),
+		terminal.WithNotificationHandler(func(terminalID string, n terminal.Notification) { sessions.NotifyTerminal(terminalID, n) }),
+	}
+	if reporter != nil {
+		terminalOpts = append(terminalOpts, terminal.WithInputCounter(reporter.Keystrokes))
+	}
+	if guards != nil {
+		terminalOpts = append(terminalOpts, terminal.WithGuard(guards.Terminal))
+	}
+
+	if terminalTmux != "" {
+		tmux, err := terminal.NewTmux(terminalTmux)
+		if err != nil {
+			log.Fatal().Err(err).Msg("terminals cannot run in tmux")
+		}
+		terminalOpts = append(terminalOpts, terminal.WithTmuxServer(tmux))
+		log.Info().Str("socket", terminalTmux).Msg("terminals run in tmux")
+	}
+
+	if auditLog != "" {
+		auditLogger, err := audit.NewFileLogger(auditLog)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", auditLog).Msg("failed to open audit log")
+		}
+		defer auditLogger.Close()
+
+		terminalOpts = append(terminalOpts, terminal.WithAuditLogger(auditLogger))
+		log.Info().Str("path", auditLog).Msg("terminal command audit enabled")
+	}
+
+	terminalManager := terminal.NewManager(terminalOpts...)
 	defer terminalManager.Close()
+	go injector.KillTerminals(ctx, terminalManager)
+
+	// Clients refresh open files when the AI or a build changes them
+	fileFeed := chat.NewFileFeed(workspaces.List())
+	defer fileFeed.Close()
+
+	// Tasks keep running while their user is away, until the gateway exits
+	taskRunner := tasks.New(sessionChat, workspaces)
+	defer taskRunner.Close()
+
+	// Replies that finish while the client is away wait for it to resume
+	mailboxes, err := openMailboxes()
+	if err != nil {
+		log.Fatal().Err(err).Str("path", mailboxDir).Msg("failed to open mailboxes")
+	}
+
+	timelines := ws.NewTimelineStore(timelineSessions)
+	handlerOpts := []ws.UnifiedHandlerOption{
+		ws.WithSessionRegistry(sessions),
+		ws.WithMailboxes(mailboxes),
+		ws.WithPlans(ws.NewPlans()),
+		ws.WithTasks(taskRunner),
+		ws.WithTimelines(timelines),
+		ws.WithDedupWindow(dedupWindow),
+		ws.WithDiagnostics(checker.Report),
+		ws.WithChatConfig(chatHandler.Update),
+		ws.WithWorkspaces(workspaces.List),
+		ws.WithFileChanges(fileFeed.Subscribe),
+		ws.WithChatExport(exportTranscripts(workspaces)),
+	}
+	if backups != nil {
+		handlerOpts = append(handlerOpts, ws.WithBackups(backups.Backup))
+	}
+	if guards != nil {
+		handlerOpts = append(handlerOpts, ws.WithGuardrails(guards))
+	}
+	if readOnly {
+		log.Info().Msg("sessions are read-only")
+		handlerOpts = append(handlerOpts, ws.WithReadOnly())
+	}
+
+	verifier, err := buildVerifier()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid auth configuration")
+	}
+	authenticate := authenticator(verifier)
+	handlerOpts = append(handlerOpts, sessionExpiry(authenticate)...)
+
+	// Handlers for transports other than WebSocket
+	newHandler := func(transport ws.Transport, opts ...ws.UnifiedHandlerOption) *ws.UnifiedHandler {
+		return ws.NewTransportHandler(injector.Transport(transport), sessionChat, terminalManager, append(opts, handlerOpts...)...)
+	}
+
+	// Shared by every transport so the caps are gateway-wide
+	limiter := ws.NewConnLimiter(maxConnections, maxConnectionsPerClient)
+	serverOpts := []ws.ServerOption{
+		ws.WithConnLimiter(limiter),
+		ws.WithAuthenticator(authenticate),
+	}
+
+	// HTTP fallback for networks that break WebSockets
+	fallback := ws.NewFallbackServer(newHandler, serverOpts...)
+
+	origins := originPolicy()
+	upgrader.CheckOrigin = origins.Check
+
+	tlsConfig, acmeHandler, err := buildTLSConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid tls configuration")
+	}
+
+	// Client-facing endpoints; health stays reachable for probes
+	var wsHandler http.Handler = requireToken(authenticate, handleWebSocket(newHandler, limiter))
+	var fallbackHandler http.Handler = origins.CORS(http.StripPrefix("/http", fallback))
+	if requireTLS {
+		wsHandler = requireSecure(wsHandler)
+		fallbackHandler = requireSecure(fallbackHandler)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", handleWebSocket(chatHandler, terminalManager))
-	mux.HandleFunc("/health", handleHealth)
+	mux.Handle("/ws", wsHandler)
+	mux.Handle("/http/", fallbackHandler)
+
+	if len(relayUpstreams) > 0 || relayUpstreamTemplate != "" {
+		relay := ws.NewRelayServer(ws.StaticUpstreams(relayUpstreams, relayUpstreamTemplate))
+
+		var relayHandler http.Handler = requireToken(authenticate, handleRelay(relay, limiter))
+		if requireTLS {
+			relayHandler = requireSecure(relayHandler)
+		}
+		mux.Handle("/relay", relayHandler)
+		log.Info().Int("upstreams", len(relayUpstreams)).Msg("relay mode enabled")
+	}
+	ready := &readiness{limiter: limiter}
+	mux.HandleFunc("/health", handleHealth(checker, workspaces))
+	mux.HandleFunc("/healthz", handleLiveness)
+	mux.HandleFunc("/readyz", ready.handleReadiness)
+	if adminToken != "" {
+		var metricsHandler http.Handler = requireAdmin(adminToken, handleMetrics(sessions, limiter))
+		if requireTLS {
+			metricsHandler = requireSecure(metricsHandler)
+		}
+		mux.Handle("/metrics", metricsHandler)
+	}
+	schemaHandler := origins.CORS(handleSchema())
+	mux.Handle("/schema", schemaHandler)
+	mux.Handle("/schema/", schemaHandler)
+	var sessionsHandler http.Handler = requireToken(authenticate, handleSessions(timelines))
+	if requireTLS {
+		sessionsHandler = requireSecure(sessionsHandler)
+	}
+	mux.Handle("/sessions", sessionsHandler)
+	mux.Handle("/sessions/", sessionsHandler)
+	if verifier != nil {
+		mux.HandleFunc("/auth/revoke", handleRevoke(verifier, sessions))
+		mux.HandleFunc("/announce", handleAnnounce(verifier, sessions))
+		mux.HandleFunc("/suspend", handleSuspend(verifier, sessions))
+		if backups != nil {
+			mux.HandleFunc("/backup", handleBackup(ctx, verifier, backups, workspaces))
+		}
+	}
 
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
+		Handler:      reportPanics(shipper, mux),
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
+	if acmeHandler != nil && acmeHTTPAddr != "" {
+		go func() {
+			log.Info().Str("addr", acmeHTTPAddr).Msg("serving acme http-01 challenges")
+			if err := http.ListenAndServe(acmeHTTPAddr, acmeHandler); err != nil {
+				log.Error().Err(err).Msg("acme challenge listener failed")
+			}
+		}()
+	}
+
+	if webTransportAddr != "" {
+		wt, err := ws.NewWebTransportServer(webTransportAddr, tlsCert, tlsKey, newHandler, origins.Check, serverOpts...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to configure webtransport")
+		}
+		defer wt.Close()
+
+		go func() {
+			log.Info().Str("addr", webTransportAddr).Msg("starting experimental webtransport listener")
+			if err := wt.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("webtransport listener failed")
+			}
+		}()
+	}
+
+	if grpcAddr != "" {
+		grpcServer, err := newGRPCServer(newHandler, serverOpts)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to configure grpc")
+		}
+		defer grpcServer.Stop()
+
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatal().Err(err).Str("addr", grpcAddr).Msg("failed to listen for grpc")
+		}
+
+		go func() {
+			log.Info().Str("addr", grpcAddr).Msg("starting grpc server")
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Error().Err(err).Msg("grpc server failed")
+			}
+		}()
+	}
+
 	go func() {
-		log.Info().Str("port", port).Msg("starting gateway server")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Info().Str("port", port).Bool("tls", tlsConfig != nil).Msg("starting gateway server")
+
+		var err error
+		if tlsConfig != nil {
+			// Certificates come from server.TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("server failed")
 		}
 	}()
 
 	<-sigCh
+
+	// Fail readiness and keep serving briefly so load balancers drain us
+	ready.draining.Store(true)
+	if drainDelay > 0 {
+		log.Info().Dur("delay", drainDelay).Msg("draining before shutdown")
+		time.Sleep(drainDelay)
+	}
 	log.Info().Msg("shutting down server")
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 10*time.Second)
@@ -99,15 +511,33 @@ func run(cmd *cobra.Command, args []string) {
 	}
 }
 
-func handleWebSocket(chatHandler chat.Handler, terminalManager *terminal.Manager) http.HandlerFunc {
+func handleWebSocket(newHandler ws.HandlerFactory, limiter *ws.ConnLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		release, limitErr := limiter.Acquire(ws.ClientKey(r))
+		if limitErr == nil {
+			defer release()
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Error().Err(err).Msg("websocket upgrade failed")
 			return
 		}
 
-		handler := ws.NewUnifiedHandler(conn, chatHandler, terminalManager)
+		if limitErr != nil {
+			log.Warn().Err(limitErr).Str("remote", r.RemoteAddr).Msg("rejected websocket connection")
+			ws.RejectWebSocket(conn, limitErr)
+			return
+		}
+
+		handler := newHandler(ws.NewWebSocketTransport(conn),
+			ws.WithGrant(requestGrant(r)),
+			ws.WithClient(ws.ClientInfo{
+				Transport:  "websocket",
+				RemoteAddr: r.RemoteAddr,
+				UserAgent:  r.UserAgent(),
+			}),
+		)
 		
 		log.Info().
 			Str("remote", r.RemoteAddr).
@@ -122,13 +552,123 @@ func handleWebSocket(chatHandler chat.Handler, terminalManager *terminal.Manager
 	}
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"healthy","service":"gateway"}`))
+// handleRelay serves clients that reach several VM gateways through this one
+func handleRelay(relay *ws.RelayServer, limiter *ws.ConnLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, limitErr := limiter.Acquire(ws.ClientKey(r))
+		if limitErr == nil {
+			defer release()
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Error().Err(err).Msg("relay upgrade failed")
+			return
+		}
+
+		if limitErr != nil {
+			log.Warn().Err(limitErr).Str("remote", r.RemoteAddr).Msg("rejected relay connection")
+			ws.RejectWebSocket(conn, limitErr)
+			return
+		}
+
+		// Forward the client's credentials to the VM gateways
+		header := http.Header{}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			header.Set("Authorization", auth)
+		} else if token := r.URL.Query().Get("token"); token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+
+		log.Info().Str("remote", r.RemoteAddr).Msg("new relay connection")
+		relay.Serve(ws.NewWebSocketTransport(conn), header)
+		log.Info().Str("remote", r.RemoteAddr).Msg("relay connection closed")
+	}
+}
+
+func newGRPCServer(newHandler ws.HandlerFactory, serverOpts []ws.ServerOption) (*grpc.Server, error) {
+	service, err := ws.NewGRPCServer(newHandler, serverOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    30 * time.Second,
+			Timeout: 60 * time.Second,
+		}),
+	}
+	if tlsCert != "" && tlsKey != "" {
+		creds, err := credentials.NewServerTLSFromFile(tlsCert, tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("load grpc tls credentials: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	server := grpc.NewServer(opts...)
+	pb.RegisterGatewayServer(server, service)
+	return server, nil
+}
+
+// originPolicy builds the browser origin policy. In development, with no
+// explicit list, every origin is allowed so local web clients just work.
+func originPolicy() *ws.OriginPolicy {
+	if len(allowedOrigins) == 0 && os.Getenv("GATEWAY_ENV") == "development" {
+		log.Warn().Msg("development mode: accepting connections from any origin")
+		return ws.AllowAllOrigins()
+	}
+	return ws.NewOriginPolicy(allowedOrigins)
+}
+
+
+func handleMetrics(sessions *ws.SessionRegistry, limiter *ws.ConnLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queues := sessions.QueueStats()
+
+		// Totals only: session IDs name sessions to anyone who reads them
+		stale := 0
+		var totals queueTotals
+		for _, q := range queues {
+			if q.Stale {
+				stale++
+			}
+			totals.Pending += q.Pending
+			totals.InFlight += q.InFlight
+			totals.Retries += q.Retries
+			totals.Expired += q.Expired
+			totals.Dropped += q.Dropped
+			totals.OldestPendingMs = max(totals.OldestPendingMs, q.OldestPendingMs)
+			totals.OldestInFlightMs = max(totals.OldestInFlightMs, q.OldestInFlightMs)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessions":        len(queues),
+			"stale_sessions":  stale,
+			"reaped":          sessions.ReapStats(),
+			"connections":     limiter.Count(),
+			"max_connections": maxConnections,
+			"queues":          totals,
+		})
+	}
+}
+
+// queueTotals sums the outbound queues of every session; the oldest
+// messages are the oldest in any queue
+type queueTotals struct {
+	Pending          int    `json:"pending"`
+	InFlight         int    `json:"in_flight"`
+	Retries          uint64 `json:"retries"`
+	Expired          uint64 `json:"expired"`
+	Dropped          uint64 `json:"dropped"`
+	OldestPendingMs  int64  `json:"oldest_pending_ms"`
+	OldestInFlightMs int64  `json:"oldest_in_flight_ms"`
 }
 
-func setupLogging() {
+// setupLogging configures the global logger. With a shipper, every line is
+// also queued for the control plane.
+func setupLogging(shipper *logship.Shipper) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
 	level, err := zerolog.ParseLevel(logLevel)
@@ -138,7 +678,13 @@ func setupLogging() {
 
 	zerolog.SetGlobalLevel(level)
 
+	var out io.Writer = os.Stderr
 	if os.Getenv("GATEWAY_ENV") == "development" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		out = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	if shipper != nil {
+		out = zerolog.MultiLevelWriter(out, shipper)
 	}
+	// Debug logs include terminal and aider output; shipped logs leave the VM
+	log.Logger = log.Output(redact.Default().Writer(out))
 }
\ No newline at end of file
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/devtail/gateway/pkg/protocol/schema"
+)
+
+// handleSchema serves the message protocol as JSON Schema, generated from
+// the payload types:
+//
+//	GET /schema         every message
+//	GET /schema/{type}  the messages of one type, e.g. /schema/terminal_create
+//
+// It describes the protocol, not any session, so it needs no token.
+func handleSchema() http.HandlerFunc {
+	doc := schema.Generate(ws.ProtocolMessages)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		out := doc
+		if name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schema"), "/"); name != "" {
+			var ok bool
+			if out, ok = schema.ForType(doc, protocol.MessageType(name)); !ok {
+				http.Error(w, "unknown message type "+name, http.StatusNotFound)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/schema+json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
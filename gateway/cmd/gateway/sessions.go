@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ws "github.com/devtail/gateway/internal/websocket"
+)
+
+// timelineSessions is how many ended sessions keep their timeline. Set by
+// flag in main.
+var timelineSessions int
+
+// handleSessions serves session timelines for support:
+//
+//	GET /sessions       live and recently ended sessions, newest first
+//	GET /sessions/{id}  one session's timeline
+//
+// With connect tokens required, callers only see sessions opened by the
+// user their token was issued to.
+func handleSessions(timelines *ws.TimelineStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		subject := requestGrant(r).Subject
+		sessionID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+
+		w.Header().Set("Content-Type", "application/json")
+		if sessionID == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"sessions": timelines.List(subject),
+			})
+			return
+		}
+
+		timeline, ok := timelines.Get(sessionID)
+		if !ok || (subject != "" && timeline.Subject != subject) {
+			w.Header().Del("Content-Type")
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(timeline)
+	}
+}
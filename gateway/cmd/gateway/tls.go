@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS settings, set by flags in main
+var (
+	acmeDomains  []string
+	acmeEmail    string
+	acmeCacheDir string
+	acmeHTTPAddr string
+	requireTLS   bool
+)
+
+// buildTLSConfig returns the server TLS configuration, or nil when the gateway
+// serves plaintext. With ACME enabled it also returns the handler answering
+// HTTP-01 challenges, which must be served on port 80.
+func buildTLSConfig() (*tls.Config, http.Handler, error) {
+	if len(acmeDomains) > 0 {
+		if tlsCert != "" || tlsKey != "" {
+			return nil, nil, fmt.Errorf("--acme-domain cannot be combined with --tls-cert/--tls-key")
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+			Cache:      autocert.DirCache(acmeCacheDir),
+			Email:      acmeEmail,
+		}
+
+		config := manager.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, manager.HTTPHandler(nil), nil
+	}
+
+	if tlsCert == "" && tlsKey == "" {
+		return nil, nil, nil
+	}
+	if tlsCert == "" || tlsKey == "" {
+		return nil, nil, fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil, nil
+}
+
+// requireSecure rejects requests that did not arrive over TLS, either
+// directly or through a proxy that terminated it
+func requireSecure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil && !strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+			http.Error(w, "TLS required: connect with https:// or wss://", http.StatusUpgradeRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/devtail/gateway/internal/workspace"
+)
+
+// extraWorkspaces maps workspace names to project roots, in addition to the
+// default workspace at workDir. Set by flag in main.
+var extraWorkspaces map[string]string
+
+// buildWorkspaces registers workDir as the default workspace and every
+// --workspace after it
+func buildWorkspaces() (*workspace.Registry, error) {
+	workspaces := workspace.NewRegistry()
+	if err := workspaces.Add(workspace.DefaultName, workDir); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(extraWorkspaces))
+	for name := range extraWorkspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := workspaces.Add(name, extraWorkspaces[name]); err != nil {
+			return nil, err
+		}
+	}
+	return workspaces, nil
+}
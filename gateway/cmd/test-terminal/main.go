@@ -123,7 +123,7 @@ func main() {
 	// Handle window resize
 	go func() {
 		sigwinch := make(chan os.Signal, 1)
-		signal.Notify(sigwinch, syscall.SIGWINCH)
+		notifyResize(sigwinch)
 		for range sigwinch {
 			width, height, _ := term.GetSize(int(os.Stdout.Fd()))
 			if terminalID != "" {
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyResize does nothing: Windows consoles signal no resizes, so the
+// terminal keeps its starting size
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,87 @@
+package activity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc, which is 100 on
+// every Linux architecture the gateway runs on
+const clockTicks = 100
+
+// Paths of the kernel's CPU accounting, replaced in tests
+var (
+	procStat     = "/proc/stat"
+	procSelfStat = "/proc/self/stat"
+)
+
+// TaskCPUSeconds returns the CPU time the VM has spent running anything but
+// the gateway since boot, in seconds. Time spent idle or waiting for I/O is
+// not counted.
+func TaskCPUSeconds() (float64, error) {
+	total, err := systemCPUTicks()
+	if err != nil {
+		return 0, err
+	}
+	own, err := processCPUTicks()
+	if err != nil {
+		return 0, err
+	}
+	return float64(total-own) / clockTicks, nil
+}
+
+// systemCPUTicks sums the busy columns of the "cpu" line of /proc/stat:
+// user, nice, system, irq, softirq and steal
+func systemCPUTicks() (uint64, error) {
+	data, err := os.ReadFile(procStat)
+	if err != nil {
+		return 0, err
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("%s: unexpected format", procStat)
+	}
+
+	var ticks uint64
+	for _, i := range []int{1, 2, 3, 6, 7, 8} {
+		n, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", procStat, err)
+		}
+		ticks += n
+	}
+	return ticks, nil
+}
+
+// processCPUTicks returns the user and system time of the gateway process
+func processCPUTicks() (uint64, error) {
+	data, err := os.ReadFile(procSelfStat)
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, so fields are counted from the
+	// parenthesis that closes it; utime and stime are the 14th and 15th
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, errors.New(procSelfStat + ": unexpected format")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 13 {
+		return 0, errors.New(procSelfStat + ": unexpected format")
+	}
+
+	var ticks uint64
+	for _, f := range fields[11:13] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", procSelfStat, err)
+		}
+		ticks += n
+	}
+	return ticks, nil
+}
@@ -0,0 +1,331 @@
+// Package activity tells the control plane when the VM is in use, a minute
+// at a time, so it can suspend idle VMs and bill for the time that was not.
+//
+// A minute is active when, during it, a client typed into a terminal, a
+// client sent the AI a request, or the VM's tasks used at least the CPU
+// threshold. Keystrokes count the bytes of terminal input, so a paste counts
+// as many. Task CPU is the CPU time the whole VM spent outside the gateway
+// itself, so a build or test run left going in a terminal keeps the VM
+// active while background daemons alone do not. Connected clients that only
+// watch output are not activity.
+package activity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultInterval   = time.Minute
+	defaultMaxPending = 24 * 60
+
+	// DefaultCPUThreshold makes a minute active once tasks use a tenth of a
+	// CPU core over it
+	DefaultCPUThreshold = 0.1
+)
+
+// Sample is one active minute, in the shape the control plane's ingest
+// endpoint accepts
+type Sample struct {
+	Minute     time.Time `json:"minute"` // start of the minute, UTC
+	Keystrokes int64     `json:"keystrokes"`
+	AIRequests int64     `json:"ai_requests"`
+	CPUSeconds float64   `json:"cpu_seconds"`
+}
+
+type ingestRequest struct {
+	Samples []Sample `json:"samples"`
+}
+
+// Reporter counts activity per minute and sends the active minutes to the
+// control plane. Minutes are queued while the control plane is unreachable,
+// up to a day of them, and sent again whole, so the control plane can store
+// them idempotently.
+type Reporter struct {
+	endpoint string
+	token    string
+	client   *http.Client
+
+	interval     time.Duration
+	maxPending   int
+	cpuThreshold float64
+	cpu          func() (float64, error)
+	now          func() time.Time
+
+	mu        sync.Mutex
+	current   Sample
+	lastCPU   float64
+	lastCPUAt time.Time
+	cpuOK     bool
+	pending   []Sample
+	failing   bool
+
+	// sendMu serializes sends, so minutes arrive in order
+	sendMu sync.Mutex
+
+	// local reports failures on stderr, like the log shipper
+	local zerolog.Logger
+}
+
+// Option configures a Reporter
+type Option func(*Reporter)
+
+// WithInterval sets how often active minutes are sent
+func WithInterval(d time.Duration) Option {
+	return func(r *Reporter) { r.interval = d }
+}
+
+// WithMaxPending caps the minutes queued while the control plane is
+// unreachable
+func WithMaxPending(n int) Option {
+	return func(r *Reporter) { r.maxPending = n }
+}
+
+// WithCPUThreshold sets the share of one CPU core tasks must use over a
+// minute to make it active; zero or less leaves CPU out of activity
+func WithCPUThreshold(cores float64) Option {
+	return func(r *Reporter) { r.cpuThreshold = cores }
+}
+
+// WithCPUSource replaces how the CPU time used by tasks is read: fn returns
+// a running total in seconds. The default reads /proc; without it, CPU is
+// left out of activity.
+func WithCPUSource(fn func() (float64, error)) Option {
+	return func(r *Reporter) { r.cpu = fn }
+}
+
+// WithHTTPClient replaces the HTTP client used to reach the control plane
+func WithHTTPClient(client *http.Client) Option {
+	return func(r *Reporter) { r.client = client }
+}
+
+// withClock replaces time.Now in tests
+func withClock(now func() time.Time) Option {
+	return func(r *Reporter) { r.now = now }
+}
+
+// New creates a reporter posting to endpoint with the VM's ingest token
+func New(endpoint, token string, opts ...Option) *Reporter {
+	r := &Reporter{
+		endpoint:     endpoint,
+		token:        token,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		interval:     defaultInterval,
+		maxPending:   defaultMaxPending,
+		cpuThreshold: DefaultCPUThreshold,
+		cpu:          TaskCPUSeconds,
+		now:          time.Now,
+		local:        zerolog.New(os.Stderr).With().Timestamp().Str("component", "activity").Logger(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.current.Minute = r.now().UTC().Truncate(time.Minute)
+	r.lastCPU, r.cpuOK = r.readCPU()
+	r.lastCPUAt = r.now()
+	return r
+}
+
+// Keystrokes counts n bytes typed into a terminal
+func (r *Reporter) Keystrokes(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll()
+	r.current.Keystrokes += int64(n)
+}
+
+// AIRequest counts a request sent to the AI
+func (r *Reporter) AIRequest() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll()
+	r.current.AIRequests++
+}
+
+// roll closes the current minute once it is over, reading the CPU time
+// used during it, and queues it if it was active. Callers hold mu.
+func (r *Reporter) roll() {
+	minute := r.now().UTC().Truncate(time.Minute)
+	if !minute.After(r.current.Minute) {
+		return
+	}
+
+	r.closeMinute()
+	r.current = Sample{Minute: minute}
+}
+
+// closeMinute queues the current minute if it was active. CPU time is read
+// as the minute is closed; if that is more than a minute since the last
+// read, the minute gets its share. Callers hold mu.
+func (r *Reporter) closeMinute() {
+	if total, ok := r.readCPU(); ok {
+		now := r.now()
+		if r.cpuOK && total >= r.lastCPU {
+			used := total - r.lastCPU
+			if elapsed := now.Sub(r.lastCPUAt); elapsed > time.Minute {
+				used *= float64(time.Minute) / float64(elapsed)
+			}
+			r.current.CPUSeconds = used
+		}
+		r.lastCPU, r.lastCPUAt, r.cpuOK = total, now, true
+	}
+
+	if !r.active(r.current) {
+		return
+	}
+	r.pending = append(r.pending, r.current)
+	if over := len(r.pending) - r.maxPending; over > 0 {
+		r.pending = r.pending[over:]
+	}
+}
+
+// active reports whether the minute counts as activity
+func (r *Reporter) active(s Sample) bool {
+	if s.Keystrokes > 0 || s.AIRequests > 0 {
+		return true
+	}
+	return r.cpuThreshold > 0 && s.CPUSeconds >= r.cpuThreshold*time.Minute.Seconds()
+}
+
+func (r *Reporter) readCPU() (float64, bool) {
+	if r.cpu == nil || r.cpuThreshold <= 0 {
+		return 0, false
+	}
+	total, err := r.cpu()
+	if err != nil {
+		return 0, false
+	}
+	return total, true
+}
+
+// Run sends the active minutes every interval until ctx is done. It then
+// closes the current minute early and makes a last attempt to send it.
+func (r *Reporter) Run(ctx context.Context) {
+	if r.cpuThreshold > 0 && !r.cpuOK {
+		r.local.Warn().Msg("task CPU time is unavailable, only keystrokes and AI requests count as activity")
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.closeMinute()
+			r.current = Sample{Minute: r.current.Minute}
+			r.mu.Unlock()
+
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			r.Flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		}
+		r.Flush(ctx)
+	}
+}
+
+// Flush sends every active minute that has ended. Minutes that fail to send
+// are kept for the next attempt.
+func (r *Reporter) Flush(ctx context.Context) error {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	r.mu.Lock()
+	r.roll()
+	samples := r.pending
+	r.pending = nil
+	r.mu.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	err := r.send(ctx, samples)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.pending = append(samples, r.pending...)
+		if over := len(r.pending) - r.maxPending; over > 0 {
+			r.pending = r.pending[over:]
+		}
+		if !r.failing {
+			r.failing = true
+			r.local.Warn().Err(err).Str("endpoint", r.endpoint).Msg("activity reporting failed, retrying")
+		}
+		return err
+	}
+	if r.failing {
+		r.failing = false
+		r.local.Info().Str("endpoint", r.endpoint).Msg("activity reporting recovered")
+	}
+	return nil
+}
+
+func (r *Reporter) send(ctx context.Context, samples []Sample) error {
+	body, err := json.Marshal(ingestRequest{Samples: samples})
+	if err != nil {
+		return fmt.Errorf("marshal activity: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send activity: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("send activity: control plane returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Chat counts each request h accepts as an AI request
+func (r *Reporter) Chat(h ws.ChatHandler) ws.ChatHandler {
+	if r == nil {
+		return h
+	}
+	return &countingChat{ChatHandler: h, reporter: r}
+}
+
+type countingChat struct {
+	ws.ChatHandler
+	reporter *Reporter
+}
+
+func (c *countingChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies, err := c.ChatHandler.HandleChatMessage(ctx, msg)
+	if err == nil {
+		c.reporter.AIRequest()
+	}
+	return replies, err
+}
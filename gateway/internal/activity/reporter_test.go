@@ -0,0 +1,292 @@
+package activity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+type ingestServer struct {
+	mu      sync.Mutex
+	fail    bool
+	samples []Sample
+	tokens  []string
+}
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req ingestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+	s.samples = append(s.samples, req.Samples...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fakeClock is a settable time source
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeCPU is a running total of task CPU seconds
+type fakeCPU struct {
+	mu    sync.Mutex
+	total float64
+	err   error
+}
+
+func (c *fakeCPU) Read() (float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total, c.err
+}
+
+func (c *fakeCPU) Use(seconds float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += seconds
+}
+
+var start = time.Date(2026, 3, 1, 12, 0, 10, 0, time.UTC)
+
+func TestReporterSendsOnlyActiveMinutes(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	clock := &fakeClock{now: start}
+	cpu := &fakeCPU{}
+	r := New(srv.URL, "token-1", withClock(clock.Now), WithCPUSource(cpu.Read))
+
+	// 12:00 is typed in and asks the AI twice
+	r.Keystrokes(5)
+	r.Keystrokes(3)
+	r.AIRequest()
+	r.AIRequest()
+
+	// 12:01 only runs a build, 12:02 is still open
+	clock.Advance(time.Minute)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	cpu.Use(30)
+	clock.Advance(time.Minute)
+	r.AIRequest()
+
+	// The minute still open is not sent
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(ingest.samples) != 2 {
+		t.Fatalf("expected 2 samples, got %+v", ingest.samples)
+	}
+	first, second := ingest.samples[0], ingest.samples[1]
+	if !first.Minute.Equal(start.Truncate(time.Minute)) || first.Keystrokes != 8 || first.AIRequests != 2 {
+		t.Errorf("unexpected first minute: %+v", first)
+	}
+	if !second.Minute.Equal(start.Truncate(time.Minute).Add(time.Minute)) || second.CPUSeconds != 30 || second.Keystrokes != 0 {
+		t.Errorf("unexpected second minute: %+v", second)
+	}
+	if ingest.tokens[0] != "Bearer token-1" {
+		t.Errorf("expected bearer token, got %q", ingest.tokens[0])
+	}
+}
+
+func TestReporterIgnoresCPUBelowThreshold(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	clock := &fakeClock{now: start}
+	cpu := &fakeCPU{}
+	r := New(srv.URL, "token-1", withClock(clock.Now), WithCPUSource(cpu.Read), WithCPUThreshold(0.5))
+
+	// A daemon using a fifth of a core is not activity
+	cpu.Use(12)
+	clock.Advance(time.Minute)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(ingest.samples) != 0 {
+		t.Fatalf("expected no samples, got %+v", ingest.samples)
+	}
+
+	// Three idle minutes between reads are averaged rather than summed
+	cpu.Use(60)
+	clock.Advance(3 * time.Minute)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(ingest.samples) != 0 {
+		t.Fatalf("expected no samples, got %+v", ingest.samples)
+	}
+
+	cpu.Use(45)
+	clock.Advance(time.Minute)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(ingest.samples) != 1 || ingest.samples[0].CPUSeconds != 45 {
+		t.Fatalf("expected the busy minute, got %+v", ingest.samples)
+	}
+}
+
+func TestReporterWithoutCPUCountsInput(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	clock := &fakeClock{now: start}
+	cpu := &fakeCPU{err: errors.New("no /proc")}
+	r := New(srv.URL, "token-1", withClock(clock.Now), WithCPUSource(cpu.Read))
+
+	r.Keystrokes(1)
+	clock.Advance(time.Minute)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(ingest.samples) != 1 || ingest.samples[0].Keystrokes != 1 || ingest.samples[0].CPUSeconds != 0 {
+		t.Fatalf("expected the typed minute, got %+v", ingest.samples)
+	}
+}
+
+func TestReporterRetriesAndCapsPending(t *testing.T) {
+	ingest := &ingestServer{fail: true}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	clock := &fakeClock{now: start}
+	r := New(srv.URL, "token-1", withClock(clock.Now), WithCPUThreshold(0), WithMaxPending(2))
+
+	for i := 0; i < 3; i++ {
+		r.Keystrokes(i + 1)
+		clock.Advance(time.Minute)
+		if err := r.Flush(context.Background()); err == nil {
+			t.Fatal("expected flush to fail while the control plane is down")
+		}
+	}
+
+	ingest.mu.Lock()
+	ingest.fail = false
+	ingest.mu.Unlock()
+
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(ingest.samples) != 2 {
+		t.Fatalf("expected the 2 newest minutes, got %+v", ingest.samples)
+	}
+	if ingest.samples[0].Keystrokes != 2 || ingest.samples[1].Keystrokes != 3 {
+		t.Errorf("expected minutes in order, got %+v", ingest.samples)
+	}
+}
+
+func TestReporterRunSendsLastMinuteOnStop(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	r := New(srv.URL, "token-1", WithCPUThreshold(0), WithInterval(time.Hour))
+	r.Keystrokes(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if len(ingest.samples) != 1 || ingest.samples[0].Keystrokes != 4 {
+		t.Fatalf("expected the open minute to be sent, got %+v", ingest.samples)
+	}
+}
+
+type stubChat struct {
+	err error
+}
+
+func (c stubChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	replies := make(chan *protocol.ChatReply)
+	close(replies)
+	return replies, nil
+}
+
+func TestChatCountsAcceptedRequests(t *testing.T) {
+	clock := &fakeClock{now: start}
+	r := New("http://unused", "token-1", withClock(clock.Now), WithCPUThreshold(0))
+
+	if _, err := r.Chat(stubChat{}).HandleChatMessage(context.Background(), &protocol.ChatMessage{}); err != nil {
+		t.Fatalf("chat: %v", err)
+	}
+	if _, err := r.Chat(stubChat{err: errors.New("busy")}).HandleChatMessage(context.Background(), &protocol.ChatMessage{}); err == nil {
+		t.Fatal("expected the chat error to pass through")
+	}
+
+	if r.current.AIRequests != 1 {
+		t.Errorf("expected 1 AI request, got %d", r.current.AIRequests)
+	}
+
+	var nilReporter *Reporter
+	if _, ok := nilReporter.Chat(stubChat{}).(stubChat); !ok {
+		t.Error("expected a nil reporter to leave the handler unwrapped")
+	}
+}
+
+func TestTaskCPUSecondsExcludesGatewayAndIdle(t *testing.T) {
+	dir := t.TempDir()
+	stat := filepath.Join(dir, "stat")
+	self := filepath.Join(dir, "self")
+	// user nice system idle iowait irq softirq steal guest guest_nice
+	os.WriteFile(stat, []byte("cpu  1000 50 300 90000 400 20 30 0 0 0\ncpu0 1000 50 300 90000 400 20 30 0 0 0\n"), 0o644)
+	// utime and stime are 200 and 100, after a command name with spaces
+	os.WriteFile(self, []byte("42 (devtail gateway) S 1 42 42 0 -1 4194560 100 0 0 0 200 100 0 0 20 0 8 0\n"), 0o644)
+
+	oldStat, oldSelf := procStat, procSelfStat
+	procStat, procSelfStat = stat, self
+	defer func() { procStat, procSelfStat = oldStat, oldSelf }()
+
+	got, err := TaskCPUSeconds()
+	if err != nil {
+		t.Fatalf("TaskCPUSeconds: %v", err)
+	}
+	if got != 11 {
+		t.Errorf("expected 11s, got %v", got)
+	}
+}
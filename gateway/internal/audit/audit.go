@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EventType identifies the kind of audited action
+type EventType string
+
+const (
+	EventTerminalOpened  EventType = "terminal_opened"
+	EventTerminalClosed  EventType = "terminal_closed"
+	EventTerminalCommand EventType = "terminal_command"
+)
+
+// Event is a single audit record
+type Event struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	Type       EventType         `json:"type"`
+	TerminalID string            `json:"terminal_id,omitempty"`
+	User       string            `json:"user,omitempty"` // who acted, when the gateway requires connect tokens
+	Command    string            `json:"command,omitempty"`
+	WorkDir    string            `json:"work_dir,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// Logger records audit events
+type Logger interface {
+	Log(event Event)
+}
+
+// FileLogger appends audit events to a file as JSON lines
+type FileLogger struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileLogger opens (or creates) the audit log at path in append mode
+func NewFileLogger(path string) (*FileLogger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create audit log directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	return &FileLogger{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Log writes an event to the audit log
+func (l *FileLogger) Log(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.enc.Encode(event); err != nil {
+		log.Error().Err(err).Str("type", string(event.Type)).Msg("failed to write audit event")
+	}
+}
+
+// Close flushes and closes the audit log
+func (l *FileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return fmt.Errorf("sync audit log: %w", err)
+	}
+	return l.file.Close()
+}
+
+// Nop returns a logger that discards all events
+func Nop() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Event) {}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// announcementAudience keeps announcements from being accepted as connect
+// tokens or revocation notices, and the other way round
+const announcementAudience = "devtail-gateway-announcement"
+
+// announcementClaims are the contents of an operator announcement signed by
+// the control plane
+type announcementClaims struct {
+	VMID         string                `json:"vm"`
+	Announcement protocol.Announcement `json:"announcement"`
+	jwt.RegisteredClaims
+}
+
+// ParseAnnouncement verifies an operator announcement signed by the control
+// plane and bound to this verifier's VM
+func (v *Verifier) ParseAnnouncement(notice string) (protocol.Announcement, error) {
+	var claims announcementClaims
+	_, err := jwt.ParseWithClaims(notice, &claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(announcementAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return protocol.Announcement{}, fmt.Errorf("invalid announcement: %w", err)
+	}
+
+	if v.vmID != "" && claims.VMID != v.vmID {
+		return protocol.Announcement{}, ErrWrongVM
+	}
+
+	a := claims.Announcement
+	if a.ID == "" || a.Message == "" || a.ExpiresAt.IsZero() {
+		return protocol.Announcement{}, fmt.Errorf("invalid announcement: missing id, message or expiry")
+	}
+	return a, nil
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// backupAudience keeps backup requests from being accepted in place of any
+// other notice the control plane signs
+const backupAudience = "devtail-gateway-backup"
+
+// backupClaims are the contents of a backup request signed by the control
+// plane, sent before it deletes the VM
+type backupClaims struct {
+	VMID string `json:"vm"`
+	jwt.RegisteredClaims
+}
+
+// ParseBackupRequest verifies a request, signed by the control plane and
+// bound to this verifier's VM, to back up every workspace now
+func (v *Verifier) ParseBackupRequest(request string) error {
+	var claims backupClaims
+	_, err := jwt.ParseWithClaims(request, &claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(backupAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return fmt.Errorf("invalid backup request: %w", err)
+	}
+
+	if v.vmID != "" && claims.VMID != v.vmID {
+		return ErrWrongVM
+	}
+	return nil
+}
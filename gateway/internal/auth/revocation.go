@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// revocationAudience keeps revocation notices and connect tokens from
+	// being accepted in place of each other
+	revocationAudience = "devtail-gateway-revocation"
+
+	// revokedIDRetention outlives any connect token, so a revoked ID is
+	// remembered until the token itself would have expired
+	revokedIDRetention = 24 * time.Hour
+)
+
+var ErrRevoked = errors.New("connect token has been revoked")
+
+// Revocation invalidates one connect token, or every token for the VM issued
+// before a point in time (rotation, or a lost device)
+type Revocation struct {
+	TokenID      string
+	IssuedBefore time.Time
+}
+
+// Matches reports whether a token with this ID and issue time is revoked
+func (r Revocation) Matches(tokenID string, issuedAt time.Time) bool {
+	if r.TokenID != "" && r.TokenID == tokenID {
+		return true
+	}
+	return !r.IssuedBefore.IsZero() && issuedAt.Before(r.IssuedBefore)
+}
+
+// revocationClaims are the contents of a revocation notice signed by the
+// control plane
+type revocationClaims struct {
+	VMID         string           `json:"vm"`
+	TokenID      string           `json:"token_id,omitempty"`
+	IssuedBefore *jwt.NumericDate `json:"issued_before,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// revocationList holds the revocations a verifier enforces. Revocations are
+// kept in memory; connect tokens are short-lived, so the exposure after a
+// gateway restart is bounded by the token lifetime.
+type revocationList struct {
+	mu           sync.RWMutex
+	ids          map[string]time.Time // token ID -> when it was revoked
+	issuedBefore time.Time
+}
+
+func (l *revocationList) add(r Revocation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if r.TokenID != "" {
+		if l.ids == nil {
+			l.ids = make(map[string]time.Time)
+		}
+		l.ids[r.TokenID] = now
+	}
+	if r.IssuedBefore.After(l.issuedBefore) {
+		l.issuedBefore = r.IssuedBefore
+	}
+
+	for id, revokedAt := range l.ids {
+		if now.Sub(revokedAt) > revokedIDRetention {
+			delete(l.ids, id)
+		}
+	}
+}
+
+func (l *revocationList) revoked(tokenID string, issuedAt time.Time) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.ids[tokenID]; ok && tokenID != "" {
+		return true
+	}
+	return issuedAt.Before(l.issuedBefore)
+}
+
+// ParseRevocation verifies a revocation notice signed by the control plane
+// and bound to this verifier's VM
+func (v *Verifier) ParseRevocation(notice string) (Revocation, error) {
+	var claims revocationClaims
+	_, err := jwt.ParseWithClaims(notice, &claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(revocationAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return Revocation{}, fmt.Errorf("invalid revocation: %w", err)
+	}
+
+	if v.vmID != "" && claims.VMID != v.vmID {
+		return Revocation{}, ErrWrongVM
+	}
+
+	r := Revocation{TokenID: claims.TokenID}
+	if claims.IssuedBefore != nil {
+		r.IssuedBefore = claims.IssuedBefore.Time
+	}
+	if r.TokenID == "" && r.IssuedBefore.IsZero() {
+		return Revocation{}, fmt.Errorf("invalid revocation: no token id or issued_before")
+	}
+	return r, nil
+}
+
+// Revoke makes Verify reject the tokens r matches
+func (v *Verifier) Revoke(r Revocation) {
+	v.revocations.add(r)
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// suspendAudience keeps suspension notices from being accepted in place of
+// any other notice the control plane signs
+const suspendAudience = "devtail-gateway-suspend"
+
+// What a suspension notice asks the gateway to do
+const (
+	SuspendSchedule = "schedule" // warn clients the VM will be suspended at SuspendAt
+	SuspendCancel   = "cancel"   // call the suspension off
+	SuspendNow      = "suspend"  // end every session; the VM is about to stop
+)
+
+// SuspendNotice is one step of suspending the VM. The control plane sends
+// the same ID at each step, so the gateway can tell a suspension a client
+// called off from a new one.
+type SuspendNotice struct {
+	ID         string    `json:"id"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason"`
+	SuspendAt  time.Time `json:"suspend_at,omitempty"`
+	ResumeHint string    `json:"resume_hint,omitempty"`
+}
+
+// suspendClaims are the contents of a suspension notice signed by the
+// control plane
+type suspendClaims struct {
+	VMID   string        `json:"vm"`
+	Notice SuspendNotice `json:"suspend"`
+	jwt.RegisteredClaims
+}
+
+// ParseSuspendNotice verifies a suspension notice signed by the control
+// plane and bound to this verifier's VM
+func (v *Verifier) ParseSuspendNotice(notice string) (SuspendNotice, error) {
+	var claims suspendClaims
+	_, err := jwt.ParseWithClaims(notice, &claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(suspendAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return SuspendNotice{}, fmt.Errorf("invalid suspension notice: %w", err)
+	}
+
+	if v.vmID != "" && claims.VMID != v.vmID {
+		return SuspendNotice{}, ErrWrongVM
+	}
+
+	n := claims.Notice
+	if n.ID == "" {
+		return SuspendNotice{}, fmt.Errorf("invalid suspension notice: missing id")
+	}
+	switch n.Action {
+	case SuspendSchedule:
+		if n.SuspendAt.IsZero() {
+			return SuspendNotice{}, fmt.Errorf("invalid suspension notice: missing suspend_at")
+		}
+	case SuspendCancel, SuspendNow:
+	default:
+		return SuspendNotice{}, fmt.Errorf("invalid suspension notice: unknown action %q", n.Action)
+	}
+	return n, nil
+}
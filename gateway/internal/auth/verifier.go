@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer and audience of control plane connect tokens
+const (
+	tokenIssuer   = "devtail-control-plane"
+	tokenAudience = "devtail-gateway"
+
+	// clockSkew tolerates small clock differences between the control plane and VMs
+	clockSkew = 30 * time.Second
+)
+
+var (
+	ErrMissingToken = errors.New("missing connect token")
+	ErrWrongVM      = errors.New("connect token is for a different vm")
+)
+
+// Claims are the contents of a connect token issued by the control plane
+type Claims struct {
+	VMID string `json:"vm"`
+
+	// ReadOnly makes the sessions opened with the token read-only
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	jwt.RegisteredClaims
+}
+
+// Verifier checks connect tokens signed by the control plane
+type Verifier struct {
+	key         ed25519.PublicKey
+	vmID        string
+	revocations revocationList
+}
+
+// NewVerifier creates a verifier accepting tokens for vmID. An empty vmID
+// accepts tokens for any VM, for gateways that serve several, like relays.
+func NewVerifier(key ed25519.PublicKey, vmID string) *Verifier {
+	return &Verifier{
+		key:  key,
+		vmID: vmID,
+	}
+}
+
+// ParsePublicKey decodes the base64 Ed25519 public key logged by the control plane
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Verify checks the token's signature, expiry, VM binding and revocation
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return v.key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(tokenAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockSkew),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connect token: %w", err)
+	}
+
+	if v.vmID != "" && claims.VMID != v.vmID {
+		return nil, ErrWrongVM
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	if v.revocations.revoked(claims.ID, issuedAt) {
+		return nil, ErrRevoked
+	}
+	return &claims, nil
+}
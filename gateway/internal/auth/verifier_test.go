@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signToken(t *testing.T, key ed25519.PrivateKey, vmID string, expiresAt time.Time) string {
+	t.Helper()
+
+	claims := Claims{
+		VMID: vmID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   "user-1",
+			Audience:  jwt.ClaimStrings{tokenAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+func TestVerifier(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	parsed, err := ParsePublicKey(base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	verifier := NewVerifier(parsed, "vm-1")
+
+	valid := signToken(t, priv, "vm-1", time.Now().Add(time.Minute))
+	claims, err := verifier.Verify(valid)
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if claims.Subject != "user-1" {
+		t.Errorf("expected subject user-1, got %q", claims.Subject)
+	}
+
+	if _, err := verifier.Verify(""); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("empty token: expected ErrMissingToken, got %v", err)
+	}
+	if _, err := verifier.Verify(signToken(t, priv, "vm-2", time.Now().Add(time.Minute))); !errors.Is(err, ErrWrongVM) {
+		t.Errorf("other vm: expected ErrWrongVM, got %v", err)
+	}
+	if _, err := verifier.Verify(signToken(t, priv, "vm-1", time.Now().Add(-time.Hour))); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("expired token: expected ErrTokenExpired, got %v", err)
+	}
+	if _, err := verifier.Verify(signToken(t, otherKey, "vm-1", time.Now().Add(time.Minute))); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("foreign key: expected ErrTokenSignatureInvalid, got %v", err)
+	}
+
+	// Relays verify tokens for any VM
+	if _, err := NewVerifier(parsed, "").Verify(signToken(t, priv, "vm-2", time.Now().Add(time.Minute))); err != nil {
+		t.Errorf("unbound verifier rejected token: %v", err)
+	}
+}
+
+func signRevocation(t *testing.T, key ed25519.PrivateKey, vmID, tokenID string, issuedBefore time.Time) string {
+	t.Helper()
+
+	claims := revocationClaims{
+		VMID:    vmID,
+		TokenID: tokenID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{revocationAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	if !issuedBefore.IsZero() {
+		claims.IssuedBefore = jwt.NewNumericDate(issuedBefore)
+	}
+	notice, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("sign revocation: %v", err)
+	}
+	return notice
+}
+
+func TestVerifierRevocation(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	verifier := NewVerifier(pub, "vm-1")
+
+	issue := func(id string, issuedAt time.Time) string {
+		claims := Claims{
+			VMID: "vm-1",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        id,
+				Issuer:    tokenIssuer,
+				Audience:  jwt.ClaimStrings{tokenAudience},
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(priv)
+		return token
+	}
+
+	old := issue("old", time.Now().Add(-10*time.Minute))
+	lost := issue("lost", time.Now())
+	fresh := issue("fresh", time.Now())
+
+	// A connect token is not a revocation notice
+	if _, err := verifier.ParseRevocation(fresh); err == nil {
+		t.Fatal("connect token accepted as a revocation notice")
+	}
+	if _, err := verifier.ParseRevocation(signRevocation(t, priv, "vm-2", "lost", time.Time{})); !errors.Is(err, ErrWrongVM) {
+		t.Fatalf("revocation for another vm: expected ErrWrongVM, got %v", err)
+	}
+
+	byID, err := verifier.ParseRevocation(signRevocation(t, priv, "vm-1", "lost", time.Time{}))
+	if err != nil {
+		t.Fatalf("parse revocation: %v", err)
+	}
+	verifier.Revoke(byID)
+	if _, err := verifier.Verify(lost); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked token: expected ErrRevoked, got %v", err)
+	}
+	if _, err := verifier.Verify(fresh); err != nil {
+		t.Errorf("unrevoked token rejected: %v", err)
+	}
+
+	rotation, err := verifier.ParseRevocation(signRevocation(t, priv, "vm-1", "", time.Now().Add(-time.Minute)))
+	if err != nil {
+		t.Fatalf("parse rotation: %v", err)
+	}
+	verifier.Revoke(rotation)
+	if _, err := verifier.Verify(old); !errors.Is(err, ErrRevoked) {
+		t.Errorf("token issued before rotation: expected ErrRevoked, got %v", err)
+	}
+	if _, err := verifier.Verify(fresh); err != nil {
+		t.Errorf("token issued after rotation rejected: %v", err)
+	}
+}
+
+func TestVerifierAnnouncement(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	verifier := NewVerifier(pub, "vm-1")
+
+	announce := func(vmID string, a protocol.Announcement) string {
+		claims := announcementClaims{
+			VMID:         vmID,
+			Announcement: a,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    tokenIssuer,
+				Audience:  jwt.ClaimStrings{announcementAudience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+		notice, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(priv)
+		if err != nil {
+			t.Fatalf("sign announcement: %v", err)
+		}
+		return notice
+	}
+	a := protocol.Announcement{
+		ID:        "a1",
+		Kind:      protocol.AnnouncementUpgrade,
+		Message:   "Update to 1.4 to keep connecting",
+		ExpiresAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+
+	got, err := verifier.ParseAnnouncement(announce("vm-1", a))
+	if err != nil {
+		t.Fatalf("parse announcement: %v", err)
+	}
+	if got.ID != a.ID || got.Kind != a.Kind || got.Message != a.Message || !got.ExpiresAt.Equal(a.ExpiresAt) {
+		t.Errorf("got %+v, want %+v", got, a)
+	}
+
+	if _, err := verifier.ParseAnnouncement(announce("vm-2", a)); !errors.Is(err, ErrWrongVM) {
+		t.Errorf("announcement for another vm: expected ErrWrongVM, got %v", err)
+	}
+	if _, err := verifier.ParseAnnouncement(announce("vm-1", protocol.Announcement{ID: "a2"})); err == nil {
+		t.Error("empty announcement accepted")
+	}
+	// Neither a revocation notice nor a connect token is an announcement
+	if _, err := verifier.ParseAnnouncement(signRevocation(t, priv, "vm-1", "lost", time.Time{})); err == nil {
+		t.Error("revocation notice accepted as an announcement")
+	}
+	if _, err := verifier.ParseAnnouncement(signToken(t, priv, "vm-1", time.Now().Add(time.Hour))); err == nil {
+		t.Error("connect token accepted as an announcement")
+	}
+}
+
+func TestVerifierBackupRequest(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	verifier := NewVerifier(pub, "vm-1")
+
+	request := func(vmID string, expiresAt time.Time) string {
+		claims := backupClaims{
+			VMID: vmID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    tokenIssuer,
+				Audience:  jwt.ClaimStrings{backupAudience},
+				ExpiresAt: jwt.NewNumericDate(expiresAt),
+			},
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(priv)
+		if err != nil {
+			t.Fatalf("sign backup request: %v", err)
+		}
+		return signed
+	}
+
+	if err := verifier.ParseBackupRequest(request("vm-1", time.Now().Add(time.Minute))); err != nil {
+		t.Fatalf("parse backup request: %v", err)
+	}
+	if err := verifier.ParseBackupRequest(request("vm-2", time.Now().Add(time.Minute))); !errors.Is(err, ErrWrongVM) {
+		t.Errorf("backup request for another vm: expected ErrWrongVM, got %v", err)
+	}
+	if err := verifier.ParseBackupRequest(request("vm-1", time.Now().Add(-time.Hour))); err == nil {
+		t.Error("expired backup request accepted")
+	}
+	if err := verifier.ParseBackupRequest(signRevocation(t, priv, "vm-1", "lost", time.Time{})); err == nil {
+		t.Error("revocation notice accepted as a backup request")
+	}
+}
+
+func TestVerifierSuspendNotice(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	verifier := NewVerifier(pub, "vm-1")
+
+	sign := func(vmID string, n SuspendNotice) string {
+		claims := suspendClaims{
+			VMID:   vmID,
+			Notice: n,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    tokenIssuer,
+				Audience:  jwt.ClaimStrings{suspendAudience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(priv)
+		if err != nil {
+			t.Fatalf("sign suspension notice: %v", err)
+		}
+		return signed
+	}
+	n := SuspendNotice{
+		ID:         "s1",
+		Action:     SuspendSchedule,
+		Reason:     protocol.SuspendIdle,
+		SuspendAt:  time.Now().Add(5 * time.Minute).UTC().Truncate(time.Second),
+		ResumeHint: "devtail resume vm-1",
+	}
+
+	got, err := verifier.ParseSuspendNotice(sign("vm-1", n))
+	if err != nil {
+		t.Fatalf("parse suspension notice: %v", err)
+	}
+	if got.ID != n.ID || got.Action != n.Action || got.Reason != n.Reason || !got.SuspendAt.Equal(n.SuspendAt) || got.ResumeHint != n.ResumeHint {
+		t.Errorf("got %+v, want %+v", got, n)
+	}
+
+	if _, err := verifier.ParseSuspendNotice(sign("vm-1", SuspendNotice{ID: "s1", Action: SuspendNow})); err != nil {
+		t.Errorf("suspend without a time: %v", err)
+	}
+	if _, err := verifier.ParseSuspendNotice(sign("vm-2", n)); !errors.Is(err, ErrWrongVM) {
+		t.Errorf("notice for another vm: expected ErrWrongVM, got %v", err)
+	}
+	if _, err := verifier.ParseSuspendNotice(sign("vm-1", SuspendNotice{ID: "s1", Action: SuspendSchedule})); err == nil {
+		t.Error("schedule without suspend_at accepted")
+	}
+	if _, err := verifier.ParseSuspendNotice(sign("vm-1", SuspendNotice{ID: "s1", Action: "reboot"})); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if _, err := verifier.ParseSuspendNotice(signRevocation(t, priv, "vm-1", "lost", time.Time{})); err == nil {
+		t.Error("revocation notice accepted as a suspension notice")
+	}
+}
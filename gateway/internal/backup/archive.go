@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/devtail/gateway/internal/ignore"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Excludes are left out of every backup on top of the workspace's ignore
+// files: dependencies and caches that a build or install recreates. Unlike
+// the watcher's defaults, hidden files are kept, so .git and the saved
+// conversation contexts are backed up.
+var Excludes = []string{
+	"node_modules/", "__pycache__/", ".venv/", ".cache/", ".tox/",
+	"*.tmp", "*.swp",
+}
+
+// WriteArchive writes root as a zstd-compressed tar to w. Paths in the
+// archive are relative to root; files ignored by .gitignore, .devtailignore
+// or Excludes are skipped.
+func WriteArchive(w io.Writer, root string) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	matcher := ignore.New(root, ignore.WithDefaults(Excludes))
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A file deleted mid-walk is not worth failing the backup
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if matcher.Match(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			matcher.LoadDir(path)
+		}
+		return addEntry(tw, root, path, d)
+	})
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// addEntry writes one directory, regular file or symlink. Other file types,
+// such as sockets, are skipped.
+func addEntry(tw *tar.Writer, root, path string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	rel, _ := filepath.Rel(root, path)
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// Owners differ between VMs; restored files belong to the gateway user
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The file may have grown since it was stat'ed; write exactly the size
+	// in the header
+	if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+		return fmt.Errorf("archive %s: %w", rel, err)
+	}
+	return nil
+}
+
+// ExtractArchive unpacks an archive written by WriteArchive into root.
+// Entries that would land outside root are rejected. Symlinks are created
+// last, so no file is written through a link from the archive.
+func ExtractArchive(r io.Reader, root string) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	type symlink struct{ path, target string }
+	var links []symlink
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := entryPath(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFile(path, tr, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, symlink{path, hdr.Linkname})
+		}
+	}
+
+	for _, link := range links {
+		if err := os.MkdirAll(filepath.Dir(link.path), 0755); err != nil {
+			return err
+		}
+		os.Remove(link.path)
+		if err := os.Symlink(link.target, link.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryPath returns where an archive entry goes under root
+func entryPath(root, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q is outside the workspace", name)
+	}
+	return filepath.Join(root, rel), nil
+}
+
+func writeFile(path string, r io.Reader, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
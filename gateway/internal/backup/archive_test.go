@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "cmd", "app"), 0755)
+	os.MkdirAll(filepath.Join(src, "node_modules", "left-pad"), 0755)
+	os.MkdirAll(filepath.Join(src, ".devtail", "contexts"), 0755)
+	os.WriteFile(filepath.Join(src, "cmd", "app", "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(src, "node_modules", "left-pad", "index.js"), []byte("module.exports = 1\n"), 0644)
+	os.WriteFile(filepath.Join(src, ".devtail", "contexts", "s1.json"), []byte(`{"id":"s1"}`), 0644)
+	os.WriteFile(filepath.Join(src, ".gitignore"), []byte("*.log\n"), 0644)
+	os.WriteFile(filepath.Join(src, "debug.log"), []byte("noise"), 0644)
+	os.Symlink("cmd/app/main.go", filepath.Join(src, "main.go"))
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := ExtractArchive(&buf, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"cmd/app/main.go":           "package main\n",
+		".devtail/contexts/s1.json": `{"id":"s1"}`,
+		"main.go":                   "package main\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "run.sh")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected run.sh to stay executable, got %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "main.go")); err != nil || target != "cmd/app/main.go" {
+		t.Errorf("expected main.go to stay a symlink, got %q, %v", target, err)
+	}
+	for _, path := range []string{"node_modules", "debug.log"} {
+		if _, err := os.Stat(filepath.Join(dst, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be left out of the archive", path)
+		}
+	}
+}
+
+func TestExtractRejectsPathsOutsideRoot(t *testing.T) {
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: "../escape.txt", Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hi"))
+	tw.Close()
+	zw.Close()
+
+	parent := t.TempDir()
+	root := filepath.Join(parent, "ws")
+	os.Mkdir(root, 0755)
+	if err := ExtractArchive(&buf, root); err == nil {
+		t.Fatal("expected an entry outside the workspace to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape.txt")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing written outside the workspace")
+	}
+}
@@ -0,0 +1,334 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownWorkspace is returned for a workspace the service does not back up
+var ErrUnknownWorkspace = errors.New("unknown workspace")
+
+// stateDir is left alone when deciding whether a workspace is empty; the
+// gateway may create it before a restore
+const stateDir = ".devtail"
+
+type startResponse struct {
+	Backup    record `json:"backup"`
+	UploadURL string `json:"upload_url"`
+}
+
+type downloadResponse struct {
+	DownloadURL string `json:"download_url"`
+}
+
+// record is a backup as the control plane reports it
+type record struct {
+	ID        int64     `json:"id"`
+	Workspace string    `json:"workspace"`
+	SizeBytes int64     `json:"size_bytes"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Service backs up workspaces to object storage arranged by the control
+// plane: the gateway builds the archive and uploads it to a presigned URL,
+// so it never holds the bucket's credentials. The control plane records the
+// backup for the VM's owner and applies the retention policy, and a VM
+// created from a backup restores it through Restore before it serves.
+type Service struct {
+	endpoint   string
+	token      string
+	workspaces []protocol.Workspace
+	client     *http.Client
+	transfer   *http.Client
+	interval   time.Duration
+	tempDir    string
+
+	// mu runs one backup at a time, so scheduled and requested backups do
+	// not compete for disk and bandwidth
+	mu sync.Mutex
+}
+
+// Option configures a Service
+type Option func(*Service)
+
+// WithInterval sets how often every workspace is backed up; 0 leaves only
+// on-demand backups
+func WithInterval(d time.Duration) Option {
+	return func(s *Service) { s.interval = d }
+}
+
+// WithHTTPClient replaces the HTTP client used for the control plane and
+// object storage
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Service) {
+		s.client = client
+		s.transfer = client
+	}
+}
+
+// WithTempDir sets where archives are built before they are uploaded
+func WithTempDir(dir string) Option {
+	return func(s *Service) { s.tempDir = dir }
+}
+
+// New creates a backup service for the control plane's backups endpoint,
+// authenticated with the VM's ingest token
+func New(endpoint, token string, workspaces []protocol.Workspace, opts ...Option) *Service {
+	s := &Service{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		token:      token,
+		workspaces: workspaces,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		// Archives can be large; transfers are bounded by their context
+		transfer: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run backs up every workspace each interval until ctx is done. Failures are
+// logged and retried at the next interval.
+func (s *Service) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.BackupAll(ctx); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("scheduled workspace backup failed")
+		}
+	}
+}
+
+// BackupAll backs up every workspace, carrying on past failures. It returns
+// the backups that were stored and an error naming each workspace that was
+// not.
+func (s *Service) BackupAll(ctx context.Context) ([]protocol.WorkspaceBackup, error) {
+	backups := make([]protocol.WorkspaceBackup, 0, len(s.workspaces))
+	var errs []error
+	for _, ws := range s.workspaces {
+		b, err := s.Backup(ctx, ws.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("workspace %s: %w", ws.Name, err))
+			continue
+		}
+		backups = append(backups, b)
+	}
+	return backups, errors.Join(errs...)
+}
+
+// Backup archives the workspace called name, or the default for "", and
+// stores it. It returns once the control plane has recorded the backup.
+func (s *Service) Backup(ctx context.Context, name string) (protocol.WorkspaceBackup, error) {
+	ws, ok := s.workspace(name)
+	if !ok {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("%w %q", ErrUnknownWorkspace, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	started := time.Now()
+
+	// The archive is built before the upload URL is requested, so its
+	// expiry only has to cover the transfer
+	f, err := os.CreateTemp(s.tempDir, "devtail-backup-*.tar.zst")
+	if err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("create archive: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if err := WriteArchive(io.MultiWriter(f, hash), ws.Root); err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("archive workspace %s: %w", ws.Name, err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("archive workspace %s: %w", ws.Name, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("archive workspace %s: %w", ws.Name, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	var start startResponse
+	if err := s.post(ctx, s.endpoint, map[string]string{"workspace": ws.Name}, &start); err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("start backup: %w", err)
+	}
+	if err := s.upload(ctx, start.UploadURL, f, size); err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("upload backup %d: %w", start.Backup.ID, err)
+	}
+
+	var done record
+	complete := map[string]interface{}{"size_bytes": size, "sha256": sum}
+	if err := s.post(ctx, s.backupURL(start.Backup.ID, "complete"), complete, &done); err != nil {
+		return protocol.WorkspaceBackup{}, fmt.Errorf("complete backup %d: %w", start.Backup.ID, err)
+	}
+
+	log.Info().
+		Int64("backupID", done.ID).
+		Str("workspace", ws.Name).
+		Int64("size", size).
+		Dur("duration", time.Since(started)).
+		Msg("workspace backed up")
+
+	return protocol.WorkspaceBackup{
+		ID:        done.ID,
+		Workspace: done.Workspace,
+		SizeBytes: done.SizeBytes,
+		SHA256:    done.SHA256,
+		CreatedAt: done.CreatedAt,
+	}, nil
+}
+
+// Restore unpacks backup id into root, unless root already holds files. The
+// restore flag stays in cloud-init, so a restarted gateway finds its
+// workspace full and leaves it alone. It reports whether it restored.
+func (s *Service) Restore(ctx context.Context, id int64, root string) (bool, error) {
+	empty, err := isEmpty(root)
+	if err != nil {
+		return false, err
+	}
+	if !empty {
+		return false, nil
+	}
+
+	var download downloadResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.backupURL(id, "download"), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := s.do(req, &download); err != nil {
+		return false, fmt.Errorf("get backup %d: %w", id, err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, download.DownloadURL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.transfer.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("download backup %d: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("download backup %d: object storage answered %s", id, resp.Status)
+	}
+
+	if err := ExtractArchive(resp.Body, root); err != nil {
+		return false, fmt.Errorf("extract backup %d: %w", id, err)
+	}
+	return true, nil
+}
+
+// upload PUTs the archive to a presigned URL. The length is sent up front;
+// S3 rejects chunked uploads to presigned URLs.
+func (s *Service) upload(ctx context.Context, rawURL string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, rawURL, io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zstd")
+
+	resp, err := s.transfer.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("object storage answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Service) workspace(name string) (protocol.Workspace, bool) {
+	for _, ws := range s.workspaces {
+		if ws.Name == name || (name == "" && ws.Default) {
+			return ws, true
+		}
+	}
+	return protocol.Workspace{}, false
+}
+
+func (s *Service) backupURL(id int64, action string) string {
+	return s.endpoint + "/" + strconv.FormatInt(id, 10) + "/" + action
+}
+
+func (s *Service) post(ctx context.Context, rawURL string, body, into interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, into)
+}
+
+// do sends req to the control plane with the ingest token and decodes the
+// JSON response into into
+func (s *Service) do(req *http.Request, into interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("control plane answered %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// isEmpty reports whether root holds nothing but the gateway's own state.
+// A missing root is created.
+func isEmpty(root string) (bool, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return false, err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != stateDir {
+			return false, nil
+		}
+	}
+	return true, nil
+}
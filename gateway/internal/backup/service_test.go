@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// backupServer stands in for the control plane's backups endpoint and the
+// bucket its presigned URLs point at
+type backupServer struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	objects  map[int64][]byte
+	records  map[int64]record
+	nextID   int64
+	tokens   []string
+	failPuts bool
+}
+
+func newBackupServer(t *testing.T) *backupServer {
+	s := &backupServer{objects: make(map[int64][]byte), records: make(map[int64]record)}
+	s.srv = httptest.NewServer(s)
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *backupServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var id int64
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/backups":
+		s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+		var req struct{ Workspace string }
+		json.NewDecoder(r.Body).Decode(&req)
+		s.nextID++
+		s.records[s.nextID] = record{ID: s.nextID, Workspace: req.Workspace, CreatedAt: time.Now()}
+		json.NewEncoder(w).Encode(startResponse{
+			Backup:    s.records[s.nextID],
+			UploadURL: s.srv.URL + "/bucket/" + strconv.FormatInt(s.nextID, 10),
+		})
+	case r.Method == http.MethodPut && scan(r.URL.Path, "/bucket/", "", &id):
+		if s.failPuts {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		if r.ContentLength <= 0 {
+			http.Error(w, "length required", http.StatusLengthRequired)
+			return
+		}
+		s.objects[id], _ = io.ReadAll(r.Body)
+	case r.Method == http.MethodPost && scan(r.URL.Path, "/backups/", "/complete", &id):
+		var req struct {
+			SizeBytes int64  `json:"size_bytes"`
+			SHA256    string `json:"sha256"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		sum := sha256.Sum256(s.objects[id])
+		if req.SizeBytes != int64(len(s.objects[id])) || req.SHA256 != hex.EncodeToString(sum[:]) {
+			http.Error(w, "checksum mismatch", http.StatusBadRequest)
+			return
+		}
+		rec := s.records[id]
+		rec.SizeBytes, rec.SHA256 = req.SizeBytes, req.SHA256
+		s.records[id] = rec
+		json.NewEncoder(w).Encode(rec)
+	case r.Method == http.MethodGet && scan(r.URL.Path, "/backups/", "/download", &id):
+		if _, ok := s.objects[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(downloadResponse{DownloadURL: s.srv.URL + "/bucket/" + strconv.FormatInt(id, 10)})
+	case r.Method == http.MethodGet && scan(r.URL.Path, "/bucket/", "", &id):
+		w.Write(s.objects[id])
+	default:
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+	}
+}
+
+func scan(path, prefix, suffix string, id *int64) bool {
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return false
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix), 10, 64)
+	*id = n
+	return err == nil
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	server := newBackupServer(t)
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "src"), 0755)
+	os.WriteFile(filepath.Join(src, "src", "app.py"), []byte("print('hi')\n"), 0644)
+	workspaces := []protocol.Workspace{
+		{Name: "api", Root: t.TempDir()},
+		{Name: "default", Root: src, Default: true},
+	}
+
+	svc := New(server.srv.URL+"/backups", "ingest-token", workspaces, WithTempDir(t.TempDir()))
+	backup, err := svc.Backup(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.ID != 1 || backup.Workspace != "default" || backup.SizeBytes == 0 || len(backup.SHA256) != 64 {
+		t.Fatalf("unexpected backup %+v", backup)
+	}
+	if len(server.tokens) != 1 || server.tokens[0] != "Bearer ingest-token" {
+		t.Fatalf("expected the ingest token to be sent, got %v", server.tokens)
+	}
+
+	// A new VM: the workspace only holds the gateway's state directory
+	dst := t.TempDir()
+	os.MkdirAll(filepath.Join(dst, ".devtail"), 0755)
+	restored, err := svc.Restore(context.Background(), backup.ID, dst)
+	if err != nil || !restored {
+		t.Fatalf("expected the backup to be restored, got %v, %v", restored, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "src", "app.py")); err != nil || string(data) != "print('hi')\n" {
+		t.Fatalf("unexpected restored file %q, %v", data, err)
+	}
+
+	// A restarted gateway finds its workspace in use
+	os.WriteFile(filepath.Join(dst, "src", "app.py"), []byte("print('edited')\n"), 0644)
+	if restored, err := svc.Restore(context.Background(), backup.ID, dst); err != nil || restored {
+		t.Fatalf("expected a workspace with files to be left alone, got %v, %v", restored, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "src", "app.py")); string(data) != "print('edited')\n" {
+		t.Fatalf("expected local edits to survive, got %q", data)
+	}
+}
+
+func TestBackupErrors(t *testing.T) {
+	server := newBackupServer(t)
+	svc := New(server.srv.URL+"/backups", "ingest-token",
+		[]protocol.Workspace{{Name: "default", Root: t.TempDir(), Default: true}}, WithTempDir(t.TempDir()))
+
+	if _, err := svc.Backup(context.Background(), "missing"); err == nil || !strings.Contains(err.Error(), "unknown workspace") {
+		t.Fatalf("expected an unknown workspace error, got %v", err)
+	}
+
+	server.mu.Lock()
+	server.failPuts = true
+	server.mu.Unlock()
+	if _, err := svc.Backup(context.Background(), "default"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the failed upload to be reported, got %v", err)
+	}
+}
+
+func TestBackupAll(t *testing.T) {
+	server := newBackupServer(t)
+	first, second := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(first, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(second, "b.txt"), []byte("b"), 0644)
+	svc := New(server.srv.URL+"/backups", "ingest-token", []protocol.Workspace{
+		{Name: "default", Root: first, Default: true},
+		{Name: "docs", Root: second},
+	}, WithTempDir(t.TempDir()))
+
+	backups, err := svc.BackupAll(context.Background())
+	if err != nil {
+		t.Fatalf("backup all: %v", err)
+	}
+	if len(backups) != 2 || backups[0].Workspace != "default" || backups[1].Workspace != "docs" {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+
+	server.mu.Lock()
+	server.failPuts = true
+	server.mu.Unlock()
+	backups, err = svc.BackupAll(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "workspace docs") || len(backups) != 0 {
+		t.Fatalf("expected both failures to be reported, got %v, %+v", err, backups)
+	}
+}
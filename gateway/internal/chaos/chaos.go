@@ -0,0 +1,244 @@
+// Package chaos injects faults into a running gateway so the retry and
+// recovery paths (acknowledgements, resume, terminal reattach) can be
+// exercised. It is only active when the gateway is started with --chaos.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultKillInterval is how often each terminal risks being killed
+const defaultKillInterval = 30 * time.Second
+
+// Config sets how often each fault happens. Zero values disable a fault.
+type Config struct {
+	// DropRate is the chance each protocol message is dropped, in either
+	// direction
+	DropRate float64
+
+	// ChatDelay bounds a random delay before each chat reply
+	ChatDelay time.Duration
+
+	// KillRate is the chance each terminal's shell is killed every
+	// KillInterval
+	KillRate     float64
+	KillInterval time.Duration
+}
+
+// ParseConfig reads a spec such as "drop=0.05,chat-delay=3s,kill=0.1".
+// Keys are drop, chat-delay, kill and kill-every.
+func ParseConfig(spec string) (Config, error) {
+	cfg := Config{KillInterval: defaultKillInterval}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Config{}, fmt.Errorf("chaos setting %q: expected key=value", part)
+		}
+
+		var err error
+		switch key {
+		case "drop":
+			cfg.DropRate, err = parseRate(value)
+		case "chat-delay":
+			cfg.ChatDelay, err = time.ParseDuration(value)
+		case "kill":
+			cfg.KillRate, err = parseRate(value)
+		case "kill-every":
+			cfg.KillInterval, err = time.ParseDuration(value)
+			if err == nil && cfg.KillInterval <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		default:
+			return Config{}, fmt.Errorf("unknown chaos setting %q, use drop, chat-delay, kill or kill-every", key)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("chaos setting %s: %w", key, err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+// Injector decides when faults happen. A nil Injector injects nothing.
+type Injector struct {
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// New creates an injector. A fixed seed replays the same faults for the
+// same sequence of calls.
+func New(config Config, seed int64) *Injector {
+	return &Injector{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// String describes the active faults for logs
+func (i *Injector) String() string {
+	return fmt.Sprintf("drop=%g chat-delay=%s kill=%g kill-every=%s",
+		i.config.DropRate, i.config.ChatDelay, i.config.KillRate, i.config.KillInterval)
+}
+
+func (i *Injector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < p
+}
+
+func (i *Injector) delay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return time.Duration(i.rand.Int63n(int64(max)))
+}
+
+// Transport drops messages on t at the configured rate. Keepalives are left
+// alone so sessions only fail the way a lossy network makes them fail.
+func (i *Injector) Transport(t ws.Transport) ws.Transport {
+	if i == nil || i.config.DropRate <= 0 {
+		return t
+	}
+	return &lossyTransport{Transport: t, injector: i}
+}
+
+type lossyTransport struct {
+	ws.Transport
+	injector *Injector
+}
+
+func (t *lossyTransport) ReadMessage() (*protocol.Message, error) {
+	for {
+		msg, err := t.Transport.ReadMessage()
+		if err != nil || !t.injector.chance(t.injector.config.DropRate) {
+			return msg, err
+		}
+		log.Debug().Str("chaos", "drop").Str("direction", "inbound").Str("type", string(msg.Type)).Str("id", msg.ID).Msg("dropped message")
+	}
+}
+
+func (t *lossyTransport) WriteMessage(msg *protocol.Message) error {
+	if t.injector.chance(t.injector.config.DropRate) {
+		log.Debug().Str("chaos", "drop").Str("direction", "outbound").Str("type", string(msg.Type)).Str("id", msg.ID).Msg("dropped message")
+		return nil
+	}
+	return t.Transport.WriteMessage(msg)
+}
+
+// LastHeartbeat passes through heartbeats from the wrapped transport, so
+// chaos mode does not change how dead sessions are reaped
+func (t *lossyTransport) LastHeartbeat() time.Time {
+	if hb, ok := t.Transport.(ws.HeartbeatTransport); ok {
+		return hb.LastHeartbeat()
+	}
+	return time.Time{}
+}
+
+// Chat delays each reply from h by up to the configured chat delay
+func (i *Injector) Chat(h ws.ChatHandler) ws.ChatHandler {
+	if i == nil || i.config.ChatDelay <= 0 {
+		return h
+	}
+	return &slowChat{ChatHandler: h, injector: i}
+}
+
+type slowChat struct {
+	ws.ChatHandler
+	injector *Injector
+}
+
+func (c *slowChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies, err := c.ChatHandler.HandleChatMessage(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	delayed := make(chan *protocol.ChatReply)
+	go func() {
+		defer close(delayed)
+		for reply := range replies {
+			select {
+			case <-time.After(c.injector.delay(c.injector.config.ChatDelay)):
+			case <-ctx.Done():
+				// Drain so the handler is not left blocked
+				for range replies {
+				}
+				return
+			}
+			select {
+			case delayed <- reply:
+			case <-ctx.Done():
+				for range replies {
+				}
+				return
+			}
+		}
+	}()
+	return delayed, nil
+}
+
+// KillTerminals kills random terminals' shells until ctx is done, so
+// clients see terminals exit unexpectedly
+func (i *Injector) KillTerminals(ctx context.Context, manager *terminal.Manager) {
+	if i == nil || i.config.KillRate <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(i.config.KillInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, id := range manager.ListTerminals() {
+			if !i.chance(i.config.KillRate) {
+				continue
+			}
+			term, err := manager.GetTerminal(id)
+			if err != nil {
+				continue
+			}
+			if err := term.Kill(); err != nil {
+				continue
+			}
+			log.Warn().Str("chaos", "kill").Str("terminal_id", id).Msg("killed terminal shell")
+		}
+	}
+}
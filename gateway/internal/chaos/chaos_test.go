@@ -0,0 +1,97 @@
+package chaos
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("drop=0.05, chat-delay=3s,kill=0.1,kill-every=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{DropRate: 0.05, ChatDelay: 3 * time.Second, KillRate: 0.1, KillInterval: 10 * time.Second}
+	if cfg != want {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+
+	for _, spec := range []string{"drop", "drop=2", "kill=-0.1", "chat-delay=soon", "kill-every=0s", "jitter=1"} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+type fakeTransport struct {
+	written int
+}
+
+func (t *fakeTransport) ReadMessage() (*protocol.Message, error) {
+	return &protocol.Message{ID: "m", Type: protocol.TypePing}, nil
+}
+
+func (t *fakeTransport) WriteMessage(*protocol.Message) error {
+	t.written++
+	return nil
+}
+
+func (t *fakeTransport) Keepalive() error { return nil }
+func (t *fakeTransport) Close() error     { return nil }
+
+func TestTransportDropsMessages(t *testing.T) {
+	inner := &fakeTransport{}
+	transport := New(Config{DropRate: 0.5}, 1).Transport(inner)
+
+	const sent = 1000
+	for i := 0; i < sent; i++ {
+		if err := transport.WriteMessage(&protocol.Message{ID: "m", Type: protocol.TypePing}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.written == 0 || inner.written == sent {
+		t.Fatalf("expected some but not all messages dropped, %d of %d delivered", inner.written, sent)
+	}
+
+	if _, err := transport.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNilInjectorIsPassThrough(t *testing.T) {
+	var injector *Injector
+	inner := &fakeTransport{}
+	if injector.Transport(inner) != inner {
+		t.Fatal("nil injector wrapped the transport")
+	}
+	injector.KillTerminals(context.Background(), nil)
+}
+
+type stubChat struct{}
+
+func (stubChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 2)
+	replies <- &protocol.ChatReply{Content: "a"}
+	replies <- &protocol.ChatReply{Content: "b", Finished: true}
+	close(replies)
+	return replies, nil
+}
+
+func TestChatDelaysReplies(t *testing.T) {
+	chat := New(Config{ChatDelay: 20 * time.Millisecond}, 1).Chat(stubChat{})
+
+	replies, err := chat.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for reply := range replies {
+		got = append(got, reply.Content)
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("replies were not passed through in order: %v", got)
+	}
+}
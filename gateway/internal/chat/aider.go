@@ -23,6 +23,7 @@ type AiderHandler struct {
 	mu           sync.Mutex
 	initialized  bool
 	workDir      string
+	lastPrompt   string
 }
 
 func NewAiderHandler(workDir string) *AiderHandler {
@@ -93,8 +94,15 @@ func (a *AiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.Chat
 	go func() {
 		defer close(replies)
 
+		// The mock keeps no conversation to branch; regenerating asks the
+		// last prompt again
 		a.mu.Lock()
-		_, err := fmt.Fprintf(a.stdin, "%s\n", msg.Content)
+		prompt := msg.Content
+		if msg.Regenerate {
+			prompt = a.lastPrompt
+		}
+		a.lastPrompt = prompt
+		_, err := fmt.Fprintf(a.stdin, "%s\n", prompt)
 		a.mu.Unlock()
 
 		if err != nil {
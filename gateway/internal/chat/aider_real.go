@@ -3,18 +3,20 @@ package chat
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
-	"path/filepath"
 
 	"github.com/creack/pty"
+	"github.com/devtail/gateway/internal/redact"
 	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/rs/zerolog/log"
 )
@@ -31,6 +33,9 @@ type AiderConfig struct {
 	MapTokens      int      // Max tokens for repo map
 	Files          []string // Files to include in context
 	ReadOnly       []string // Files to include as read-only
+	HistoryFile    string   // Chat history to restore on start, if any
+	ContextDir     string   // Where conversations are kept; ContextDir(workDir) if empty
+	APIKeys        map[string]string // API keys by environment variable; nil passes the gateway's own
 }
 
 // RealAiderHandler implements production Aider integration
@@ -51,24 +56,38 @@ type RealAiderHandler struct {
 	contextManager *ContextManager
 	fileWatcher    *FileWatcher
 	errorRecovery  *ErrorRecovery
+	breaker        *CircuitBreaker
 	
-	// Channel for managing output
+	// Channel for managing output. These live as long as the handler and are
+	// never closed; goroutines select on ctx/procDone to stop instead.
 	outputChan     chan string
 	errorChan      chan error
 	promptReady    chan struct{}
 	
+	// Current aider process
+	procDone       chan struct{} // closed by monitorProcess when the process exits
+	stopping       atomic.Bool   // set while the process is being stopped on purpose
+	
 	// Context for lifecycle management
 	ctx            context.Context
 	cancel         context.CancelFunc
+	closeOnce      sync.Once
 }
 
 // NewRealAiderHandler creates a production Aider handler
 func NewRealAiderHandler(workDir string, config AiderConfig) *RealAiderHandler {
 	ctx, cancel := context.WithCancel(context.Background())
-	sessionID := generateSessionID()
 	
-	// Initialize context manager
-	contextManager := NewContextManager(filepath.Join(workDir, ".devtail", "contexts"))
+	// Initialize context manager, resuming the last conversation if any
+	contextDir := config.ContextDir
+	if contextDir == "" {
+		contextDir = ContextDir(workDir)
+	}
+	contextManager := NewContextManager(contextDir)
+	sessionID := contextManager.LatestSessionID()
+	if sessionID == "" {
+		sessionID = generateSessionID()
+	}
 	conversation := contextManager.GetOrCreateContext(sessionID, workDir)
 	
 	// Initialize file watcher
@@ -79,6 +98,7 @@ func NewRealAiderHandler(workDir string, config AiderConfig) *RealAiderHandler {
 	
 	// Initialize error recovery
 	errorRecovery := NewErrorRecovery(sessionID)
+	breaker := NewCircuitBreaker(sessionID)
 	
 	handler := &RealAiderHandler{
 		workDir:        workDir,
@@ -88,6 +108,7 @@ func NewRealAiderHandler(workDir string, config AiderConfig) *RealAiderHandler {
 		contextManager: contextManager,
 		fileWatcher:    fileWatcher,
 		errorRecovery:  errorRecovery,
+		breaker:        breaker,
 		outputChan:     make(chan string, 100),
 		errorChan:      make(chan error, 10),
 		promptReady:    make(chan struct{}, 1),
@@ -102,6 +123,11 @@ func NewRealAiderHandler(workDir string, config AiderConfig) *RealAiderHandler {
 		handler.cleanupResources,     // Cleanup
 	)
 	
+	// While the breaker is open, restarting aider is how it checks for recovery
+	breaker.SetProbe(func(ctx context.Context) error {
+		return handler.restartAiderProcess()
+	})
+	
 	// Start file event processing if watcher is available
 	if fileWatcher != nil {
 		go handler.processFileEvents()
@@ -123,6 +149,13 @@ func (a *RealAiderHandler) Initialize(ctx context.Context) error {
 		return nil
 	}
 
+	if a.ctx.Err() != nil {
+		return fmt.Errorf("aider handler closed")
+	}
+
+	// Release anything left behind by a process that exited on its own
+	a.stopProcessLocked()
+
 	// Construct Aider command with proper arguments
 	args := a.buildAiderArgs()
 	
@@ -132,8 +165,9 @@ func (a *RealAiderHandler) Initialize(ctx context.Context) error {
 		Strs("args", args).
 		Msg("starting aider process")
 
-	// Create command
-	a.cmd = exec.CommandContext(ctx, "aider", args...)
+	// Create command. The process is tied to the handler's lifetime, not to
+	// the context of the request that happened to start it.
+	a.cmd = exec.CommandContext(a.ctx, "aider", args...)
 	a.cmd.Dir = a.workDir
 	
 	// Set environment variables
@@ -152,10 +186,7 @@ func (a *RealAiderHandler) Initialize(ctx context.Context) error {
 	a.cmd.Stdin = tty
 	a.cmd.Stdout = tty
 	a.cmd.Stderr = tty
-	a.cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setctty: true,
-		Setsid:  true,
-	}
+	a.cmd.SysProcAttr = ptyProcAttr()
 
 	// Start the process
 	if err := a.cmd.Start(); err != nil {
@@ -164,13 +195,20 @@ func (a *RealAiderHandler) Initialize(ctx context.Context) error {
 		return fmt.Errorf("failed to start aider: %w", err)
 	}
 
+	// The child holds its own copy of the tty
+	tty.Close()
+	a.pty = nil
+
 	// Set up I/O
 	a.stdin = ptmx
 	a.stdout = ptmx
 
+	procDone := make(chan struct{})
+	a.procDone = procDone
+
 	// Start output processing
-	go a.processOutput()
-	go a.monitorProcess()
+	go a.processOutput(ptmx, procDone)
+	go a.monitorProcess(a.cmd, procDone)
 
 	// Wait for initial prompt
 	select {
@@ -179,10 +217,14 @@ func (a *RealAiderHandler) Initialize(ctx context.Context) error {
 		log.Info().Str("sessionID", a.sessionID).Msg("aider initialized successfully")
 		return nil
 	case err := <-a.errorChan:
+		a.stopProcessLocked()
 		return fmt.Errorf("aider initialization failed: %w", err)
 	case <-time.After(30 * time.Second):
-		a.cleanup()
+		a.stopProcessLocked()
 		return fmt.Errorf("aider initialization timeout")
+	case <-ctx.Done():
+		a.stopProcessLocked()
+		return ctx.Err()
 	}
 }
 
@@ -232,6 +274,11 @@ func (a *RealAiderHandler) buildAiderArgs() []string {
 		args = append(args, "--read", file)
 	}
 
+	// Continue the branch of the conversation last switched to
+	if a.config.HistoryFile != "" {
+		args = append(args, "--chat-history-file", a.config.HistoryFile, "--restore-chat-history")
+	}
+
 	return args
 }
 
@@ -243,17 +290,26 @@ func (a *RealAiderHandler) getAiderEnv() []string {
 	}
 
 	// Pass through API keys if set
-	for _, key := range []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY"} {
-		if val := os.Getenv(key); val != "" {
-			env = append(env, fmt.Sprintf("%s=%s", key, val))
+	if a.config.APIKeys == nil {
+		for _, key := range []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY"} {
+			if val := os.Getenv(key); val != "" {
+				env = append(env, fmt.Sprintf("%s=%s", key, val))
+			}
 		}
+		return env
+	}
+	
+	// Configured keys replace the gateway's, including ones that were
+	// removed at runtime
+	for _, key := range apiKeyEnvVars {
+		env = append(env, fmt.Sprintf("%s=%s", key, a.config.APIKeys[key]))
 	}
 
 	return env
 }
 
-func (a *RealAiderHandler) processOutput() {
-	scanner := bufio.NewScanner(a.stdout)
+func (a *RealAiderHandler) processOutput(stdout io.Reader, procDone <-chan struct{}) {
+	scanner := bufio.NewScanner(stdout)
 	var buffer strings.Builder
 	
 	for scanner.Scan() {
@@ -271,6 +327,8 @@ func (a *RealAiderHandler) processOutput() {
 			if buffer.Len() > 0 {
 				select {
 				case a.outputChan <- buffer.String():
+				case <-procDone:
+					return
 				case <-a.ctx.Done():
 					return
 				}
@@ -296,6 +354,8 @@ func (a *RealAiderHandler) processOutput() {
 				select {
 				case a.outputChan <- buffer.String():
 					buffer.Reset()
+				case <-procDone:
+					return
 				case <-a.ctx.Done():
 					return
 				}
@@ -303,11 +363,27 @@ func (a *RealAiderHandler) processOutput() {
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		select {
-		case a.errorChan <- fmt.Errorf("output scanner error: %w", err):
-		case <-a.ctx.Done():
-		}
+	// EIO is how Linux reports that the process side of the PTY closed
+	err := scanner.Err()
+	if err == nil || errors.Is(err, syscall.EIO) {
+		return
+	}
+	
+	// Read errors are expected once the PTY is closed during a stop, and
+	// monitorProcess reports processes that exited on their own
+	select {
+	case <-procDone:
+		return
+	default:
+	}
+	if a.stopping.Load() {
+		return
+	}
+	
+	select {
+	case a.errorChan <- fmt.Errorf("output scanner error: %w", err):
+	case <-procDone:
+	case <-a.ctx.Done():
 	}
 }
 
@@ -332,29 +408,74 @@ func (a *RealAiderHandler) isPromptLine(line string) bool {
 	return false
 }
 
-func (a *RealAiderHandler) monitorProcess() {
-	err := a.cmd.Wait()
+// monitorProcess is the only caller of cmd.Wait for a given process
+func (a *RealAiderHandler) monitorProcess(cmd *exec.Cmd, procDone chan struct{}) {
+	err := cmd.Wait()
 	
-	if err != nil && !strings.Contains(err.Error(), "signal: killed") {
-		select {
-		case a.errorChan <- fmt.Errorf("aider process exited: %w", err):
-		case <-a.ctx.Done():
-		}
+	// Sample before closing procDone: stopProcessLocked clears the flag as
+	// soon as it observes the exit
+	intentional := a.stopping.Load() || a.ctx.Err() != nil
+	
+	a.initialized.Store(false)
+	close(procDone)
+	
+	if intentional {
+		return
 	}
 	
-	a.cleanup()
+	if err == nil {
+		err = fmt.Errorf("exited unexpectedly")
+	}
+	
+	// Report the crash without blocking if nobody is waiting on a response
+	select {
+	case a.errorChan <- fmt.Errorf("aider process exited: %w", err):
+	default:
+		log.Error().Err(err).Str("sessionID", a.sessionID).Msg("aider process exited")
+	}
 }
 
 func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	// Fail fast instead of restarting a crash-looping aider for every message
+	if err := a.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	if msg.Regenerate || msg.BranchFrom != "" {
+		var err error
+		if msg, err = a.branch(msg); err != nil {
+			return nil, err
+		}
+	}
+	
 	if err := a.Initialize(ctx); err != nil {
+		if ctx.Err() == nil {
+			a.breaker.RecordFailure(err)
+		}
 		return nil, fmt.Errorf("failed to initialize aider: %w", err)
 	}
 
+	// Edits made outside the assistant since it last answered
+	if changed := a.conversation.ChangedFiles(); len(changed) > 0 {
+		log.Debug().
+			Str("sessionID", a.sessionID).
+			Interface("files", changed).
+			Msg("files changed since the last response")
+	}
+
 	// Add message to conversation context
 	a.conversation.AddMessage(msg)
 
 	replies := make(chan *protocol.ChatReply, 10)
 
+	// Let the client know while the process is being restarted
+	ctx = WithRecoveryObserver(ctx, func(event protocol.BackendRecovery) {
+		select {
+		case replies <- &protocol.ChatReply{Recovery: &event}:
+		case <-ctx.Done():
+		}
+	})
+
 	go func() {
 		defer close(replies)
 		defer func() {
@@ -364,9 +485,11 @@ func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.
 			}
 		}()
 		
-		// Send user message
+		// Send user message; aider forwards it to the model API, so secrets
+		// pasted into the chat are scrubbed first
+		prompt := redact.String(msg.Content)
 		a.mu.Lock()
-		_, err := fmt.Fprintf(a.stdin, "%s\n", msg.Content)
+		_, err := fmt.Fprintf(a.stdin, "%s\n", prompt)
 		a.mu.Unlock()
 		
 		if err != nil {
@@ -382,7 +505,7 @@ func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.
 			}
 			
 			// Retry after successful recovery
-			_, retryErr := fmt.Fprintf(a.stdin, "%s\n", msg.Content)
+			_, retryErr := fmt.Fprintf(a.stdin, "%s\n", prompt)
 			if retryErr != nil {
 				replies <- &protocol.ChatReply{
 					Content:  FormatUserFriendlyError(retryErr),
@@ -418,10 +541,13 @@ func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.
 				}
 				
 			case <-a.promptReady:
+				a.breaker.RecordSuccess()
+				
 				// Response complete - add to context
 				fullResponse := responseBuffer.String()
+				var responseID string
 				if fullResponse != "" {
-					a.conversation.AddResponse(fullResponse, editedFiles, actions)
+					responseID = a.conversation.AddResponse(fullResponse, editedFiles, actions)
 					
 					// Update file contexts for edited files
 					for _, file := range editedFiles {
@@ -430,10 +556,12 @@ func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.
 						}
 					}
 				}
+				a.conversation.MarkInteraction()
 				
 				replies <- &protocol.ChatReply{
-					Content:  "",
-					Finished: true,
+					Content:   "",
+					Finished:  true,
+					MessageID: responseID,
 				}
 				return
 				
@@ -469,6 +597,40 @@ func (a *RealAiderHandler) HandleChatMessage(ctx context.Context, msg *protocol.
 	return replies, nil
 }
 
+// branch moves the conversation to the branch msg asks for and restarts
+// aider with that branch's history, returning the message to send on it
+func (a *RealAiderHandler) branch(msg *protocol.ChatMessage) (*protocol.ChatMessage, error) {
+	log.Info().
+		Str("sessionID", a.sessionID).
+		Str("from", msg.BranchFrom).
+		Bool("regenerate", msg.Regenerate).
+		Msg("switching conversation branch")
+
+	if msg.Regenerate {
+		prompt, err := a.contextManager.Retry(a.conversation, msg.BranchFrom)
+		if err != nil {
+			return nil, err
+		}
+		msg = &protocol.ChatMessage{Role: prompt.Role, Content: prompt.Content, Author: msg.Author, Workspace: msg.Workspace, WorkDir: msg.WorkDir}
+	} else if err := a.contextManager.Branch(a.conversation, msg.BranchFrom); err != nil {
+		return nil, err
+	}
+
+	// Aider keeps the conversation in memory, so it only forgets the
+	// messages after the branch point by starting over with the branch's
+	historyFile := filepath.Join(a.contextManager.dataDir, branchHistoryFile)
+	if err := writeChatHistory(historyFile, a.conversation.GetMessages()); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.config.HistoryFile = historyFile
+	a.stopProcessLocked()
+	a.mu.Unlock()
+	a.drainChannels()
+	return msg, nil
+}
+
 // parseAiderOutput extracts file operations and actions from Aider's output
 func (a *RealAiderHandler) parseAiderOutput(output string) (files []string, actions []string) {
 	lines := strings.Split(output, "\n")
@@ -496,7 +658,9 @@ func (a *RealAiderHandler) parseAiderOutput(output string) (files []string, acti
 		if strings.Contains(line, "Applied edit") {
 			actions = append(actions, "applied_edit")
 		}
-		if strings.Contains(line, "Committed") {
+		if m := commitLine.FindStringSubmatch(line); m != nil {
+			actions = append(actions, "commit:"+m[1])
+		} else if strings.Contains(line, "Committed") {
 			actions = append(actions, "commit")
 		}
 	}
@@ -504,9 +668,27 @@ func (a *RealAiderHandler) parseAiderOutput(output string) (files []string, acti
 	return files, actions
 }
 
+// Close stops the aider process and releases the handler's resources. It is
+// safe to call more than once.
 func (a *RealAiderHandler) Close() error {
-	a.cancel()
-	return a.cleanup()
+	var err error
+	
+	a.closeOnce.Do(func() {
+		a.cancel()
+		a.breaker.Close()
+		
+		a.mu.Lock()
+		a.stopProcessLocked()
+		a.mu.Unlock()
+		
+		if a.fileWatcher != nil {
+			if closeErr := a.fileWatcher.Close(); closeErr != nil {
+				err = fmt.Errorf("close file watcher: %w", closeErr)
+			}
+		}
+	})
+	
+	return err
 }
 
 // processFileEvents handles file system events from the watcher
@@ -537,61 +719,45 @@ func (a *RealAiderHandler) processFileEvents() {
 	}
 }
 
-func (a *RealAiderHandler) cleanup() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	var errs []error
-
-	// Close file watcher
-	if a.fileWatcher != nil {
-		if err := a.fileWatcher.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("close file watcher: %w", err))
-		}
+// stopProcessLocked terminates the current aider process, if any, and waits
+// for monitorProcess to observe its exit. The shared channels stay open so a
+// restarted process can reuse them. Callers must hold a.mu.
+func (a *RealAiderHandler) stopProcessLocked() {
+	a.initialized.Store(false)
+	
+	if a.cmd == nil {
+		return
 	}
-
-	// Close PTY
+	
+	a.stopping.Store(true)
+	defer a.stopping.Store(false)
+	
+	// Closing the PTY also unblocks processOutput
 	if a.ptmx != nil {
-		if err := a.ptmx.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("close ptmx: %w", err))
-		}
+		a.ptmx.Close()
+		a.ptmx = nil
 	}
 	if a.pty != nil {
-		if err := a.pty.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("close pty: %w", err))
-		}
+		a.pty.Close()
+		a.pty = nil
 	}
-
-	// Terminate process
-	if a.cmd != nil && a.cmd.Process != nil {
+	
+	if a.cmd.Process != nil && a.procDone != nil {
 		// Try graceful shutdown first
 		a.cmd.Process.Signal(syscall.SIGTERM)
 		
-		done := make(chan error, 1)
-		go func() {
-			done <- a.cmd.Wait()
-		}()
-		
 		select {
-		case <-done:
+		case <-a.procDone:
 			// Process exited gracefully
 		case <-time.After(5 * time.Second):
 			// Force kill
 			a.cmd.Process.Kill()
+			<-a.procDone
 		}
 	}
-
-	// Close channels
-	close(a.outputChan)
-	close(a.errorChan)
-	close(a.promptReady)
-
-	a.initialized.Store(false)
-
-	if len(errs) > 0 {
-		return fmt.Errorf("cleanup errors: %v", errs)
-	}
-	return nil
+	
+	a.cmd = nil
+	a.procDone = nil
 }
 
 // Error recovery methods
@@ -599,13 +765,12 @@ func (a *RealAiderHandler) cleanup() error {
 func (a *RealAiderHandler) restartAiderProcess() error {
 	log.Info().Str("sessionID", a.sessionID).Msg("attempting to restart aider process")
 	
-	// Clean up current process
-	if err := a.cleanup(); err != nil {
-		log.Error().Err(err).Msg("cleanup failed during restart")
-	}
+	// Stop the current process; the output channels are reused
+	a.mu.Lock()
+	a.stopProcessLocked()
+	a.mu.Unlock()
 	
-	// Reset initialization flag
-	a.initialized.Store(false)
+	a.drainChannels()
 	
 	// Reinitialize
 	ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
@@ -614,32 +779,12 @@ func (a *RealAiderHandler) restartAiderProcess() error {
 	return a.Initialize(ctx)
 }
 
+// resetConnection replaces the PTY linking the gateway to aider. The PTY is
+// the process's controlling terminal, so a fresh one needs a fresh process.
 func (a *RealAiderHandler) resetConnection() error {
 	log.Info().Str("sessionID", a.sessionID).Msg("attempting to reset connection")
 	
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	
-	// Close and reopen PTY
-	if a.ptmx != nil {
-		a.ptmx.Close()
-	}
-	if a.pty != nil {
-		a.pty.Close()
-	}
-	
-	// Recreate PTY
-	ptmx, tty, err := pty.Open()
-	if err != nil {
-		return fmt.Errorf("failed to recreate pty: %w", err)
-	}
-	
-	a.ptmx = ptmx
-	a.pty = tty
-	a.stdin = ptmx
-	a.stdout = ptmx
-	
-	return nil
+	return a.restartAiderProcess()
 }
 
 func (a *RealAiderHandler) cleanupResources() error {
@@ -650,20 +795,33 @@ func (a *RealAiderHandler) cleanupResources() error {
 		log.Error().Err(err).Msg("failed to save context during cleanup")
 	}
 	
-	// Clear channel buffers
-	for len(a.outputChan) > 0 {
-		<-a.outputChan
-	}
-	for len(a.errorChan) > 0 {
-		<-a.errorChan
-	}
+	a.drainChannels()
 	
 	return nil
 }
 
+// drainChannels discards stale output, errors and prompt signals so they are
+// not attributed to the next request
+func (a *RealAiderHandler) drainChannels() {
+	for {
+		select {
+		case <-a.outputChan:
+		case <-a.errorChan:
+		case <-a.promptReady:
+		default:
+			return
+		}
+	}
+}
+
 // Enhanced error handling in message processing
 
 func (a *RealAiderHandler) handleErrorWithRecovery(ctx context.Context, err error) error {
+	// Once the breaker opens, recovery is left to its background probe
+	if a.breaker.RecordFailure(err) {
+		return err
+	}
+	
 	// Attempt recovery
 	if recoveryErr := a.errorRecovery.HandleError(ctx, err); recoveryErr == nil {
 		// Recovery successful
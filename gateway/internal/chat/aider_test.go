@@ -9,8 +9,12 @@ import (
 	"github.com/devtail/gateway/pkg/protocol"
 )
 
+// mockWorkDir holds echo-aider.py, the mock AiderHandler runs from its
+// working directory
+const mockWorkDir = "testdata"
+
 func TestMockAiderHandler(t *testing.T) {
-	handler := NewAiderHandler(".")
+	handler := NewAiderHandler(mockWorkDir)
 	defer handler.Close()
 
 	ctx := context.Background()
@@ -44,7 +48,7 @@ func TestMockAiderHandler(t *testing.T) {
 }
 
 func TestAiderHandlerTimeout(t *testing.T) {
-	handler := NewAiderHandler(".")
+	handler := NewAiderHandler(mockWorkDir)
 	defer handler.Close()
 
 	// Create a context that times out quickly
@@ -68,7 +72,7 @@ func TestAiderHandlerTimeout(t *testing.T) {
 }
 
 func TestAiderHandlerConcurrent(t *testing.T) {
-	handler := NewAiderHandler(".")
+	handler := NewAiderHandler(mockWorkDir)
 	defer handler.Close()
 
 	ctx := context.Background()
@@ -141,8 +145,15 @@ func TestFactoryMockMode(t *testing.T) {
 }
 
 func TestFactoryRealMode(t *testing.T) {
-	// Test that factory creates real handler when requested
-	handler := NewHandler(".", false)
+	// Real mode needs the aider CLI and an API key; without either the
+	// factory returns the unconfigured handler instead
+	if !hasRealAider() {
+		t.Skip("aider not installed")
+	}
+	handler := NewHandlerFromConfig(".", protocol.ChatConfig{
+		Backend: protocol.BackendAider,
+		APIKeys: map[string]string{"OPENAI_API_KEY": "test"},
+	})
 	
 	// Check it's the real implementation
 	if _, ok := handler.(*RealAiderHandler); !ok {
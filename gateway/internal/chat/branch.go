@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/internal/redact"
+)
+
+// CodeUnknownMessage is the ChatError code for a branch or regenerate
+// request naming a message no conversation of the directory has
+const CodeUnknownMessage = "unknown_message"
+
+// branchHistoryFile is where the history of the branch a conversation moved
+// to is written for aider to restore, in the context directory
+const branchHistoryFile = "branch.chat.history.md"
+
+// Branch moves conv to a new branch holding the messages of the
+// conversation messageID is in, up to and including it. messageID may be
+// from conv or any other branch kept in the directory. The branch conv was
+// on is saved first and left as it was, so it can be returned to later.
+func (cm *ContextManager) Branch(conv *ConversationContext, messageID string) error {
+	source, messages, i, err := cm.findMessage(conv, messageID)
+	if err != nil {
+		return err
+	}
+	return cm.branch(conv, source, messageID, messages[:i+1])
+}
+
+// Retry moves conv to a new branch ending just before the user message
+// messageID names, or that the reply messageID names answered, and returns
+// that message to send again. An empty messageID retries the latest user
+// message of conv.
+func (cm *ContextManager) Retry(conv *ConversationContext, messageID string) (ContextMessage, error) {
+	var source string
+	var messages []ContextMessage
+	i := -1
+	if messageID == "" {
+		conv.mu.RLock()
+		source, messages = conv.SessionID, append([]ContextMessage(nil), conv.Messages...)
+		conv.mu.RUnlock()
+		i = len(messages) - 1
+	} else {
+		var err error
+		if source, messages, i, err = cm.findMessage(conv, messageID); err != nil {
+			return ContextMessage{}, err
+		}
+	}
+
+	for ; i >= 0 && messages[i].Role != "user"; i-- {
+	}
+	if i < 0 {
+		return ContextMessage{}, unknownMessage("no user message to answer again")
+	}
+	prompt := messages[i]
+	if err := cm.branch(conv, source, prompt.ID, messages[:i]); err != nil {
+		return ContextMessage{}, err
+	}
+	return prompt, nil
+}
+
+// branch saves conv and gives it a new session holding messages, the start
+// of the conversation source up to the message from
+func (cm *ContextManager) branch(conv *ConversationContext, source, from string, messages []ContextMessage) error {
+	if err := cm.SaveContext(conv); err != nil {
+		return err
+	}
+
+	conv.mu.Lock()
+	parent := conv.SessionID
+	conv.SessionID = fmt.Sprintf("aider-%d", time.Now().UnixNano())
+	conv.Messages = append(make([]ContextMessage, 0, len(messages)), messages...)
+	conv.ParentSessionID = source
+	conv.BranchedFrom = from
+	conv.LastActivity = time.Now()
+	conv.mu.Unlock()
+
+	// The branch left behind is only on disk from now on
+	cm.mu.Lock()
+	delete(cm.contexts, parent)
+	cm.contexts[conv.SessionID] = conv
+	cm.mu.Unlock()
+
+	return cm.SaveContext(conv)
+}
+
+// findMessage returns the session and messages of the conversation holding
+// messageID, and its index. conv is searched first, then the other
+// conversations in memory and on disk.
+func (cm *ContextManager) findMessage(conv *ConversationContext, messageID string) (string, []ContextMessage, int, error) {
+	if messageID == "" {
+		return "", nil, 0, unknownMessage("message_id is required")
+	}
+
+	candidates := []*ConversationContext{conv}
+	cm.mu.RLock()
+	for _, ctx := range cm.contexts {
+		if ctx != conv {
+			candidates = append(candidates, ctx)
+		}
+	}
+	cm.mu.RUnlock()
+
+	search := func(ctx *ConversationContext) (string, []ContextMessage, int, bool) {
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		for i, msg := range ctx.Messages {
+			if msg.ID == messageID {
+				return ctx.SessionID, append([]ContextMessage(nil), ctx.Messages...), i, true
+			}
+		}
+		return "", nil, 0, false
+	}
+	for _, ctx := range candidates {
+		if session, messages, i, ok := search(ctx); ok {
+			return session, messages, i, nil
+		}
+	}
+
+	// Branches left behind before a restart are only on disk
+	files, _ := filepath.Glob(filepath.Join(cm.dataDir, "*.json"))
+	for _, file := range files {
+		sessionID := strings.TrimSuffix(filepath.Base(file), ".json")
+		cm.mu.RLock()
+		_, loaded := cm.contexts[sessionID]
+		cm.mu.RUnlock()
+		if loaded {
+			continue
+		}
+		if ctx := cm.loadContextFromDisk(sessionID); ctx != nil {
+			if session, messages, i, ok := search(ctx); ok {
+				return session, messages, i, nil
+			}
+		}
+	}
+	return "", nil, 0, unknownMessage(fmt.Sprintf("no message %q in the conversation", messageID))
+}
+
+// writeChatHistory writes messages to path in the markdown aider keeps its
+// chat history in, for --restore-chat-history: user messages as "####"
+// lines, replies as plain text. Like saved contexts it is redacted.
+func writeChatHistory(path string, messages []ContextMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n# aider chat started at %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			for _, line := range strings.Split(redact.String(strings.TrimRight(msg.Content, "\n")), "\n") {
+				b.WriteString("#### " + line + "\n")
+			}
+		case "assistant":
+			b.WriteString(redact.String(strings.TrimRight(msg.Content, "\n")) + "\n")
+		default:
+			continue
+		}
+		b.WriteString("\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create context directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write chat history: %w", err)
+	}
+	return nil
+}
+
+func unknownMessage(message string) error {
+	err := NewChatError(ErrorTypeConfig, message, "").WithCode(CodeUnknownMessage)
+	err.Retryable = false
+	return err
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestBranchKeepsTheBranchLeftBehind(t *testing.T) {
+	dir := ContextDir(t.TempDir())
+	cm := NewContextManager(dir)
+	conv := cm.GetOrCreateContext("aider-1", dir)
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Content: "write a cache"})
+	first := conv.AddResponse("here is an LRU cache", nil, nil)
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Content: "make it thread safe"})
+	conv.AddResponse("added a mutex", nil, nil)
+
+	if err := cm.Branch(conv, first); err != nil {
+		t.Fatal(err)
+	}
+	if conv.SessionID == "aider-1" || conv.ParentSessionID != "aider-1" || conv.BranchedFrom != first || len(conv.Messages) != 2 {
+		t.Fatalf("expected a branch of aider-1 after its first reply, got %s from %s with %d messages",
+			conv.SessionID, conv.ParentSessionID, len(conv.Messages))
+	}
+	branch := conv.SessionID
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Content: "use a sync.Map instead"})
+
+	// The original keeps all four messages, and can be returned to
+	if left := NewContextManager(dir).GetOrCreateContext("aider-1", dir); len(left.Messages) != 4 {
+		t.Fatalf("expected the branch left behind saved whole, got %d messages", len(left.Messages))
+	}
+	if err := cm.Branch(conv, NewContextManager(dir).GetOrCreateContext("aider-1", dir).Messages[3].ID); err != nil {
+		t.Fatal(err)
+	}
+	if conv.ParentSessionID != "aider-1" || len(conv.Messages) != 4 || conv.Messages[3].Content != "added a mutex" {
+		t.Fatalf("expected to be back on the first branch's messages, got %+v", conv.Messages)
+	}
+	if _, err := os.Stat(filepath.Join(dir, branch+".json")); err != nil {
+		t.Fatalf("expected the second branch saved: %v", err)
+	}
+
+	var chatErr *ChatError
+	if err := cm.Branch(conv, "msg-nope"); !errors.As(err, &chatErr) || chatErr.Code != CodeUnknownMessage {
+		t.Fatalf("expected an unknown_message error, got %v", err)
+	}
+}
+
+func TestRetryAnswersThePromptAgain(t *testing.T) {
+	dir := ContextDir(t.TempDir())
+	cm := NewContextManager(dir)
+	conv := cm.GetOrCreateContext("aider-1", dir)
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Content: "write a cache"})
+	reply := conv.AddResponse("here is an LRU cache", nil, nil)
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Content: "make it thread safe"})
+	conv.AddResponse("added a mutex", nil, nil)
+
+	prompt, err := cm.Retry(conv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Content != "make it thread safe" || len(conv.Messages) != 2 {
+		t.Fatalf("expected the latest prompt retried after 2 messages, got %q after %d", prompt.Content, len(conv.Messages))
+	}
+
+	prompt, err = cm.Retry(conv, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Content != "write a cache" || len(conv.Messages) != 0 {
+		t.Fatalf("expected the first prompt retried from the start, got %q after %d", prompt.Content, len(conv.Messages))
+	}
+}
+
+func TestChatHistoryIsAiderMarkdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), branchHistoryFile)
+	err := writeChatHistory(path, []ContextMessage{
+		{Role: "user", Content: "write a cache\nin Go"},
+		{Role: "assistant", Content: "here is an LRU cache\n"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	want := "#### write a cache\n#### in Go\n\nhere is an LRU cache\n\n"
+	if got := string(data); len(got) < len(want) || got[len(got)-len(want):] != want {
+		t.Fatalf("unexpected history:\n%s", got)
+	}
+}
@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState string
+
+const (
+	// CircuitClosed lets requests through
+	CircuitClosed CircuitState = "closed"
+
+	// CircuitOpen rejects requests while the backend is probed in the
+	// background
+	CircuitOpen CircuitState = "open"
+)
+
+// CodeCircuitOpen is the ChatError code returned while the breaker is open
+const CodeCircuitOpen = "backend_unavailable"
+
+// CircuitBreaker stops a crash-looping AI backend from being restarted for
+// every message. After threshold consecutive failures it opens: requests fail
+// immediately with the last failure as the cause, and a probe tries to bring
+// the backend back with growing delays until one succeeds.
+type CircuitBreaker struct {
+	sessionID   string
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	lastErr   error
+	nextProbe time.Time
+	probe     func(ctx context.Context) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCircuitBreaker creates a closed breaker
+func NewCircuitBreaker(sessionID string) *CircuitBreaker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &CircuitBreaker{
+		sessionID:   sessionID,
+		threshold:   5,
+		cooldown:    10 * time.Second,
+		maxCooldown: 5 * time.Minute,
+		state:       CircuitClosed,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// SetProbe configures how the breaker checks whether the backend recovered.
+// Without a probe the breaker closes again once the cooldown has passed.
+func (cb *CircuitBreaker) SetProbe(probe func(ctx context.Context) error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probe = probe
+}
+
+// State returns the breaker's state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// Allow returns nil if a request may go to the backend, or a ChatError with
+// code CodeCircuitOpen wrapping the failure that opened the breaker
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitClosed {
+		return nil
+	}
+
+	cause := ClassifyError(cb.lastErr, cb.sessionID)
+	err := NewChatError(cause.Type, "AI assistant is failing repeatedly: "+cause.Message, cb.sessionID).
+		WithCode(CodeCircuitOpen).
+		WithCause(cb.lastErr).
+		WithMetadata("failures", cb.failures)
+	err.Retryable = false
+	if wait := time.Until(cb.nextProbe); wait > 0 {
+		err.WithRetryAfter(wait)
+	}
+	return err
+}
+
+// RecordSuccess resets the failure count
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitClosed {
+		cb.failures = 0
+		cb.lastErr = nil
+	}
+}
+
+// RecordFailure counts a backend failure and reports whether the breaker is
+// now open
+func (cb *CircuitBreaker) RecordFailure(err error) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		err = errors.New("unknown failure")
+	}
+	cb.failures++
+	cb.lastErr = err
+	if cb.state == CircuitOpen {
+		return true
+	}
+	if cb.failures < cb.threshold {
+		return false
+	}
+
+	cb.state = CircuitOpen
+	cb.nextProbe = time.Now().Add(cb.cooldown)
+	log.Warn().
+		Err(err).
+		Str("sessionID", cb.sessionID).
+		Int("failures", cb.failures).
+		Msg("ai backend circuit opened")
+
+	go cb.probeUntilClosed()
+	return true
+}
+
+// probeUntilClosed runs while the breaker is open
+func (cb *CircuitBreaker) probeUntilClosed() {
+	cooldown := cb.cooldown
+	for {
+		select {
+		case <-time.After(cooldown):
+		case <-cb.ctx.Done():
+			return
+		}
+
+		cb.mu.Lock()
+		probe := cb.probe
+		cb.mu.Unlock()
+
+		var err error
+		if probe != nil {
+			err = probe(cb.ctx)
+		}
+		if cb.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// A backend that starts can still fail on the first real
+			// request, so one more failure reopens the breaker until a
+			// request succeeds
+			cb.mu.Lock()
+			cb.state = CircuitClosed
+			cb.failures = cb.threshold - 1
+			cb.mu.Unlock()
+
+			log.Info().Str("sessionID", cb.sessionID).Msg("ai backend recovered, circuit closed")
+			return
+		}
+
+		cooldown *= 2
+		if cooldown > cb.maxCooldown {
+			cooldown = cb.maxCooldown
+		}
+
+		cb.mu.Lock()
+		cb.lastErr = err
+		cb.nextProbe = time.Now().Add(cooldown)
+		cb.mu.Unlock()
+
+		log.Warn().
+			Err(err).
+			Str("sessionID", cb.sessionID).
+			Dur("nextProbe", cooldown).
+			Msg("ai backend probe failed")
+	}
+}
+
+// Close stops background probing
+func (cb *CircuitBreaker) Close() {
+	cb.cancel()
+}
+
+// IsCircuitOpen reports whether err was returned by an open CircuitBreaker
+func IsCircuitOpen(err error) bool {
+	var chatErr *ChatError
+	return errors.As(err, &chatErr) && chatErr.Code == CodeCircuitOpen
+}
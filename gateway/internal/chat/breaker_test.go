@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(probe func(ctx context.Context) error) *CircuitBreaker {
+	cb := NewCircuitBreaker("s1")
+	cb.threshold = 3
+	cb.cooldown = 10 * time.Millisecond
+	cb.maxCooldown = 20 * time.Millisecond
+	cb.SetProbe(probe)
+	return cb
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := newTestBreaker(func(ctx context.Context) error { return errors.New("still broken") })
+	defer cb.Close()
+
+	cause := errors.New("aider process exited: exit status 1")
+	for i := 0; i < 2; i++ {
+		if cb.RecordFailure(cause) {
+			t.Fatalf("opened after %d failures", i+1)
+		}
+		if err := cb.Allow(); err != nil {
+			t.Fatalf("closed breaker rejected a request: %v", err)
+		}
+	}
+	if !cb.RecordFailure(cause) {
+		t.Fatal("expected the breaker to open")
+	}
+
+	err := cb.Allow()
+	if !IsCircuitOpen(err) {
+		t.Fatalf("expected a circuit open error, got %v", err)
+	}
+	var chatErr *ChatError
+	if !errors.As(err, &chatErr) {
+		t.Fatalf("expected a ChatError, got %T", err)
+	}
+	if chatErr.Type != ErrorTypeProcess || chatErr.Retryable || !errors.Is(err, cause) {
+		t.Fatalf("unexpected error %+v", chatErr)
+	}
+	if client := chatErr.ClientError(); client.Code != CodeCircuitOpen || client.Cause == "" || client.ErrorType != "process" {
+		t.Fatalf("unexpected client error %+v", client)
+	}
+}
+
+func TestCircuitBreakerProbesUntilRecovered(t *testing.T) {
+	var probes atomic.Int32
+	cb := newTestBreaker(func(ctx context.Context) error {
+		if probes.Add(1) < 3 {
+			return errors.New("missing binary")
+		}
+		return nil
+	})
+	defer cb.Close()
+
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure(errors.New("exec: aider not found"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cb.State() != CircuitClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker still open after %d probes", probes.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if probes.Load() != 3 {
+		t.Fatalf("expected 3 probes, got %d", probes.Load())
+	}
+
+	// Recovered but unproven: one more failure reopens it
+	if !cb.RecordFailure(errors.New("aider process exited")) {
+		t.Fatal("expected a failure right after recovery to reopen the breaker")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := newTestBreaker(nil)
+	defer cb.Close()
+
+	cb.RecordFailure(errors.New("timeout"))
+	cb.RecordFailure(errors.New("timeout"))
+	cb.RecordSuccess()
+	if cb.RecordFailure(errors.New("timeout")) {
+		t.Fatal("failures before a success should not count")
+	}
+}
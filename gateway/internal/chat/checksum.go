@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// racyWindow is how recently a file may have been modified for its
+	// cached checksum to be distrusted. Filesystems with coarse timestamps
+	// give a same-size edit within the same tick an unchanged mtime.
+	racyWindow = 2 * time.Second
+
+	// maxChecksumEntries bounds the cache; it starts over when full
+	maxChecksumEntries = 10000
+)
+
+// checksumCache remembers content hashes by size and modification time, so
+// files that did not change are not read again
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var fileChecksums = &checksumCache{entries: make(map[string]checksumEntry)}
+
+// Sum returns the SHA-256 of the file at path as "sha256:<hex>"
+func (c *checksumCache) Sum(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) && time.Since(stat.ModTime()) > racyWindow {
+		return entry.sum, nil
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxChecksumEntries {
+		c.entries = make(map[string]checksumEntry)
+	}
+	c.entries[path] = checksumEntry{size: stat.Size(), modTime: stat.ModTime(), sum: sum}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
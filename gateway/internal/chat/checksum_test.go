@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChecksumDetectsSameSizeEdits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	os.WriteFile(path, []byte("package a"), 0644)
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(path, mtime, mtime)
+
+	before, err := calculateFileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size, same mtime, different content
+	os.WriteFile(path, []byte("package b"), 0644)
+	os.Chtimes(path, mtime, mtime)
+	fileChecksums.mu.Lock()
+	delete(fileChecksums.entries, path)
+	fileChecksums.mu.Unlock()
+
+	after, err := calculateFileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("checksum did not change with the content")
+	}
+}
+
+func TestChecksumCacheDistrustsRecentFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.go")
+	os.WriteFile(path, []byte("package a"), 0644)
+	mtime := time.Now()
+	os.Chtimes(path, mtime, mtime)
+
+	before, _ := calculateFileChecksum(path)
+
+	// An edit within the filesystem's timestamp resolution
+	os.WriteFile(path, []byte("package b"), 0644)
+	os.Chtimes(path, mtime, mtime)
+
+	if after, _ := calculateFileChecksum(path); before == after {
+		t.Fatal("cached checksum returned for a file modified just now")
+	}
+}
+
+func TestChangedFilesSinceInteraction(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	write("edited.go", "package a")
+	write("same.go", "package a")
+	write("removed.go", "package a")
+
+	conv := NewConversationContext("test", dir)
+	for _, name := range []string{"edited.go", "same.go", "removed.go"} {
+		conv.UpdateFileContext(name, "active")
+	}
+	if changed := conv.ChangedFiles(); changed != nil {
+		t.Fatalf("changes reported before any interaction: %v", changed)
+	}
+
+	conv.MarkInteraction()
+	if changed := conv.ChangedFiles(); len(changed) != 0 {
+		t.Fatalf("changes reported right after the interaction: %v", changed)
+	}
+
+	write("edited.go", "package b")
+	os.Remove(filepath.Join(dir, "removed.go"))
+	write("new.go", "package a")
+	conv.UpdateFileContext("new.go", "created")
+
+	want := []FileChange{
+		{Path: "edited.go", Change: "modified"},
+		{Path: "new.go", Change: "created"},
+		{Path: "removed.go", Change: "deleted"},
+	}
+	if changed := conv.ChangedFiles(); !reflect.DeepEqual(changed, want) {
+		t.Fatalf("ChangedFiles() = %v, want %v", changed, want)
+	}
+}
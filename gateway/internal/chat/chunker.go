@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+const (
+	// maxHeldBack bounds how much prose a Chunker holds back waiting for a
+	// boundary, such as a long line without one
+	maxHeldBack = 4096
+
+	// maxHeldCode bounds how much of a code block is held back waiting for
+	// its closing fence; longer blocks are sent in pieces
+	maxHeldCode = 64 << 10
+)
+
+// Chunk is a piece of a streamed reply and the markdown block it is part
+// of, empty when streaming by token
+type Chunk struct {
+	Text  string
+	Block string
+}
+
+// Chunker regroups streamed reply content at sentence or paragraph
+// boundaries, for clients that would rather get fewer, readable messages
+// than every token as the backend produces it. It follows the reply's
+// markdown so a fenced code block is never split across chunks, since
+// clients render half a fence as garbage.
+type Chunker struct {
+	granularity string
+	held        string
+	scanned     int    // end of the complete lines of held already looked at
+	midLine     bool   // held starts partway through a line
+	fence       string // opening fence of the code block held, if in one
+}
+
+// NewChunker slices content at granularity; unknown granularities pass
+// content through as it arrives
+func NewChunker(granularity string) *Chunker {
+	return &Chunker{granularity: Granularity(granularity)}
+}
+
+// Granularity returns g if the gateway supports it, or token
+func Granularity(g string) string {
+	switch g {
+	case protocol.GranularitySentence, protocol.GranularityParagraph:
+		return g
+	}
+	return protocol.GranularityToken
+}
+
+// Add appends content and returns the chunks complete so far: prose up to
+// its last boundary and code blocks up to their closing fence. It returns
+// none to wait for more.
+func (c *Chunker) Add(content string) []Chunk {
+	if c.granularity == protocol.GranularityToken {
+		return []Chunk{{Text: content}}
+	}
+
+	c.held += content
+	var chunks []Chunk
+	for {
+		nl := strings.IndexByte(c.held[c.scanned:], '\n')
+		if nl < 0 {
+			break
+		}
+		start := c.scanned
+		line := c.held[start : start+nl]
+		c.scanned += nl + 1
+
+		if c.fence == "" {
+			fence, ok := openingFence(line)
+			if !ok || (start == 0 && c.midLine) {
+				continue
+			}
+			// The prose before the block goes on its own
+			if start > 0 {
+				chunks = append(chunks, c.cut(start, protocol.BlockProse))
+			}
+			c.fence = fence
+		} else if closesFence(line, c.fence) {
+			c.fence = ""
+			chunks = append(chunks, c.cut(c.scanned, protocol.BlockCode))
+		}
+	}
+
+	if c.fence != "" {
+		if len(c.held) >= maxHeldCode {
+			chunks = append(chunks, c.cut(len(c.held), protocol.BlockCode))
+		}
+		return chunks
+	}
+
+	end := c.lastBoundary()
+	if end == 0 && len(c.held) >= maxHeldBack {
+		end = len(c.held)
+	}
+	if end > 0 {
+		chunks = append(chunks, c.cut(end, protocol.BlockProse))
+	}
+	return chunks
+}
+
+// Flush returns whatever is held back, for the end of the reply
+func (c *Chunker) Flush() Chunk {
+	if c.held == "" {
+		return Chunk{}
+	}
+
+	block := protocol.BlockProse
+	if c.fence != "" {
+		block = protocol.BlockCode
+	}
+	chunk := Chunk{Text: c.held, Block: block}
+	*c = Chunker{granularity: c.granularity}
+	return chunk
+}
+
+// cut removes the first end bytes held and returns them as a chunk
+func (c *Chunker) cut(end int, block string) Chunk {
+	text := c.held[:end]
+	c.held = c.held[end:]
+	c.scanned = max(c.scanned-end, 0)
+	c.midLine = !strings.HasSuffix(text, "\n")
+	return Chunk{Text: text, Block: block}
+}
+
+// lastBoundary returns the end of the last complete sentence or paragraph
+// held, or 0 if there is none yet
+func (c *Chunker) lastBoundary() int {
+	if c.granularity == protocol.GranularityParagraph {
+		if i := strings.LastIndex(c.held, "\n\n"); i >= 0 {
+			return i + 2
+		}
+		return 0
+	}
+
+	// A full stop only ends a sentence once whitespace follows, so "3.14"
+	// and "main.go" stay whole
+	for i := len(c.held) - 1; i >= 0; i-- {
+		switch c.held[i] {
+		case '\n':
+			return i + 1
+		case ' ', '\t':
+			if i > 0 && strings.IndexByte(".!?", c.held[i-1]) >= 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// openingFence returns the fence a line opens a code block with, such as
+// "```" in "```go", allowing the three spaces of indent markdown does
+func openingFence(line string) (string, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return "", false
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+	if n < 3 {
+		return "", false
+	}
+	// Backtick fences cannot have backticks in their info string
+	if trimmed[0] == '`' && strings.Contains(trimmed[n:], "`") {
+		return "", false
+	}
+	return trimmed[:n], true
+}
+
+// closesFence reports whether line closes a code block opened with fence:
+// the same character at least as many times, and nothing else
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimSpace(line)
+	return len(trimmed) >= len(fence) && strings.Trim(trimmed, fence[:1]) == ""
+}
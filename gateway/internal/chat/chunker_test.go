@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func chunk(granularity string, tokens ...string) []Chunk {
+	c := NewChunker(granularity)
+	var chunks []Chunk
+	for _, token := range tokens {
+		chunks = append(chunks, c.Add(token)...)
+	}
+	if final := c.Flush(); final.Text != "" {
+		chunks = append(chunks, final)
+	}
+	return chunks
+}
+
+func texts(chunks []Chunk) []string {
+	var texts []string
+	for _, chunk := range chunks {
+		texts = append(texts, chunk.Text)
+	}
+	return texts
+}
+
+func TestChunkerGranularities(t *testing.T) {
+	tokens := []string{"Edit ", "main", ".go", " first. ", "Then", " run it", "!\n\nDone", " at 3.", "14"}
+
+	for _, tt := range []struct {
+		granularity string
+		want        []string
+	}{
+		{protocol.GranularityToken, tokens},
+		{"", tokens},
+		{protocol.GranularitySentence, []string{"Edit main.go first. ", "Then run it!\n\n", "Done at 3.14"}},
+		{protocol.GranularityParagraph, []string{"Edit main.go first. Then run it!\n\n", "Done at 3.14"}},
+	} {
+		got := texts(chunk(tt.granularity, tokens...))
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%q: got %q, want %q", tt.granularity, got, tt.want)
+		}
+	}
+}
+
+func TestChunkerBoundsWhatItHoldsBack(t *testing.T) {
+	c := NewChunker(protocol.GranularityParagraph)
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 4; i++ {
+		if chunks := c.Add(line); len(chunks) != 0 {
+			t.Fatalf("flushed after %d bytes", (i+1)*len(line))
+		}
+	}
+	if chunks := c.Add(line); len(chunks) != 1 || len(chunks[0].Text) != 5*len(line) {
+		t.Fatalf("expected everything held back flushed, got %q", texts(chunks))
+	}
+}
+
+func TestChunkerKeepsCodeBlocksWhole(t *testing.T) {
+	tokens := []string{"Change it. Like", " this:\n``", "`go\nfunc main() {\n", "\tfmt.Println(\"hi. there\")\n\n", "}\n", "```\nThen ", "build.\n~~~~\n", "```\n~~~\n~~~~\nDone."}
+
+	for _, granularity := range []string{protocol.GranularitySentence, protocol.GranularityParagraph} {
+		got := chunk(granularity, tokens...)
+		var blocks []string
+		for _, c := range got {
+			blocks = append(blocks, c.Block)
+		}
+
+		// Each block arrives as one chunk, labelled with its kind
+		want := []Chunk{
+			{"```go\nfunc main() {\n\tfmt.Println(\"hi. there\")\n\n}\n```\n", protocol.BlockCode},
+			{"~~~~\n```\n~~~\n~~~~\n", protocol.BlockCode},
+		}
+		for _, w := range want {
+			found := false
+			for _, c := range got {
+				found = found || c == w
+			}
+			if !found {
+				t.Errorf("%s: code block %q not sent whole, got %q %q", granularity, w.Text, texts(got), blocks)
+			}
+		}
+		for _, c := range got {
+			if c.Block == protocol.BlockProse && strings.Contains(c.Text, "```") {
+				t.Errorf("%s: fence in prose chunk %q", granularity, c.Text)
+			}
+		}
+		if strings.Join(texts(got), "") != strings.Join(tokens, "") {
+			t.Errorf("%s: text changed: %q", granularity, texts(got))
+		}
+	}
+}
+
+func TestChunkerLabelsUnfinishedCodeBlocks(t *testing.T) {
+	c := NewChunker(protocol.GranularitySentence)
+	if chunks := c.Add("Here.\n```sh\nmake\n"); len(chunks) != 1 || chunks[0].Block != protocol.BlockProse {
+		t.Fatalf("expected the prose before the block, got %+v", chunks)
+	}
+	if final := c.Flush(); final.Text != "```sh\nmake\n" || final.Block != protocol.BlockCode {
+		t.Fatalf("expected the unfinished block as code, got %+v", final)
+	}
+}
@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// CodeExtractor picks the fenced code blocks out of a streamed reply, with
+// their language and, when the reply names it, the file they are for
+type CodeExtractor struct {
+	line     string // the line being received
+	previous string // the last non-empty line outside a block
+	fence    string // opening fence of the block being received
+	block    protocol.CodeBlock
+	content  strings.Builder
+}
+
+// NewCodeExtractor starts extracting from a new reply
+func NewCodeExtractor() *CodeExtractor {
+	return &CodeExtractor{}
+}
+
+// Add takes the next part of the reply and returns the blocks it closed
+func (e *CodeExtractor) Add(content string) []protocol.CodeBlock {
+	var blocks []protocol.CodeBlock
+	for content != "" {
+		nl := strings.IndexByte(content, '\n')
+		if nl < 0 {
+			e.line += content
+			break
+		}
+		line := e.line + content[:nl]
+		e.line = ""
+		content = content[nl+1:]
+
+		if block, ok := e.addLine(line); ok {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// Flush returns the block the reply ended in without closing, if any
+func (e *CodeExtractor) Flush() []protocol.CodeBlock {
+	defer func() { *e = CodeExtractor{} }()
+
+	if e.fence == "" {
+		return nil
+	}
+	e.content.WriteString(e.line)
+	e.block.Content = e.content.String()
+	return []protocol.CodeBlock{e.block}
+}
+
+// addLine follows the reply one line at a time, returning a block once its
+// closing fence arrives
+func (e *CodeExtractor) addLine(line string) (protocol.CodeBlock, bool) {
+	if e.fence == "" {
+		fence, ok := openingFence(line)
+		if !ok {
+			if strings.TrimSpace(line) != "" {
+				e.previous = line
+			}
+			return protocol.CodeBlock{}, false
+		}
+		e.fence = fence
+		e.block = parseInfo(strings.TrimSpace(line)[len(fence):])
+		if e.block.File == "" {
+			e.block.File = pathFromLine(e.previous)
+		}
+		e.content.Reset()
+		return protocol.CodeBlock{}, false
+	}
+
+	if !closesFence(line, e.fence) {
+		e.content.WriteString(line)
+		e.content.WriteByte('\n')
+		return protocol.CodeBlock{}, false
+	}
+	block := e.block
+	block.Content = e.content.String()
+	e.fence, e.previous = "", ""
+	return block, true
+}
+
+// parseInfo reads the language and file from a fence's info string, as in
+// "go", "go main.go", "python:app/main.py" or "main.go"
+func parseInfo(info string) protocol.CodeBlock {
+	var block protocol.CodeBlock
+	fields := strings.Fields(info)
+	if len(fields) == 0 {
+		return block
+	}
+
+	first := fields[0]
+	if lang, file, ok := strings.Cut(first, ":"); ok && looksLikePath(file) {
+		return protocol.CodeBlock{Language: lang, File: file}
+	}
+	if looksLikePath(first) && strings.Contains(first, ".") {
+		return protocol.CodeBlock{File: first}
+	}
+	block.Language = first
+	for _, field := range fields[1:] {
+		// Some models write title="main.go" or file=main.go
+		if _, value, ok := strings.Cut(field, "="); ok {
+			field = strings.Trim(value, `"'`)
+		}
+		if looksLikePath(field) {
+			block.File = field
+			break
+		}
+	}
+	return block
+}
+
+// pathFromLine returns the file a line on its own names, as aider and most
+// models write one before a block: "main.go", "`main.go`", "**main.go**:"
+func pathFromLine(line string) string {
+	path := strings.Trim(strings.TrimSpace(line), "*`#: ")
+	if !looksLikePath(path) {
+		return ""
+	}
+	return path
+}
+
+// looksLikePath reports whether s could be a relative or absolute file path
+// rather than a word or a sentence
+func looksLikePath(s string) bool {
+	if s == "" || len(s) > 255 || strings.ContainsAny(s, " \t`\"'<>|") || strings.Contains(s, "://") {
+		return false
+	}
+	if strings.HasSuffix(s, ".") || strings.HasSuffix(s, "/") {
+		return false
+	}
+	return strings.ContainsAny(s, "/.")
+}
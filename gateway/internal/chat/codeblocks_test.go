@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestCodeExtractor(t *testing.T) {
+	reply := "Update the handler.\n\n**internal/api/handler.go**\n```go\nfunc Handle() {}\n```\n" +
+		"And the script:\n```python:scripts/run.py\nprint(\"hi\")\n\n```\n" +
+		"Run it with:\n```sh\nmake test\n```\n" +
+		"Finally:\n```main.go\npackage main\n```\n" +
+		"```ts title=\"web/app.ts\"\nlet x = 1\n"
+
+	// Split mid-fence and mid-line, as streamed tokens are
+	e := NewCodeExtractor()
+	var got []protocol.CodeBlock
+	for i := 0; i < len(reply); i += 7 {
+		got = append(got, e.Add(reply[i:min(i+7, len(reply))])...)
+	}
+	got = append(got, e.Flush()...)
+
+	want := []protocol.CodeBlock{
+		{Language: "go", Content: "func Handle() {}\n", File: "internal/api/handler.go"},
+		{Language: "python", Content: "print(\"hi\")\n\n", File: "scripts/run.py"},
+		{Language: "sh", Content: "make test\n"},
+		{Content: "package main\n", File: "main.go"},
+		{Language: "ts", Content: "let x = 1\n", File: "web/app.ts"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
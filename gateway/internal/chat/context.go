@@ -1,14 +1,16 @@
 package chat
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/devtail/gateway/internal/redact"
 	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/rs/zerolog/log"
 )
@@ -23,6 +25,15 @@ type ConversationContext struct {
 	Files         map[string]FileContext    `json:"files"`
 	GitState      GitContext                `json:"git_state"`
 	TokenUsage    TokenUsage                `json:"token_usage"`
+
+	// LastInteraction is when the AI last finished a response; see
+	// ChangedFiles
+	LastInteraction time.Time               `json:"last_interaction,omitempty"`
+
+	// ParentSessionID and BranchedFrom are the conversation and message a
+	// branch was started from; see ContextManager.Branch
+	ParentSessionID string                  `json:"parent_session_id,omitempty"`
+	BranchedFrom    string                  `json:"branched_from,omitempty"`
 	mu            sync.RWMutex              `json:"-"`
 }
 
@@ -31,6 +42,7 @@ type ContextMessage struct {
 	ID        string                 `json:"id"`
 	Timestamp time.Time              `json:"timestamp"`
 	Role      string                 `json:"role"` // "user", "assistant", "system"
+	Author    string                 `json:"author,omitempty"` // user who sent a user message, on shared gateways
 	Content   string                 `json:"content"`
 	Files     []string               `json:"files,omitempty"`     // Files referenced
 	Actions   []string               `json:"actions,omitempty"`   // Actions taken (edit, create, delete)
@@ -44,6 +56,16 @@ type FileContext struct {
 	Size         int64     `json:"size"`
 	Checksum     string    `json:"checksum"`
 	Role         string    `json:"role"` // "active", "readonly", "created", "deleted"
+
+	// InteractionChecksum is the checksum when the AI last finished a
+	// response, empty if the file did not exist or was not tracked then
+	InteractionChecksum string `json:"interaction_checksum,omitempty"`
+}
+
+// FileChange is a tracked file that changed since the last AI interaction
+type FileChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"` // "created", "modified", "deleted"
 }
 
 // GitContext tracks git repository state
@@ -71,6 +93,11 @@ type ContextManager struct {
 	mu        sync.RWMutex
 }
 
+// ContextDir returns where conversation contexts for workDir are kept
+func ContextDir(workDir string) string {
+	return filepath.Join(workDir, ".devtail", "contexts")
+}
+
 // NewContextManager creates a new context manager
 func NewContextManager(dataDir string) *ContextManager {
 	return &ContextManager{
@@ -123,8 +150,8 @@ func (cm *ContextManager) GetOrCreateContext(sessionID, workDir string) *Convers
 	return ctx
 }
 
-// AddMessage adds a message to the conversation context
-func (ctx *ConversationContext) AddMessage(msg *protocol.ChatMessage) {
+// AddMessage adds a message to the conversation context and returns its ID
+func (ctx *ConversationContext) AddMessage(msg *protocol.ChatMessage) string {
 	ctx.mu.Lock()
 	defer ctx.mu.Unlock()
 
@@ -132,6 +159,7 @@ func (ctx *ConversationContext) AddMessage(msg *protocol.ChatMessage) {
 		ID:        generateMessageID(),
 		Timestamp: time.Now(),
 		Role:      msg.Role,
+		Author:    msg.Author,
 		Content:   msg.Content,
 		Metadata:  make(map[string]interface{}),
 	}
@@ -144,10 +172,13 @@ func (ctx *ConversationContext) AddMessage(msg *protocol.ChatMessage) {
 		Str("role", msg.Role).
 		Int("messageCount", len(ctx.Messages)).
 		Msg("added message to context")
+
+	return contextMsg.ID
 }
 
-// AddResponse adds an AI response to the conversation context
-func (ctx *ConversationContext) AddResponse(content string, files []string, actions []string) {
+// AddResponse adds an AI response to the conversation context and returns
+// its ID
+func (ctx *ConversationContext) AddResponse(content string, files []string, actions []string) string {
 	ctx.mu.Lock()
 	defer ctx.mu.Unlock()
 
@@ -163,6 +194,8 @@ func (ctx *ConversationContext) AddResponse(content string, files []string, acti
 
 	ctx.Messages = append(ctx.Messages, contextMsg)
 	ctx.LastActivity = time.Now()
+
+	return contextMsg.ID
 }
 
 // UpdateFileContext updates the context for a specific file
@@ -191,6 +224,7 @@ func (ctx *ConversationContext) UpdateFileContext(filePath string, role string)
 		Size:         stat.Size(),
 		Role:         role,
 	}
+	fileCtx.InteractionChecksum = ctx.Files[filePath].InteractionChecksum
 
 	// Calculate checksum for change detection
 	if checksum, err := calculateFileChecksum(fullPath); err == nil {
@@ -209,6 +243,70 @@ func (ctx *ConversationContext) UpdateFileContext(filePath string, role string)
 	return nil
 }
 
+// MarkInteraction records the current content of every tracked file as the
+// baseline for ChangedFiles. Call it once the AI finishes a response.
+func (ctx *ConversationContext) MarkInteraction() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for path, fileCtx := range ctx.Files {
+		fileCtx.InteractionChecksum = ""
+		if checksum, err := calculateFileChecksum(filepath.Join(ctx.WorkDir, path)); err == nil {
+			fileCtx.Checksum = checksum
+			fileCtx.InteractionChecksum = checksum
+		}
+		ctx.Files[path] = fileCtx
+	}
+	ctx.LastInteraction = time.Now()
+}
+
+// ChangedFiles returns the tracked files whose content changed since the
+// last AI interaction, sorted by path. Files are compared by content, so an
+// edit that keeps the size and timestamp is still found. Before the first
+// interaction there is nothing to compare against and nothing is returned.
+func (ctx *ConversationContext) ChangedFiles() []FileChange {
+	ctx.mu.RLock()
+	since := ctx.LastInteraction
+	files := make([]FileContext, 0, len(ctx.Files))
+	for _, fileCtx := range ctx.Files {
+		files = append(files, fileCtx)
+	}
+	ctx.mu.RUnlock()
+
+	if since.IsZero() {
+		return nil
+	}
+
+	// Hash outside the lock; reading large files can take a while
+	var changes []FileChange
+	for _, fileCtx := range files {
+		fullPath := filepath.Join(ctx.WorkDir, fileCtx.Path)
+		checksum, err := calculateFileChecksum(fullPath)
+		exists := err == nil
+
+		var change string
+		switch {
+		case fileCtx.InteractionChecksum == "" && exists:
+			// Not there, or not tracked, at the last interaction
+			if fileCtx.Role == "created" {
+				change = "created"
+			} else if stat, err := os.Stat(fullPath); err == nil && stat.ModTime().After(since) {
+				change = "modified"
+			}
+		case fileCtx.InteractionChecksum != "" && !exists:
+			change = "deleted"
+		case fileCtx.InteractionChecksum != "" && checksum != fileCtx.InteractionChecksum:
+			change = "modified"
+		}
+		if change != "" {
+			changes = append(changes, FileChange{Path: fileCtx.Path, Change: change})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
 // UpdateTokenUsage updates token usage statistics
 func (ctx *ConversationContext) UpdateTokenUsage(prompt, completion, total int) {
 	ctx.mu.Lock()
@@ -240,6 +338,13 @@ func (ctx *ConversationContext) GetRecentMessages(limit int) []ContextMessage {
 	return ctx.Messages[len(ctx.Messages)-limit:]
 }
 
+// GetMessages returns a copy of the conversation's messages
+func (ctx *ConversationContext) GetMessages() []ContextMessage {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+	return append([]ContextMessage(nil), ctx.Messages...)
+}
+
 // GetActiveFiles returns files that are currently active in the conversation
 func (ctx *ConversationContext) GetActiveFiles() []string {
 	ctx.mu.RLock()
@@ -271,6 +376,9 @@ func (ctx *ConversationContext) Save(dataDir string) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal context: %w", err)
 	}
+	// Saved contexts are synced off the VM and backed up; secrets pasted
+	// into the chat stay in memory only
+	data = redact.Bytes(data)
 
 	if err := os.WriteFile(contextPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write context file: %w", err)
@@ -289,6 +397,30 @@ func (cm *ContextManager) SaveContext(ctx *ConversationContext) error {
 	return ctx.Save(cm.dataDir)
 }
 
+// LatestSessionID returns the session of the most recently saved context, or
+// "" if there is none. Contexts restored from the control plane count, so a
+// recreated VM resumes the conversation its predecessor was having.
+func (cm *ContextManager) LatestSessionID() string {
+	files, err := filepath.Glob(filepath.Join(cm.dataDir, "*.json"))
+	if err != nil {
+		return ""
+	}
+
+	var latest string
+	var latestTime time.Time
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil || stat.IsDir() {
+			continue
+		}
+		if latest == "" || stat.ModTime().After(latestTime) {
+			latest = strings.TrimSuffix(filepath.Base(file), ".json")
+			latestTime = stat.ModTime()
+		}
+	}
+	return latest
+}
+
 // loadContextFromDisk loads a context from disk
 func (cm *ContextManager) loadContextFromDisk(sessionID string) *ConversationContext {
 	contextPath := filepath.Join(cm.dataDir, fmt.Sprintf("%s.json", sessionID))
@@ -360,12 +492,8 @@ func generateMessageID() string {
 	return fmt.Sprintf("msg-%d", time.Now().UnixNano())
 }
 
+// calculateFileChecksum hashes the file's content. Hashes are cached while
+// the file's size and modification time stay the same.
 func calculateFileChecksum(filePath string) (string, error) {
-	// Simple checksum based on file size and modification time
-	stat, err := os.Stat(filePath)
-	if err != nil {
-		return "", err
-	}
-	
-	return fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().Unix()), nil
+	return fileChecksums.Sum(filePath)
 }
\ No newline at end of file
@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestLatestSessionIDPicksNewestContext(t *testing.T) {
+	dir := ContextDir(t.TempDir())
+	cm := NewContextManager(dir)
+	if id := cm.LatestSessionID(); id != "" {
+		t.Fatalf("expected no session without contexts, got %q", id)
+	}
+
+	old := NewConversationContext("aider-1", dir)
+	recent := NewConversationContext("aider-2", dir)
+	for _, ctx := range []*ConversationContext{old, recent} {
+		if err := cm.SaveContext(ctx); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	// Restored contexts carry the time they were saved on the old VM
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "aider-2.json"), hourAgo, hourAgo)
+	if id := cm.LatestSessionID(); id != "aider-1" {
+		t.Errorf("expected aider-1, got %q", id)
+	}
+
+	resumed := NewContextManager(dir).GetOrCreateContext(cm.LatestSessionID(), dir)
+	if resumed.SessionID != "aider-1" || !resumed.StartTime.Equal(old.StartTime) {
+		t.Errorf("expected the saved context to be loaded, got %+v", resumed.SessionID)
+	}
+}
+
+func TestSavedContextIsRedacted(t *testing.T) {
+	dir := ContextDir(t.TempDir())
+	cm := NewContextManager(dir)
+
+	ctx := cm.GetOrCreateContext("aider-1", dir)
+	ctx.AddMessage(&protocol.ChatMessage{Role: "user", Content: "use Authorization: Bearer abcdefgh12345678 for the staging API"})
+	if err := cm.SaveContext(ctx); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "aider-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "abcdefgh12345678") || !strings.Contains(string(data), "Bearer [REDACTED]") {
+		t.Fatalf("expected the token to be redacted on disk, got %s", data)
+	}
+	if !strings.Contains(ctx.Messages[0].Content, "abcdefgh12345678") {
+		t.Error("expected the in-memory conversation to keep the original")
+	}
+}
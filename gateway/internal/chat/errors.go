@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/rs/zerolog/log"
 )
 
@@ -21,6 +22,7 @@ const (
 	ErrorTypeFileSystem   ErrorType = "filesystem"
 	ErrorTypeAuth         ErrorType = "auth"
 	ErrorTypeRateLimit    ErrorType = "rate_limit"
+	ErrorTypeConfig       ErrorType = "config"
 	ErrorTypeUnknown      ErrorType = "unknown"
 )
 
@@ -78,6 +80,23 @@ func NewErrorRecovery(sessionID string) *ErrorRecovery {
 	}
 }
 
+// ClientError describes the error for clients in a chat_error message
+func (e *ChatError) ClientError() protocol.ChatError {
+	out := protocol.ChatError{
+		Error:     e.Message,
+		Code:      e.Code,
+		Retryable: e.Retryable,
+		ErrorType: string(e.Type),
+	}
+	if e.Cause != nil {
+		out.Cause = e.Cause.Error()
+	}
+	if e.RetryAfter != nil {
+		out.RetryAfterMs = e.RetryAfter.Milliseconds()
+	}
+	return out
+}
+
 // NewChatError creates a new structured chat error
 func NewChatError(errorType ErrorType, message string, sessionID string) *ChatError {
 	return &ChatError{
@@ -171,6 +190,37 @@ func (er *ErrorRecovery) SetRecoveryStrategies(
 	er.cleanup = cleanup
 }
 
+// RecoveryObserver is told when HandleError starts and finishes a recovery
+type RecoveryObserver func(protocol.BackendRecovery)
+
+type recoveryObserverKey struct{}
+
+// WithRecoveryObserver returns a context whose recoveries are reported to fn,
+// so the caller can tell its client the backend is restarting
+func WithRecoveryObserver(ctx context.Context, fn RecoveryObserver) context.Context {
+	return context.WithValue(ctx, recoveryObserverKey{}, fn)
+}
+
+func notifyRecovery(ctx context.Context, event protocol.BackendRecovery) {
+	if fn, ok := ctx.Value(recoveryObserverKey{}).(RecoveryObserver); ok && fn != nil {
+		fn(event)
+	}
+}
+
+// recoveryAction names what attemptRecovery does for an error type
+func recoveryAction(errorType ErrorType) string {
+	switch errorType {
+	case ErrorTypeProcess, ErrorTypeTimeout:
+		return "restart_process"
+	case ErrorTypeConnection:
+		return "reset_connection"
+	case ErrorTypeFileSystem:
+		return "cleanup"
+	default:
+		return "wait"
+	}
+}
+
 // HandleError attempts to recover from an error
 func (er *ErrorRecovery) HandleError(ctx context.Context, err error) error {
 	chatErr := ClassifyError(err, er.sessionID)
@@ -187,11 +237,26 @@ func (er *ErrorRecovery) HandleError(ctx context.Context, err error) error {
 		return chatErr
 	}
 
+	delay := er.calculateRetryDelay(chatErr)
+	event := protocol.BackendRecovery{
+		Phase:        protocol.RecoveryStarted,
+		ErrorType:    string(chatErr.Type),
+		Action:       recoveryAction(chatErr.Type),
+		Attempt:      er.attempt(chatErr),
+		Error:        chatErr.Message,
+		RetryAfterMs: delay.Milliseconds(),
+	}
+	notifyRecovery(ctx, event)
+	event.RetryAfterMs = 0
+
 	// Wait before retry if needed
-	if delay := er.calculateRetryDelay(chatErr); delay > 0 {
+	if delay > 0 {
 		select {
 		case <-time.After(delay):
 		case <-ctx.Done():
+			event.Phase = protocol.RecoveryFailed
+			event.Error = ctx.Err().Error()
+			notifyRecovery(ctx, event)
 			return ctx.Err()
 		}
 	}
@@ -202,12 +267,19 @@ func (er *ErrorRecovery) HandleError(ctx context.Context, err error) error {
 			Err(recoveryErr).
 			Str("sessionID", er.sessionID).
 			Msg("recovery attempt failed")
+		event.Phase = protocol.RecoveryFailed
+		event.Error = recoveryErr.Error()
+		notifyRecovery(ctx, event)
 		return chatErr
 	}
 
 	// Update retry tracking
 	er.updateRetryTracking(chatErr)
 
+	event.Phase = protocol.RecoverySucceeded
+	event.Error = ""
+	notifyRecovery(ctx, event)
+
 	log.Info().
 		Str("sessionID", er.sessionID).
 		Str("errorType", string(chatErr.Type)).
@@ -227,6 +299,14 @@ func (er *ErrorRecovery) shouldRetry(chatErr *ChatError) bool {
 	return count < er.maxRetries
 }
 
+// attempt numbers the next recovery of chatErr's type, starting at 1
+func (er *ErrorRecovery) attempt(chatErr *ChatError) int {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	return er.retryCount[string(chatErr.Type)] + 1
+}
+
 // calculateRetryDelay calculates exponential backoff delay
 func (er *ErrorRecovery) calculateRetryDelay(chatErr *ChatError) time.Duration {
 	er.mu.RLock()
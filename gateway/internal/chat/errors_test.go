@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func recordRecoveries(ctx context.Context) (context.Context, *[]protocol.BackendRecovery) {
+	var events []protocol.BackendRecovery
+	return WithRecoveryObserver(ctx, func(event protocol.BackendRecovery) {
+		events = append(events, event)
+	}), &events
+}
+
+func TestHandleErrorReportsRecovery(t *testing.T) {
+	recovery := NewErrorRecovery("s1")
+	recovery.baseDelay = 0
+	restarts := 0
+	recovery.SetRecoveryStrategies(func() error { restarts++; return nil }, nil, nil)
+
+	ctx, events := recordRecoveries(context.Background())
+	if err := recovery.HandleError(ctx, errors.New("aider process exited")); err != nil {
+		t.Fatalf("expected recovery to succeed, got %v", err)
+	}
+	if restarts != 1 {
+		t.Fatalf("expected one restart, got %d", restarts)
+	}
+
+	if len(*events) != 2 {
+		t.Fatalf("expected started and succeeded, got %+v", *events)
+	}
+	started, succeeded := (*events)[0], (*events)[1]
+	if started.Phase != protocol.RecoveryStarted || started.ErrorType != string(ErrorTypeProcess) || started.Action != "restart_process" || started.Attempt != 1 {
+		t.Errorf("unexpected started event %+v", started)
+	}
+	if succeeded.Phase != protocol.RecoverySucceeded || succeeded.Error != "" {
+		t.Errorf("unexpected succeeded event %+v", succeeded)
+	}
+
+	// The next recovery of the same type is the second attempt
+	*events = nil
+	recovery.HandleError(ctx, errors.New("aider process exited"))
+	if len(*events) == 0 || (*events)[0].Attempt != 2 {
+		t.Errorf("expected a second attempt, got %+v", *events)
+	}
+}
+
+func TestHandleErrorReportsFailedRecovery(t *testing.T) {
+	recovery := NewErrorRecovery("s1")
+	recovery.baseDelay = 0
+	recovery.SetRecoveryStrategies(nil, func() error { return errors.New("pty gone") }, nil)
+
+	ctx, events := recordRecoveries(context.Background())
+	if err := recovery.HandleError(ctx, errors.New("connection refused")); err == nil {
+		t.Fatal("expected the error back when recovery fails")
+	}
+	if len(*events) != 2 {
+		t.Fatalf("expected started and failed, got %+v", *events)
+	}
+	if failed := (*events)[1]; failed.Phase != protocol.RecoveryFailed || failed.Action != "reset_connection" || failed.Error != "pty gone" {
+		t.Errorf("unexpected failed event %+v", failed)
+	}
+}
+
+func TestHandleErrorSkipsUnrecoverableErrors(t *testing.T) {
+	recovery := NewErrorRecovery("s1")
+
+	ctx, events := recordRecoveries(context.Background())
+	if err := recovery.HandleError(ctx, errors.New("unauthorized")); err == nil {
+		t.Fatal("expected auth errors not to be recovered")
+	}
+	if len(*events) != 0 {
+		t.Fatalf("expected no recovery events, got %+v", *events)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/exec"
+	"path/filepath"
 
 	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/rs/zerolog/log"
@@ -18,17 +19,42 @@ type Handler interface {
 
 // NewHandler creates the appropriate chat handler based on configuration
 func NewHandler(workDir string, useMock bool) Handler {
-	// Check if we should use mock
+	return NewHandlerFromConfig(workDir, ConfigFromEnv(useMock))
+}
+
+// ConfigFromEnv reads the chat backend configuration from the environment
+func ConfigFromEnv(useMock bool) protocol.ChatConfig {
+	config := protocol.ChatConfig{
+		Backend: protocol.BackendAider,
+		Model:   os.Getenv("AIDER_MODEL"),
+		APIKeys: make(map[string]string),
+
+		PlannerModel: os.Getenv("AIDER_PLANNER_MODEL"),
+	}
 	if useMock || os.Getenv("USE_MOCK_AIDER") == "true" {
+		config.Backend = protocol.BackendMock
+	}
+	for _, key := range apiKeyEnvVars {
+		if val := os.Getenv(key); val != "" {
+			config.APIKeys[key] = val
+		}
+	}
+	return config
+}
+
+// NewHandlerFromConfig creates the chat handler config selects
+func NewHandlerFromConfig(workDir string, config protocol.ChatConfig) Handler {
+	// Check if we should use mock
+	if config.Backend == protocol.BackendMock {
 		log.Info().Msg("using mock aider implementation")
 		return NewAiderHandler(workDir) // Existing mock implementation
 	}
 
-	// Try real Aider first, with fallback to enhanced mock
-	if hasRealAider() && hasAPIKey() {
+	// Use real Aider when it can run
+	if hasRealAider() && len(config.APIKeys) > 0 {
 		// Use real Aider with default configuration
-		config := AiderConfig{
-			Model:          getModel(),
+		aiderConfig := AiderConfig{
+			Model:          getModel(config),
 			AutoCommit:     false,
 			StreamResponse: true,
 			NoGit:          false,
@@ -36,38 +62,53 @@ func NewHandler(workDir string, useMock bool) Handler {
 			WholeFiles:     false,
 			EditFormat:     "diff",
 			MapTokens:      1024,
+			APIKeys:        config.APIKeys,
 		}
 
 		log.Info().
-			Str("model", config.Model).
+			Str("model", aiderConfig.Model).
+			Str("plannerModel", config.PlannerModel).
 			Msg("using real aider implementation")
 		
-		return NewRealAiderHandler(workDir, config)
+		editor := NewRealAiderHandler(workDir, aiderConfig)
+		if config.PlannerModel == "" {
+			return editor
+		}
+
+		// The planner only answers questions, in a conversation of its own
+		plannerConfig := aiderConfig
+		plannerConfig.Model = config.PlannerModel
+		plannerConfig.ContextDir = filepath.Join(ContextDir(workDir), "planner")
+		return NewPipeline(NewRealAiderHandler(workDir, plannerConfig), editor, config.Parallelism)
 	}
 
-	// Fallback to enhanced mock with real aider integration
-	log.Info().Msg("real aider not available, using enhanced mock implementation")
-	return NewAiderHandler(workDir)
+	// Without aider or a key there is nothing to answer with; say so rather
+	// than let a mock pretend to be the assistant
+	problems := unconfiguredProblems(config)
+	log.Warn().
+		Strs("problems", problems).
+		Msg("ai backend is not configured, chat will return setup instructions")
+	return NewUnconfiguredHandler(problems...)
 }
 
-// getModel returns the AI model to use based on environment variables
-func getModel() string {
+// getModel returns the AI model to use based on the configured API keys
+func getModel(config protocol.ChatConfig) string {
 	// Check for explicit model override
-	if model := os.Getenv("AIDER_MODEL"); model != "" {
-		return model
+	if config.Model != "" {
+		return config.Model
 	}
 
 	// Default based on available API keys
-	if os.Getenv("OPENROUTER_API_KEY") != "" {
+	if config.APIKeys["OPENROUTER_API_KEY"] != "" {
 		if model := os.Getenv("OPENROUTER_MODEL"); model != "" {
 			return model
 		}
 		return "anthropic/claude-3-haiku" // Default OpenRouter model
 	}
-	if os.Getenv("ANTHROPIC_API_KEY") != "" {
+	if config.APIKeys["ANTHROPIC_API_KEY"] != "" {
 		return "claude-3-sonnet-20240229"
 	}
-	if os.Getenv("OPENAI_API_KEY") != "" {
+	if config.APIKeys["OPENAI_API_KEY"] != "" {
 		return "gpt-4-turbo-preview"
 	}
 
@@ -81,10 +122,5 @@ func hasRealAider() bool {
 	return err == nil
 }
 
-// hasAPIKey checks if any AI API key is available
-func hasAPIKey() bool {
-	return os.Getenv("ANTHROPIC_API_KEY") != "" || 
-		   os.Getenv("OPENAI_API_KEY") != "" ||
-		   os.Getenv("GOOGLE_API_KEY") != "" ||
-		   os.Getenv("OPENROUTER_API_KEY") != ""
-}
\ No newline at end of file
+// apiKeyEnvVars lists the API keys aider can use, the one to suggest first
+var apiKeyEnvVars = []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY", "OPENROUTER_API_KEY", "GOOGLE_API_KEY"}
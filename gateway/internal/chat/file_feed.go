@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// fileFeedBuffer is how many events a subscriber may fall behind by before
+// further events are dropped for it
+const fileFeedBuffer = 64
+
+// FileFeed watches every workspace and hands each file change to all
+// subscribers, so clients can refresh what they show when the AI or a build
+// modifies files. Notifications are advisory: a subscriber that falls behind
+// misses events rather than holding up the others.
+type FileFeed struct {
+	watchers []*FileWatcher
+
+	mu        sync.Mutex
+	subs      map[uint64]chan protocol.WorkspaceFileChanged
+	nextSubID uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+// NewFileFeed starts watching workspaces. Workspaces that cannot be watched
+// are logged and skipped.
+func NewFileFeed(workspaces []protocol.Workspace, opts ...FileWatcherOption) *FileFeed {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &FileFeed{
+		subs:   make(map[uint64]chan protocol.WorkspaceFileChanged),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for _, ws := range workspaces {
+		watcher, err := NewFileWatcher(ws.Root, nil, opts...)
+		if err != nil {
+			log.Error().Err(err).Str("workspace", ws.Name).Msg("failed to watch workspace for file changes")
+			continue
+		}
+		f.watchers = append(f.watchers, watcher)
+
+		f.done.Add(1)
+		go f.forward(ws.Name, watcher)
+	}
+	return f
+}
+
+// Subscribe returns a channel of file changes and a function that ends the
+// subscription
+func (f *FileFeed) Subscribe() (<-chan protocol.WorkspaceFileChanged, func()) {
+	ch := make(chan protocol.WorkspaceFileChanged, fileFeedBuffer)
+
+	f.mu.Lock()
+	f.nextSubID++
+	id := f.nextSubID
+	f.subs[id] = ch
+	f.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			delete(f.subs, id)
+			f.mu.Unlock()
+		})
+	}
+}
+
+func (f *FileFeed) forward(name string, watcher *FileWatcher) {
+	defer f.done.Done()
+
+	for {
+		select {
+		case event := <-watcher.Events():
+			f.publish(protocol.WorkspaceFileChanged{
+				Workspace: name,
+				Path:      filepath.ToSlash(event.Path),
+				Operation: event.Operation,
+				Size:      event.Size,
+			})
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *FileFeed) publish(change protocol.WorkspaceFileChanged) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, ch := range f.subs {
+		select {
+		case ch <- change:
+		default:
+			log.Warn().Str("path", change.Path).Msg("file change subscriber is behind, dropping event")
+		}
+	}
+}
+
+// Close stops watching. Subscription channels are not closed; subscribers
+// stop on their own context.
+func (f *FileFeed) Close() error {
+	f.cancel()
+	f.done.Wait()
+
+	var err error
+	for _, watcher := range f.watchers {
+		if closeErr := watcher.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestFileFeedFansOutChanges(t *testing.T) {
+	web, api := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(api, "handlers"), 0755)
+
+	feed := NewFileFeed([]protocol.Workspace{{Name: "web", Root: web}, {Name: "api", Root: api}})
+	defer feed.Close()
+
+	first, unsubscribeFirst := feed.Subscribe()
+	second, unsubscribeSecond := feed.Subscribe()
+	defer unsubscribeSecond()
+
+	os.WriteFile(filepath.Join(api, "handlers", "users.go"), []byte("package handlers"), 0644)
+
+	for _, ch := range []<-chan protocol.WorkspaceFileChanged{first, second} {
+		select {
+		case got := <-ch:
+			// The create and the write are debounced into one event
+			if got.Workspace != "api" || got.Path != "handlers/users.go" {
+				t.Fatalf("unexpected change %+v", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no file change delivered")
+		}
+	}
+
+	unsubscribeFirst()
+	os.WriteFile(filepath.Join(web, "index.html"), nil, 0644)
+	select {
+	case got := <-second:
+		if got.Workspace != "web" || got.Path != "index.html" {
+			t.Fatalf("unexpected change %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no file change delivered")
+	}
+	select {
+	case got := <-first:
+		t.Fatalf("unsubscribed channel got %+v", got)
+	default:
+	}
+}
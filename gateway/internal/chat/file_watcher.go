@@ -2,30 +2,46 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/devtail/gateway/internal/ignore"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 )
 
-// FileWatcher monitors file system changes in the work directory
+// defaultMaxWatchedDirs caps the directories one watcher registers. Each
+// costs an inotify watch, and the per-user limit is often 8192.
+const defaultMaxWatchedDirs = 4096
+
+// errWatchLimit is returned by addWatch once the cap is reached
+var errWatchLimit = errors.New("watched directory limit reached")
+
+// FileWatcher monitors file system changes in the work directory and every
+// directory below it that is not ignored
 type FileWatcher struct {
 	workDir     string
 	watcher     *fsnotify.Watcher
 	context     *ConversationContext
 	mu          sync.RWMutex
 	watchedDirs map[string]bool
+	maxWatches  int
+	refused     int
+	ignore      *ignore.Matcher
 	debouncer   *EventDebouncer
 	
-	// Channels for communication
+	// Channels for communication. eventChan is never closed because debounced
+	// timers may still fire after Close; consumers select on their own context.
 	eventChan   chan FileEvent
 	ctx         context.Context
 	cancel      context.CancelFunc
+	closeOnce   sync.Once
 }
 
 // FileEvent represents a file system event
@@ -37,6 +53,25 @@ type FileEvent struct {
 	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
+// WatchStats reports how much of the tree a FileWatcher covers
+type WatchStats struct {
+	Watched int `json:"watched"`
+	Limit   int `json:"limit"`
+
+	// Refused counts directories left unwatched because of Limit
+	Refused int `json:"refused"`
+}
+
+// FileWatcherOption configures a FileWatcher
+type FileWatcherOption func(*FileWatcher)
+
+// WithMaxWatchedDirs caps how many directories are watched
+func WithMaxWatchedDirs(max int) FileWatcherOption {
+	return func(fw *FileWatcher) {
+		fw.maxWatches = max
+	}
+}
+
 // EventDebouncer prevents rapid-fire events for the same file
 type EventDebouncer struct {
 	events map[string]*time.Timer
@@ -44,8 +79,9 @@ type EventDebouncer struct {
 	mu     sync.Mutex
 }
 
-// NewFileWatcher creates a new file watcher
-func NewFileWatcher(workDir string, context *ConversationContext) (*FileWatcher, error) {
+// NewFileWatcher creates a new file watcher. Events update convCtx, if not
+// nil, and are delivered on Events.
+func NewFileWatcher(workDir string, convCtx *ConversationContext, opts ...FileWatcherOption) (*FileWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
@@ -56,13 +92,18 @@ func NewFileWatcher(workDir string, context *ConversationContext) (*FileWatcher,
 	fw := &FileWatcher{
 		workDir:     workDir,
 		watcher:     watcher,
-		context:     context,
+		context:     convCtx,
 		watchedDirs: make(map[string]bool),
+		maxWatches:  defaultMaxWatchedDirs,
+		ignore:      ignore.New(workDir),
 		debouncer:   NewEventDebouncer(500 * time.Millisecond),
 		eventChan:   make(chan FileEvent, 100),
 		ctx:         ctx,
 		cancel:      cancel,
 	}
+	for _, opt := range opts {
+		opt(fw)
+	}
 
 	// Start watching
 	go fw.watchLoop()
@@ -73,8 +114,11 @@ func NewFileWatcher(workDir string, context *ConversationContext) (*FileWatcher,
 		return nil, fmt.Errorf("failed to add initial watches: %w", err)
 	}
 
+	stats := fw.Stats()
 	log.Info().
 		Str("workDir", workDir).
+		Int("watchedDirs", stats.Watched).
+		Int("refusedDirs", stats.Refused).
 		Msg("file watcher initialized")
 
 	return fw, nil
@@ -88,28 +132,15 @@ func NewEventDebouncer(delay time.Duration) *EventDebouncer {
 	}
 }
 
-// addInitialWatches adds the work directory and important subdirectories to the watch list
+// addInitialWatches watches the work directory tree and the directories of
+// files already in the conversation context
 func (fw *FileWatcher) addInitialWatches() error {
-	// Always watch the root work directory
-	if err := fw.addWatch(fw.workDir); err != nil {
+	if err := fw.addTree(fw.workDir); err != nil {
 		return err
 	}
 
-	// Watch common development directories
-	commonDirs := []string{
-		"src", "lib", "app", "components", "utils", "services",
-		"internal", "pkg", "cmd", "api", "handlers", "models",
-		"tests", "test", "__tests__", "spec",
-		"docs", "scripts", "config",
-	}
-
-	for _, dir := range commonDirs {
-		dirPath := filepath.Join(fw.workDir, dir)
-		if info, err := os.Stat(dirPath); err == nil && info.IsDir() {
-			if err := fw.addWatch(dirPath); err != nil {
-				log.Error().Err(err).Str("dir", dirPath).Msg("failed to watch directory")
-			}
-		}
+	if fw.context == nil {
+		return nil
 	}
 
 	// Watch files already in the conversation context
@@ -123,6 +154,41 @@ func (fw *FileWatcher) addInitialWatches() error {
 	return nil
 }
 
+// addTree watches root and every directory below it that is not ignored.
+// Only a failure to watch root itself is an error; subdirectories that
+// vanish or cannot be read mid-walk are skipped.
+func (fw *FileWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && fw.shouldIgnoreFile(path, true) {
+			return filepath.SkipDir
+		}
+		// Rules below this directory may come from its own ignore files
+		if err := fw.ignore.LoadDir(path); err != nil {
+			log.Debug().Err(err).Str("dir", path).Msg("failed to read ignore files")
+		}
+
+		if err := fw.addWatch(path); err != nil {
+			if path == root {
+				return err
+			}
+			if !errors.Is(err, errWatchLimit) {
+				log.Debug().Err(err).Str("dir", path).Msg("failed to watch directory")
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
 // addWatch adds a directory to the watch list
 func (fw *FileWatcher) addWatch(path string) error {
 	fw.mu.Lock()
@@ -133,6 +199,17 @@ func (fw *FileWatcher) addWatch(path string) error {
 		return nil
 	}
 
+	if fw.maxWatches > 0 && len(fw.watchedDirs) >= fw.maxWatches {
+		if fw.refused == 0 {
+			log.Warn().
+				Str("workDir", fw.workDir).
+				Int("limit", fw.maxWatches).
+				Msg("file watcher limit reached, changes in further directories will be missed")
+		}
+		fw.refused++
+		return errWatchLimit
+	}
+
 	// Add to fsnotify watcher
 	if err := fw.watcher.Add(path); err != nil {
 		return fmt.Errorf("failed to add watch for %s: %w", path, err)
@@ -147,6 +224,35 @@ func (fw *FileWatcher) addWatch(path string) error {
 	return nil
 }
 
+// removeWatches forgets path and every watched directory below it, after it
+// was removed or renamed
+func (fw *FileWatcher) removeWatches(path string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for dir := range fw.watchedDirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			// fsnotify drops watches on deleted directories itself, so
+			// errors here are expected
+			fw.watcher.Remove(dir)
+			delete(fw.watchedDirs, dir)
+		}
+	}
+}
+
+// Stats reports how many directories are watched
+func (fw *FileWatcher) Stats() WatchStats {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+
+	return WatchStats{
+		Watched: len(fw.watchedDirs),
+		Limit:   fw.maxWatches,
+		Refused: fw.refused,
+	}
+}
+
 // WatchFile adds a specific file's directory to the watch list
 func (fw *FileWatcher) WatchFile(filePath string) error {
 	absPath := filepath.Join(fw.workDir, filePath)
@@ -178,11 +284,25 @@ func (fw *FileWatcher) watchLoop() {
 
 // handleFsEvent processes a file system event
 func (fw *FileWatcher) handleFsEvent(event fsnotify.Event) {
-	// Filter out irrelevant files
-	if fw.shouldIgnoreFile(event.Name) {
+	info, statErr := os.Stat(event.Name)
+	isDir := statErr == nil && info.IsDir()
+
+	// Filter out irrelevant files. A removed path might have been either.
+	ignored := fw.shouldIgnoreFile(event.Name, isDir)
+	if statErr != nil {
+		ignored = ignored || fw.shouldIgnoreFile(event.Name, true)
+	}
+	if ignored {
 		return
 	}
 
+	// Edited ignore files change what is watched from now on
+	if name := filepath.Base(event.Name); name == ".gitignore" || name == ".devtailignore" {
+		if err := fw.ignore.LoadDir(filepath.Dir(event.Name)); err != nil {
+			log.Debug().Err(err).Str("path", event.Name).Msg("failed to reload ignore file")
+		}
+	}
+
 	// Convert to relative path
 	relPath, err := filepath.Rel(fw.workDir, event.Name)
 	if err != nil {
@@ -198,12 +318,23 @@ func (fw *FileWatcher) handleFsEvent(event fsnotify.Event) {
 		Metadata:  make(map[string]string),
 	}
 
-	// Add file size for write operations
-	if event.Op&fsnotify.Write == fsnotify.Write {
-		if stat, err := os.Stat(event.Name); err == nil {
-			fileEvent.Size = stat.Size()
+	// Watch new directories right away, before files appear in them;
+	// directories moved in arrive as creates too
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if isDir {
+			if err := fw.addTree(event.Name); err != nil {
+				log.Debug().Err(err).Str("dir", event.Name).Msg("failed to watch new directory")
+			}
 		}
 	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		fw.removeWatches(event.Name)
+	}
+
+	// Add file size for write operations
+	if event.Op&fsnotify.Write == fsnotify.Write && statErr == nil {
+		fileEvent.Size = info.Size()
+	}
 
 	// Debounce the event
 	fw.debouncer.Debounce(relPath, func() {
@@ -211,47 +342,10 @@ func (fw *FileWatcher) handleFsEvent(event fsnotify.Event) {
 	})
 }
 
-// shouldIgnoreFile determines if a file should be ignored
-func (fw *FileWatcher) shouldIgnoreFile(path string) bool {
-	name := filepath.Base(path)
-	
-	// Ignore hidden files and directories
-	if strings.HasPrefix(name, ".") && name != ".env" && name != ".gitignore" {
-		return true
-	}
-
-	// Ignore common build/cache directories
-	ignoreDirs := []string{
-		"node_modules", ".git", ".svn", ".hg",
-		"build", "dist", "target", "bin", "obj",
-		".next", ".nuxt", ".cache", "coverage",
-		"__pycache__", ".pytest_cache", ".mypy_cache",
-		"vendor", ".vendor", "Godeps",
-	}
-
-	for _, ignoreDir := range ignoreDirs {
-		if strings.Contains(path, string(filepath.Separator)+ignoreDir+string(filepath.Separator)) ||
-			strings.HasSuffix(path, string(filepath.Separator)+ignoreDir) {
-			return true
-		}
-	}
-
-	// Ignore temporary and backup files
-	if strings.HasSuffix(name, "~") ||
-		strings.HasSuffix(name, ".tmp") ||
-		strings.HasSuffix(name, ".temp") ||
-		strings.HasSuffix(name, ".swp") ||
-		strings.HasSuffix(name, ".swo") ||
-		strings.HasPrefix(name, "#") {
-		return true
-	}
-
-	// Ignore log files
-	if strings.HasSuffix(name, ".log") {
-		return true
-	}
-
-	return false
+// shouldIgnoreFile determines if a file should be ignored, by the default
+// rules and the .gitignore and .devtailignore files in the tree
+func (fw *FileWatcher) shouldIgnoreFile(path string, isDir bool) bool {
+	return fw.ignore.Match(path, isDir)
 }
 
 // fsEventToOperation converts fsnotify events to our operation strings
@@ -285,10 +379,6 @@ func (fw *FileWatcher) processFileEvent(event FileEvent) {
 	switch event.Operation {
 	case "create":
 		role = "created"
-		// Auto-watch the directory of new files
-		if dir := filepath.Dir(filepath.Join(fw.workDir, event.Path)); dir != "." {
-			fw.addWatch(dir)
-		}
 	case "write":
 		role = "active"
 	case "remove":
@@ -297,14 +387,19 @@ func (fw *FileWatcher) processFileEvent(event FileEvent) {
 		role = "modified"
 	}
 
-	if err := fw.context.UpdateFileContext(event.Path, role); err != nil {
-		log.Error().Err(err).
-			Str("path", event.Path).
-			Str("operation", event.Operation).
-			Msg("failed to update file context")
+	if fw.context != nil {
+		if err := fw.context.UpdateFileContext(event.Path, role); err != nil {
+			log.Error().Err(err).
+				Str("path", event.Path).
+				Str("operation", event.Operation).
+				Msg("failed to update file context")
+		}
 	}
 
 	// Send event to channel for external processing
+	if fw.ctx.Err() != nil {
+		return
+	}
 	select {
 	case fw.eventChan <- event:
 	default:
@@ -331,6 +426,17 @@ func (ed *EventDebouncer) Debounce(key string, fn func()) {
 	})
 }
 
+// Stop cancels all pending debounced calls
+func (ed *EventDebouncer) Stop() {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+
+	for key, timer := range ed.events {
+		timer.Stop()
+		delete(ed.events, key)
+	}
+}
+
 // Events returns the file event channel
 func (fw *FileWatcher) Events() <-chan FileEvent {
 	return fw.eventChan
@@ -348,18 +454,24 @@ func (fw *FileWatcher) GetWatchedDirectories() []string {
 	return dirs
 }
 
-// Close stops the file watcher and cleans up resources
+// Close stops the file watcher and cleans up resources. It is safe to call
+// more than once.
 func (fw *FileWatcher) Close() error {
-	fw.cancel()
-	
-	if fw.watcher != nil {
-		if err := fw.watcher.Close(); err != nil {
-			return fmt.Errorf("failed to close fsnotify watcher: %w", err)
+	var err error
+
+	fw.closeOnce.Do(func() {
+		fw.cancel()
+		fw.debouncer.Stop()
+
+		if fw.watcher != nil {
+			if closeErr := fw.watcher.Close(); closeErr != nil {
+				err = fmt.Errorf("failed to close fsnotify watcher: %w", closeErr)
+				return
+			}
 		}
-	}
 
-	close(fw.eventChan)
+		log.Info().Msg("file watcher closed")
+	})
 
-	log.Info().Msg("file watcher closed")
-	return nil
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,124 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWatcher(t *testing.T, dir string, opts ...FileWatcherOption) *FileWatcher {
+	t.Helper()
+
+	watcher, err := NewFileWatcher(dir, NewConversationContext("test", dir), opts...)
+	if err != nil {
+		t.Fatalf("new file watcher: %v", err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+	return watcher
+}
+
+func TestFileWatcherWatchesWholeTree(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"web/src/pages", "node_modules/react", ".git/objects", "dist"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+
+	watcher := newTestWatcher(t, dir)
+
+	watched := map[string]bool{}
+	for _, path := range watcher.GetWatchedDirectories() {
+		rel, _ := filepath.Rel(dir, path)
+		watched[rel] = true
+	}
+	for _, want := range []string{".", "web", "web/src", "web/src/pages"} {
+		if !watched[filepath.FromSlash(want)] {
+			t.Errorf("%s is not watched", want)
+		}
+	}
+	for _, ignored := range []string{"node_modules", "node_modules/react", ".git", "dist"} {
+		if watched[filepath.FromSlash(ignored)] {
+			t.Errorf("ignored directory %s is watched", ignored)
+		}
+	}
+}
+
+func TestFileWatcherFollowsNewDirectories(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newTestWatcher(t, dir)
+
+	nested := filepath.Join(dir, "services", "billing", "internal")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Give the watcher a moment to pick up the new tree
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(nested, "invoice.go"), []byte("package internal"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join("services", "billing", "internal", "invoice.go")
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-watcher.Events():
+			if event.Path == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event for %s; watching %v", want, watcher.GetWatchedDirectories())
+		}
+	}
+}
+
+func TestFileWatcherLimit(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b", "c"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+
+	watcher := newTestWatcher(t, dir, WithMaxWatchedDirs(2))
+
+	stats := watcher.Stats()
+	if stats.Watched != 2 || stats.Limit != 2 || stats.Refused != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFileWatcherHonorsIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"generated", "dist", "src"} {
+		os.MkdirAll(filepath.Join(dir, sub), 0755)
+	}
+	os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("generated/\n*.pb.go\n"), 0644)
+	os.WriteFile(filepath.Join(dir, ".devtailignore"), []byte("!dist/\n"), 0644)
+
+	watcher := newTestWatcher(t, dir)
+
+	watched := map[string]bool{}
+	for _, path := range watcher.GetWatchedDirectories() {
+		rel, _ := filepath.Rel(dir, path)
+		watched[rel] = true
+	}
+	if watched["generated"] || !watched["dist"] || !watched["src"] {
+		t.Fatalf("unexpected watched directories %v", watched)
+	}
+
+	os.WriteFile(filepath.Join(dir, "src", "api.pb.go"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, "src", "api.go"), nil, 0644)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-watcher.Events():
+			switch event.Path {
+			case filepath.Join("src", "api.pb.go"):
+				t.Fatal("got an event for an ignored file")
+			case filepath.Join("src", "api.go"):
+				return
+			}
+		case <-timeout:
+			t.Fatal("no event for src/api.go")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// installFakeAider puts a stand-in aider on PATH that prints a prompt and
+// then echoes its input until the PTY is closed
+func installFakeAider(t *testing.T) {
+	t.Helper()
+
+	binDir := t.TempDir()
+	script := "#!/bin/sh\necho 'aider>'\nexec cat\n"
+	if err := os.WriteFile(filepath.Join(binDir, "aider"), []byte(script), 0755); err != nil {
+		t.Fatalf("write fake aider: %v", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRealAiderHandlerRestartAndClose(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+	installFakeAider(t)
+
+	handler := NewRealAiderHandler(t.TempDir(), AiderConfig{NoGit: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := handler.Initialize(ctx); err != nil {
+		t.Fatalf("initialize: %v", err)
+	}
+
+	// Every recovery strategy must leave the shared channels usable
+	for i := 0; i < 2; i++ {
+		if err := handler.restartAiderProcess(); err != nil {
+			t.Fatalf("restart %d: %v", i, err)
+		}
+	}
+	if err := handler.resetConnection(); err != nil {
+		t.Fatalf("reset connection: %v", err)
+	}
+	if err := handler.cleanupResources(); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if !handler.initialized.Load() {
+		t.Fatal("handler not initialized after recovery")
+	}
+
+	select {
+	case err := <-handler.errorChan:
+		t.Fatalf("unexpected error after intentional restarts: %v", err)
+	default:
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := handler.Close(); err != nil {
+				t.Errorf("close: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := handler.Initialize(ctx); err == nil {
+		t.Fatal("expected initialize after close to fail")
+	}
+	if err := handler.restartAiderProcess(); err == nil {
+		t.Fatal("expected restart after close to fail")
+	}
+}
+
+func TestRealAiderHandlerCloseWithoutProcess(t *testing.T) {
+	handler := NewRealAiderHandler(t.TempDir(), AiderConfig{})
+
+	if err := handler.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := handler.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestFileWatcherCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewFileWatcher(dir, NewConversationContext("test", dir))
+	if err != nil {
+		t.Fatalf("new file watcher: %v", err)
+	}
+
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
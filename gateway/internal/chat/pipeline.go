@@ -0,0 +1,273 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// planApprovalTimeout is how long a plan waits for the user to approve it
+const planApprovalTimeout = 30 * time.Minute
+
+// planInstructions asks the planner for a plan the pipeline can parse
+const planInstructions = "Do not change any files yet. Draft a numbered plan for the request below, " +
+	"one short step per line, each naming the file it changes in backticks, " +
+	"so another assistant can carry the steps out one at a time. Request: "
+
+// Pipeline is a Handler chaining two backends: the planner drafts the steps
+// of a request, and once the user approves them the editor carries them out
+// one at a time. Each backend gets its own queue, so a plan waiting for
+// approval holds up neither.
+type Pipeline struct {
+	planner Handler
+	editor  Handler
+
+	plannerQueue *RequestQueue
+	editorQueue  *RequestQueue
+
+	approvalTimeout time.Duration
+}
+
+// NewPipeline plans requests with planner and carries them out with editor,
+// each serving up to parallelism requests if it can
+func NewPipeline(planner, editor Handler, parallelism int) *Pipeline {
+	return &Pipeline{
+		planner:         planner,
+		editor:          editor,
+		plannerQueue:    NewRequestQueue(planner, parallelism),
+		editorQueue:     NewRequestQueue(editor, parallelism),
+		approvalTimeout: planApprovalTimeout,
+	}
+}
+
+// QueuesRequests reports that the pipeline queues requests to its backends
+// itself; see QueuedBackend
+func (p *Pipeline) QueuesRequests() bool {
+	return true
+}
+
+func (p *Pipeline) Initialize(ctx context.Context) error {
+	if err := p.editor.Initialize(ctx); err != nil {
+		return err
+	}
+	return p.planner.Initialize(ctx)
+}
+
+func (p *Pipeline) Close() error {
+	err := p.editor.Close()
+	if closeErr := p.planner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// HandleChatMessage has msg planned, the plan approved and then carried
+// out. Branching, regenerating and aider commands go to the editor as they
+// are.
+func (p *Pipeline) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	if msg.Regenerate || msg.BranchFrom != "" || strings.HasPrefix(msg.Content, "/") {
+		return p.editorQueue.HandleChatMessage(ctx, msg)
+	}
+
+	planning := *msg
+	planning.Content = "/ask " + planInstructions + oneLine(msg.Content)
+	planned, err := p.plannerQueue.HandleChatMessage(ctx, &planning)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(chan *protocol.ChatReply, 10)
+	go func() {
+		defer close(replies)
+		send := func(reply *protocol.ChatReply) bool {
+			select {
+			case replies <- reply:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// The draft streams as it is written
+		var draft strings.Builder
+		_, ok := forwardStage(planned, func(reply *protocol.ChatReply) bool {
+			draft.WriteString(reply.Content)
+			return send(reply)
+		})
+		if !ok {
+			return
+		}
+
+		steps := ParsePlan(draft.String())
+		if len(steps) == 0 {
+			// Nothing to carry out; the draft is the answer
+			send(&protocol.ChatReply{Finished: true})
+			return
+		}
+		plan := &protocol.ChatPlan{ID: uuid.New().String(), Steps: steps}
+		if steps, ok = p.approve(ctx, plan, send); !ok {
+			return
+		}
+
+		var last string
+		for i, step := range steps {
+			heading := fmt.Sprintf("\n\n**Step %d of %d:** %s\n\n", i+1, len(steps), step.Description)
+			if !send(&protocol.ChatReply{Content: heading}) {
+				return
+			}
+			stepMsg := *msg
+			stepMsg.Content = stepPrompt(msg.Content, step, i, len(steps))
+			edits, err := p.editorQueue.HandleChatMessage(ctx, &stepMsg)
+			if err != nil {
+				send(&protocol.ChatReply{Finished: true, Error: replyError(err)})
+				return
+			}
+			if last, ok = forwardStage(edits, send); !ok {
+				return
+			}
+		}
+		send(&protocol.ChatReply{Finished: true, MessageID: last})
+	}()
+	return replies, nil
+}
+
+// approve puts plan to the user, if the context has a way to, and returns
+// the steps to carry out. It reports false once the reply is over: the plan
+// was rejected, never answered, or the request was cancelled.
+func (p *Pipeline) approve(ctx context.Context, plan *protocol.ChatPlan, send func(*protocol.ChatReply) bool) ([]protocol.PlanStep, bool) {
+	decisions := planDecisionsFrom(ctx)
+	if decisions == nil {
+		return plan.Steps, true
+	}
+	if !send(&protocol.ChatReply{Plan: plan}) {
+		return nil, false
+	}
+
+	timeout := time.NewTimer(p.approvalTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case decision := <-decisions:
+			if decision.PlanID != plan.ID {
+				continue
+			}
+			if !decision.Approved {
+				send(&protocol.ChatReply{Content: "\n\nPlan rejected, nothing was changed.", Finished: true})
+				return nil, false
+			}
+			if len(decision.Steps) > 0 {
+				return decision.Steps, true
+			}
+			return plan.Steps, true
+		case <-timeout.C:
+			log.Info().Str("planID", plan.ID).Msg("plan was not approved in time")
+			send(&protocol.ChatReply{Content: "\n\nThe plan was not approved in time, nothing was changed.", Finished: true})
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// forwardStage passes a stage's replies to send, without the final reply's
+// Finished flag and message ID since the pipeline goes on. It returns that
+// ID, and reports false if the stage failed, its error having been sent as
+// the pipeline's final reply, or the request was cancelled.
+func forwardStage(replies <-chan *protocol.ChatReply, send func(*protocol.ChatReply) bool) (string, bool) {
+	defer func() {
+		// Drain so the stage is not left blocked
+		for range replies {
+		}
+	}()
+
+	var messageID string
+	for reply := range replies {
+		if reply.Error != nil {
+			send(reply)
+			return "", false
+		}
+		part := *reply
+		if reply.Finished {
+			messageID = reply.MessageID
+			part.Finished, part.MessageID = false, ""
+			if part.Content == "" && len(part.CodeBlocks) == 0 {
+				continue
+			}
+		}
+		if !send(&part) {
+			return "", false
+		}
+	}
+	return messageID, true
+}
+
+// planStep matches a numbered list item such as "1. " or "2) "
+var planStep = regexp.MustCompile(`^\s{0,3}(\d+)[.)]\s+(.+)$`)
+
+// backticked matches `code spans`
+var backticked = regexp.MustCompile("`([^`]+)`")
+
+// ParsePlan reads the steps of a plan from the planner's numbered list.
+// Indented lines under a step continue it; anything else is commentary.
+func ParsePlan(text string) []protocol.PlanStep {
+	var steps []protocol.PlanStep
+	inStep := false
+	for _, line := range strings.Split(text, "\n") {
+		if m := planStep.FindStringSubmatch(line); m != nil {
+			steps = append(steps, protocol.PlanStep{Description: strings.TrimSpace(m[2])})
+			inStep = true
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if inStep && trimmed != "" && line != trimmed && !strings.HasPrefix(trimmed, "```") {
+			step := &steps[len(steps)-1]
+			step.Description += " " + trimmed
+			continue
+		}
+		inStep = false
+	}
+
+	for i := range steps {
+		for _, m := range backticked.FindAllStringSubmatch(steps[i].Description, -1) {
+			if looksLikePath(m[1]) && strings.Contains(m[1], ".") {
+				steps[i].File = m[1]
+				break
+			}
+		}
+	}
+	return steps
+}
+
+// stepPrompt asks the editor for one step of the plan for request
+func stepPrompt(request string, step protocol.PlanStep, i, n int) string {
+	prompt := fmt.Sprintf("Carry out step %d of %d of the approved plan for %q: %s", i+1, n, oneLine(request), step.Description)
+	if step.File != "" && !strings.Contains(step.Description, step.File) {
+		prompt += " (in " + step.File + ")"
+	}
+	return prompt
+}
+
+// oneLine joins text onto a line; aider reads each line as a prompt
+func oneLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+type planDecisionsKey struct{}
+
+// WithPlanDecisions returns a context whose chat puts the plans it drafts
+// to the user, as replies with Plan set, and waits for their decisions on
+// decisions. Without it plans run as drafted.
+func WithPlanDecisions(ctx context.Context, decisions <-chan protocol.ChatPlanDecision) context.Context {
+	return context.WithValue(ctx, planDecisionsKey{}, decisions)
+}
+
+func planDecisionsFrom(ctx context.Context) <-chan protocol.ChatPlanDecision {
+	decisions, _ := ctx.Value(planDecisionsKey{}).(<-chan protocol.ChatPlanDecision)
+	return decisions
+}
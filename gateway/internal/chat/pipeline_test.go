@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// scriptedBackend answers every message with answer and records the prompts
+type scriptedBackend struct {
+	answer string
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (s *scriptedBackend) Initialize(ctx context.Context) error { return nil }
+func (s *scriptedBackend) Close() error                         { return nil }
+
+func (s *scriptedBackend) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	s.mu.Lock()
+	s.prompts = append(s.prompts, msg.Content)
+	s.mu.Unlock()
+
+	replies := make(chan *protocol.ChatReply, 2)
+	replies <- &protocol.ChatReply{Content: s.answer}
+	replies <- &protocol.ChatReply{Finished: true, MessageID: "msg-" + s.answer}
+	close(replies)
+	return replies, nil
+}
+
+func (s *scriptedBackend) asked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.prompts...)
+}
+
+const testPlan = "Here is the plan:\n\n1. Add a `Retry` option to `client/options.go`\n2) Use it in `client/client.go`\n   when the request times out\n\nThat should do it."
+
+func TestParsePlan(t *testing.T) {
+	steps := ParsePlan(testPlan)
+	want := []protocol.PlanStep{
+		{Description: "Add a `Retry` option to `client/options.go`", File: "client/options.go"},
+		{Description: "Use it in `client/client.go` when the request times out", File: "client/client.go"},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("expected %d steps, got %+v", len(want), steps)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Errorf("step %d: expected %+v, got %+v", i+1, want[i], steps[i])
+		}
+	}
+	if steps := ParsePlan("No plan needed, the code already retries."); len(steps) != 0 {
+		t.Fatalf("expected no steps, got %+v", steps)
+	}
+}
+
+// collectPlanned reads a reply to the end, answering its plan with decide
+func collectPlanned(t *testing.T, replies <-chan *protocol.ChatReply, decide func(*protocol.ChatPlan)) (string, *protocol.ChatReply) {
+	t.Helper()
+	var content strings.Builder
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				t.Fatal("replies ended without a finished reply")
+			}
+			if reply.Plan != nil {
+				decide(reply.Plan)
+				continue
+			}
+			content.WriteString(reply.Content)
+			if reply.Finished {
+				return content.String(), reply
+			}
+		case <-timeout:
+			t.Fatal("no finished reply")
+		}
+	}
+}
+
+func TestPipelineRunsTheApprovedSteps(t *testing.T) {
+	planner := &scriptedBackend{answer: testPlan}
+	editor := &scriptedBackend{answer: "done"}
+	p := NewPipeline(planner, editor, 0)
+
+	decisions := make(chan protocol.ChatPlanDecision, 1)
+	ctx := WithPlanDecisions(context.Background(), decisions)
+	replies, err := p.HandleChatMessage(ctx, &protocol.ChatMessage{Role: "user", Content: "retry\ntimeouts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var proposed *protocol.ChatPlan
+	content, final := collectPlanned(t, replies, func(plan *protocol.ChatPlan) {
+		proposed = plan
+		// The user drops the first step
+		decisions <- protocol.ChatPlanDecision{PlanID: plan.ID, Approved: true, Steps: plan.Steps[1:]}
+	})
+
+	if proposed == nil || len(proposed.Steps) != 2 {
+		t.Fatalf("expected the plan put to the user, got %+v", proposed)
+	}
+	if asked := planner.asked(); len(asked) != 1 || !strings.HasPrefix(asked[0], "/ask ") || !strings.HasSuffix(asked[0], "retry timeouts") {
+		t.Fatalf("expected one planning question, got %q", asked)
+	}
+	asked := editor.asked()
+	if len(asked) != 1 || !strings.Contains(asked[0], "step 1 of 1") || !strings.Contains(asked[0], "client/client.go") {
+		t.Fatalf("expected the editor asked for the kept step only, got %q", asked)
+	}
+	if !strings.HasPrefix(content, testPlan) || !strings.Contains(content, "**Step 1 of 1:**") || !strings.HasSuffix(content, "done") {
+		t.Fatalf("unexpected reply %q", content)
+	}
+	if final.MessageID != "msg-done" {
+		t.Fatalf("expected the editor's last message ID, got %q", final.MessageID)
+	}
+}
+
+func TestPipelineRejectedPlanChangesNothing(t *testing.T) {
+	planner := &scriptedBackend{answer: testPlan}
+	editor := &scriptedBackend{answer: "done"}
+	p := NewPipeline(planner, editor, 0)
+
+	decisions := make(chan protocol.ChatPlanDecision, 1)
+	replies, err := p.HandleChatMessage(WithPlanDecisions(context.Background(), decisions), &protocol.ChatMessage{Role: "user", Content: "retry timeouts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := collectPlanned(t, replies, func(plan *protocol.ChatPlan) {
+		decisions <- protocol.ChatPlanDecision{PlanID: plan.ID}
+	})
+	if len(editor.asked()) != 0 || !strings.Contains(content, "Plan rejected") {
+		t.Fatalf("expected the plan rejected without edits, got %q and %q", content, editor.asked())
+	}
+}
+
+func TestPipelineWithoutApprovalRunsThePlan(t *testing.T) {
+	planner := &scriptedBackend{answer: testPlan}
+	editor := &scriptedBackend{answer: "done"}
+	p := NewPipeline(planner, editor, 0)
+
+	replies, err := p.HandleChatMessage(context.Background(), &protocol.ChatMessage{Role: "user", Content: "retry timeouts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collectPlanned(t, replies, func(plan *protocol.ChatPlan) {
+		t.Fatal("plan put to a user who cannot decide it")
+	})
+	if len(editor.asked()) != 2 {
+		t.Fatalf("expected both steps carried out, got %q", editor.asked())
+	}
+
+	// Branching goes straight to the editor
+	replies, _ = p.HandleChatMessage(context.Background(), &protocol.ChatMessage{Role: "user", Regenerate: true})
+	collectPlanned(t, replies, nil)
+	if len(planner.asked()) != 1 || len(editor.asked()) != 3 {
+		t.Fatalf("expected regenerate to skip planning, planner got %q", planner.asked())
+	}
+}
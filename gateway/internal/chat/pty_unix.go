@@ -0,0 +1,14 @@
+//go:build !windows
+
+package chat
+
+import "syscall"
+
+// ptyProcAttr makes the PTY a process runs on its controlling terminal, in
+// a session of its own
+func ptyProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setctty: true,
+		Setsid:  true,
+	}
+}
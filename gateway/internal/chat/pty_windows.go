@@ -0,0 +1,11 @@
+//go:build windows
+
+package chat
+
+import "syscall"
+
+// ptyProcAttr returns nil: there are no PTYs on Windows, so real Aider fails
+// to start at pty.Open
+func ptyProcAttr() *syscall.SysProcAttr {
+	return nil
+}
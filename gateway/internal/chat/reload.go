@@ -0,0 +1,429 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadDrainTimeout is how long a replaced backend may keep streaming
+// replies that were in progress before it is closed. It matches the longest
+// aider response.
+const reloadDrainTimeout = 2 * time.Minute
+
+// Reloadable is a Handler whose backend can be replaced at runtime. Callers
+// keep using the same Reloadable, so connections and terminals are not
+// affected; replies already streaming finish on the old backend.
+type Reloadable struct {
+	workspaces   *workspace.Registry
+	newHandler   func(workDir string, config protocol.ChatConfig) Handler
+	drainTimeout time.Duration
+	warm         bool
+
+	// reloadMu serializes reloads; mu guards the current backend
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	config   protocol.ChatConfig
+	current  *backend
+	closed   bool
+}
+
+// backend is one configuration's handlers and the requests they are
+// serving. The default workspace's root has a handler from the start; other
+// workspaces and directories chats are scoped to get their own when first
+// used.
+type backend struct {
+	config     protocol.ChatConfig
+	newHandler func(workDir string, config protocol.ChatConfig) Handler
+	handler    Handler
+	queue      *RequestQueue
+	active     sync.WaitGroup
+
+	// Ends when the backend closes, stopping handlers still warming up
+	warmCtx  context.Context
+	stopWarm context.CancelFunc
+
+	mu     sync.Mutex
+	scoped map[string]*RequestQueue
+	closed bool
+}
+
+func newBackend(workDir string, config protocol.ChatConfig, newHandler func(string, protocol.ChatConfig) Handler) *backend {
+	handler := newHandler(workDir, config)
+	warmCtx, stopWarm := context.WithCancel(context.Background())
+	return &backend{
+		config:     config,
+		newHandler: newHandler,
+		handler:    handler,
+		queue:      NewRequestQueue(handler, config.Parallelism),
+		warmCtx:    warmCtx,
+		stopWarm:   stopWarm,
+		scoped:     make(map[string]*RequestQueue),
+	}
+}
+
+// queueFor returns the queue for requests in dir, or the root's for ""
+func (b *backend) queueFor(dir string) (*RequestQueue, error) {
+	if dir == "" {
+		return b.queue, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, fmt.Errorf("chat backend closed")
+	}
+	if queue, ok := b.scoped[dir]; ok {
+		return queue, nil
+	}
+	if len(b.scoped) >= maxWorkDirs {
+		err := NewChatError(ErrorTypeFileSystem, fmt.Sprintf("too many working directories in use, at most %d", maxWorkDirs), "").WithCode(CodeInvalidWorkDir)
+		err.Retryable = false
+		return nil, err
+	}
+
+	queue := NewRequestQueue(b.newHandler(dir, b.config), b.config.Parallelism)
+	b.scoped[dir] = queue
+	return queue, nil
+}
+
+// warm starts the root's handler and those for dirs ahead of their first
+// chat, so it streams without waiting for aider to start. Handlers that fail
+// to start are left for the first chat to retry.
+func (b *backend) warm(dirs []string) {
+	start := time.Now()
+	queues := map[string]*RequestQueue{"": b.queue}
+	for _, dir := range dirs {
+		queue, err := b.queueFor(dir)
+		if err != nil {
+			// The rest start on first use
+			break
+		}
+		queues[dir] = queue
+	}
+
+	var wg sync.WaitGroup
+	var ready atomic.Int32
+	for dir, queue := range queues {
+		wg.Add(1)
+		go func(dir string, queue *RequestQueue) {
+			defer wg.Done()
+			if err := queue.Initialize(b.warmCtx); err != nil {
+				if b.warmCtx.Err() == nil {
+					log.Warn().Err(err).Str("workDir", dir).Msg("failed to warm up chat backend")
+				}
+				return
+			}
+			ready.Add(1)
+		}(dir, queue)
+	}
+	wg.Wait()
+
+	log.Info().
+		Int("ready", int(ready.Load())).
+		Int("handlers", len(queues)).
+		Dur("took", time.Since(start)).
+		Msg("chat backend warmed up")
+}
+
+// close closes every handler
+func (b *backend) close() error {
+	b.stopWarm()
+
+	b.mu.Lock()
+	b.closed = true
+	scoped := b.scoped
+	b.scoped = nil
+	b.mu.Unlock()
+
+	err := b.handler.Close()
+	for _, queue := range scoped {
+		if closeErr := queue.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReloadableOption configures a Reloadable
+type ReloadableOption func(*Reloadable)
+
+// WithWarmStart starts the backend for every workspace as soon as it is
+// created, and again after each reload, instead of on its first chat. Aider
+// takes several seconds to start, which the first message of a session
+// would otherwise wait for.
+func WithWarmStart() ReloadableOption {
+	return func(r *Reloadable) {
+		r.warm = true
+	}
+}
+
+// NewReloadable creates the backend config selects for chats in workspaces
+func NewReloadable(workspaces *workspace.Registry, config protocol.ChatConfig, opts ...ReloadableOption) (*Reloadable, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	r := newReloadable(workspaces, copyConfig(config), NewHandlerFromConfig)
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.warmUp(r.current)
+	return r, nil
+}
+
+func newReloadable(workspaces *workspace.Registry, config protocol.ChatConfig, newHandler func(string, protocol.ChatConfig) Handler) *Reloadable {
+	return &Reloadable{
+		workspaces:   workspaces,
+		newHandler:   newHandler,
+		drainTimeout: reloadDrainTimeout,
+		config:       config,
+		current:      newBackend(workspaces.Default().Root, config, newHandler),
+	}
+}
+
+// Config returns the configuration in use
+func (r *Reloadable) Config() protocol.ChatConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyConfig(r.config)
+}
+
+// Status describes the backend in use without exposing API keys
+func (r *Reloadable) Status() protocol.ChatConfigStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return configStatus(r.config, r.current.handler)
+}
+
+// Update applies the fields set in change to the current configuration and
+// reloads. An empty API key removes that key.
+func (r *Reloadable) Update(change protocol.ChatConfig) (protocol.ChatConfigStatus, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	config := r.Config()
+	if change.Backend != "" {
+		config.Backend = change.Backend
+	}
+	if change.Model != "" {
+		config.Model = change.Model
+	}
+	if change.Parallelism != 0 {
+		config.Parallelism = change.Parallelism
+	}
+	if change.PlannerModel != "" {
+		config.PlannerModel = change.PlannerModel
+	}
+	for key, val := range change.APIKeys {
+		if val == "" {
+			delete(config.APIKeys, key)
+		} else {
+			config.APIKeys[key] = val
+		}
+	}
+	return r.reloadLocked(config)
+}
+
+// Reload replaces the configuration and the backend
+func (r *Reloadable) Reload(config protocol.ChatConfig) (protocol.ChatConfigStatus, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	return r.reloadLocked(copyConfig(config))
+}
+
+func (r *Reloadable) reloadLocked(config protocol.ChatConfig) (protocol.ChatConfigStatus, error) {
+	if err := validateConfig(config); err != nil {
+		return protocol.ChatConfigStatus{}, err
+	}
+
+	next := newBackend(r.workspaces.Default().Root, config, r.newHandler)
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		next.close()
+		return protocol.ChatConfigStatus{}, fmt.Errorf("chat backend closed")
+	}
+	old := r.current
+	r.current = next
+	r.config = config
+	status := configStatus(config, next.handler)
+	r.mu.Unlock()
+
+	log.Info().
+		Str("backend", status.Backend).
+		Str("model", status.Model).
+		Strs("apiKeys", status.APIKeys).
+		Msg("chat backend reloaded")
+
+	r.warmUp(next)
+	go r.retire(old)
+	return status, nil
+}
+
+// warmUp starts b's handlers in the background with warm start enabled
+func (r *Reloadable) warmUp(b *backend) {
+	if !r.warm {
+		return
+	}
+
+	// Workspaces other than the default get their own handler, keyed by
+	// their resolved root as chats scoped to them are
+	defaultRoot := r.workspaces.Default().Root
+	var dirs []string
+	for _, ws := range r.workspaces.List() {
+		dir, err := resolveChatDir(r.workspaces, ws.Name, "")
+		if err != nil || ws.Default || dir == defaultRoot {
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	go b.warm(dirs)
+}
+
+// retire closes a replaced backend once its requests finish
+func (r *Reloadable) retire(old *backend) {
+	done := make(chan struct{})
+	go func() {
+		old.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(r.drainTimeout):
+		log.Warn().Msg("closing replaced chat backend with requests still in progress")
+	}
+	if err := old.close(); err != nil {
+		log.Error().Err(err).Msg("failed to close replaced chat backend")
+	}
+}
+
+func (r *Reloadable) Initialize(ctx context.Context) error {
+	r.mu.RLock()
+	handler := r.current.handler
+	r.mu.RUnlock()
+	return handler.Initialize(ctx)
+}
+
+// HandleChatMessage sends msg to the handler for its workspace and work_dir,
+// which must be under the workspace's root
+func (r *Reloadable) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	var dir string
+	if msg.Workspace != "" || msg.WorkDir != "" {
+		var err error
+		if dir, err = resolveChatDir(r.workspaces, msg.Workspace, msg.WorkDir); err != nil {
+			return nil, err
+		}
+		if dir == r.workspaces.Default().Root {
+			dir = ""
+		}
+	}
+
+	// Count the request against the backend before a reload can retire it
+	r.mu.RLock()
+	current := r.current
+	current.active.Add(1)
+	r.mu.RUnlock()
+
+	queue, err := current.queueFor(dir)
+	if err != nil {
+		current.active.Done()
+		return nil, err
+	}
+	replies, err := queue.HandleChatMessage(ctx, msg)
+	if err != nil {
+		current.active.Done()
+		return nil, err
+	}
+
+	forwarded := make(chan *protocol.ChatReply)
+	go func() {
+		defer current.active.Done()
+		defer close(forwarded)
+		for reply := range replies {
+			select {
+			case forwarded <- reply:
+			case <-ctx.Done():
+				// Drain so the backend is not left blocked
+				for range replies {
+				}
+				return
+			}
+		}
+	}()
+	return forwarded, nil
+}
+
+// Close closes the current backend. Replaced backends close on their own
+// once drained.
+func (r *Reloadable) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	current := r.current
+	r.mu.Unlock()
+	return current.close()
+}
+
+func validateConfig(config protocol.ChatConfig) error {
+	switch config.Backend {
+	case protocol.BackendAider, protocol.BackendMock:
+	default:
+		return fmt.Errorf("unknown chat backend %q, expected %s or %s", config.Backend, protocol.BackendAider, protocol.BackendMock)
+	}
+
+	if config.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative")
+	}
+
+	for key := range config.APIKeys {
+		known := false
+		for _, name := range apiKeyEnvVars {
+			known = known || key == name
+		}
+		if !known {
+			return fmt.Errorf("unknown API key %s, expected one of %v", key, apiKeyEnvVars)
+		}
+	}
+	return nil
+}
+
+func configStatus(config protocol.ChatConfig, handler Handler) protocol.ChatConfigStatus {
+	status := protocol.ChatConfigStatus{Backend: config.Backend}
+	for key := range config.APIKeys {
+		status.APIKeys = append(status.APIKeys, key)
+	}
+	sort.Strings(status.APIKeys)
+
+	switch h := handler.(type) {
+	case *UnconfiguredHandler:
+		status.Backend = protocol.BackendUnconfigured
+		status.Problems = h.Problems()
+	case *RealAiderHandler:
+		status.Model = h.config.Model
+	case *Pipeline:
+		status = configStatus(config, h.editor)
+		if planner, ok := h.planner.(*RealAiderHandler); ok {
+			status.PlannerModel = planner.config.Model
+		}
+	}
+	return status
+}
+
+func copyConfig(config protocol.ChatConfig) protocol.ChatConfig {
+	keys := make(map[string]string, len(config.APIKeys))
+	for key, val := range config.APIKeys {
+		keys[key] = val
+	}
+	config.APIKeys = keys
+	return config
+}
@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// stubBackend answers with its name once release is closed
+type stubBackend struct {
+	name        string
+	workDir     string
+	release     chan struct{}
+	initialized atomic.Bool
+	closed      atomic.Bool
+}
+
+func (s *stubBackend) Initialize(ctx context.Context) error {
+	s.initialized.Store(true)
+	return nil
+}
+
+func (s *stubBackend) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 1)
+	go func() {
+		defer close(replies)
+		<-s.release
+		replies <- &protocol.ChatReply{Content: s.name, Finished: true}
+	}()
+	return replies, nil
+}
+
+func (s *stubBackend) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// testWorkspaces registers root as the default workspace
+func testWorkspaces(t *testing.T, root string) *workspace.Registry {
+	t.Helper()
+
+	workspaces := workspace.NewRegistry()
+	if err := workspaces.Add(workspace.DefaultName, root); err != nil {
+		t.Fatal(err)
+	}
+	return workspaces
+}
+
+func newStubReloadable(t *testing.T) (*Reloadable, func() []*stubBackend) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var backends []*stubBackend
+	r := newReloadable(testWorkspaces(t, t.TempDir()), protocol.ChatConfig{Backend: protocol.BackendMock, APIKeys: map[string]string{}}, func(workDir string, config protocol.ChatConfig) Handler {
+		mu.Lock()
+		defer mu.Unlock()
+		b := &stubBackend{name: config.Model, workDir: workDir, release: make(chan struct{})}
+		backends = append(backends, b)
+		return b
+	})
+	t.Cleanup(func() { r.Close() })
+	return r, func() []*stubBackend {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*stubBackend(nil), backends...)
+	}
+}
+
+func TestReloadDrainsTheOldBackend(t *testing.T) {
+	r, backends := newStubReloadable(t)
+
+	replies, err := r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Update(protocol.ChatConfig{Model: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	old := backends()[0]
+	time.Sleep(20 * time.Millisecond)
+	if old.closed.Load() {
+		t.Fatal("old backend closed while a reply was streaming")
+	}
+
+	// The in-flight reply finishes on the old backend, then it is closed
+	close(old.release)
+	if reply := <-replies; reply.Content != "" {
+		t.Fatalf("reply came from %q, expected the old backend", reply.Content)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !old.closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("old backend was never closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// New requests go to the new backend
+	close(backends()[1].release)
+	replies, err = r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := <-replies; reply.Content != "new" {
+		t.Fatalf("reply came from %q, expected the new backend", reply.Content)
+	}
+}
+
+func TestUpdateMergesConfig(t *testing.T) {
+	r, _ := newStubReloadable(t)
+
+	status, err := r.Update(protocol.ChatConfig{APIKeys: map[string]string{"ANTHROPIC_API_KEY": "k1", "OPENAI_API_KEY": "k2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.APIKeys) != 2 || status.APIKeys[0] != "ANTHROPIC_API_KEY" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if _, err := r.Update(protocol.ChatConfig{Model: "m", APIKeys: map[string]string{"OPENAI_API_KEY": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	config := r.Config()
+	if config.Backend != protocol.BackendMock || config.Model != "m" || len(config.APIKeys) != 1 || config.APIKeys["ANTHROPIC_API_KEY"] != "k1" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
+
+func TestUpdateRejectsInvalidConfig(t *testing.T) {
+	r, backends := newStubReloadable(t)
+
+	for _, change := range []protocol.ChatConfig{
+		{Backend: "gpt"},
+		{APIKeys: map[string]string{"PATH": "/tmp"}},
+	} {
+		if _, err := r.Update(change); err == nil {
+			t.Errorf("accepted %+v", change)
+		}
+	}
+	if n := len(backends()); n != 1 {
+		t.Fatalf("invalid config created %d backends", n)
+	}
+}
+
+func TestWarmStartInitializesEveryWorkspace(t *testing.T) {
+	r, backends := newStubReloadable(t)
+	api := t.TempDir()
+	if err := r.workspaces.Add("api", api); err != nil {
+		t.Fatal(err)
+	}
+	r.warm = true
+	r.warmUp(r.current)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		warmed := 0
+		for _, b := range backends() {
+			if b.initialized.Load() {
+				warmed++
+			}
+		}
+		if warmed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both workspaces warmed, got %d", warmed)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The first chat in the workspace uses the handler already started
+	close(backends()[1].release)
+	replies, err := r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi", Workspace: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-replies
+	if n := len(backends()); n != 2 {
+		t.Fatalf("chat created another handler, %d in all", n)
+	}
+	if dir, _ := ResolveWorkDir(api, ""); backends()[1].workDir != dir {
+		t.Fatalf("warmed %s, expected %s", backends()[1].workDir, dir)
+	}
+
+	// A reload warms the new backend too
+	if _, err := r.Update(protocol.ChatConfig{Model: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	for !backends()[2].initialized.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("reloaded backend was not warmed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// ConcurrentBackend is implemented by backends that can serve several
+// requests at once, such as ones calling a provider's API directly. Other
+// backends, like aider behind a single PTY, get one request at a time.
+type ConcurrentBackend interface {
+	Handler
+	SupportsConcurrency() bool
+}
+
+// QueuedBackend is implemented by backends that queue the requests they
+// pass on themselves, like Pipeline, so nothing should queue in front of
+// them
+type QueuedBackend interface {
+	Handler
+	QueuesRequests() bool
+}
+
+// RequestQueue runs requests to a backend in the order they arrive, at most
+// parallelism at a time. Waiting requests get chat_queued replies as their
+// position changes.
+type RequestQueue struct {
+	handler Handler
+
+	mu      sync.Mutex
+	free    int
+	waiting []*queuedRequest
+}
+
+type queuedRequest struct {
+	ready    chan struct{} // closed when the request gets a slot
+	position chan int      // latest position, 1 being next
+}
+
+// NewRequestQueue queues requests to handler. parallelism is ignored, and
+// requests run one at a time, unless handler is a ConcurrentBackend that
+// supports concurrency. A QueuedBackend gets every request as it arrives.
+func NewRequestQueue(handler Handler, parallelism int) *RequestQueue {
+	if queued, ok := handler.(QueuedBackend); ok && queued.QueuesRequests() {
+		return &RequestQueue{handler: handler, free: math.MaxInt32}
+	}
+	if concurrent, ok := handler.(ConcurrentBackend); !ok || !concurrent.SupportsConcurrency() || parallelism < 1 {
+		parallelism = 1
+	}
+	return &RequestQueue{handler: handler, free: parallelism}
+}
+
+// Waiting returns how many requests are queued
+func (q *RequestQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+func (q *RequestQueue) Initialize(ctx context.Context) error {
+	return q.handler.Initialize(ctx)
+}
+
+func (q *RequestQueue) Close() error {
+	return q.handler.Close()
+}
+
+// HandleChatMessage runs msg now if a slot is free, returning the backend's
+// errors directly. Otherwise it queues msg; errors from a queued request
+// arrive as a final reply with Error set.
+func (q *RequestQueue) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	q.mu.Lock()
+	if q.free > 0 {
+		q.free--
+		q.mu.Unlock()
+
+		replies, err := q.handler.HandleChatMessage(ctx, msg)
+		if err != nil {
+			q.release()
+			return nil, err
+		}
+		out := make(chan *protocol.ChatReply)
+		go func() {
+			defer close(out)
+			q.forward(ctx, replies, out)
+		}()
+		return out, nil
+	}
+
+	req := &queuedRequest{ready: make(chan struct{}), position: make(chan int, 1)}
+	q.waiting = append(q.waiting, req)
+	q.notifyPositionsLocked()
+	q.mu.Unlock()
+
+	out := make(chan *protocol.ChatReply)
+	go func() {
+		defer close(out)
+
+		if !q.wait(ctx, req, out) {
+			return
+		}
+
+		replies, err := q.handler.HandleChatMessage(ctx, msg)
+		if err != nil {
+			q.release()
+			select {
+			case out <- &protocol.ChatReply{Finished: true, Error: replyError(err)}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		q.forward(ctx, replies, out)
+	}()
+	return out, nil
+}
+
+// wait reports positions until req gets a slot, or returns false if ctx ends
+// first
+func (q *RequestQueue) wait(ctx context.Context, req *queuedRequest, out chan<- *protocol.ChatReply) bool {
+	for {
+		select {
+		case <-req.ready:
+			return true
+		case position := <-req.position:
+			select {
+			case out <- &protocol.ChatReply{Queued: &protocol.ChatQueued{Position: position}}:
+			case <-req.ready:
+				return true
+			case <-ctx.Done():
+				return q.abandon(req)
+			}
+		case <-ctx.Done():
+			return q.abandon(req)
+		}
+	}
+}
+
+// abandon takes req out of the queue. If it got a slot in the meantime the
+// slot is passed on.
+func (q *RequestQueue) abandon(req *queuedRequest) bool {
+	q.mu.Lock()
+	for i, w := range q.waiting {
+		if w == req {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.notifyPositionsLocked()
+			q.mu.Unlock()
+			return false
+		}
+	}
+	q.mu.Unlock()
+
+	// Already handed a slot
+	q.release()
+	return false
+}
+
+// forward passes replies on and frees the slot once the backend is done
+func (q *RequestQueue) forward(ctx context.Context, replies <-chan *protocol.ChatReply, out chan<- *protocol.ChatReply) {
+	defer q.release()
+
+	for reply := range replies {
+		select {
+		case out <- reply:
+		case <-ctx.Done():
+			// Drain so the backend is not left blocked
+			for range replies {
+			}
+			return
+		}
+	}
+}
+
+// release hands a slot to the next waiting request, or frees it
+func (q *RequestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 {
+		q.free++
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+	q.notifyPositionsLocked()
+}
+
+// notifyPositionsLocked tells every waiting request its position, replacing
+// any position it has not read yet
+func (q *RequestQueue) notifyPositionsLocked() {
+	for i, req := range q.waiting {
+		select {
+		case <-req.position:
+		default:
+		}
+		req.position <- i + 1
+	}
+}
+
+// replyError describes err for the client, as the gateway would had the
+// backend returned it directly
+func replyError(err error) *protocol.ChatError {
+	var chatErr *ChatError
+	if errors.As(err, &chatErr) {
+		clientErr := chatErr.ClientError()
+		return &clientErr
+	}
+	return &protocol.ChatError{Error: err.Error(), Code: "chat_error", Retryable: true}
+}
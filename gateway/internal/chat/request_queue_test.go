@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// gatedBackend holds each request until it is released, recording the order
+// requests start in
+type gatedBackend struct {
+	concurrent bool
+	fail       error
+
+	mu      sync.Mutex
+	started []string
+	running int
+	peak    int
+	release chan struct{}
+}
+
+func newGatedBackend() *gatedBackend {
+	return &gatedBackend{release: make(chan struct{})}
+}
+
+func (g *gatedBackend) Initialize(ctx context.Context) error { return nil }
+func (g *gatedBackend) Close() error                         { return nil }
+func (g *gatedBackend) SupportsConcurrency() bool            { return g.concurrent }
+
+func (g *gatedBackend) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	if g.fail != nil {
+		return nil, g.fail
+	}
+
+	g.mu.Lock()
+	g.started = append(g.started, msg.Content)
+	g.running++
+	g.peak = max(g.peak, g.running)
+	g.mu.Unlock()
+
+	replies := make(chan *protocol.ChatReply)
+	go func() {
+		defer close(replies)
+		<-g.release
+		g.mu.Lock()
+		g.running--
+		g.mu.Unlock()
+		replies <- &protocol.ChatReply{Content: msg.Content, Finished: true}
+	}()
+	return replies, nil
+}
+
+func (g *gatedBackend) startedOrder() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.started...)
+}
+
+// collect reads replies until the channel closes
+func collect(replies <-chan *protocol.ChatReply) []*protocol.ChatReply {
+	var out []*protocol.ChatReply
+	for reply := range replies {
+		out = append(out, reply)
+	}
+	return out
+}
+
+func TestRequestQueueRunsInOrder(t *testing.T) {
+	backend := newGatedBackend()
+	q := NewRequestQueue(backend, 4)
+
+	var replies [3]<-chan *protocol.ChatReply
+	for i, content := range []string{"a", "b", "c"} {
+		var err error
+		replies[i], err = q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The third request waits behind two
+	if reply := <-replies[2]; reply.Queued == nil || reply.Queued.Position != 2 {
+		t.Fatalf("expected queue position 2, got %+v", reply)
+	}
+
+	close(backend.release)
+	var last []*protocol.ChatReply
+	for i := range replies {
+		last = collect(replies[i])
+	}
+
+	if order := backend.startedOrder(); len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "c" {
+		t.Fatalf("requests ran out of order: %v", order)
+	}
+	if backend.peak != 1 {
+		t.Fatalf("a backend without concurrency support ran %d requests at once", backend.peak)
+	}
+	if final := last[len(last)-1]; final.Content != "c" || !final.Finished {
+		t.Fatalf("unexpected final reply %+v", final)
+	}
+}
+
+func TestRequestQueueParallelism(t *testing.T) {
+	backend := newGatedBackend()
+	backend.concurrent = true
+	q := NewRequestQueue(backend, 2)
+
+	var wg sync.WaitGroup
+	for _, content := range []string{"a", "b", "c"} {
+		replies, err := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collect(replies)
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.startedOrder()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("two requests did not start side by side")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if q.Waiting() != 1 {
+		t.Fatalf("expected one request waiting, got %d", q.Waiting())
+	}
+
+	close(backend.release)
+	wg.Wait()
+	if backend.peak != 2 {
+		t.Fatalf("expected 2 requests at once, got %d", backend.peak)
+	}
+}
+
+func TestRequestQueueAbandonedRequest(t *testing.T) {
+	backend := newGatedBackend()
+	q := NewRequestQueue(backend, 1)
+
+	first, err := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	second, err := q.HandleChatMessage(ctx, &protocol.ChatMessage{Content: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	collect(second)
+	if q.Waiting() != 0 {
+		t.Fatal("cancelled request stayed in the queue")
+	}
+
+	close(backend.release)
+	collect(first)
+	if order := backend.startedOrder(); len(order) != 1 {
+		t.Fatalf("cancelled request ran: %v", order)
+	}
+
+	// The slot is free again
+	third, err := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies := collect(third); len(replies) != 1 || replies[0].Queued != nil {
+		t.Fatalf("expected the request to run at once, got %+v", replies)
+	}
+}
+
+func TestRequestQueueReportsQueuedErrors(t *testing.T) {
+	backend := newGatedBackend()
+	q := NewRequestQueue(backend, 1)
+
+	first, _ := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "a"})
+	second, _ := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "b"})
+
+	backend.mu.Lock()
+	backend.fail = NewChatError(ErrorTypeConfig, "no API key", "").WithCode(CodeUnconfigured)
+	backend.mu.Unlock()
+	close(backend.release)
+	collect(first)
+
+	replies := collect(second)
+	last := replies[len(replies)-1]
+	if last.Error == nil || last.Error.Code != CodeUnconfigured || !last.Finished {
+		t.Fatalf("expected the backend error as the final reply, got %+v", last)
+	}
+
+	// Requests that do not wait get errors directly
+	if _, err := q.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "c"}); !errors.Is(err, backend.fail) {
+		t.Fatalf("expected the error directly, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/internal/redact"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// Formats a conversation can be exported in
+const (
+	TranscriptMarkdown = "markdown"
+	TranscriptJSON     = "json"
+)
+
+const (
+	// CodeNoConversation is the ChatError code for an export of a directory
+	// no conversation has been saved in
+	CodeNoConversation = "no_conversation"
+
+	// CodeUnknownFormat is the ChatError code for an export in a format
+	// other than TranscriptMarkdown or TranscriptJSON
+	CodeUnknownFormat = "unknown_format"
+
+	// CodeTranscriptTooLarge is the ChatError code for a transcript larger
+	// than MaxTranscriptSize
+	CodeTranscriptTooLarge = "transcript_too_large"
+)
+
+// MaxTranscriptSize caps an exported transcript, which is sent in a single
+// message
+const MaxTranscriptSize = 768 << 10
+
+// maxCommitDiff caps the diff exported for one commit; a larger one is cut
+// off with a note, so a vendored dependency does not swamp the transcript
+const maxCommitDiff = 64 << 10
+
+// commitLine matches the line aider prints after committing its edits,
+// e.g. "Commit 1a2b3c4 feat: add parser"
+var commitLine = regexp.MustCompile(`\bCommit(?:ted)?\s+([0-9a-f]{7,40})\b`)
+
+// Transcript is a conversation as exported for documentation and code
+// review: its messages with the commands they ran and the changes the
+// assistant committed
+type Transcript struct {
+	SessionID string            `json:"session_id"`
+	WorkDir   string            `json:"work_dir"`
+	StartTime time.Time         `json:"start_time"`
+	Entries   []TranscriptEntry `json:"entries"`
+}
+
+// TranscriptEntry is one message of a Transcript
+type TranscriptEntry struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Role      string    `json:"role"`
+	Author    string    `json:"author,omitempty"`
+	Content   string    `json:"content"`
+
+	// Command is the shell command a user message had aider run
+	Command string `json:"command,omitempty"`
+
+	// Files and Commits are what an assistant reply edited and committed
+	Files   []string           `json:"files,omitempty"`
+	Commits []TranscriptCommit `json:"commits,omitempty"`
+}
+
+// TranscriptCommit is a commit the assistant made, with its diff when the
+// repository still has it
+type TranscriptCommit struct {
+	Hash string `json:"hash"`
+	Diff string `json:"diff,omitempty"`
+}
+
+// ExportTranscript renders the conversation last saved in the workspace and
+// work_dir export names. Diffs come from the repository there, bounded by
+// ctx.
+func ExportTranscript(ctx context.Context, workspaces *workspace.Registry, export protocol.ChatExport) (protocol.ChatTranscript, error) {
+	format := export.Format
+	if format == "" {
+		format = TranscriptMarkdown
+	}
+	if format != TranscriptMarkdown && format != TranscriptJSON {
+		chatErr := NewChatError(ErrorTypeConfig, fmt.Sprintf("unknown transcript format %q", format), "").WithCode(CodeUnknownFormat)
+		chatErr.Retryable = false
+		return protocol.ChatTranscript{}, chatErr
+	}
+
+	dir, err := resolveChatDir(workspaces, export.Workspace, export.WorkDir)
+	if err != nil {
+		return protocol.ChatTranscript{}, err
+	}
+	cm := NewContextManager(ContextDir(dir))
+	var conv *ConversationContext
+	if sessionID := cm.LatestSessionID(); sessionID != "" {
+		conv = cm.loadContextFromDisk(sessionID)
+	}
+	if conv == nil {
+		chatErr := NewChatError(ErrorTypeFileSystem, "no conversation has been saved here", "").WithCode(CodeNoConversation)
+		chatErr.Retryable = false
+		return protocol.ChatTranscript{}, chatErr
+	}
+
+	transcript := NewTranscript(conv, func(hash string) string { return commitDiff(ctx, dir, hash) })
+	exported := protocol.ChatTranscript{
+		Workspace:   export.Workspace,
+		WorkDir:     export.WorkDir,
+		Format:      format,
+		Filename:    "conversation-" + conv.SessionID + ".md",
+		ContentType: "text/markdown; charset=utf-8",
+	}
+	if format == TranscriptJSON {
+		data, err := json.MarshalIndent(transcript, "", "  ")
+		if err != nil {
+			return protocol.ChatTranscript{}, fmt.Errorf("marshal transcript: %w", err)
+		}
+		exported.Filename = "conversation-" + conv.SessionID + ".json"
+		exported.ContentType = "application/json"
+		exported.Content = string(data)
+	} else {
+		exported.Content = string(transcript.Markdown())
+	}
+	if len(exported.Content) > MaxTranscriptSize {
+		chatErr := NewChatError(ErrorTypeFileSystem, fmt.Sprintf("transcript is %d bytes, more than the %d one message can carry", len(exported.Content), MaxTranscriptSize), "").WithCode(CodeTranscriptTooLarge)
+		chatErr.Retryable = false
+		return protocol.ChatTranscript{}, chatErr
+	}
+	return exported, nil
+}
+
+// NewTranscript builds the transcript of conv, asking diff for the diff of
+// each commit the assistant made
+func NewTranscript(conv *ConversationContext, diff func(hash string) string) *Transcript {
+	conv.mu.RLock()
+	defer conv.mu.RUnlock()
+
+	t := &Transcript{SessionID: conv.SessionID, WorkDir: conv.WorkDir, StartTime: conv.StartTime}
+	for _, msg := range conv.Messages {
+		entry := TranscriptEntry{
+			ID:        msg.ID,
+			Timestamp: msg.Timestamp,
+			Role:      msg.Role,
+			Author:    msg.Author,
+			Content:   msg.Content,
+		}
+		if msg.Role == "user" {
+			entry.Command = ShellCommand(msg.Content)
+		} else {
+			entry.Files = msg.Files
+			for _, action := range msg.Actions {
+				if hash, ok := strings.CutPrefix(action, "commit:"); ok {
+					entry.Commits = append(entry.Commits, TranscriptCommit{Hash: hash, Diff: diff(hash)})
+				}
+			}
+		}
+		t.Entries = append(t.Entries, entry)
+	}
+	return t
+}
+
+// Markdown renders t as a markdown document
+func (t *Transcript) Markdown() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Conversation %s\n\n", t.SessionID)
+	fmt.Fprintf(&b, "Started %s in `%s`\n", t.StartTime.UTC().Format(time.RFC3339), t.WorkDir)
+
+	for _, entry := range t.Entries {
+		speaker := entry.Role
+		if entry.Author != "" {
+			speaker = fmt.Sprintf("%s (%s)", entry.Role, entry.Author)
+		}
+		fmt.Fprintf(&b, "\n## %s, %s\n\n", speaker, entry.Timestamp.UTC().Format(time.RFC3339))
+		b.WriteString(strings.TrimSpace(entry.Content))
+		b.WriteString("\n")
+
+		if entry.Command != "" {
+			fmt.Fprintf(&b, "\nRan:\n\n```sh\n%s\n```\n", entry.Command)
+		}
+		if len(entry.Files) > 0 {
+			b.WriteString("\nFiles edited:\n\n")
+			for _, file := range entry.Files {
+				fmt.Fprintf(&b, "- `%s`\n", file)
+			}
+		}
+		for _, commit := range entry.Commits {
+			fmt.Fprintf(&b, "\nCommit `%s`", commit.Hash)
+			if commit.Diff == "" {
+				b.WriteString(" (diff unavailable)\n")
+				continue
+			}
+			fmt.Fprintf(&b, ":\n\n```diff\n%s\n```\n", strings.TrimRight(commit.Diff, "\n"))
+		}
+	}
+	return b.Bytes()
+}
+
+// commitDiff returns the diff hash made in the repository at dir, or "" if
+// git cannot show it, e.g. after a rebase dropped the commit. Exported
+// transcripts leave the VM, so secrets in the diff are redacted.
+func commitDiff(ctx context.Context, dir, hash string) string {
+	cmd := exec.CommandContext(ctx, "git", "show", "--format=", "--patch", hash)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	if len(out) > maxCommitDiff {
+		out = append(out[:maxCommitDiff:maxCommitDiff], "\n... diff truncated\n"...)
+	}
+	return redact.String(string(out))
+}
+
+// ShellCommand returns the shell command a chat message or task has aider
+// run, or "" if it runs none: /run and ! run a command, /test runs one as
+// the test suite and /git runs git. aider runs with --yes-always, which
+// never runs the commands the model suggests by itself.
+func ShellCommand(content string) string {
+	content = strings.TrimSpace(content)
+	if command, ok := strings.CutPrefix(content, "!"); ok {
+		return strings.TrimSpace(command)
+	}
+	name, args, _ := strings.Cut(content, " ")
+	switch name {
+	case "/run", "/test":
+		return strings.TrimSpace(args)
+	case "/git":
+		return "git " + strings.TrimSpace(args)
+	}
+	return ""
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestShellCommand(t *testing.T) {
+	tests := map[string]string{
+		"/run rm -rf build":   "rm -rf build",
+		"!  git push -f ":     "git push -f",
+		"/test go test ./...": "go test ./...",
+		"/git push --force":   "git push --force",
+		"/ask why rm -rf?":    "",
+		"remove the build":    "",
+	}
+	for content, want := range tests {
+		if got := ShellCommand(content); got != want {
+			t.Errorf("%q: expected %q, got %q", content, want, got)
+		}
+	}
+}
+
+func TestParseAiderOutputRecordsCommitHash(t *testing.T) {
+	var a RealAiderHandler
+	_, actions := a.parseAiderOutput("Applied edit to main.go\nCommit 1a2b3c4 feat: add parser\n")
+	if len(actions) != 2 || actions[1] != "commit:1a2b3c4" {
+		t.Fatalf("expected applied_edit and commit:1a2b3c4, got %v", actions)
+	}
+}
+
+// transcriptRepo creates a repository with one commit changing a.txt and a
+// saved conversation in which the assistant made it
+func transcriptRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Skipf("git unavailable: %v", err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("init", "-q")
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\n"), 0o644)
+	run("add", ".")
+	run("commit", "-q", "-m", "initial")
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\ntwo\n"), 0o644)
+	run("commit", "-q", "-am", "add two")
+	hash := run("rev-parse", "--short", "HEAD")
+
+	conv := NewConversationContext("s1", dir)
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Author: "ana", Content: "add a second line to a.txt"})
+	conv.AddResponse("Added it.", []string{"a.txt"}, []string{"edit:a.txt", "commit:" + hash})
+	conv.AddMessage(&protocol.ChatMessage{Role: "user", Author: "ana", Content: "/test go test ./..."})
+	if err := conv.Save(ContextDir(dir)); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExportTranscriptMarkdown(t *testing.T) {
+	dir := transcriptRepo(t)
+
+	exported, err := ExportTranscript(context.Background(), testWorkspaces(t, dir), protocol.ChatExport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Format != TranscriptMarkdown || exported.Filename != "conversation-s1.md" {
+		t.Errorf("expected a markdown file, got %s %s", exported.Format, exported.Filename)
+	}
+	for _, want := range []string{"## user (ana)", "add a second line to a.txt", "- `a.txt`", "```diff", "+two", "```sh\ngo test ./...\n```"} {
+		if !strings.Contains(exported.Content, want) {
+			t.Errorf("expected transcript to contain %q:\n%s", want, exported.Content)
+		}
+	}
+}
+
+func TestExportTranscriptJSON(t *testing.T) {
+	dir := transcriptRepo(t)
+
+	exported, err := ExportTranscript(context.Background(), testWorkspaces(t, dir), protocol.ChatExport{Format: TranscriptJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.ContentType != "application/json" || exported.Filename != "conversation-s1.json" {
+		t.Errorf("expected a JSON file, got %s %s", exported.ContentType, exported.Filename)
+	}
+
+	var transcript Transcript
+	if err := json.Unmarshal([]byte(exported.Content), &transcript); err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(transcript.Entries))
+	}
+	reply := transcript.Entries[1]
+	if len(reply.Commits) != 1 || !strings.Contains(reply.Commits[0].Diff, "+two") {
+		t.Errorf("expected the reply's commit with its diff, got %+v", reply.Commits)
+	}
+	if transcript.Entries[2].Command != "go test ./..." {
+		t.Errorf("expected the test command, got %q", transcript.Entries[2].Command)
+	}
+}
+
+func TestExportTranscriptErrors(t *testing.T) {
+	dir := transcriptRepo(t)
+	workspaces := testWorkspaces(t, dir)
+
+	tests := map[string]struct {
+		export protocol.ChatExport
+		dir    string
+		code   string
+	}{
+		"unknown format":  {protocol.ChatExport{Format: "pdf"}, dir, CodeUnknownFormat},
+		"no conversation": {protocol.ChatExport{}, t.TempDir(), CodeNoConversation},
+		"outside":         {protocol.ChatExport{WorkDir: ".."}, dir, CodeInvalidWorkDir},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			spaces := workspaces
+			if tt.dir != dir {
+				spaces = testWorkspaces(t, tt.dir)
+			}
+			_, err := ExportTranscript(context.Background(), spaces, tt.export)
+			var chatErr *ChatError
+			if !errors.As(err, &chatErr) || chatErr.Code != tt.code {
+				t.Fatalf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"context"
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// CodeUnconfigured is the ChatError code returned by UnconfiguredHandler
+const CodeUnconfigured = "backend_unconfigured"
+
+// UnconfiguredHandler stands in for the AI backend when it cannot run at all.
+// Every message fails with an error telling the user what to set up, instead
+// of a mock answering as if it were the assistant.
+type UnconfiguredHandler struct {
+	problems []string
+}
+
+// NewUnconfiguredHandler creates a handler that reports problems, each a
+// sentence telling the user what to fix
+func NewUnconfiguredHandler(problems ...string) *UnconfiguredHandler {
+	return &UnconfiguredHandler{problems: problems}
+}
+
+// unconfiguredProblems returns what keeps the real backend from running
+func unconfiguredProblems(config protocol.ChatConfig) []string {
+	var problems []string
+	if len(config.APIKeys) == 0 {
+		problems = append(problems, "No API key found; set "+apiKeyEnvVars[0]+" (or "+strings.Join(apiKeyEnvVars[1:], ", ")+") or configure one in settings.")
+	}
+	if !hasRealAider() {
+		problems = append(problems, "Aider is not installed on the workspace; install it with: pip install aider-chat")
+	}
+	return problems
+}
+
+// Problems returns what needs fixing before chat works
+func (u *UnconfiguredHandler) Problems() []string {
+	return u.problems
+}
+
+func (u *UnconfiguredHandler) Initialize(ctx context.Context) error {
+	return nil
+}
+
+func (u *UnconfiguredHandler) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	err := NewChatError(ErrorTypeConfig, strings.Join(u.problems, " "), "").WithCode(CodeUnconfigured)
+	err.Retryable = false
+	return nil, err
+}
+
+func (u *UnconfiguredHandler) Close() error {
+	return nil
+}
@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestFactoryWithoutAPIKeyIsUnconfigured(t *testing.T) {
+	for _, key := range apiKeyEnvVars {
+		t.Setenv(key, "")
+	}
+	t.Setenv("USE_MOCK_AIDER", "")
+
+	handler, ok := NewHandler(t.TempDir(), false).(*UnconfiguredHandler)
+	if !ok {
+		t.Fatal("expected an UnconfiguredHandler without an API key")
+	}
+
+	replies, err := handler.HandleChatMessage(context.Background(), &protocol.ChatMessage{Role: "user", Content: "hi"})
+	if replies != nil {
+		t.Fatal("unconfigured handler sent replies")
+	}
+	var chatErr *ChatError
+	if !errors.As(err, &chatErr) {
+		t.Fatalf("expected a ChatError, got %v", err)
+	}
+	if chatErr.Code != CodeUnconfigured || chatErr.Type != ErrorTypeConfig || chatErr.Retryable {
+		t.Fatalf("unexpected error %+v", chatErr)
+	}
+	if !strings.Contains(chatErr.Message, "ANTHROPIC_API_KEY") || !strings.Contains(chatErr.Message, "settings") {
+		t.Fatalf("error does not say how to configure a key: %q", chatErr.Message)
+	}
+	if client := chatErr.ClientError(); client.Error != chatErr.Message || client.Code != CodeUnconfigured {
+		t.Fatalf("unexpected client error %+v", client)
+	}
+}
+
+func TestFactoryMockOverridesUnconfigured(t *testing.T) {
+	for _, key := range apiKeyEnvVars {
+		t.Setenv(key, "")
+	}
+	t.Setenv("USE_MOCK_AIDER", "true")
+
+	if _, ok := NewHandler(t.TempDir(), false).(*AiderHandler); !ok {
+		t.Fatal("expected USE_MOCK_AIDER to select the mock")
+	}
+}
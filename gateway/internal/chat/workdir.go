@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/devtail/gateway/internal/workspace"
+)
+
+const (
+	// CodeInvalidWorkDir is the ChatError code for a work_dir outside the
+	// workspace or that does not exist
+	CodeInvalidWorkDir = "invalid_work_dir"
+
+	// CodeUnknownWorkspace is the ChatError code for a workspace the
+	// gateway does not serve
+	CodeUnknownWorkspace = "unknown_workspace"
+)
+
+// maxWorkDirs caps how many directories get their own backend at once,
+// besides the default workspace's root; each is a separate aider process
+const maxWorkDirs = 8
+
+// ResolveWorkDir returns the directory dir names under root. dir is relative
+// to root; an absolute dir must lie under root. Symlinks are followed, so a
+// link cannot lead the assistant out of the workspace.
+func ResolveWorkDir(root, dir string) (string, error) {
+	path, err := workspace.Within(root, dir)
+	var pathErr *workspace.PathError
+	if errors.As(err, &pathErr) {
+		return "", invalidWorkDir(pathErr)
+	}
+	return path, err
+}
+
+// resolveChatDir returns the directory a chat in the named workspace and
+// work_dir runs in
+func resolveChatDir(workspaces *workspace.Registry, name, dir string) (string, error) {
+	ws, err := workspaces.Get(name)
+	if err != nil {
+		chatErr := NewChatError(ErrorTypeFileSystem, err.Error(), "").WithCode(CodeUnknownWorkspace)
+		chatErr.Retryable = false
+		return "", chatErr
+	}
+	return ResolveWorkDir(ws.Root, dir)
+}
+
+func invalidWorkDir(pathErr *workspace.PathError) error {
+	err := NewChatError(ErrorTypeFileSystem, fmt.Sprintf("work_dir %s", pathErr), "").WithCode(CodeInvalidWorkDir)
+	err.Retryable = false
+	return err
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestResolveWorkDir(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "services", "api"), 0755)
+	os.WriteFile(filepath.Join(root, "README.md"), nil, 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+
+	realRoot, _ := filepath.EvalSymlinks(root)
+	api := filepath.Join(realRoot, "services", "api")
+
+	for dir, want := range map[string]string{
+		"":                                     realRoot,
+		"services/api":                         api,
+		"./services/../services/api/":          api,
+		filepath.Join(root, "services", "api"): api,
+	} {
+		got, err := ResolveWorkDir(root, dir)
+		if err != nil || got != want {
+			t.Errorf("ResolveWorkDir(%q) = %q, %v; want %q", dir, got, err, want)
+		}
+	}
+
+	for _, dir := range []string{"..", "../" + filepath.Base(outside), outside, "escape", "README.md", "missing"} {
+		if _, err := ResolveWorkDir(root, dir); err == nil {
+			t.Errorf("ResolveWorkDir(%q) accepted a directory it should not", dir)
+		} else if chatErr, ok := err.(*ChatError); !ok || chatErr.Code != CodeInvalidWorkDir {
+			t.Errorf("ResolveWorkDir(%q): expected %s, got %v", dir, CodeInvalidWorkDir, err)
+		}
+	}
+}
+
+func TestReloadableScopesChatsToWorkspaceAndWorkDir(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "web"), 0755)
+
+	var mu sync.Mutex
+	dirs := map[string]*stubBackend{}
+	other := t.TempDir()
+	workspaces := testWorkspaces(t, root)
+	if err := workspaces.Add("other", other); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReloadable(workspaces, protocol.ChatConfig{Backend: protocol.BackendMock}, func(workDir string, config protocol.ChatConfig) Handler {
+		mu.Lock()
+		defer mu.Unlock()
+		b := &stubBackend{name: filepath.Base(workDir), release: make(chan struct{})}
+		close(b.release)
+		dirs[workDir] = b
+		return b
+	})
+
+	ask := func(ws, dir string) string {
+		t.Helper()
+		replies, err := r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi", Workspace: ws, WorkDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return (<-replies).Content
+	}
+
+	if got := ask("", "web"); got != "web" {
+		t.Fatalf("chat ran in %q, expected web", got)
+	}
+	ask("", "web")
+	if got := ask("", ""); got != filepath.Base(root) {
+		t.Fatalf("chat ran in %q, expected the root", got)
+	}
+	if got := ask("other", ""); got != filepath.Base(other) {
+		t.Fatalf("chat ran in %q, expected the other workspace", got)
+	}
+	if len(dirs) != 3 {
+		t.Fatalf("expected one backend per directory, got %d", len(dirs))
+	}
+
+	if _, err := r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi", WorkDir: "../"}); err == nil {
+		t.Fatal("accepted a work_dir outside the workspace")
+	}
+	_, err := r.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi", Workspace: "missing"})
+	if chatErr, ok := err.(*ChatError); !ok || chatErr.Code != CodeUnknownWorkspace {
+		t.Fatalf("expected %s, got %v", CodeUnknownWorkspace, err)
+	}
+
+	r.Close()
+	for dir, b := range dirs {
+		if !b.closed.Load() {
+			t.Errorf("backend for %s not closed", dir)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package contextsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultInterval = 30 * time.Second
+	defaultMaxSize  = 4 << 20
+)
+
+// Workspace is a workspace whose conversation contexts are synced. Dir holds
+// the context files, one <session>.json per session.
+type Workspace struct {
+	Name string
+	Dir  string
+}
+
+// Snapshot is a context saved on the control plane. Listings leave Data out.
+type Snapshot struct {
+	Workspace string          `json:"workspace"`
+	SessionID string          `json:"session_id"`
+	VMID      string          `json:"vm_id"`
+	Size      int64           `json:"size"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+type listResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Syncer copies AI conversation contexts to the control plane, which keeps
+// them for the VM's owner rather than the VM. When the user recreates their
+// VM, the new gateway restores them before chat starts, so the conversation
+// carries on. Context files are uploaded when they change; the control plane
+// holds the latest copy of each.
+type Syncer struct {
+	endpoint   string
+	token      string
+	workspaces []Workspace
+	client     *http.Client
+	interval   time.Duration
+	maxSize    int64
+
+	// mu guards synced, the modification time of each file when it was
+	// last uploaded or restored
+	mu     sync.Mutex
+	synced map[string]time.Time
+}
+
+// Option configures a Syncer
+type Option func(*Syncer)
+
+// WithInterval sets how often changed contexts are uploaded
+func WithInterval(d time.Duration) Option {
+	return func(s *Syncer) { s.interval = d }
+}
+
+// WithHTTPClient replaces the HTTP client used to reach the control plane
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Syncer) { s.client = client }
+}
+
+// WithMaxSize sets the largest context file uploaded; the control plane
+// rejects bigger ones
+func WithMaxSize(n int64) Option {
+	return func(s *Syncer) { s.maxSize = n }
+}
+
+// New creates a syncer for the control plane's contexts endpoint,
+// authenticated with the VM's ingest token
+func New(endpoint, token string, workspaces []Workspace, opts ...Option) *Syncer {
+	s := &Syncer{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		token:      token,
+		workspaces: workspaces,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		interval:   defaultInterval,
+		maxSize:    defaultMaxSize,
+		synced:     make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Restore downloads saved contexts of this gateway's workspaces that are
+// missing locally and returns how many it wrote. Local files are never
+// replaced; they are at least as new as what this VM uploaded.
+func (s *Syncer) Restore(ctx context.Context) (int, error) {
+	var list listResponse
+	if err := s.get(ctx, s.endpoint, &list); err != nil {
+		return 0, fmt.Errorf("list contexts: %w", err)
+	}
+
+	restored := 0
+	for _, snap := range list.Snapshots {
+		ws, ok := s.workspace(snap.Workspace)
+		if !ok || !validSessionID(snap.SessionID) {
+			continue
+		}
+		path := filepath.Join(ws.Dir, snap.SessionID+".json")
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		var full Snapshot
+		if err := s.get(ctx, s.contextURL(snap.Workspace, snap.SessionID), &full); err != nil {
+			return restored, fmt.Errorf("get context %s/%s: %w", snap.Workspace, snap.SessionID, err)
+		}
+		if err := writeContext(path, full.Data, full.UpdatedAt); err != nil {
+			return restored, err
+		}
+
+		s.markSynced(path, full.UpdatedAt)
+		restored++
+
+		log.Info().
+			Str("workspace", snap.Workspace).
+			Str("sessionID", snap.SessionID).
+			Msg("restored conversation context from control plane")
+	}
+	return restored, nil
+}
+
+// Run uploads changed contexts every interval until ctx is done, then makes
+// a last attempt, so contexts saved at shutdown are not lost
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			pushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.logPush(s.Push(pushCtx))
+			cancel()
+			return
+		case <-ticker.C:
+		}
+		s.logPush(s.Push(ctx))
+	}
+}
+
+func (s *Syncer) logPush(err error) {
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to sync conversation contexts, will retry")
+	}
+}
+
+// Push uploads every context file modified since it was last synced. Files
+// that fail are retried on the next push.
+func (s *Syncer) Push(ctx context.Context) error {
+	var firstErr error
+	for _, ws := range s.workspaces {
+		files, err := filepath.Glob(filepath.Join(ws.Dir, "*.json"))
+		if err != nil {
+			continue
+		}
+		for _, path := range files {
+			if err := s.pushFile(ctx, ws, path); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (s *Syncer) pushFile(ctx context.Context, ws Workspace, path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	s.mu.Lock()
+	last, ok := s.synced[path]
+	s.mu.Unlock()
+	if ok && info.ModTime().Equal(last) {
+		return nil
+	}
+
+	sessionID := strings.TrimSuffix(filepath.Base(path), ".json")
+	if info.Size() > s.maxSize {
+		// Marked synced so the warning is not repeated until it changes
+		log.Warn().
+			Str("workspace", ws.Name).
+			Str("sessionID", sessionID).
+			Int64("size", info.Size()).
+			Msg("conversation context too large to sync")
+		s.markSynced(path, info.ModTime())
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		// Caught mid-write; the next push sees the finished file
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.contextURL(ws.Name, sessionID), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.do(req, nil); err != nil {
+		return fmt.Errorf("upload context %s/%s: %w", ws.Name, sessionID, err)
+	}
+
+	s.markSynced(path, info.ModTime())
+	return nil
+}
+
+func (s *Syncer) markSynced(path string, modTime time.Time) {
+	s.mu.Lock()
+	s.synced[path] = modTime
+	s.mu.Unlock()
+}
+
+func (s *Syncer) workspace(name string) (Workspace, bool) {
+	for _, ws := range s.workspaces {
+		if ws.Name == name {
+			return ws, true
+		}
+	}
+	return Workspace{}, false
+}
+
+func (s *Syncer) contextURL(workspace, sessionID string) string {
+	return s.endpoint + "/" + url.PathEscape(workspace) + "/" + url.PathEscape(sessionID)
+}
+
+func (s *Syncer) get(ctx context.Context, rawURL string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, into)
+}
+
+// do sends req with the ingest token and decodes a JSON response into into,
+// if not nil
+func (s *Syncer) do(req *http.Request, into interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return fmt.Errorf("control plane answered %s", resp.Status)
+	}
+	if into == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// writeContext writes a restored context with its saved time as the
+// modification time, so the newest session is still the one resumed
+func writeContext(path string, data []byte, updatedAt time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create context directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write context: %w", err)
+	}
+	if !updatedAt.IsZero() {
+		os.Chtimes(tmp, updatedAt, updatedAt)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write context: %w", err)
+	}
+	return nil
+}
+
+// validSessionID rejects IDs that would not name a file in the context
+// directory
+func validSessionID(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && filepath.Base(id) == id && !strings.ContainsAny(id, `/\`)
+}
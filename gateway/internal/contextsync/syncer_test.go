@@ -0,0 +1,162 @@
+package contextsync
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// contextServer stands in for the control plane's contexts endpoint
+type contextServer struct {
+	mu        sync.Mutex
+	snapshots map[string]Snapshot // by workspace/session
+	puts      int
+	tokens    []string
+}
+
+func newContextServer() *contextServer {
+	return &contextServer{snapshots: make(map[string]Snapshot)}
+}
+
+func (s *contextServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/contexts"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		var list listResponse
+		for _, snap := range s.snapshots {
+			snap.Data = nil
+			list.Snapshots = append(list.Snapshots, snap)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodGet:
+		snap, ok := s.snapshots[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(snap)
+	case r.Method == http.MethodPut:
+		workspace, session, _ := strings.Cut(key, "/")
+		data, _ := io.ReadAll(r.Body)
+		s.snapshots[key] = Snapshot{Workspace: workspace, SessionID: session, Size: int64(len(data)), UpdatedAt: time.Now(), Data: data}
+		s.puts++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPushUploadsChangedContexts(t *testing.T) {
+	server := newContextServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aider-1.json")
+	if err := os.WriteFile(path, []byte(`{"session_id":"aider-1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := New(srv.URL+"/contexts", "token-1", []Workspace{{Name: "default", Dir: dir}})
+	for i := 0; i < 2; i++ {
+		if err := syncer.Push(context.Background()); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+
+	if server.puts != 1 {
+		t.Fatalf("expected an unchanged context to be uploaded once, got %d uploads", server.puts)
+	}
+	if got := string(server.snapshots["default/aider-1"].Data); got != `{"session_id":"aider-1"}` {
+		t.Errorf("unexpected upload %q", got)
+	}
+	if server.tokens[0] != "Bearer token-1" {
+		t.Errorf("expected the ingest token, got %q", server.tokens[0])
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(path, []byte(`{"session_id":"aider-1","messages":[]}`), 0644)
+	os.Chtimes(path, later, later)
+	if err := syncer.Push(context.Background()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if server.puts != 2 {
+		t.Errorf("expected the changed context to be uploaded again, got %d uploads", server.puts)
+	}
+}
+
+func TestRestoreWritesMissingContexts(t *testing.T) {
+	server := newContextServer()
+	saved := time.Now().Add(-time.Hour).Truncate(time.Second)
+	server.snapshots["default/aider-1"] = Snapshot{Workspace: "default", SessionID: "aider-1", UpdatedAt: saved, Data: json.RawMessage(`{"session_id":"aider-1"}`)}
+	server.snapshots["default/aider-2"] = Snapshot{Workspace: "default", SessionID: "aider-2", UpdatedAt: saved, Data: json.RawMessage(`{"session_id":"remote"}`)}
+	server.snapshots["other/aider-3"] = Snapshot{Workspace: "other", SessionID: "aider-3", UpdatedAt: saved, Data: json.RawMessage(`{}`)}
+	server.snapshots["default/..bad"] = Snapshot{Workspace: "default", SessionID: "../bad", UpdatedAt: saved, Data: json.RawMessage(`{}`)}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	dir := filepath.Join(t.TempDir(), "contexts")
+	os.MkdirAll(dir, 0755)
+	if err := os.WriteFile(filepath.Join(dir, "aider-2.json"), []byte(`{"session_id":"local"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := New(srv.URL+"/contexts", "token-1", []Workspace{{Name: "default", Dir: dir}})
+	restored, err := syncer.Restore(context.Background())
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if restored != 1 {
+		t.Fatalf("expected 1 restored context, got %d", restored)
+	}
+
+	path := filepath.Join(dir, "aider-1.json")
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != `{"session_id":"aider-1"}` {
+		t.Fatalf("unexpected restored file %q: %v", data, err)
+	}
+	if info, _ := os.Stat(path); !info.ModTime().Equal(saved) {
+		t.Errorf("expected the saved time %v as modification time, got %v", saved, info.ModTime())
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "aider-2.json")); string(data) != `{"session_id":"local"}` {
+		t.Errorf("expected the local context to be kept, got %q", data)
+	}
+
+	// A restored context is not uploaded straight back
+	if err := syncer.Push(context.Background()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if server.puts != 1 {
+		t.Errorf("expected only the local context to be uploaded, got %d uploads", server.puts)
+	}
+}
+
+func TestPushSkipsOversizedContexts(t *testing.T) {
+	server := newContextServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "big.json"), []byte(`{"padding":"`+strings.Repeat("x", 100)+`"}`), 0644)
+
+	syncer := New(srv.URL+"/contexts", "token-1", []Workspace{{Name: "default", Dir: dir}}, WithMaxSize(64))
+	if err := syncer.Push(context.Background()); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if server.puts != 0 {
+		t.Errorf("expected the oversized context to be skipped, got %d uploads", server.puts)
+	}
+}
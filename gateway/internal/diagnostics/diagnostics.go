@@ -0,0 +1,337 @@
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+const (
+	defaultMaxAge       = 5 * time.Minute
+	defaultCheckTimeout = 10 * time.Second
+)
+
+// Provider is an AI provider whose API key can be checked with a cheap,
+// read-only request
+type Provider struct {
+	Name   string
+	EnvVar string
+
+	// NewRequest builds the request; a 2xx response means the key works
+	NewRequest func(ctx context.Context, key string) (*http.Request, error)
+}
+
+// DefaultProviders lists the providers aider is configured for, in the order
+// the chat factory prefers them
+var DefaultProviders = []Provider{
+	{
+		Name:   "openrouter",
+		EnvVar: "OPENROUTER_API_KEY",
+		NewRequest: func(ctx context.Context, key string) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://openrouter.ai/api/v1/auth/key", nil)
+			if err == nil {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			return req, err
+		},
+	},
+	{
+		Name:   "anthropic",
+		EnvVar: "ANTHROPIC_API_KEY",
+		NewRequest: func(ctx context.Context, key string) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.anthropic.com/v1/models?limit=1", nil)
+			if err == nil {
+				req.Header.Set("x-api-key", key)
+				req.Header.Set("anthropic-version", "2023-06-01")
+			}
+			return req, err
+		},
+	},
+	{
+		Name:   "openai",
+		EnvVar: "OPENAI_API_KEY",
+		NewRequest: func(ctx context.Context, key string) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.openai.com/v1/models", nil)
+			if err == nil {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			return req, err
+		},
+	},
+	{
+		Name:   "google",
+		EnvVar: "GOOGLE_API_KEY",
+		NewRequest: func(ctx context.Context, key string) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://generativelanguage.googleapis.com/v1beta/models?pageSize=1", nil)
+			if err == nil {
+				req.Header.Set("x-goog-api-key", key)
+			}
+			return req, err
+		},
+	},
+}
+
+// Checker checks that the gateway's environment can serve chat, so problems
+// like "chat returns nothing" can be diagnosed from the client. Results are
+// cached, since the API key check costs a request to the provider.
+type Checker struct {
+	workDir   string
+	mock      bool
+	client    *http.Client
+	providers []Provider
+	maxAge    time.Duration
+	timeout   time.Duration
+	lookPath  func(file string) (string, error)
+	getenv    func(key string) string
+
+	// runMu serializes runs; Report callers that waited on one get its
+	// results
+	runMu  sync.Mutex
+	mu     sync.RWMutex
+	latest *protocol.Diagnostics
+}
+
+// Option configures a Checker
+type Option func(*Checker)
+
+// WithMock reports that chat uses the mock backend, so a missing aider or
+// API key is expected
+func WithMock(mock bool) Option {
+	return func(c *Checker) { c.mock = mock }
+}
+
+// WithHTTPClient sets the client for API key checks
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Checker) { c.client = client }
+}
+
+// WithProviders replaces DefaultProviders
+func WithProviders(providers []Provider) Option {
+	return func(c *Checker) { c.providers = providers }
+}
+
+// WithMaxAge sets how long Report reuses a previous run
+func WithMaxAge(d time.Duration) Option {
+	return func(c *Checker) { c.maxAge = d }
+}
+
+// New creates a Checker for the workspace at workDir
+func New(workDir string, opts ...Option) *Checker {
+	c := &Checker{
+		workDir:   workDir,
+		client:    &http.Client{Timeout: defaultCheckTimeout},
+		providers: DefaultProviders,
+		maxAge:    defaultMaxAge,
+		timeout:   defaultCheckTimeout,
+		lookPath:  exec.LookPath,
+		getenv:    os.Getenv,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Latest returns the most recent results without running the checks
+func (c *Checker) Latest() (protocol.Diagnostics, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.latest == nil {
+		return protocol.Diagnostics{}, false
+	}
+	return *c.latest, true
+}
+
+// Report returns the latest results, running the checks again if they are
+// older than the maximum age
+func (c *Checker) Report(ctx context.Context) protocol.Diagnostics {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	if latest, ok := c.Latest(); ok && time.Since(latest.CheckedAt) < c.maxAge {
+		return latest
+	}
+	return c.run(ctx)
+}
+
+// Run runs every check now
+func (c *Checker) Run(ctx context.Context) protocol.Diagnostics {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	return c.run(ctx)
+}
+
+func (c *Checker) run(ctx context.Context) protocol.Diagnostics {
+	checks := []struct {
+		name string
+		fn   func(ctx context.Context) (status, detail string)
+	}{
+		{"aider", c.checkAider},
+		{"api_key", c.checkAPIKey},
+		{"git", c.checkGit},
+		{"workspace", c.checkWorkspace},
+	}
+
+	report := protocol.Diagnostics{
+		Status:    protocol.DiagnosticOK,
+		Checks:    make([]protocol.DiagnosticCheck, len(checks)),
+		CheckedAt: time.Now(),
+	}
+
+	// The checks are independent and mostly wait on subprocesses or the
+	// network, so run them side by side
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, name string, fn func(ctx context.Context) (string, string)) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			status, detail := fn(checkCtx)
+			report.Checks[i] = protocol.DiagnosticCheck{
+				Name:       name,
+				Status:     status,
+				Detail:     detail,
+				DurationMs: time.Since(start).Milliseconds(),
+			}
+		}(i, check.name, check.fn)
+	}
+	wg.Wait()
+
+	for _, check := range report.Checks {
+		report.Status = worse(report.Status, check.Status)
+	}
+
+	c.mu.Lock()
+	c.latest = &report
+	c.mu.Unlock()
+	return report
+}
+
+func (c *Checker) checkAider(ctx context.Context) (string, string) {
+	path, err := c.lookPath("aider")
+	if err != nil {
+		if c.mock {
+			return protocol.DiagnosticOK, "not installed, chat uses the mock backend"
+		}
+		return protocol.DiagnosticFail, "aider not found on PATH; install it with: pip install aider-chat"
+	}
+
+	version, err := commandOutput(ctx, path, "--version")
+	if err != nil {
+		return protocol.DiagnosticWarn, fmt.Sprintf("%s is installed but --version failed: %v", path, err)
+	}
+	return protocol.DiagnosticOK, fmt.Sprintf("%s at %s", version, path)
+}
+
+func (c *Checker) checkAPIKey(ctx context.Context) (string, string) {
+	// The first configured provider is the one the chat factory uses
+	for _, provider := range c.providers {
+		if key := c.getenv(provider.EnvVar); key != "" {
+			return c.verifyKey(ctx, provider, key)
+		}
+	}
+
+	if c.mock {
+		return protocol.DiagnosticOK, "no API key, chat uses the mock backend"
+	}
+	names := make([]string, len(c.providers))
+	for i, provider := range c.providers {
+		names[i] = provider.EnvVar
+	}
+	return protocol.DiagnosticFail, "no API key found; set one of " + strings.Join(names, ", ")
+}
+
+func (c *Checker) verifyKey(ctx context.Context, provider Provider, key string) (string, string) {
+	req, err := provider.NewRequest(ctx, key)
+	if err != nil {
+		return protocol.DiagnosticWarn, fmt.Sprintf("%s: could not build request: %v", provider.Name, err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return protocol.DiagnosticWarn, fmt.Sprintf("%s: could not reach the API: %v", provider.Name, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return protocol.DiagnosticOK, fmt.Sprintf("%s key accepted", provider.Name)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return protocol.DiagnosticFail, fmt.Sprintf("%s rejected %s (HTTP %d)", provider.Name, provider.EnvVar, resp.StatusCode)
+	default:
+		return protocol.DiagnosticWarn, fmt.Sprintf("%s: could not verify key (HTTP %d)", provider.Name, resp.StatusCode)
+	}
+}
+
+func (c *Checker) checkGit(ctx context.Context) (string, string) {
+	path, err := c.lookPath("git")
+	if err != nil {
+		return protocol.DiagnosticFail, "git not found on PATH"
+	}
+
+	version, err := commandOutput(ctx, path, "--version")
+	if err != nil {
+		return protocol.DiagnosticWarn, fmt.Sprintf("%s is installed but --version failed: %v", path, err)
+	}
+	return protocol.DiagnosticOK, version
+}
+
+func (c *Checker) checkWorkspace(ctx context.Context) (string, string) {
+	info, err := os.Stat(c.workDir)
+	if err != nil {
+		return protocol.DiagnosticFail, err.Error()
+	}
+	if !info.IsDir() {
+		return protocol.DiagnosticFail, c.workDir + " is not a directory"
+	}
+
+	f, err := os.CreateTemp(c.workDir, ".devtail-check-*")
+	if err != nil {
+		return protocol.DiagnosticFail, fmt.Sprintf("%s is not writable: %v", c.workDir, err)
+	}
+	name := f.Name()
+	_, writeErr := f.Write([]byte("ok"))
+	closeErr := f.Close()
+	os.Remove(name)
+	if writeErr != nil {
+		return protocol.DiagnosticFail, fmt.Sprintf("write to %s: %v", c.workDir, writeErr)
+	}
+	if closeErr != nil {
+		return protocol.DiagnosticFail, fmt.Sprintf("write to %s: %v", c.workDir, closeErr)
+	}
+	return protocol.DiagnosticOK, c.workDir + " is writable"
+}
+
+// commandOutput runs a command and returns the first line of its output
+func commandOutput(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return line, nil
+}
+
+// worse returns the more severe of two statuses
+func worse(a, b string) string {
+	rank := map[string]int{protocol.DiagnosticOK: 0, protocol.DiagnosticWarn: 1, protocol.DiagnosticFail: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,127 @@
+package diagnostics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// newTestChecker checks a fake environment: tools resolve to /bin/echo,
+// which prints its arguments for --version, and the provider is a test
+// server accepting the key "good"
+func newTestChecker(t *testing.T, env map[string]string, opts ...Option) *Checker {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+
+	provider := Provider{
+		Name:   "test",
+		EnvVar: "TEST_API_KEY",
+		NewRequest: func(ctx context.Context, key string) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if err == nil {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			return req, err
+		},
+	}
+
+	c := New(t.TempDir(), append([]Option{WithProviders([]Provider{provider})}, opts...)...)
+	c.lookPath = func(file string) (string, error) { return "/bin/echo", nil }
+	c.getenv = func(key string) string { return env[key] }
+	return c
+}
+
+func checkByName(t *testing.T, report protocol.Diagnostics, name string) protocol.DiagnosticCheck {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("no %s check in %+v", name, report)
+	return protocol.DiagnosticCheck{}
+}
+
+func TestRunReportsHealthyEnvironment(t *testing.T) {
+	if _, err := os.Stat("/bin/echo"); err != nil {
+		t.Skip("/bin/echo not available")
+	}
+	c := newTestChecker(t, map[string]string{"TEST_API_KEY": "good"})
+
+	report := c.Run(context.Background())
+	if report.Status != protocol.DiagnosticOK {
+		t.Fatalf("expected ok, got %+v", report)
+	}
+	if len(report.Checks) != 4 {
+		t.Fatalf("expected 4 checks, got %+v", report.Checks)
+	}
+	if latest, ok := c.Latest(); !ok || !latest.CheckedAt.Equal(report.CheckedAt) {
+		t.Fatal("Latest does not return the last run")
+	}
+}
+
+func TestRunReportsProblems(t *testing.T) {
+	if _, err := os.Stat("/bin/echo"); err != nil {
+		t.Skip("/bin/echo not available")
+	}
+
+	c := newTestChecker(t, map[string]string{"TEST_API_KEY": "revoked"})
+	report := c.Run(context.Background())
+	if report.Status != protocol.DiagnosticFail || checkByName(t, report, "api_key").Status != protocol.DiagnosticFail {
+		t.Fatalf("expected a rejected key to fail, got %+v", report)
+	}
+
+	c = newTestChecker(t, nil)
+	c.lookPath = func(file string) (string, error) { return "", errors.New("not found") }
+	c.workDir = filepath.Join(c.workDir, "missing")
+	report = c.Run(context.Background())
+	for _, name := range []string{"aider", "api_key", "git", "workspace"} {
+		if check := checkByName(t, report, name); check.Status != protocol.DiagnosticFail || check.Detail == "" {
+			t.Errorf("expected %s to fail with a reason, got %+v", name, check)
+		}
+	}
+}
+
+func TestMockModeExpectsNoAider(t *testing.T) {
+	c := newTestChecker(t, nil, WithMock(true))
+	c.lookPath = func(file string) (string, error) {
+		if file == "aider" {
+			return "", errors.New("not found")
+		}
+		return "/bin/echo", nil
+	}
+
+	report := c.Run(context.Background())
+	for _, name := range []string{"aider", "api_key"} {
+		if check := checkByName(t, report, name); check.Status != protocol.DiagnosticOK {
+			t.Errorf("mock mode: expected %s ok, got %+v", name, check)
+		}
+	}
+}
+
+func TestReportReusesRecentResults(t *testing.T) {
+	c := newTestChecker(t, nil, WithMaxAge(time.Hour))
+
+	first := c.Report(context.Background())
+	if second := c.Report(context.Background()); !second.CheckedAt.Equal(first.CheckedAt) {
+		t.Fatal("Report ran the checks again within the max age")
+	}
+	if third := c.Run(context.Background()); third.CheckedAt.Equal(first.CheckedAt) {
+		t.Fatal("Run reused cached results")
+	}
+}
@@ -0,0 +1,184 @@
+// Package guard decides whether a shell command may run: commands on the
+// denylist never do, commands the policy wants confirmed wait for the user,
+// and the allowlist exempts commands from confirmation. It only classifies
+// commands; the gateway applies the verdict where the command is entered.
+package guard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Action is what happens to a command
+type Action string
+
+const (
+	Allow   Action = "allow"
+	Confirm Action = "confirm"
+	Deny    Action = "deny"
+)
+
+// Defaults are the commands confirmed unless a policy replaces them:
+// recursive forced deletes, force pushes, scripts piped from the network
+// into a shell, and writes to block devices
+var Defaults = []Rule{
+	{Pattern: `\brm\b[^;&|]*\s-[a-zA-Z]*(?:[rR][a-zA-Z]*f|f[a-zA-Z]*[rR])` +
+		`|\brm\b[^;&|]*\s(?:-[rR]|--recursive)\b[^;&|]*\s(?:-f|--force)\b` +
+		`|\brm\b[^;&|]*\s(?:-f|--force)\b[^;&|]*\s(?:-[rR]|--recursive)\b`,
+		Reason: "deletes files recursively without asking"},
+	{Pattern: `\bgit\s+(?:-[Cc]\s+\S+\s+|-\S+\s+)*push\b[^;&|]*\s(?:--force(?:-with-lease)?\b|-[a-zA-Z]*f\b|\+\S)`,
+		Reason: "overwrites the remote branch's history"},
+	{Pattern: `\b(?:curl|wget)\b[^;&]*\|\s*(?:sudo\s+)?(?:ba|da|k|z)?sh\b` +
+		`|\b(?:ba|da|k|z)?sh\s[^;&|]*[<$]\(\s*(?:curl|wget)\b`,
+		Reason: "runs a script downloaded from the network"},
+	{Pattern: `\bmkfs\b|\bdd\s[^;&|]*\bof=/dev/`,
+		Reason: "overwrites a disk"},
+	{Pattern: `:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`,
+		Reason: "fork bomb"},
+}
+
+// Rule matches commands with a regular expression
+type Rule struct {
+	Pattern string `json:"pattern"`
+	Reason  string `json:"reason,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Verdict is the policy's decision on a command and the rule behind it
+type Verdict struct {
+	Action Action
+	Rule   string
+	Reason string
+}
+
+// Policy holds the rules commands are checked against. The zero value
+// allows everything.
+type Policy struct {
+	Deny    []Rule `json:"deny,omitempty"`
+	Allow   []Rule `json:"allow,omitempty"`
+	Confirm []Rule `json:"confirm,omitempty"`
+
+	// ReplaceDefaults leaves Defaults out when the policy is loaded
+	ReplaceDefaults bool `json:"replace_defaults,omitempty"`
+}
+
+// Default returns a policy confirming the Defaults
+func Default() *Policy {
+	p := &Policy{Confirm: append([]Rule(nil), Defaults...)}
+	if err := p.compile(); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Load reads a policy from a JSON file. Defaults are added to its confirm
+// rules unless it replaces them.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if !p.ReplaceDefaults {
+		p.Confirm = append(p.Confirm, Defaults...)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func (p *Policy) compile() error {
+	for _, rules := range [][]Rule{p.Deny, p.Allow, p.Confirm} {
+		for i := range rules {
+			re, err := regexp.Compile(rules[i].Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", rules[i].Pattern, err)
+			}
+			rules[i].re = re
+		}
+	}
+	return nil
+}
+
+// Check decides on command. The denylist wins over everything, and the
+// allowlist over confirmation, but only if it allows every command on the
+// line: `npm test && rm -rf /` is confirmed even if npm test is allowed.
+func (p *Policy) Check(command string) Verdict {
+	if rule, ok := match(p.Deny, command); ok {
+		return Verdict{Action: Deny, Rule: rule.Pattern, Reason: rule.Reason}
+	}
+	rule, ok := match(p.Confirm, command)
+	if !ok || p.allows(command) {
+		return Verdict{Action: Allow}
+	}
+	return Verdict{Action: Confirm, Rule: rule.Pattern, Reason: rule.Reason}
+}
+
+// CheckUnknown decides on a command line whose text could not be read, as
+// when it was recalled from the shell's history. Any line might run what
+// the policy denies or confirms, so it is confirmed unless there is none.
+func (p *Policy) CheckUnknown() Verdict {
+	if len(p.Deny) == 0 && len(p.Confirm) == 0 {
+		return Verdict{Action: Allow}
+	}
+	return Verdict{Action: Confirm, Reason: "the command could not be read, as when it is recalled from history or edited with the cursor keys"}
+}
+
+// allows reports whether an allow rule matches each command on the line
+func (p *Policy) allows(line string) bool {
+	commands := split(line)
+	if len(p.Allow) == 0 || len(commands) == 0 {
+		return false
+	}
+	for _, command := range commands {
+		if _, ok := match(p.Allow, command); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// split breaks a command line into the commands it runs: at ; & | and
+// newlines, and at the parentheses and backquotes of subshells and command
+// substitutions, but not at redirections such as 2>&1. Quoting is not
+// understood, so a separator inside quotes splits the line too, which can
+// only cost a command its exemption.
+func split(line string) []string {
+	var commands []string
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) {
+			switch line[i] {
+			case '&':
+				if i > 0 && (line[i-1] == '>' || line[i-1] == '<') || i+1 < len(line) && line[i+1] == '>' {
+					continue
+				}
+			case ';', '|', '\n', '(', ')', '`':
+			default:
+				continue
+			}
+		}
+		if command := strings.TrimSpace(line[start:i]); command != "" {
+			commands = append(commands, command)
+		}
+		start = i + 1
+	}
+	return commands
+}
+
+func match(rules []Rule, command string) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.re != nil && rule.re.MatchString(command) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
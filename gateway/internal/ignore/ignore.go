@@ -0,0 +1,267 @@
+// Package ignore matches paths against .gitignore style rules, so generated
+// artifacts stay out of file events and the assistant's context.
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Files are the ignore files read from each directory, in order; later
+// files override earlier ones
+var Files = []string{".gitignore", ".devtailignore"}
+
+// Defaults apply before any ignore file: hidden files, dependency and build
+// directories, editor backups and logs. Ignore files can re-include them
+// with "!" patterns.
+var Defaults = []string{
+	".*",
+	"!.env",
+	"!.gitignore",
+	"!.devtailignore",
+	"node_modules/", "vendor/", "Godeps/",
+	"build/", "dist/", "target/", "bin/", "obj/",
+	"coverage/", "__pycache__/",
+	"*~", "#*", "*.tmp", "*.temp", "*.swp", "*.swo",
+	"*.log",
+}
+
+// Matcher holds the rules for one directory tree. Rules from an ignore file
+// apply to paths below the directory holding it, after those of its parents.
+type Matcher struct {
+	root     string
+	defaults []string
+
+	mu    sync.RWMutex
+	rules map[string][]rule // by directory relative to root, "" for root
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Option configures a Matcher
+type Option func(*Matcher)
+
+// WithDefaults replaces Defaults, the rules applied before any ignore file
+func WithDefaults(patterns []string) Option {
+	return func(m *Matcher) { m.defaults = patterns }
+}
+
+// New creates a Matcher for the tree at root with Defaults and root's ignore
+// files loaded. Ignore files in subdirectories are loaded with LoadDir.
+func New(root string, opts ...Option) *Matcher {
+	m := &Matcher{root: root, defaults: Defaults, rules: make(map[string][]rule)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.LoadDir(root)
+	return m
+}
+
+// LoadDir reads the ignore files in dir, replacing rules read from it
+// before. Missing files are not an error.
+func (m *Matcher) LoadDir(dir string) error {
+	rel, ok := m.rel(dir)
+	if !ok {
+		return nil
+	}
+
+	var rules []rule
+	if rel == "" {
+		rules = parse(m.defaults)
+	}
+	for _, name := range Files {
+		lines, err := readLines(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		rules = append(rules, parse(lines)...)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(rules) == 0 {
+		delete(m.rules, rel)
+	} else {
+		m.rules[rel] = rules
+	}
+	return nil
+}
+
+// Match reports whether path, absolute or relative to the root, is ignored.
+// A path is ignored if it or any directory above it is.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	rel, ok := m.rel(path)
+	if !ok || rel == "" {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Git does not look inside ignored directories, so nothing below one
+	// can be re-included
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchLocked(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matchLocked(rel, isDir)
+}
+
+// matchLocked applies the rules of every directory above rel, the last
+// matching rule deciding
+func (m *Matcher) matchLocked(rel string, isDir bool) bool {
+	ignored := false
+	base := ""
+	for {
+		sub := strings.TrimPrefix(rel, base)
+		sub = strings.TrimPrefix(sub, "/")
+		for _, r := range m.rules[base] {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.re.MatchString(sub) {
+				ignored = !r.negate
+			}
+		}
+
+		next := strings.IndexByte(sub, '/')
+		if next < 0 {
+			return ignored
+		}
+		if base == "" {
+			base = sub[:next]
+		} else {
+			base = base + "/" + sub[:next]
+		}
+	}
+}
+
+// rel returns path relative to the root with forward slashes, or false if
+// it lies outside
+func (m *Matcher) rel(path string) (string, bool) {
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(m.root, path)
+		if err != nil {
+			return "", false
+		}
+		path = rel
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." {
+		return "", true
+	}
+	if path == ".." || strings.HasPrefix(path, "../") {
+		return "", false
+	}
+	return path, true
+}
+
+// parse compiles gitignore patterns. Blank lines and comments are skipped,
+// as are patterns that do not compile.
+func parse(lines []string) []rule {
+	var rules []rule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var r rule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// \# and \! match a literal leading # or !
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// A slash anywhere but the end anchors the pattern to the
+		// directory of the ignore file; otherwise it matches at any depth
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		expr := globToRegexp(line)
+		if !anchored {
+			expr = "(?:.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// globToRegexp translates a gitignore glob, including **, to a regular
+// expression over slash-separated paths
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
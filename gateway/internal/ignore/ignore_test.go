@@ -0,0 +1,101 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "web", "src"), 0755)
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte(`
+# generated code
+*.pb.go
+/out
+docs/**/*.html
+gen/
+!keep.log
+\#notes
+`), 0644)
+	os.WriteFile(filepath.Join(root, ".devtailignore"), []byte("!dist/\nfixtures/large/\n"), 0644)
+	os.WriteFile(filepath.Join(root, "web", ".gitignore"), []byte("*.css\n!src/app.css\n/cache\n"), 0644)
+
+	m := New(root)
+	m.LoadDir(filepath.Join(root, "web"))
+
+	for _, tc := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"main.go", false, false},
+		{"api/v1/api.pb.go", false, true},
+		{"out", true, true},
+		{"cmd/out", true, false},
+		{"docs/guide/index.html", false, true},
+		{"docs/index.html", false, true},
+		{"docs/index.md", false, false},
+		{"gen", true, true},
+		{"gen", false, false},
+		{"gen/types.go", false, true},
+		{"server.log", false, true},
+		{"keep.log", false, false},
+		{"#notes", false, true},
+		{"node_modules/react/index.js", false, true},
+		{".git/HEAD", false, true},
+		{".env", false, false},
+		{"dist", true, false},
+		{"fixtures/large/blob.bin", false, true},
+		{"web/site.css", false, true},
+		{"web/src/app.css", false, false},
+		{"web/cache", false, true},
+		{"web/src/cache", false, false},
+		{"site.css", false, false},
+		{filepath.Join(root, "api.pb.go"), false, true},
+		{"../elsewhere.pb.go", false, false},
+	} {
+		if got := m.Match(tc.path, tc.isDir); got != tc.ignored {
+			t.Errorf("Match(%q, dir=%v) = %v, want %v", tc.path, tc.isDir, got, tc.ignored)
+		}
+	}
+}
+
+func TestLoadDirReplacesRules(t *testing.T) {
+	root := t.TempDir()
+	m := New(root)
+	if m.Match("secret.txt", false) {
+		t.Fatal("ignored before any rule")
+	}
+
+	os.WriteFile(filepath.Join(root, ".devtailignore"), []byte("secret.txt\n"), 0644)
+	m.LoadDir(root)
+	if !m.Match("secret.txt", false) {
+		t.Fatal("rule not picked up")
+	}
+
+	os.Remove(filepath.Join(root, ".devtailignore"))
+	m.LoadDir(root)
+	if m.Match("secret.txt", false) {
+		t.Fatal("removed rule still applies")
+	}
+	if !m.Match("node_modules", true) {
+		t.Fatal("defaults lost on reload")
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+
+	m := New(root, WithDefaults([]string{"node_modules/"}))
+	if !m.Match(filepath.Join(root, "web", "node_modules"), true) {
+		t.Error("expected the replacement default to apply")
+	}
+	if !m.Match(filepath.Join(root, "build.log"), false) {
+		t.Error("expected ignore files to apply on top of the defaults")
+	}
+	if m.Match(filepath.Join(root, ".git"), true) {
+		t.Error("expected the package defaults to be replaced")
+	}
+}
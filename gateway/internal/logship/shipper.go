@@ -0,0 +1,308 @@
+package logship
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultInterval   = 5 * time.Second
+	defaultBatchSize  = 200
+	defaultMaxPending = 5000
+
+	kindLog   = "log"
+	kindPanic = "panic"
+)
+
+// Entry is one log line or panic report, in the shape the control plane's
+// ingest endpoint accepts
+type Entry struct {
+	Kind    string          `json:"kind"`
+	Level   string          `json:"level"`
+	Message string          `json:"message"`
+	Fields  json.RawMessage `json:"fields,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+type ingestRequest struct {
+	Entries []Entry `json:"entries"`
+}
+
+// Shipper sends the gateway's structured logs to the control plane, which
+// keeps them per VM, so they outlive the VM and can be read without logging
+// in to it. It is an io.Writer for zerolog: lines are queued and sent in
+// batches, and the oldest are dropped if the control plane is unreachable
+// for long enough to fill the queue.
+type Shipper struct {
+	endpoint string
+	token    string
+	client   *http.Client
+
+	interval   time.Duration
+	batchSize  int
+	maxPending int
+
+	mu      sync.Mutex
+	pending []Entry
+	dropped int
+	failing bool
+
+	// sendMu serializes sends, so batches arrive in order
+	sendMu sync.Mutex
+	kick   chan struct{}
+
+	// local reports shipping failures on stderr; logging them through the
+	// shipped logger would queue more lines for the endpoint that is failing
+	local zerolog.Logger
+}
+
+// Option configures a Shipper
+type Option func(*Shipper)
+
+// WithInterval sets how often queued lines are sent
+func WithInterval(d time.Duration) Option {
+	return func(s *Shipper) { s.interval = d }
+}
+
+// WithBatchSize sets how many lines are sent per request; a full batch is
+// sent without waiting for the interval
+func WithBatchSize(n int) Option {
+	return func(s *Shipper) { s.batchSize = n }
+}
+
+// WithMaxPending caps the lines queued while the control plane is unreachable
+func WithMaxPending(n int) Option {
+	return func(s *Shipper) { s.maxPending = n }
+}
+
+// WithHTTPClient replaces the HTTP client used to reach the control plane
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Shipper) { s.client = client }
+}
+
+// New creates a shipper posting to endpoint with the VM's ingest token
+func New(endpoint, token string, opts ...Option) *Shipper {
+	s := &Shipper{
+		endpoint:   endpoint,
+		token:      token,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		interval:   defaultInterval,
+		batchSize:  defaultBatchSize,
+		maxPending: defaultMaxPending,
+		kick:       make(chan struct{}, 1),
+		local:      zerolog.New(os.Stderr).With().Timestamp().Str("component", "logship").Logger(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Write queues one zerolog JSON line. It never blocks on the network.
+func (s *Shipper) Write(p []byte) (int, error) {
+	entry, ok := parseLine(p)
+	if !ok {
+		return len(p), nil
+	}
+
+	s.mu.Lock()
+	s.enqueue(entry)
+	full := len(s.pending) >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// parseLine splits a zerolog line into the level and message and the
+// remaining fields. The time is taken when the line is written, which is
+// when zerolog stamped it.
+func parseLine(p []byte) (Entry, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return Entry{}, false
+	}
+
+	entry := Entry{Kind: kindLog, Time: time.Now()}
+	if raw, ok := fields[zerolog.LevelFieldName]; ok {
+		json.Unmarshal(raw, &entry.Level)
+		delete(fields, zerolog.LevelFieldName)
+	}
+	if raw, ok := fields[zerolog.MessageFieldName]; ok {
+		json.Unmarshal(raw, &entry.Message)
+		delete(fields, zerolog.MessageFieldName)
+	}
+	delete(fields, zerolog.TimestampFieldName)
+
+	if len(fields) > 0 {
+		entry.Fields, _ = json.Marshal(fields)
+	}
+	return entry, true
+}
+
+// enqueue adds an entry, dropping the oldest when the queue is full.
+// Callers hold mu.
+func (s *Shipper) enqueue(entries ...Entry) {
+	s.pending = append(s.pending, entries...)
+	if over := len(s.pending) - s.maxPending; over > 0 {
+		s.pending = s.pending[over:]
+		s.dropped += over
+	}
+}
+
+// Run sends queued lines every interval, or sooner when a batch fills,
+// until ctx is done. It then makes a last attempt to send what is queued.
+func (s *Shipper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			s.Flush(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		s.Flush(ctx)
+	}
+}
+
+// Flush sends everything queued. Lines that fail to send are requeued for
+// the next attempt.
+func (s *Shipper) Flush(ctx context.Context) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	for {
+		lines, dropped := s.take()
+		if len(lines) == 0 && dropped == 0 {
+			return nil
+		}
+
+		batch := lines
+		if dropped > 0 {
+			batch = append([]Entry{{
+				Kind:    kindLog,
+				Level:   zerolog.WarnLevel.String(),
+				Message: fmt.Sprintf("dropped %d log lines while the control plane was unreachable", dropped),
+				Time:    time.Now(),
+			}}, lines...)
+		}
+
+		if err := s.send(ctx, batch); err != nil {
+			s.mu.Lock()
+			s.dropped += dropped
+			s.pending = append(lines, s.pending...)
+			s.enqueue()
+			if !s.failing {
+				s.failing = true
+				s.local.Warn().Err(err).Str("endpoint", s.endpoint).Msg("log shipping failed, retrying")
+			}
+			s.mu.Unlock()
+			return err
+		}
+
+		s.mu.Lock()
+		if s.failing {
+			s.failing = false
+			s.local.Info().Str("endpoint", s.endpoint).Msg("log shipping recovered")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// take removes up to one batch from the queue, with the number of lines
+// dropped since the last batch
+func (s *Shipper) take() ([]Entry, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := s.dropped
+	s.dropped = 0
+
+	n := s.batchSize
+	if n > len(s.pending) {
+		n = len(s.pending)
+	}
+	lines := make([]Entry, n)
+	copy(lines, s.pending)
+	s.pending = s.pending[n:]
+	return lines, dropped
+}
+
+func (s *Shipper) send(ctx context.Context, entries []Entry) error {
+	body, err := json.Marshal(ingestRequest{Entries: entries})
+	if err != nil {
+		return fmt.Errorf("marshal logs: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send logs: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("send logs: control plane returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ReportPanic sends a panic report straight away, ahead of queued lines,
+// since the process may be about to exit
+func (s *Shipper) ReportPanic(value interface{}, stack []byte) {
+	fields, _ := json.Marshal(map[string]string{"stack": string(stack)})
+	report := Entry{
+		Kind:    kindPanic,
+		Level:   zerolog.PanicLevel.String(),
+		Message: fmt.Sprint(value),
+		Fields:  fields,
+		Time:    time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s.sendMu.Lock()
+	err := s.send(ctx, []Entry{report})
+	s.sendMu.Unlock()
+	if err != nil {
+		s.local.Error().Err(err).Msg("failed to report panic")
+	}
+	s.Flush(ctx)
+}
+
+// Recover reports a panic in the calling goroutine and panics again, so the
+// crash is not hidden. Use it as `defer shipper.Recover()`.
+func (s *Shipper) Recover() {
+	if v := recover(); v != nil {
+		s.ReportPanic(v, debug.Stack())
+		panic(v)
+	}
+}
@@ -0,0 +1,127 @@
+package logship
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+type ingestServer struct {
+	mu      sync.Mutex
+	fail    bool
+	entries []Entry
+	tokens  []string
+}
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req ingestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+	s.entries = append(s.entries, req.Entries...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestShipperSendsStructuredLines(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	shipper := New(srv.URL, "token-1")
+	logger := zerolog.New(shipper).With().Timestamp().Logger()
+	logger.Warn().Str("terminal", "t-1").Msg("terminal exited")
+
+	if err := shipper.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(ingest.entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(ingest.entries))
+	}
+	entry := ingest.entries[0]
+	if entry.Kind != kindLog || entry.Level != "warn" || entry.Message != "terminal exited" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if string(entry.Fields) != `{"terminal":"t-1"}` {
+		t.Errorf("expected only the extra fields, got %s", entry.Fields)
+	}
+	if ingest.tokens[0] != "Bearer token-1" {
+		t.Errorf("expected bearer token, got %q", ingest.tokens[0])
+	}
+}
+
+func TestShipperRetriesAndReportsDrops(t *testing.T) {
+	ingest := &ingestServer{fail: true}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	shipper := New(srv.URL, "token-1", WithMaxPending(3))
+	logger := zerolog.New(shipper)
+	for i := 0; i < 5; i++ {
+		logger.Info().Int("n", i).Msg("line")
+	}
+
+	if err := shipper.Flush(context.Background()); err == nil {
+		t.Fatal("expected flush to fail while the control plane is down")
+	}
+
+	ingest.fail = false
+	if err := shipper.Flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(ingest.entries) != 4 {
+		t.Fatalf("expected a drop note and 3 lines, got %d entries", len(ingest.entries))
+	}
+	if !strings.Contains(ingest.entries[0].Message, "dropped 2") {
+		t.Errorf("expected drop note first, got %q", ingest.entries[0].Message)
+	}
+	if string(ingest.entries[1].Fields) != `{"n":2}` {
+		t.Errorf("expected the oldest lines to be dropped, got %s", ingest.entries[1].Fields)
+	}
+}
+
+func TestShipperRecoverReportsPanic(t *testing.T) {
+	ingest := &ingestServer{}
+	srv := httptest.NewServer(ingest)
+	defer srv.Close()
+
+	shipper := New(srv.URL, "token-1")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to propagate")
+			}
+		}()
+		defer shipper.Recover()
+		panic("boom")
+	}()
+
+	if len(ingest.entries) != 1 {
+		t.Fatalf("expected 1 panic report, got %d entries", len(ingest.entries))
+	}
+	report := ingest.entries[0]
+	if report.Kind != kindPanic || report.Message != "boom" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if !strings.Contains(string(report.Fields), "TestShipperRecoverReportsPanic") {
+		t.Errorf("expected stack trace in fields, got %s", report.Fields)
+	}
+}
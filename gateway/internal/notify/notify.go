@@ -0,0 +1,189 @@
+// Package notify tells the control plane about events the VM's owner should
+// hear of while no client is connected, such as an AI reply that finished
+// after they locked their phone, so it can push them a notification.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog"
+)
+
+// KindAITaskFinished is reported when an AI reply finishes with no client
+// connected
+const KindAITaskFinished = "ai_task_finished"
+
+const (
+	defaultAttempts   = 3
+	defaultRetryDelay = 2 * time.Second
+)
+
+// Event is one event, in the shape the control plane's ingest endpoint
+// accepts
+type Event struct {
+	Kind            string  `json:"kind"`
+	Workspace       string  `json:"workspace,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Notifier reports events to the control plane. Events are sent as they
+// happen, retried briefly, and dropped if the control plane stays
+// unreachable: a late notification is worth little.
+type Notifier struct {
+	endpoint  string
+	token     string
+	client    *http.Client
+	connected func() bool
+
+	attempts   int
+	retryDelay time.Duration
+	now        func() time.Time
+
+	// local reports failures on stderr, like the log shipper
+	local zerolog.Logger
+}
+
+// Option configures a Notifier
+type Option func(*Notifier)
+
+// WithHTTPClient replaces the HTTP client used to reach the control plane
+func WithHTTPClient(client *http.Client) Option {
+	return func(n *Notifier) { n.client = client }
+}
+
+// WithRetries sets how many times an event is sent before it is dropped,
+// and the delay between attempts
+func WithRetries(attempts int, delay time.Duration) Option {
+	return func(n *Notifier) { n.attempts, n.retryDelay = attempts, delay }
+}
+
+// withClock replaces time.Now in tests
+func withClock(now func() time.Time) Option {
+	return func(n *Notifier) { n.now = now }
+}
+
+// New creates a notifier posting to endpoint with the VM's ingest token.
+// connected reports whether any client is connected to the gateway.
+func New(endpoint, token string, connected func() bool, opts ...Option) *Notifier {
+	n := &Notifier{
+		endpoint:   endpoint,
+		token:      token,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		connected:  connected,
+		attempts:   defaultAttempts,
+		retryDelay: defaultRetryDelay,
+		now:        time.Now,
+		local:      zerolog.New(os.Stderr).With().Timestamp().Str("component", "notify").Logger(),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// Report sends event to the control plane, retrying while ctx allows
+func (n *Notifier) Report(ctx context.Context, event Event) error {
+	var err error
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		if err = n.send(ctx, event); err == nil {
+			return nil
+		}
+		if attempt == n.attempts {
+			break
+		}
+		select {
+		case <-time.After(n.retryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+	return err
+}
+
+func (n *Notifier) send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+n.token)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send event: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("send event: control plane returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Chat reports each reply h finishes while no client is connected
+func (n *Notifier) Chat(h ws.ChatHandler) ws.ChatHandler {
+	if n == nil {
+		return h
+	}
+	return &notifyingChat{ChatHandler: h, notifier: n}
+}
+
+type notifyingChat struct {
+	ws.ChatHandler
+	notifier *Notifier
+}
+
+func (c *notifyingChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies, err := c.ChatHandler.HandleChatMessage(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	started := c.notifier.now()
+	out := make(chan *protocol.ChatReply)
+	go func() {
+		finished := false
+		for reply := range replies {
+			if reply.Finished && reply.Error == nil {
+				finished = true
+			}
+			select {
+			case out <- reply:
+			case <-ctx.Done():
+				// The caller stopped reading; the reply may still finish
+			}
+		}
+		close(out)
+
+		if !finished || c.notifier.connected() {
+			return
+		}
+
+		event := Event{
+			Kind:            KindAITaskFinished,
+			Workspace:       msg.Workspace,
+			DurationSeconds: c.notifier.now().Sub(started).Seconds(),
+		}
+		reportCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := c.notifier.Report(reportCtx, event); err != nil {
+			c.notifier.local.Warn().Err(err).Str("endpoint", c.notifier.endpoint).Msg("failed to report finished AI task")
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+type eventServer struct {
+	mu     sync.Mutex
+	fail   int // requests to fail before succeeding
+	calls  int
+	events chan Event
+	tokens []string
+}
+
+func newEventServer(t *testing.T) (*eventServer, *httptest.Server) {
+	s := &eventServer{events: make(chan Event, 10)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func (s *eventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls <= s.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.tokens = append(s.tokens, r.Header.Get("Authorization"))
+	s.events <- event
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scriptedChat answers every message with the same replies
+type scriptedChat []*protocol.ChatReply
+
+func (c scriptedChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, len(c))
+	for _, reply := range c {
+		replies <- reply
+	}
+	close(replies)
+	return replies, nil
+}
+
+// steppingClock moves a step forward every time it is read
+func steppingClock(step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(step)
+		return now
+	}
+}
+
+func drain(t *testing.T, replies <-chan *protocol.ChatReply) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-replies:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("replies were never closed")
+		}
+	}
+}
+
+func TestReportsRepliesFinishedWhileAway(t *testing.T) {
+	server, srv := newEventServer(t)
+	n := New(srv.URL, "ingest-token", func() bool { return false }, withClock(steppingClock(90*time.Second)))
+	chat := n.Chat(scriptedChat{{Content: "done"}, {Finished: true}})
+
+	replies, err := chat.HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "refactor", Workspace: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(t, replies)
+
+	select {
+	case event := <-server.events:
+		want := Event{Kind: KindAITaskFinished, Workspace: "api", DurationSeconds: 90}
+		if event != want {
+			t.Fatalf("expected %+v, got %+v", want, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("finished reply was not reported")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.tokens[0] != "Bearer ingest-token" {
+		t.Fatalf("expected the ingest token, got %q", server.tokens[0])
+	}
+}
+
+func TestDoesNotReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+		replies   scriptedChat
+	}{
+		{"client connected", true, scriptedChat{{Content: "done"}, {Finished: true}}},
+		{"reply unfinished", false, scriptedChat{{Content: "partial"}}},
+		{"reply failed", false, scriptedChat{{Finished: true, Error: &protocol.ChatError{Error: "no API key"}}}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, srv := newEventServer(t)
+			n := New(srv.URL, "token", func() bool { return tt.connected })
+
+			replies, err := n.Chat(tt.replies).HandleChatMessage(context.Background(), &protocol.ChatMessage{Content: "hi"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			drain(t, replies)
+
+			select {
+			case event := <-server.events:
+				t.Fatalf("unexpected event %+v", event)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestReportsAfterTheCallerStopsReading(t *testing.T) {
+	server, srv := newEventServer(t)
+	n := New(srv.URL, "token", func() bool { return false })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replies, err := n.Chat(scriptedChat{{Content: "a"}, {Content: "b"}, {Finished: true}}).HandleChatMessage(ctx, &protocol.ChatMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-replies
+	cancel()
+
+	select {
+	case event := <-server.events:
+		if event.Kind != KindAITaskFinished {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply finished after the caller stopped reading was not reported")
+	}
+}
+
+func TestReportRetries(t *testing.T) {
+	server, srv := newEventServer(t)
+	server.fail = 2
+	n := New(srv.URL, "token", nil, WithRetries(3, time.Millisecond))
+
+	if err := n.Report(context.Background(), Event{Kind: KindAITaskFinished}); err != nil {
+		t.Fatalf("expected the third attempt to succeed: %v", err)
+	}
+
+	server.mu.Lock()
+	server.fail, server.calls = 5, 0
+	server.mu.Unlock()
+	if err := n.Report(context.Background(), Event{Kind: KindAITaskFinished}); err == nil {
+		t.Fatal("expected an error once every attempt failed")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", server.calls)
+	}
+}
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxTrackedIDs bounds memory use when a client sends faster than the window expires
+const maxTrackedIDs = 10000
+
+type seenID struct {
+	id     string
+	seenAt time.Time
+}
+
+// Deduplicator remembers recently received message IDs so retransmissions
+// from the client can be recognised and dropped
+type Deduplicator struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]*list.Element
+	order  *list.List // oldest first
+}
+
+// NewDeduplicator tracks IDs for window. A zero window disables deduplication.
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		seen:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Seen records id and reports whether it was already received within the window
+func (d *Deduplicator) Seen(id string) bool {
+	if d.window <= 0 || id == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.expire(now)
+
+	if _, exists := d.seen[id]; exists {
+		return true
+	}
+
+	if d.order.Len() >= maxTrackedIDs {
+		d.evict(d.order.Front())
+	}
+	d.seen[id] = d.order.PushBack(&seenID{id: id, seenAt: now})
+	return false
+}
+
+// Len returns the number of IDs currently tracked
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+func (d *Deduplicator) expire(now time.Time) {
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		if now.Sub(elem.Value.(*seenID).seenAt) < d.window {
+			return
+		}
+		d.evict(elem)
+	}
+}
+
+func (d *Deduplicator) evict(elem *list.Element) {
+	delete(d.seen, elem.Value.(*seenID).id)
+	d.order.Remove(elem)
+}
@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(20 * time.Millisecond)
+
+	if d.Seen("a") {
+		t.Fatal("first delivery reported as duplicate")
+	}
+	if !d.Seen("a") {
+		t.Fatal("retransmission not detected")
+	}
+	if d.Seen("b") {
+		t.Fatal("distinct ID reported as duplicate")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if d.Seen("a") {
+		t.Fatal("ID still tracked after window expired")
+	}
+	if n := d.Len(); n != 1 {
+		t.Fatalf("expected expired IDs to be pruned, tracking %d", n)
+	}
+}
+
+func TestDeduplicatorDisabled(t *testing.T) {
+	d := NewDeduplicator(0)
+
+	d.Seen("a")
+	if d.Seen("a") {
+		t.Fatal("zero window should disable deduplication")
+	}
+	if d.Seen("") || d.Seen("") {
+		t.Fatal("empty IDs must never be treated as duplicates")
+	}
+}
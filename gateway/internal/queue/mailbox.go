@@ -0,0 +1,369 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+const (
+	// DefaultMailboxBytes bounds the messages kept for one session
+	DefaultMailboxBytes = 4 << 20
+
+	// DefaultMailboxTTL is how long a mailbox is kept after its last message
+	DefaultMailboxTTL = 24 * time.Hour
+
+	// maxMailboxes bounds the sessions messages are kept for; the mailbox
+	// updated longest ago makes way for a new one
+	maxMailboxes = 64
+
+	mailboxExt = ".jsonl"
+)
+
+// Mailboxes keep the messages a session could not deliver because its
+// client disconnected, such as the end of a chat reply that finished while
+// the phone was locked, until the client resumes the session from another
+// connection. Each mailbox holds up to maxBytes of messages, dropping the
+// oldest first, and expires ttl after its last message.
+//
+// With a directory, each mailbox is appended to a file, so messages survive
+// a gateway restart such as the VM being suspended.
+type Mailboxes struct {
+	dir      string
+	maxBytes int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	boxes   map[string]*mailbox
+	dropped uint64
+}
+
+type mailbox struct {
+	owner    string
+	messages []*protocol.Message
+	sizes    []int // encoded size of each message
+	bytes    int
+	ids      map[string]bool
+	dropped  int
+	updated  time.Time
+
+	// forward delivers messages kept after the session was resumed to the
+	// connection that resumed it
+	forward func(*protocol.Message) bool
+}
+
+// mailboxHeader is the first line of a mailbox file
+type mailboxHeader struct {
+	Owner string `json:"owner"`
+}
+
+// MailboxStats is a point-in-time view of the mailboxes
+type MailboxStats struct {
+	Sessions int    `json:"sessions"`
+	Messages int    `json:"messages"`
+	Bytes    int    `json:"bytes"`
+	Dropped  uint64 `json:"dropped"` // messages dropped because a mailbox was full
+}
+
+// OpenMailboxes loads the mailboxes kept in dir, creating it if needed. An
+// empty dir keeps mailboxes in memory only. Zero maxBytes or ttl mean the
+// defaults.
+func OpenMailboxes(dir string, maxBytes int, ttl time.Duration) (*Mailboxes, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMailboxBytes
+	}
+	if ttl <= 0 {
+		ttl = DefaultMailboxTTL
+	}
+	m := &Mailboxes{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		now:      time.Now,
+		boxes:    make(map[string]*mailbox),
+	}
+	if dir == "" {
+		return m, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create mailbox directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read mailbox directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), mailboxExt) {
+			continue
+		}
+		sessionID := strings.TrimSuffix(entry.Name(), mailboxExt)
+		box, err := m.load(sessionID)
+		if err != nil || m.now().Sub(box.updated) > m.ttl {
+			os.Remove(m.path(sessionID))
+			continue
+		}
+		m.boxes[sessionID] = box
+		if m.trim(box) > 0 {
+			m.rewrite(sessionID, box)
+		}
+	}
+	m.evict()
+	return m, nil
+}
+
+// Put keeps msg for the session's client, or hands it straight to the
+// connection that resumed the session. Messages already kept, by ID, are
+// ignored.
+func (m *Mailboxes) Put(sessionID, owner string, msg *protocol.Message) error {
+	m.mu.Lock()
+	if box := m.boxes[sessionID]; box != nil && box.forward != nil {
+		forward := box.forward
+		m.mu.Unlock()
+		// Outside the lock, as forwarding may keep msg in another mailbox
+		if forward(msg) {
+			return nil
+		}
+		m.mu.Lock()
+	}
+	defer m.mu.Unlock()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+
+	m.prune()
+	box := m.boxes[sessionID]
+	if box == nil {
+		box = &mailbox{owner: owner, ids: make(map[string]bool)}
+		m.boxes[sessionID] = box
+		m.evict()
+		if err := m.writeHeader(sessionID, owner); err != nil {
+			return err
+		}
+	}
+	if box.ids[msg.ID] {
+		return nil
+	}
+
+	box.messages = append(box.messages, msg)
+	box.sizes = append(box.sizes, len(data)+1)
+	box.bytes += len(data) + 1
+	box.ids[msg.ID] = true
+	box.updated = m.now()
+
+	if m.trim(box) > 0 {
+		return m.rewrite(sessionID, box)
+	}
+	return m.appendLine(sessionID, data)
+}
+
+// Take removes and returns the messages kept for the session, with how
+// many were dropped because its mailbox was full, and reports false if the
+// session has none or belongs to another owner. Messages kept for the
+// session from then on go to forward instead, unless it returns false.
+func (m *Mailboxes) Take(sessionID, owner string, forward func(*protocol.Message) bool) ([]*protocol.Message, int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune()
+	box := m.boxes[sessionID]
+	if box == nil || box.owner != owner {
+		return nil, 0, false
+	}
+
+	messages, dropped := box.messages, box.dropped
+	box.messages, box.sizes, box.bytes, box.dropped = nil, nil, 0, 0
+	box.ids = make(map[string]bool)
+	box.updated = m.now()
+	box.forward = forward
+	if m.dir != "" {
+		os.Remove(m.path(sessionID))
+	}
+	return messages, dropped, true
+}
+
+// Stats returns how much the mailboxes hold
+func (m *Mailboxes) Stats() MailboxStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := MailboxStats{Dropped: m.dropped}
+	for _, box := range m.boxes {
+		if len(box.messages) == 0 {
+			continue
+		}
+		stats.Sessions++
+		stats.Messages += len(box.messages)
+		stats.Bytes += box.bytes
+	}
+	return stats
+}
+
+// trim drops the oldest messages of a mailbox over its limit, down to three
+// quarters of it so a busy session does not rewrite its file on every
+// message, and returns how many. Callers hold mu.
+func (m *Mailboxes) trim(box *mailbox) int {
+	if box.bytes <= m.maxBytes {
+		return 0
+	}
+	n := 0
+	for n < len(box.messages) && box.bytes > m.maxBytes*3/4 {
+		box.bytes -= box.sizes[n]
+		delete(box.ids, box.messages[n].ID)
+		n++
+	}
+	box.messages = append([]*protocol.Message(nil), box.messages[n:]...)
+	box.sizes = append([]int(nil), box.sizes[n:]...)
+	box.dropped += n
+	m.dropped += uint64(n)
+	return n
+}
+
+// prune removes mailboxes whose last message is older than the TTL.
+// Callers hold mu.
+func (m *Mailboxes) prune() {
+	now := m.now()
+	for sessionID, box := range m.boxes {
+		if now.Sub(box.updated) > m.ttl {
+			m.remove(sessionID)
+		}
+	}
+}
+
+// evict removes the mailboxes updated longest ago while there are too
+// many. Callers hold mu.
+func (m *Mailboxes) evict() {
+	if len(m.boxes) <= maxMailboxes {
+		return
+	}
+	ids := make([]string, 0, len(m.boxes))
+	for sessionID := range m.boxes {
+		ids = append(ids, sessionID)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return m.boxes[ids[i]].updated.Before(m.boxes[ids[j]].updated)
+	})
+	for _, sessionID := range ids[:len(ids)-maxMailboxes] {
+		m.dropped += uint64(len(m.boxes[sessionID].messages))
+		m.remove(sessionID)
+	}
+}
+
+func (m *Mailboxes) remove(sessionID string) {
+	delete(m.boxes, sessionID)
+	if m.dir != "" {
+		os.Remove(m.path(sessionID))
+	}
+}
+
+func (m *Mailboxes) path(sessionID string) string {
+	return filepath.Join(m.dir, sessionID+mailboxExt)
+}
+
+func (m *Mailboxes) writeHeader(sessionID, owner string) error {
+	if m.dir == "" {
+		return nil
+	}
+	header, _ := json.Marshal(mailboxHeader{Owner: owner})
+	if err := os.WriteFile(m.path(sessionID), append(header, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write mailbox: %w", err)
+	}
+	return nil
+}
+
+func (m *Mailboxes) appendLine(sessionID string, data []byte) error {
+	if m.dir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(m.path(sessionID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open mailbox: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write mailbox: %w", err)
+	}
+	return nil
+}
+
+// rewrite replaces a mailbox's file with its current messages
+func (m *Mailboxes) rewrite(sessionID string, box *mailbox) error {
+	if m.dir == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	header, _ := json.Marshal(mailboxHeader{Owner: box.owner})
+	buf.Write(header)
+	buf.WriteByte('\n')
+	for _, msg := range box.messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	tmp := m.path(sessionID) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("write mailbox: %w", err)
+	}
+	if err := os.Rename(tmp, m.path(sessionID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write mailbox: %w", err)
+	}
+	return nil
+}
+
+// load reads a mailbox file. Lines that do not parse, such as one cut
+// short by a crash, are skipped.
+func (m *Mailboxes) load(sessionID string) (*mailbox, error) {
+	f, err := os.Open(m.path(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), m.maxBytes+1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("mailbox %s has no header", sessionID)
+	}
+	var header mailboxHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("mailbox %s header: %w", sessionID, err)
+	}
+
+	box := &mailbox{owner: header.Owner, ids: make(map[string]bool), updated: info.ModTime()}
+	for scanner.Scan() {
+		var msg protocol.Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil || box.ids[msg.ID] {
+			continue
+		}
+		box.messages = append(box.messages, &msg)
+		box.sizes = append(box.sizes, len(scanner.Bytes())+1)
+		box.bytes += len(scanner.Bytes()) + 1
+		box.ids[msg.ID] = true
+	}
+	return box, nil
+}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func mailboxMessage(id string) *protocol.Message {
+	payload, _ := json.Marshal(protocol.ChatReply{Content: "part of a reply"})
+	return &protocol.Message{ID: id, Type: protocol.TypeChatStream, Payload: payload}
+}
+
+func TestMailboxesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	m, err := OpenMailboxes(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "b", "c"} {
+		if err := m.Put("s1", "alice", mailboxMessage(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err = OpenMailboxes(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := m.Take("s1", "mallory", nil); ok {
+		t.Fatal("another user took the session's messages")
+	}
+
+	messages, dropped, ok := m.Take("s1", "alice", nil)
+	if !ok || dropped != 0 || len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d (dropped %d, ok %v)", len(messages), dropped, ok)
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		if messages[i].ID != id {
+			t.Fatalf("message %d is %q, want %q", i, messages[i].ID, id)
+		}
+	}
+
+	m, err = OpenMailboxes(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.Stats(); stats.Messages != 0 {
+		t.Fatalf("taken messages came back after a restart: %+v", stats)
+	}
+}
+
+func TestMailboxesDropOldestWhenFull(t *testing.T) {
+	m, err := OpenMailboxes("", 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		m.Put("s1", "", mailboxMessage(fmt.Sprintf("m%02d", i)))
+	}
+
+	stats := m.Stats()
+	if stats.Bytes > 1024 || stats.Dropped == 0 {
+		t.Fatalf("mailbox was not bounded: %+v", stats)
+	}
+	messages, dropped, _ := m.Take("s1", "", nil)
+	if uint64(dropped) != stats.Dropped || messages[len(messages)-1].ID != "m49" {
+		t.Fatalf("expected the newest messages kept, got %d ending %q, dropped %d", len(messages), messages[len(messages)-1].ID, dropped)
+	}
+}
+
+func TestMailboxesExpire(t *testing.T) {
+	m, err := OpenMailboxes("", 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.Put("s1", "", mailboxMessage("a"))
+
+	now = now.Add(2 * time.Hour)
+	if _, _, ok := m.Take("s1", "", nil); ok {
+		t.Fatal("expired mailbox was still delivered")
+	}
+}
+
+func TestMailboxesForwardAfterTake(t *testing.T) {
+	m, err := OpenMailboxes("", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Put("s1", "", mailboxMessage("a"))
+
+	var forwarded []string
+	connected := true
+	m.Take("s1", "", func(msg *protocol.Message) bool {
+		if connected {
+			forwarded = append(forwarded, msg.ID)
+		}
+		return connected
+	})
+
+	m.Put("s1", "", mailboxMessage("b"))
+	connected = false
+	m.Put("s1", "", mailboxMessage("c"))
+
+	if len(forwarded) != 1 || forwarded[0] != "b" {
+		t.Fatalf("expected b forwarded, got %v", forwarded)
+	}
+	if messages, _, _ := m.Take("s1", "", nil); len(messages) != 1 || messages[0].ID != "c" {
+		t.Fatalf("expected c kept once forwarding failed, got %v", messages)
+	}
+}
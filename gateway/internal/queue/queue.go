@@ -9,9 +9,21 @@ import (
 )
 
 type QueueItem struct {
-	Message   *protocol.Message
-	Timestamp time.Time
-	Retries   int
+	Message    *protocol.Message
+	Timestamp  time.Time // last (re)send, drives retry timing
+	EnqueuedAt time.Time
+	Retries    int
+}
+
+// Stats is a point-in-time view of a queue's health
+type Stats struct {
+	Pending           int
+	InFlight          int
+	Retries           uint64 // retransmissions since creation
+	Expired           uint64 // messages dropped after max retries
+	Dropped           uint64 // messages evicted because the queue was full
+	OldestPendingAge  time.Duration
+	OldestInFlightAge time.Duration
 }
 
 type MessageQueue struct {
@@ -22,6 +34,11 @@ type MessageQueue struct {
 	retryTimeout    time.Duration
 	maxQueueSize    int
 	sequenceCounter uint64
+	
+	// Counters reported by Stats
+	retries         uint64
+	expired         uint64
+	dropped         uint64
 }
 
 func NewMessageQueue(maxQueueSize, maxRetries int, retryTimeout time.Duration) *MessageQueue {
@@ -42,22 +59,43 @@ func (q *MessageQueue) Enqueue(msg *protocol.Message) error {
 		oldest := q.pending.Front()
 		if oldest != nil {
 			q.pending.Remove(oldest)
+			q.dropped++
 		}
 	}
 
 	q.sequenceCounter++
 	msg.SeqNum = q.sequenceCounter
 
+	now := time.Now()
 	item := &QueueItem{
-		Message:   msg,
-		Timestamp: time.Now(),
-		Retries:   0,
+		Message:    msg,
+		Timestamp:  now,
+		EnqueuedAt: now,
+		Retries:    0,
 	}
 
 	q.pending.PushBack(item)
 	return nil
 }
 
+// Track records msg as sent and awaiting acknowledgment, assigning it the next
+// sequence number. CheckRetries returns it for retransmission until Ack is
+// called with its ID or it runs out of retries.
+func (q *MessageQueue) Track(msg *protocol.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sequenceCounter++
+	msg.SeqNum = q.sequenceCounter
+
+	now := time.Now()
+	q.inFlight[msg.ID] = &QueueItem{
+		Message:    msg,
+		Timestamp:  now,
+		EnqueuedAt: now,
+	}
+}
+
 func (q *MessageQueue) Dequeue() *protocol.Message {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -82,6 +120,8 @@ func (q *MessageQueue) Ack(messageID string) {
 	delete(q.inFlight, messageID)
 }
 
+// CheckRetries returns copies of unacknowledged messages whose retry timeout
+// has elapsed, with RetryCount set, and expires those out of retries
 func (q *MessageQueue) CheckRetries() []*protocol.Message {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -94,9 +134,15 @@ func (q *MessageQueue) CheckRetries() []*protocol.Message {
 			if item.Retries < q.maxRetries {
 				item.Retries++
 				item.Timestamp = now
-				toRetry = append(toRetry, item.Message)
+				q.retries++
+				
+				// The original may still be in a writer's hands
+				retry := *item.Message
+				retry.RetryCount = item.Retries
+				toRetry = append(toRetry, &retry)
 			} else {
 				delete(q.inFlight, id)
+				q.expired++
 			}
 		}
 	}
@@ -116,6 +162,47 @@ func (q *MessageQueue) GetInFlightCount() int {
 	return len(q.inFlight)
 }
 
+// Stats returns the current queue depth, retry counters and the age of the
+// oldest pending and unacknowledged messages
+func (q *MessageQueue) Stats() Stats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	now := time.Now()
+	stats := Stats{
+		Pending:  q.pending.Len(),
+		InFlight: len(q.inFlight),
+		Retries:  q.retries,
+		Expired:  q.expired,
+		Dropped:  q.dropped,
+	}
+
+	// Pending items are kept in enqueue order
+	if front := q.pending.Front(); front != nil {
+		stats.OldestPendingAge = now.Sub(front.Value.(*QueueItem).EnqueuedAt)
+	}
+
+	for _, item := range q.inFlight {
+		if age := now.Sub(item.EnqueuedAt); age > stats.OldestInFlightAge {
+			stats.OldestInFlightAge = age
+		}
+	}
+
+	return stats
+}
+
+// Clear drops every pending and unacknowledged message and returns how many
+// there were
+func (q *MessageQueue) Clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.pending.Len() + len(q.inFlight)
+	q.pending.Init()
+	q.inFlight = make(map[string]*QueueItem)
+	return n
+}
+
 func (q *MessageQueue) GetMessagesAfter(seqNum uint64) []*protocol.Message {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
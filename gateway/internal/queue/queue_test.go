@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestQueueStats(t *testing.T) {
+	q := NewMessageQueue(2, 1, time.Millisecond)
+
+	for _, id := range []string{"a", "b", "c"} {
+		q.Enqueue(&protocol.Message{ID: id})
+	}
+
+	stats := q.Stats()
+	if stats.Pending != 2 || stats.Dropped != 1 {
+		t.Fatalf("expected 2 pending and 1 dropped, got %+v", stats)
+	}
+
+	q.Dequeue()
+	q.Dequeue()
+	q.Ack("c")
+
+	time.Sleep(5 * time.Millisecond)
+	if retried := q.CheckRetries(); len(retried) != 1 {
+		t.Fatalf("expected 1 retry, got %d", len(retried))
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	q.CheckRetries()
+
+	stats = q.Stats()
+	if stats.InFlight != 0 || stats.Retries != 1 || stats.Expired != 1 {
+		t.Fatalf("unexpected stats after retries: %+v", stats)
+	}
+}
+
+func TestQueueStatsOldestAge(t *testing.T) {
+	q := NewMessageQueue(10, 3, time.Minute)
+
+	q.Enqueue(&protocol.Message{ID: "a"})
+	time.Sleep(10 * time.Millisecond)
+	q.Enqueue(&protocol.Message{ID: "b"})
+	q.Dequeue()
+
+	stats := q.Stats()
+	if stats.OldestInFlightAge < 10*time.Millisecond {
+		t.Fatalf("oldest in-flight age too small: %v", stats.OldestInFlightAge)
+	}
+	if stats.OldestPendingAge >= stats.OldestInFlightAge {
+		t.Fatalf("pending message should be younger: pending %v, in flight %v", stats.OldestPendingAge, stats.OldestInFlightAge)
+	}
+}
+
+func TestQueueTrackAndAck(t *testing.T) {
+	q := NewMessageQueue(10, 2, time.Millisecond)
+
+	first := &protocol.Message{ID: "a", RequiresAck: true}
+	second := &protocol.Message{ID: "b", RequiresAck: true}
+	q.Track(first)
+	q.Track(second)
+
+	if first.SeqNum != 1 || second.SeqNum != 2 {
+		t.Fatalf("expected sequence numbers 1 and 2, got %d and %d", first.SeqNum, second.SeqNum)
+	}
+
+	q.Ack("a")
+	time.Sleep(5 * time.Millisecond)
+
+	retried := q.CheckRetries()
+	if len(retried) != 1 || retried[0].ID != "b" {
+		t.Fatalf("expected only b to be retransmitted, got %v", retried)
+	}
+	if retried[0].RetryCount != 1 || second.RetryCount != 0 {
+		t.Fatalf("retry count should be set on the copy only: copy %d, original %d", retried[0].RetryCount, second.RetryCount)
+	}
+
+	if missed := q.GetMessagesAfter(1); len(missed) != 1 || missed[0].ID != "b" {
+		t.Fatalf("expected b to be replayed after reconnect, got %v", missed)
+	}
+}
@@ -0,0 +1,138 @@
+// Package redact scrubs credentials from text before it leaves the user's
+// terminal or chat: logs, the audit trail, saved conversation contexts and
+// prompts sent to model APIs.
+package redact
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync/atomic"
+)
+
+// Replacement stands in for every redacted secret
+const Replacement = "[REDACTED]"
+
+// Defaults match common credential formats. Patterns with a capture group
+// redact only the first group, so the key name or scheme stays readable.
+var Defaults = []string{
+	// PEM private keys, including OpenSSH's
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	// Authorization headers
+	`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`,
+	// OpenAI, Anthropic and OpenRouter keys
+	`\bsk-[A-Za-z0-9_-]{20,}`,
+	// Google API keys
+	`\bAIza[0-9A-Za-z_-]{35}`,
+	// AWS access key IDs
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// GitHub tokens
+	`\bgh[pousr]_[A-Za-z0-9]{36,}`,
+	`\bgithub_pat_[A-Za-z0-9_]{22,}`,
+	// Slack tokens
+	`\bxox[abprs]-[A-Za-z0-9-]{10,}`,
+	// JSON Web Tokens
+	`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`,
+	// Assignments such as OPENAI_API_KEY=... or "password": "...", also
+	// inside JSON strings where the quotes are escaped
+	`(?i)\b[A-Z0-9_]*(?:API_?KEY|SECRET|TOKEN|PASSWORD|PASSWD)[A-Z0-9_]*\\?["']?\s*[:=]\s*\\?["']?([A-Za-z0-9_\-./+=]{12,})`,
+}
+
+// Redactor replaces matches of its patterns with Replacement
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// New compiles patterns, which use RE2 syntax
+func New(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// String returns s with every secret replaced
+func (r *Redactor) String(s string) string {
+	return string(r.Bytes([]byte(s)))
+}
+
+// Bytes returns b with every secret replaced. b is returned unchanged, not
+// copied, when nothing matches.
+func (r *Redactor) Bytes(b []byte) []byte {
+	for _, re := range r.patterns {
+		matches := re.FindAllSubmatchIndex(b, -1)
+		if matches == nil {
+			continue
+		}
+
+		out := make([]byte, 0, len(b))
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			// Only the first group, if the pattern has one and it matched
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			out = append(out, b[last:start]...)
+			out = append(out, Replacement...)
+			last = end
+		}
+		b = append(out, b[last:]...)
+	}
+	return b
+}
+
+// Writer returns a writer that redacts each write before passing it to w.
+// Writes must hold whole records, as zerolog's do, so a secret is never
+// split between two of them.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.r.Bytes(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var std atomic.Pointer[Redactor]
+
+func init() {
+	r, err := New(Defaults)
+	if err != nil {
+		panic(err)
+	}
+	std.Store(r)
+}
+
+// Default returns the redactor the package-level functions use, which
+// starts out with Defaults
+func Default() *Redactor {
+	return std.Load()
+}
+
+// SetDefault replaces the redactor the package-level functions use
+func SetDefault(r *Redactor) {
+	std.Store(r)
+}
+
+// String redacts s with the default redactor
+func String(s string) string {
+	return Default().String(s)
+}
+
+// Bytes redacts b with the default redactor
+func Bytes(b []byte) []byte {
+	return Default().Bytes(b)
+}
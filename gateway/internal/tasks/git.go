@@ -0,0 +1,110 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// gitTimeout bounds each git command a task runs
+	gitTimeout = 30 * time.Second
+
+	// maxDiffBytes caps the diff reported for a task
+	maxDiffBytes = 256 << 10
+)
+
+// snapshot is the working tree before a task, so its diff shows only what
+// the task changed and not edits the user had not committed yet
+type snapshot struct {
+	commit    string // compared against; empty outside a git repository
+	untracked map[string]bool
+}
+
+// changes is what a task changed in the working tree
+type changes struct {
+	diff      string
+	truncated bool
+	newFiles  []string
+}
+
+// takeSnapshot records the working tree of dir. Uncommitted changes are
+// stored as a dangling commit that git collects later; nothing in the
+// repository, index or stash list changes.
+func takeSnapshot(ctx context.Context, dir string) snapshot {
+	ctx, cancel := context.WithTimeout(ctx, gitTimeout)
+	defer cancel()
+
+	head, err := git(ctx, dir, "rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		return snapshot{}
+	}
+	commit, err := git(ctx, dir, "stash", "create")
+	if err != nil || commit == "" {
+		commit = head
+	}
+	untracked, _ := git(ctx, dir, "ls-files", "--others", "--exclude-standard")
+	return snapshot{commit: commit, untracked: lineSet(untracked)}
+}
+
+// changes compares dir's working tree with the snapshot
+func (s snapshot) changes(ctx context.Context, dir string) changes {
+	if s.commit == "" {
+		return changes{}
+	}
+
+	var c changes
+	diff, err := git(ctx, dir, "diff", "--no-color", "--no-ext-diff", s.commit)
+	if err == nil {
+		c.diff, c.truncated = truncateLines(diff, maxDiffBytes)
+	}
+	untracked, _ := git(ctx, dir, "ls-files", "--others", "--exclude-standard")
+	for _, file := range strings.Split(untracked, "\n") {
+		if file != "" && !s.untracked[file] {
+			c.newFiles = append(c.newFiles, file)
+		}
+	}
+	return c
+}
+
+// git runs a git command in dir and returns its output without the final
+// newline
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// stash create makes a commit, which needs an identity even if the
+	// user never set one up
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=devtail", "GIT_AUTHOR_EMAIL=devtail@localhost",
+		"GIT_COMMITTER_NAME=devtail", "GIT_COMMITTER_EMAIL=devtail@localhost")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(out.String(), "\n"), nil
+}
+
+// truncateLines cuts text to at most limit bytes, at the end of a line
+func truncateLines(text string, limit int) (string, bool) {
+	if len(text) <= limit {
+		return text, false
+	}
+	if cut := strings.LastIndexByte(text[:limit], '\n'); cut >= 0 {
+		return text[:cut+1], true
+	}
+	return text[:limit], true
+}
+
+func lineSet(text string) map[string]bool {
+	set := make(map[string]bool)
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" {
+			set[line] = true
+		}
+	}
+	return set
+}
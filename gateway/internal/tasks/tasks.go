@@ -0,0 +1,430 @@
+// Package tasks runs background AI tasks: longer instructions, such as
+// "upgrade all deps and fix breakages", that the gateway carries out on its
+// own. A task reports its progress to whoever watches it and ends with the
+// assistant's summary and a diff of what changed. Tasks outlive the sessions
+// that submit them and are kept in memory until the gateway exits.
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/internal/chat"
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultMaxTasks is how many tasks are kept; the oldest ended ones are
+	// forgotten first
+	defaultMaxTasks = 50
+
+	// maxProgressBytes caps the progress kept per task for watchers that
+	// join late; older progress is dropped first
+	maxProgressBytes = 1 << 20
+
+	// watcherBuffer is how many events a watcher may fall behind by before
+	// it is dropped and has to watch again
+	watcherBuffer = 256
+)
+
+// summaryPrompt asks the assistant for the task's summary once it is done
+const summaryPrompt = "/ask Summarize in a few sentences what you changed for the task you just carried out, " +
+	"and anything that is left to do."
+
+// Runner carries out tasks through a chat backend, one chat per task. The
+// chats queue with everyone else's, so a task never runs alongside a chat
+// the backend cannot serve at the same time.
+type Runner struct {
+	chat       ws.ChatHandler
+	workspaces *workspace.Registry
+	maxTasks   int
+	now        func() time.Time
+
+	ctx     context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+
+	mu    sync.Mutex
+	tasks map[string]*task
+	order []string // task IDs, oldest first
+}
+
+type task struct {
+	owner  string
+	dir    string
+	status protocol.TaskStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	progress      []protocol.TaskProgress
+	progressBytes int
+	watchers      map[*watcher]bool
+}
+
+type watcher struct {
+	events chan ws.TaskEvent
+}
+
+// Option configures a Runner
+type Option func(*Runner)
+
+// WithMaxTasks sets how many tasks are kept, ended or not
+func WithMaxTasks(n int) Option {
+	return func(r *Runner) { r.maxTasks = n }
+}
+
+// New creates a runner sending tasks to chatHandler, in directories of
+// workspaces
+func New(chatHandler ws.ChatHandler, workspaces *workspace.Registry, opts ...Option) *Runner {
+	ctx, stop := context.WithCancel(context.Background())
+	r := &Runner{
+		chat:       chatHandler,
+		workspaces: workspaces,
+		maxTasks:   defaultMaxTasks,
+		now:        time.Now,
+		ctx:        ctx,
+		stop:       stop,
+		tasks:      make(map[string]*task),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Close stops the running tasks and waits for them to end
+func (r *Runner) Close() {
+	r.stop()
+	r.running.Wait()
+}
+
+// Submit starts a task for owner
+func (r *Runner) Submit(owner string, req protocol.TaskSubmit) (protocol.TaskStatus, error) {
+	dir, err := r.resolve(req.Workspace, req.WorkDir)
+	if err != nil {
+		return protocol.TaskStatus{}, err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	t := &task{
+		owner: owner,
+		dir:   dir,
+		status: protocol.TaskStatus{
+			ID:          uuid.New().String(),
+			Instruction: req.Instruction,
+			Workspace:   req.Workspace,
+			WorkDir:     req.WorkDir,
+			State:       protocol.TaskQueued,
+			CreatedAt:   r.now(),
+		},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		watchers: make(map[*watcher]bool),
+	}
+
+	r.mu.Lock()
+	r.tasks[t.status.ID] = t
+	r.order = append(r.order, t.status.ID)
+	r.forgetOld()
+	status := t.status
+	r.mu.Unlock()
+
+	log.Info().Str("task_id", status.ID).Str("owner", owner).Str("dir", dir).Msg("task submitted")
+	r.running.Add(1)
+	go r.run(ctx, t)
+	return status, nil
+}
+
+// resolve returns the directory a task in the named workspace and work_dir
+// runs in, failing like a chat would
+func (r *Runner) resolve(name, dir string) (string, error) {
+	ws, err := r.workspaces.Get(name)
+	if err != nil {
+		chatErr := chat.NewChatError(chat.ErrorTypeFileSystem, err.Error(), "").WithCode(chat.CodeUnknownWorkspace)
+		chatErr.Retryable = false
+		return "", chatErr
+	}
+	return chat.ResolveWorkDir(ws.Root, dir)
+}
+
+// forgetOld drops the oldest ended tasks while there are too many. Running
+// tasks are never dropped.
+func (r *Runner) forgetOld() {
+	excess := len(r.order) - r.maxTasks
+	if excess <= 0 {
+		return
+	}
+	kept := r.order[:0]
+	for _, id := range r.order {
+		if excess > 0 && r.tasks[id].status.Ended() {
+			delete(r.tasks, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	r.order = kept
+}
+
+// List returns owner's tasks, newest first
+func (r *Runner) List(owner string) []protocol.TaskStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []protocol.TaskStatus{}
+	for i := len(r.order) - 1; i >= 0; i-- {
+		if t := r.tasks[r.order[i]]; t.owner == owner {
+			list = append(list, t.status)
+		}
+	}
+	return list
+}
+
+// get returns owner's task with id; the caller holds r.mu
+func (r *Runner) get(owner, id string) (*task, error) {
+	t, ok := r.tasks[id]
+	if !ok || t.owner != owner {
+		return nil, fmt.Errorf("%w %s", ws.ErrUnknownTask, id)
+	}
+	return t, nil
+}
+
+// Cancel stops owner's task with id and returns its final status
+func (r *Runner) Cancel(owner, id string) (protocol.TaskStatus, error) {
+	r.mu.Lock()
+	t, err := r.get(owner, id)
+	r.mu.Unlock()
+	if err != nil {
+		return protocol.TaskStatus{}, err
+	}
+
+	t.cancel()
+	<-t.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return t.status, nil
+}
+
+// Watch streams owner's task with id: the progress kept after afterSeq,
+// the current status, and then every change until the task ends
+func (r *Runner) Watch(owner, id string, afterSeq int64) (<-chan ws.TaskEvent, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, err := r.get(owner, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var missed []protocol.TaskProgress
+	for _, p := range t.progress {
+		if p.Seq > afterSeq {
+			missed = append(missed, p)
+		}
+	}
+	w := &watcher{events: make(chan ws.TaskEvent, len(missed)+watcherBuffer)}
+	for i := range missed {
+		w.events <- ws.TaskEvent{Progress: &missed[i]}
+	}
+	status := t.status
+	w.events <- ws.TaskEvent{Status: &status}
+	if status.Ended() {
+		close(w.events)
+		return w.events, func() {}, nil
+	}
+
+	t.watchers[w] = true
+	stop := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if t.watchers[w] {
+			delete(t.watchers, w)
+			close(w.events)
+		}
+	}
+	return w.events, stop, nil
+}
+
+// publish sends event to t's watchers, dropping those that fell behind; the
+// caller holds r.mu
+func (r *Runner) publish(t *task, event ws.TaskEvent) {
+	for w := range t.watchers {
+		select {
+		case w.events <- event:
+		default:
+			delete(t.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// addProgress records part of the assistant's output for t
+func (r *Runner) addProgress(t *task, content string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t.status.Seq++
+	p := protocol.TaskProgress{TaskID: t.status.ID, Seq: t.status.Seq, Content: content}
+	t.progress = append(t.progress, p)
+	t.progressBytes += len(content)
+	for t.progressBytes > maxProgressBytes && len(t.progress) > 1 {
+		t.progressBytes -= len(t.progress[0].Content)
+		t.progress = t.progress[1:]
+	}
+	r.publish(t, ws.TaskEvent{Progress: &p})
+}
+
+// update changes t's status with change and tells its watchers. Once the
+// task has ended its watchers are done.
+func (r *Runner) update(t *task, change func(*protocol.TaskStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change(&t.status)
+	status := t.status
+	r.publish(t, ws.TaskEvent{Status: &status})
+	if status.Ended() {
+		for w := range t.watchers {
+			delete(t.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// run carries out t: the instruction, then the summary, then the diff
+func (r *Runner) run(ctx context.Context, t *task) {
+	defer r.running.Done()
+	defer close(t.done)
+	defer t.cancel()
+
+	before := takeSnapshot(ctx, t.dir)
+	state, errMsg := r.carryOut(ctx, t)
+
+	var summary string
+	if state == protocol.TaskSucceeded {
+		summary = r.summarize(ctx, t)
+	}
+
+	// The diff is taken even for a failed or cancelled task, since it may
+	// have changed files before it stopped
+	diffCtx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	changes := before.changes(diffCtx, t.dir)
+
+	log.Info().Str("task_id", t.status.ID).Str("state", state).Msg("task ended")
+	r.update(t, func(s *protocol.TaskStatus) {
+		finished := r.now()
+		s.State = state
+		s.FinishedAt = &finished
+		s.Summary = summary
+		s.Diff, s.DiffTruncated, s.NewFiles = changes.diff, changes.truncated, changes.newFiles
+		s.Error = errMsg
+	})
+}
+
+// carryOut sends the task's instruction to the chat and records the reply
+// as progress. It returns the state the task ended in and why it failed.
+func (r *Runner) carryOut(ctx context.Context, t *task) (string, string) {
+	msg := &protocol.ChatMessage{
+		Role:   "user",
+		Author: t.owner,
+		// The backend reads each line as a prompt
+		Content:   strings.Join(strings.Fields(t.status.Instruction), " "),
+		Workspace: t.status.Workspace,
+		WorkDir:   t.status.WorkDir,
+	}
+	replies, err := r.chat.HandleChatMessage(ctx, msg)
+	if err != nil {
+		return protocol.TaskFailed, err.Error()
+	}
+	defer func() {
+		// Drain so the backend is not left blocked
+		go func() {
+			for range replies {
+			}
+		}()
+	}()
+
+	started := false
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				if ctx.Err() != nil {
+					return protocol.TaskCancelled, ""
+				}
+				return protocol.TaskFailed, "the reply ended early"
+			}
+			if reply.Error != nil {
+				return protocol.TaskFailed, reply.Error.Error
+			}
+			if reply.Queued != nil || reply.Recovery != nil {
+				continue
+			}
+			if !started {
+				started = true
+				r.update(t, func(s *protocol.TaskStatus) {
+					now := r.now()
+					s.State = protocol.TaskRunning
+					s.StartedAt = &now
+				})
+			}
+			if reply.Content != "" {
+				r.addProgress(t, reply.Content)
+			}
+			if reply.Finished {
+				return protocol.TaskSucceeded, ""
+			}
+		case <-ctx.Done():
+			return protocol.TaskCancelled, ""
+		}
+	}
+}
+
+// summarize asks the assistant what it did for t. A task without a summary
+// still succeeded, so failures are only logged.
+func (r *Runner) summarize(ctx context.Context, t *task) string {
+	replies, err := r.chat.HandleChatMessage(ctx, &protocol.ChatMessage{
+		Role:      "user",
+		Content:   summaryPrompt,
+		Workspace: t.status.Workspace,
+		WorkDir:   t.status.WorkDir,
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("task_id", t.status.ID).Msg("failed to summarize task")
+		return ""
+	}
+
+	defer func() {
+		go func() {
+			for range replies {
+			}
+		}()
+	}()
+
+	var summary strings.Builder
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return strings.TrimSpace(summary.String())
+			}
+			if reply.Error != nil {
+				log.Warn().Str("error", reply.Error.Error).Str("task_id", t.status.ID).Msg("failed to summarize task")
+				return ""
+			}
+			summary.WriteString(reply.Content)
+			if reply.Finished {
+				return strings.TrimSpace(summary.String())
+			}
+		case <-ctx.Done():
+			return ""
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/devtail/gateway/internal/websocket"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// editingChat carries out every instruction by changing a.txt and creating
+// new.txt in dir, and answers the summary prompt with a summary
+type editingChat struct {
+	dir string
+}
+
+func (c editingChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 4)
+	defer close(replies)
+	if msg.Content == summaryPrompt {
+		replies <- &protocol.ChatReply{Content: "Changed a.txt and added new.txt.", Finished: true}
+		return replies, nil
+	}
+
+	os.WriteFile(filepath.Join(c.dir, "a.txt"), []byte("two\n"), 0o644)
+	os.WriteFile(filepath.Join(c.dir, "new.txt"), []byte("new\n"), 0o644)
+	replies <- &protocol.ChatReply{Queued: &protocol.ChatQueued{Position: 1}}
+	replies <- &protocol.ChatReply{Content: "Editing"}
+	replies <- &protocol.ChatReply{Content: " a.txt", Finished: true}
+	return replies, nil
+}
+
+// stalledChat starts a reply and never finishes it
+type stalledChat struct{}
+
+func (stalledChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 1)
+	replies <- &protocol.ChatReply{Content: "Starting"}
+	go func() {
+		<-ctx.Done()
+		close(replies)
+	}()
+	return replies, nil
+}
+
+// gitRepo creates a repository with a.txt and b.txt committed, b.txt
+// changed since, and old.txt untracked
+func gitRepo(t *testing.T) (string, *workspace.Registry) {
+	t.Helper()
+	dir := t.TempDir()
+	ctx := context.Background()
+	if _, err := git(ctx, dir, "init", "-q"); err != nil {
+		t.Skipf("git unavailable: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b\n"), 0o644)
+	for _, args := range [][]string{{"add", "."}, {"commit", "-q", "-m", "initial"}} {
+		if _, err := git(ctx, dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b changed by the user\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("old\n"), 0o644)
+
+	workspaces := workspace.NewRegistry()
+	if err := workspaces.Add(workspace.DefaultName, dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir, workspaces
+}
+
+// watchToEnd collects a watched task's progress until its final status
+func watchToEnd(t *testing.T, events <-chan ws.TaskEvent) ([]protocol.TaskProgress, protocol.TaskStatus) {
+	t.Helper()
+	var progress []protocol.TaskProgress
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("events ended before the task did")
+			}
+			if event.Progress != nil {
+				progress = append(progress, *event.Progress)
+			} else if event.Status.Ended() {
+				return progress, *event.Status
+			}
+		case <-timeout:
+			t.Fatal("task did not end")
+		}
+	}
+}
+
+func TestTaskReportsProgressSummaryAndDiff(t *testing.T) {
+	dir, workspaces := gitRepo(t)
+	r := New(editingChat{dir: dir}, workspaces)
+	defer r.Close()
+
+	submitted, err := r.Submit("alice", protocol.TaskSubmit{Instruction: "change\na.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop, err := r.Watch("alice", submitted.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	progress, status := watchToEnd(t, events)
+	if len(progress) != 2 || progress[0].Content != "Editing" || progress[1].Seq != 2 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+	if status.State != protocol.TaskSucceeded || status.Seq != 2 || status.StartedAt == nil || status.FinishedAt == nil {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if status.Summary != "Changed a.txt and added new.txt." {
+		t.Fatalf("unexpected summary %q", status.Summary)
+	}
+	// The user's own uncommitted change to b.txt is not the task's
+	if !strings.Contains(status.Diff, "+two") || strings.Contains(status.Diff, "b.txt") {
+		t.Fatalf("unexpected diff %q", status.Diff)
+	}
+	if len(status.NewFiles) != 1 || status.NewFiles[0] != "new.txt" {
+		t.Fatalf("expected only new.txt reported as new, got %q", status.NewFiles)
+	}
+
+	// A client coming back catches up from the last progress it saw
+	events, _, err = r.Watch("alice", submitted.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, _ = watchToEnd(t, events)
+	if len(progress) != 1 || progress[0].Seq != 2 {
+		t.Fatalf("expected the progress after seq 1, got %+v", progress)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected the events of an ended task to end")
+	}
+
+	if _, _, err := r.Watch("bob", submitted.ID, 0); !errors.Is(err, ws.ErrUnknownTask) {
+		t.Fatalf("expected another user's task unknown, got %v", err)
+	}
+	if tasks := r.List("bob"); len(tasks) != 0 {
+		t.Fatalf("expected bob to have no tasks, got %+v", tasks)
+	}
+	if tasks := r.List("alice"); len(tasks) != 1 || tasks[0].ID != submitted.ID {
+		t.Fatalf("expected alice's task listed, got %+v", tasks)
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	_, workspaces := gitRepo(t)
+	r := New(stalledChat{}, workspaces)
+	defer r.Close()
+
+	submitted, err := r.Submit("alice", protocol.TaskSubmit{Instruction: "upgrade all deps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Cancel("bob", submitted.ID); !errors.Is(err, ws.ErrUnknownTask) {
+		t.Fatalf("expected another user unable to cancel, got %v", err)
+	}
+	status, err := r.Cancel("alice", submitted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != protocol.TaskCancelled || status.Summary != "" {
+		t.Fatalf("expected the task cancelled without a summary, got %+v", status)
+	}
+}
+
+func TestSubmitRejectsWorkDirOutsideWorkspace(t *testing.T) {
+	_, workspaces := gitRepo(t)
+	r := New(stalledChat{}, workspaces)
+	defer r.Close()
+
+	if _, err := r.Submit("alice", protocol.TaskSubmit{Instruction: "x", WorkDir: "../.."}); err == nil {
+		t.Fatal("expected work_dir outside the workspace rejected")
+	}
+}
+
+func TestOldTasksAreForgotten(t *testing.T) {
+	dir, workspaces := gitRepo(t)
+	r := New(editingChat{dir: dir}, workspaces, WithMaxTasks(2))
+	defer r.Close()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		status, err := r.Submit("alice", protocol.TaskSubmit{Instruction: "change a.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, _, _ := r.Watch("alice", status.ID, 0)
+		watchToEnd(t, events)
+		ids = append(ids, status.ID)
+	}
+	tasks := r.List("alice")
+	if len(tasks) != 2 || tasks[0].ID != ids[2] || tasks[1].ID != ids[1] {
+		t.Fatalf("expected the two newest tasks kept, got %+v", tasks)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build !windows
+
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultShell is the shell terminals run unless configured otherwise
+const DefaultShell = "/bin/bash"
+
+// console is the PTY a terminal's shell runs on, with the shell
+type console struct {
+	ptmx *os.File
+	cmd  *exec.Cmd
+}
+
+// startConsole starts cmd on a new PTY of the given size. cmd is made with
+// exec.CommandContext, which already kills it when ctx is done.
+func startConsole(_ context.Context, cmd *exec.Cmd, rows, cols uint16) (*console, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open pty: %w", err)
+	}
+
+	c := &console{ptmx: ptmx, cmd: cmd}
+	if err := c.resize(rows, cols); err != nil {
+		ptmx.Close()
+		tty.Close()
+		return nil, fmt.Errorf("set initial size: %w", err)
+	}
+
+	// Connect command to PTY
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setctty: true,
+		Setsid:  true,
+	}
+
+	if err := cmd.Start(); err != nil {
+		ptmx.Close()
+		tty.Close()
+		return nil, fmt.Errorf("start command: %w", err)
+	}
+
+	// The child holds its own copy of the tty. Closing ours lets reads on
+	// the master fail once the shell exits, which ends the read loop.
+	tty.Close()
+
+	return c, nil
+}
+
+func (c *console) Read(p []byte) (int, error) {
+	return c.ptmx.Read(p)
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	return c.ptmx.Write(p)
+}
+
+func (c *console) resize(rows, cols uint16) error {
+	return pty.Setsize(c.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// hidesInput reports whether the PTY reads a line without echoing it; the
+// master reports the shell side's settings
+func (c *console) hidesInput() bool {
+	return fileHidesInput(c.ptmx)
+}
+
+// ttyHidesInput reports whether the terminal device at path reads a line
+// without echoing it
+func ttyHidesInput(path string) bool {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return fileHidesInput(f)
+}
+
+// fileHidesInput reports whether the terminal f reads a line without echoing
+// it, or false when it cannot tell. Password prompts keep the terminal in
+// canonical mode with echo off; line editors such as readline turn echo off
+// too, but also leave canonical mode to echo what is typed themselves.
+// It goes through SyscallConn, as Fd would put f in blocking mode and Close
+// would no longer unblock reads.
+func fileHidesInput(f *os.File) bool {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	hidden := false
+	conn.Control(func(fd uintptr) {
+		if termios, err := unix.IoctlGetTermios(int(fd), ioctlReadTermios); err == nil {
+			hidden = termios.Lflag&unix.ECHO == 0 && termios.Lflag&unix.ICANON != 0
+		}
+	})
+	return hidden
+}
+
+func (c *console) kill() error {
+	return c.cmd.Process.Kill()
+}
+
+// wait waits for the shell to exit
+func (c *console) wait() error {
+	return c.cmd.Wait()
+}
+
+// Close closes the PTY, which unblocks reads
+func (c *console) Close() error {
+	return c.ptmx.Close()
+}
+
+// consoleClosed reports whether a read failed because the shell side of the
+// console closed: Linux reports EIO
+func consoleClosed(err error) bool {
+	return errors.Is(err, syscall.EIO)
+}
@@ -0,0 +1,236 @@
+//go:build windows
+
+package terminal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultShell is the shell terminals run unless configured otherwise
+const DefaultShell = "powershell.exe"
+
+// console is the ConPTY pseudo console a terminal's shell runs on, with the
+// shell. ConPTY needs Windows 10 1809 or Windows Server 2019 and later.
+type console struct {
+	hpc     windows.Handle
+	in      *os.File // the shell's input
+	out     *os.File // its output, VT sequences as from a PTY
+	process *os.Process
+	killed  atomic.Bool
+
+	closeOnce sync.Once
+}
+
+// startConsole starts cmd on a new pseudo console of the given size. The
+// shell is killed when ctx is done.
+func startConsole(ctx context.Context, cmd *exec.Cmd, rows, cols uint16) (*console, error) {
+	if cmd.Err != nil {
+		return nil, fmt.Errorf("start command: %w", cmd.Err)
+	}
+
+	var inRead, inWrite, outRead, outWrite windows.Handle
+	if err := windows.CreatePipe(&inRead, &inWrite, nil, 0); err != nil {
+		return nil, fmt.Errorf("create input pipe: %w", err)
+	}
+	if err := windows.CreatePipe(&outRead, &outWrite, nil, 0); err != nil {
+		windows.CloseHandle(inRead)
+		windows.CloseHandle(inWrite)
+		return nil, fmt.Errorf("create output pipe: %w", err)
+	}
+	// The pseudo console keeps its own copies of its ends of the pipes
+	defer windows.CloseHandle(inRead)
+	defer windows.CloseHandle(outWrite)
+
+	c := &console{
+		in:  os.NewFile(uintptr(inWrite), "conpty-in"),
+		out: os.NewFile(uintptr(outRead), "conpty-out"),
+	}
+	if err := windows.CreatePseudoConsole(coord(rows, cols), inRead, outWrite, 0, &c.hpc); err != nil {
+		c.in.Close()
+		c.out.Close()
+		return nil, fmt.Errorf("create pseudo console: %w", err)
+	}
+
+	if err := c.start(cmd); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("start command: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		c.kill()
+	}()
+
+	return c, nil
+}
+
+// start creates the shell's process attached to the pseudo console
+func (c *console) start(cmd *exec.Cmd) error {
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attrs.Delete()
+
+	// The attribute's value is the HPCON itself, not a pointer to it
+	hpc := *(*unsafe.Pointer)(unsafe.Pointer(&c.hpc))
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, hpc, unsafe.Sizeof(c.hpc)); err != nil {
+		return err
+	}
+
+	si := windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(si))
+	// Without standard handles of its own, the shell would write to the
+	// gateway's instead of the console
+	si.Flags = windows.STARTF_USESTDHANDLES
+
+	app, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	cmdLine, err := windows.UTF16PtrFromString(windows.ComposeCommandLine(cmd.Args))
+	if err != nil {
+		return err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		if dir, err = windows.UTF16PtrFromString(cmd.Dir); err != nil {
+			return err
+		}
+	}
+	env, err := environmentBlock(cmd.Env)
+	if err != nil {
+		return err
+	}
+
+	var pi windows.ProcessInformation
+	flags := uint32(windows.EXTENDED_STARTUPINFO_PRESENT | windows.CREATE_UNICODE_ENVIRONMENT)
+	if err := windows.CreateProcess(app, cmdLine, nil, nil, false, flags, env, dir, &si.StartupInfo, &pi); err != nil {
+		return err
+	}
+	defer windows.CloseHandle(pi.Thread)
+	// Held until FindProcess has its own handle, so the ID cannot be reused
+	defer windows.CloseHandle(pi.Process)
+
+	c.process, err = os.FindProcess(int(pi.ProcessId))
+	return err
+}
+
+// environmentBlock returns env as CreateProcess takes it. As with exec.Cmd,
+// a variable's last value wins; names are case-insensitive.
+func environmentBlock(env []string) (*uint16, error) {
+	seen := make(map[string]bool)
+	var kept []string
+	for i := len(env) - 1; i >= 0; i-- {
+		if name := envName(env[i]); !seen[name] {
+			seen[name] = true
+			kept = append(kept, env[i])
+		}
+	}
+
+	var block []uint16
+	for i := len(kept) - 1; i >= 0; i-- {
+		kv, err := windows.UTF16FromString(kept[i])
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, kv...)
+	}
+	// The block ends with an empty string, and is never empty itself
+	block = append(block, 0)
+	if len(block) == 1 {
+		block = append(block, 0)
+	}
+	return &block[0], nil
+}
+
+// envName returns the upper-cased name of the variable kv sets. Names of the
+// hidden per-drive variables start with =, as in =C:=C:\src.
+func envName(kv string) string {
+	if kv == "" {
+		return ""
+	}
+	if i := strings.IndexByte(kv[1:], '='); i >= 0 {
+		kv = kv[:i+1]
+	}
+	return strings.ToUpper(kv)
+}
+
+func coord(rows, cols uint16) windows.Coord {
+	return windows.Coord{X: int16(cols), Y: int16(rows)}
+}
+
+func (c *console) Read(p []byte) (int, error) {
+	return c.out.Read(p)
+}
+
+func (c *console) Write(p []byte) (int, error) {
+	return c.in.Write(p)
+}
+
+func (c *console) resize(rows, cols uint16) error {
+	return windows.ResizePseudoConsole(c.hpc, coord(rows, cols))
+}
+
+// hidesInput reports whether the console reads a line without echoing it.
+// ConPTY does not tell, so input never counts as hidden.
+func (c *console) hidesInput() bool {
+	return false
+}
+
+// ttyHidesInput is not used on Windows, which has no tmux
+func ttyHidesInput(path string) bool {
+	return false
+}
+
+func (c *console) kill() error {
+	c.killed.Store(true)
+	return c.process.Kill()
+}
+
+// wait waits for the shell to exit. Being killed is not an error, as a
+// signal is not on Unix.
+func (c *console) wait() error {
+	state, err := c.process.Wait()
+
+	// Output only ends once the pseudo console is closed, not when the
+	// shell exits
+	c.closePseudoConsole()
+
+	if err != nil {
+		return err
+	}
+	if !state.Success() && !c.killed.Load() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+func (c *console) closePseudoConsole() {
+	c.closeOnce.Do(func() {
+		windows.ClosePseudoConsole(c.hpc)
+	})
+}
+
+// Close closes the pseudo console and the pipes, which unblocks reads
+func (c *console) Close() error {
+	c.closePseudoConsole()
+	c.in.Close()
+	return c.out.Close()
+}
+
+// consoleClosed reports whether a read failed because the pseudo console
+// closed
+func consoleClosed(err error) bool {
+	return errors.Is(err, windows.ERROR_BROKEN_PIPE) || errors.Is(err, os.ErrClosed)
+}
@@ -0,0 +1,67 @@
+//go:build windows
+
+package terminal
+
+import (
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestConsoleRunsCmd(t *testing.T) {
+	term, err := NewTerminal("test", WithShell("cmd.exe"), WithEnvironment([]string{"GREETING=hello"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+	term.Write([]byte("echo %GREETING%-conpty\r\n"))
+	readUntil(t, sub, "hello-conpty")
+
+	if err := term.Resize(40, 120); err != nil {
+		t.Errorf("resize: %v", err)
+	}
+
+	term.Write([]byte("exit\r\n"))
+	select {
+	case <-term.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the terminal to end when cmd exits")
+	}
+}
+
+func TestEnvironmentBlock(t *testing.T) {
+	block, err := environmentBlock([]string{"=C:=C:\\src", "Path=C:\\old", "TERM=dumb", "PATH=C:\\new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the NUL-separated strings up to the empty one ending the block
+	var got []string
+	for p := unsafe.Pointer(block); ; {
+		s := windows.UTF16PtrToString((*uint16)(p))
+		if s == "" {
+			break
+		}
+		got = append(got, s)
+		p = unsafe.Add(p, 2*(len(utf16.Encode([]rune(s)))+1))
+	}
+
+	want := []string{"=C:=C:\\src", "TERM=dumb", "PATH=C:\\new"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
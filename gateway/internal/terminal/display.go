@@ -0,0 +1,85 @@
+package terminal
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Display is how programs in a terminal should render for the client: the
+// terminal type, color depth and locale they read from TERM, COLORTERM and
+// LANG
+type Display struct {
+	Term      string
+	ColorTerm string
+	Locale    string
+}
+
+// DefaultDisplay is used for whatever a client leaves out
+var DefaultDisplay = Display{Term: "xterm-256color", Locale: "en_US.UTF-8"}
+
+// terminalTypes are the TERM values clients may ask for: ones with terminfo
+// entries in ncurses-base, which every image has. Truecolor is announced with
+// COLORTERM on top of one of these, as terminal emulators do.
+var terminalTypes = map[string]bool{
+	"xterm":           true,
+	"xterm-256color":  true,
+	"screen":          true,
+	"screen-256color": true,
+	"tmux":            true,
+	"tmux-256color":   true,
+	"linux":           true,
+	"vt100":           true,
+	"vt220":           true,
+	"dumb":            true,
+}
+
+// colorTerms are the COLORTERM values clients may ask for; both announce
+// 24-bit color
+var colorTerms = map[string]bool{
+	"truecolor": true,
+	"24bit":     true,
+}
+
+// localePattern matches the UTF-8 locales clients may ask for, such as
+// de_DE.UTF-8 or sr_RS.UTF-8@latin. Terminal output is UTF-8, so other
+// encodings are refused.
+var localePattern = regexp.MustCompile(`^([a-z]{2,3}(_[A-Z]{2})?|C)\.(UTF-8|utf8)(@[a-z]+)?$`)
+
+// withDefaults fills in what d leaves out from DefaultDisplay. A ColorTerm
+// left out stays unset, as most programs then stay within 256 colors.
+func (d Display) withDefaults() Display {
+	if d.Term == "" {
+		d.Term = DefaultDisplay.Term
+	}
+	if d.ColorTerm == "" {
+		d.ColorTerm = DefaultDisplay.ColorTerm
+	}
+	if d.Locale == "" {
+		d.Locale = DefaultDisplay.Locale
+	}
+	return d
+}
+
+// Validate checks d against the values clients may ask for. The values end
+// up in the shell's environment, so anything else is refused.
+func (d Display) Validate() error {
+	if d.Term != "" && !terminalTypes[d.Term] {
+		return fmt.Errorf("unsupported terminal type %q", d.Term)
+	}
+	if d.ColorTerm != "" && !colorTerms[d.ColorTerm] {
+		return fmt.Errorf("unsupported color depth %q, only truecolor or 24bit", d.ColorTerm)
+	}
+	if d.Locale != "" && !localePattern.MatchString(d.Locale) {
+		return fmt.Errorf("unsupported locale %q, expected a UTF-8 one such as de_DE.UTF-8", d.Locale)
+	}
+	return nil
+}
+
+// env returns the variables that tell programs about d
+func (d Display) env() []string {
+	env := []string{"TERM=" + d.Term}
+	if d.ColorTerm != "" {
+		env = append(env, "COLORTERM="+d.ColorTerm)
+	}
+	return append(env, "LANG="+d.Locale, "LC_ALL="+d.Locale)
+}
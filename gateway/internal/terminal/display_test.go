@@ -0,0 +1,56 @@
+package terminal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDisplayValidate(t *testing.T) {
+	valid := []Display{
+		{},
+		{Term: "xterm-256color", ColorTerm: "truecolor", Locale: "de_DE.UTF-8"},
+		{Term: "tmux-256color", Locale: "C.UTF-8"},
+		{ColorTerm: "24bit", Locale: "sr_RS.utf8@latin"},
+	}
+	for _, d := range valid {
+		if err := d.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid, got %v", d, err)
+		}
+	}
+
+	invalid := []Display{
+		{Term: "xterm-kitty"},
+		{Term: "xterm-256color\nPATH=/tmp"},
+		{ColorTerm: "yes"},
+		{Locale: "de_DE.ISO-8859-1"},
+		{Locale: "en_US.UTF-8 LD_PRELOAD=x"},
+	}
+	for _, d := range invalid {
+		if err := d.Validate(); err == nil {
+			t.Errorf("expected %+v to be refused", d)
+		}
+	}
+}
+
+func TestTerminalDisplayEnv(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	term, err := NewTerminal("test", WithShell("/bin/sh"),
+		WithEnvironment([]string{"TERM=vt100"}),
+		WithDisplay(Display{ColorTerm: "truecolor", Locale: "C.UTF-8"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+	term.Write([]byte("echo \"[$TERM|$COLORTERM|$LANG|$LC_ALL]\"\n"))
+	// Left out, the terminal type is the default, over the one in env
+	readUntil(t, sub, "[xterm-256color|truecolor|C.UTF-8|C.UTF-8]")
+}
@@ -11,6 +11,33 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+type userKey struct{}
+
+// WithUser returns a context for HandleTerminalMessage saying which user the
+// message came from, so the audit log can tell users sharing terminals apart
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+type participantKey struct{}
+
+// WithParticipant returns a context for HandleTerminalMessage saying which
+// participant the message came from, which terminals it creates are told as
+// DEVTAIL_PARTICIPANT_ID
+func WithParticipant(ctx context.Context, participantID string) context.Context {
+	return context.WithValue(ctx, participantKey{}, participantID)
+}
+
+func participantFrom(ctx context.Context) string {
+	participantID, _ := ctx.Value(participantKey{}).(string)
+	return participantID
+}
+
 // Handler integrates terminals with WebSocket messaging
 type Handler struct {
 	manager *Manager
@@ -41,6 +68,12 @@ func (h *Handler) HandleTerminalMessage(ctx context.Context, msg *protocol.Messa
 			h.handleClose(ctx, msg, replies)
 		case "terminal_list":
 			h.handleList(ctx, msg, replies)
+		case "terminal_attach":
+			h.handleAttach(ctx, msg, replies)
+		case "terminal_detach":
+			h.handleDetach(ctx, msg, replies)
+		case "terminal_export":
+			h.handleExport(ctx, msg, replies)
 		default:
 			h.sendError(replies, msg.ID, "Unknown terminal message type")
 		}
@@ -51,11 +84,18 @@ func (h *Handler) HandleTerminalMessage(ctx context.Context, msg *protocol.Messa
 
 // Message types
 
+// TerminalCreateRequest starts a shell. Term, ColorTerm and Locale set TERM,
+// COLORTERM and the locale, within the values Display.Validate allows;
+// left out, they come from DefaultDisplay.
 type TerminalCreateRequest struct {
-	WorkDir string   `json:"work_dir,omitempty"`
-	Env     []string `json:"env,omitempty"`
-	Rows    uint16   `json:"rows,omitempty"`
-	Cols    uint16   `json:"cols,omitempty"`
+	Workspace string   `json:"workspace,omitempty"`
+	WorkDir   string   `json:"work_dir,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	Rows      uint16   `json:"rows,omitempty"`
+	Cols      uint16   `json:"cols,omitempty"`
+	Term      string   `json:"term,omitempty"`
+	ColorTerm string   `json:"colorterm,omitempty"`
+	Locale    string   `json:"locale,omitempty"`
 }
 
 type TerminalCreateResponse struct {
@@ -64,6 +104,36 @@ type TerminalCreateResponse struct {
 	Error      string `json:"error,omitempty"`
 }
 
+type TerminalAttachRequest struct {
+	TerminalID string `json:"terminal_id"`
+}
+
+type TerminalAttachResponse struct {
+	TerminalID string `json:"terminal_id"`
+	Success    bool   `json:"success"`
+}
+
+// TerminalExportRequest asks for a terminal's recording, as PlaybackAsciicast
+// (the default) or PlaybackText
+type TerminalExportRequest struct {
+	TerminalID string `json:"terminal_id"`
+	Format     string `json:"format,omitempty"`
+}
+
+// TerminalExportResponse is a terminal's recording, the file to save as
+// Filename
+type TerminalExportResponse struct {
+	TerminalID  string `json:"terminal_id"`
+	Format      string `json:"format"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+type TerminalExitMessage struct {
+	TerminalID string `json:"terminal_id"`
+}
+
 type TerminalInputMessage struct {
 	TerminalID string `json:"terminal_id"`
 	Data       string `json:"data"` // base64 encoded
@@ -98,8 +168,25 @@ func (h *Handler) handleCreate(ctx context.Context, msg *protocol.Message, repli
 		req.Cols = 80
 	}
 	
+	workDir, err := h.manager.ResolveWorkDir(req.Workspace, req.WorkDir)
+	if err != nil {
+		h.sendError(replies, msg.ID, fmt.Sprintf("Invalid working directory: %v", err))
+		return
+	}
+	
+	display := Display{Term: req.Term, ColorTerm: req.ColorTerm, Locale: req.Locale}
+	if err := display.Validate(); err != nil {
+		h.sendError(replies, msg.ID, fmt.Sprintf("Invalid display: %v", err))
+		return
+	}
+	
 	// Create terminal
-	term, err := h.manager.CreateTerminal(req.WorkDir, req.Env)
+	term, err := h.manager.createTerminal(userFrom(ctx), terminalSpec{
+		workDir: workDir,
+		env:     req.Env,
+		display: display,
+		context: shellContext{participantID: participantFrom(ctx), workspace: h.manager.workspace(req.Workspace)},
+	})
 	if err != nil {
 		h.sendError(replies, msg.ID, fmt.Sprintf("Failed to create terminal: %v", err))
 		return
@@ -124,9 +211,89 @@ func (h *Handler) handleCreate(ctx context.Context, msg *protocol.Message, repli
 		Payload:       respData,
 		CorrelationID: msg.ID,
 	}
+}
+
+func (h *Handler) handleAttach(ctx context.Context, msg *protocol.Message, replies chan<- *protocol.Message) {
+	var req TerminalAttachRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		h.sendError(replies, msg.ID, "Invalid attach request")
+		return
+	}
+	
+	term, err := h.manager.attachTerminal(req.TerminalID)
+	if err != nil {
+		h.sendError(replies, msg.ID, fmt.Sprintf("Terminal not found: %v", err))
+		return
+	}
+	
+	respData, _ := json.Marshal(TerminalAttachResponse{
+		TerminalID: term.ID,
+		Success:    true,
+	})
+	replies <- &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          "terminal_attached",
+		Timestamp:     protocol.Now(),
+		Payload:       respData,
+		CorrelationID: msg.ID,
+	}
+}
+
+// handleDetach acknowledges a detach request. The connection handler owns
+// output subscriptions and stops streaming; the terminal keeps running.
+func (h *Handler) handleDetach(ctx context.Context, msg *protocol.Message, replies chan<- *protocol.Message) {
+	var req TerminalAttachRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		h.sendError(replies, msg.ID, "Invalid detach request")
+		return
+	}
+	
+	h.sendAck(replies, msg.ID)
+}
+
+// handleExport replies with a terminal's recording
+func (h *Handler) handleExport(ctx context.Context, msg *protocol.Message, replies chan<- *protocol.Message) {
+	var req TerminalExportRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		h.sendError(replies, msg.ID, "Invalid export request")
+		return
+	}
+	if req.Format == "" {
+		req.Format = PlaybackAsciicast
+	}
+	
+	term, err := h.manager.GetTerminal(req.TerminalID)
+	if err != nil {
+		h.sendError(replies, msg.ID, fmt.Sprintf("Terminal not found: %v", err))
+		return
+	}
+	
+	content, err := term.Export(req.Format)
+	if err != nil {
+		h.sendError(replies, msg.ID, fmt.Sprintf("Export failed: %v", err))
+		return
+	}
+	
+	resp := TerminalExportResponse{
+		TerminalID:  term.ID,
+		Format:      req.Format,
+		Filename:    "terminal-" + term.ID + ".cast",
+		ContentType: "application/x-asciicast",
+		Content:     string(content),
+	}
+	if req.Format == PlaybackText {
+		resp.Filename = "terminal-" + term.ID + ".txt"
+		resp.ContentType = "text/plain; charset=utf-8"
+	}
 	
-	// Start output streaming
-	go h.streamOutput(ctx, term, replies)
+	respData, _ := json.Marshal(resp)
+	replies <- &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          "terminal_export",
+		Timestamp:     protocol.Now(),
+		Payload:       respData,
+		CorrelationID: msg.ID,
+	}
 }
 
 func (h *Handler) handleInput(ctx context.Context, msg *protocol.Message, replies chan<- *protocol.Message) {
@@ -151,7 +318,7 @@ func (h *Handler) handleInput(ctx context.Context, msg *protocol.Message, replie
 	}
 	
 	// Write to terminal
-	if err := term.Write(data); err != nil {
+	if err := term.WriteAs(userFrom(ctx), data); err != nil {
 		h.sendError(replies, msg.ID, fmt.Sprintf("Write failed: %v", err))
 		return
 	}
@@ -201,7 +368,7 @@ func (h *Handler) handleClose(ctx context.Context, msg *protocol.Message, replie
 	}
 	
 	// Close terminal
-	if err := h.manager.CloseTerminal(req.TerminalID); err != nil {
+	if err := h.manager.closeTerminal(userFrom(ctx), req.TerminalID); err != nil {
 		h.sendError(replies, msg.ID, fmt.Sprintf("Close failed: %v", err))
 		return
 	}
@@ -229,42 +396,51 @@ func (h *Handler) handleList(ctx context.Context, msg *protocol.Message, replies
 	}
 }
 
-// streamOutput continuously sends terminal output to the client
-func (h *Handler) streamOutput(ctx context.Context, term *Terminal, replies chan<- *protocol.Message) {
-	outputChan := term.Read()
+// StreamOutput subscribes to a terminal's output and converts it to
+// terminal_output messages. The returned channel is closed when the terminal
+// exits or ctx is cancelled; callers tell the two apart by checking ctx.Err().
+func (h *Handler) StreamOutput(ctx context.Context, terminalID string) (<-chan *protocol.Message, error) {
+	term, err := h.manager.GetTerminal(terminalID)
+	if err != nil {
+		return nil, err
+	}
 	
-	for {
-		select {
-		case data, ok := <-outputChan:
-			if !ok {
-				// Terminal closed
-				return
-			}
-			
-			// Send output message
-			output := TerminalOutputMessage{
-				TerminalID: term.ID,
-				Data:       base64.StdEncoding.EncodeToString(data),
-				Stderr:     false,
-			}
-			
-			outputData, _ := json.Marshal(output)
-			
+	sub := term.Subscribe()
+	out := make(chan *protocol.Message, 64)
+	quotedID, _ := json.Marshal(term.ID)
+	
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		
+		for {
 			select {
-			case replies <- &protocol.Message{
-				ID:        uuid.New().String(),
-				Type:      "terminal_output",
-				Timestamp: protocol.Now(),
-				Payload:   outputData,
-			}:
+			case data, ok := <-sub.C:
+				if !ok {
+					// Terminal exited
+					return
+				}
+				
+				outputData := appendOutputPayload(nil, quotedID, data)
+				
+				select {
+				case out <- &protocol.Message{
+					ID:        uuid.New().String(),
+					Type:      "terminal_output",
+					Timestamp: protocol.Now(),
+					Payload:   outputData,
+				}:
+				case <-ctx.Done():
+					return
+				}
+				
 			case <-ctx.Done():
 				return
 			}
-			
-		case <-ctx.Done():
-			return
 		}
-	}
+	}()
+	
+	return out, nil
 }
 
 // Helper methods
@@ -6,6 +6,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/devtail/gateway/internal/audit"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
@@ -20,6 +23,16 @@ type Manager struct {
 	sessionTimeout   time.Duration
 	cleanupInterval  time.Duration
 	defaultShell     string
+	auditLogger      audit.Logger
+	outputRate       int // bytes per second per terminal, 0 for no cap
+	recordSize       int // output kept per terminal for export, 0 for none
+	workspaces       *workspace.Registry
+	onInput          func(n int)
+	onNotify         func(terminalID string, n Notification)
+	tmux             *Tmux // nil unless shells run in tmux, see WithTmuxServer
+	shellInit        *ShellInit
+	rcFile           string // the managed rc snippet, "" if not written
+	guard            CommandGuard
 	
 	// Lifecycle
 	ctx    context.Context
@@ -51,6 +64,78 @@ func WithDefaultShell(shell string) ManagerOption {
 	}
 }
 
+// WithWorkspaces binds terminals to workspaces: their working directory must
+// lie inside one, and defaults to the default workspace's root
+func WithWorkspaces(workspaces *workspace.Registry) ManagerOption {
+	return func(m *Manager) {
+		m.workspaces = workspaces
+	}
+}
+
+// WithAuditLogger enables the command audit trail for all terminals
+func WithAuditLogger(logger audit.Logger) ManagerOption {
+	return func(m *Manager) {
+		m.auditLogger = logger
+	}
+}
+
+// WithOutputRate caps each terminal's output at bytesPerSecond, see
+// WithOutputRateLimit; zero means no cap. The default is DefaultOutputRate.
+func WithOutputRate(bytesPerSecond int) ManagerOption {
+	return func(m *Manager) {
+		m.outputRate = bytesPerSecond
+	}
+}
+
+// WithRecordingSize keeps each terminal's latest maxBytes of output for
+// export, see WithRecording; zero records nothing. The default is
+// DefaultRecordingSize.
+func WithRecordingSize(maxBytes int) ManagerOption {
+	return func(m *Manager) {
+		m.recordSize = maxBytes
+	}
+}
+
+// WithInputCounter calls fn with the size of each input written to any
+// terminal, such as to report keystrokes as activity
+func WithInputCounter(fn func(n int)) ManagerOption {
+	return func(m *Manager) {
+		m.onInput = fn
+	}
+}
+
+// WithNotificationHandler calls fn with the desktop notifications programs
+// in any terminal ask for, see WithNotifications
+func WithNotificationHandler(fn func(terminalID string, n Notification)) ManagerOption {
+	return func(m *Manager) {
+		m.onNotify = fn
+	}
+}
+
+// WithShellInit gives new terminals the workspace context init configures
+func WithShellInit(init ShellInit) ManagerOption {
+	return func(m *Manager) {
+		m.shellInit = &init
+	}
+}
+
+// WithTmuxServer runs every terminal in a session of the tmux server x, so
+// shells survive the gateway restarting: terminals left by an earlier
+// gateway are listed and can be attached again. See Tmux.
+func WithTmuxServer(x *Tmux) ManagerOption {
+	return func(m *Manager) {
+		m.tmux = x
+	}
+}
+
+// WithGuard has guard vet the command lines entered in every terminal, see
+// WithCommandGuard
+func WithGuard(guard CommandGuard) ManagerOption {
+	return func(m *Manager) {
+		m.guard = guard
+	}
+}
+
 // NewManager creates a new terminal manager
 func NewManager(opts ...ManagerOption) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -60,7 +145,9 @@ func NewManager(opts ...ManagerOption) *Manager {
 		maxSessions:     10,
 		sessionTimeout:  30 * time.Minute,
 		cleanupInterval: 5 * time.Minute,
-		defaultShell:    "/bin/bash",
+		defaultShell:    DefaultShell,
+		outputRate:      DefaultOutputRate,
+		recordSize:      DefaultRecordingSize,
 		ctx:            ctx,
 		cancel:         cancel,
 		done:           make(chan struct{}),
@@ -71,35 +158,148 @@ func NewManager(opts ...ManagerOption) *Manager {
 		opt(m)
 	}
 	
+	if m.shellInit != nil {
+		rcFile, err := m.shellInit.write()
+		if err != nil {
+			// Terminals still get the variables
+			log.Warn().Err(err).Msg("terminals start without the devtail rc snippet")
+		}
+		m.rcFile = rcFile
+	}
+	
 	// Start cleanup routine
 	go m.cleanupLoop()
 	
 	return m
 }
 
+// ResolveWorkDir returns the directory a terminal in the named workspace and
+// workDir starts in. Without workspaces workDir is used as given.
+func (m *Manager) ResolveWorkDir(name, workDir string) (string, error) {
+	if m.workspaces == nil {
+		if name != "" {
+			return "", fmt.Errorf("workspaces are not enabled")
+		}
+		return workDir, nil
+	}
+	return m.workspaces.Resolve(name, workDir)
+}
+
+// terminalSpec is what a terminal is created with
+type terminalSpec struct {
+	workDir string
+	env     []string
+	display Display
+	context shellContext
+}
+
+// workspace returns the workspace called name, zero without workspaces
+func (m *Manager) workspace(name string) protocol.Workspace {
+	if m.workspaces == nil {
+		return protocol.Workspace{}
+	}
+	ws, _ := m.workspaces.Get(name)
+	return ws
+}
+
 // CreateTerminal creates a new terminal session
 func (m *Manager) CreateTerminal(workDir string, env []string) (*Terminal, error) {
+	return m.createTerminal("", terminalSpec{workDir: workDir, env: env})
+}
+
+// createTerminal creates a terminal on behalf of user, for the audit log
+func (m *Manager) createTerminal(user string, spec terminalSpec) (*Terminal, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
+	// Generate ID
+	id := uuid.New().String()
+	
+	term, err := m.startTerminal(id, spec)
+	if err != nil {
+		return nil, err
+	}
+	
+	m.audit(audit.EventTerminalOpened, id, spec.workDir, user)
+	
+	log.Info().
+		Str("id", id).
+		Str("workDir", spec.workDir).
+		Int("totalSessions", len(m.terminals)).
+		Msg("terminal created")
+	
+	return term, nil
+}
+
+// attachTerminal returns the running terminal id names. With tmux, a session
+// an earlier gateway left running is taken over.
+func (m *Manager) attachTerminal(id string) (*Terminal, error) {
+	term, err := m.GetTerminal(id)
+	if err == nil || m.tmux == nil || !m.tmux.has(id) {
+		return term, err
+	}
+	
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	if term, exists := m.terminals[id]; exists && term.IsRunning() {
+		// Taken over by another attach meanwhile
+		return term, nil
+	}
+	term, err = m.startTerminal(id, terminalSpec{})
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("id", id).Msg("terminal taken over from tmux")
+	return term, nil
+}
+
+// startTerminal starts terminal id and adds it; m.mu must be held
+func (m *Manager) startTerminal(id string, spec terminalSpec) (*Terminal, error) {
 	// Check session limit
 	if len(m.terminals) >= m.maxSessions {
 		return nil, fmt.Errorf("maximum sessions reached (%d)", m.maxSessions)
 	}
 	
-	// Generate ID
-	id := uuid.New().String()
-	
 	// Create terminal with options
 	opts := []TerminalOption{
 		WithShell(m.defaultShell),
-		WithWorkDir(workDir),
+		WithWorkDir(spec.workDir),
+		WithOutputRateLimit(m.outputRate),
+		WithRecording(m.recordSize),
+		WithDisplay(spec.display),
 	}
 	
+	// The context comes last, so the request's env cannot override it
+	env := append(append([]string(nil), spec.env...), spec.context.env(m.shellInit)...)
 	if len(env) > 0 {
 		opts = append(opts, WithEnvironment(env))
 	}
 	
+	if m.rcFile != "" {
+		opts = append(opts, WithRCFile(m.rcFile))
+	}
+	
+	if m.auditLogger != nil {
+		opts = append(opts, WithCommandAudit(m.auditLogger))
+	}
+	
+	if m.onInput != nil {
+		opts = append(opts, WithInputObserver(m.onInput))
+	}
+	
+	if m.guard != nil {
+		opts = append(opts, WithCommandGuard(m.guard))
+	}
+	
+	if m.onNotify != nil {
+		opts = append(opts, WithNotifications(m.onNotify))
+	}
+	
+	if m.tmux != nil {
+		opts = append(opts, WithTmux(m.tmux))
+	}
+	
 	term, err := NewTerminal(id, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("create terminal: %w", err)
@@ -112,13 +312,6 @@ func (m *Manager) CreateTerminal(workDir string, env []string) (*Terminal, error
 	
 	// Store in map
 	m.terminals[id] = term
-	
-	log.Info().
-		Str("id", id).
-		Str("workDir", workDir).
-		Int("totalSessions", len(m.terminals)).
-		Msg("terminal created")
-	
 	return term, nil
 }
 
@@ -141,6 +334,11 @@ func (m *Manager) GetTerminal(id string) (*Terminal, error) {
 
 // CloseTerminal closes a specific terminal
 func (m *Manager) CloseTerminal(id string) error {
+	return m.closeTerminal("", id)
+}
+
+// closeTerminal closes a terminal on behalf of user, for the audit log
+func (m *Manager) closeTerminal(user, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
@@ -154,9 +352,18 @@ func (m *Manager) CloseTerminal(id string) error {
 		return fmt.Errorf("close terminal: %w", err)
 	}
 	
+	// Closing the client only detached from the tmux session
+	if m.tmux != nil {
+		if err := m.tmux.kill(id); err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("failed to end tmux session")
+		}
+	}
+	
 	// Remove from map
 	delete(m.terminals, id)
 	
+	m.audit(audit.EventTerminalClosed, id, term.workDir, user)
+	
 	log.Info().
 		Str("id", id).
 		Int("remainingSessions", len(m.terminals)).
@@ -165,8 +372,14 @@ func (m *Manager) CloseTerminal(id string) error {
 	return nil
 }
 
-// ListTerminals returns all active terminal IDs
+// ListTerminals returns all active terminal IDs. With tmux, they include
+// the sessions left by an earlier gateway, which can be attached.
 func (m *Manager) ListTerminals() []string {
+	var detached []string
+	if m.tmux != nil {
+		detached = m.tmux.sessions()
+	}
+	
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
@@ -176,6 +389,11 @@ func (m *Manager) ListTerminals() []string {
 			ids = append(ids, id)
 		}
 	}
+	for _, id := range detached {
+		if _, exists := m.terminals[id]; !exists {
+			ids = append(ids, id)
+		}
+	}
 	
 	return ids
 }
@@ -210,6 +428,10 @@ func (m *Manager) Close() error {
 		if err := term.Close(); err != nil {
 			log.Error().Err(err).Str("id", id).Msg("error closing terminal")
 		}
+		// Shells in tmux keep running for the next gateway
+		if m.tmux == nil {
+			m.audit(audit.EventTerminalClosed, id, term.workDir, "")
+		}
 	}
 	m.terminals = make(map[string]*Terminal)
 	m.mu.Unlock()
@@ -266,8 +488,14 @@ func (m *Manager) cleanupIdleSessions() {
 	// Close idle terminals
 	for _, id := range toClose {
 		if term, exists := m.terminals[id]; exists {
+			// An idle shell in tmux is only detached, and can be
+			// attached again
+			detached := m.tmux != nil && term.IsRunning()
 			term.Close()
 			delete(m.terminals, id)
+			if !detached {
+				m.audit(audit.EventTerminalClosed, id, term.workDir, "")
+			}
 		}
 	}
 	
@@ -277,4 +505,18 @@ func (m *Manager) cleanupIdleSessions() {
 			Int("remaining", len(m.terminals)).
 			Msg("cleaned up idle terminals")
 	}
+}
+
+func (m *Manager) audit(eventType audit.EventType, terminalID, workDir, user string) {
+	if m.auditLogger == nil {
+		return
+	}
+	
+	m.auditLogger.Log(audit.Event{
+		Timestamp:  time.Now(),
+		Type:       eventType,
+		TerminalID: terminalID,
+		User:       user,
+		WorkDir:    workDir,
+	})
 }
\ No newline at end of file
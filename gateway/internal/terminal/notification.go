@@ -0,0 +1,131 @@
+package terminal
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxNotificationSize bounds the escape sequence of a notification;
+	// longer ones are ignored
+	maxNotificationSize = 1024
+
+	// notificationInterval is how soon after a notification a terminal's
+	// next one is passed on; ones sooner are dropped, so a loop printing
+	// them cannot flood every client
+	notificationInterval = time.Second
+)
+
+// Notification is a desktop notification a program in a terminal asked for,
+// such as "build finished"
+type Notification struct {
+	Title string
+	Body  string
+}
+
+// notificationScanner finds the escape sequences programs print to raise
+// desktop notifications in terminal output:
+//
+//	OSC 777 ; notify ; title ; body ST   (urxvt, foot, Windows Terminal)
+//	OSC 9 ; body ST                      (iTerm2)
+//
+// where OSC is ESC ] and ST is BEL or ESC \. Sequences may be split across
+// chunks of output.
+type notificationScanner struct {
+	state   int // escNone, escStart or escOSC
+	osc     []byte
+	sawEsc  bool // an ESC inside the OSC, which may start ST
+	tooLong bool
+}
+
+// scan returns the notifications completed in data
+func (s *notificationScanner) scan(data []byte) []Notification {
+	var found []Notification
+	for _, ch := range data {
+		switch s.state {
+		case escNone:
+			if ch == keyEscape {
+				s.state = escStart
+			}
+		case escStart:
+			switch ch {
+			case ']':
+				s.state = escOSC
+				s.osc, s.sawEsc, s.tooLong = s.osc[:0], false, false
+			case keyEscape:
+			default:
+				s.state = escNone
+			}
+		case escOSC:
+			switch {
+			case ch == 0x07 || (s.sawEsc && ch == '\\'):
+				s.state = escNone
+				if n, ok := parseNotification(s.osc); ok && !s.tooLong {
+					found = append(found, n)
+				}
+			case s.sawEsc:
+				// Not ST: the OSC was cut short by another sequence
+				s.state = escNone
+				if ch == ']' {
+					s.state = escOSC
+					s.osc, s.sawEsc, s.tooLong = s.osc[:0], false, false
+				}
+			case ch == keyEscape:
+				s.sawEsc = true
+			case len(s.osc) >= maxNotificationSize:
+				s.tooLong = true
+			default:
+				s.osc = append(s.osc, ch)
+			}
+		}
+	}
+	return found
+}
+
+// parseNotification reads a notification from the body of an OSC, reporting
+// false if it is some other command
+func parseNotification(osc []byte) (Notification, bool) {
+	command, rest, _ := bytes.Cut(osc, []byte(";"))
+	switch string(command) {
+	case "777":
+		kind, rest, _ := bytes.Cut(rest, []byte(";"))
+		if string(kind) != "notify" {
+			return Notification{}, false
+		}
+		title, body, _ := bytes.Cut(rest, []byte(";"))
+		n := Notification{Title: cleanNotification(title), Body: cleanNotification(body)}
+		return n, n.Title != "" || n.Body != ""
+	case "9":
+		// ConEmu uses OSC 9 ; n ; ... for other commands, such as
+		// progress
+		if command, _, _ := bytes.Cut(rest, []byte(";")); isDigits(command) {
+			return Notification{}, false
+		}
+		n := Notification{Body: cleanNotification(rest)}
+		return n, n.Body != ""
+	}
+	return Notification{}, false
+}
+
+func isDigits(b []byte) bool {
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// cleanNotification makes text from a program safe to show: valid UTF-8
+// without control characters
+func cleanNotification(text []byte) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(string(text), "�"))
+	return strings.TrimSpace(clean)
+}
@@ -0,0 +1,97 @@
+package terminal
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotificationScanner(t *testing.T) {
+	tests := map[string]struct {
+		chunks []string
+		want   []Notification
+	}{
+		"osc 777": {
+			[]string{"done\x1b]777;notify;make;build finished\x07$ "},
+			[]Notification{{Title: "make", Body: "build finished"}},
+		},
+		"osc 9 with ST": {
+			[]string{"\x1b]9;tests passed\x1b\\"},
+			[]Notification{{Body: "tests passed"}},
+		},
+		"split across chunks": {
+			[]string{"\x1b", "]777;noti", "fy;deploy;ok\x1b", "\\"},
+			[]Notification{{Title: "deploy", Body: "ok"}},
+		},
+		"control characters removed": {
+			[]string{"\x1b]9;a\tb\rc\x07"},
+			[]Notification{{Body: "abc"}},
+		},
+		"progress is not a notification": {
+			[]string{"\x1b]9;4;1;50\x07"},
+			nil,
+		},
+		"window titles are not": {
+			[]string{"\x1b]0;vim\x07\x1b]777;preexec\x07"},
+			nil,
+		},
+		"cut short by another sequence": {
+			[]string{"\x1b]9;lost\x1b[0m\x1b]9;kept\x07"},
+			[]Notification{{Body: "kept"}},
+		},
+		"too long": {
+			[]string{"\x1b]9;" + strings.Repeat("x", maxNotificationSize) + "\x07"},
+			nil,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var s notificationScanner
+			var got []Notification
+			for _, chunk := range tt.chunks {
+				got = append(got, s.scan([]byte(chunk))...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTerminalPassesNotificationsOn(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	notified := make(chan Notification, 4)
+	term, err := NewTerminal("test", WithShell("/bin/sh"), WithNotifications(func(terminalID string, n Notification) {
+		if terminalID == "test" {
+			notified <- n
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	// The second comes too soon after the first and is dropped
+	term.Write([]byte(`printf '\033]777;notify;make;done\007\033]9;again\007'` + "\n"))
+	select {
+	case n := <-notified:
+		if n.Title != "make" || n.Body != "done" {
+			t.Fatalf("unexpected notification %+v", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not passed on")
+	}
+	select {
+	case n := <-notified:
+		t.Fatalf("expected the second notification dropped, got %+v", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,24 @@
+package terminal
+
+import (
+	"encoding/base64"
+	"slices"
+)
+
+// appendOutputPayload appends the JSON of a TerminalOutputMessage for data
+// to dst, as json.Marshal would write it, growing dst at most once. Terminal
+// output is the most frequent message, so it skips reflection and the
+// intermediate base64 string. quotedID is the terminal ID as a JSON string.
+func appendOutputPayload(dst, quotedID, data []byte) []byte {
+	const prefix, middle, suffix = `{"terminal_id":`, `,"data":"`, `"}`
+	encoded := base64.StdEncoding.EncodedLen(len(data))
+	dst = slices.Grow(dst, len(prefix)+len(quotedID)+len(middle)+encoded+len(suffix))
+
+	dst = append(dst, prefix...)
+	dst = append(dst, quotedID...)
+	dst = append(dst, middle...)
+	start := len(dst)
+	dst = dst[:start+encoded]
+	base64.StdEncoding.Encode(dst[start:], data)
+	return append(dst, suffix...)
+}
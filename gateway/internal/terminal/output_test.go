@@ -0,0 +1,51 @@
+package terminal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestOutputPayloadMatchesJSON(t *testing.T) {
+	for _, tc := range []struct{ id, data string }{
+		{"3f1c9a4e-6b7d-4c2a-9e8f-1a2b3c4d5e6f", "ls -la\r\n\x1b[0m"},
+		{"<term&1>", ""},
+		{"t", "\x00\xff\xfe binary"},
+	} {
+		quotedID, _ := json.Marshal(tc.id)
+		want, _ := json.Marshal(TerminalOutputMessage{
+			TerminalID: tc.id,
+			Data:       base64.StdEncoding.EncodeToString([]byte(tc.data)),
+		})
+		if got := appendOutputPayload(nil, quotedID, []byte(tc.data)); string(got) != string(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+// BenchmarkOutputPayload compares building a terminal_output payload with
+// json.Marshal, as StreamOutput used to, against appendOutputPayload
+func BenchmarkOutputPayload(b *testing.B) {
+	id := "3f1c9a4e-6b7d-4c2a-9e8f-1a2b3c4d5e6f"
+	data := make([]byte, 512)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+
+	b.Run("json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.Marshal(TerminalOutputMessage{
+				TerminalID: id,
+				Data:       base64.StdEncoding.EncodeToString(data),
+			})
+		}
+	})
+	b.Run("append", func(b *testing.B) {
+		quotedID, _ := json.Marshal(id)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			appendOutputPayload(nil, quotedID, data)
+		}
+	})
+}
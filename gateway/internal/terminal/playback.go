@@ -0,0 +1,298 @@
+package terminal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/devtail/gateway/internal/redact"
+)
+
+// Formats a terminal's recording can be exported in
+const (
+	// PlaybackAsciicast is an asciicast v2 file, played back with
+	// asciinema play or the asciinema web player
+	PlaybackAsciicast = "asciicast"
+
+	// PlaybackText is the output as plain text, escape sequences removed,
+	// with the time elapsed marked wherever output paused
+	PlaybackText = "text"
+)
+
+const (
+	// DefaultRecordingSize is how much of each terminal's latest output is
+	// kept for export
+	DefaultRecordingSize = 1 << 20
+
+	// MaxPlaybackSize caps an exported recording, which is sent in a single
+	// message; older output is left out of a larger one
+	MaxPlaybackSize = 768 << 10
+
+	// playbackPause is how long output must pause for the text export to
+	// mark the time
+	playbackPause = time.Second
+)
+
+// playbackEvent is a chunk of output or a resize, at its offset from the
+// start of the recording
+type playbackEvent struct {
+	at     time.Duration
+	resize bool
+	data   []byte // output, or "COLSxROWS" for a resize
+}
+
+// recording keeps a terminal's latest output with its timing, and its size
+// changes, for export. The oldest events are dropped past max bytes.
+type recording struct {
+	start      time.Time
+	rows, cols uint16 // size before the first event kept
+	events     []playbackEvent
+	size       int
+	max        int
+	truncated  bool
+}
+
+func newRecording(max int, rows, cols uint16) *recording {
+	return &recording{start: time.Now(), rows: rows, cols: cols, max: max}
+}
+
+// output records a chunk of output. data is copied: read chunks are cut
+// from slabs a small chunk would otherwise keep alive.
+func (r *recording) output(now time.Time, data []byte) {
+	r.add(playbackEvent{at: now.Sub(r.start), data: append([]byte(nil), data...)})
+}
+
+// resized records a size change
+func (r *recording) resized(now time.Time, rows, cols uint16) {
+	r.add(playbackEvent{at: now.Sub(r.start), resize: true, data: []byte(fmt.Sprintf("%dx%d", cols, rows))})
+}
+
+func (r *recording) add(event playbackEvent) {
+	r.events = append(r.events, event)
+	r.size += len(event.data)
+
+	drop := 0
+	for r.size > r.max && drop < len(r.events)-1 {
+		dropped := r.events[drop]
+		if dropped.resize {
+			fmt.Sscanf(string(dropped.data), "%dx%d", &r.cols, &r.rows)
+		}
+		r.size -= len(dropped.data)
+		drop++
+	}
+	if drop > 0 {
+		r.events = append(r.events[:0], r.events[drop:]...)
+		r.truncated = true
+	}
+}
+
+// Export renders the terminal's recording in format, PlaybackAsciicast or
+// PlaybackText. Exports leave the VM, so secrets are redacted.
+func (t *Terminal) Export(format string) ([]byte, error) {
+	if format != PlaybackAsciicast && format != PlaybackText {
+		return nil, fmt.Errorf("unknown playback format %q", format)
+	}
+
+	t.subsMu.Lock()
+	if t.recording == nil {
+		t.subsMu.Unlock()
+		return nil, fmt.Errorf("terminal %s is not recorded", t.ID)
+	}
+	r := *t.recording
+	r.events = append([]playbackEvent(nil), r.events...)
+	t.subsMu.Unlock()
+
+	if format == PlaybackText {
+		return r.text(), nil
+	}
+	return r.asciicast(t.termEnv()), nil
+}
+
+// asciicast renders the recording as an asciicast v2 file: a header line,
+// then one line per event
+func (r *recording) asciicast(term string) []byte {
+	var lines [][]byte
+	var pending []byte
+	for _, event := range r.events {
+		kind := "o"
+		data := event.data
+		if event.resize {
+			kind = "r"
+		} else {
+			// A chunk may end inside a UTF-8 sequence that the next
+			// completes; JSON strings would mangle the halves
+			data, pending = completeRunes(append(pending, data...))
+			data = []byte(redact.String(string(data)))
+		}
+		line, _ := json.Marshal([]any{event.at.Seconds(), kind, string(data)})
+		lines = append(lines, line)
+	}
+
+	// Keep the latest events that fit, starting at the size they were
+	// played at
+	size, first := 0, len(lines)
+	for first > 0 && size+len(lines[first-1])+1 <= MaxPlaybackSize-1024 {
+		first--
+		size += len(lines[first]) + 1
+	}
+	rows, cols := r.rows, r.cols
+	for _, event := range r.events[:first] {
+		if event.resize {
+			fmt.Sscanf(string(event.data), "%dx%d", &cols, &rows)
+		}
+	}
+
+	header, _ := json.Marshal(map[string]any{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": r.start.Unix(),
+		"env":       map[string]string{"TERM": term},
+	})
+	var b bytes.Buffer
+	b.Write(header)
+	b.WriteByte('\n')
+	for _, line := range lines[first:] {
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// text renders the recording as plain text, marking the time after pauses
+func (r *recording) text() []byte {
+	var p plainText
+	if r.truncated {
+		p.buf = append(p.buf, "[earlier output not recorded]\n"...)
+	}
+	var last time.Duration
+	marked := false
+	for _, event := range r.events {
+		if event.resize {
+			continue
+		}
+		if !marked || event.at-last >= playbackPause {
+			p.mark(formatElapsed(event.at))
+			marked = true
+		}
+		last = event.at
+		p.write(event.data)
+	}
+
+	text := redact.String(string(p.buf))
+	if len(text) > MaxPlaybackSize {
+		text = text[len(text)-MaxPlaybackSize:]
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+		text = "[earlier output left out]\n" + text
+	}
+	return []byte(text)
+}
+
+// formatElapsed formats d as minutes and seconds, e.g. 01:05.3
+func formatElapsed(d time.Duration) string {
+	d = d.Round(100 * time.Millisecond)
+	return fmt.Sprintf("%02d:%04.1f", int(d.Minutes()), (d % time.Minute).Seconds())
+}
+
+// completeRunes splits data before a UTF-8 sequence cut short at its end
+func completeRunes(data []byte) (complete, rest []byte) {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		start := len(data) - i
+		if !utf8.RuneStart(data[start]) {
+			continue
+		}
+		if !utf8.FullRune(data[start:]) {
+			return data[:start], append([]byte(nil), data[start:]...)
+		}
+		break
+	}
+	return data, nil
+}
+
+// plainText turns terminal output into plain text: escape sequences and
+// control characters other than newlines and tabs are removed. A carriage
+// return not followed by a newline starts the line again, as progress bars
+// use them.
+type plainText struct {
+	buf   []byte
+	state int
+	cr    bool
+}
+
+// mark starts a line with [elapsed]
+func (p *plainText) mark(elapsed string) {
+	if p.cr {
+		p.buf = p.buf[:bytes.LastIndexByte(p.buf, '\n')+1]
+		p.cr = false
+	}
+	if len(p.buf) > 0 && p.buf[len(p.buf)-1] != '\n' {
+		p.buf = append(p.buf, '\n')
+	}
+	p.buf = append(p.buf, '[')
+	p.buf = append(p.buf, elapsed...)
+	p.buf = append(p.buf, "]\n"...)
+}
+
+// write adds a chunk of output; sequences may continue in the next chunk
+func (p *plainText) write(data []byte) {
+	for _, ch := range data {
+		switch p.state {
+		case escStart:
+			switch ch {
+			case '[':
+				p.state = escCSI
+			case ']':
+				p.state = escOSC
+			case 'O', '(', ')':
+				p.state = escSS3
+			default:
+				p.state = escNone
+			}
+			continue
+		case escCSI:
+			if ch >= 0x40 && ch <= 0x7e {
+				p.state = escNone
+			}
+			continue
+		case escSS3:
+			p.state = escNone
+			continue
+		case escOSC:
+			// OSC ends with BEL or ESC \
+			if ch == 0x07 {
+				p.state = escNone
+			} else if ch == keyEscape {
+				p.state = escStart
+			}
+			continue
+		}
+
+		if p.cr && ch != '\n' && ch != '\r' {
+			p.buf = p.buf[:bytes.LastIndexByte(p.buf, '\n')+1]
+		}
+		p.cr = false
+		switch {
+		case ch == keyEscape:
+			p.state = escStart
+		case ch == '\r':
+			p.cr = true
+		case ch == '\n', ch == '\t', ch >= 0x20:
+			p.buf = append(p.buf, ch)
+		}
+	}
+}
+
+// termEnv returns the TERM the terminal's shell runs with
+func (t *Terminal) termEnv() string {
+	for i := len(t.env) - 1; i >= 0; i-- {
+		if term, ok := strings.CutPrefix(t.env[i], "TERM="); ok {
+			return term
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecording records events at the given offsets from its start
+func testRecording(max int, events ...playbackEvent) *recording {
+	r := newRecording(max, 24, 80)
+	for _, event := range events {
+		if event.resize {
+			var rows, cols uint16
+			fmt.Sscanf(string(event.data), "%dx%d", &cols, &rows)
+			r.resized(r.start.Add(event.at), rows, cols)
+		} else {
+			r.output(r.start.Add(event.at), event.data)
+		}
+	}
+	return r
+}
+
+func TestPlaybackAsciicast(t *testing.T) {
+	r := testRecording(1<<20,
+		playbackEvent{at: 0, resize: true, data: []byte("120x40")},
+		playbackEvent{at: 100 * time.Millisecond, data: []byte("$ echo h\xc3")},
+		playbackEvent{at: 200 * time.Millisecond, data: []byte("\xa9\r\n")},
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(r.asciicast("xterm-256color")))
+	var header struct {
+		Version int               `json:"version"`
+		Width   int               `json:"width"`
+		Height  int               `json:"height"`
+		Env     map[string]string `json:"env"`
+	}
+	scanner.Scan()
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Env["TERM"] != "xterm-256color" {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	var events [][]any
+	for scanner.Scan() {
+		var event []any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 || events[0][1] != "r" || events[0][2] != "120x40" {
+		t.Fatalf("expected a resize then output, got %v", events)
+	}
+	// The é split across chunks arrives whole
+	if events[1][2] != "$ echo h" || events[2][2] != "é\r\n" || events[2][0].(float64) != 0.2 {
+		t.Errorf("unexpected output events %v", events[1:])
+	}
+}
+
+func TestPlaybackText(t *testing.T) {
+	r := testRecording(1<<20,
+		playbackEvent{at: 0, data: []byte("\x1b]0;title\x07$ make\r\n\x1b[32mbuil")},
+		playbackEvent{at: 300 * time.Millisecond, data: []byte("ding\x1b[0m\r\n10%\r")},
+		playbackEvent{at: 2500 * time.Millisecond, data: []byte("100%\r\ndone\r\n")},
+	)
+
+	want := "[00:00.0]\n$ make\nbuilding\n[00:02.5]\n100%\ndone\n"
+	if got := string(r.text()); got != want {
+		t.Errorf("expected\n%q, got\n%q", want, got)
+	}
+}
+
+func TestRecordingDropsOldestOutput(t *testing.T) {
+	r := testRecording(10,
+		playbackEvent{at: 0, resize: true, data: []byte("100x30")},
+		playbackEvent{at: time.Millisecond, data: []byte("first\n")},
+		playbackEvent{at: 2 * time.Millisecond, data: []byte("second\n")},
+	)
+	if len(r.events) != 1 || string(r.events[0].data) != "second\n" || !r.truncated {
+		t.Fatalf("expected only the latest output kept, got %+v", r.events)
+	}
+	if r.cols != 100 || r.rows != 30 {
+		t.Errorf("expected the dropped resize to set the starting size, got %dx%d", r.cols, r.rows)
+	}
+	if text := string(r.text()); !strings.HasPrefix(text, "[earlier output not recorded]\n") {
+		t.Errorf("expected the text to say output is missing, got %q", text)
+	}
+}
+
+func TestTerminalExport(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	term, err := NewTerminal("test", WithShell("/bin/sh"), WithRecording(DefaultRecordingSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+	var output strings.Builder
+	term.Write([]byte("echo rec$((1+1))orded\n"))
+	waitForOutput(t, sub, &output, "rec2orded")
+
+	for _, format := range []string{PlaybackAsciicast, PlaybackText} {
+		content, err := term.Export(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), "rec2orded") {
+			t.Errorf("expected the %s export to hold the output, got %q", format, content)
+		}
+	}
+	if _, err := term.Export("gif"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+
+	unrecorded, _ := NewTerminal("plain", WithShell("/bin/sh"))
+	if _, err := unrecorded.Export(PlaybackText); err == nil {
+		t.Error("expected a terminal without recording to fail")
+	}
+}
@@ -1,26 +1,35 @@
 package terminal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/creack/pty"
+	"github.com/devtail/gateway/internal/audit"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// readChunkSize is the most output one PTY read returns
+	readChunkSize = 4096
+
+	// readSlabSize is how much output is allocated at once for reads
+	readSlabSize = 64 << 10
+)
+
 // Terminal represents a PTY-based terminal session
 type Terminal struct {
 	ID       string
 	cmd      *exec.Cmd
-	ptmx     *os.File
-	tty      *os.File
+	console  *console
 	
 	// Size
 	rows     uint16
@@ -28,23 +37,67 @@ type Terminal struct {
 	
 	// I/O channels
 	input    chan []byte
-	output   chan []byte
 	resize   chan WindowSize
 	
+	// Output fan-out
+	subsMu       sync.Mutex
+	subscribers  map[uint64]*Subscription
+	nextSubID    uint64
+	scrollback   []byte
+	outputClosed bool
+	recording    *recording // nil unless recorded, see Export
+	recordSize   int
+	
 	// State
 	mu       sync.RWMutex
 	running  atomic.Bool
 	lastUsed time.Time
 	
 	// Lifecycle
-	ctx      context.Context
-	cancel   context.CancelFunc
-	done     chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}   // closed when the shell process exits
+	started   atomic.Bool
+	loops     sync.WaitGroup  // read/write loops
+	resizing  sync.WaitGroup  // resize loop, over before the PTY closes
+	closeOnce sync.Once
 	
 	// Options
 	shell    string
+	args     []string
+	rcFile   string
 	env      []string
+	baseEnv  int // how much of env is the gateway's own
 	workDir  string
+	display  Display
+	tmux     *Tmux
+	
+	// Auditing
+	auditLogger audit.Logger
+	recorder    *commandRecorder
+	writer      atomic.Pointer[string] // user whose input was written last
+	paneTTY     atomic.Pointer[string] // terminal device of the tmux pane
+	
+	// Command vetting. guardMu orders input while an entered line waits for
+	// the guard's decision, with the input after it held back.
+	guard    CommandGuard
+	guardMu  sync.Mutex
+	guarded  lineEditor
+	holding  bool
+	held     []byte
+	
+	// Told the size of each input written, for activity reporting
+	onInput func(n int)
+	
+	// Told of the desktop notifications programs ask for, see Notification
+	onNotify     func(terminalID string, n Notification)
+	notices      notificationScanner
+	lastNotified time.Time
+	
+	// Output rate cap, nil for none. emitMu orders the read loop's output
+	// with the throttle's markers.
+	throttle *outputThrottle
+	emitMu   sync.Mutex
 }
 
 // WindowSize represents terminal dimensions
@@ -79,6 +132,89 @@ func WithWorkDir(dir string) TerminalOption {
 	}
 }
 
+// WithCommandAudit records commands entered in the terminal to the audit log
+func WithCommandAudit(logger audit.Logger) TerminalOption {
+	return func(t *Terminal) {
+		t.auditLogger = logger
+	}
+}
+
+// CommandGuard vets a command line typed into a terminal when the user
+// presses enter. It returns nil to let the line run, or a channel the
+// decision arrives on; until then the enter and any input after it are held
+// back from the shell. command is empty when the line could not be read back
+// from the keystrokes, as when it was recalled from history, and may be
+// anything.
+type CommandGuard func(terminalID, command string) <-chan bool
+
+// WithCommandGuard has guard vet each command line before the shell runs it
+func WithCommandGuard(guard CommandGuard) TerminalOption {
+	return func(t *Terminal) {
+		t.guard = guard
+	}
+}
+
+// WithInputObserver calls fn with the size of each input written to the
+// terminal
+func WithInputObserver(fn func(n int)) TerminalOption {
+	return func(t *Terminal) {
+		t.onInput = fn
+	}
+}
+
+// WithNotifications calls fn with each desktop notification a program in the
+// terminal asks for
+func WithNotifications(fn func(terminalID string, n Notification)) TerminalOption {
+	return func(t *Terminal) {
+		t.onNotify = fn
+	}
+}
+
+// WithOutputRateLimit caps the terminal's output at bytesPerSecond; output
+// past the cap is dropped and replaced by a marker saying how much. Zero
+// means no cap.
+func WithOutputRateLimit(bytesPerSecond int) TerminalOption {
+	return func(t *Terminal) {
+		t.throttle = nil
+		if bytesPerSecond > 0 {
+			t.throttle = newOutputThrottle(bytesPerSecond)
+		}
+	}
+}
+
+// WithRecording keeps the terminal's latest maxBytes of output with its
+// timing, so it can be exported for playback; zero records nothing
+func WithRecording(maxBytes int) TerminalOption {
+	return func(t *Terminal) {
+		t.recordSize = maxBytes
+	}
+}
+
+// WithRCFile has the shell source the managed rc snippet at path when it
+// starts, see ShellInit
+func WithRCFile(path string) TerminalOption {
+	return func(t *Terminal) {
+		t.rcFile = path
+	}
+}
+
+// WithDisplay sets the terminal type, color depth and locale the shell is
+// told about; what d leaves out comes from DefaultDisplay. d should have
+// passed Validate.
+func WithDisplay(d Display) TerminalOption {
+	return func(t *Terminal) {
+		t.display = d
+	}
+}
+
+// WithTmux runs the shell in a session of the tmux server x, named after
+// the terminal, attaching to it if it is already running
+func WithTmux(x *Tmux) TerminalOption {
+	return func(t *Terminal) {
+		t.tmux = x
+	}
+}
+
 // NewTerminal creates a new terminal session
 func NewTerminal(id string, opts ...TerminalOption) (*Terminal, error) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -86,30 +222,42 @@ func NewTerminal(id string, opts ...TerminalOption) (*Terminal, error) {
 	t := &Terminal{
 		ID:       id,
 		input:    make(chan []byte, 256),
-		output:   make(chan []byte, 256),
 		resize:   make(chan WindowSize, 1),
+		subscribers: make(map[uint64]*Subscription),
 		ctx:      ctx,
 		cancel:   cancel,
 		done:     make(chan struct{}),
-		shell:    "/bin/bash",
+		shell:    DefaultShell,
 		env:      os.Environ(),
 		rows:     24,
 		cols:     80,
 		lastUsed: time.Now(),
 	}
 	
+	t.baseEnv = len(t.env)
+	
 	// Apply options
 	for _, opt := range opts {
 		opt(t)
 	}
 	
 	// Add custom environment
-	t.env = append(t.env,
-		"TERM=xterm-256color",
-		"LANG=en_US.UTF-8",
-		"LC_ALL=en_US.UTF-8",
-		fmt.Sprintf("DEVTAIL_TERMINAL_ID=%s", id),
-	)
+	t.env = append(t.env, t.display.withDefaults().env()...)
+	t.env = append(t.env, fmt.Sprintf("DEVTAIL_TERMINAL_ID=%s", id))
+	
+	if t.rcFile != "" {
+		args, env := rcArgs(t.shell, t.rcFile)
+		t.args = args
+		t.env = append(t.env, env...)
+	}
+	
+	if t.auditLogger != nil {
+		t.recorder = newCommandRecorder(id, t.workDir, t.auditLogger)
+	}
+	
+	if t.recordSize > 0 {
+		t.recording = newRecording(t.recordSize, t.rows, t.cols)
+	}
 	
 	return t, nil
 }
@@ -121,48 +269,30 @@ func (t *Terminal) Start() error {
 	}
 	
 	// Create command
-	t.cmd = exec.CommandContext(t.ctx, t.shell)
+	if t.tmux != nil {
+		t.cmd = t.tmux.command(t.ctx, t.ID, append([]string{t.shell}, t.args...), t.workDir, t.sessionEnv())
+	} else {
+		t.cmd = exec.CommandContext(t.ctx, t.shell, t.args...)
+	}
 	t.cmd.Env = t.env
 	
 	if t.workDir != "" {
 		t.cmd.Dir = t.workDir
 	}
 	
-	// Start with PTY
-	ptmx, tty, err := pty.Open()
+	// Start with a PTY, or a ConPTY pseudo console on Windows
+	console, err := startConsole(t.ctx, t.cmd, t.rows, t.cols)
 	if err != nil {
-		return fmt.Errorf("open pty: %w", err)
-	}
-	
-	t.ptmx = ptmx
-	t.tty = tty
-	
-	// Set initial size
-	if err := t.setSize(t.rows, t.cols); err != nil {
-		ptmx.Close()
-		tty.Close()
-		return fmt.Errorf("set initial size: %w", err)
-	}
-	
-	// Connect command to PTY
-	t.cmd.Stdin = tty
-	t.cmd.Stdout = tty
-	t.cmd.Stderr = tty
-	t.cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setctty: true,
-		Setsid:  true,
-	}
-	
-	// Start command
-	if err := t.cmd.Start(); err != nil {
-		ptmx.Close()
-		tty.Close()
-		return fmt.Errorf("start command: %w", err)
+		return err
 	}
+	t.console = console
 	
 	t.running.Store(true)
+	t.started.Store(true)
 	
 	// Start I/O loops
+	t.loops.Add(2)
+	t.resizing.Add(1)
 	go t.readLoop()
 	go t.writeLoop()
 	go t.resizeLoop()
@@ -178,6 +308,49 @@ func (t *Terminal) Start() error {
 	return nil
 }
 
+// sessionEnv returns the variables the terminal adds to the gateway's
+// environment, which a tmux session has to be given explicitly. TERM is left
+// to tmux, which emulates its own terminal.
+func (t *Terminal) sessionEnv() []string {
+	var env []string
+	for _, kv := range t.env[t.baseEnv:] {
+		if !strings.HasPrefix(kv, "TERM=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// hidesInput reports whether the shell side of the terminal reads a line
+// without echoing it, as programs reading passwords do. Under tmux the
+// console is the client's, which tmux keeps raw, so the pane's terminal is
+// asked instead. When the state cannot be read input is not hidden.
+func (t *Terminal) hidesInput() bool {
+	if t.tmux != nil {
+		path := t.paneTTY.Load()
+		if path == nil {
+			tty, err := t.tmux.paneTTY(t.ID)
+			if err != nil {
+				return false
+			}
+			path = &tty
+			t.paneTTY.Store(path)
+		}
+		return ttyHidesInput(*path)
+	}
+	if t.console == nil {
+		return false
+	}
+	return t.console.hidesInput()
+}
+
+// WriteAs sends input from user to the terminal; commands entered are
+// recorded as theirs
+func (t *Terminal) WriteAs(user string, data []byte) error {
+	t.writer.Store(&user)
+	return t.Write(data)
+}
+
 // Write sends input to the terminal
 func (t *Terminal) Write(data []byte) error {
 	if !t.running.Load() {
@@ -185,9 +358,44 @@ func (t *Terminal) Write(data []byte) error {
 	}
 	
 	t.updateLastUsed()
+	if t.guard == nil {
+		return t.send(data)
+	}
+	
+	t.guardMu.Lock()
+	defer t.guardMu.Unlock()
+	if t.holding {
+		t.held = append(t.held, data...)
+		return nil
+	}
+	return t.send(t.vet(data))
+}
+
+// send queues input for the shell
+func (t *Terminal) send(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	
+	// Whether entered lines are hidden is read before the shell sees them,
+	// as a program reading a password turns echo back on once it has the line
+	hidden := false
+	if t.recorder != nil && bytes.ContainsAny(data, "\r\n") {
+		hidden = t.hidesInput()
+	}
 	
 	select {
 	case t.input <- data:
+		if t.recorder != nil {
+			var user string
+			if writer := t.writer.Load(); writer != nil {
+				user = *writer
+			}
+			t.recorder.Feed(user, data, hidden)
+		}
+		if t.onInput != nil {
+			t.onInput(len(data))
+		}
 		return nil
 	case <-t.ctx.Done():
 		return fmt.Errorf("terminal closed")
@@ -196,9 +404,53 @@ func (t *Terminal) Write(data []byte) error {
 	}
 }
 
-// Read returns the output channel for reading terminal output
-func (t *Terminal) Read() <-chan []byte {
-	return t.output
+// vet returns data up to the first entered line the guard wants to decide
+// on, holding the rest back until it has; the caller holds guardMu
+func (t *Terminal) vet(data []byte) []byte {
+	for i, ch := range string(data) {
+		command, known, entered := t.guarded.feed(ch)
+		if !entered || known && command == "" {
+			continue
+		}
+		if !known {
+			command = ""
+		}
+		decision := t.guard(t.ID, command)
+		if decision == nil {
+			continue
+		}
+		t.holding = true
+		t.held = append([]byte(nil), data[i:]...)
+		go t.awaitDecision(decision)
+		return data[:i]
+	}
+	return data
+}
+
+// awaitDecision releases the held input once the guard has decided: an
+// approved line runs and the input after it is vetted in turn, a rejected
+// one is abandoned along with everything typed after it
+func (t *Terminal) awaitDecision(decision <-chan bool) {
+	var approved bool
+	select {
+	case approved = <-decision:
+	case <-t.ctx.Done():
+		return
+	}
+	
+	t.guardMu.Lock()
+	defer t.guardMu.Unlock()
+	held := t.held
+	t.holding, t.held = false, nil
+	if !approved {
+		// Interrupting clears the line at the shell's prompt
+		t.send([]byte{keyCtrlC})
+		return
+	}
+	if err := t.send(held[:1]); err != nil {
+		return
+	}
+	t.send(t.vet(held[1:]))
 }
 
 // Resize changes the terminal size
@@ -215,37 +467,52 @@ func (t *Terminal) Resize(rows, cols uint16) error {
 	}
 }
 
-// Close terminates the terminal session
+// Close terminates the terminal session. Shutdown is driven by cancelling the
+// terminal's context; the input and resize channels are never closed, so
+// concurrent Write and Resize calls fail cleanly instead of panicking. Close
+// is safe to call more than once and from multiple goroutines.
 func (t *Terminal) Close() error {
-	t.cancel()
-	
-	// Wait for graceful shutdown
-	select {
-	case <-t.done:
-		// Clean shutdown
-	case <-time.After(5 * time.Second):
-		// Force kill if needed
-		if t.cmd != nil && t.cmd.Process != nil {
-			t.cmd.Process.Kill()
+	t.closeOnce.Do(func() {
+		// Cancelling the context also kills the shell (exec.CommandContext)
+		t.cancel()
+		
+		if t.started.Load() {
+			select {
+			case <-t.done:
+				// Clean shutdown
+			case <-time.After(5 * time.Second):
+				// Force kill if needed
+				t.console.kill()
+				<-t.done
+			}
 		}
-	}
-	
-	// Cleanup
-	if t.ptmx != nil {
-		t.ptmx.Close()
-	}
-	if t.tty != nil {
-		t.tty.Close()
-	}
-	
-	close(t.input)
-	close(t.output)
-	close(t.resize)
-	
-	log.Info().Str("id", t.ID).Msg("terminal closed")
+		
+		// The resize loop uses the PTY's descriptor, so it has to be done
+		// before the PTY closes
+		t.resizing.Wait()
+		
+		// Closing the console unblocks the read loop
+		if t.console != nil {
+			t.console.Close()
+		}
+		
+		t.loops.Wait()
+		t.running.Store(false)
+		
+		log.Info().Str("id", t.ID).Msg("terminal closed")
+	})
 	return nil
 }
 
+// Kill ends the shell abruptly, as if it had crashed. The terminal then winds
+// down the same way as after a normal exit.
+func (t *Terminal) Kill() error {
+	if !t.started.Load() || t.console == nil {
+		return fmt.Errorf("terminal not started")
+	}
+	return t.console.kill()
+}
+
 // IsRunning returns whether the terminal is active
 func (t *Terminal) IsRunning() bool {
 	return t.running.Load()
@@ -261,36 +528,123 @@ func (t *Terminal) LastUsed() time.Time {
 // Internal methods
 
 func (t *Terminal) readLoop() {
-	buf := make([]byte, 4096)
+	defer t.loops.Done()
+	defer t.closeOutput()
+	
+	// Output chunks are cut from a shared slab instead of allocated per
+	// read. Subscribers may keep a chunk, so slabs are never reused: a new
+	// one starts when the current one runs low, and the old one is freed
+	// with its last chunk.
+	var slab []byte
 	
 	for {
-		n, err := t.ptmx.Read(buf)
+		if cap(slab)-len(slab) < readChunkSize {
+			slab = make([]byte, 0, readSlabSize)
+		}
+		buf := slab[len(slab) : len(slab)+readChunkSize]
+		
+		n, err := t.console.Read(buf)
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !consoleClosed(err) && t.ctx.Err() == nil {
 				log.Error().Err(err).Str("id", t.ID).Msg("read error")
 			}
 			return
 		}
 		
 		if n > 0 {
-			data := make([]byte, n)
-			copy(data, buf[:n])
+			data := buf[:n:n]
+			slab = slab[:len(slab)+n]
 			
-			select {
-			case t.output <- data:
-				t.updateLastUsed()
-			case <-t.ctx.Done():
+			t.updateLastUsed()
+			if t.onNotify != nil {
+				t.passNotifications(data)
+			}
+			if !t.emit(data) {
 				return
 			}
 		}
 	}
 }
 
+// passNotifications passes on the notifications completed in a chunk of
+// output, at most one per notificationInterval. Only the read loop calls it.
+func (t *Terminal) passNotifications(data []byte) {
+	for _, n := range t.notices.scan(data) {
+		now := time.Now()
+		if now.Sub(t.lastNotified) < notificationInterval {
+			log.Debug().Str("id", t.ID).Msg("dropped terminal notification")
+			continue
+		}
+		t.lastNotified = now
+		t.onNotify(t.ID, n)
+	}
+}
+
+// emit passes a chunk of output through the throttle, if any, to subscribers.
+// It returns false once the terminal is shutting down.
+func (t *Terminal) emit(data []byte) bool {
+	if t.throttle == nil {
+		return t.broadcast(data)
+	}
+	
+	t.emitMu.Lock()
+	defer t.emitMu.Unlock()
+	
+	marker, data := t.throttle.admit(time.Now(), data)
+	if marker != nil && !t.broadcast(marker) {
+		return false
+	}
+	if data == nil {
+		// Dropping: make sure the marker goes out even if output stops
+		if t.throttle.timer == nil {
+			t.throttle.timer = time.AfterFunc(t.throttle.recovery(), t.flushThrottle)
+		}
+		return true
+	}
+	return t.broadcast(data)
+}
+
+// flushThrottle sends the marker for dropped output when output stopped
+// before the throttle let it resume
+func (t *Terminal) flushThrottle() {
+	t.emitMu.Lock()
+	defer t.emitMu.Unlock()
+	
+	if t.throttle.timer == nil {
+		// Output already closed
+		return
+	}
+	marker, wait := t.throttle.flush(time.Now())
+	if wait > 0 {
+		t.throttle.timer.Reset(wait)
+		return
+	}
+	t.throttle.timer = nil
+	if marker != nil {
+		t.broadcast(marker)
+	}
+}
+
+// closeOutput ends output once the read loop stops; after it, throttle
+// markers reach no one
+func (t *Terminal) closeOutput() {
+	t.emitMu.Lock()
+	defer t.emitMu.Unlock()
+	
+	if t.throttle != nil && t.throttle.timer != nil {
+		t.throttle.timer.Stop()
+		t.throttle.timer = nil
+	}
+	t.closeSubscribers()
+}
+
 func (t *Terminal) writeLoop() {
+	defer t.loops.Done()
+	
 	for {
 		select {
 		case data := <-t.input:
-			if _, err := t.ptmx.Write(data); err != nil {
+			if _, err := t.console.Write(data); err != nil {
 				log.Error().Err(err).Str("id", t.ID).Msg("write error")
 				return
 			}
@@ -302,6 +656,8 @@ func (t *Terminal) writeLoop() {
 }
 
 func (t *Terminal) resizeLoop() {
+	defer t.resizing.Done()
+	
 	for {
 		select {
 		case size := <-t.resize:
@@ -314,6 +670,12 @@ func (t *Terminal) resizeLoop() {
 				log.Error().Err(err).Str("id", t.ID).Msg("resize error")
 			}
 			
+			if t.recording != nil {
+				t.subsMu.Lock()
+				t.recording.resized(time.Now(), size.Rows, size.Cols)
+				t.subsMu.Unlock()
+			}
+			
 		case <-t.ctx.Done():
 			return
 		}
@@ -323,8 +685,8 @@ func (t *Terminal) resizeLoop() {
 func (t *Terminal) waitLoop() {
 	defer close(t.done)
 	
-	if t.cmd != nil {
-		err := t.cmd.Wait()
+	if t.console != nil {
+		err := t.console.wait()
 		if err != nil && !isExpectedError(err) {
 			log.Error().Err(err).Str("id", t.ID).Msg("terminal process exited with error")
 		}
@@ -334,16 +696,11 @@ func (t *Terminal) waitLoop() {
 }
 
 func (t *Terminal) setSize(rows, cols uint16) error {
-	if t.ptmx == nil {
+	if t.console == nil {
 		return fmt.Errorf("pty not initialized")
 	}
 	
-	ws := &pty.Winsize{
-		Rows: rows,
-		Cols: cols,
-	}
-	
-	return pty.Setsize(t.ptmx, ws)
+	return t.console.resize(rows, cols)
 }
 
 func (t *Terminal) updateLastUsed() {
@@ -0,0 +1,156 @@
+package terminal
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTerminalCloseConcurrentWithIO(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	term, err := NewTerminal("test", WithShell("/bin/sh"))
+	if err != nil {
+		t.Fatalf("new terminal: %v", err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatalf("start terminal: %v", err)
+	}
+
+	sub := term.Subscribe()
+	go func() {
+		for range sub.C {
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := term.Write([]byte("echo x\n")); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := term.Resize(24, uint16(80+j)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Close races with the writers above and with itself
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			term.Close()
+		}()
+	}
+	wg.Wait()
+
+	if term.IsRunning() {
+		t.Fatal("terminal still running after close")
+	}
+	if err := term.Write([]byte("echo late\n")); err == nil {
+		t.Fatal("expected write after close to fail")
+	}
+	if err := term.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestTerminalCloseBeforeStart(t *testing.T) {
+	term, err := NewTerminal("test", WithShell("/bin/sh"))
+	if err != nil {
+		t.Fatalf("new terminal: %v", err)
+	}
+	if err := term.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := term.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+// waitForOutput reads sub until the output so far contains want
+func waitForOutput(t *testing.T, sub *Subscription, output *strings.Builder, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for !strings.Contains(output.String(), want) {
+		select {
+		case data, ok := <-sub.C:
+			if !ok {
+				t.Fatalf("output ended without %q: %q", want, output.String())
+			}
+			output.Write(data)
+		case <-timeout:
+			t.Fatalf("no %q in %q", want, output.String())
+		}
+	}
+}
+
+func TestCommandGuardHoldsLinesUntilDecided(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	decisions := make(chan bool, 1)
+	guard := func(terminalID, command string) <-chan bool {
+		if strings.Contains(command, "held") {
+			return decisions
+		}
+		return nil
+	}
+	term, err := NewTerminal("test", WithShell("/bin/sh"), WithCommandGuard(guard),
+		WithEnvironment([]string{"PS1=ready> "}))
+	if err != nil {
+		t.Fatalf("new terminal: %v", err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatalf("start terminal: %v", err)
+	}
+	defer term.Close()
+	sub := term.Subscribe()
+	defer sub.Close()
+
+	// The shell echoes what is typed; arithmetic only expands once a line
+	// runs
+	var output strings.Builder
+	term.Write([]byte("echo held-$((1+1))\recho next-$((2+2))\r"))
+	term.Write([]byte("echo free-$((0+5))\r"))
+	time.Sleep(200 * time.Millisecond)
+	if strings.Contains(output.String(), "held-2") || strings.Contains(output.String(), "free-5") {
+		t.Fatalf("expected input held until decided, got %q", output.String())
+	}
+	decisions <- true
+	waitForOutput(t, sub, &output, "free-5")
+	if !strings.Contains(output.String(), "held-2") || !strings.Contains(output.String(), "next-4") {
+		t.Fatalf("expected the approved line and those after it run, got %q", output.String())
+	}
+
+	output.Reset()
+	term.Write([]byte("echo held-$((3+3))\r"))
+	decisions <- false
+	waitForOutput(t, sub, &output, "^C")
+	// Input typed before the shell has handled the interrupt is thrown
+	// away with the cancelled line, so wait for its next prompt
+	interrupted := output.String()[strings.Index(output.String(), "^C"):]
+	output.Reset()
+	output.WriteString(interrupted)
+	waitForOutput(t, sub, &output, "ready> ")
+	term.Write([]byte("echo after-$((4+4))\r"))
+	waitForOutput(t, sub, &output, "after-8")
+	if strings.Contains(output.String(), "held-6") {
+		t.Fatalf("expected the rejected line not run, got %q", output.String())
+	}
+}
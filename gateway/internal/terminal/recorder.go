@@ -0,0 +1,180 @@
+package terminal
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/internal/audit"
+	"github.com/devtail/gateway/internal/redact"
+)
+
+// Control bytes interpreted while reconstructing input lines
+const (
+	keyCtrlC     = 0x03
+	keyBackspace = 0x08
+	keyCtrlL     = 0x0c
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// escape sequence parser states
+const (
+	escNone = iota
+	escStart
+	escCSI
+	escSS3
+	escOSC // operating system command, only followed by the playback export
+)
+
+// lineEditor reconstructs command lines from raw terminal input.
+//
+// Reconstruction works on the keystrokes sent to the PTY, so it sees what the
+// user typed rather than what the shell executed: history recall and tab
+// completion are not expanded, and cursor movement is ignored. A line edited
+// with such keys is reported as unknown, since its text is not what runs.
+type lineEditor struct {
+	line     []rune
+	escState int
+	csi      []rune // parameters of the CSI sequence being read
+	pasting  bool   // between bracketed paste markers
+	unknown  bool   // edited with keys the editor cannot follow
+}
+
+// feed processes one character of input, returning the line when it is
+// entered and whether its text is known
+func (e *lineEditor) feed(ch rune) (line string, known, entered bool) {
+	switch e.escState {
+	case escStart:
+		switch ch {
+		case '[':
+			e.escState = escCSI
+			e.csi = e.csi[:0]
+		case 'O':
+			e.escState = escSS3
+		default:
+			// Meta keys, such as Alt-. inserting the last argument
+			e.escState = escNone
+			e.unknown = true
+		}
+		return "", false, false
+	case escCSI:
+		// CSI sequences end with a byte in the range 0x40-0x7e
+		if ch < 0x40 || ch > 0x7e {
+			e.csi = append(e.csi, ch)
+			return "", false, false
+		}
+		e.escState = escNone
+		switch {
+		case ch == '~' && string(e.csi) == "200":
+			e.pasting = true
+		case ch == '~' && string(e.csi) == "201":
+			e.pasting = false
+		default:
+			// Arrow, home, end and delete keys
+			e.unknown = true
+		}
+		return "", false, false
+	case escSS3:
+		e.escState = escNone
+		e.unknown = true
+		return "", false, false
+	}
+
+	switch ch {
+	case '\r', '\n':
+		line, known = strings.TrimSpace(string(e.line)), !e.unknown
+		e.line = e.line[:0]
+		e.unknown = false
+		return line, known, true
+	case keyEscape:
+		e.escState = escStart
+	case keyBackspace, keyDelete:
+		if len(e.line) > 0 {
+			e.line = e.line[:len(e.line)-1]
+		}
+	case keyCtrlC:
+		e.line = e.line[:0]
+		e.unknown = false
+	case keyCtrlU:
+		// Clears only the text before the cursor, which is all of it
+		// unless the cursor was moved
+		e.line = e.line[:0]
+	case keyCtrlW:
+		e.deleteWord()
+	case keyCtrlL:
+	default:
+		switch {
+		case ch >= 0x20 || ch == '\t' && e.pasting:
+			e.line = append(e.line, ch)
+		default:
+			// Completion, history search and the other readline
+			// commands bound to control keys
+			e.unknown = true
+		}
+	}
+	return "", false, false
+}
+
+func (e *lineEditor) deleteWord() {
+	end := len(e.line)
+	for end > 0 && e.line[end-1] == ' ' {
+		end--
+	}
+	for end > 0 && e.line[end-1] != ' ' {
+		end--
+	}
+	e.line = e.line[:end]
+}
+
+// commandRecorder records the command lines entered in a terminal to the
+// audit log when the user presses enter
+type commandRecorder struct {
+	terminalID string
+	workDir    string
+	logger     audit.Logger
+
+	mu     sync.Mutex
+	editor lineEditor
+}
+
+func newCommandRecorder(terminalID, workDir string, logger audit.Logger) *commandRecorder {
+	return &commandRecorder{
+		terminalID: terminalID,
+		workDir:    workDir,
+		logger:     logger,
+	}
+}
+
+// Feed processes a chunk of input user wrote to the terminal. A command is
+// recorded as the user's who pressed enter. Lines the terminal read without
+// echoing, as hidden tells, are left out: programs reading passwords, such as
+// sudo, ssh and read -s, turn echo off.
+func (r *commandRecorder) Feed(user string, data []byte, hidden bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ch := range string(data) {
+		if command, _, entered := r.editor.feed(ch); entered && !hidden {
+			r.record(user, command)
+		}
+	}
+}
+
+func (r *commandRecorder) record(user, command string) {
+	if command == "" {
+		return
+	}
+
+	// Commands often carry credentials, as in export API_KEY=...
+	r.logger.Log(audit.Event{
+		Timestamp:  time.Now(),
+		Type:       audit.EventTerminalCommand,
+		TerminalID: r.terminalID,
+		User:       user,
+		Command:    redact.String(command),
+		WorkDir:    r.workDir,
+	})
+}
@@ -0,0 +1,200 @@
+package terminal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/devtail/gateway/internal/audit"
+)
+
+type captureLogger struct {
+	events []audit.Event
+}
+
+func (c *captureLogger) Log(event audit.Event) {
+	c.events = append(c.events, event)
+}
+
+func TestCommandRecorder(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+		want  []string
+	}{
+		{"simple", []string{"ls -la\r"}, []string{"ls -la"}},
+		{"split writes", []string{"git st", "atus\r"}, []string{"git status"}},
+		{"backspace", []string{"lss\x7f -l\r"}, []string{"ls -l"}},
+		{"ctrl-u clears line", []string{"rm -rf /\x15echo hi\r"}, []string{"echo hi"}},
+		{"ctrl-c discards", []string{"sleep 10\x03", "pwd\r"}, []string{"pwd"}},
+		{"ctrl-w deletes word", []string{"git push --force\x17\r"}, []string{"git push"}},
+		{"arrow keys ignored", []string{"make\x1b[A\x1bOB test\r"}, []string{"make test"}},
+		{"blank lines skipped", []string{"\r\r  \r"}, nil},
+		{"multiple commands", []string{"cd src\rmake\n"}, []string{"cd src", "make"}},
+		{"secrets redacted", []string{"export OPENAI_API_KEY=sk-abcdefghijklmnopqrstuvwx\r"}, []string{"export OPENAI_API_KEY=[REDACTED]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &captureLogger{}
+			recorder := newCommandRecorder("term-1", "/work", logger)
+
+			for _, chunk := range tt.input {
+				recorder.Feed("", []byte(chunk), false)
+			}
+
+			if len(logger.events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d: %+v", len(logger.events), len(tt.want), logger.events)
+			}
+			for i, event := range logger.events {
+				if event.Command != tt.want[i] {
+					t.Errorf("event %d: got command %q, want %q", i, event.Command, tt.want[i])
+				}
+				if event.Type != audit.EventTerminalCommand || event.TerminalID != "term-1" {
+					t.Errorf("event %d: unexpected metadata %+v", i, event)
+				}
+			}
+		})
+	}
+}
+
+func TestLineEditorReportsLinesItCannotRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		known bool
+	}{
+		{"typed", "ls -la\r", "ls -la", true},
+		{"history recall", "\x1b[A\r", "", false},
+		{"application cursor keys", "\x1bOA\r", "", false},
+		{"edited with the cursor", "rm -rf /tmp/x\x1b[D\x1b[D\x7f\r", "rm -rf /tmp/", false},
+		{"tab completion", "cat READ\t\r", "cat READ", false},
+		{"reverse search", "\x12push\r", "push", false},
+		{"meta key", "echo \x1b.\r", "echo", false},
+		{"ctrl-u keeps the text after a moved cursor", "ls\x1b[D\x15\r", "", false},
+		{"ctrl-c starts over", "\x1b[A\x03pwd\r", "pwd", true},
+		{"next line starts over", "\x1b[A\rpwd\r", "pwd", true},
+		{"clearing the screen", "\x0cls\r", "ls", true},
+		{"bracketed paste", "\x1b[200~git status\tx\x1b[201~\r", "git status\tx", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e lineEditor
+			var line string
+			var known bool
+			for _, ch := range tt.input {
+				if l, k, entered := e.feed(ch); entered {
+					line, known = l, k
+				}
+			}
+			if line != tt.want || known != tt.known {
+				t.Fatalf("got %q known %v, want %q known %v", line, known, tt.want, tt.known)
+			}
+		})
+	}
+}
+
+func TestCommandsAreAttributedToWhoEnteredThem(t *testing.T) {
+	logger := &captureLogger{}
+	recorder := newCommandRecorder("term-1", "/work", logger)
+
+	recorder.Feed("alice", []byte("git st"), false)
+	recorder.Feed("bob", []byte("atus\r"), false)
+	recorder.Feed("alice", []byte("ls\r"), false)
+
+	if len(logger.events) != 2 || logger.events[0].User != "bob" || logger.events[1].User != "alice" {
+		t.Fatalf("expected each command recorded as entered by its user, got %+v", logger.events)
+	}
+}
+
+func TestLinesEnteredWithoutEchoAreNotRecorded(t *testing.T) {
+	logger := &captureLogger{}
+	recorder := newCommandRecorder("term-1", "/work", logger)
+
+	recorder.Feed("", []byte("sudo -k true\r"), false)
+	recorder.Feed("", []byte("hunter2\r"), true)
+	recorder.Feed("", []byte("ls\r"), false)
+
+	if len(logger.events) != 2 || logger.events[0].Command != "sudo -k true" || logger.events[1].Command != "ls" {
+		t.Fatalf("expected the line typed without echo left out, got %+v", logger.events)
+	}
+}
+
+func TestPasswordsReadWithoutEchoAreNotRecorded(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	logger := &captureLogger{}
+	term, err := NewTerminal("test", WithShell("/bin/sh"), WithCommandAudit(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+
+	// What read -s does in bash
+	term.Write([]byte("stty -echo; echo ready-$((1+1)); read -r secret; stty echo; echo read-${#secret}\n"))
+	readUntil(t, sub, "ready-2")
+	term.Write([]byte("hunter2\n"))
+	readUntil(t, sub, "read-7")
+	term.Write([]byte("echo done\n"))
+
+	var commands []string
+	for _, event := range logger.events {
+		commands = append(commands, event.Command)
+	}
+	if len(commands) != 2 || commands[1] != "echo done" {
+		t.Fatalf("expected only the commands typed with echo on recorded, got %q", commands)
+	}
+}
+
+func TestBashCommandsAreRecordedWhilePasswordsAreNot(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+
+	// readline turns echo off while it reads a line, but leaves canonical
+	// mode; a known prompt shows when it is reading
+	rc := filepath.Join(t.TempDir(), "bashrc")
+	if err := os.WriteFile(rc, []byte("PS1='prompt> '\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := &captureLogger{}
+	term, err := NewTerminal("test", WithShell("bash"), WithRCFile(rc), WithCommandAudit(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+
+	readUntil(t, sub, "prompt> ")
+	term.Write([]byte("echo one-$((0+1))\r"))
+	readUntil(t, sub, "one-1")
+	term.Write([]byte("stty -echo; echo ready-$((1+1)); read -r secret; stty echo; echo read-${#secret}\r"))
+	readUntil(t, sub, "ready-2")
+	term.Write([]byte("hunter2\r"))
+	readUntil(t, sub, "read-7")
+	term.Write([]byte("echo done\r"))
+
+	var commands []string
+	for _, event := range logger.events {
+		commands = append(commands, event.Command)
+	}
+	if len(commands) != 3 || commands[0] != "echo one-$((0+1))" || commands[2] != "echo done" {
+		t.Fatalf("expected the commands typed at the prompt recorded and the password left out, got %q", commands)
+	}
+}
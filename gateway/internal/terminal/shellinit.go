@@ -0,0 +1,179 @@
+package terminal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// The variables telling every terminal where it runs, besides
+// DEVTAIL_TERMINAL_ID
+const (
+	// EnvParticipantID is the participant ID of the session that created
+	// the terminal. It is shown to every other participant anyway, unlike
+	// the session ID, which resumes the session and must not leak into
+	// shared or tmux terminals.
+	EnvParticipantID = "DEVTAIL_PARTICIPANT_ID"
+
+	// EnvWorkspace and EnvWorkspaceRoot are the workspace the terminal was
+	// created in and its root directory
+	EnvWorkspace     = "DEVTAIL_WORKSPACE"
+	EnvWorkspaceRoot = "DEVTAIL_WORKSPACE_ROOT"
+
+	// EnvPreviewURL is ShellInit.PreviewURL
+	EnvPreviewURL = "DEVTAIL_PREVIEW_URL"
+)
+
+// shellRCFile is the name of the managed rc snippet in ShellInit.Dir
+const shellRCFile = "shell.rc"
+
+// ShellInit configures the workspace context new terminals start with. The
+// Manager writes a managed rc snippet from it, which bash sources in place
+// of ~/.bashrc (after sourcing that itself) and sh reads as $ENV; other
+// shells only get the variables.
+type ShellInit struct {
+	// Dir is where the rc snippet is written: devtail in the user's cache
+	// directory if empty
+	Dir string
+
+	// Prompt sets a PS1 showing the directory and, in a git repository,
+	// the branch. Only bash uses it.
+	Prompt bool
+
+	// PreviewURL is the address a port in the VM is served at, with {port}
+	// where the port goes, such as https://{port}-vm12.preview.devtail.dev.
+	// It defines the devtail_preview PORT helper printing the URL; empty
+	// leaves the helper out.
+	PreviewURL string
+}
+
+// Validate checks the configuration before the gateway starts with it
+func (c ShellInit) Validate() error {
+	if c.PreviewURL != "" && !strings.Contains(c.PreviewURL, "{port}") {
+		return fmt.Errorf("preview URL %q has no {port}", c.PreviewURL)
+	}
+	return nil
+}
+
+// write writes the rc snippet, returning its path. It is replaced whole, so
+// shells starting meanwhile never read half of it.
+func (c ShellInit) write() (string, error) {
+	dir := c.Dir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+		}
+		dir = filepath.Join(cache, "devtail")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+
+	path := filepath.Join(dir, shellRCFile)
+	tmp, err := os.CreateTemp(dir, shellRCFile+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(c.rc()); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+	// CreateTemp makes the file private; shells of other users may read it
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("write %s: %w", shellRCFile, err)
+	}
+	return path, nil
+}
+
+// rc returns the rc snippet
+func (c ShellInit) rc() string {
+	rc := rcHeader
+	if c.Prompt {
+		rc += rcPrompt
+	}
+	if c.PreviewURL != "" {
+		rc += rcPreview
+	}
+	return rc
+}
+
+const rcHeader = `# Managed by devtail: the gateway rewrites this file when it starts, so
+# changes to it are lost. Terminal shells source it: bash in place of
+# ~/.bashrc, which it sources first, and sh as $ENV.
+
+if [ -n "$BASH_VERSION" ] && [ -f "$HOME/.bashrc" ]; then
+	. "$HOME/.bashrc"
+fi
+`
+
+const rcPrompt = `
+# The prompt shows the directory and, in a git repository, the branch
+if [ -n "$BASH_VERSION" ]; then
+	__devtail_git_branch() {
+		local branch
+		branch=$(git symbolic-ref --short -q HEAD 2>/dev/null || git rev-parse --short HEAD 2>/dev/null) || return 0
+		printf ' (%s)' "$branch"
+	}
+	PS1='\[\e[34m\]\w\[\e[33m\]$(__devtail_git_branch)\[\e[0m\] \$ '
+fi
+`
+
+const rcPreview = `
+# devtail_preview PORT prints the URL the server on PORT is previewed at
+devtail_preview() {
+	case "$1" in
+	''|*[!0-9]*)
+		echo "usage: devtail_preview PORT" >&2
+		return 2
+		;;
+	esac
+	printf '%s\n' "$DEVTAIL_PREVIEW_URL" | sed "s/{port}/$1/g"
+}
+`
+
+// shellContext is where a terminal runs, which its shell is told through
+// the DEVTAIL_ variables
+type shellContext struct {
+	participantID string
+	workspace     protocol.Workspace // zero without workspaces
+}
+
+// env returns the variables for c, leaving out what is unknown
+func (c shellContext) env(init *ShellInit) []string {
+	var env []string
+	if c.participantID != "" {
+		env = append(env, EnvParticipantID+"="+c.participantID)
+	}
+	if c.workspace.Name != "" {
+		env = append(env, EnvWorkspace+"="+c.workspace.Name, EnvWorkspaceRoot+"="+c.workspace.Root)
+	}
+	if init != nil && init.PreviewURL != "" {
+		env = append(env, EnvPreviewURL+"="+init.PreviewURL)
+	}
+	return env
+}
+
+// rcArgs returns the arguments and variables that have shell source the rc
+// snippet at rc when it starts
+func rcArgs(shell, rc string) (args, env []string) {
+	switch filepath.Base(shell) {
+	case "bash":
+		return []string{"--rcfile", rc}, nil
+	case "sh", "dash", "ksh", "mksh":
+		// Interactive POSIX shells read the file $ENV names
+		return nil, []string{"ENV=" + rc}
+	}
+	return nil, nil
+}
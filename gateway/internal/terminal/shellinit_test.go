@@ -0,0 +1,60 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestShellInitValidate(t *testing.T) {
+	if err := (ShellInit{PreviewURL: "https://{port}-vm.preview.devtail.dev"}).Validate(); err != nil {
+		t.Errorf("expected a preview URL with {port} to be valid, got %v", err)
+	}
+	if err := (ShellInit{PreviewURL: "https://vm.preview.devtail.dev"}).Validate(); err == nil {
+		t.Error("expected a preview URL without {port} to be refused")
+	}
+}
+
+func TestTerminalsGetWorkspaceContext(t *testing.T) {
+	for _, shell := range []string{"/bin/bash", "/bin/sh"} {
+		t.Run(filepath.Base(shell), func(t *testing.T) {
+			if _, err := os.Stat(shell); err != nil {
+				t.Skipf("%s not available", shell)
+			}
+
+			home := t.TempDir()
+			os.WriteFile(filepath.Join(home, ".bashrc"), []byte("FROM_BASHRC=yes\n"), 0o644)
+
+			m := NewManager(WithDefaultShell(shell), WithShellInit(ShellInit{
+				Dir:        t.TempDir(),
+				Prompt:     true,
+				PreviewURL: "https://{port}-vm.preview.devtail.dev",
+			}))
+			defer m.Close()
+
+			term, err := m.createTerminal("alice", terminalSpec{
+				workDir: home,
+				// The request cannot pass itself off as another participant
+				env:     []string{"HOME=" + home, EnvParticipantID + "=forged"},
+				context: shellContext{participantID: "p1", workspace: protocol.Workspace{Name: "api", Root: home}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sub := term.Subscribe()
+			defer sub.Close()
+
+			term.Write([]byte("echo \"[$DEVTAIL_PARTICIPANT_ID|$DEVTAIL_WORKSPACE|$DEVTAIL_WORKSPACE_ROOT|$(devtail_preview 30$((1+1))0)]\"\n"))
+			readUntil(t, sub, "[p1|api|"+home+"|https://3020-vm.preview.devtail.dev]")
+
+			if shell == "/bin/bash" {
+				// The user's own rc file still runs, and the prompt
+				// shows the branch
+				term.Write([]byte("case $PS1 in *__devtail_git_branch*) p=branch;; esac; echo \"[$FROM_BASHRC|$p]\"\n"))
+				readUntil(t, sub, "[yes|branch]")
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package terminal
+
+import (
+	"sync"
+	"time"
+)
+
+// maxScrollback bounds the recent output replayed to newly attached subscribers
+const maxScrollback = 64 * 1024
+
+// Subscription receives a copy of everything the terminal writes.
+//
+// C is closed when the terminal exits. Close detaches the subscription
+// early; it is safe to call more than once and after the terminal exits.
+type Subscription struct {
+	C <-chan []byte
+
+	id   uint64
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+	term *Terminal
+}
+
+// Close detaches the subscription from the terminal
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.term.removeSubscriber(s.id)
+	})
+}
+
+// Subscribe attaches a new output consumer to the terminal. Several
+// subscriptions can be active at once; each receives every output chunk.
+// The first chunk delivered is the terminal's recent scrollback, so output
+// written before the subscriber attached (such as the first prompt) is not lost.
+func (t *Terminal) Subscribe() *Subscription {
+	ch := make(chan []byte, 256)
+	sub := &Subscription{
+		C:    ch,
+		ch:   ch,
+		done: make(chan struct{}),
+		term: t,
+	}
+
+	t.subsMu.Lock()
+	defer t.subsMu.Unlock()
+
+	if len(t.scrollback) > 0 {
+		replay := make([]byte, len(t.scrollback))
+		copy(replay, t.scrollback)
+		ch <- replay
+	}
+
+	if t.outputClosed {
+		close(ch)
+		return sub
+	}
+
+	t.nextSubID++
+	sub.id = t.nextSubID
+	t.subscribers[sub.id] = sub
+	return sub
+}
+
+// SubscriberCount returns the number of attached output consumers
+func (t *Terminal) SubscriberCount() int {
+	t.subsMu.Lock()
+	defer t.subsMu.Unlock()
+	return len(t.subscribers)
+}
+
+func (t *Terminal) removeSubscriber(id uint64) {
+	t.subsMu.Lock()
+	delete(t.subscribers, id)
+	t.subsMu.Unlock()
+}
+
+// broadcast delivers data to every subscriber. A slow subscriber applies
+// backpressure to the PTY rather than losing output. It returns false once
+// the terminal is shutting down.
+func (t *Terminal) broadcast(data []byte) bool {
+	t.subsMu.Lock()
+	t.scrollback = append(t.scrollback, data...)
+	if excess := len(t.scrollback) - maxScrollback; excess > 0 {
+		t.scrollback = append(t.scrollback[:0], t.scrollback[excess:]...)
+	}
+	if t.recording != nil {
+		t.recording.output(time.Now(), data)
+	}
+	subs := make([]*Subscription, 0, len(t.subscribers))
+	for _, sub := range t.subscribers {
+		subs = append(subs, sub)
+	}
+	t.subsMu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- data:
+		case <-sub.done:
+		case <-t.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// closeSubscribers signals end of output to all subscribers. Only the read
+// loop and throttle markers send on subscriber channels, serialized by
+// emitMu, so closeOutput is the only place they are closed.
+func (t *Terminal) closeSubscribers() {
+	t.subsMu.Lock()
+	defer t.subsMu.Unlock()
+
+	t.outputClosed = true
+	for id, sub := range t.subscribers {
+		close(sub.ch)
+		delete(t.subscribers, id)
+	}
+}
@@ -0,0 +1,62 @@
+package terminal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func readUntil(t *testing.T, sub *Subscription, want string) {
+	t.Helper()
+	var buf bytes.Buffer
+	timeout := time.After(5 * time.Second)
+	for !bytes.Contains(buf.Bytes(), []byte(want)) {
+		select {
+		case data, ok := <-sub.C:
+			if !ok {
+				t.Fatalf("subscription closed before %q was seen; got %q", want, buf.String())
+			}
+			buf.Write(data)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q; got %q", want, buf.String())
+		}
+	}
+}
+
+func TestTerminalMultipleSubscribers(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	term, err := NewTerminal("test", WithShell("/bin/sh"))
+	if err != nil {
+		t.Fatalf("new terminal: %v", err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatalf("start terminal: %v", err)
+	}
+	defer term.Close()
+
+	first := term.Subscribe()
+	second := term.Subscribe()
+	defer first.Close()
+
+	if err := term.Write([]byte("echo multi-attach-ok\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	readUntil(t, first, "multi-attach-ok")
+	readUntil(t, second, "multi-attach-ok")
+
+	second.Close()
+	second.Close() // idempotent
+	if n := term.SubscriberCount(); n != 1 {
+		t.Fatalf("expected 1 subscriber after close, got %d", n)
+	}
+
+	// A late subscriber gets the scrollback replayed
+	late := term.Subscribe()
+	defer late.Close()
+	readUntil(t, late, "multi-attach-ok")
+}
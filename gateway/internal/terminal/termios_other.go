@@ -0,0 +1,8 @@
+//go:build !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package terminal
+
+import "golang.org/x/sys/unix"
+
+// ioctlReadTermios reads a terminal's settings
+const ioctlReadTermios = unix.TCGETS
@@ -0,0 +1,132 @@
+package terminal
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// DefaultOutputRate is the output rate cap for terminals, in bytes per
+// second. It is well above what anyone reads, and well below what `yes` or a
+// runaway build log produce.
+const DefaultOutputRate = 1 << 20
+
+// throttleTail is how much of the latest dropped output is kept to follow
+// the marker, so the end of a flood, and the prompt after it, are not lost
+const throttleTail = 4096
+
+// outputThrottle caps how fast a terminal's output reaches subscribers, so a
+// flood of output can't saturate the client's uplink and freeze its UI. It
+// is a token bucket holding a second's worth of output: chunks that don't
+// fit are dropped until half the bucket has refilled, and then replaced by a
+// marker saying how much was left out, and the last lines dropped. The PTY is
+// still read at full speed, so the program writing never blocks.
+type outputThrottle struct {
+	rate    float64 // bytes per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+	omitted int64       // bytes dropped since the last marker
+	tail    []byte      // latest dropped output, after the omitted bytes
+	timer   *time.Timer // sends the marker if output stops while dropping
+}
+
+func newOutputThrottle(rate int) *outputThrottle {
+	return &outputThrottle{rate: float64(rate), burst: float64(rate), tokens: float64(rate)}
+}
+
+func (o *outputThrottle) refill(now time.Time) {
+	if !o.last.IsZero() {
+		o.tokens += now.Sub(o.last).Seconds() * o.rate
+		if o.tokens > o.burst {
+			o.tokens = o.burst
+		}
+	}
+	o.last = now
+}
+
+// admit returns what to deliver of a chunk of output: a marker for output
+// dropped earlier, if it is time for one, and the chunk itself unless it is
+// dropped too
+func (o *outputThrottle) admit(now time.Time, data []byte) (marker, out []byte) {
+	o.refill(now)
+	if o.dropping() {
+		if o.tokens < o.burst/2 {
+			o.drop(data)
+			return nil, nil
+		}
+		marker = o.marker()
+	}
+
+	if o.tokens < float64(len(data)) {
+		o.drop(data)
+		return marker, nil
+	}
+	o.tokens -= float64(len(data))
+	return marker, data
+}
+
+// flush returns the marker for dropped output once the bucket has refilled
+// enough to resume, or how long until it will have
+func (o *outputThrottle) flush(now time.Time) (marker []byte, wait time.Duration) {
+	if !o.dropping() {
+		return nil, 0
+	}
+	o.refill(now)
+	if o.tokens < o.burst/2 {
+		return nil, o.recovery()
+	}
+	return o.marker(), 0
+}
+
+func (o *outputThrottle) dropping() bool {
+	return o.omitted > 0 || len(o.tail) > 0
+}
+
+// drop adds a chunk to the dropped output, keeping the latest lines
+func (o *outputThrottle) drop(data []byte) {
+	o.tail = append(o.tail, data...)
+	if len(o.tail) <= throttleTail {
+		return
+	}
+	cut := len(o.tail) - throttleTail
+	if i := bytes.IndexByte(o.tail[cut:], '\n'); i >= 0 {
+		cut += i + 1
+	}
+	o.omitted += int64(cut)
+	o.tail = append(o.tail[:0], o.tail[cut:]...)
+}
+
+// recovery returns how long until dropped output can resume
+func (o *outputThrottle) recovery() time.Duration {
+	missing := o.burst/2 - o.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / o.rate * float64(time.Second))
+}
+
+// marker builds the elision marker for the output dropped so far, dimmed and
+// on a line of its own, followed by the kept tail, and resets them
+func (o *outputThrottle) marker() []byte {
+	var marker []byte
+	if o.omitted > 0 {
+		marker = fmt.Appendf(nil, "\r\n\x1b[2m… %s omitted …\x1b[22m\r\n", formatBytes(o.omitted))
+	}
+	marker = append(marker, o.tail...)
+	o.omitted, o.tail = 0, nil
+	return marker
+}
+
+// formatBytes renders a byte count for the elision marker, e.g. 4.2 MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,112 @@
+package terminal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOutputThrottle(t *testing.T) {
+	o := newOutputThrottle(1000)
+	now := time.Unix(0, 0)
+	chunk := make([]byte, 400)
+
+	// A second's worth passes at once
+	for i := 0; i < 2; i++ {
+		if marker, out := o.admit(now, chunk); marker != nil || len(out) != 400 {
+			t.Fatalf("chunk %d: marker %q, %d bytes", i, marker, len(out))
+		}
+	}
+	// Then output is dropped until half the bucket refills, keeping the
+	// latest lines
+	flood := bytes.Repeat([]byte("y\r\n"), 1000)
+	for i := 0; i < 2; i++ {
+		now = now.Add(100 * time.Millisecond)
+		if marker, out := o.admit(now, flood); marker != nil || out != nil {
+			t.Fatalf("chunk %d not dropped", i)
+		}
+	}
+	if wait := o.recovery(); wait != 100*time.Millisecond {
+		t.Fatalf("recovery in %v", wait)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	marker, out := o.admit(now, chunk)
+	if want := "\r\n\x1b[2m… 1.9 KB omitted …\x1b[22m\r\ny\r\n"; !bytes.HasPrefix(marker, []byte(want)) {
+		t.Fatalf("marker %q", marker)
+	}
+	if !bytes.HasSuffix(marker, flood) {
+		t.Fatal("latest dropped output not kept")
+	}
+	if len(out) != 400 {
+		t.Fatalf("output did not resume: %d bytes", len(out))
+	}
+	if marker, _ := o.flush(now.Add(time.Hour)); marker != nil {
+		t.Fatalf("marker sent twice: %q", marker)
+	}
+}
+
+func TestOutputThrottleFlush(t *testing.T) {
+	o := newOutputThrottle(1000)
+	now := time.Unix(0, 0)
+
+	o.admit(now, make([]byte, 1000))
+	o.admit(now, []byte("$ "))
+	if marker, wait := o.flush(now.Add(100 * time.Millisecond)); marker != nil || wait != 400*time.Millisecond {
+		t.Fatalf("flushed early: marker %q, wait %v", marker, wait)
+	}
+	// Too little was dropped for a marker, but the prompt still shows
+	marker, _ := o.flush(now.Add(500 * time.Millisecond))
+	if string(marker) != "$ " {
+		t.Fatalf("marker %q", marker)
+	}
+	if marker, wait := o.flush(now.Add(time.Second)); marker != nil || wait != 0 {
+		t.Fatalf("flushed twice: %q", marker)
+	}
+}
+
+func TestTerminalOutputRateLimit(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	const rate = 32 << 10
+	term, err := NewTerminal("test", WithShell("/bin/sh"), WithOutputRateLimit(rate))
+	if err != nil {
+		t.Fatalf("new terminal: %v", err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatalf("start terminal: %v", err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+	if err := term.Write([]byte("yes | head -c 2000000; echo; echo done-$((6*7))\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var output bytes.Buffer
+	deadline := time.After(10 * time.Second)
+	for !bytes.Contains(output.Bytes(), []byte("done-42")) {
+		select {
+		case data, ok := <-sub.C:
+			if !ok {
+				t.Fatal("terminal exited")
+			}
+			output.Write(data)
+		case <-deadline:
+			t.Fatalf("output never finished; got %d bytes", output.Len())
+		}
+	}
+
+	if !bytes.Contains(output.Bytes(), []byte("omitted …")) {
+		t.Fatal("no elision marker in throttled output")
+	}
+	// yes finishes in well under a second, so little more than the burst
+	// gets through
+	if output.Len() > 4*rate {
+		t.Fatalf("%d bytes got through a %d bytes/s cap", output.Len(), rate)
+	}
+}
@@ -0,0 +1,113 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// tmuxSessionPrefix starts the names of the tmux sessions terminals
+	// run in, followed by the terminal ID
+	tmuxSessionPrefix = "devtail-"
+
+	// tmuxTimeout bounds the tmux commands run besides the clients
+	tmuxTimeout = 5 * time.Second
+)
+
+// Tmux runs terminals inside sessions of a tmux server, so their shells
+// survive the gateway restarting and can also be attached from plain SSH
+// with tmux -L <socket> attach -t devtail-<terminal ID>. The terminal's
+// process is a tmux client: closing the terminal detaches it, and only
+// terminal_close ends the session.
+type Tmux struct {
+	path   string
+	socket string
+}
+
+// NewTmux returns the tmux server on socket, as tmux -L names it. The server
+// is started with the first terminal.
+func NewTmux(socket string) (*Tmux, error) {
+	path, err := exec.LookPath("tmux")
+	if err != nil {
+		return nil, fmt.Errorf("tmux not found: %w", err)
+	}
+	return &Tmux{path: path, socket: socket}, nil
+}
+
+// command returns the client running terminal id: it creates the session
+// running the shell command line argv in workDir and env, or attaches to the
+// session if an earlier gateway left it running
+func (x *Tmux) command(ctx context.Context, id string, argv []string, workDir string, env []string) *exec.Cmd {
+	args := []string{"-L", x.socket, "new-session", "-A", "-s", tmuxSessionPrefix + id}
+	if workDir != "" {
+		args = append(args, "-c", workDir)
+	}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	return exec.CommandContext(ctx, x.path, append(args, argv...)...)
+}
+
+// has reports whether the session of terminal id is running
+func (x *Tmux) has(id string) bool {
+	if id == "" || strings.ContainsAny(id, ".:") {
+		// tmux would read these as window or pane targets
+		return false
+	}
+	_, err := x.run("has-session", "-t", "="+tmuxSessionPrefix+id)
+	return err == nil
+}
+
+// sessions returns the IDs of the terminals running in the server
+func (x *Tmux) sessions() []string {
+	out, err := x.run("list-sessions", "-F", "#{session_name}")
+	if err != nil {
+		// No server runs until the first terminal starts one
+		return nil
+	}
+	var ids []string
+	for _, name := range strings.Fields(string(out)) {
+		if id, ok := strings.CutPrefix(name, tmuxSessionPrefix); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// paneTTY returns the terminal device of the session of terminal id, which
+// its shell and the programs it starts read from
+func (x *Tmux) paneTTY(id string) (string, error) {
+	out, err := x.run("display-message", "-p", "-t", "="+tmuxSessionPrefix+id+":", "#{pane_tty}")
+	if err != nil {
+		return "", err
+	}
+	tty := strings.TrimSpace(string(out))
+	if tty == "" {
+		return "", fmt.Errorf("tmux session %s has no pane", tmuxSessionPrefix+id)
+	}
+	return tty, nil
+}
+
+// kill ends the session of terminal id, and its shell
+func (x *Tmux) kill(id string) error {
+	_, err := x.run("kill-session", "-t", "="+tmuxSessionPrefix+id)
+	return err
+}
+
+func (x *Tmux) run(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tmuxTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, x.path, append([]string{"-L", x.socket}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("tmux %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package terminal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTmuxShellsSurviveTheManager(t *testing.T) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux not available")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	tmux, err := NewTmux(fmt.Sprintf("devtail-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tmux.run("kill-server") })
+
+	first := NewManager(WithDefaultShell("/bin/sh"), WithTmuxServer(tmux))
+	term, err := first.CreateTerminal(t.TempDir(), []string{"GREETING=hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := term.Subscribe()
+	term.Write([]byte("KEPT=$GREETING-kept; echo set-$KEPT\n"))
+	readUntil(t, sub, "set-hello-kept")
+	sub.Close()
+	id := term.ID
+
+	// Closing the gateway's side leaves the shell running in tmux
+	first.Close()
+	if !tmux.has(id) {
+		t.Fatal("expected the tmux session to outlive the manager")
+	}
+
+	second := NewManager(WithDefaultShell("/bin/sh"), WithTmuxServer(tmux))
+	defer second.Close()
+	if ids := second.ListTerminals(); !slices.Contains(ids, id) {
+		t.Fatalf("expected %s to be listed, got %v", id, ids)
+	}
+	term, err = second.attachTerminal(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub = term.Subscribe()
+	defer sub.Close()
+	term.Write([]byte("echo again-$KEPT\n"))
+	readUntil(t, sub, "again-hello-kept")
+
+	if _, err := second.attachTerminal("unknown"); err == nil {
+		t.Error("expected attaching a terminal tmux does not run to fail")
+	}
+
+	// terminal_close ends the shell too
+	if err := second.CloseTerminal(id); err != nil {
+		t.Fatal(err)
+	}
+	if tmux.has(id) {
+		t.Error("expected closing the terminal to end its tmux session")
+	}
+}
+
+func TestTmuxPasswordsReadWithoutEchoAreNotRecorded(t *testing.T) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux not available")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+
+	tmux, err := NewTmux(fmt.Sprintf("devtail-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tmux.run("kill-server") })
+
+	// The tmux client's own terminal is raw, so this only passes when the
+	// pane's terminal is asked
+	logger := &captureLogger{}
+	term, err := NewTerminal("echo", WithShell("/bin/sh"), WithTmux(tmux), WithCommandAudit(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := term.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	sub := term.Subscribe()
+	defer sub.Close()
+	term.Write([]byte("stty -echo; echo ready-$((1+1)); read -r secret; stty echo; echo read-${#secret}\n"))
+	readUntil(t, sub, "ready-2")
+	term.Write([]byte("hunter2\n"))
+	readUntil(t, sub, "read-7")
+
+	if len(logger.events) != 1 {
+		t.Fatalf("expected only the command typed with echo on recorded, got %+v", logger.events)
+	}
+}
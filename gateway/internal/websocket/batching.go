@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rttProbeInterval is how often the proto handler pings to measure the
+	// link, more often than keepalives need
+	rttProbeInterval = 5 * time.Second
+
+	// fastLinkRTT is the round trip below which batching saves too little
+	// to be worth the delay, unless messages are already backing up
+	fastLinkRTT = 20 * time.Millisecond
+)
+
+// batcher decides how long outbound messages wait to be sent together. With
+// a fixed window it always uses the configured size and delay; otherwise the
+// window follows the link: messages go out at once on fast links, and wait
+// up to a quarter of the round trip on slow ones, or the full delay while
+// messages are backing up.
+type batcher struct {
+	maxSize  int
+	maxDelay time.Duration
+	fixed    bool
+
+	mu      sync.Mutex
+	rtt     time.Duration // smoothed, zero until measured
+	stats   BatchStats
+	waiting time.Duration // total time messages waited
+}
+
+// BatchStats reports how batching has behaved on a connection, to check it
+// helps: larger batches on slow links, and little added delay on fast ones
+type BatchStats struct {
+	Adaptive    bool    `json:"adaptive"`
+	RTTMs       float64 `json:"rtt_ms"`
+	Messages    uint64  `json:"messages"`
+	Frames      uint64  `json:"frames"`  // batches and single messages written
+	Batches     uint64  `json:"batches"` // frames holding more than one message
+	AvgBatch    float64 `json:"avg_batch"`
+	AvgDelayMs  float64 `json:"avg_delay_ms"` // how long frames were held back
+	FullBatches uint64  `json:"full_batches"` // sent because they reached the size limit
+}
+
+func newBatcher(maxSize int, maxDelay time.Duration, fixed bool) *batcher {
+	return &batcher{maxSize: maxSize, maxDelay: maxDelay, fixed: fixed}
+}
+
+// observeRTT folds a round trip measurement into the smoothed RTT, weighting
+// it an eighth as TCP does
+func (b *batcher) observeRTT(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rtt == 0 {
+		b.rtt = sample
+		return
+	}
+	b.rtt += (sample - b.rtt) / 8
+}
+
+// window returns how many messages a batch may hold and how long the first
+// may wait, given how many more are already queued. A delay of zero sends
+// immediately.
+func (b *batcher) window(backlog int) (size int, delay time.Duration) {
+	if b.fixed {
+		return b.maxSize, b.maxDelay
+	}
+
+	b.mu.Lock()
+	rtt := b.rtt
+	b.mu.Unlock()
+
+	switch {
+	case backlog >= b.maxSize/2:
+		// Congested: the messages are queued anyway, so send them together
+		return b.maxSize, b.maxDelay
+	case rtt < fastLinkRTT:
+		// Unmeasured links count as fast until the first pong
+		return b.maxSize, 0
+	}
+
+	delay = rtt / 4
+	if delay > b.maxDelay {
+		delay = b.maxDelay
+	}
+	return b.maxSize, delay
+}
+
+// record counts a frame of n messages whose first message was held back for
+// waited
+func (b *batcher) record(n int, waited time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stats.Messages += uint64(n)
+	b.stats.Frames++
+	if n > 1 {
+		b.stats.Batches++
+	}
+	if n >= b.maxSize {
+		b.stats.FullBatches++
+	}
+	b.waiting += waited
+}
+
+// Stats returns the counters so far
+func (b *batcher) Stats() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Adaptive = !b.fixed
+	stats.RTTMs = float64(b.rtt) / float64(time.Millisecond)
+	if stats.Frames > 0 {
+		stats.AvgBatch = float64(stats.Messages) / float64(stats.Frames)
+		stats.AvgDelayMs = float64(b.waiting) / float64(stats.Frames) / float64(time.Millisecond)
+	}
+	return stats
+}
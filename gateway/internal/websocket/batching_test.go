@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestBatcherFollowsTheLink(t *testing.T) {
+	b := newBatcher(10, 50*time.Millisecond, false)
+
+	// Unmeasured and fast links send at once
+	if _, delay := b.window(0); delay != 0 {
+		t.Fatalf("unmeasured link delayed by %v", delay)
+	}
+	b.observeRTT(5 * time.Millisecond)
+	if _, delay := b.window(0); delay != 0 {
+		t.Fatalf("fast link delayed by %v", delay)
+	}
+
+	// A backlog is batched even on a fast link
+	if size, delay := b.window(5); size != 10 || delay != 50*time.Millisecond {
+		t.Fatalf("backlog got window %d/%v", size, delay)
+	}
+
+	// Slow links wait a quarter of the round trip, up to the limit
+	b = newBatcher(10, 50*time.Millisecond, false)
+	b.observeRTT(120 * time.Millisecond)
+	if _, delay := b.window(0); delay != 30*time.Millisecond {
+		t.Fatalf("120ms link delayed by %v, want 30ms", delay)
+	}
+	b.observeRTT(920 * time.Millisecond)
+	if rtt := b.Stats().RTTMs; rtt != 220 {
+		t.Fatalf("smoothed rtt %vms, want 220ms", rtt)
+	}
+	if _, delay := b.window(0); delay != 50*time.Millisecond {
+		t.Fatalf("220ms link delayed by %v, want the 50ms limit", delay)
+	}
+}
+
+func TestFixedBatcherIgnoresTheLink(t *testing.T) {
+	b := newBatcher(4, 20*time.Millisecond, true)
+	b.observeRTT(time.Millisecond)
+	if size, delay := b.window(0); size != 4 || delay != 20*time.Millisecond {
+		t.Fatalf("fixed window became %d/%v", size, delay)
+	}
+}
+
+func TestBatchStats(t *testing.T) {
+	b := newBatcher(4, 20*time.Millisecond, false)
+	b.record(1, 0)
+	b.record(4, 10*time.Millisecond)
+	b.record(3, 20*time.Millisecond)
+
+	stats := b.Stats()
+	if stats.Messages != 8 || stats.Frames != 3 || stats.Batches != 2 || stats.FullBatches != 1 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+	if stats.AvgBatch < 2.66 || stats.AvgBatch > 2.67 || stats.AvgDelayMs != 10 || !stats.Adaptive {
+		t.Fatalf("unexpected averages %+v", stats)
+	}
+}
+
+func TestProtoHandlerBatchesSlowLinks(t *testing.T) {
+	handlers := make(chan *ProtoHandler, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := testUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		h, err := NewProtoHandler(conn, echoChat{}, WithAdaptiveBatching(4, time.Second))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handlers <- h
+		h.Run()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	h := <-handlers
+	defer h.cancel()
+
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() []*protocol.Message {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := codec.DecodeFrame(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+
+	// Nothing queued on an unmeasured link: sent alone, without delay
+	if messages := read(); len(messages) != 1 || messages[0].Type != "session_start" {
+		t.Fatalf("expected session_start alone, got %d messages", len(messages))
+	}
+
+	// On a slow link, messages arriving together go out in full batches
+	h.batcher.observeRTT(200 * time.Millisecond)
+	for i := 0; i < 8; i++ {
+		h.send <- &protocol.Message{ID: "m", Type: protocol.TypePong, Timestamp: time.Now()}
+	}
+	got := 0
+	for got < 8 {
+		got += len(read())
+	}
+	if stats := h.BatchStats(); stats.Batches == 0 || stats.Messages != 9 {
+		t.Fatalf("messages were not batched: %+v", stats)
+	}
+}
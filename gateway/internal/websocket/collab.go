@@ -0,0 +1,181 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// user returns who the session belongs to, empty if the gateway requires
+// no connect token
+func (h *UnifiedHandler) user() string {
+	return h.Grant().Subject
+}
+
+// participant describes the session to the other participants
+func (h *UnifiedHandler) participant() protocol.Participant {
+	terminals := h.terminals.attached()
+	sort.Strings(terminals)
+	h.mu.RLock()
+	presence := h.presence
+	h.mu.RUnlock()
+	return protocol.Participant{
+		ID:             h.participantID,
+		User:           h.user(),
+		Transport:      h.client.Transport,
+		ReadOnly:       h.isReadOnly(),
+		ConnectedAt:    h.connectedAt,
+		Terminals:      terminals,
+		PresenceUpdate: presence,
+	}
+}
+
+// handleParticipants lists the sessions connected to the gateway
+func (h *UnifiedHandler) handleParticipants(msg *protocol.Message) {
+	handlers := []*UnifiedHandler{h}
+	if h.sessions != nil {
+		handlers = h.sessions.handlers()
+	}
+
+	participants := make([]protocol.Participant, 0, len(handlers))
+	for _, other := range handlers {
+		p := other.participant()
+		p.Self = other == h
+		participants = append(participants, p)
+	}
+	sort.SliceStable(participants, func(i, j int) bool {
+		return participants[i].ConnectedAt.Before(participants[j].ConnectedAt)
+	})
+
+	payload, _ := json.Marshal(protocol.Participants{Participants: participants})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeParticipants,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// collaborators returns the other sessions that are shown what this one
+// asks the assistant and what its user is doing
+func (h *UnifiedHandler) collaborators() []*UnifiedHandler {
+	if h.sessions == nil {
+		return nil
+	}
+	var peers []*UnifiedHandler
+	for _, other := range h.sessions.handlers() {
+		if other != h && other.supports(protocol.CapabilityCollaboration) {
+			peers = append(peers, other)
+		}
+	}
+	return peers
+}
+
+// shareChat shows the prompt chatMsg to the collaborators and returns the
+// function that shows them the reply once it is finished, or nil if there
+// is nobody to show. Each collaborator gets the two in order, without
+// holding up the reply or the other collaborators.
+func (h *UnifiedHandler) shareChat(correlationID string, chatMsg *protocol.ChatMessage) func(reply protocol.ChatShared) {
+	peers := h.collaborators()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	prompt := sharedMessage(correlationID, protocol.ChatShared{
+		Author:    chatMsg.Author,
+		Role:      "user",
+		Content:   chatMsg.Content,
+		Workspace: chatMsg.Workspace,
+		WorkDir:   chatMsg.WorkDir,
+	})
+	var (
+		reply    *protocol.Message
+		finished = make(chan struct{})
+		once     sync.Once
+	)
+	for _, peer := range peers {
+		go func(peer *UnifiedHandler) {
+			if !peer.deliver(prompt) {
+				return
+			}
+			select {
+			case <-finished:
+				peer.deliver(reply)
+			case <-peer.ctx.Done():
+			}
+		}(peer)
+	}
+
+	return func(shared protocol.ChatShared) {
+		once.Do(func() {
+			shared.Role = "assistant"
+			shared.Workspace, shared.WorkDir = chatMsg.Workspace, chatMsg.WorkDir
+			reply = sharedMessage(correlationID, shared)
+			close(finished)
+		})
+	}
+}
+
+func sharedMessage(correlationID string, shared protocol.ChatShared) *protocol.Message {
+	payload, _ := json.Marshal(shared)
+	return &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeChatShared,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: correlationID,
+	}
+}
+
+// handlePresence records what the user is doing and tells the other
+// participants
+func (h *UnifiedHandler) handlePresence(msg *protocol.Message) {
+	var update protocol.PresenceUpdate
+	if err := json.Unmarshal(msg.Payload, &update); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+	h.updatePresence(func(p *protocol.PresenceUpdate) { *p = update })
+}
+
+// updatePresence applies change to the session's presence and tells the
+// other participants if it changed anything
+func (h *UnifiedHandler) updatePresence(change func(p *protocol.PresenceUpdate)) {
+	h.mu.Lock()
+	before := h.presence
+	change(&h.presence)
+	changed := h.presence != before
+	h.mu.Unlock()
+
+	if changed {
+		h.sharePresence(protocol.PresenceUpdated)
+	}
+}
+
+// sharePresence tells the collaborators the session joined, left or
+// changed its presence. Presence is superseded by the next change, so it
+// is dropped for clients that are not keeping up rather than waited for.
+func (h *UnifiedHandler) sharePresence(event string) {
+	peers := h.collaborators()
+	if len(peers) == 0 {
+		return
+	}
+
+	payload, _ := json.Marshal(protocol.PresenceChanged{Event: event, Participant: h.participant()})
+	for _, peer := range peers {
+		select {
+		case peer.send <- &protocol.Message{
+			ID:        uuid.New().String(),
+			Type:      protocol.TypePresenceChanged,
+			Timestamp: time.Now(),
+			Payload:   payload,
+		}:
+		default:
+		}
+	}
+}
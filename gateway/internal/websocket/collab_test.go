@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestCollaboratorsSeeEachOthersChats(t *testing.T) {
+	sessions := NewSessionRegistry()
+	_, alice, _ := startExpiringHandler(t, WithSessionRegistry(sessions), WithGrant(Grant{Subject: "alice"}))
+	helloWith(t, alice)
+	_, bob, _ := startExpiringHandler(t, WithSessionRegistry(sessions), WithGrant(Grant{Subject: "bob"}))
+	if hello := helloWith(t, bob, protocol.CapabilityCollaboration); len(hello.Capabilities) != 1 {
+		t.Fatalf("expected collaboration agreed, got %v", hello.Capabilities)
+	}
+
+	bob.push(&protocol.Message{ID: "p1", Type: protocol.TypeParticipants, Timestamp: time.Now()})
+	var participants protocol.Participants
+	msg := nextOutbound(t, bob)
+	json.Unmarshal(msg.Payload, &participants)
+	list := participants.Participants
+	if msg.Type != protocol.TypeParticipants || msg.CorrelationID != "p1" || len(list) != 2 {
+		t.Fatalf("expected both participants, got %+v %s", msg, msg.Payload)
+	}
+	if list[0].User != "alice" || list[0].Self || list[1].User != "bob" || !list[1].Self {
+		t.Fatalf("expected alice then bob, who asked, got %+v", list)
+	}
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hello", Workspace: "app"})
+	alice.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	for _, want := range []protocol.ChatShared{
+		{Author: "alice", Role: "user", Content: "hello", Workspace: "app"},
+		{Role: "assistant", Content: "hello", Workspace: "app"},
+	} {
+		var shared protocol.ChatShared
+		msg := nextOutbound(t, bob)
+		json.Unmarshal(msg.Payload, &shared)
+		if msg.Type != protocol.TypeChatShared || msg.CorrelationID != "c1" || shared != want {
+			t.Fatalf("expected %+v shared, got %+v %s", want, msg, msg.Payload)
+		}
+	}
+
+	// Alice did not ask to be shown bob's chats
+	if msg := nextOutbound(t, alice); msg.Type != protocol.TypeChatStream || msg.CorrelationID != "c1" {
+		t.Fatalf("expected alice's reply, got %+v", msg)
+	}
+	bob.push(&protocol.Message{ID: "c2", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	if msg := nextOutbound(t, bob); msg.Type != protocol.TypeChatStream || msg.CorrelationID != "c2" {
+		t.Fatalf("expected bob's reply, got %+v", msg)
+	}
+	select {
+	case msg := <-alice.outbound:
+		t.Fatalf("expected nothing shared with alice, got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// expectPresence reads the next message, which must be the presence event
+// for user
+func expectPresence(t *testing.T, transport *httpTransport, event, user string) protocol.Participant {
+	t.Helper()
+	msg := nextOutbound(t, transport)
+	var changed protocol.PresenceChanged
+	json.Unmarshal(msg.Payload, &changed)
+	if msg.Type != protocol.TypePresenceChanged || changed.Event != event || changed.Participant.User != user {
+		t.Fatalf("expected %s %s, got %+v %s", user, event, msg, msg.Payload)
+	}
+	return changed.Participant
+}
+
+func TestPresenceIsSharedLive(t *testing.T) {
+	sessions := NewSessionRegistry()
+	_, alice, _ := startExpiringHandler(t, WithSessionRegistry(sessions), WithGrant(Grant{Subject: "alice"}))
+	helloWith(t, alice, protocol.CapabilityCollaboration)
+	_, bob, _ := startExpiringHandler(t, WithSessionRegistry(sessions), WithGrant(Grant{Subject: "bob"}))
+	joined := expectPresence(t, alice, protocol.PresenceJoined, "bob")
+	if joined.ID == "" {
+		t.Fatal("expected participants to have an ID")
+	}
+
+	typing, _ := json.Marshal(protocol.PresenceUpdate{Typing: true, Workspace: "api"})
+	bob.push(&protocol.Message{ID: "p1", Type: protocol.TypePresence, Timestamp: time.Now(), Payload: typing})
+	if p := expectPresence(t, alice, protocol.PresenceUpdated, "bob"); !p.Typing || p.Workspace != "api" || p.ID != joined.ID {
+		t.Fatalf("expected bob typing in api, got %+v", p)
+	}
+	// Unchanged presence is not sent again
+	bob.push(&protocol.Message{ID: "p2", Type: protocol.TypePresence, Timestamp: time.Now(), Payload: typing})
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hello", Workspace: "api"})
+	bob.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	if p := expectPresence(t, alice, protocol.PresenceUpdated, "bob"); p.Typing {
+		t.Fatalf("expected bob done typing once the message is sent, got %+v", p)
+	}
+	for i := 0; i < 2; i++ {
+		if msg := nextOutbound(t, alice); msg.Type != protocol.TypeChatShared {
+			t.Fatalf("expected bob's chat shared, got %+v", msg)
+		}
+	}
+
+	input, _ := json.Marshal(map[string]string{"terminal_id": "t1", "data": "bHM="})
+	bob.push(&protocol.Message{ID: "i1", Type: "terminal_input", Timestamp: time.Now(), Payload: input})
+	if p := expectPresence(t, alice, protocol.PresenceUpdated, "bob"); p.ActiveTerminal != "t1" {
+		t.Fatalf("expected t1 active once bob types into it, got %+v", p)
+	}
+
+	bob.Close()
+	expectPresence(t, alice, protocol.PresenceLeft, "bob")
+}
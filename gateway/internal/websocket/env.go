@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/internal/workspace"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// sessionEnv holds the variables a client set for its session
+type sessionEnv struct {
+	mu   sync.Mutex
+	vars map[string]string
+}
+
+func (e *sessionEnv) set(vars map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.vars == nil {
+		e.vars = make(map[string]string, len(vars))
+	}
+	for name, value := range vars {
+		e.vars[name] = value
+	}
+}
+
+func (e *sessionEnv) unset(names []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range names {
+		delete(e.vars, name)
+	}
+}
+
+func (e *sessionEnv) names() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.vars))
+	for name := range e.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// environ returns the variables as NAME=value, sorted by name
+func (e *sessionEnv) environ() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	env := make([]string, 0, len(e.vars))
+	for name, value := range e.vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// handleEnv sets, unsets or lists the session's environment variables and
+// replies with their names
+func (h *UnifiedHandler) handleEnv(msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.TypeEnvSet:
+		var req protocol.EnvSet
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		for name, value := range req.Vars {
+			if !workspace.ValidEnvName(name) || strings.ContainsRune(value, 0) {
+				h.sendError(msg.ID, "invalid_env", fmt.Sprintf("invalid variable %q", name), false)
+				return
+			}
+		}
+		if req.Persist && !h.persistEnv(msg.ID, req.Workspace, func(root string) error {
+			return workspace.SetDotEnv(root, req.Vars)
+		}) {
+			return
+		}
+		h.env.set(req.Vars)
+
+	case protocol.TypeEnvUnset:
+		var req protocol.EnvUnset
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		if req.Persist && !h.persistEnv(msg.ID, req.Workspace, func(root string) error {
+			return workspace.UnsetDotEnv(root, req.Names)
+		}) {
+			return
+		}
+		h.env.unset(req.Names)
+	}
+
+	payload, _ := json.Marshal(protocol.SessionEnv{Names: h.env.names()})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          msg.Type,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// persistEnv applies write to the root of the named workspace, answering
+// the request with an error if it fails
+func (h *UnifiedHandler) persistEnv(messageID, name string, write func(root string) error) bool {
+	root, ok := h.workspaceRoot(name)
+	if !ok {
+		h.sendError(messageID, "unknown_workspace", fmt.Sprintf("unknown workspace %q", name), false)
+		return false
+	}
+	if err := write(root); err != nil {
+		h.sendError(messageID, "env_persist_failed", err.Error(), false)
+		return false
+	}
+	return true
+}
+
+// workspaceRoot returns the root of the workspace called name, or of the
+// default for ""
+func (h *UnifiedHandler) workspaceRoot(name string) (string, bool) {
+	if h.workspaces == nil {
+		return "", false
+	}
+	for _, ws := range h.workspaces() {
+		if ws.Name == name || (name == "" && ws.Default) {
+			return ws.Root, true
+		}
+	}
+	return "", false
+}
+
+// withSessionEnv adds the session's variables to a terminal_create request.
+// Variables in the request itself take precedence.
+func (h *UnifiedHandler) withSessionEnv(msg *protocol.Message) *protocol.Message {
+	env := h.env.environ()
+	if len(env) == 0 {
+		return msg
+	}
+
+	var req terminal.TerminalCreateRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		// The terminal handler reports the invalid request
+		return msg
+	}
+	req.Env = append(env, req.Env...)
+
+	withEnv := *msg
+	withEnv.Payload, _ = json.Marshal(req)
+	return &withEnv
+}
@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// reauthLead is how long before its token expires a session is asked
+	// for a new one; tokens shorter-lived than twice this are asked for
+	// halfway through
+	reauthLead = 2 * time.Minute
+
+	// tokenExpiryGrace matches the clock skew tokens are verified with, so
+	// a token accepted at connect time does not end the session at once
+	tokenExpiryGrace = 30 * time.Second
+)
+
+var errReauthSubject = errors.New("token was issued to a different user")
+
+// WithMaxLifetime ends sessions this long after they start, however often
+// they re-authenticate. Zero means no limit.
+func WithMaxLifetime(d time.Duration) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.maxLifetime = d
+	}
+}
+
+// WithTokenExpiry ends sessions when their connect token expires, unless the
+// client sends a fresh one, checked with authenticate, in a reauth message
+// when asked
+func WithTokenExpiry(authenticate Authenticator) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.reauthenticate = authenticate
+	}
+}
+
+// watchExpiry ends the session when it reaches its maximum lifetime, or when
+// its token expires without the client re-authenticating. It runs until the
+// session ends.
+func (h *UnifiedHandler) watchExpiry() {
+	var endOfLife time.Time
+	if h.maxLifetime > 0 {
+		endOfLife = time.Now().Add(h.maxLifetime)
+	}
+	var asked time.Time // the expiry the client was last asked to renew
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		now := time.Now()
+		if !endOfLife.IsZero() && !now.Before(endOfLife) {
+			h.expire(protocol.ExpiryMaxLifetime)
+			return
+		}
+		next := endOfLife
+
+		if grant := h.Grant(); h.reauthenticate != nil && !grant.ExpiresAt.IsZero() {
+			deadline := grant.ExpiresAt.Add(tokenExpiryGrace)
+			if !now.Before(deadline) {
+				h.expire(protocol.ExpiryTokenExpired)
+				return
+			}
+			next = earliest(next, deadline)
+
+			if !asked.Equal(grant.ExpiresAt) {
+				remindAt := grant.ExpiresAt.Add(-reauthLeadFor(grant))
+				if now.Before(remindAt) {
+					next = earliest(next, remindAt)
+				} else {
+					h.requestReauth(grant.ExpiresAt)
+					asked = grant.ExpiresAt
+				}
+			}
+		}
+
+		var wake <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(next.Sub(now))
+			wake = timer.C
+		}
+
+		select {
+		case <-wake:
+		case <-h.renewed:
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// reauthLeadFor returns how long before the grant's token expires to ask for
+// a new one
+func reauthLeadFor(grant Grant) time.Duration {
+	if grant.IssuedAt.IsZero() {
+		return reauthLead
+	}
+	if half := grant.ExpiresAt.Sub(grant.IssuedAt) / 2; half < reauthLead {
+		return half
+	}
+	return reauthLead
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// requestReauth asks the client for a fresh connect token
+func (h *UnifiedHandler) requestReauth(expiresAt time.Time) {
+	payload, _ := json.Marshal(protocol.TokenExpiry{ExpiresAt: expiresAt})
+	h.deliverReliable(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeReauthRequired,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// handleReauth replaces the session's grant with the one for a fresh token.
+// The token must be for the same user; revocations then match the new token.
+func (h *UnifiedHandler) handleReauth(msg *protocol.Message) {
+	if h.reauthenticate == nil {
+		h.sendError(msg.ID, "reauth_unsupported", "this gateway does not expire sessions with their token", false)
+		return
+	}
+
+	var req protocol.Reauth
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+
+	grant, err := h.reauthenticate(req.Token)
+	if err == nil && grant.Subject != h.Grant().Subject {
+		err = errReauthSubject
+	}
+	if err != nil {
+		h.log.Warn().Err(err).Msg("re-authentication failed")
+		h.sendError(msg.ID, "reauth_failed", err.Error(), true)
+		return
+	}
+
+	h.mu.Lock()
+	h.grant = grant
+	h.mu.Unlock()
+	select {
+	case h.renewed <- struct{}{}:
+	default:
+	}
+	h.timeline.record(EventReauthenticated, "token_id", grant.TokenID)
+
+	payload, _ := json.Marshal(protocol.TokenExpiry{ExpiresAt: grant.ExpiresAt})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeReauth,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// expire ends the session after telling the client why, like Revoke
+func (h *UnifiedHandler) expire(reason string) {
+	payload, _ := json.Marshal(protocol.SessionExpired{Reason: reason})
+	msg := &protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeSessionExpired,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+
+	select {
+	case h.terminate <- msg:
+		h.timeline.record(EventExpired, "reason", reason)
+		h.end("expired: " + reason)
+	default:
+		// Already terminating
+	}
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func startExpiringHandler(t *testing.T, opts ...UnifiedHandlerOption) (*UnifiedHandler, *httpTransport, chan struct{}) {
+	t.Helper()
+
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, opts...)
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+	t.Cleanup(func() { transport.Close() })
+	return h, transport, done
+}
+
+func expectExpired(t *testing.T, transport *httpTransport, done chan struct{}, reason string) {
+	t.Helper()
+
+	msg := nextOutbound(t, transport)
+	var expired protocol.SessionExpired
+	json.Unmarshal(msg.Payload, &expired)
+	if msg.Type != protocol.TypeSessionExpired || expired.Reason != reason {
+		t.Fatalf("expected session_expired for %s, got %s %s", reason, msg.Type, msg.Payload)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired session kept running")
+	}
+}
+
+func TestSessionMaxLifetime(t *testing.T) {
+	_, transport, done := startExpiringHandler(t, WithMaxLifetime(100*time.Millisecond))
+	expectExpired(t, transport, done, protocol.ExpiryMaxLifetime)
+}
+
+func TestSessionTokenExpired(t *testing.T) {
+	reject := func(string) (Grant, error) { return Grant{}, errors.New("unused") }
+	issued := time.Now().Add(-time.Hour)
+	_, transport, done := startExpiringHandler(t,
+		WithGrant(Grant{TokenID: "t1", IssuedAt: issued, ExpiresAt: issued.Add(15 * time.Minute)}),
+		WithTokenExpiry(reject))
+	expectExpired(t, transport, done, protocol.ExpiryTokenExpired)
+}
+
+func TestSessionReauth(t *testing.T) {
+	renewedUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+	authenticate := func(token string) (Grant, error) {
+		switch token {
+		case "fresh":
+			return Grant{TokenID: "t2", Subject: "user-1", IssuedAt: time.Now(), ExpiresAt: renewedUntil}, nil
+		case "stolen":
+			return Grant{TokenID: "t3", Subject: "user-2", IssuedAt: time.Now(), ExpiresAt: renewedUntil}, nil
+		}
+		return Grant{}, errors.New("invalid connect token")
+	}
+
+	// Asked for a new token halfway through a short one
+	now := time.Now()
+	h, transport, _ := startExpiringHandler(t,
+		WithGrant(Grant{TokenID: "t1", Subject: "user-1", IssuedAt: now, ExpiresAt: now.Add(400 * time.Millisecond)}),
+		WithTokenExpiry(authenticate))
+
+	msg := nextOutbound(t, transport)
+	if msg.Type != protocol.TypeReauthRequired || !msg.RequiresAck {
+		t.Fatalf("expected reauth_required, got %s", msg.Type)
+	}
+	if elapsed := time.Since(now); elapsed < 150*time.Millisecond {
+		t.Fatalf("asked for a new token after %v", elapsed)
+	}
+
+	reauth := func(id, token string) *protocol.Message {
+		payload, _ := json.Marshal(protocol.Reauth{Token: token})
+		transport.push(&protocol.Message{ID: id, Type: protocol.TypeReauth, Timestamp: time.Now(), Payload: payload})
+		return nextOutbound(t, transport)
+	}
+	for _, token := range []string{"garbage", "stolen"} {
+		if reply := reauth("r-"+token, token); reply.Type != protocol.TypeChatError {
+			t.Fatalf("%s token: expected chat_error, got %s", token, reply.Type)
+		}
+	}
+	if h.Grant().TokenID != "t1" {
+		t.Fatalf("grant replaced by a rejected token: %+v", h.Grant())
+	}
+
+	reply := reauth("r-fresh", "fresh")
+	var expiry protocol.TokenExpiry
+	json.Unmarshal(reply.Payload, &expiry)
+	if reply.Type != protocol.TypeReauth || reply.CorrelationID != "r-fresh" || !expiry.ExpiresAt.Equal(renewedUntil) {
+		t.Fatalf("unexpected reauth reply %s %s", reply.Type, reply.Payload)
+	}
+	if h.Grant().TokenID != "t2" {
+		t.Fatalf("grant not replaced: %+v", h.Grant())
+	}
+
+	// The new token is good for an hour, so nothing else is sent
+	select {
+	case msg := <-transport.outbound:
+		t.Fatalf("unexpected %s after re-authenticating", msg.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	pb "github.com/devtail/gateway/pkg/protocol/pb"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTransport carries protocol messages over one bidirectional Connect stream
+type grpcTransport struct {
+	stream pb.Gateway_ConnectServer
+	codec  *protocol.Codec
+}
+
+func (t *grpcTransport) ReadMessage() (*protocol.Message, error) {
+	pbMsg, err := t.stream.Recv()
+	if err != nil {
+		if err == io.EOF || t.stream.Context().Err() != nil {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return t.codec.FromProto(pbMsg)
+}
+
+func (t *grpcTransport) WriteMessage(msg *protocol.Message) error {
+	pbMsg, err := t.codec.ToProto(msg)
+	if err != nil {
+		return fmt.Errorf("convert message: %w", err)
+	}
+	return t.stream.Send(pbMsg)
+}
+
+// Keepalive only reports stream loss; gRPC keepalives are configured on the server
+func (t *grpcTransport) Keepalive() error {
+	return t.stream.Context().Err()
+}
+
+// Close is a no-op: a server stream ends when Connect returns, which happens
+// as soon as the handler stops
+func (t *grpcTransport) Close() error {
+	return nil
+}
+
+// GRPCServer implements the Gateway gRPC service. Each Connect stream is a
+// gateway session speaking the same protocol as a WebSocket connection, for
+// backend services that prefer gRPC.
+type GRPCServer struct {
+	pb.UnimplementedGatewayServer
+
+	codec        *protocol.Codec
+	newHandler   HandlerFactory
+	limiter      *ConnLimiter
+	authenticate Authenticator
+}
+
+// NewGRPCServer creates the Gateway service; register it with
+// pb.RegisterGatewayServer
+func NewGRPCServer(newHandler HandlerFactory, opts ...ServerOption) (*GRPCServer, error) {
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		return nil, fmt.Errorf("create codec: %w", err)
+	}
+
+	config := newServerConfig(opts)
+	return &GRPCServer{
+		codec:        codec,
+		newHandler:   newHandler,
+		limiter:      config.limiter,
+		authenticate: config.authenticate,
+	}, nil
+}
+
+// Connect runs a gateway session for the lifetime of the stream
+func (s *GRPCServer) Connect(stream pb.Gateway_ConnectServer) error {
+	remote := ""
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr.String()
+	}
+
+	token := grpcToken(stream.Context())
+	grant, err := s.authenticate.check(token)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", remote).Msg("unauthorized grpc session")
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	release, err := s.limiter.Acquire(clientKey(token, remote))
+	if err != nil {
+		log.Warn().Err(err).Str("remote", remote).Msg("rejected grpc session")
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	defer release()
+
+	transport := &grpcTransport{
+		stream: stream,
+		codec:  s.codec,
+	}
+	handler := s.newHandler(transport, WithGrant(grant), WithClient(ClientInfo{
+		Transport:  "grpc",
+		RemoteAddr: remote,
+	}))
+
+	log.Info().
+		Str("remote", remote).
+		Str("session_id", handler.SessionID()).
+		Msg("new grpc session")
+
+	handler.Run()
+
+	log.Info().
+		Str("remote", remote).
+		Str("session_id", handler.SessionID()).
+		Msg("grpc session closed")
+
+	return nil
+}
+
+// grpcToken returns the bearer token from the authorization metadata
+func grpcToken(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			return strings.TrimPrefix(auth[0], "Bearer ")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+	pb "github.com/devtail/gateway/pkg/protocol/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCConnect(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	service, err := NewGRPCServer(func(transport Transport, opts ...UnifiedHandlerOption) *UnifiedHandler {
+		return NewTransportHandler(transport, echoChat{}, manager, opts...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterGatewayServer(server, service)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewGatewayClient(conn).Connect(ctx)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queue_stats has no enum value, so this also checks type passthrough
+	for _, msg := range []*protocol.Message{
+		{ID: "p1", Type: protocol.TypePing, Timestamp: time.Now()},
+		{ID: "q1", Type: protocol.TypeQueueStats, Timestamp: time.Now()},
+	} {
+		pbMsg, err := codec.ToProto(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(pbMsg); err != nil {
+			t.Fatalf("send %s: %v", msg.Type, err)
+		}
+	}
+
+	for _, want := range []protocol.MessageType{protocol.TypePong, protocol.TypeQueueStats} {
+		pbMsg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		msg, err := codec.FromProto(pbMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != want {
+			t.Fatalf("expected %s, got %s", want, msg.Type)
+		}
+	}
+
+	stream.CloseSend()
+}
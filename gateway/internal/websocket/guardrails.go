@@ -0,0 +1,226 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/internal/guard"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultApprovalTimeout is how long a guarded command waits for approval
+// before it is refused
+const defaultApprovalTimeout = 5 * time.Minute
+
+// Guardrails checks commands against a policy before they run: lines typed
+// into terminals, the shell commands chats have aider run, and tasks.
+// Commands the policy wants confirmed wait for the user's approval. Share
+// one between sessions so any of the user's sessions can decide.
+type Guardrails struct {
+	policy   *guard.Policy
+	sessions *SessionRegistry
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingCommand
+}
+
+type pendingCommand struct {
+	owner      string // decides a chat's or task's command
+	terminalID string // sessions attached to it decide a terminal's
+	decided    chan bool
+	expiry     *time.Timer
+}
+
+// NewGuardrails enforces policy. Terminal commands are put to the sessions
+// in sessions that are attached to the terminal.
+func NewGuardrails(policy *guard.Policy, sessions *SessionRegistry) *Guardrails {
+	return &Guardrails{
+		policy:   policy,
+		sessions: sessions,
+		timeout:  defaultApprovalTimeout,
+		pending:  make(map[string]*pendingCommand),
+	}
+}
+
+// WithGuardrails checks the commands the session's chats and tasks run
+// against g's policy
+func WithGuardrails(g *Guardrails) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.guardrails = g
+	}
+}
+
+// Terminal is a terminal.CommandGuard enforcing the policy on the lines
+// typed into terminals. Approval is asked of every attached session that
+// can give it, and the first answer counts; with none the command is
+// refused. A line the terminal could not read is treated as unknown.
+func (g *Guardrails) Terminal(terminalID, command string) <-chan bool {
+	var verdict guard.Verdict
+	if command == "" {
+		verdict = g.policy.CheckUnknown()
+	} else {
+		verdict = g.policy.Check(command)
+	}
+	if verdict.Action == guard.Allow {
+		return nil
+	}
+
+	var attached, approvers []*UnifiedHandler
+	if g.sessions != nil {
+		for _, h := range g.sessions.handlers() {
+			if h.terminals.streaming(terminalID) {
+				attached = append(attached, h)
+				if h.supports(protocol.CapabilityCommandApprovals) && !h.isReadOnly() {
+					approvers = append(approvers, h)
+				}
+			}
+		}
+	}
+
+	decided := make(chan bool, 1)
+	if verdict.Action == guard.Deny || len(approvers) == 0 {
+		blocked := protocol.CommandBlocked{Command: command, TerminalID: terminalID, Rule: verdict.Rule, Reason: verdict.Reason}
+		if verdict.Action == guard.Confirm {
+			blocked.Reason = "needs approval from a client that supports " + string(protocol.CapabilityCommandApprovals)
+		}
+		log.Info().Str("terminal_id", terminalID).Str("rule", verdict.Rule).Msg("terminal command refused")
+		payload, _ := json.Marshal(blocked)
+		for _, h := range attached {
+			go h.deliver(&protocol.Message{
+				ID:        uuid.New().String(),
+				Type:      protocol.TypeCommandBlocked,
+				Timestamp: time.Now(),
+				Payload:   payload,
+			})
+		}
+		decided <- false
+		return decided
+	}
+
+	approval := g.await(protocol.CommandSourceTerminal, command, verdict, &pendingCommand{terminalID: terminalID, decided: decided})
+	approval.TerminalID = terminalID
+	for _, h := range approvers {
+		go h.deliverReliable(approvalMessage("", approval))
+	}
+	return decided
+}
+
+// await registers command as waiting for a decision on p.decided, which is
+// refused once the approval expires
+func (g *Guardrails) await(source, command string, verdict guard.Verdict, p *pendingCommand) protocol.CommandApproval {
+	approval := protocol.CommandApproval{
+		ID:        uuid.New().String(),
+		Command:   command,
+		Source:    source,
+		Rule:      verdict.Rule,
+		Reason:    verdict.Reason,
+		ExpiresAt: time.Now().Add(g.timeout),
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[approval.ID] = p
+	p.expiry = time.AfterFunc(g.timeout, func() {
+		if g.resolve(approval.ID, func(*pendingCommand) bool { return true }, false) {
+			log.Info().Str("source", source).Str("rule", verdict.Rule).Msg("guarded command not approved in time")
+		}
+	})
+	return approval
+}
+
+// resolve passes approved to the command with id if may allows it,
+// reporting false if there is no such command
+func (g *Guardrails) resolve(id string, may func(*pendingCommand) bool, approved bool) bool {
+	g.mu.Lock()
+	p, ok := g.pending[id]
+	ok = ok && may(p)
+	if ok {
+		delete(g.pending, id)
+	}
+	g.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	p.expiry.Stop()
+	p.decided <- approved
+	return true
+}
+
+// decide passes the decision of h's user to the command waiting for it
+func (g *Guardrails) decide(h *UnifiedHandler, decision protocol.CommandDecision) bool {
+	return g.resolve(decision.ID, func(p *pendingCommand) bool {
+		if p.terminalID != "" {
+			return h.terminals.streaming(p.terminalID)
+		}
+		return p.owner == h.Grant().Subject
+	}, decision.Approved)
+}
+
+// approvalMessage wraps an approval request for the client
+func approvalMessage(correlationID string, approval protocol.CommandApproval) *protocol.Message {
+	payload, _ := json.Marshal(approval)
+	return &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeCommandApproval,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: correlationID,
+	}
+}
+
+// vetCommand checks the shell command content asks aider to run, if any,
+// and calls run once it may go ahead. Refused commands fail the request
+// with command_denied.
+func (h *UnifiedHandler) vetCommand(msg *protocol.Message, source, content string, run func()) {
+	command := chat.ShellCommand(content)
+	if h.guardrails == nil || command == "" {
+		run()
+		return
+	}
+
+	verdict := h.guardrails.policy.Check(command)
+	switch {
+	case verdict.Action == guard.Allow:
+		run()
+		return
+	case verdict.Action == guard.Deny:
+		h.sendError(msg.ID, "command_denied", command+" is not allowed: "+verdict.Reason, false)
+		return
+	case !h.supports(protocol.CapabilityCommandApprovals):
+		h.sendError(msg.ID, "command_denied", command+" needs approval, which this client cannot give", false)
+		return
+	}
+
+	decided := make(chan bool, 1)
+	approval := h.guardrails.await(source, command, verdict, &pendingCommand{owner: h.Grant().Subject, decided: decided})
+	h.deliverReliable(approvalMessage(msg.ID, approval))
+	go func() {
+		if <-decided {
+			run()
+			return
+		}
+		h.deliverOrKeep(h.errorMessage(msg.ID, protocol.ChatError{
+			Error: command + " was not approved",
+			Code:  "command_denied",
+		}), false)
+	}()
+}
+
+// handleCommandDecision passes the user's decision on a guarded command to
+// the request or terminal line waiting for it
+func (h *UnifiedHandler) handleCommandDecision(msg *protocol.Message) {
+	var decision protocol.CommandDecision
+	if err := json.Unmarshal(msg.Payload, &decision); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+	if h.guardrails == nil || !h.guardrails.decide(h, decision) {
+		h.sendError(msg.ID, "unknown_command", "no command "+decision.ID+" is waiting for approval", false)
+	}
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/guard"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// expectChatError reads the next message, which must fail request id with
+// code
+func expectChatError(t *testing.T, transport *httpTransport, id, code string) {
+	t.Helper()
+	msg := nextOutbound(t, transport)
+	var chatErr protocol.ChatError
+	if json.Unmarshal(msg.Payload, &chatErr); msg.Type != protocol.TypeChatError || msg.ID != id || chatErr.Code != code {
+		t.Fatalf("expected %s for %s, got %+v %s", code, id, msg, msg.Payload)
+	}
+}
+
+func TestChatCommandsWaitForApproval(t *testing.T) {
+	guardrails := NewGuardrails(guard.Default(), nil)
+	_, transport, _ := startExpiringHandler(t, WithGuardrails(guardrails), WithGrant(Grant{Subject: "alice"}))
+	if hello := helloWith(t, transport, protocol.CapabilityCommandApprovals); len(hello.Capabilities) != 1 {
+		t.Fatalf("expected command_approvals agreed, got %v", hello.Capabilities)
+	}
+
+	chat := func(id, content string) {
+		payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: content})
+		transport.push(&protocol.Message{ID: id, Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	}
+	awaitApproval := func(id string) protocol.CommandApproval {
+		t.Helper()
+		msg := nextOutbound(t, transport)
+		var approval protocol.CommandApproval
+		json.Unmarshal(msg.Payload, &approval)
+		if msg.Type != protocol.TypeCommandApproval || msg.CorrelationID != id || !msg.RequiresAck {
+			t.Fatalf("expected an approval request for %s, got %+v", id, msg)
+		}
+		if approval.Command != "rm -rf build" || approval.Source != protocol.CommandSourceChat || approval.Reason == "" {
+			t.Fatalf("unexpected approval %+v", approval)
+		}
+		return approval
+	}
+	decide := func(id, approvalID string, approved bool) {
+		payload, _ := json.Marshal(protocol.CommandDecision{ID: approvalID, Approved: approved})
+		transport.push(&protocol.Message{ID: id, Type: protocol.TypeCommandDecision, Timestamp: time.Now(), Payload: payload})
+	}
+
+	chat("c1", "/run rm -rf build")
+	approval := awaitApproval("c1")
+
+	decide("d1", "nope", true)
+	expectChatError(t, transport, "d1", "unknown_command")
+
+	decide("d2", approval.ID, true)
+	for {
+		msg := nextOutbound(t, transport)
+		if msg.Type == protocol.TypeChatError {
+			t.Fatalf("expected the approved command run, got %+v %s", msg, msg.Payload)
+		}
+		if msg.CorrelationID == "c1" || msg.ID == "c1" {
+			break
+		}
+	}
+
+	chat("c2", "/run rm -rf build")
+	approval = awaitApproval("c2")
+	decide("d3", approval.ID, false)
+	expectChatError(t, transport, "c2", "command_denied")
+
+	// Only asked once
+	decide("d4", approval.ID, true)
+	expectChatError(t, transport, "d4", "unknown_command")
+}
+
+func TestGuardedCommandsNeedAnApprovingClient(t *testing.T) {
+	guardrails := NewGuardrails(guard.Default(), nil)
+	_, transport, _ := startExpiringHandler(t, WithGuardrails(guardrails))
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "/git push --force"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	expectChatError(t, transport, "c1", "command_denied")
+}
+
+func TestUnreadableTerminalLinesAreNotAllowed(t *testing.T) {
+	guardrails := NewGuardrails(guard.Default(), nil)
+	if decided := guardrails.Terminal("term-1", "ls -la"); decided != nil {
+		t.Fatal("expected an unguarded command to run")
+	}
+	decided := guardrails.Terminal("term-1", "")
+	if decided == nil {
+		t.Fatal("expected a line the terminal could not read to be vetted")
+	}
+	if <-decided {
+		t.Fatal("expected the line refused without an approving client")
+	}
+
+	open := NewGuardrails(&guard.Policy{}, nil)
+	if decided := open.Terminal("term-1", ""); decided != nil {
+		t.Fatal("expected every line to run without rules")
+	}
+}
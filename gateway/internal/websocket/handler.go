@@ -167,7 +167,17 @@ func (h *Handler) handleChat(msg *protocol.Message) {
 
 	go func() {
 		for reply := range replies {
-			replyData, _ := json.Marshal(reply)
+			// Recovery and queue events need protocol version 2, which
+			// this handler does not negotiate
+			if reply.Recovery != nil || reply.Queued != nil {
+				continue
+			}
+			if reply.Error != nil {
+				h.sendError(msg.ID, reply.Error.Code, reply.Error.Error, reply.Error.Retryable)
+				h.queue.Ack(msg.ID)
+				break
+			}
+			replyData := reply.AppendJSON(nil)
 			h.send <- &protocol.Message{
 				ID:        uuid.New().String(),
 				Type:      protocol.TypeChatStream,
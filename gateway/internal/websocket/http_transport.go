@@ -0,0 +1,421 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// httpWriteTimeout is how long outbound messages may wait for the
+	// client to open an event stream or poll before the session is dropped
+	httpWriteTimeout = 30 * time.Second
+
+	// httpIdleTimeout ends sessions whose client has made no request
+	httpIdleTimeout = 2 * time.Minute
+
+	longPollTimeout = 25 * time.Second
+	maxPollBatch    = 100
+	sseKeepalive    = 15 * time.Second
+)
+
+// SessionSecretHeader carries the secret an HTTP fallback session was
+// created with on each later request for it
+const SessionSecretHeader = "X-Session-Secret"
+
+// httpTransport carries protocol messages over plain HTTP requests for
+// clients whose network breaks WebSockets. Inbound messages arrive by POST;
+// outbound messages are read by an SSE stream or long-poll requests.
+type httpTransport struct {
+	inbound  chan *protocol.Message
+	outbound chan *protocol.Message
+
+	// secret is handed to the client that created the session, and only
+	// to it; requests without it are refused
+	secret string
+
+	// Only one event stream or poll may read outbound messages at a time
+	reader sync.Mutex
+
+	lastSeen  atomic.Int64 // unix nanoseconds of the last client request
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHTTPTransport() *httpTransport {
+	t := &httpTransport{
+		inbound:  make(chan *protocol.Message, 64),
+		outbound: make(chan *protocol.Message, 256),
+		done:     make(chan struct{}),
+	}
+	t.touch()
+	return t
+}
+
+// authorized reports whether r carries the session's secret
+func (t *httpTransport) authorized(r *http.Request) bool {
+	secret := r.Header.Get(SessionSecretHeader)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(t.secret)) == 1
+}
+
+func (t *httpTransport) ReadMessage() (*protocol.Message, error) {
+	select {
+	case msg := <-t.inbound:
+		return msg, nil
+	case <-t.done:
+		return nil, io.EOF
+	}
+}
+
+func (t *httpTransport) WriteMessage(msg *protocol.Message) error {
+	select {
+	case t.outbound <- msg:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	case <-time.After(httpWriteTimeout):
+		return fmt.Errorf("client is not reading events")
+	}
+}
+
+func (t *httpTransport) Keepalive() error {
+	idle := time.Since(time.Unix(0, t.lastSeen.Load()))
+	if idle > httpIdleTimeout {
+		return fmt.Errorf("no client request for %s", idle.Round(time.Second))
+	}
+	return nil
+}
+
+func (t *httpTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+func (t *httpTransport) LastHeartbeat() time.Time {
+	return time.Unix(0, t.lastSeen.Load())
+}
+
+func (t *httpTransport) touch() {
+	t.lastSeen.Store(time.Now().UnixNano())
+}
+
+// push hands an inbound message to the handler
+func (t *httpTransport) push(msg *protocol.Message) error {
+	select {
+	case t.inbound <- msg:
+		return nil
+	case <-t.done:
+		return errTransportClosed
+	case <-time.After(writeTimeout):
+		return fmt.Errorf("session is not accepting messages")
+	}
+}
+
+// HandlerFactory builds the protocol handler for a new session. Servers pass
+// per-session options, such as the session's grant.
+type HandlerFactory func(transport Transport, opts ...UnifiedHandlerOption) *UnifiedHandler
+
+// FallbackServer serves the gateway protocol over plain HTTP:
+//
+//	POST   /sessions               start a session
+//	POST   /sessions/{id}/messages send a message or an array of messages
+//	GET    /sessions/{id}/events   receive messages as server-sent events
+//	GET    /sessions/{id}/poll     long-poll for a batch of messages
+//	DELETE /sessions/{id}          end the session
+//
+// Starting a session returns its ID and a secret, which every later request
+// for the session presents in the X-Session-Secret header. Sessions share the
+// handler, queue and message types used over WebSockets.
+type FallbackServer struct {
+	newHandler   HandlerFactory
+	limiter      *ConnLimiter
+	authenticate Authenticator
+
+	mu       sync.Mutex
+	sessions map[string]*httpTransport
+}
+
+// NewFallbackServer creates an HTTP fallback server
+func NewFallbackServer(newHandler HandlerFactory, opts ...ServerOption) *FallbackServer {
+	config := newServerConfig(opts)
+	return &FallbackServer{
+		newHandler:   newHandler,
+		limiter:      config.limiter,
+		authenticate: config.authenticate,
+		sessions:     make(map[string]*httpTransport),
+	}
+}
+
+func (s *FallbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 0 || parts[0] != "sessions" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.createSession(w, r)
+		return
+	}
+
+	// A session is only found with its secret: the ID alone shows up in
+	// places the secret does not, such as logs and the session history
+	t := s.session(parts[1])
+	if t == nil || !t.authorized(r) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	t.touch()
+
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	} else if len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		t.Close()
+		w.WriteHeader(http.StatusNoContent)
+	case action == "messages" && r.Method == http.MethodPost:
+		s.postMessages(w, r, t)
+	case action == "events" && r.Method == http.MethodGet:
+		s.streamEvents(w, r, t)
+	case action == "poll" && r.Method == http.MethodGet:
+		s.poll(w, r, t)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *FallbackServer) createSession(w http.ResponseWriter, r *http.Request) {
+	// The session's secret authorizes later requests, so a token expiring
+	// mid-session does not end it
+	grant, err := s.authenticate.check(RequestToken(r))
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("unauthorized http fallback session")
+		RejectUnauthorized(w, err)
+		return
+	}
+
+	secret, err := newSessionSecret()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create http fallback session secret")
+		http.Error(w, "failed to start session", http.StatusInternalServerError)
+		return
+	}
+
+	release, err := s.limiter.Acquire(ClientKey(r))
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected http fallback session")
+		RejectHTTP(w, err)
+		return
+	}
+
+	t := newHTTPTransport()
+	t.secret = secret
+	h := s.newHandler(t, WithGrant(grant), WithClient(ClientInfo{
+		Transport:  "http",
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}))
+	sessionID := h.SessionID()
+
+	s.mu.Lock()
+	s.sessions[sessionID] = t
+	s.mu.Unlock()
+
+	go func() {
+		defer release()
+		h.Run()
+
+		s.mu.Lock()
+		delete(s.sessions, sessionID)
+		s.mu.Unlock()
+
+		log.Info().Str("session_id", sessionID).Msg("http fallback session closed")
+	}()
+
+	log.Info().
+		Str("session_id", sessionID).
+		Str("remote", r.RemoteAddr).
+		Msg("new http fallback session")
+
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"session_id":     sessionID,
+		"session_secret": secret,
+	})
+}
+
+// newSessionSecret returns a random secret for a new session
+func newSessionSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s *FallbackServer) session(id string) *httpTransport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *FallbackServer) postMessages(w http.ResponseWriter, r *http.Request, t *httpTransport) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var messages []*protocol.Message
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &messages)
+	} else {
+		var msg protocol.Message
+		err = json.Unmarshal(body, &msg)
+		messages = append(messages, &msg)
+	}
+	if err != nil {
+		http.Error(w, "invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, msg := range messages {
+		if err := t.push(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *FallbackServer) streamEvents(w http.ResponseWriter, r *http.Request, t *httpTransport) {
+	if !t.reader.TryLock() {
+		http.Error(w, "session already has a reader", http.StatusConflict)
+		return
+	}
+	defer t.reader.Unlock()
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ticker := time.NewTicker(sseKeepalive)
+	defer ticker.Stop()
+
+	var data []byte
+	for {
+		select {
+		case msg := <-t.outbound:
+			var err error
+			data, err = msg.AppendJSON(data[:0])
+			if err != nil {
+				log.Error().Err(err).Msg("failed to encode event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", msg.ID, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-t.done:
+			io.WriteString(w, "event: close\ndata: {}\n\n")
+			rc.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		t.touch()
+	}
+}
+
+func (s *FallbackServer) poll(w http.ResponseWriter, r *http.Request, t *httpTransport) {
+	if !t.reader.TryLock() {
+		http.Error(w, "session already has a reader", http.StatusConflict)
+		return
+	}
+	defer t.reader.Unlock()
+
+	timeout := longPollTimeout
+	if secs, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && secs >= 0 {
+		if d := time.Duration(secs) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + writeTimeout))
+
+	messages := make([]*protocol.Message, 0, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-t.outbound:
+		messages = append(messages, msg)
+	case <-timer.C:
+	case <-t.done:
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// Return whatever else is already waiting
+drain:
+	for len(messages) > 0 && len(messages) < maxPollBatch {
+		select {
+		case msg := <-t.outbound:
+			messages = append(messages, msg)
+		default:
+			break drain
+		}
+	}
+
+	t.touch()
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
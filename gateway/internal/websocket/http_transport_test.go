@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+type echoChat struct{}
+
+func (echoChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 1)
+	replies <- &protocol.ChatReply{Content: msg.Content, Finished: true}
+	close(replies)
+	return replies, nil
+}
+
+func newFallbackTestServer(t *testing.T, opts ...ServerOption) *httptest.Server {
+	t.Helper()
+
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	fallback := NewFallbackServer(func(transport Transport, handlerOpts ...UnifiedHandlerOption) *UnifiedHandler {
+		return NewTransportHandler(transport, echoChat{}, manager, handlerOpts...)
+	}, opts...)
+	server := httptest.NewServer(fallback)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fallbackSession is an HTTP fallback session a test created
+type fallbackSession struct {
+	url    string
+	secret string
+}
+
+// do sends a request for the session, with its secret
+func (s fallbackSession) do(t *testing.T, method, path string, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, s.url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(SessionSecretHeader, s.secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func createFallbackSession(t *testing.T, server *httptest.Server) fallbackSession {
+	t.Helper()
+
+	resp, err := http.Post(server.URL+"/sessions", "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create session: status %d", resp.StatusCode)
+	}
+	var created struct {
+		SessionID     string `json:"session_id"`
+		SessionSecret string `json:"session_secret"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode session: %v", err)
+	}
+	if created.SessionSecret == "" {
+		t.Fatal("create session: no secret")
+	}
+	return fallbackSession{url: server.URL + "/sessions/" + created.SessionID, secret: created.SessionSecret}
+}
+
+func postFallbackMessage(t *testing.T, session fallbackSession, body string) {
+	t.Helper()
+
+	resp := session.do(t, http.MethodPost, "/messages", body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("post message: status %d", resp.StatusCode)
+	}
+}
+
+func TestFallbackLongPoll(t *testing.T) {
+	server := newFallbackTestServer(t)
+	session := createFallbackSession(t, server)
+
+	postFallbackMessage(t, session, `{"id":"p1","type":"ping"}`)
+
+	resp := session.do(t, http.MethodGet, "/poll?timeout=5", "")
+	defer resp.Body.Close()
+
+	var messages []*protocol.Message
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		t.Fatalf("decode poll: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Type != protocol.TypePong {
+		t.Fatalf("expected a pong, got %+v", messages)
+	}
+
+	resp = session.do(t, http.MethodDelete, "", "")
+	resp.Body.Close()
+
+	// The session is removed once its handler has stopped
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := session.do(t, http.MethodGet, "/poll?timeout=0", "")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session still available after delete: status %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFallbackServerSentEvents(t *testing.T) {
+	server := newFallbackTestServer(t)
+	session := createFallbackSession(t, server)
+
+	resp := session.do(t, http.MethodGet, "/events", "")
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	// A second reader is refused while the stream is open
+	second := session.do(t, http.MethodGet, "/poll?timeout=0", "")
+	second.Body.Close()
+	if second.StatusCode != http.StatusConflict {
+		t.Fatalf("expected conflict for second reader, got %d", second.StatusCode)
+	}
+
+	postFallbackMessage(t, session,
+		`[{"id":"c1","type":"chat","payload":{"role":"user","content":"hello"}}]`)
+
+	events := make(chan *protocol.Message)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var msg protocol.Message
+			if json.Unmarshal([]byte(data), &msg) == nil {
+				events <- &msg
+			}
+		}
+		close(events)
+	}()
+
+	select {
+	case msg, ok := <-events:
+		if !ok {
+			t.Fatal("event stream closed early")
+		}
+		if msg.Type != protocol.TypeChatStream || !msg.RequiresAck || msg.CorrelationID != "c1" {
+			t.Fatalf("unexpected event %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for chat reply event")
+	}
+}
+
+func TestFallbackRequestsNeedTheSessionSecret(t *testing.T) {
+	server := newFallbackTestServer(t)
+	session := createFallbackSession(t, server)
+
+	// Knowing the session ID is not enough to use the session
+	for _, secret := range []string{"", "not-the-secret", session.secret[1:]} {
+		for _, req := range []struct{ method, path string }{
+			{http.MethodPost, "/messages"},
+			{http.MethodGet, "/events"},
+			{http.MethodGet, "/poll?timeout=0"},
+			{http.MethodDelete, ""},
+		} {
+			stolen := fallbackSession{url: session.url, secret: secret}
+			resp := stolen.do(t, req.method, req.path, `{"id":"p1","type":"ping"}`)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s with secret %q: expected 404, got %d", req.method, req.path, secret, resp.StatusCode)
+			}
+		}
+	}
+
+	// The session is untouched and still answers its client
+	postFallbackMessage(t, session, `{"id":"p2","type":"ping"}`)
+	resp := session.do(t, http.MethodGet, "/poll?timeout=5", "")
+	defer resp.Body.Close()
+	var messages []*protocol.Message
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		t.Fatalf("decode poll: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Type != protocol.TypePong {
+		t.Fatalf("expected only the pong for p2, got %+v", messages)
+	}
+}
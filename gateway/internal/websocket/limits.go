@@ -0,0 +1,148 @@
+package websocket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// limitRetryAfter is the Retry-After hint, in seconds, sent with a rejection
+const limitRetryAfter = "30"
+
+var (
+	// ErrTooManyConnections is returned when the gateway is at capacity
+	ErrTooManyConnections = errors.New("gateway connection limit reached")
+
+	// ErrTooManyClientConnections is returned when one client holds too
+	// many connections
+	ErrTooManyClientConnections = errors.New("per-client connection limit reached")
+)
+
+// ConnLimiter caps the number of concurrent sessions, both in total and per
+// client, so a misbehaving client cannot exhaust file descriptors and PTYs.
+// A nil limiter, or a limit of zero, imposes no cap.
+type ConnLimiter struct {
+	maxTotal     int
+	maxPerClient int
+
+	mu        sync.Mutex
+	total     int
+	perClient map[string]int
+}
+
+// NewConnLimiter creates a limiter allowing maxTotal concurrent sessions, of
+// which at most maxPerClient may belong to the same client
+func NewConnLimiter(maxTotal, maxPerClient int) *ConnLimiter {
+	return &ConnLimiter{
+		maxTotal:     maxTotal,
+		maxPerClient: maxPerClient,
+		perClient:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a session slot for client. The returned release function
+// frees the slot; it is safe to call more than once.
+func (l *ConnLimiter) Acquire(client string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return nil, ErrTooManyConnections
+	}
+	if l.maxPerClient > 0 && l.perClient[client] >= l.maxPerClient {
+		return nil, ErrTooManyClientConnections
+	}
+
+	l.total++
+	l.perClient[client]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(client) })
+	}, nil
+}
+
+func (l *ConnLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perClient[client] <= 1 {
+		delete(l.perClient, client)
+	} else {
+		l.perClient[client]--
+	}
+}
+
+// Count returns the number of sessions currently holding a slot
+func (l *ConnLimiter) Count() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// ClientKey identifies the client making r for per-client limits. Requests
+// carrying a bearer token (Authorization header or token query parameter)
+// are keyed by a hash of the token, others by remote IP.
+func ClientKey(r *http.Request) string {
+	return clientKey(RequestToken(r), r.RemoteAddr)
+}
+
+// RequestToken returns the bearer token from the Authorization header, or
+// from the token query parameter for clients that cannot set headers
+// (browser WebSockets)
+func RequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func clientKey(token, remoteAddr string) string {
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// RejectHTTP answers a request refused by the limiter with 429 Too Many
+// Requests and the reason
+func RejectHTTP(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", limitRetryAfter)
+	writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+}
+
+// RejectUnauthorized answers a request whose token was refused with 401
+func RejectUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+}
+
+// RejectWebSocket closes an upgraded connection refused by the limiter with
+// close code 1013 (try again later) and the reason. Browsers cannot read the
+// status of a failed handshake, so the connection is upgraded first.
+func RejectWebSocket(conn *websocket.Conn, err error) {
+	msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeTimeout))
+	conn.Close()
+}
@@ -0,0 +1,113 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnLimiter(t *testing.T) {
+	limiter := NewConnLimiter(3, 2)
+
+	releaseA1, err := limiter.Acquire("a")
+	if err != nil {
+		t.Fatalf("first connection rejected: %v", err)
+	}
+	if _, err := limiter.Acquire("a"); err != nil {
+		t.Fatalf("second connection rejected: %v", err)
+	}
+	if _, err := limiter.Acquire("a"); err != ErrTooManyClientConnections {
+		t.Fatalf("expected per-client limit, got %v", err)
+	}
+	if _, err := limiter.Acquire("b"); err != nil {
+		t.Fatalf("other client rejected: %v", err)
+	}
+	if _, err := limiter.Acquire("c"); err != ErrTooManyConnections {
+		t.Fatalf("expected global limit, got %v", err)
+	}
+
+	// Releasing twice must only free one slot
+	releaseA1()
+	releaseA1()
+	if got := limiter.Count(); got != 2 {
+		t.Fatalf("expected 2 connections after release, got %d", got)
+	}
+	if _, err := limiter.Acquire("c"); err != nil {
+		t.Fatalf("connection rejected after release: %v", err)
+	}
+
+	var unlimited *ConnLimiter
+	release, err := unlimited.Acquire("a")
+	if err != nil {
+		t.Fatalf("nil limiter rejected a connection: %v", err)
+	}
+	release()
+}
+
+func TestClientKey(t *testing.T) {
+	byIP := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	byIP.RemoteAddr = "10.0.0.1:5000"
+	samePort := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	samePort.RemoteAddr = "10.0.0.1:6000"
+	if ClientKey(byIP) != ClientKey(samePort) {
+		t.Error("connections from one IP got different keys")
+	}
+
+	header := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	header.Header.Set("Authorization", "Bearer secret")
+	query := httptest.NewRequest(http.MethodGet, "/ws?token=secret", nil)
+	query.RemoteAddr = "10.0.0.2:5000"
+	if ClientKey(header) != ClientKey(query) {
+		t.Error("same token got different keys")
+	}
+	if ClientKey(header) == ClientKey(byIP) {
+		t.Error("token and IP clients share a key")
+	}
+}
+
+func TestFallbackRejectsOverLimit(t *testing.T) {
+	server := newFallbackTestServer(t, WithConnLimiter(NewConnLimiter(0, 1)))
+
+	createFallbackSession(t, server)
+
+	resp, err := http.Post(server.URL+"/sessions", "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("rejection has no Retry-After header")
+	}
+}
+
+func TestFallbackRequiresToken(t *testing.T) {
+	server := newFallbackTestServer(t, WithAuthenticator(func(token string) (Grant, error) {
+		if token != "valid" {
+			return Grant{}, errors.New("bad token")
+		}
+		return Grant{TokenID: "token-1"}, nil
+	}))
+
+	resp, err := http.Post(server.URL+"/sessions", "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/sessions?token=valid", "application/json", nil)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 with token, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/devtail/gateway/internal/queue"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// WithMailboxes keeps the chat replies and reliable messages a session
+// cannot deliver because its client disconnected in m, until the client
+// resumes the session with a reconnect message from another connection
+func WithMailboxes(m *queue.Mailboxes) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.mailboxes = m
+	}
+}
+
+// deliverOrKeep sends msg, acknowledged if reliable, and keeps it in the
+// session's mailbox once the client is gone. It reports false if msg was
+// neither sent nor kept.
+func (h *UnifiedHandler) deliverOrKeep(msg *protocol.Message, reliable bool) bool {
+	if h.ctx.Err() == nil {
+		send := h.deliver
+		if reliable {
+			send = h.deliverReliable
+		}
+		if send(msg) {
+			return true
+		}
+	}
+	// The connection that resumes the session must ask for the ack too
+	msg.RequiresAck = reliable
+	return h.keep(msg)
+}
+
+// keep stores msg in the session's mailbox, reporting false without one
+func (h *UnifiedHandler) keep(msg *protocol.Message) bool {
+	if h.mailboxes == nil {
+		return false
+	}
+	if err := h.mailboxes.Put(h.sessionID, h.Grant().Subject, msg); err != nil {
+		h.log.Error().Err(err).Str("id", msg.ID).Msg("failed to keep message for the client")
+		return false
+	}
+	return true
+}
+
+// keepUnacked moves the messages the client never acknowledged to the
+// session's mailbox, so they are delivered again when it resumes from
+// another connection. Messages already kept are ignored by ID, so calling
+// it twice is harmless.
+func (h *UnifiedHandler) keepUnacked() {
+	if h.mailboxes == nil {
+		return
+	}
+	messages := h.queue.GetMessagesAfter(0)
+	sort.Slice(messages, func(i, j int) bool { return messages[i].SeqNum < messages[j].SeqNum })
+	for _, msg := range messages {
+		h.keep(msg)
+	}
+}
+
+// resume delivers the messages kept for another session of the same user,
+// and forwards those kept for it from then on to this connection. It
+// reports false if there is no such session.
+func (h *UnifiedHandler) resume(sessionID string) bool {
+	if h.mailboxes == nil || sessionID == "" {
+		return false
+	}
+	forward := func(msg *protocol.Message) bool {
+		return h.deliverOrKeep(msg, msg.RequiresAck)
+	}
+	messages, dropped, ok := h.mailboxes.Take(sessionID, h.Grant().Subject, forward)
+	if !ok {
+		return false
+	}
+
+	h.timeline.record(EventResumed, "session_id", sessionID,
+		"delivered", strconv.Itoa(len(messages)), "dropped", strconv.Itoa(dropped))
+	if dropped > 0 {
+		h.log.Warn().Str("resumed_session_id", sessionID).Int("dropped", dropped).
+			Msg("mailbox was full, oldest messages were dropped")
+	}
+	for _, msg := range messages {
+		forward(msg)
+	}
+	return true
+}
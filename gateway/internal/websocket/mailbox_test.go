@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/queue"
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestChatRepliesWaitForTheClientToResume(t *testing.T) {
+	mailboxes, err := queue.OpenMailboxes(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+	chat := streamingChat{replies: make(chan *protocol.ChatReply), ctx: make(chan context.Context, 1)}
+
+	first := newHTTPTransport()
+	h := NewTransportHandler(first, chat, manager, WithMailboxes(mailboxes), WithGrant(Grant{Subject: "alice"}))
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "refactor everything"})
+	first.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	<-chat.ctx
+	first.Close()
+	<-done
+
+	chat.replies <- &protocol.ChatReply{Content: "all "}
+	chat.replies <- &protocol.ChatReply{Content: "done", Finished: true}
+	close(chat.replies)
+	// The handler keeps the last reply after taking it
+	waitForKept(t, mailboxes, 2)
+
+	// Another user cannot pick the replies up
+	other := newHTTPTransport()
+	go NewTransportHandler(other, echoChat{}, manager, WithMailboxes(mailboxes), WithGrant(Grant{Subject: "mallory"})).Run()
+	t.Cleanup(func() { other.Close() })
+	reconnect, _ := json.Marshal(protocol.ReconnectMessage{SessionID: h.SessionID()})
+	other.push(&protocol.Message{ID: "r1", Type: protocol.TypeReconnect, Timestamp: time.Now(), Payload: reconnect})
+	other.push(&protocol.Message{ID: "p1", Type: protocol.TypePing, Timestamp: time.Now()})
+	if msg := nextOutbound(t, other); msg.Type != protocol.TypePong {
+		t.Fatalf("another user's reconnect got %+v", msg)
+	}
+
+	second := newHTTPTransport()
+	go NewTransportHandler(second, echoChat{}, manager, WithMailboxes(mailboxes), WithGrant(Grant{Subject: "alice"})).Run()
+	t.Cleanup(func() { second.Close() })
+	second.push(&protocol.Message{ID: "r2", Type: protocol.TypeReconnect, Timestamp: time.Now(), Payload: reconnect})
+
+	for _, want := range []struct {
+		content  string
+		finished bool
+	}{{"all ", false}, {"done", true}} {
+		msg := nextOutbound(t, second)
+		var reply protocol.ChatReply
+		json.Unmarshal(msg.Payload, &reply)
+		if msg.Type != protocol.TypeChatStream || msg.CorrelationID != "c1" || reply.Content != want.content || msg.RequiresAck != want.finished {
+			t.Fatalf("expected kept reply %q, got %+v", want.content, msg)
+		}
+	}
+	waitForKept(t, mailboxes, 0)
+}
+
+// waitForKept waits for the mailboxes to hold n messages
+func waitForKept(t *testing.T, mailboxes *queue.Mailboxes, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := mailboxes.Stats()
+		if stats.Messages == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages kept, got %+v", n, stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
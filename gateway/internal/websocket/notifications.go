@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// NotifyTerminal passes a desktop notification a program in a terminal asked
+// for to every live session that shows notifications. It returns how many
+// sessions it was sent to.
+func (r *SessionRegistry) NotifyTerminal(terminalID string, n terminal.Notification) int {
+	notification := protocol.Notification{
+		Source:     protocol.NotificationSourceTerminal,
+		TerminalID: terminalID,
+		Title:      n.Title,
+		Body:       n.Body,
+		Time:       time.Now(),
+	}
+
+	sent := 0
+	for _, h := range r.handlers() {
+		if h.supports(protocol.CapabilityNotifications) {
+			// A session whose client stopped reading must not hold up the
+			// others
+			go h.Notify(notification)
+			sent++
+		}
+	}
+	return sent
+}
+
+// Notify sends the client a notification, kept for it if it is away: a
+// build finishing is what it wants to hear of when it comes back
+func (h *UnifiedHandler) Notify(n protocol.Notification) {
+	payload, _ := json.Marshal(n)
+	if h.deliverOrKeep(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeNotification,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}, true) {
+		h.timeline.record(EventNotified, "source", n.Source, "terminal_id", n.TerminalID)
+	}
+}
@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestTerminalNotificationsReachSessionsThatShowThem(t *testing.T) {
+	sessions := NewSessionRegistry()
+	_, plain, _ := startExpiringHandler(t, WithSessionRegistry(sessions))
+	helloWith(t, plain)
+	_, notified, _ := startExpiringHandler(t, WithSessionRegistry(sessions))
+	if hello := helloWith(t, notified, protocol.CapabilityNotifications); len(hello.Capabilities) != 1 {
+		t.Fatalf("expected notifications agreed, got %v", hello.Capabilities)
+	}
+
+	if sent := sessions.NotifyTerminal("t1", terminal.Notification{Title: "make", Body: "build finished"}); sent != 1 {
+		t.Fatalf("expected one session notified, got %d", sent)
+	}
+	msg := nextOutbound(t, notified)
+	var n protocol.Notification
+	json.Unmarshal(msg.Payload, &n)
+	if msg.Type != protocol.TypeNotification || !msg.RequiresAck || n.Source != protocol.NotificationSourceTerminal ||
+		n.TerminalID != "t1" || n.Title != "make" || n.Body != "build finished" {
+		t.Fatalf("expected the notification, acknowledged, got %+v %s", msg, msg.Payload)
+	}
+
+	select {
+	case msg := <-plain.outbound:
+		t.Fatalf("expected nothing for a session without notifications, got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
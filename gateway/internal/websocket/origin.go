@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may open sessions. Requests
+// without an Origin header (native mobile apps, CLI tools) are always
+// allowed; browsers always send one, so this is what blocks cross-site use.
+type OriginPolicy struct {
+	allowAll bool
+	exact    map[string]bool
+	suffixes []string // from "scheme://*.domain" entries, stored as "scheme://" + ".domain"
+}
+
+// NewOriginPolicy builds a policy from origins such as "https://app.devtail.dev"
+// or "https://*.devtail.dev". An entry of "*" allows every origin. With no
+// entries only same-origin requests are allowed.
+func NewOriginPolicy(origins []string) *OriginPolicy {
+	p := &OriginPolicy{exact: make(map[string]bool)}
+
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "":
+		case origin == "*":
+			p.allowAll = true
+		case strings.Contains(origin, "://*."):
+			scheme, domain, _ := strings.Cut(origin, "://*")
+			p.suffixes = append(p.suffixes, scheme+"://"+domain)
+		default:
+			p.exact[origin] = true
+		}
+	}
+
+	return p
+}
+
+// AllowAllOrigins returns a policy accepting every origin, for development
+func AllowAllOrigins() *OriginPolicy {
+	return &OriginPolicy{allowAll: true, exact: map[string]bool{}}
+}
+
+// Check reports whether the request's origin is allowed. It has the
+// signature expected by websocket.Upgrader.CheckOrigin.
+func (p *OriginPolicy) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.allowAll {
+		return true
+	}
+	return p.allowed(origin, r.Host)
+}
+
+func (p *OriginPolicy) allowed(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	normalized := strings.ToLower(u.Scheme + "://" + u.Host)
+	if p.exact[normalized] {
+		return true
+	}
+
+	for _, suffix := range p.suffixes {
+		scheme, domain, _ := strings.Cut(suffix, "://")
+		if strings.EqualFold(u.Scheme, scheme) && strings.HasSuffix(strings.ToLower(u.Host), domain) {
+			return true
+		}
+	}
+
+	// Same origin is always fine
+	return strings.EqualFold(u.Host, host)
+}
+
+// CORS wraps an HTTP handler with CORS headers for allowed origins. Requests
+// from other origins are rejected outright rather than merely left without
+// headers, since simple POSTs would otherwise still reach the handler.
+func (p *OriginPolicy) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !p.Check(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		// Preflight
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID, "+SessionSecretHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginPolicyCheck(t *testing.T) {
+	policy := NewOriginPolicy([]string{"https://app.devtail.dev/", "https://*.preview.devtail.dev"})
+
+	tests := []struct {
+		origin string
+		host   string
+		want   bool
+	}{
+		{"", "gw.devtail.dev", true},
+		{"https://app.devtail.dev", "gw.devtail.dev", true},
+		{"HTTPS://APP.DEVTAIL.DEV", "gw.devtail.dev", true},
+		{"http://app.devtail.dev", "gw.devtail.dev", false},
+		{"https://pr-12.preview.devtail.dev", "gw.devtail.dev", true},
+		{"https://preview.devtail.dev.evil.com", "gw.devtail.dev", false},
+		{"https://evil.com", "gw.devtail.dev", false},
+		{"https://gw.devtail.dev", "gw.devtail.dev", true},
+		{"null", "gw.devtail.dev", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := policy.Check(r); got != tt.want {
+			t.Errorf("origin %q on host %q: got %v, want %v", tt.origin, tt.host, got, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	if !AllowAllOrigins().Check(r) || !NewOriginPolicy([]string{"*"}).Check(r) {
+		t.Error("allow-all policies rejected an origin")
+	}
+}
+
+func TestOriginPolicyCORS(t *testing.T) {
+	policy := NewOriginPolicy([]string{"https://app.devtail.dev"})
+	handler := policy.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/sessions", nil)
+	preflight.Header.Set("Origin", "https://app.devtail.dev")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, preflight)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.devtail.dev" {
+		t.Fatalf("preflight: status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	blocked := httptest.NewRequest(http.MethodPost, "/sessions", nil)
+	blocked.Header.Set("Origin", "https://evil.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, blocked)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("disallowed origin: expected 403, got %d", rec.Code)
+	}
+
+	native := httptest.NewRequest(http.MethodPost, "/sessions", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, native)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("request without origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// Plans holds the chat plans waiting for the user's decision. Share one
+// between sessions so a plan can be decided from the connection that
+// resumes the session it was drafted in.
+type Plans struct {
+	mu      sync.Mutex
+	pending map[string]pendingPlan
+}
+
+type pendingPlan struct {
+	owner     string
+	decisions chan protocol.ChatPlanDecision
+}
+
+// NewPlans creates an empty set of plans
+func NewPlans() *Plans {
+	return &Plans{pending: make(map[string]pendingPlan)}
+}
+
+// WithPlans keeps the plans the session's chats wait on in p instead of in
+// the session, so another session of the same user can decide them
+func WithPlans(p *Plans) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.plans = p
+	}
+}
+
+// add waits for owner's decision on planID on decisions
+func (p *Plans) add(planID, owner string, decisions chan protocol.ChatPlanDecision) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[planID] = pendingPlan{owner: owner, decisions: decisions}
+}
+
+// remove forgets planID once its chat is over
+func (p *Plans) remove(planID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, planID)
+}
+
+// decide passes decision to the chat waiting on its plan, reporting false
+// if there is none of owner's
+func (p *Plans) decide(owner string, decision protocol.ChatPlanDecision) bool {
+	p.mu.Lock()
+	plan, ok := p.pending[decision.PlanID]
+	if ok && plan.owner == owner {
+		delete(p.pending, decision.PlanID)
+	}
+	p.mu.Unlock()
+	if !ok || plan.owner != owner {
+		return false
+	}
+
+	select {
+	case plan.decisions <- decision:
+	default:
+		// The chat already has a decision waiting
+	}
+	return true
+}
+
+// planMessage registers plan as waiting on decisions and wraps it for the
+// client
+func (h *UnifiedHandler) planMessage(correlationID string, plan *protocol.ChatPlan, decisions chan protocol.ChatPlanDecision) *protocol.Message {
+	h.plans.add(plan.ID, h.Grant().Subject, decisions)
+	payload, _ := json.Marshal(plan)
+	return &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeChatPlan,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: correlationID,
+	}
+}
+
+// handlePlanDecision passes the user's decision on a plan to its chat
+func (h *UnifiedHandler) handlePlanDecision(msg *protocol.Message) {
+	var decision protocol.ChatPlanDecision
+	if err := json.Unmarshal(msg.Payload, &decision); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+	if !h.plans.decide(h.Grant().Subject, decision) {
+		h.sendError(msg.ID, "unknown_plan", "no plan "+decision.PlanID+" is waiting for a decision", false)
+	}
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// answeringChat answers every message with answer
+type answeringChat struct {
+	answer string
+}
+
+func (a answeringChat) Initialize(ctx context.Context) error { return nil }
+func (a answeringChat) Close() error                         { return nil }
+
+func (a answeringChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 1)
+	replies <- &protocol.ChatReply{Content: a.answer, Finished: true}
+	close(replies)
+	return replies, nil
+}
+
+func TestChatPlansWaitForApproval(t *testing.T) {
+	pipeline := chat.NewPipeline(answeringChat{answer: "1. Edit `main.go`\n"}, answeringChat{answer: "edited"}, 0)
+	transport := startTestHandlerWithChat(t, pipeline)
+	if hello := helloWith(t, transport, protocol.CapabilityChatPlans); len(hello.Capabilities) != 1 {
+		t.Fatalf("expected chat_plans agreed, got %v", hello.Capabilities)
+	}
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "fix main"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+
+	var plan protocol.ChatPlan
+	for plan.ID == "" {
+		msg := nextOutbound(t, transport)
+		switch msg.Type {
+		case protocol.TypeChatPlan:
+			json.Unmarshal(msg.Payload, &plan)
+			if msg.CorrelationID != "c1" || !msg.RequiresAck || len(plan.Steps) != 1 || plan.Steps[0].File != "main.go" {
+				t.Fatalf("unexpected plan %+v %+v", msg, plan)
+			}
+		case protocol.TypeChatStream:
+		default:
+			t.Fatalf("expected the plan, got %+v", msg)
+		}
+	}
+
+	unknown, _ := json.Marshal(protocol.ChatPlanDecision{PlanID: "nope", Approved: true})
+	transport.push(&protocol.Message{ID: "d1", Type: protocol.TypeChatPlanDecision, Timestamp: time.Now(), Payload: unknown})
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeChatError || msg.ID != "d1" {
+		t.Fatalf("expected unknown_plan, got %+v", msg)
+	}
+
+	decision, _ := json.Marshal(protocol.ChatPlanDecision{PlanID: plan.ID, Approved: true})
+	transport.push(&protocol.Message{ID: "d2", Type: protocol.TypeChatPlanDecision, Timestamp: time.Now(), Payload: decision})
+	var content string
+	for {
+		msg := nextOutbound(t, transport)
+		if msg.Type != protocol.TypeChatStream {
+			continue
+		}
+		var reply protocol.ChatReply
+		json.Unmarshal(msg.Payload, &reply)
+		content += reply.Content
+		if reply.Finished {
+			break
+		}
+	}
+	if content != "\n\n**Step 1 of 1:** Edit `main.go`\n\nedited" {
+		t.Fatalf("expected the approved step carried out, got %q", content)
+	}
+}
@@ -2,8 +2,9 @@ package websocket
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"strconv"
 	"sync"
 	"time"
 
@@ -38,17 +39,32 @@ type ProtoHandler struct {
 	// Options
 	batchSize    int
 	batchTimeout time.Duration
+	adaptive     bool
 	useBinary    bool
+	batcher      *batcher
 }
 
 // ProtoHandlerOption configures the handler
 type ProtoHandlerOption func(*ProtoHandler)
 
-// WithBatching enables message batching
+// WithBatching batches messages with a fixed window: up to size messages,
+// the first waiting at most timeout
 func WithBatching(size int, timeout time.Duration) ProtoHandlerOption {
 	return func(h *ProtoHandler) {
 		h.batchSize = size
 		h.batchTimeout = timeout
+		h.adaptive = false
+	}
+}
+
+// WithAdaptiveBatching sizes the batch window from the measured round trip
+// and the send backlog, up to size messages and maxDelay. This is the
+// default, with 10 messages and 50ms.
+func WithAdaptiveBatching(size int, maxDelay time.Duration) ProtoHandlerOption {
+	return func(h *ProtoHandler) {
+		h.batchSize = size
+		h.batchTimeout = maxDelay
+		h.adaptive = true
 	}
 }
 
@@ -81,6 +97,7 @@ func NewProtoHandler(conn *websocket.Conn, chatHandler ChatHandler, opts ...Prot
 		cancel:       cancel,
 		batchSize:    10,
 		batchTimeout: 50 * time.Millisecond,
+		adaptive:     true,
 		useBinary:    false,
 	}
 
@@ -88,6 +105,7 @@ func NewProtoHandler(conn *websocket.Conn, chatHandler ChatHandler, opts ...Prot
 	for _, opt := range opts {
 		opt(h)
 	}
+	h.batcher = newBatcher(h.batchSize, h.batchTimeout, !h.adaptive)
 
 	return h, nil
 }
@@ -108,6 +126,22 @@ func (h *ProtoHandler) Run() {
 
 	// Wait for shutdown
 	<-h.ctx.Done()
+
+	if h.batchSize > 1 {
+		stats := h.batcher.Stats()
+		log.Info().
+			Str("session_id", h.sessionID).
+			Bool("adaptive", stats.Adaptive).
+			Float64("rtt_ms", stats.RTTMs).
+			Float64("avg_batch", stats.AvgBatch).
+			Float64("avg_delay_ms", stats.AvgDelayMs).
+			Msg("batching summary")
+	}
+}
+
+// BatchStats reports how batching behaved on this connection
+func (h *ProtoHandler) BatchStats() BatchStats {
+	return h.batcher.Stats()
 }
 
 func (h *ProtoHandler) readPump() {
@@ -115,8 +149,12 @@ func (h *ProtoHandler) readPump() {
 	
 	h.conn.SetReadLimit(maxMessageSize)
 	h.conn.SetReadDeadline(time.Now().Add(pongTimeout))
-	h.conn.SetPongHandler(func(string) error {
+	h.conn.SetPongHandler(func(data string) error {
 		h.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		// Pongs echo the ping's payload, the time it was sent
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			h.batcher.observeRTT(time.Since(time.Unix(0, sent)))
+		}
 		return nil
 	})
 
@@ -138,6 +176,13 @@ func (h *ProtoHandler) readPump() {
 		// Decode message
 		msg, err := h.codec.DecodeMessage(data)
 		if err != nil {
+			if errors.Is(err, protocol.ErrLimitExceeded) {
+				log.Warn().Err(err).Str("session_id", h.sessionID).Msg("closing abusive connection")
+				h.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseMessageTooBig, err.Error()),
+					time.Now().Add(writeTimeout))
+				return
+			}
 			log.Error().Err(err).Msg("decode message failed")
 			continue
 		}
@@ -148,30 +193,46 @@ func (h *ProtoHandler) readPump() {
 }
 
 func (h *ProtoHandler) writePump() {
-	ticker := time.NewTicker(pingInterval)
+	// Adaptive batching needs fresher round trips than keepalives give
+	interval := pingInterval
+	if h.batchSize > 1 && h.adaptive {
+		interval = rttProbeInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer func() {
 		ticker.Stop()
 		h.conn.Close()
 		h.cancel()
 	}()
 
+	// With batching, batchPump owns the send channel
+	send := h.send
+	if h.batchSize > 1 {
+		send = nil
+	}
+
 	for {
 		select {
-		case message := <-h.send:
+		case message := <-send:
 			if err := h.writeMessage(message); err != nil {
 				log.Error().Err(err).Msg("write message failed")
 				return
 			}
 
 		case batch := <-h.sendBatch:
-			if err := h.writeBatch(batch); err != nil {
+			write := h.writeBatch
+			if len(batch) == 1 {
+				write = func(batch []*protocol.Message) error { return h.writeMessage(batch[0]) }
+			}
+			if err := write(batch); err != nil {
 				log.Error().Err(err).Msg("write batch failed")
 				return
 			}
 
 		case <-ticker.C:
 			h.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := h.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			ping := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+			if err := h.conn.WriteMessage(websocket.PingMessage, ping); err != nil {
 				return
 			}
 
@@ -181,27 +242,60 @@ func (h *ProtoHandler) writePump() {
 	}
 }
 
+// batchPump collects outbound messages into batches. Each batch's window
+// starts with its first message and is chosen by the batcher at that point.
 func (h *ProtoHandler) batchPump() {
-	ticker := time.NewTicker(h.batchTimeout)
-	defer ticker.Stop()
-
-	batch := make([]*protocol.Message, 0, h.batchSize)
+	var (
+		batch   []*protocol.Message
+		size    int
+		started time.Time
+		timer   = time.NewTimer(0)
+	)
+	<-timer.C
+	defer timer.Stop()
+
+	flush := func() bool {
+		h.batcher.record(len(batch), time.Since(started))
+		select {
+		case h.sendBatch <- batch:
+		case <-h.ctx.Done():
+			return false
+		}
+		batch = nil
+		return true
+	}
 
 	for {
 		select {
 		case msg := <-h.send:
+			if len(batch) == 0 {
+				var delay time.Duration
+				size, delay = h.batcher.window(len(h.send))
+				started = time.Now()
+				if delay > 0 {
+					timer.Reset(delay)
+				} else {
+					size = 1
+				}
+			}
 			batch = append(batch, msg)
-			
-			if len(batch) >= h.batchSize {
-				h.sendBatch <- batch
-				batch = make([]*protocol.Message, 0, h.batchSize)
-				ticker.Reset(h.batchTimeout)
+
+			if len(batch) >= size {
+				if !timer.Stop() && size > 1 {
+					// The window closed as the batch filled; drain it
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				if !flush() {
+					return
+				}
 			}
 
-		case <-ticker.C:
-			if len(batch) > 0 {
-				h.sendBatch <- batch
-				batch = make([]*protocol.Message, 0, h.batchSize)
+		case <-timer.C:
+			if len(batch) > 0 && !flush() {
+				return
 			}
 
 		case <-h.ctx.Done():
@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// WithReadOnly makes the session read-only, for demos and viewers: it can
+// watch terminals, ask questions and follow tasks, but nothing it sends
+// changes the workspace, see refuseWrite
+func WithReadOnly() UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.readOnly = true
+	}
+}
+
+// isReadOnly reports whether the session was made read-only by the gateway,
+// its connect token or its hello
+func (h *UnifiedHandler) isReadOnly() bool {
+	h.mu.RLock()
+	readOnly := h.readOnly
+	h.mu.RUnlock()
+	return readOnly || h.Grant().ReadOnly
+}
+
+// refuseWrite fails msg with read_only if the session is read-only and msg
+// would change the workspace, a terminal or the backend, reporting whether
+// it did. Every message passes here before it is routed, so handlers need
+// no checks of their own.
+func (h *UnifiedHandler) refuseWrite(msg *protocol.Message) bool {
+	if !writes(msg) || !h.isReadOnly() {
+		return false
+	}
+	h.log.Debug().Str("type", string(msg.Type)).Str("id", msg.ID).Msg("refused message in read-only session")
+	h.sendError(msg.ID, "read_only", string(msg.Type)+" is not allowed in a read-only session", false)
+	return true
+}
+
+// writes reports whether msg may change something. Only the types known to
+// just read are let through, so new message types start out refused. Chats
+// may only ask (/ask), since anything else may have the assistant edit files
+// or run commands, and terminals may only be listed, attached, detached and
+// exported.
+func writes(msg *protocol.Message) bool {
+	switch msg.Type {
+	case protocol.TypeChat, protocol.TypeChatBranch:
+		var chatMsg struct {
+			Content string `json:"content"`
+		}
+		json.Unmarshal(msg.Payload, &chatMsg)
+		name, _, _ := strings.Cut(strings.TrimSpace(chatMsg.Content), " ")
+		return name != "/ask"
+	case protocol.TypePing, protocol.TypeAck, protocol.TypeReconnect, protocol.TypeQueueStats,
+		protocol.TypeHello, protocol.TypeReauth, protocol.TypeDiagnostics, protocol.TypeWorkspaces,
+		protocol.TypeEnvList, protocol.TypeParticipants, protocol.TypePresence, protocol.TypeChatExport,
+		protocol.TypeTaskList, protocol.TypeTaskWatch,
+		"terminal_list", "terminal_attach", "terminal_detach", "terminal_export":
+		return false
+	}
+	return true
+}
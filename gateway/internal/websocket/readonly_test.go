@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestReadOnlySessionsOnlyWatch(t *testing.T) {
+	for name, opts := range map[string][]UnifiedHandlerOption{
+		"gateway": {WithReadOnly()},
+		"token":   {WithGrant(Grant{Subject: "alice", ReadOnly: true})},
+		"hello":   nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, transport, _ := startExpiringHandler(t, opts...)
+
+			payload, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.CurrentVersion, ReadOnly: name == "hello"})
+			transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: payload})
+			var hello protocol.Hello
+			msg := nextOutbound(t, transport)
+			if json.Unmarshal(msg.Payload, &hello); msg.Type != protocol.TypeHello || !hello.ReadOnly {
+				t.Fatalf("expected the hello to report a read-only session, got %+v %s", msg, msg.Payload)
+			}
+
+			input, _ := json.Marshal(map[string]string{"terminal_id": "t1", "data": "rm -rf /\r"})
+			transport.push(&protocol.Message{ID: "i1", Type: "terminal_input", Timestamp: time.Now(), Payload: input})
+			expectChatError(t, transport, "i1", "read_only")
+
+			edit, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "fix the tests"})
+			transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: edit})
+			expectChatError(t, transport, "c1", "read_only")
+
+			ask, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "/ask why do the tests fail?"})
+			transport.push(&protocol.Message{ID: "c2", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: ask})
+			if msg := nextOutbound(t, transport); msg.Type == protocol.TypeChatError {
+				t.Fatalf("expected questions answered, got %+v %s", msg, msg.Payload)
+			}
+		})
+	}
+}
+
+func TestSessionsAreWritableByDefault(t *testing.T) {
+	if writes(&protocol.Message{Type: protocol.TypeTaskList}) {
+		t.Fatal("expected task_list to be read-only")
+	}
+	_, transport, _ := startExpiringHandler(t)
+	hello := helloWith(t, transport)
+	if hello.ReadOnly {
+		t.Fatal("expected a writable session")
+	}
+}
+
+func TestOnlyReadingMessagesPassReadOnlySessions(t *testing.T) {
+	tests := []struct {
+		msgType protocol.MessageType
+		content string
+		want    bool
+	}{
+		{protocol.TypeChat, "/ask what does this do?", false},
+		{protocol.TypeChat, "/run make", true},
+		{protocol.TypeChatBranch, "rename it", true},
+		{protocol.TypeTaskWatch, "", false},
+		{protocol.TypeTaskCancel, "", true},
+		{protocol.TypeEnvList, "", false},
+		{protocol.TypeEnvSet, "", true},
+		{"terminal_attach", "", false},
+		{"terminal_resize", "", true},
+		{protocol.TypeKeepAlive, "", true},
+		{protocol.TypeWorkspaceBackup, "", true},
+		{protocol.TypeRelayAttach, "", true},
+		{protocol.TypeRelay, "", true},
+		{"something_new", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.msgType)+" "+tt.content, func(t *testing.T) {
+			payload, _ := json.Marshal(protocol.ChatMessage{Content: tt.content})
+			if got := writes(&protocol.Message{Type: tt.msgType, Payload: payload}); got != tt.want {
+				t.Fatalf("expected writes %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
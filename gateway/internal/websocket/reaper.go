@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultReapGrace is how long past pongTimeout a silent session is kept
+// before it is reaped
+const DefaultReapGrace = 30 * time.Second
+
+// ReapStats counts what the reaper has released since the gateway started
+type ReapStats struct {
+	Sessions  uint64 `json:"sessions"`
+	Terminals uint64 `json:"terminal_attachments"`
+	Messages  uint64 `json:"queued_messages"`
+}
+
+// ReapStats returns the reaper's counters
+func (r *SessionRegistry) ReapStats() ReapStats {
+	return ReapStats{
+		Sessions:  r.reapedSessions.Load(),
+		Terminals: r.reapedTerminals.Load(),
+		Messages:  r.reapedMessages.Load(),
+	}
+}
+
+// Reap ends sessions whose client has sent neither a message nor a
+// transport heartbeat for pongTimeout plus grace, and returns how many.
+// Their queues and terminal attachments are released immediately instead
+// of when the read loop finally errors, which on a half-open connection
+// may be never. Only sessions on a HeartbeatTransport are reaped; QUIC and
+// gRPC detect dead peers themselves.
+func (r *SessionRegistry) Reap(grace time.Duration) int {
+	r.mu.RLock()
+	handlers := make([]*UnifiedHandler, 0, len(r.sessions))
+	for _, h := range r.sessions {
+		handlers = append(handlers, h)
+	}
+	r.mu.RUnlock()
+
+	now := time.Now()
+	reaped := 0
+	for _, h := range handlers {
+		last, ok := h.lastHeartbeat()
+		if !ok {
+			continue
+		}
+		idle := now.Sub(last)
+		if idle <= pongTimeout+grace {
+			continue
+		}
+
+		terminals, messages, ok := h.reap(idle)
+		if !ok {
+			continue
+		}
+		reaped++
+		r.reapedSessions.Add(1)
+		r.reapedTerminals.Add(uint64(terminals))
+		r.reapedMessages.Add(uint64(messages))
+
+		h.log.Warn().
+			Dur("idle", idle).
+			Int("terminals", terminals).
+			Int("queued_messages", messages).
+			Msg("reaped dead session")
+	}
+	return reaped
+}
+
+// RunReaper reaps dead sessions every pingInterval until ctx is done
+func (r *SessionRegistry) RunReaper(ctx context.Context, grace time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	log.Info().Dur("after", pongTimeout+grace).Msg("reaping sessions without heartbeats")
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Reap(grace)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestReapDeadSessions(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	registry := NewSessionRegistry()
+	start := func() (*httpTransport, chan struct{}) {
+		transport := newHTTPTransport()
+		h := NewTransportHandler(transport, echoChat{}, manager, WithSessionRegistry(registry))
+		done := make(chan struct{})
+		go func() {
+			h.Run()
+			close(done)
+		}()
+		return transport, done
+	}
+
+	dead, deadDone := start()
+	alive, _ := start()
+	defer alive.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for registry.Count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing is reaped while heartbeats are recent
+	if n := registry.Reap(DefaultReapGrace); n != 0 {
+		t.Fatalf("reaped %d live sessions", n)
+	}
+
+	// One client goes silent with an unacknowledged message outstanding
+	registry.mu.RLock()
+	for _, h := range registry.sessions {
+		if h.transport == dead {
+			h.queue.Track(&protocol.Message{ID: "m1", Type: "terminal_created", RequiresAck: true})
+			h.mu.Lock()
+			h.lastActivity = time.Now().Add(-time.Hour)
+			h.mu.Unlock()
+		}
+	}
+	registry.mu.RUnlock()
+	dead.lastSeen.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	if n := registry.Reap(DefaultReapGrace); n != 1 {
+		t.Fatalf("expected 1 session reaped, got %d", n)
+	}
+	select {
+	case <-deadDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaped session kept running")
+	}
+
+	stats := registry.ReapStats()
+	if stats.Sessions != 1 || stats.Messages != 1 {
+		t.Fatalf("unexpected reap stats %+v", stats)
+	}
+	if registry.Count() != 1 {
+		t.Fatalf("expected the live session to keep running, got %d sessions", registry.Count())
+	}
+
+	// Reaping again finds nothing new
+	if n := registry.Reap(DefaultReapGrace); n != 0 {
+		t.Fatalf("reaped %d sessions on the second pass", n)
+	}
+}
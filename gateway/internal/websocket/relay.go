@@ -0,0 +1,414 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// relayDialTimeout bounds connecting to a VM gateway
+	relayDialTimeout = 10 * time.Second
+
+	// maxRelayUpstreams caps the VMs one client can attach at once
+	maxRelayUpstreams = 16
+)
+
+// UpstreamResolver returns the WebSocket URL of the gateway running on a VM
+type UpstreamResolver func(vmID string) (string, error)
+
+// relayVMID is what a VM ID must look like to be put in an upstream URL: it
+// comes from the client, and the client's credentials go to the URL
+var relayVMID = regexp.MustCompile(`^[a-z0-9-]{1,63}$`)
+
+// StaticUpstreams resolves VM IDs from a fixed map. VMs missing from the map
+// are resolved with template, in which %s is replaced by the VM ID (for
+// example ws://devtail-%s:8080/ws using tailnet MagicDNS names).
+func StaticUpstreams(upstreams map[string]string, template string) UpstreamResolver {
+	return func(vmID string) (string, error) {
+		if url, ok := upstreams[vmID]; ok {
+			return url, nil
+		}
+		if template != "" && strings.Contains(template, "%s") {
+			return templateUpstream(template, vmID)
+		}
+		return "", fmt.Errorf("unknown vm %q", vmID)
+	}
+}
+
+// templateUpstream puts vmID in template, refusing IDs that could point the
+// URL at a host other than the one template names
+func templateUpstream(template, vmID string) (string, error) {
+	if !relayVMID.MatchString(vmID) {
+		return "", fmt.Errorf("invalid vm id %q", vmID)
+	}
+	upstream := fmt.Sprintf(template, vmID)
+
+	// The host as written in the template, with the ID in place
+	host := template
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.Replace(host, "%s", vmID, 1)
+
+	u, err := url.Parse(upstream)
+	if err != nil || u.User != nil || u.Host != host {
+		return "", fmt.Errorf("vm id %q does not make a valid upstream url", vmID)
+	}
+	return upstream, nil
+}
+
+// RelayServer lets a client reach the gateways of several VMs over a single
+// connection. The client attaches VMs with relay_attach and exchanges
+// protocol messages with each one wrapped in relay envelopes; the relay
+// forwards them unchanged, so acks, retries and reconnects work end to end.
+type RelayServer struct {
+	resolve UpstreamResolver
+	dialer  *websocket.Dialer
+}
+
+// NewRelayServer creates a relay that connects to VM gateways found by resolve
+func NewRelayServer(resolve UpstreamResolver) *RelayServer {
+	return &RelayServer{
+		resolve: resolve,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: relayDialTimeout,
+		},
+	}
+}
+
+// Serve relays for one client until it disconnects. header is sent with
+// every upstream handshake, so the client's credentials reach the VMs.
+func (s *RelayServer) Serve(client Transport, header http.Header) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rs := &relaySession{
+		server:    s,
+		client:    client,
+		header:    header,
+		ctx:       ctx,
+		cancel:    cancel,
+		upstreams: make(map[string]*relayUpstream),
+	}
+	rs.run()
+}
+
+// relaySession is one client connection to the relay
+type relaySession struct {
+	server *RelayServer
+	client Transport
+	header http.Header
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Upstream pumps and the keepalive loop all write to the client
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	upstreams map[string]*relayUpstream
+	wg        sync.WaitGroup
+}
+
+// relayUpstream is the connection to one VM's gateway
+type relayUpstream struct {
+	vmID      string
+	transport Transport
+	writeMu   sync.Mutex
+	detached  bool // guarded by relaySession.mu
+}
+
+func (u *relayUpstream) write(msg *protocol.Message) error {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	return u.transport.WriteMessage(msg)
+}
+
+func (u *relayUpstream) keepalive() error {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	return u.transport.Keepalive()
+}
+
+func (rs *relaySession) run() {
+	go rs.keepalive()
+
+	for {
+		msg, err := rs.client.ReadMessage()
+		if err != nil {
+			if err != io.EOF && rs.ctx.Err() == nil {
+				log.Error().Err(err).Msg("relay client read error")
+			}
+			break
+		}
+		rs.route(msg)
+	}
+
+	rs.cancel()
+	rs.mu.Lock()
+	for _, u := range rs.upstreams {
+		u.detached = true
+		u.transport.Close()
+	}
+	rs.mu.Unlock()
+
+	rs.wg.Wait()
+	rs.client.Close()
+}
+
+func (rs *relaySession) keepalive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rs.writeMu.Lock()
+			err := rs.client.Keepalive()
+			rs.writeMu.Unlock()
+			if err != nil {
+				log.Warn().Err(err).Msg("relay client keepalive failed")
+				rs.cancel()
+				rs.client.Close()
+				return
+			}
+
+			for _, u := range rs.attached() {
+				if err := u.keepalive(); err != nil {
+					// The pump reports the loss to the client
+					u.transport.Close()
+				}
+			}
+		case <-rs.ctx.Done():
+			return
+		}
+	}
+}
+
+func (rs *relaySession) route(msg *protocol.Message) {
+	switch msg.Type {
+	case protocol.TypeRelay:
+		rs.forward(msg)
+	case protocol.TypeRelayAttach:
+		rs.attach(msg)
+	case protocol.TypeRelayDetach:
+		rs.detach(msg)
+	case protocol.TypePing:
+		rs.sendClient(&protocol.Message{
+			ID:        uuid.New().String(),
+			Type:      protocol.TypePong,
+			Timestamp: time.Now(),
+		})
+	default:
+		log.Warn().
+			Str("type", string(msg.Type)).
+			Str("id", msg.ID).
+			Msg("unknown relay message type")
+	}
+}
+
+func (rs *relaySession) attach(msg *protocol.Message) {
+	var target protocol.RelayTarget
+	if err := json.Unmarshal(msg.Payload, &target); err != nil || target.VMID == "" {
+		rs.sendStatus(protocol.TypeRelayDetached, target.VMID, "invalid relay_attach payload", msg.ID)
+		return
+	}
+
+	rs.mu.Lock()
+	_, exists := rs.upstreams[target.VMID]
+	full := len(rs.upstreams) >= maxRelayUpstreams
+	rs.mu.Unlock()
+
+	if exists {
+		rs.sendStatus(protocol.TypeRelayAttached, target.VMID, "", msg.ID)
+		return
+	}
+	if full {
+		rs.sendStatus(protocol.TypeRelayDetached, target.VMID, "too many attached vms", msg.ID)
+		return
+	}
+
+	// Dialing blocks this client's other traffic for at most relayDialTimeout
+	transport, err := rs.dial(target)
+	if err != nil {
+		log.Warn().Err(err).Str("vm_id", target.VMID).Msg("relay failed to reach vm gateway")
+		rs.sendStatus(protocol.TypeRelayDetached, target.VMID, err.Error(), msg.ID)
+		return
+	}
+
+	u := &relayUpstream{vmID: target.VMID, transport: transport}
+
+	rs.mu.Lock()
+	if rs.ctx.Err() != nil {
+		rs.mu.Unlock()
+		transport.Close()
+		return
+	}
+	rs.upstreams[target.VMID] = u
+	rs.wg.Add(1)
+	rs.mu.Unlock()
+
+	go rs.pump(u)
+
+	log.Info().Str("vm_id", target.VMID).Msg("relay attached vm")
+	rs.sendStatus(protocol.TypeRelayAttached, target.VMID, "", msg.ID)
+}
+
+func (rs *relaySession) dial(target protocol.RelayTarget) (Transport, error) {
+	url, err := rs.server.resolve(target.VMID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect tokens are bound to one VM, so a per-VM token takes precedence
+	// over the credentials the client connected to the relay with
+	header := rs.header
+	if target.Token != "" {
+		header = http.Header{"Authorization": {"Bearer " + target.Token}}
+	}
+
+	ctx, cancel := context.WithTimeout(rs.ctx, relayDialTimeout)
+	defer cancel()
+
+	conn, resp, err := rs.server.dialer.DialContext(ctx, url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("vm gateway rejected connection: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("connect to vm gateway: %w", err)
+	}
+	return NewWebSocketTransport(conn), nil
+}
+
+// pump forwards messages from one VM gateway to the client until either side
+// goes away
+func (rs *relaySession) pump(u *relayUpstream) {
+	defer rs.wg.Done()
+
+	reason := "vm gateway closed the connection"
+	for {
+		msg, err := u.transport.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				reason = err.Error()
+			}
+			break
+		}
+
+		payload, _ := json.Marshal(protocol.RelayEnvelope{VMID: u.vmID, Message: msg})
+		if err := rs.sendClient(&protocol.Message{
+			ID:        uuid.New().String(),
+			Type:      protocol.TypeRelay,
+			Timestamp: time.Now(),
+			Payload:   payload,
+		}); err != nil {
+			break
+		}
+	}
+	u.transport.Close()
+
+	rs.mu.Lock()
+	detached := u.detached
+	if rs.upstreams[u.vmID] == u {
+		delete(rs.upstreams, u.vmID)
+	}
+	rs.mu.Unlock()
+
+	if detached {
+		reason = "detached"
+	}
+	if rs.ctx.Err() == nil {
+		rs.sendStatus(protocol.TypeRelayDetached, u.vmID, reason, "")
+	}
+	log.Info().Str("vm_id", u.vmID).Str("reason", reason).Msg("relay detached vm")
+}
+
+func (rs *relaySession) detach(msg *protocol.Message) {
+	var target protocol.RelayTarget
+	if err := json.Unmarshal(msg.Payload, &target); err != nil {
+		return
+	}
+
+	rs.mu.Lock()
+	u, exists := rs.upstreams[target.VMID]
+	if exists {
+		u.detached = true
+	}
+	rs.mu.Unlock()
+
+	if !exists {
+		rs.sendStatus(protocol.TypeRelayDetached, target.VMID, "not attached", msg.ID)
+		return
+	}
+	// The pump sends relay_detached once the connection is down
+	u.transport.Close()
+}
+
+func (rs *relaySession) forward(msg *protocol.Message) {
+	var env protocol.RelayEnvelope
+	if err := json.Unmarshal(msg.Payload, &env); err != nil || env.Message == nil {
+		log.Warn().Str("id", msg.ID).Msg("invalid relay envelope")
+		return
+	}
+
+	rs.mu.Lock()
+	u, exists := rs.upstreams[env.VMID]
+	rs.mu.Unlock()
+
+	if !exists {
+		rs.sendStatus(protocol.TypeRelayDetached, env.VMID, "not attached", msg.ID)
+		return
+	}
+	if err := u.write(env.Message); err != nil {
+		log.Warn().Err(err).Str("vm_id", env.VMID).Msg("relay write to vm gateway failed")
+		u.transport.Close()
+	}
+}
+
+func (rs *relaySession) attached() []*relayUpstream {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	upstreams := make([]*relayUpstream, 0, len(rs.upstreams))
+	for _, u := range rs.upstreams {
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+func (rs *relaySession) sendStatus(msgType protocol.MessageType, vmID, reason, correlationID string) {
+	payload, _ := json.Marshal(protocol.RelayTarget{VMID: vmID, Reason: reason})
+	rs.sendClient(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          msgType,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: correlationID,
+	})
+}
+
+func (rs *relaySession) sendClient(msg *protocol.Message) error {
+	rs.writeMu.Lock()
+	defer rs.writeMu.Unlock()
+
+	if err := rs.client.WriteMessage(msg); err != nil {
+		rs.cancel()
+		rs.client.Close()
+		return err
+	}
+	return nil
+}
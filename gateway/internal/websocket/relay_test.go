@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+var testUpgrader = websocket.Upgrader{}
+
+// newVMGatewayServer serves the gateway protocol over WebSocket, standing in
+// for the gateway on one VM
+func newVMGatewayServer(t *testing.T) string {
+	t.Helper()
+
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := testUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		NewUnifiedHandler(conn, echoChat{}, manager).Run()
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func newRelayClient(t *testing.T, upstreams map[string]string) *websocket.Conn {
+	t.Helper()
+
+	relay := NewRelayServer(StaticUpstreams(upstreams, ""))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := testUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		relay.Serve(NewWebSocketTransport(conn), nil)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendRelayMessage(t *testing.T, conn *websocket.Conn, msgType protocol.MessageType, id string, payload interface{}) {
+	t.Helper()
+
+	data, _ := json.Marshal(payload)
+	if err := conn.WriteJSON(&protocol.Message{
+		ID:        id,
+		Type:      msgType,
+		Timestamp: time.Now(),
+		Payload:   data,
+	}); err != nil {
+		t.Fatalf("write %s: %v", msgType, err)
+	}
+}
+
+// readRelayMessage returns the next message of msgType, skipping others
+func readRelayMessage(t *testing.T, conn *websocket.Conn, msgType protocol.MessageType) *protocol.Message {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg protocol.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return &msg
+		}
+	}
+}
+
+func TestRelayRoutesToAttachedVMs(t *testing.T) {
+	conn := newRelayClient(t, map[string]string{
+		"vm-a": newVMGatewayServer(t),
+		"vm-b": newVMGatewayServer(t),
+	})
+
+	for _, vmID := range []string{"vm-a", "vm-b"} {
+		sendRelayMessage(t, conn, protocol.TypeRelayAttach, "attach-"+vmID, protocol.RelayTarget{VMID: vmID})
+		attached := readRelayMessage(t, conn, protocol.TypeRelayAttached)
+		if attached.CorrelationID != "attach-"+vmID {
+			t.Fatalf("relay_attached correlates to %q, want attach-%s", attached.CorrelationID, vmID)
+		}
+	}
+
+	ping := &protocol.Message{ID: "ping-b", Type: protocol.TypePing, Timestamp: time.Now()}
+	sendRelayMessage(t, conn, protocol.TypeRelay, "env-1", protocol.RelayEnvelope{VMID: "vm-b", Message: ping})
+
+	reply := readRelayMessage(t, conn, protocol.TypeRelay)
+	var env protocol.RelayEnvelope
+	if err := json.Unmarshal(reply.Payload, &env); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	if env.VMID != "vm-b" || env.Message == nil || env.Message.Type != protocol.TypePong {
+		t.Fatalf("expected pong from vm-b, got %+v", env)
+	}
+
+	sendRelayMessage(t, conn, protocol.TypeRelayDetach, "detach-a", protocol.RelayTarget{VMID: "vm-a"})
+	detached := readRelayMessage(t, conn, protocol.TypeRelayDetached)
+
+	var target protocol.RelayTarget
+	json.Unmarshal(detached.Payload, &target)
+	if target.VMID != "vm-a" || target.Reason != "detached" {
+		t.Fatalf("unexpected relay_detached payload: %+v", target)
+	}
+}
+
+func TestRelayUnknownVM(t *testing.T) {
+	conn := newRelayClient(t, nil)
+
+	sendRelayMessage(t, conn, protocol.TypeRelayAttach, "attach-x", protocol.RelayTarget{VMID: "vm-x"})
+	detached := readRelayMessage(t, conn, protocol.TypeRelayDetached)
+	if detached.CorrelationID != "attach-x" {
+		t.Fatalf("relay_detached correlates to %q", detached.CorrelationID)
+	}
+
+	var target protocol.RelayTarget
+	json.Unmarshal(detached.Payload, &target)
+	if target.VMID != "vm-x" || target.Reason == "" {
+		t.Fatalf("expected a reason for vm-x, got %+v", target)
+	}
+}
+
+func TestStaticUpstreamsTemplate(t *testing.T) {
+	resolve := StaticUpstreams(map[string]string{"Pinned": "ws://10.0.0.5:8080/ws"}, "ws://devtail-%s:8080/ws")
+
+	tests := []struct {
+		vmID string
+		want string
+	}{
+		{"vm-1", "ws://devtail-vm-1:8080/ws"},
+		{"6f1c2a9e-0b7d-4f3e-9a51-2c8d7e4b1f60", "ws://devtail-6f1c2a9e-0b7d-4f3e-9a51-2c8d7e4b1f60:8080/ws"},
+		// Configured upstreams are looked up as they are
+		{"Pinned", "ws://10.0.0.5:8080/ws"},
+		// Anything that could change the host is refused
+		{"x@evil.example/", ""},
+		{"evil.example/x", ""},
+		{"x:1@evil.example", ""},
+		{"x/../../evil", ""},
+		{"x?", ""},
+		{"VM-1", ""},
+		{"", ""},
+		{strings.Repeat("a", 64), ""},
+	}
+	for _, tt := range tests {
+		got, err := resolve(tt.vmID)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.vmID, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: expected %q, got %q, %v", tt.vmID, tt.want, got, err)
+		}
+	}
+}
+
+func TestTemplateUpstreamKeepsTheTemplateHost(t *testing.T) {
+	// The ID can sit in the path, but never reach the host
+	got, err := templateUpstream("wss://relay.internal/vms/%s/ws", "vm-1")
+	if err != nil || got != "wss://relay.internal/vms/vm-1/ws" {
+		t.Fatalf("expected the ID in the path, got %q, %v", got, err)
+	}
+	if got, err := templateUpstream("wss://relay.internal/vms/%s/ws", "x@evil.example"); err == nil {
+		t.Fatalf("expected an error, got %q", got)
+	}
+}
@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/devtail/gateway/pkg/protocol/schema"
+)
+
+// ProtocolMessages lists every message of the client protocol with its
+// payload type. Keep it in step with routeMessage and the terminal and relay
+// handlers; GET /schema is generated from it.
+var ProtocolMessages = []schema.Message{
+	// Session
+	{Type: protocol.TypeHello, Direction: schema.FromClient, Payload: protocol.Hello{},
+		Description: "Opens a versioned session with the client's protocol version and capabilities"},
+	{Type: protocol.TypeHello, Direction: schema.FromGateway, Payload: protocol.Hello{},
+		Description: "The version and capabilities the session will use, and its session ID"},
+	{Type: protocol.TypePing, Direction: schema.FromClient,
+		Description: "Keepalive; answered with pong"},
+	{Type: protocol.TypePong, Direction: schema.FromGateway,
+		Description: "Answer to ping"},
+	{Type: protocol.TypeAck, Direction: schema.FromClient, Payload: protocol.AckMessage{},
+		Description: "Acknowledges a message sent with requires_ack, so it is not redelivered"},
+	{Type: protocol.TypeAck, Direction: schema.FromGateway, Payload: protocol.AckMessage{},
+		Description: "Acknowledges a client message; also sent for duplicates the gateway dropped"},
+	{Type: protocol.TypeReconnect, Direction: schema.FromClient, Payload: protocol.ReconnectMessage{},
+		Description: "Resumes a session, replaying messages after last_seq_num, or from another connection delivering the messages kept while its client was away"},
+	{Type: protocol.TypeQueueStats, Direction: schema.FromClient,
+		Description: "Asks for the session's outbound queue statistics"},
+	{Type: protocol.TypeQueueStats, Direction: schema.FromGateway, Payload: protocol.QueueStats{},
+		Description: "The session's outbound queue statistics"},
+	{Type: protocol.TypeSessionRevoked, Direction: schema.FromGateway, Payload: protocol.SessionRevoked{},
+		Description: "Sent before the gateway ends a session whose token was revoked"},
+	{Type: protocol.TypeReauthRequired, Direction: schema.FromGateway, Payload: protocol.TokenExpiry{},
+		Description: "The session's connect token expires soon; answer with reauth and a fresh token; must be acknowledged"},
+	{Type: protocol.TypeReauth, Direction: schema.FromClient, Payload: protocol.Reauth{},
+		Description: "A fresh connect token for the same user, from the control plane"},
+	{Type: protocol.TypeReauth, Direction: schema.FromGateway, Payload: protocol.TokenExpiry{},
+		Description: "The fresh token is in use until expires_at; failures are chat_error reauth_failed"},
+	{Type: protocol.TypeSessionExpired, Direction: schema.FromGateway, Payload: protocol.SessionExpired{},
+		Description: "Sent before the gateway ends a session that reached its maximum lifetime or whose token expired"},
+	{Type: protocol.TypeAnnouncement, Direction: schema.FromGateway, Payload: protocol.Announcement{},
+		Description: "A notice from the operators, such as a maintenance window or a required upgrade; must be acknowledged"},
+	{Type: protocol.TypeSuspendScheduled, Direction: schema.FromGateway, Payload: protocol.SuspendScheduled{},
+		Description: "The VM will be suspended at suspend_at unless a client sends keep_alive; must be acknowledged"},
+	{Type: protocol.TypeKeepAlive, Direction: schema.FromClient,
+		Description: "Calls off a scheduled suspension; typing in a terminal or chatting does too"},
+	{Type: protocol.TypeSuspendCancelled, Direction: schema.FromGateway, Payload: protocol.SuspendCancelled{},
+		Description: "A scheduled suspension was called off"},
+	{Type: protocol.TypeVMSuspended, Direction: schema.FromGateway, Payload: protocol.VMSuspended{},
+		Description: "Sent before the gateway ends every session because the VM is being suspended; resume it before reconnecting"},
+
+	// Chat
+	{Type: protocol.TypeChat, Direction: schema.FromClient, Payload: protocol.ChatMessage{},
+		Description: "Sends a prompt to the AI assistant"},
+	{Type: protocol.TypeChatRegenerate, Direction: schema.FromClient, Payload: protocol.ChatRegenerate{},
+		Description: "Asks for another answer to an earlier prompt, on a new branch of the conversation; the reply streams as for chat"},
+	{Type: protocol.TypeChatBranch, Direction: schema.FromClient, Payload: protocol.ChatBranch{},
+		Description: "Sends a prompt continuing from an earlier message, on a new branch of the conversation; the reply streams as for chat"},
+	{Type: protocol.TypeChatExport, Direction: schema.FromClient, Payload: protocol.ChatExport{},
+		Description: "Asks for the transcript of a conversation"},
+	{Type: protocol.TypeChatTranscript, Direction: schema.FromGateway, Payload: protocol.ChatTranscript{},
+		Description: "A conversation as markdown or JSON, with the commands it ran and the diffs of its commits"},
+	{Type: protocol.TypeChatStream, Direction: schema.FromGateway, Payload: protocol.ChatReply{},
+		Description: "Part of the assistant's reply; the last part has finished set"},
+	{Type: protocol.TypeChatQueued, Direction: schema.FromGateway, Payload: protocol.ChatQueued{},
+		Description: "The chat request's place in the backend's queue"},
+	{Type: protocol.TypeChatPlan, Direction: schema.FromGateway, Payload: protocol.ChatPlan{},
+		Description: "Steps a planning backend drafted for the chat request, waiting for chat_plan_decision; needs the chat_plans capability; must be acknowledged"},
+	{Type: protocol.TypeChatPlanDecision, Direction: schema.FromClient, Payload: protocol.ChatPlanDecision{},
+		Description: "Approves or rejects a plan, optionally with edited steps; unknown plans are chat_error unknown_plan"},
+	{Type: protocol.TypeChatError, Direction: schema.FromGateway, Payload: protocol.ChatError{},
+		Description: "A request failed; correlation_id names it. Used for errors of every message type except terminals."},
+	{Type: protocol.TypeBackendRecoveryStarted, Direction: schema.FromGateway, Payload: protocol.BackendRecovery{},
+		Description: "The AI backend is recovering from an error"},
+	{Type: protocol.TypeBackendRecoverySucceeded, Direction: schema.FromGateway, Payload: protocol.BackendRecovery{},
+		Description: "The AI backend recovered"},
+	{Type: protocol.TypeBackendRecoveryFailed, Direction: schema.FromGateway, Payload: protocol.BackendRecovery{},
+		Description: "The AI backend could not recover"},
+	{Type: protocol.TypeChatConfig, Direction: schema.FromClient, Payload: protocol.ChatConfig{},
+		Description: "Changes the chat backend; only the fields that are set change"},
+	{Type: protocol.TypeChatConfig, Direction: schema.FromGateway, Payload: protocol.ChatConfigStatus{},
+		Description: "The chat backend after a change"},
+	{Type: protocol.TypeDiagnostics, Direction: schema.FromClient,
+		Description: "Asks the gateway to check its environment"},
+	{Type: protocol.TypeDiagnostics, Direction: schema.FromGateway, Payload: protocol.Diagnostics{},
+		Description: "Whether the gateway can serve chat, check by check"},
+
+	// Tasks
+	{Type: protocol.TypeTaskSubmit, Direction: schema.FromClient, Payload: protocol.TaskSubmit{},
+		Description: "Starts a background task; it keeps running when the client disconnects"},
+	{Type: protocol.TypeTaskStatus, Direction: schema.FromGateway, Payload: protocol.TaskStatus{},
+		Description: "A task's state; once it has ended, its summary and diff. The final status of a watched task must be acknowledged."},
+	{Type: protocol.TypeTaskProgress, Direction: schema.FromGateway, Payload: protocol.TaskProgress{},
+		Description: "Part of the assistant's output for a watched task"},
+	{Type: protocol.TypeTaskList, Direction: schema.FromClient,
+		Description: "Asks for the user's tasks"},
+	{Type: protocol.TypeTaskList, Direction: schema.FromGateway, Payload: protocol.TaskList{},
+		Description: "The user's tasks, newest first"},
+	{Type: protocol.TypeTaskWatch, Direction: schema.FromClient, Payload: protocol.TaskWatch{},
+		Description: "Streams a task's progress after after_seq and its status changes until it ends; unknown tasks are chat_error unknown_task"},
+	{Type: protocol.TypeTaskCancel, Direction: schema.FromClient, Payload: protocol.TaskCancel{},
+		Description: "Stops a task; the reply is its final task_status"},
+
+	// Guardrails
+	{Type: protocol.TypeCommandApproval, Direction: schema.FromGateway, Payload: protocol.CommandApproval{},
+		Description: "A shell command the policy wants confirmed; it waits for command_decision until expires_at. Must be acknowledged."},
+	{Type: protocol.TypeCommandDecision, Direction: schema.FromClient, Payload: protocol.CommandDecision{},
+		Description: "Approves or refuses a command; commands that are not waiting are chat_error unknown_command"},
+	{Type: protocol.TypeCommandBlocked, Direction: schema.FromGateway, Payload: protocol.CommandBlocked{},
+		Description: "A line typed into an attached terminal was refused and not run"},
+
+	// Collaboration
+	{Type: protocol.TypeParticipants, Direction: schema.FromClient,
+		Description: "Asks who is connected to the gateway"},
+	{Type: protocol.TypeParticipants, Direction: schema.FromGateway, Payload: protocol.Participants{},
+		Description: "The connected sessions, their users and the terminals they are attached to"},
+	{Type: protocol.TypeChatShared, Direction: schema.FromGateway, Payload: protocol.ChatShared{},
+		Description: "A prompt another participant sent to the assistant, then its finished reply, correlated with the prompt's request"},
+	{Type: protocol.TypePresence, Direction: schema.FromClient, Payload: protocol.PresenceUpdate{},
+		Description: "What the user is doing, replacing what they were doing before; no reply"},
+	{Type: protocol.TypePresenceChanged, Direction: schema.FromGateway, Payload: protocol.PresenceChanged{},
+		Description: "Another participant joined, left or changed its presence; only sent to collaboration clients, and dropped for clients that fall behind"},
+
+	// Terminals
+	{Type: "terminal_create", Direction: schema.FromClient, Payload: terminal.TerminalCreateRequest{},
+		Description: "Starts a shell; the session's environment variables are added to env"},
+	{Type: "terminal_created", Direction: schema.FromGateway, Payload: terminal.TerminalCreateResponse{},
+		Description: "The new terminal; its output follows as terminal_output"},
+	{Type: "terminal_attach", Direction: schema.FromClient, Payload: terminal.TerminalAttachRequest{},
+		Description: "Streams the output of a running terminal to this session"},
+	{Type: "terminal_attached", Direction: schema.FromGateway, Payload: terminal.TerminalAttachResponse{},
+		Description: "The terminal's output follows"},
+	{Type: "terminal_detach", Direction: schema.FromClient, Payload: terminal.TerminalAttachRequest{},
+		Description: "Stops streaming a terminal's output; the terminal keeps running"},
+	{Type: "terminal_input", Direction: schema.FromClient, Payload: terminal.TerminalInputMessage{},
+		Description: "Keystrokes, base64 encoded"},
+	{Type: "terminal_output", Direction: schema.FromGateway, Payload: terminal.TerminalOutputMessage{},
+		Description: "Terminal output, base64 encoded"},
+	{Type: "terminal_resize", Direction: schema.FromClient, Payload: terminal.TerminalResizeMessage{},
+		Description: "Changes a terminal's size"},
+	{Type: "terminal_close", Direction: schema.FromClient, Payload: terminal.TerminalExitMessage{},
+		Description: "Ends a terminal"},
+	{Type: "terminal_exit", Direction: schema.FromGateway, Payload: terminal.TerminalExitMessage{},
+		Description: "A terminal's shell exited"},
+	{Type: protocol.TypeNotification, Direction: schema.FromGateway, Payload: protocol.Notification{},
+		Description: "A desktop notification a program in a terminal asked for; needs the notifications capability; must be acknowledged"},
+	{Type: "terminal_export", Direction: schema.FromClient, Payload: terminal.TerminalExportRequest{},
+		Description: "Asks for a terminal's recorded output, as asciicast or text"},
+	{Type: "terminal_export", Direction: schema.FromGateway, Payload: terminal.TerminalExportResponse{},
+		Description: "A terminal's recording, the file to save as filename"},
+	{Type: "terminal_list", Direction: schema.FromClient,
+		Description: "Asks for the running terminals"},
+	{Type: "terminal_list", Direction: schema.FromGateway, Payload: terminalList{},
+		Description: "The running terminals"},
+	{Type: "terminal_error", Direction: schema.FromGateway, Payload: terminalError{},
+		Description: "A terminal request failed; correlation_id names it"},
+
+	// Workspaces
+	{Type: protocol.TypeWorkspaces, Direction: schema.FromClient,
+		Description: "Asks which workspaces the gateway serves"},
+	{Type: protocol.TypeWorkspaces, Direction: schema.FromGateway, Payload: protocol.WorkspaceList{},
+		Description: "The workspaces the gateway serves"},
+	{Type: protocol.TypeWorkspaceFileChanged, Direction: schema.FromGateway, Payload: protocol.WorkspaceFileChanged{},
+		Description: "A file in a workspace changed"},
+	{Type: protocol.TypeWorkspaceBackup, Direction: schema.FromClient, Payload: protocol.WorkspaceBackupRequest{},
+		Description: "Backs up a workspace now"},
+	{Type: protocol.TypeWorkspaceBackup, Direction: schema.FromGateway, Payload: protocol.WorkspaceBackup{},
+		Description: "The stored backup"},
+	{Type: protocol.TypeEnvSet, Direction: schema.FromClient, Payload: protocol.EnvSet{},
+		Description: "Sets session environment variables for terminals created afterwards"},
+	{Type: protocol.TypeEnvUnset, Direction: schema.FromClient, Payload: protocol.EnvUnset{},
+		Description: "Removes session environment variables"},
+	{Type: protocol.TypeEnvList, Direction: schema.FromClient,
+		Description: "Asks for the names of the session's environment variables"},
+	{Type: protocol.TypeEnvSet, Direction: schema.FromGateway, Payload: protocol.SessionEnv{},
+		Description: "The session's variable names after the change"},
+	{Type: protocol.TypeEnvUnset, Direction: schema.FromGateway, Payload: protocol.SessionEnv{},
+		Description: "The session's variable names after the change"},
+	{Type: protocol.TypeEnvList, Direction: schema.FromGateway, Payload: protocol.SessionEnv{},
+		Description: "The session's variable names"},
+
+	// Relay
+	{Type: protocol.TypeRelayAttach, Direction: schema.FromClient, Payload: protocol.RelayTarget{},
+		Description: "Connects the relay to a VM's gateway"},
+	{Type: protocol.TypeRelayAttached, Direction: schema.FromGateway, Payload: protocol.RelayTarget{},
+		Description: "The relay is connected to the VM"},
+	{Type: protocol.TypeRelayDetach, Direction: schema.FromClient, Payload: protocol.RelayTarget{},
+		Description: "Disconnects the relay from a VM"},
+	{Type: protocol.TypeRelayDetached, Direction: schema.FromGateway, Payload: protocol.RelayTarget{},
+		Description: "The relay's connection to the VM ended, with the reason"},
+	{Type: protocol.TypeRelay, Direction: schema.FromClient, Payload: protocol.RelayEnvelope{},
+		Description: "A message for one VM's gateway"},
+	{Type: protocol.TypeRelay, Direction: schema.FromGateway, Payload: protocol.RelayEnvelope{},
+		Description: "A message from one VM's gateway"},
+}
+
+// terminalList is the payload of a terminal_list reply
+type terminalList struct {
+	Terminals []string               `json:"terminals"`
+	Stats     map[string]interface{} `json:"stats"`
+}
+
+// terminalError is the payload of a terminal_error message
+type terminalError struct {
+	Error string `json:"error"`
+}
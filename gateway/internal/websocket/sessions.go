@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/internal/queue"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// staleAckThreshold is how long a message may stay unacknowledged before the
+// session is reported as stale
+const staleAckThreshold = 2 * time.Minute
+
+// defaultDedupWindow covers a mobile client retrying through a reconnect
+const defaultDedupWindow = 5 * time.Minute
+
+// SessionRegistry tracks live connections so gateway-wide endpoints such as
+// /metrics can report on them
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*UnifiedHandler
+
+	// Operator announcements, by ID, sent to sessions that open before they
+	// expire
+	announcements map[string]protocol.Announcement
+
+	// The suspension clients were warned about, if any, and the ID of the
+	// last one called off; see ScheduleSuspend
+	suspend   *pendingSuspend
+	calledOff string
+
+	// Reaper counters, see ReapStats
+	reapedSessions  atomic.Uint64
+	reapedTerminals atomic.Uint64
+	reapedMessages  atomic.Uint64
+}
+
+// NewSessionRegistry creates an empty registry
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions:      make(map[string]*UnifiedHandler),
+		announcements: make(map[string]protocol.Announcement),
+	}
+}
+
+// Count returns the number of live sessions
+func (r *SessionRegistry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sessions)
+}
+
+// QueueStats returns queue metrics for every live session, ordered by session ID
+func (r *SessionRegistry) QueueStats() []protocol.QueueStats {
+	r.mu.RLock()
+	handlers := make([]*UnifiedHandler, 0, len(r.sessions))
+	for _, h := range r.sessions {
+		handlers = append(handlers, h)
+	}
+	r.mu.RUnlock()
+
+	stats := make([]protocol.QueueStats, 0, len(handlers))
+	for _, h := range handlers {
+		stats = append(stats, h.QueueStats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].SessionID < stats[j].SessionID
+	})
+	return stats
+}
+
+// Revoke ends every live session whose grant matches and returns how many
+// were ended
+func (r *SessionRegistry) Revoke(match func(Grant) bool, reason string) int {
+	r.mu.RLock()
+	var revoked []*UnifiedHandler
+	for _, h := range r.sessions {
+		if match(h.Grant()) {
+			revoked = append(revoked, h)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, h := range revoked {
+		h.Revoke(reason)
+	}
+	return len(revoked)
+}
+
+// Announce sends an operator announcement to every live session and keeps
+// it for sessions that open before it expires. An announcement with the ID of
+// an earlier one replaces it. It returns how many sessions it was sent to.
+func (r *SessionRegistry) Announce(a protocol.Announcement) int {
+	r.mu.Lock()
+	r.pruneAnnouncements(time.Now())
+	if a.ExpiresAt.After(time.Now()) {
+		r.announcements[a.ID] = a
+	}
+	handlers := r.live()
+	r.mu.Unlock()
+
+	// A session whose client stopped reading must not hold up the others
+	for _, h := range handlers {
+		go h.Announce(a)
+	}
+	return len(handlers)
+}
+
+// add registers a session and returns the announcements it should be sent,
+// and the suspension it should be warned about
+func (r *SessionRegistry) add(h *UnifiedHandler) ([]protocol.Announcement, *protocol.SuspendScheduled) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[h.sessionID] = h
+	r.pruneAnnouncements(time.Now())
+	active := make([]protocol.Announcement, 0, len(r.announcements))
+	for _, a := range r.announcements {
+		active = append(active, a)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].ExpiresAt.Before(active[j].ExpiresAt)
+	})
+	return active, r.pendingSuspension()
+}
+
+// live returns the live sessions; r.mu must be held
+func (r *SessionRegistry) live() []*UnifiedHandler {
+	handlers := make([]*UnifiedHandler, 0, len(r.sessions))
+	for _, h := range r.sessions {
+		handlers = append(handlers, h)
+	}
+	return handlers
+}
+
+// handlers returns the live sessions
+func (r *SessionRegistry) handlers() []*UnifiedHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.live()
+}
+
+// pruneAnnouncements drops expired announcements; r.mu must be held
+func (r *SessionRegistry) pruneAnnouncements(now time.Time) {
+	for id, a := range r.announcements {
+		if !a.ExpiresAt.After(now) {
+			delete(r.announcements, id)
+		}
+	}
+}
+
+func (r *SessionRegistry) remove(h *UnifiedHandler) {
+	r.mu.Lock()
+	if r.sessions[h.sessionID] == h {
+		delete(r.sessions, h.sessionID)
+	}
+	r.mu.Unlock()
+}
+
+func newQueueStats(sessionID string, stats queue.Stats, staleAfter time.Duration) protocol.QueueStats {
+	return protocol.QueueStats{
+		SessionID:        sessionID,
+		Pending:          stats.Pending,
+		InFlight:         stats.InFlight,
+		Retries:          stats.Retries,
+		Expired:          stats.Expired,
+		Dropped:          stats.Dropped,
+		OldestPendingMs:  stats.OldestPendingAge.Milliseconds(),
+		OldestInFlightMs: stats.OldestInFlightAge.Milliseconds(),
+		Stale:            staleAfter > 0 && stats.OldestInFlightAge > staleAfter,
+	}
+}
@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestSessionRegistryRevoke(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	registry := NewSessionRegistry()
+	start := func(tokenID string) (*httpTransport, chan struct{}) {
+		transport := newHTTPTransport()
+		h := NewTransportHandler(transport, echoChat{}, manager,
+			WithSessionRegistry(registry), WithGrant(Grant{TokenID: tokenID}))
+
+		done := make(chan struct{})
+		go func() {
+			h.Run()
+			close(done)
+		}()
+		return transport, done
+	}
+
+	revokedTransport, revokedDone := start("lost-device")
+	keptTransport, _ := start("other-device")
+	defer keptTransport.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for registry.Count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := registry.Revoke(func(g Grant) bool { return g.TokenID == "lost-device" }, "connect token revoked")
+	if closed != 1 {
+		t.Fatalf("expected 1 session revoked, got %d", closed)
+	}
+
+	select {
+	case msg := <-revokedTransport.outbound:
+		if msg.Type != protocol.TypeSessionRevoked {
+			t.Fatalf("expected session_revoked, got %s", msg.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client was not told about the revocation")
+	}
+
+	select {
+	case <-revokedDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("revoked session kept running")
+	}
+
+	if registry.Count() != 1 {
+		t.Fatalf("expected the other session to keep running, got %d sessions", registry.Count())
+	}
+}
+
+func TestSessionRegistryAnnounce(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	registry := NewSessionRegistry()
+	start := func() *httpTransport {
+		transport := newHTTPTransport()
+		h := NewTransportHandler(transport, echoChat{}, manager, WithSessionRegistry(registry))
+		go h.Run()
+		return transport
+	}
+	expectAnnouncement := func(transport *httpTransport, id string) {
+		t.Helper()
+		select {
+		case msg := <-transport.outbound:
+			if msg.Type != protocol.TypeAnnouncement || !msg.RequiresAck {
+				t.Fatalf("expected a reliable announcement, got %s", msg.Type)
+			}
+			var a protocol.Announcement
+			if err := json.Unmarshal(msg.Payload, &a); err != nil || a.ID != id {
+				t.Fatalf("expected announcement %s, got %s (%v)", id, msg.Payload, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("announcement %s not delivered", id)
+		}
+	}
+
+	live := start()
+	defer live.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for registry.Count() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("session never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	maintenance := protocol.Announcement{
+		ID:        "maintenance",
+		Kind:      protocol.AnnouncementMaintenance,
+		Message:   "Restarting at 02:00 UTC",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if n := registry.Announce(maintenance); n != 1 {
+		t.Fatalf("expected 1 session announced to, got %d", n)
+	}
+	expectAnnouncement(live, "maintenance")
+
+	// Expired announcements are delivered live but not kept
+	registry.Announce(protocol.Announcement{ID: "past", Message: "over", ExpiresAt: time.Now().Add(-time.Second)})
+	expectAnnouncement(live, "past")
+
+	// Sessions opened later get the announcements still in effect
+	late := start()
+	defer late.Close()
+	expectAnnouncement(late, "maintenance")
+	select {
+	case msg := <-late.outbound:
+		t.Fatalf("unexpected %s message", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
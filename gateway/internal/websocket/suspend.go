@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// suspendGrace is how long past its time a scheduled suspension stays
+// pending. If the control plane has not followed up by then it is not
+// coming, and clients are told the suspension is off.
+const suspendGrace = 2 * time.Minute
+
+// pendingSuspend is a suspension the control plane scheduled and no client
+// has called off yet
+type pendingSuspend struct {
+	notice protocol.SuspendScheduled
+	expiry *time.Timer
+}
+
+// ScheduleSuspend warns every live session that the VM will be suspended,
+// and keeps the warning for sessions that open before then. A later
+// suspension replaces it. It returns how many sessions were warned.
+func (r *SessionRegistry) ScheduleSuspend(s protocol.SuspendScheduled) int {
+	pending := &pendingSuspend{notice: s}
+
+	r.mu.Lock()
+	if r.suspend != nil {
+		r.suspend.expiry.Stop()
+	}
+	pending.expiry = time.AfterFunc(time.Until(s.SuspendAt)+suspendGrace, func() {
+		r.cancelSuspend(pending, protocol.SuspendCancelledExpired)
+	})
+	r.suspend = pending
+	handlers := r.live()
+	r.mu.Unlock()
+
+	// A session whose client stopped reading must not hold up the others
+	for _, h := range handlers {
+		go h.WarnSuspend(s)
+	}
+	return len(handlers)
+}
+
+// CancelSuspend calls off the suspension with id and tells every live
+// session. It returns how many sessions were told, and false if that
+// suspension was not pending.
+func (r *SessionRegistry) CancelSuspend(id, reason string) (int, bool) {
+	r.mu.RLock()
+	pending := r.suspend
+	r.mu.RUnlock()
+
+	if pending == nil || pending.notice.ID != id {
+		return 0, false
+	}
+	return r.cancelSuspend(pending, reason)
+}
+
+// KeepAlive calls off the pending suspension, if there is one, because a
+// client is using the VM. It reports whether one was called off.
+func (r *SessionRegistry) KeepAlive(reason string) bool {
+	r.mu.RLock()
+	pending := r.suspend
+	r.mu.RUnlock()
+
+	if pending == nil {
+		return false
+	}
+	_, ok := r.cancelSuspend(pending, reason)
+	return ok
+}
+
+func (r *SessionRegistry) cancelSuspend(pending *pendingSuspend, reason string) (int, bool) {
+	r.mu.Lock()
+	if r.suspend != pending {
+		r.mu.Unlock()
+		return 0, false
+	}
+	r.suspend = nil
+	r.calledOff = pending.notice.ID
+	pending.expiry.Stop()
+	handlers := r.live()
+	r.mu.Unlock()
+
+	cancelled := protocol.SuspendCancelled{ID: pending.notice.ID, Reason: reason}
+	for _, h := range handlers {
+		go h.CancelSuspend(cancelled)
+	}
+	return len(handlers), true
+}
+
+// Suspend ends every live session with vm_suspended s. It reports false if
+// the suspension was called off, by a client or because it lapsed, in which
+// case the VM must be left running. One the gateway does not know of, as it
+// restarted since the warning or already went ahead with it, goes ahead, so
+// the control plane can retry.
+func (r *SessionRegistry) Suspend(s protocol.VMSuspended) (int, bool) {
+	r.mu.Lock()
+	if r.calledOff == s.ID {
+		r.mu.Unlock()
+		return 0, false
+	}
+	if r.suspend != nil && r.suspend.notice.ID == s.ID {
+		r.suspend.expiry.Stop()
+		r.suspend = nil
+	}
+	handlers := r.live()
+	r.mu.Unlock()
+
+	for _, h := range handlers {
+		h.Suspend(s)
+	}
+	return len(handlers), true
+}
+
+// pendingSuspension returns the suspension new sessions should be warned
+// about; r.mu must be held
+func (r *SessionRegistry) pendingSuspension() *protocol.SuspendScheduled {
+	if r.suspend == nil {
+		return nil
+	}
+	s := r.suspend.notice
+	return &s
+}
+
+// WarnSuspend tells the client the VM will be suspended unless it answers
+// keep_alive
+func (h *UnifiedHandler) WarnSuspend(s protocol.SuspendScheduled) {
+	s.SecondsLeft = int(time.Until(s.SuspendAt).Round(time.Second).Seconds())
+	if s.SecondsLeft < 0 {
+		s.SecondsLeft = 0
+	}
+
+	payload, _ := json.Marshal(s)
+	if h.deliverReliable(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeSuspendScheduled,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}) {
+		h.timeline.record(EventSuspendWarned, "suspend_id", s.ID, "reason", s.Reason)
+	}
+}
+
+// CancelSuspend tells the client a suspension it was warned about is off
+func (h *UnifiedHandler) CancelSuspend(c protocol.SuspendCancelled) {
+	payload, _ := json.Marshal(c)
+	h.deliver(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeSuspendCancelled,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// Suspend ends the session after telling the client the VM is being
+// suspended and how to resume it, like Revoke
+func (h *UnifiedHandler) Suspend(s protocol.VMSuspended) {
+	payload, _ := json.Marshal(s)
+	msg := &protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeVMSuspended,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+
+	select {
+	case h.terminate <- msg:
+		h.timeline.record(EventSuspended, "suspend_id", s.ID, "reason", s.Reason)
+		h.end("vm suspended: " + s.Reason)
+	default:
+		// Already terminating
+	}
+}
+
+// keepAlive calls off a pending suspension because the client is using the
+// VM
+func (h *UnifiedHandler) keepAlive(reason string) {
+	if h.sessions != nil {
+		h.sessions.KeepAlive(reason)
+	}
+}
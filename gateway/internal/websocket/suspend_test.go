@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestSessionRegistrySuspend(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	registry := NewSessionRegistry()
+	start := func() (*httpTransport, chan struct{}) {
+		transport := newHTTPTransport()
+		h := NewTransportHandler(transport, echoChat{}, manager, WithSessionRegistry(registry))
+		done := make(chan struct{})
+		go func() {
+			h.Run()
+			close(done)
+		}()
+		return transport, done
+	}
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for registry.Count() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d sessions, got %d", n, registry.Count())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	expect := func(transport *httpTransport, typ protocol.MessageType, v interface{}) {
+		t.Helper()
+		select {
+		case msg := <-transport.outbound:
+			if msg.Type != typ {
+				t.Fatalf("expected %s, got %s", typ, msg.Type)
+			}
+			if err := json.Unmarshal(msg.Payload, v); err != nil {
+				t.Fatalf("decode %s: %v", typ, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s message", typ)
+		}
+	}
+
+	first, firstDone := start()
+	second, secondDone := start()
+	defer first.Close()
+	defer second.Close()
+	waitFor(2)
+
+	// Every session is warned, and a keep_alive from one calls it off for all
+	idle := protocol.SuspendScheduled{
+		ID:         "s1",
+		Reason:     protocol.SuspendIdle,
+		SuspendAt:  time.Now().Add(5 * time.Minute),
+		ResumeHint: "devtail resume vm-1",
+	}
+	if n := registry.ScheduleSuspend(idle); n != 2 {
+		t.Fatalf("expected 2 sessions warned, got %d", n)
+	}
+	var warning protocol.SuspendScheduled
+	expect(first, protocol.TypeSuspendScheduled, &warning)
+	if warning.ID != "s1" || warning.SecondsLeft < 290 || warning.SecondsLeft > 300 || warning.ResumeHint != idle.ResumeHint {
+		t.Fatalf("unexpected warning %+v", warning)
+	}
+	expect(second, protocol.TypeSuspendScheduled, &warning)
+
+	second.push(&protocol.Message{ID: "keep-1", Type: protocol.TypeKeepAlive, Timestamp: time.Now()})
+	var cancelled protocol.SuspendCancelled
+	expect(first, protocol.TypeSuspendCancelled, &cancelled)
+	if cancelled.ID != "s1" || cancelled.Reason != protocol.SuspendCancelledKeepAlive {
+		t.Fatalf("unexpected cancellation %+v", cancelled)
+	}
+	expect(second, protocol.TypeSuspendCancelled, &cancelled)
+
+	if _, ok := registry.Suspend(protocol.VMSuspended{ID: "s1"}); ok {
+		t.Fatal("suspension went ahead after a keep_alive")
+	}
+
+	// Sessions opened while a suspension is pending are warned too, and all
+	// are ended with the resume hint when it goes ahead
+	idle.ID = "s2"
+	registry.ScheduleSuspend(idle)
+	expect(first, protocol.TypeSuspendScheduled, &warning)
+	expect(second, protocol.TypeSuspendScheduled, &warning)
+
+	late, lateDone := start()
+	defer late.Close()
+	expect(late, protocol.TypeSuspendScheduled, &warning)
+	if warning.ID != "s2" {
+		t.Fatalf("late session warned about %s", warning.ID)
+	}
+
+	if n, ok := registry.Suspend(protocol.VMSuspended{ID: "s2", Reason: idle.Reason, ResumeHint: idle.ResumeHint}); !ok || n != 3 {
+		t.Fatalf("expected 3 sessions suspended, got %d (pending %v)", n, ok)
+	}
+	for _, transport := range []*httpTransport{first, second, late} {
+		var suspended protocol.VMSuspended
+		expect(transport, protocol.TypeVMSuspended, &suspended)
+		if suspended.ID != "s2" || suspended.ResumeHint != idle.ResumeHint {
+			t.Fatalf("unexpected vm_suspended %+v", suspended)
+		}
+	}
+	for _, done := range []chan struct{}{firstDone, secondDone, lateDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("session kept running after the vm was suspended")
+		}
+	}
+}
+
+func TestSessionRegistrySuspendActivity(t *testing.T) {
+	registry := NewSessionRegistry()
+	registry.ScheduleSuspend(protocol.SuspendScheduled{ID: "s1", SuspendAt: time.Now().Add(time.Minute)})
+
+	if _, ok := registry.CancelSuspend("other", protocol.SuspendCancelledControlPlane); ok {
+		t.Fatal("cancelled a suspension that was not pending")
+	}
+	if !registry.KeepAlive(protocol.SuspendCancelledActivity) {
+		t.Fatal("activity did not call off the suspension")
+	}
+	if registry.KeepAlive(protocol.SuspendCancelledActivity) {
+		t.Fatal("called off a suspension twice")
+	}
+
+	// A suspension the control plane never follows up lapses
+	registry.ScheduleSuspend(protocol.SuspendScheduled{ID: "s2", SuspendAt: time.Now().Add(-suspendGrace)})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		registry.mu.RLock()
+		pending := registry.suspend
+		registry.mu.RUnlock()
+		if pending == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("overdue suspension never lapsed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := registry.Suspend(protocol.VMSuspended{ID: "s2"}); ok {
+		t.Fatal("suspension went ahead after it lapsed")
+	}
+}
+
+func TestSessionRegistrySuspendRetried(t *testing.T) {
+	registry := NewSessionRegistry()
+	registry.ScheduleSuspend(protocol.SuspendScheduled{ID: "s1", SuspendAt: time.Now().Add(time.Minute)})
+
+	// The control plane may send the notice again, as when it did not hear
+	// back the first time
+	for i := 0; i < 2; i++ {
+		if _, ok := registry.Suspend(protocol.VMSuspended{ID: "s1"}); !ok {
+			t.Fatalf("attempt %d: expected the suspension to go ahead", i+1)
+		}
+	}
+
+	// A gateway restarted since the warning does not know of it
+	if _, ok := NewSessionRegistry().Suspend(protocol.VMSuspended{ID: "s2"}); !ok {
+		t.Fatal("expected a suspension the gateway was not warned about to go ahead")
+	}
+}
@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// ErrUnknownTask is returned by a TaskRunner for a task the user does not
+// have
+var ErrUnknownTask = errors.New("unknown task")
+
+// TaskEvent is a change to a watched task: more progress, or with Status
+// set its new state
+type TaskEvent struct {
+	Progress *protocol.TaskProgress
+	Status   *protocol.TaskStatus
+}
+
+// TaskRunner carries out background tasks. Each task belongs to the user
+// who submitted it, named by their grant's subject, and is only visible to
+// them.
+type TaskRunner interface {
+	Submit(owner string, req protocol.TaskSubmit) (protocol.TaskStatus, error)
+	List(owner string) []protocol.TaskStatus
+	Cancel(owner, taskID string) (protocol.TaskStatus, error)
+
+	// Watch streams the task's progress after afterSeq and its status
+	// changes. The events end with the task's final status, or early if
+	// the watcher falls behind, in which case it can watch again from the
+	// last seq it saw. stop ends the events.
+	Watch(owner, taskID string, afterSeq int64) (events <-chan TaskEvent, stop func(), err error)
+}
+
+// WithTasks answers task requests by running the tasks with r
+func WithTasks(r TaskRunner) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.tasks = r
+	}
+}
+
+// handleTask submits, lists, watches or cancels the user's tasks
+func (h *UnifiedHandler) handleTask(msg *protocol.Message) {
+	if h.tasks == nil {
+		h.sendError(msg.ID, "tasks_unavailable", "this gateway does not run tasks", false)
+		return
+	}
+	owner := h.Grant().Subject
+
+	switch msg.Type {
+	case protocol.TypeTaskSubmit:
+		var req protocol.TaskSubmit
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		if req.Instruction == "" {
+			h.sendError(msg.ID, "invalid_payload", "instruction is required", false)
+			return
+		}
+		h.vetCommand(msg, protocol.CommandSourceTask, req.Instruction, func() {
+			status, err := h.tasks.Submit(owner, req)
+			if err != nil {
+				h.sendTaskError(msg.ID, err)
+				return
+			}
+			h.timeline.record(EventTaskSubmitted, "task_id", status.ID)
+			h.deliver(h.taskStatusMessage(msg.ID, status))
+			if req.Watch {
+				h.watchTask(msg.ID, status.ID, status.Seq)
+			}
+		})
+
+	case protocol.TypeTaskList:
+		payload, _ := json.Marshal(protocol.TaskList{Tasks: h.tasks.List(owner)})
+		h.deliver(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypeTaskList,
+			Timestamp:     time.Now(),
+			Payload:       payload,
+			CorrelationID: msg.ID,
+		})
+
+	case protocol.TypeTaskWatch:
+		var req protocol.TaskWatch
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		if err := h.watchTask(msg.ID, req.TaskID, req.AfterSeq); err != nil {
+			h.sendTaskError(msg.ID, err)
+		}
+
+	case protocol.TypeTaskCancel:
+		var req protocol.TaskCancel
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		// The task's diff is taken before it reports having stopped
+		go func() {
+			status, err := h.tasks.Cancel(owner, req.TaskID)
+			if err != nil {
+				h.sendTaskError(msg.ID, err)
+				return
+			}
+			h.deliver(h.taskStatusMessage(msg.ID, status))
+		}()
+	}
+}
+
+// watchTask streams a task to the client, correlated with the request that
+// asked for it, until the task ends or the session does. Progress is best
+// effort, since a client that reconnects watches again from the last seq it
+// saw; the final status is kept for the client if it has gone.
+func (h *UnifiedHandler) watchTask(correlationID, taskID string, afterSeq int64) error {
+	owner := h.Grant().Subject
+	events, stop, err := h.tasks.Watch(owner, taskID, afterSeq)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() { stop() }()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					// Fell behind; catch up from the last progress sent
+					stop()
+					if events, stop, err = h.tasks.Watch(owner, taskID, afterSeq); err != nil {
+						stop = func() {}
+						return
+					}
+					continue
+				}
+				if event.Progress != nil {
+					payload, _ := json.Marshal(event.Progress)
+					if !h.deliver(&protocol.Message{
+						ID:            uuid.New().String(),
+						Type:          protocol.TypeTaskProgress,
+						Timestamp:     time.Now(),
+						Payload:       payload,
+						CorrelationID: correlationID,
+					}) {
+						return
+					}
+					afterSeq = event.Progress.Seq
+					continue
+				}
+				if event.Status.Ended() {
+					h.deliverOrKeep(h.taskStatusMessage(correlationID, *event.Status), true)
+					return
+				}
+				if !h.deliver(h.taskStatusMessage(correlationID, *event.Status)) {
+					return
+				}
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// taskStatusMessage wraps a task's status for the client
+func (h *UnifiedHandler) taskStatusMessage(correlationID string, status protocol.TaskStatus) *protocol.Message {
+	payload, _ := json.Marshal(status)
+	return &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeTaskStatus,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: correlationID,
+	}
+}
+
+// sendTaskError reports a failed task request. Errors that describe
+// themselves, such as an invalid work_dir, keep their code.
+func (h *UnifiedHandler) sendTaskError(messageID string, err error) {
+	var clientErr clientError
+	if errors.As(err, &clientErr) {
+		h.sendErrorPayload(messageID, clientErr.ClientError())
+		return
+	}
+	if errors.Is(err, ErrUnknownTask) {
+		h.sendError(messageID, "unknown_task", err.Error(), false)
+		return
+	}
+	h.sendError(messageID, "task_error", err.Error(), true)
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// finishedTaskRunner runs every task instantly: two parts of progress and
+// done
+type finishedTaskRunner struct {
+	owner string
+}
+
+func (r finishedTaskRunner) Submit(owner string, req protocol.TaskSubmit) (protocol.TaskStatus, error) {
+	return protocol.TaskStatus{ID: "t1", Instruction: req.Instruction, State: protocol.TaskQueued}, nil
+}
+
+func (r finishedTaskRunner) List(owner string) []protocol.TaskStatus {
+	return nil
+}
+
+func (r finishedTaskRunner) Cancel(owner, taskID string) (protocol.TaskStatus, error) {
+	return protocol.TaskStatus{}, ErrUnknownTask
+}
+
+func (r finishedTaskRunner) Watch(owner, taskID string, afterSeq int64) (<-chan TaskEvent, func(), error) {
+	if owner != r.owner || taskID != "t1" {
+		return nil, nil, ErrUnknownTask
+	}
+	events := make(chan TaskEvent, 3)
+	for seq := afterSeq + 1; seq <= 2; seq++ {
+		events <- TaskEvent{Progress: &protocol.TaskProgress{TaskID: taskID, Seq: seq, Content: "working"}}
+	}
+	events <- TaskEvent{Status: &protocol.TaskStatus{ID: taskID, State: protocol.TaskSucceeded, Seq: 2, Summary: "done"}}
+	close(events)
+	return events, func() {}, nil
+}
+
+// expectTask reads the progress seqs of a watched task up to its final
+// status
+func expectTask(t *testing.T, transport *httpTransport, correlationID string) []int64 {
+	t.Helper()
+	var seqs []int64
+	for {
+		msg := nextOutbound(t, transport)
+		if msg.CorrelationID != correlationID {
+			t.Fatalf("expected messages for %s, got %+v", correlationID, msg)
+		}
+		switch msg.Type {
+		case protocol.TypeTaskProgress:
+			var progress protocol.TaskProgress
+			json.Unmarshal(msg.Payload, &progress)
+			seqs = append(seqs, progress.Seq)
+		case protocol.TypeTaskStatus:
+			var status protocol.TaskStatus
+			json.Unmarshal(msg.Payload, &status)
+			if status.State != protocol.TaskSucceeded || !msg.RequiresAck {
+				t.Fatalf("expected the final status, to be acknowledged, got %+v %+v", msg, status)
+			}
+			return seqs
+		default:
+			t.Fatalf("unexpected %+v", msg)
+		}
+	}
+}
+
+func TestTasksStreamToWatchers(t *testing.T) {
+	_, transport, _ := startExpiringHandler(t, WithTasks(finishedTaskRunner{owner: "alice"}), WithGrant(Grant{Subject: "alice"}))
+
+	submit, _ := json.Marshal(protocol.TaskSubmit{Instruction: "upgrade all deps", Watch: true})
+	transport.push(&protocol.Message{ID: "s1", Type: protocol.TypeTaskSubmit, Timestamp: time.Now(), Payload: submit})
+	var status protocol.TaskStatus
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeTaskStatus || msg.CorrelationID != "s1" {
+		t.Fatalf("expected the submitted task's status, got %+v", msg)
+	} else if json.Unmarshal(msg.Payload, &status); status.State != protocol.TaskQueued {
+		t.Fatalf("expected the task queued, got %+v", status)
+	}
+	if seqs := expectTask(t, transport, "s1"); len(seqs) != 2 {
+		t.Fatalf("expected all progress, got %v", seqs)
+	}
+
+	// Coming back after seeing the first part
+	watch, _ := json.Marshal(protocol.TaskWatch{TaskID: "t1", AfterSeq: 1})
+	transport.push(&protocol.Message{ID: "w1", Type: protocol.TypeTaskWatch, Timestamp: time.Now(), Payload: watch})
+	if seqs := expectTask(t, transport, "w1"); len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("expected the progress after seq 1, got %v", seqs)
+	}
+
+	unknown, _ := json.Marshal(protocol.TaskWatch{TaskID: "nope"})
+	transport.push(&protocol.Message{ID: "w2", Type: protocol.TypeTaskWatch, Timestamp: time.Now(), Payload: unknown})
+	var chatErr protocol.ChatError
+	msg := nextOutbound(t, transport)
+	if json.Unmarshal(msg.Payload, &chatErr); msg.Type != protocol.TypeChatError || msg.ID != "w2" || chatErr.Code != "unknown_task" {
+		t.Fatalf("expected unknown_task, got %+v", msg)
+	}
+}
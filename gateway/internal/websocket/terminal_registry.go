@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+var errRegistryClosed = errors.New("terminal registry closed")
+
+// terminalSource opens an output stream for a terminal. The stream must be
+// closed when ctx is cancelled or the terminal exits.
+type terminalSource func(ctx context.Context, terminalID string) (<-chan *protocol.Message, error)
+
+// terminalRegistry tracks the terminals a connection is attached to and owns
+// the goroutines forwarding their output. Each terminal has at most one
+// subscriber per connection; other connections attach independently.
+type terminalRegistry struct {
+	source terminalSource
+
+	mu     sync.Mutex
+	subs   map[string]*terminalSubscriber
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type terminalSubscriber struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTerminalRegistry(source terminalSource) *terminalRegistry {
+	return &terminalRegistry{
+		source: source,
+		subs:   make(map[string]*terminalSubscriber),
+	}
+}
+
+// attach starts forwarding output for terminalID through deliver, which
+// reports false once the connection can no longer accept messages. onExit is
+// called if the stream ends because the terminal exited rather than because
+// it was detached. Attaching an already attached terminal is a no-op.
+func (r *terminalRegistry) attach(parent context.Context, terminalID string, deliver func(*protocol.Message) bool, onExit func(terminalID string)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errRegistryClosed
+	}
+	if _, exists := r.subs[terminalID]; exists {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	stream, err := r.source(ctx, terminalID)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	sub := &terminalSubscriber{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.subs[terminalID] = sub
+
+	r.wg.Add(1)
+	go r.forward(ctx, terminalID, sub, stream, deliver, onExit)
+	return nil
+}
+
+// streaming reports whether output of terminalID is being forwarded
+func (r *terminalRegistry) streaming(terminalID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.subs[terminalID]
+	return ok
+}
+
+func (r *terminalRegistry) forward(ctx context.Context, terminalID string, sub *terminalSubscriber, stream <-chan *protocol.Message, deliver func(*protocol.Message) bool, onExit func(string)) {
+	defer r.wg.Done()
+	defer close(sub.done)
+
+	for msg := range stream {
+		if ctx.Err() != nil {
+			// Detached; drain until the source notices
+			continue
+		}
+		if !deliver(msg) {
+			sub.cancel()
+		}
+	}
+
+	exited := ctx.Err() == nil
+	sub.cancel()
+	r.remove(terminalID, sub)
+
+	if exited && onExit != nil {
+		onExit(terminalID)
+	}
+}
+
+// detach stops forwarding output for terminalID and waits for the forwarding
+// goroutine to finish, so no output for it is delivered after detach returns.
+func (r *terminalRegistry) detach(terminalID string) bool {
+	r.mu.Lock()
+	sub, exists := r.subs[terminalID]
+	delete(r.subs, terminalID)
+	r.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	sub.cancel()
+	<-sub.done
+	return true
+}
+
+// closeAll detaches every terminal and waits for all forwarders to exit.
+// Later attach calls fail.
+func (r *terminalRegistry) closeAll() {
+	r.mu.Lock()
+	r.closed = true
+	for id, sub := range r.subs {
+		sub.cancel()
+		delete(r.subs, id)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+// attached returns the IDs of terminals currently streaming to this connection
+func (r *terminalRegistry) attached() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]string, 0, len(r.subs))
+	for id := range r.subs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (r *terminalRegistry) remove(terminalID string, sub *terminalSubscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subs[terminalID] == sub {
+		delete(r.subs, terminalID)
+	}
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// fakeTerminals hands out controllable output streams keyed by terminal ID
+type fakeTerminals struct {
+	mu      sync.Mutex
+	streams map[string]chan *protocol.Message
+	opened  map[string]int
+}
+
+func newFakeTerminals() *fakeTerminals {
+	return &fakeTerminals{
+		streams: make(map[string]chan *protocol.Message),
+		opened:  make(map[string]int),
+	}
+}
+
+func (f *fakeTerminals) source(ctx context.Context, terminalID string) (<-chan *protocol.Message, error) {
+	in := make(chan *protocol.Message)
+	out := make(chan *protocol.Message)
+
+	f.mu.Lock()
+	f.streams[terminalID] = in
+	f.opened[terminalID]++
+	f.mu.Unlock()
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (f *fakeTerminals) stream(terminalID string) chan *protocol.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[terminalID]
+}
+
+type collector struct {
+	mu       sync.Mutex
+	messages []*protocol.Message
+	exited   []string
+}
+
+func (c *collector) deliver(msg *protocol.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, msg)
+	return true
+}
+
+func (c *collector) onExit(terminalID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exited = append(c.exited, terminalID)
+}
+
+func (c *collector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTerminalRegistryForwardsOutput(t *testing.T) {
+	terms := newFakeTerminals()
+	reg := newTerminalRegistry(terms.source)
+	defer reg.closeAll()
+	c := &collector{}
+
+	if err := reg.attach(context.Background(), "t1", c.deliver, c.onExit); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	// Attaching twice must not open a second stream
+	if err := reg.attach(context.Background(), "t1", c.deliver, c.onExit); err != nil {
+		t.Fatalf("second attach: %v", err)
+	}
+	if terms.opened["t1"] != 1 {
+		t.Fatalf("expected 1 stream, got %d", terms.opened["t1"])
+	}
+
+	terms.stream("t1") <- &protocol.Message{ID: "a"}
+	terms.stream("t1") <- &protocol.Message{ID: "b"}
+	waitFor(t, func() bool { return c.count() == 2 })
+}
+
+func TestTerminalRegistryDetach(t *testing.T) {
+	terms := newFakeTerminals()
+	reg := newTerminalRegistry(terms.source)
+	defer reg.closeAll()
+	c := &collector{}
+
+	reg.attach(context.Background(), "t1", c.deliver, c.onExit)
+	terms.stream("t1") <- &protocol.Message{ID: "a"}
+	waitFor(t, func() bool { return c.count() == 1 })
+
+	if !reg.detach("t1") {
+		t.Fatal("detach reported terminal not attached")
+	}
+	if len(reg.attached()) != 0 {
+		t.Fatalf("expected no attached terminals, got %v", reg.attached())
+	}
+	if len(c.exited) != 0 {
+		t.Fatalf("detach must not report an exit, got %v", c.exited)
+	}
+
+	// Re-attaching after detach opens a fresh stream
+	reg.attach(context.Background(), "t1", c.deliver, c.onExit)
+	if terms.opened["t1"] != 2 {
+		t.Fatalf("expected re-attach to open a new stream, got %d", terms.opened["t1"])
+	}
+}
+
+func TestTerminalRegistryTerminalExit(t *testing.T) {
+	terms := newFakeTerminals()
+	reg := newTerminalRegistry(terms.source)
+	defer reg.closeAll()
+	c := &collector{}
+
+	reg.attach(context.Background(), "t1", c.deliver, c.onExit)
+	close(terms.stream("t1"))
+
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.exited) == 1
+	})
+	if len(reg.attached()) != 0 {
+		t.Fatalf("exited terminal still attached: %v", reg.attached())
+	}
+}
+
+func TestTerminalRegistryCloseAll(t *testing.T) {
+	terms := newFakeTerminals()
+	reg := newTerminalRegistry(terms.source)
+	c := &collector{}
+
+	reg.attach(context.Background(), "t1", c.deliver, c.onExit)
+	reg.attach(context.Background(), "t2", c.deliver, c.onExit)
+
+	done := make(chan struct{})
+	go func() {
+		reg.closeAll()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("closeAll did not return")
+	}
+
+	if err := reg.attach(context.Background(), "t3", c.deliver, c.onExit); err != errRegistryClosed {
+		t.Fatalf("expected errRegistryClosed, got %v", err)
+	}
+	if len(c.exited) != 0 {
+		t.Fatalf("teardown must not report exits, got %v", c.exited)
+	}
+}
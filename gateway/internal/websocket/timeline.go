@@ -0,0 +1,221 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTimelineSessions is how many ended sessions keep their timeline
+	defaultTimelineSessions = 100
+
+	// maxTimelineEvents caps one session's timeline; the oldest events are
+	// dropped first, since the end of a session is what support asks about
+	maxTimelineEvents = 500
+)
+
+// Timeline event types
+const (
+	EventConnected        = "connected"
+	EventAuthenticated    = "authenticated"
+	EventHello            = "hello"
+	EventResumed          = "resumed"
+	EventTerminalOpened   = "terminal_opened"
+	EventTerminalAttached = "terminal_attached"
+	EventTerminalDetached = "terminal_detached"
+	EventTerminalExited   = "terminal_exited"
+	EventChatStarted      = "chat_started"
+	EventTaskSubmitted    = "task_submitted"
+	EventBackendRecovery  = "backend_recovery"
+	EventError            = "error"
+	EventStale            = "stale"
+	EventRecovered        = "recovered"
+	EventRevoked          = "revoked"
+	EventReauthenticated  = "reauthenticated"
+	EventExpired          = "expired"
+	EventAnnounced        = "announced"
+	EventNotified         = "notified"
+	EventSuspendWarned    = "suspend_warned"
+	EventSuspended        = "suspended"
+	EventReaped           = "reaped"
+	EventDisconnected     = "disconnected"
+)
+
+// ClientInfo describes the client end of a session
+type ClientInfo struct {
+	Transport  string `json:"transport"` // websocket, http, webtransport or grpc
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+}
+
+// TimelineEvent is one step of a session
+type TimelineEvent struct {
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	Detail map[string]string `json:"detail,omitempty"`
+}
+
+// SessionSummary describes a session without its events
+type SessionSummary struct {
+	SessionID        string     `json:"session_id"`
+	Client           ClientInfo `json:"client"`
+	Subject          string     `json:"subject,omitempty"` // user the connect token was issued to
+	StartedAt        time.Time  `json:"started_at"`
+	EndedAt          *time.Time `json:"ended_at,omitempty"`
+	DisconnectReason string     `json:"disconnect_reason,omitempty"`
+	Events           int        `json:"events"`
+}
+
+// SessionTimeline is everything recorded about one session
+type SessionTimeline struct {
+	SessionSummary
+	DroppedEvents int             `json:"dropped_events,omitempty"`
+	Timeline      []TimelineEvent `json:"timeline"`
+}
+
+// timeline records the events of one session
+type timeline struct {
+	mu      sync.Mutex
+	summary SessionSummary
+	events  []TimelineEvent
+	dropped int
+}
+
+// record appends an event; detail is alternating keys and values
+func (t *timeline) record(eventType string, detail ...string) {
+	if t == nil {
+		return
+	}
+
+	event := TimelineEvent{Time: time.Now(), Type: eventType}
+	if len(detail) > 1 {
+		event.Detail = make(map[string]string, len(detail)/2)
+		for i := 0; i+1 < len(detail); i += 2 {
+			event.Detail[detail[i]] = detail[i+1]
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, event)
+	if over := len(t.events) - maxTimelineEvents; over > 0 {
+		t.events = append(t.events[:0:0], t.events[over:]...)
+		t.dropped += over
+	}
+}
+
+func (t *timeline) snapshot() SessionTimeline {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := SessionTimeline{
+		SessionSummary: t.summary,
+		DroppedEvents:  t.dropped,
+		Timeline:       append([]TimelineEvent(nil), t.events...),
+	}
+	s.Events = len(t.events) + t.dropped
+	return s
+}
+
+// TimelineStore keeps the timelines of live sessions and of the most recent
+// ended ones, so support can reconstruct what a user experienced. Timelines
+// are held in memory and lost when the gateway restarts.
+type TimelineStore struct {
+	mu       sync.RWMutex
+	live     map[string]*timeline
+	ended    []*timeline // oldest first
+	maxEnded int
+}
+
+// NewTimelineStore keeps the timelines of up to maxEnded ended sessions
+func NewTimelineStore(maxEnded int) *TimelineStore {
+	if maxEnded <= 0 {
+		maxEnded = defaultTimelineSessions
+	}
+	return &TimelineStore{
+		live:     make(map[string]*timeline),
+		maxEnded: maxEnded,
+	}
+}
+
+func (s *TimelineStore) start(sessionID, subject string, client ClientInfo) *timeline {
+	t := &timeline{summary: SessionSummary{
+		SessionID: sessionID,
+		Client:    client,
+		Subject:   subject,
+		StartedAt: time.Now(),
+	}}
+
+	s.mu.Lock()
+	s.live[sessionID] = t
+	s.mu.Unlock()
+	return t
+}
+
+// finish records the disconnect and moves the timeline to the ended list
+func (s *TimelineStore) finish(t *timeline, reason string) {
+	t.record(EventDisconnected, "reason", reason)
+
+	t.mu.Lock()
+	now := time.Now()
+	t.summary.EndedAt = &now
+	t.summary.DisconnectReason = reason
+	sessionID := t.summary.SessionID
+	t.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.live[sessionID] == t {
+		delete(s.live, sessionID)
+	}
+	s.ended = append(s.ended, t)
+	if over := len(s.ended) - s.maxEnded; over > 0 {
+		s.ended = append(s.ended[:0:0], s.ended[over:]...)
+	}
+}
+
+// Get returns the timeline of a live or recently ended session
+func (s *TimelineStore) Get(sessionID string) (SessionTimeline, bool) {
+	s.mu.RLock()
+	t, ok := s.live[sessionID]
+	if !ok {
+		for i := len(s.ended) - 1; i >= 0; i-- {
+			if s.ended[i].summary.SessionID == sessionID {
+				t, ok = s.ended[i], true
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		return SessionTimeline{}, false
+	}
+	return t.snapshot(), true
+}
+
+// List summarizes live and recently ended sessions, newest first. A
+// non-empty subject limits the list to that user's sessions.
+func (s *TimelineStore) List(subject string) []SessionSummary {
+	s.mu.RLock()
+	all := make([]*timeline, 0, len(s.live)+len(s.ended))
+	for _, t := range s.live {
+		all = append(all, t)
+	}
+	all = append(all, s.ended...)
+	s.mu.RUnlock()
+
+	summaries := make([]SessionSummary, 0, len(all))
+	for _, t := range all {
+		snap := t.snapshot()
+		if subject != "" && snap.Subject != subject {
+			continue
+		}
+		summaries = append(summaries, snap.SessionSummary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StartedAt.After(summaries[j].StartedAt)
+	})
+	return summaries
+}
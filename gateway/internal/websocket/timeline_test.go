@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestTimelineRecordsSession(t *testing.T) {
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	timelines := NewTimelineStore(10)
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager,
+		WithTimelines(timelines),
+		WithGrant(Grant{TokenID: "token-1", Subject: "user-1"}),
+		WithClient(ClientInfo{Transport: "http", RemoteAddr: "10.0.0.1:1234"}))
+
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Content: "hello"})
+	transport.push(&protocol.Message{ID: "chat-1", Type: protocol.TypeChat, Payload: payload})
+	transport.push(&protocol.Message{ID: "chat-2", Type: protocol.TypeChat, Payload: json.RawMessage(`"not an object"`)})
+
+	// Both messages are answered before the client goes away
+	for i := 0; i < 2; i++ {
+		select {
+		case <-transport.outbound:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply to chat message")
+		}
+	}
+	transport.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+
+	timeline, ok := timelines.Get(h.SessionID())
+	if !ok {
+		t.Fatal("timeline not kept after the session ended")
+	}
+	if timeline.Subject != "user-1" || timeline.Client.RemoteAddr != "10.0.0.1:1234" {
+		t.Errorf("unexpected summary: %+v", timeline.SessionSummary)
+	}
+	if timeline.EndedAt == nil || timeline.DisconnectReason != "client closed the connection" {
+		t.Errorf("expected a client disconnect, got %q", timeline.DisconnectReason)
+	}
+
+	var types []string
+	for _, e := range timeline.Timeline {
+		types = append(types, e.Type)
+	}
+	want := []string{EventConnected, EventAuthenticated, EventChatStarted, EventError, EventDisconnected}
+	if len(types) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("expected events %v, got %v", want, types)
+		}
+	}
+	if timeline.Timeline[3].Detail["code"] != "invalid_payload" {
+		t.Errorf("expected the error code in the event, got %v", timeline.Timeline[3].Detail)
+	}
+}
+
+func TestTimelineStoreKeepsRecentSessions(t *testing.T) {
+	timelines := NewTimelineStore(2)
+
+	for _, id := range []string{"s1", "s2", "s3"} {
+		subject := "user-1"
+		if id == "s2" {
+			subject = "user-2"
+		}
+		tl := timelines.start(id, subject, ClientInfo{Transport: "websocket"})
+		timelines.finish(tl, "client closed the connection")
+	}
+	live := timelines.start("s4", "user-1", ClientInfo{Transport: "websocket"})
+	live.record(EventChatStarted)
+
+	if _, ok := timelines.Get("s1"); ok {
+		t.Error("expected the oldest ended session to be forgotten")
+	}
+	if _, ok := timelines.Get("s4"); !ok {
+		t.Error("expected the live session to be listed")
+	}
+
+	summaries := timelines.List("user-1")
+	if len(summaries) != 2 || summaries[0].SessionID != "s4" || summaries[1].SessionID != "s3" {
+		t.Fatalf("expected s4 then s3 for user-1, got %+v", summaries)
+	}
+	if len(timelines.List("")) != 3 {
+		t.Errorf("expected every kept session without a subject filter")
+	}
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+)
+
+// WithChatExport answers chat_export requests with the transcript fn
+// renders
+func WithChatExport(fn func(ctx context.Context, export protocol.ChatExport) (protocol.ChatTranscript, error)) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.chatExport = fn
+	}
+}
+
+// handleChatExport replies with the transcript of a conversation. Diffs are
+// read from git, which may take a moment, so it runs in the background.
+func (h *UnifiedHandler) handleChatExport(msg *protocol.Message) {
+	if h.chatExport == nil {
+		h.sendError(msg.ID, "export_unavailable", "this gateway does not export conversations", false)
+		return
+	}
+
+	var export protocol.ChatExport
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &export); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+	}
+
+	go func() {
+		transcript, err := h.chatExport(h.ctx, export)
+		if err != nil {
+			var clientErr clientError
+			if errors.As(err, &clientErr) {
+				h.sendErrorPayload(msg.ID, clientErr.ClientError())
+				return
+			}
+			h.log.Warn().Err(err).Str("workspace", export.Workspace).Msg("chat export failed")
+			h.sendError(msg.ID, "export_failed", err.Error(), true)
+			return
+		}
+
+		payload, _ := json.Marshal(transcript)
+		h.deliver(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypeChatTranscript,
+			Timestamp:     time.Now(),
+			Payload:       payload,
+			CorrelationID: msg.ID,
+		})
+	}()
+}
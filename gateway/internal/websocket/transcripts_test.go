@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/chat"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func TestChatExport(t *testing.T) {
+	_, transport, _ := startExpiringHandler(t, WithReadOnly(), WithChatExport(func(ctx context.Context, export protocol.ChatExport) (protocol.ChatTranscript, error) {
+		if export.Format == "pdf" {
+			return protocol.ChatTranscript{}, chat.NewChatError(chat.ErrorTypeConfig, "unknown transcript format", "").WithCode(chat.CodeUnknownFormat)
+		}
+		return protocol.ChatTranscript{WorkDir: export.WorkDir, Format: "markdown", Filename: "conversation-s1.md", Content: "# Conversation s1\n"}, nil
+	}))
+
+	// Exporting changes nothing, so read-only sessions may
+	payload, _ := json.Marshal(protocol.ChatExport{WorkDir: "api"})
+	transport.push(&protocol.Message{ID: "x1", Type: protocol.TypeChatExport, Timestamp: time.Now(), Payload: payload})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeChatTranscript || reply.CorrelationID != "x1" {
+		t.Fatalf("expected a chat_transcript reply, got %+v", reply)
+	}
+	var transcript protocol.ChatTranscript
+	if err := json.Unmarshal(reply.Payload, &transcript); err != nil {
+		t.Fatal(err)
+	}
+	if transcript.WorkDir != "api" || transcript.Filename != "conversation-s1.md" {
+		t.Fatalf("unexpected transcript %+v", transcript)
+	}
+
+	payload, _ = json.Marshal(protocol.ChatExport{Format: "pdf"})
+	transport.push(&protocol.Message{ID: "x2", Type: protocol.TypeChatExport, Timestamp: time.Now(), Payload: payload})
+	expectChatError(t, transport, "x2", chat.CodeUnknownFormat)
+}
+
+func TestChatExportUnavailable(t *testing.T) {
+	_, transport, _ := startExpiringHandler(t)
+
+	transport.push(&protocol.Message{ID: "x1", Type: protocol.TypeChatExport, Timestamp: time.Now()})
+	expectChatError(t, transport, "x1", "export_unavailable")
+}
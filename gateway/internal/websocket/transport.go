@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries protocol messages between the gateway and one client.
+// ReadMessage is called from a single goroutine, as are WriteMessage and
+// Keepalive; Close may be called from any goroutine.
+type Transport interface {
+	// ReadMessage blocks until the next inbound message. It returns io.EOF
+	// when the client closed the session normally.
+	ReadMessage() (*protocol.Message, error)
+
+	// WriteMessage sends one outbound message
+	WriteMessage(msg *protocol.Message) error
+
+	// Keepalive is called every pingInterval. An error ends the session.
+	Keepalive() error
+
+	// Close releases the transport and unblocks ReadMessage
+	Close() error
+}
+
+// HeartbeatTransport is implemented by transports that see the client's
+// heartbeats below the message layer, such as WebSocket pongs. Sessions on
+// these transports are reaped when heartbeats stop; see
+// SessionRegistry.Reap.
+type HeartbeatTransport interface {
+	Transport
+
+	// LastHeartbeat returns when the client last showed it was alive. A
+	// zero time means the transport has nothing to report.
+	LastHeartbeat() time.Time
+}
+
+// BinaryTransport is implemented by transports that can carry raw bytes
+// alongside JSON messages, such as WebSocket binary frames. Sessions on
+// these transports offer protocol.CapabilityBinaryTerminal.
+type BinaryTransport interface {
+	Transport
+
+	// WriteBinary sends one binary frame; it is called from the same
+	// goroutine as WriteMessage
+	WriteBinary(data []byte) error
+}
+
+// DictionaryTransport is implemented by transports that frame messages with
+// protocol.Codec. Sessions on these transports offer
+// protocol.CapabilityDictionary.
+type DictionaryTransport interface {
+	Transport
+
+	// UseDictionary starts compressing small messages against
+	// protocol.Dictionary; it may be called from any goroutine
+	UseDictionary()
+}
+
+// wsTransport carries JSON messages over a WebSocket connection
+type wsTransport struct {
+	conn      *websocket.Conn
+	lastPong  atomic.Int64 // unix nanoseconds
+	closeOnce sync.Once
+	buf       []byte // reused by WriteMessage
+}
+
+// NewWebSocketTransport wraps an upgraded WebSocket connection
+func NewWebSocketTransport(conn *websocket.Conn) Transport {
+	t := &wsTransport{conn: conn}
+	t.lastPong.Store(time.Now().UnixNano())
+
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		t.lastPong.Store(time.Now().UnixNano())
+		conn.SetReadDeadline(time.Now().Add(pongTimeout))
+		return nil
+	})
+
+	return t
+}
+
+func (t *wsTransport) ReadMessage() (*protocol.Message, error) {
+	var msg protocol.Message
+	if err := t.conn.ReadJSON(&msg); err != nil {
+		if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (t *wsTransport) WriteMessage(msg *protocol.Message) error {
+	buf, err := msg.AppendJSON(t.buf[:0])
+	if err != nil {
+		return err
+	}
+	// Newline-terminated, as WriteJSON wrote them
+	t.buf = append(buf, '\n')
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return t.conn.WriteMessage(websocket.TextMessage, t.buf)
+}
+
+func (t *wsTransport) WriteBinary(data []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return t.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (t *wsTransport) LastHeartbeat() time.Time {
+	return time.Unix(0, t.lastPong.Load())
+}
+
+func (t *wsTransport) Keepalive() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t *wsTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		t.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		err = t.conn.Close()
+	})
+	return err
+}
+
+// errTransportClosed is returned by writes to a closed transport
+var errTransportClosed = errors.New("transport closed")
+
+// ServerOption configures the HTTP fallback, WebTransport and gRPC servers
+type ServerOption func(*serverConfig)
+
+type serverConfig struct {
+	limiter      *ConnLimiter
+	authenticate Authenticator
+}
+
+// Authenticator checks the bearer token a client presents when it starts a
+// session and returns what the token grants. A nil Authenticator accepts
+// every client.
+type Authenticator func(token string) (Grant, error)
+
+// Grant identifies the token a session was authorized with, so the session
+// can be ended if the token is revoked or expires, and the user it was
+// issued to
+type Grant struct {
+	TokenID   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Subject   string
+	ReadOnly  bool // the session may not change the workspace
+}
+
+// WithConnLimiter caps the sessions a server accepts. Share one limiter
+// across servers to enforce gateway-wide limits.
+func WithConnLimiter(limiter *ConnLimiter) ServerOption {
+	return func(c *serverConfig) {
+		c.limiter = limiter
+	}
+}
+
+// WithAuthenticator requires clients to present a token accepted by authenticate
+func WithAuthenticator(authenticate Authenticator) ServerOption {
+	return func(c *serverConfig) {
+		c.authenticate = authenticate
+	}
+}
+
+func newServerConfig(opts []ServerOption) serverConfig {
+	var c serverConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// check runs the authenticator, if any
+func (a Authenticator) check(token string) (Grant, error) {
+	if a == nil {
+		return Grant{}, nil
+	}
+	return a(token)
+}
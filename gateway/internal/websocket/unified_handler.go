@@ -3,34 +3,86 @@ package websocket
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/devtail/gateway/internal/chat"
 	"github.com/devtail/gateway/internal/queue"
 	"github.com/devtail/gateway/internal/terminal"
 	"github.com/devtail/gateway/pkg/protocol"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 // UnifiedHandler handles both chat and terminal messages
 type UnifiedHandler struct {
-	conn            *websocket.Conn
+	transport       Transport
 	queue           *queue.MessageQueue
 	sessionID       string
 	send            chan *protocol.Message
 	chatHandler     ChatHandler
 	terminalHandler *terminal.Handler
 	
-	// Terminal output channels
-	terminalOutputs map[string]chan *protocol.Message
-	terminalMu      sync.RWMutex
+	// Terminals this connection receives output from
+	terminals       *terminalRegistry
+	
+	// Session tracking and queue health
+	sessions        *SessionRegistry
+	staleAfter      time.Duration
+	staleReported   bool // only accessed by retryPump
+	
+	// Recently received message IDs, for dropping client retransmissions
+	dedup           *queue.Deduplicator
+	dedupWindow     time.Duration
+	
+	// Token the session was authorized with, and the final message sent
+	// when the session is ended by the gateway
+	grant           Grant
+	terminate       chan *protocol.Message
+	
+	// Session expiry, see WithMaxLifetime and WithTokenExpiry
+	maxLifetime     time.Duration
+	reauthenticate  Authenticator
+	renewed         chan struct{}
+	
+	// Who is connected, the session's timeline and the reason it ended
+	client          ClientInfo
+	connectedAt     time.Time
+	participantID   string // shown to other participants instead of the session ID
+	timelines       *TimelineStore
+	timeline        *timeline
+	diagnostics     func(ctx context.Context) protocol.Diagnostics
+	chatConfig      func(change protocol.ChatConfig) (protocol.ChatConfigStatus, error)
+	workspaces      func() []protocol.Workspace
+	fileChanges     func() (<-chan protocol.WorkspaceFileChanged, func())
+	backups         func(ctx context.Context, workspace string) (protocol.WorkspaceBackup, error)
+	chatExport      func(ctx context.Context, export protocol.ChatExport) (protocol.ChatTranscript, error)
+	mailboxes       *queue.Mailboxes
+	plans           *Plans
+	tasks           TaskRunner
+	guardrails      *Guardrails
+	env             sessionEnv
+	endReason       string
+	endOnce         sync.Once
+	reaped          atomic.Bool
+	log             zerolog.Logger
 	
 	// State
 	mu              sync.RWMutex
 	lastActivity    time.Time
+	version         int // negotiated protocol version
+	capabilities    map[protocol.Capability]bool // negotiated in the hello
+	granularity     string // how chat replies are sliced, chosen in the hello
+	readOnly        bool   // set by WithReadOnly or asked for in the hello
+	presence        protocol.PresenceUpdate
+	frameBuf        []byte // binary terminal frames, only used by writePump
 	ctx             context.Context
 	cancel          context.CancelFunc
 }
@@ -40,69 +92,282 @@ type TerminalHandler interface {
 	HandleTerminalMessage(ctx context.Context, msg *protocol.Message) (<-chan *protocol.Message, error)
 }
 
+// UnifiedHandlerOption configures the handler
+type UnifiedHandlerOption func(*UnifiedHandler)
+
+// WithSessionRegistry registers the connection with r while it is running
+func WithSessionRegistry(r *SessionRegistry) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.sessions = r
+	}
+}
+
+// WithStaleAckThreshold sets how long a message may go unacknowledged before
+// the session is reported as stale. Zero disables staleness alerts.
+func WithStaleAckThreshold(d time.Duration) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.staleAfter = d
+	}
+}
+
+// WithDedupWindow sets how long inbound message IDs are remembered for
+// duplicate detection. Zero disables deduplication.
+func WithDedupWindow(d time.Duration) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.dedupWindow = d
+	}
+}
+
+// WithGrant records the token the session was authorized with
+func WithGrant(g Grant) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.grant = g
+	}
+}
+
+// WithClient describes the client end of the session for logs and its
+// timeline
+func WithClient(c ClientInfo) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.client = c
+	}
+}
+
+// WithTimelines records the session's timeline in s
+func WithTimelines(s *TimelineStore) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.timelines = s
+	}
+}
+
+// WithDiagnostics answers diagnostics requests with fn
+func WithDiagnostics(fn func(ctx context.Context) protocol.Diagnostics) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.diagnostics = fn
+	}
+}
+
+// WithChatConfig lets clients change the chat backend with chat_config
+// messages, applied by fn
+func WithChatConfig(fn func(change protocol.ChatConfig) (protocol.ChatConfigStatus, error)) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.chatConfig = fn
+	}
+}
+
+// WithWorkspaces answers workspaces requests with the list fn returns
+func WithWorkspaces(fn func() []protocol.Workspace) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.workspaces = fn
+	}
+}
+
+// WithFileChanges pushes workspace_file_changed messages to the client for
+// every change on the subscription subscribe returns
+func WithFileChanges(subscribe func() (<-chan protocol.WorkspaceFileChanged, func())) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.fileChanges = subscribe
+	}
+}
+
+// WithBackups answers workspace_backup requests by backing up the named
+// workspace with fn
+func WithBackups(fn func(ctx context.Context, workspace string) (protocol.WorkspaceBackup, error)) UnifiedHandlerOption {
+	return func(h *UnifiedHandler) {
+		h.backups = fn
+	}
+}
+
 // NewUnifiedHandler creates a handler that supports both chat and terminal
-func NewUnifiedHandler(conn *websocket.Conn, chatHandler ChatHandler, terminalManager *terminal.Manager) *UnifiedHandler {
+func NewUnifiedHandler(conn *websocket.Conn, chatHandler ChatHandler, terminalManager *terminal.Manager, opts ...UnifiedHandlerOption) *UnifiedHandler {
+	return NewTransportHandler(NewWebSocketTransport(conn), chatHandler, terminalManager, opts...)
+}
+
+// NewTransportHandler creates a unified handler speaking the gateway protocol
+// over any transport, such as the HTTP fallback
+func NewTransportHandler(transport Transport, chatHandler ChatHandler, terminalManager *terminal.Manager, opts ...UnifiedHandlerOption) *UnifiedHandler {
 	ctx, cancel := context.WithCancel(context.Background())
+	terminalHandler := terminal.NewHandler(terminalManager)
 	
-	return &UnifiedHandler{
-		conn:            conn,
+	h := &UnifiedHandler{
+		transport:       transport,
 		queue:           queue.NewMessageQueue(1000, 3, 30*time.Second),
 		sessionID:       uuid.New().String(),
 		send:            make(chan *protocol.Message, 256),
 		chatHandler:     chatHandler,
-		terminalHandler: terminal.NewHandler(terminalManager),
-		terminalOutputs: make(map[string]chan *protocol.Message),
+		terminalHandler: terminalHandler,
+		terminals:       newTerminalRegistry(terminalHandler.StreamOutput),
+		staleAfter:      staleAckThreshold,
+		dedupWindow:     defaultDedupWindow,
 		lastActivity:    time.Now(),
+		connectedAt:     time.Now(),
+		participantID:   uuid.New().String(),
+		version:         protocol.Version1,
+		granularity:     protocol.GranularityToken,
+		terminate:       make(chan *protocol.Message, 1),
+		renewed:         make(chan struct{}, 1),
 		ctx:             ctx,
 		cancel:          cancel,
 	}
+	
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.dedup = queue.NewDeduplicator(h.dedupWindow)
+	if h.plans == nil {
+		h.plans = NewPlans()
+	}
+	
+	// Every line about this connection carries the session and client
+	logCtx := log.With().Str("session_id", h.sessionID).Str("transport", h.client.Transport)
+	if h.client.RemoteAddr != "" {
+		logCtx = logCtx.Str("remote", h.client.RemoteAddr)
+	}
+	h.log = logCtx.Logger()
+	
+	return h
 }
 
 func (h *UnifiedHandler) Run() {
+	var (
+		announcements []protocol.Announcement
+		suspension    *protocol.SuspendScheduled
+	)
+	if h.sessions != nil {
+		announcements, suspension = h.sessions.add(h)
+		defer h.sessions.remove(h)
+	}
+	
+	if h.timelines != nil {
+		h.timeline = h.timelines.start(h.sessionID, h.grant.Subject, h.client)
+		defer func() { h.timelines.finish(h.timeline, h.endReason) }()
+	}
+	h.timeline.record(EventConnected, "transport", h.client.Transport, "remote", h.client.RemoteAddr)
+	if h.grant.TokenID != "" {
+		h.timeline.record(EventAuthenticated, "token_id", h.grant.TokenID)
+	}
+	
 	go h.writePump()
 	go h.readPump()
 	go h.retryPump()
+	if h.fileChanges != nil {
+		go h.forwardFileChanges()
+	}
+	if h.maxLifetime > 0 || h.reauthenticate != nil {
+		go h.watchExpiry()
+	}
+	for _, a := range announcements {
+		h.Announce(a)
+	}
+	if suspension != nil {
+		h.WarnSuspend(*suspension)
+	}
+	h.sharePresence(protocol.PresenceJoined)
 	
 	<-h.ctx.Done()
+	h.keepUnacked()
 	
-	// Cleanup terminal outputs
-	h.terminalMu.Lock()
-	for _, ch := range h.terminalOutputs {
-		close(ch)
-	}
-	h.terminalMu.Unlock()
+	// Stop streaming terminal output; the terminals themselves keep running
+	// so the client can attach again after reconnecting
+	h.terminals.closeAll()
+	h.end("connection closed")
+	h.sharePresence(protocol.PresenceLeft)
+}
+
+// end records why the session is ending; the first reason wins, since later
+// ones are consequences of it
+func (h *UnifiedHandler) end(reason string) {
+	h.endOnce.Do(func() {
+		h.endReason = reason
+	})
 }
 
 func (h *UnifiedHandler) readPump() {
 	defer h.cancel()
-	
-	h.conn.SetReadLimit(maxMessageSize)
-	h.conn.SetReadDeadline(time.Now().Add(pongTimeout))
-	h.conn.SetPongHandler(func(string) error {
-		h.conn.SetReadDeadline(time.Now().Add(pongTimeout))
-		return nil
-	})
 
 	for {
-		var msg protocol.Message
-		err := h.conn.ReadJSON(&msg)
+		msg, err := h.transport.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Error().Err(err).Msg("websocket read error")
+			if err != io.EOF {
+				h.log.Error().Err(err).Msg("read error")
+				h.end("read error: " + err.Error())
+			} else {
+				h.end("client closed the connection")
 			}
 			return
 		}
 
 		h.updateActivity()
-		h.routeMessage(&msg)
+		msg = protocol.Upgrade(msg, h.protocolVersion())
+		if h.isDuplicate(msg) {
+			continue
+		}
+		if msg.RequiresAck {
+			h.sendAck(msg)
+		}
+		h.routeMessage(msg)
 	}
 }
 
+// isDuplicate reports whether msg is a retransmission of a message already
+// received. Duplicates are acknowledged again so the client stops retrying.
+func (h *UnifiedHandler) isDuplicate(msg *protocol.Message) bool {
+	// Keepalives and acks are idempotent
+	switch msg.Type {
+	case protocol.TypePing, protocol.TypeAck:
+		return false
+	}
+	
+	if !h.dedup.Seen(msg.ID) {
+		return false
+	}
+	
+	h.log.Debug().
+		Str("id", msg.ID).
+		Str("type", string(msg.Type)).
+		Msg("dropping duplicate message")
+	
+	h.sendAck(msg)
+	return true
+}
+
+func (h *UnifiedHandler) sendAck(msg *protocol.Message) {
+	payload, _ := json.Marshal(protocol.AckMessage{
+		MessageID: msg.ID,
+		SeqNum:    msg.SeqNum,
+	})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeAck,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
 func (h *UnifiedHandler) routeMessage(msg *protocol.Message) {
+	if h.refuseWrite(msg) {
+		return
+	}
+
+	// Someone is using the VM, so it must not be suspended under them
+	switch msg.Type {
+	case protocol.TypeChat, protocol.TypeChatRegenerate, protocol.TypeChatBranch, protocol.TypeChatPlanDecision, protocol.TypeTaskSubmit, protocol.TypeCommandDecision, "terminal_input":
+		h.keepAlive(protocol.SuspendCancelledActivity)
+	}
+
 	// Route based on message type prefix
 	switch {
 	case msg.Type == protocol.TypeChat:
 		h.handleChat(msg)
+	case msg.Type == protocol.TypeChatRegenerate, msg.Type == protocol.TypeChatBranch:
+		h.handleChatBranch(msg)
+	case msg.Type == protocol.TypeChatPlanDecision:
+		h.handlePlanDecision(msg)
+	case msg.Type == protocol.TypeCommandDecision:
+		h.handleCommandDecision(msg)
+	case strings.HasPrefix(string(msg.Type), "task_"):
+		h.handleTask(msg)
 	case strings.HasPrefix(string(msg.Type), "terminal_"):
 		h.handleTerminal(msg)
 	case msg.Type == protocol.TypePing:
@@ -111,8 +376,32 @@ func (h *UnifiedHandler) routeMessage(msg *protocol.Message) {
 		h.handleReconnect(msg)
 	case msg.Type == protocol.TypeAck:
 		h.handleAck(msg)
+	case msg.Type == protocol.TypeQueueStats:
+		h.sendQueueStats(msg)
+	case msg.Type == protocol.TypeHello:
+		h.handleHello(msg)
+	case msg.Type == protocol.TypeReauth:
+		h.handleReauth(msg)
+	case msg.Type == protocol.TypeKeepAlive:
+		h.keepAlive(protocol.SuspendCancelledKeepAlive)
+	case msg.Type == protocol.TypeDiagnostics:
+		h.handleDiagnostics(msg)
+	case msg.Type == protocol.TypeChatConfig:
+		h.handleChatConfig(msg)
+	case msg.Type == protocol.TypeWorkspaces:
+		h.handleWorkspaces(msg)
+	case msg.Type == protocol.TypeWorkspaceBackup:
+		h.handleWorkspaceBackup(msg)
+	case msg.Type == protocol.TypeEnvSet, msg.Type == protocol.TypeEnvUnset, msg.Type == protocol.TypeEnvList:
+		h.handleEnv(msg)
+	case msg.Type == protocol.TypeParticipants:
+		h.handleParticipants(msg)
+	case msg.Type == protocol.TypePresence:
+		h.handlePresence(msg)
+	case msg.Type == protocol.TypeChatExport:
+		h.handleChatExport(msg)
 	default:
-		log.Warn().
+		h.log.Warn().
 			Str("type", string(msg.Type)).
 			Str("id", msg.ID).
 			Msg("unknown message type")
@@ -125,152 +414,362 @@ func (h *UnifiedHandler) handleChat(msg *protocol.Message) {
 		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
 		return
 	}
+	h.vetCommand(msg, protocol.CommandSourceChat, chatMsg.Content, func() { h.startChat(msg, &chatMsg) })
+}
 
-	h.queue.Enqueue(msg)
+// handleChatBranch turns chat_regenerate and chat_branch into the chat
+// message that asks the backend for them; the reply streams as a chat's
+func (h *UnifiedHandler) handleChatBranch(msg *protocol.Message) {
+	var chatMsg protocol.ChatMessage
+	if msg.Type == protocol.TypeChatRegenerate {
+		var regenerate protocol.ChatRegenerate
+		if err := json.Unmarshal(msg.Payload, &regenerate); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		chatMsg = protocol.ChatMessage{Role: "user", Workspace: regenerate.Workspace, WorkDir: regenerate.WorkDir,
+			BranchFrom: regenerate.MessageID, Regenerate: true}
+	} else {
+		var branch protocol.ChatBranch
+		if err := json.Unmarshal(msg.Payload, &branch); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+		if branch.MessageID == "" || branch.Content == "" {
+			h.sendError(msg.ID, "invalid_payload", "message_id and content are required", false)
+			return
+		}
+		chatMsg = protocol.ChatMessage{Role: "user", Content: branch.Content, Workspace: branch.Workspace, WorkDir: branch.WorkDir,
+			BranchFrom: branch.MessageID}
+	}
+	h.vetCommand(msg, protocol.CommandSourceChat, chatMsg.Content, func() { h.startChat(msg, &chatMsg) })
+}
 
-	replies, err := h.chatHandler.HandleChatMessage(h.ctx, &chatMsg)
+// startChat sends chatMsg to the backend and streams its reply to the
+// client, correlated with msg, and shows both to the collaborators
+func (h *UnifiedHandler) startChat(msg *protocol.Message, chatMsg *protocol.ChatMessage) {
+	chatMsg.Author = h.user()
+	h.updatePresence(func(p *protocol.PresenceUpdate) { p.Typing = false })
+	// A long reply keeps going when the client disconnects, so it is
+	// finished when the user comes back
+	ctx := context.WithoutCancel(h.ctx)
+	var decisions chan protocol.ChatPlanDecision
+	if h.supports(protocol.CapabilityChatPlans) {
+		decisions = make(chan protocol.ChatPlanDecision, 1)
+		ctx = chat.WithPlanDecisions(ctx, decisions)
+	}
+	replies, err := h.chatHandler.HandleChatMessage(ctx, chatMsg)
 	if err != nil {
+		// Backend errors that describe themselves keep their code and cause
+		var clientErr clientError
+		if errors.As(err, &clientErr) {
+			h.sendErrorPayload(msg.ID, clientErr.ClientError())
+			return
+		}
 		h.sendError(msg.ID, "chat_error", err.Error(), true)
-		h.queue.Ack(msg.ID)
 		return
 	}
+	h.timeline.record(EventChatStarted, "message_id", msg.ID)
+	share := h.shareChat(msg.ID, chatMsg)
 
 	go func() {
+		// Collaborators see the whole reply once it is finished
+		var shared protocol.ChatShared
+		var content strings.Builder
+		if share != nil {
+			defer func() {
+				shared.Content = content.String()
+				share(shared)
+			}()
+		}
+
+		// Once the client is gone replies are kept in the session's
+		// mailbox, or without one still read to the end so the backend is
+		// not left blocked
+		gone := false
+		chunker := chat.NewChunker(h.streamGranularity())
+		extractor := chat.NewCodeExtractor()
+		var blocks []protocol.CodeBlock // parsed, waiting for a part to go with
+		send := func(m *protocol.Message, reliable bool) {
+			if !h.deliverOrKeep(m, reliable) {
+				gone = true
+			}
+		}
 		for reply := range replies {
-			replyData, _ := json.Marshal(reply)
-			h.send <- &protocol.Message{
-				ID:        uuid.New().String(),
-				Type:      protocol.TypeChatStream,
-				Timestamp: time.Now(),
-				Payload:   replyData,
+			if share != nil {
+				content.WriteString(reply.Content)
+				if reply.Error != nil {
+					shared.Error = reply.Error.Error
+				}
+				if reply.Finished {
+					shared.MessageID = reply.MessageID
+				}
 			}
-			
+			if gone {
+				continue
+			}
+			if reply.Error != nil {
+				h.deliverOrKeep(h.errorMessage(msg.ID, *reply.Error), false)
+				return
+			}
+			if reply.Queued != nil {
+				// Positions are superseded by the next one, so losing one
+				// does not matter
+				queuedData, _ := json.Marshal(reply.Queued)
+				if !h.deliver(&protocol.Message{
+					ID:            uuid.New().String(),
+					Type:          protocol.TypeChatQueued,
+					Timestamp:     time.Now(),
+					Payload:       queuedData,
+					CorrelationID: msg.ID,
+				}) && h.mailboxes == nil {
+					gone = true
+				}
+				continue
+			}
+			if reply.Plan != nil {
+				// Waits for a chat_plan_decision, from this connection or
+				// the one resuming the session
+				defer h.plans.remove(reply.Plan.ID)
+				send(h.planMessage(msg.ID, reply.Plan, decisions), true)
+				continue
+			}
+			if reply.Recovery != nil {
+				h.timeline.record(EventBackendRecovery, "phase", reply.Recovery.Phase, "error_type", reply.Recovery.ErrorType)
+				recoveryData, _ := json.Marshal(reply.Recovery)
+				// The client must not be left showing a restart that ended
+				send(&protocol.Message{
+					ID:            uuid.New().String(),
+					Type:          reply.Recovery.MessageType(),
+					Timestamp:     time.Now(),
+					Payload:       recoveryData,
+					CorrelationID: msg.ID,
+				}, true)
+				continue
+			}
+
+			chunks := chunker.Add(reply.Content)
+			blocks = append(blocks, extractor.Add(reply.Content)...)
+			var final chat.Chunk
 			if reply.Finished {
-				h.queue.Ack(msg.ID)
-				break
+				// Text held back for a sentence, paragraph or code block to
+				// end goes out with the final reply
+				if final = chunker.Flush(); final.Text == "" && len(chunks) > 0 {
+					final, chunks = chunks[len(chunks)-1], chunks[:len(chunks)-1]
+				}
+				blocks = append(blocks, extractor.Flush()...)
 			}
+			for i, chunk := range chunks {
+				part := protocol.ChatReply{Content: chunk.Text, Block: chunk.Block}
+				if i == len(chunks)-1 {
+					part.CodeBlocks, blocks = blocks, nil
+				}
+				send(h.streamMessage(msg.ID, part), false)
+			}
+			if !reply.Finished {
+				continue
+			}
+			
+			// Losing a token is cosmetic, losing the final reply leaves the
+			// client waiting forever
+			send(h.streamMessage(msg.ID, protocol.ChatReply{Content: final.Text, Block: final.Block, Finished: true, CodeBlocks: blocks,
+				MessageID: reply.MessageID}), true)
+			break
 		}
 	}()
 }
 
+// streamMessage wraps part of the reply to the chat message with ID
+// correlationID
+func (h *UnifiedHandler) streamMessage(correlationID string, reply protocol.ChatReply) *protocol.Message {
+	return &protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeChatStream,
+		Timestamp:     time.Now(),
+		Payload:       reply.AppendJSON(nil),
+		CorrelationID: correlationID,
+	}
+}
+
 func (h *UnifiedHandler) handleTerminal(msg *protocol.Message) {
-	replies, err := h.terminalHandler.HandleTerminalMessage(h.ctx, msg)
+	switch msg.Type {
+	case "terminal_create":
+		msg = h.withSessionEnv(msg)
+	case "terminal_input":
+		terminalID := terminalIDFromPayload(msg.Payload)
+		h.updatePresence(func(p *protocol.PresenceUpdate) { p.ActiveTerminal = terminalID })
+	}
+
+	replies, err := h.terminalHandler.HandleTerminalMessage(terminal.WithParticipant(terminal.WithUser(h.ctx, h.user()), h.participantID), msg)
 	if err != nil {
 		h.sendError(msg.ID, "terminal_error", err.Error(), false)
 		return
 	}
 
-	// Handle terminal creation specially to set up output streaming
-	if msg.Type == "terminal_create" {
-		go h.handleTerminalOutput(msg.ID, replies)
-	} else {
-		// For other terminal messages, just forward the replies
-		go func() {
-			for reply := range replies {
-				select {
-				case h.send <- reply:
-				case <-h.ctx.Done():
-					return
-				}
+	go func() {
+		// Stop output before acknowledging the detach
+		if msg.Type == "terminal_detach" {
+			terminalID := terminalIDFromPayload(msg.Payload)
+			h.terminals.detach(terminalID)
+			h.timeline.record(EventTerminalDetached, "terminal_id", terminalID)
+		}
+		
+		for reply := range replies {
+			send := h.deliver
+			if requiresAck(reply) {
+				send = h.deliverReliable
 			}
-		}()
-	}
-}
-
-func (h *UnifiedHandler) handleTerminalOutput(correlationID string, replies <-chan *protocol.Message) {
-	// Create a dedicated channel for this terminal's output
-	outputChan := make(chan *protocol.Message, 100)
-	
-	// Store the channel
-	h.terminalMu.Lock()
-	h.terminalOutputs[correlationID] = outputChan
-	h.terminalMu.Unlock()
-	
-	defer func() {
-		h.terminalMu.Lock()
-		delete(h.terminalOutputs, correlationID)
-		h.terminalMu.Unlock()
-		close(outputChan)
-	}()
-	
-	// Forward replies and watch for terminal ID
-	var terminalID string
-	for reply := range replies {
-		// Extract terminal ID from creation response
-		if reply.Type == "terminal_created" {
-			var resp struct {
-				TerminalID string `json:"terminal_id"`
+			if !send(reply) {
+				return
 			}
-			if err := json.Unmarshal(reply.Payload, &resp); err == nil {
-				terminalID = resp.TerminalID
+			
+			// Output starts streaming once the client knows the terminal ID
+			switch reply.Type {
+			case "terminal_created":
+				terminalID := terminalIDFromPayload(reply.Payload)
+				h.timeline.record(EventTerminalOpened, "terminal_id", terminalID)
+				h.attachTerminal(terminalID)
+			case "terminal_attached":
+				terminalID := terminalIDFromPayload(reply.Payload)
+				h.timeline.record(EventTerminalAttached, "terminal_id", terminalID)
+				h.attachTerminal(terminalID)
 			}
 		}
-		
-		// Forward the reply
-		select {
-		case h.send <- reply:
-		case <-h.ctx.Done():
-			return
-		}
-		
-		// For output messages, continue streaming
-		if reply.Type == "terminal_output" && terminalID != "" {
-			// This goroutine will continue receiving output
-			continue
-		}
+	}()
+}
+
+func (h *UnifiedHandler) attachTerminal(terminalID string) {
+	if terminalID == "" {
+		return
 	}
 	
-	// Continue streaming output for this terminal
-	if terminalID != "" {
-		for {
-			select {
-			case output := <-outputChan:
-				select {
-				case h.send <- output:
-				case <-h.ctx.Done():
-					return
-				}
-			case <-h.ctx.Done():
-				return
-			}
-		}
+	if err := h.terminals.attach(h.ctx, terminalID, h.deliver, h.sendTerminalExit); err != nil {
+		h.log.Error().Err(err).Str("terminal_id", terminalID).Msg("failed to attach terminal output")
 	}
 }
 
+func (h *UnifiedHandler) sendTerminalExit(terminalID string) {
+	h.timeline.record(EventTerminalExited, "terminal_id", terminalID)
+	payload, _ := json.Marshal(terminal.TerminalExitMessage{TerminalID: terminalID})
+	h.deliverOrKeep(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      "terminal_exit",
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}, true)
+}
+
+// deliver queues a message for the client, reporting false once the
+// connection is shutting down
+func (h *UnifiedHandler) deliver(msg *protocol.Message) bool {
+	select {
+	case h.send <- msg:
+		return true
+	case <-h.ctx.Done():
+		return false
+	}
+}
+
+// ackRequired lists the terminal handler replies that the gateway
+// retransmits until the client acknowledges them
+var ackRequired = map[protocol.MessageType]bool{
+	"terminal_created": true,
+}
+
+func requiresAck(msg *protocol.Message) bool {
+	return ackRequired[msg.Type]
+}
+
+// deliverReliable sends a message the client must acknowledge. The queue
+// retransmits it until the ack arrives, and replays it after a reconnect.
+func (h *UnifiedHandler) deliverReliable(msg *protocol.Message) bool {
+	msg.RequiresAck = true
+	h.queue.Track(msg)
+	return h.deliver(msg)
+}
+
+func terminalIDFromPayload(payload json.RawMessage) string {
+	var ref struct {
+		TerminalID string `json:"terminal_id"`
+	}
+	if err := json.Unmarshal(payload, &ref); err != nil {
+		return ""
+	}
+	return ref.TerminalID
+}
+
 func (h *UnifiedHandler) writePump() {
 	ticker := time.NewTicker(pingInterval)
 	defer func() {
 		ticker.Stop()
-		h.conn.Close()
+		h.transport.Close()
 		h.cancel()
 	}()
 
 	for {
 		select {
 		case message, ok := <-h.send:
-			h.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 			if !ok {
-				h.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			if err := h.conn.WriteJSON(message); err != nil {
-				log.Error().Err(err).Msg("write error")
+			message, ok = protocol.Downgrade(message, h.protocolVersion())
+			if !ok {
+				continue
+			}
+			if err := h.write(message); err != nil {
+				h.log.Error().Err(err).Msg("write error")
+				h.end("write error: " + err.Error())
 				return
 			}
 
 		case <-ticker.C:
-			h.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			if err := h.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := h.transport.Keepalive(); err != nil {
+				h.end("keepalive failed: " + err.Error())
 				return
 			}
 
+		case message := <-h.terminate:
+			if message, ok := protocol.Downgrade(message, h.protocolVersion()); ok {
+				h.transport.WriteMessage(message)
+			}
+			return
+
 		case <-h.ctx.Done():
 			return
 		}
 	}
 }
 
+// write sends one message, as a binary frame if it is terminal output and
+// the client asked for those
+func (h *UnifiedHandler) write(msg *protocol.Message) error {
+	if msg.Type == "terminal_output" && h.supports(protocol.CapabilityBinaryTerminal) {
+		if frame, ok := binaryTerminalFrame(h.frameBuf[:0], msg); ok {
+			// Transports copy the frame, so its buffer is reused
+			h.frameBuf = frame[:0]
+			return h.transport.(BinaryTransport).WriteBinary(frame)
+		}
+	}
+	return h.transport.WriteMessage(msg)
+}
+
+// binaryTerminalFrame appends the binary frame for a terminal_output message
+// to dst, reporting false if the payload cannot be converted
+func binaryTerminalFrame(dst []byte, msg *protocol.Message) ([]byte, bool) {
+	// encoding/json decodes base64 straight into a byte slice
+	var output struct {
+		TerminalID string `json:"terminal_id"`
+		Data       []byte `json:"data"`
+		Stderr     bool   `json:"stderr"`
+	}
+	if err := json.Unmarshal(msg.Payload, &output); err != nil || output.Stderr {
+		return nil, false
+	}
+	frame, err := protocol.AppendTerminalFrame(dst, output.TerminalID, output.Data)
+	return frame, err == nil
+}
+
 func (h *UnifiedHandler) retryPump() {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -286,12 +785,50 @@ func (h *UnifiedHandler) retryPump() {
 					return
 				}
 			}
+			h.checkStaleness()
 		case <-h.ctx.Done():
 			return
 		}
 	}
 }
 
+// checkStaleness logs once when the client stops acknowledging messages and
+// again when it recovers
+func (h *UnifiedHandler) checkStaleness() {
+	stats := h.QueueStats()
+	
+	switch {
+	case stats.Stale && !h.staleReported:
+		h.staleReported = true
+		h.timeline.record(EventStale, "in_flight", strconv.Itoa(stats.InFlight))
+		h.log.Warn().
+			Int("in_flight", stats.InFlight).
+			Int64("oldest_in_flight_ms", stats.OldestInFlightMs).
+			Uint64("retries", stats.Retries).
+			Msg("client stopped acknowledging messages")
+	case !stats.Stale && h.staleReported:
+		h.staleReported = false
+		h.timeline.record(EventRecovered)
+		h.log.Info().Msg("client acknowledging messages again")
+	}
+}
+
+// QueueStats returns the current health of this session's message queue
+func (h *UnifiedHandler) QueueStats() protocol.QueueStats {
+	return newQueueStats(h.sessionID, h.queue.Stats(), h.staleAfter)
+}
+
+func (h *UnifiedHandler) sendQueueStats(msg *protocol.Message) {
+	payload, _ := json.Marshal(h.QueueStats())
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeQueueStats,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
 // Reuse existing helper methods
 func (h *UnifiedHandler) handleReconnect(msg *protocol.Message) {
 	var reconnect protocol.ReconnectMessage
@@ -299,11 +836,14 @@ func (h *UnifiedHandler) handleReconnect(msg *protocol.Message) {
 		return
 	}
 
+	// A client back on a new connection picks up what its old session kept
 	if reconnect.SessionID != h.sessionID {
+		h.resume(reconnect.SessionID)
 		return
 	}
 
 	messages := h.queue.GetMessagesAfter(reconnect.LastSeqNum)
+	h.timeline.record(EventResumed, "replayed", strconv.Itoa(len(messages)))
 	for _, m := range messages {
 		select {
 		case h.send <- m:
@@ -313,6 +853,236 @@ func (h *UnifiedHandler) handleReconnect(msg *protocol.Message) {
 	}
 }
 
+// handleHello settles the protocol version for the rest of the session.
+// Clients too old to convert for are told why and disconnected.
+func (h *UnifiedHandler) handleHello(msg *protocol.Message) {
+	var hello protocol.Hello
+	if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+
+	version, err := protocol.NegotiateVersion(hello.ProtocolVersion)
+	if err != nil {
+		h.log.Warn().Int("protocol_version", hello.ProtocolVersion).Str("client", hello.Client).Msg("unsupported protocol version")
+		errData, _ := json.Marshal(protocol.ChatError{Error: err.Error(), Code: "unsupported_version"})
+		select {
+		case h.terminate <- &protocol.Message{ID: msg.ID, Type: protocol.TypeChatError, Timestamp: time.Now(), Payload: errData}:
+			h.timeline.record(EventError, "code", "unsupported_version", "message", err.Error())
+			h.end("unsupported protocol version")
+		default:
+		}
+		return
+	}
+
+	agreed := protocol.NegotiateCapabilities(hello.Capabilities, h.offeredCapabilities())
+	capabilities := make(map[protocol.Capability]bool, len(agreed))
+	names := make([]string, len(agreed))
+	for i, c := range agreed {
+		capabilities[c] = true
+		names[i] = string(c)
+	}
+
+	granularity := chat.Granularity(hello.StreamGranularity)
+
+	h.mu.Lock()
+	h.version = version
+	h.capabilities = capabilities
+	h.granularity = granularity
+	h.readOnly = h.readOnly || hello.ReadOnly
+	h.mu.Unlock()
+	if capabilities[protocol.CapabilityDictionary] {
+		h.transport.(DictionaryTransport).UseDictionary()
+	}
+	h.timeline.record(EventHello, "protocol_version", strconv.Itoa(version), "client", hello.Client,
+		"capabilities", strings.Join(names, ","), "stream_granularity", granularity)
+
+	payload, _ := json.Marshal(protocol.Hello{
+		ProtocolVersion:   version,
+		MinVersion:        protocol.MinVersion,
+		MaxVersion:        protocol.CurrentVersion,
+		SessionID:         h.sessionID,
+		Capabilities:      agreed,
+		StreamGranularity: granularity,
+		ReadOnly:          h.isReadOnly(),
+	})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeHello,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// handleDiagnostics reports the gateway's self-check. Checks can take
+// seconds, so they run off the read loop.
+func (h *UnifiedHandler) handleDiagnostics(msg *protocol.Message) {
+	if h.diagnostics == nil {
+		h.sendError(msg.ID, "diagnostics_unavailable", "this gateway does not run diagnostics", false)
+		return
+	}
+
+	go func() {
+		payload, _ := json.Marshal(h.diagnostics(h.ctx))
+		h.deliver(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypeDiagnostics,
+			Timestamp:     time.Now(),
+			Payload:       payload,
+			CorrelationID: msg.ID,
+		})
+	}()
+}
+
+// handleChatConfig changes the chat backend. Chats already streaming finish
+// on the old backend.
+func (h *UnifiedHandler) handleChatConfig(msg *protocol.Message) {
+	if h.chatConfig == nil {
+		h.sendError(msg.ID, "config_unavailable", "this gateway does not accept chat configuration", false)
+		return
+	}
+
+	var change protocol.ChatConfig
+	if err := json.Unmarshal(msg.Payload, &change); err != nil {
+		h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+		return
+	}
+
+	status, err := h.chatConfig(change)
+	if err != nil {
+		h.sendError(msg.ID, "invalid_config", err.Error(), false)
+		return
+	}
+
+	payload, _ := json.Marshal(status)
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeChatConfig,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// forwardFileChanges tells the client about changed workspace files until
+// the session ends
+func (h *UnifiedHandler) forwardFileChanges() {
+	changes, unsubscribe := h.fileChanges()
+	defer unsubscribe()
+
+	for {
+		select {
+		case change := <-changes:
+			payload, _ := json.Marshal(change)
+			if !h.deliver(&protocol.Message{
+				ID:        uuid.New().String(),
+				Type:      protocol.TypeWorkspaceFileChanged,
+				Timestamp: time.Now(),
+				Payload:   payload,
+			}) {
+				return
+			}
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// handleWorkspaces lists the workspaces chats and terminals can work in
+func (h *UnifiedHandler) handleWorkspaces(msg *protocol.Message) {
+	if h.workspaces == nil {
+		h.sendError(msg.ID, "workspaces_unavailable", "this gateway does not serve workspaces", false)
+		return
+	}
+
+	payload, _ := json.Marshal(protocol.WorkspaceList{Workspaces: h.workspaces()})
+	h.deliver(&protocol.Message{
+		ID:            uuid.New().String(),
+		Type:          protocol.TypeWorkspaces,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		CorrelationID: msg.ID,
+	})
+}
+
+// handleWorkspaceBackup backs up a workspace and replies once the backup is
+// stored. Archiving and uploading take a while, so it runs in the background.
+func (h *UnifiedHandler) handleWorkspaceBackup(msg *protocol.Message) {
+	if h.backups == nil {
+		h.sendError(msg.ID, "backups_unavailable", "this gateway does not back up workspaces", false)
+		return
+	}
+
+	var req protocol.WorkspaceBackupRequest
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			h.sendError(msg.ID, "invalid_payload", err.Error(), false)
+			return
+		}
+	}
+
+	go func() {
+		backup, err := h.backups(h.ctx, req.Workspace)
+		if err != nil {
+			h.log.Warn().Err(err).Str("workspace", req.Workspace).Msg("workspace backup failed")
+			h.sendError(msg.ID, "backup_failed", err.Error(), true)
+			return
+		}
+
+		payload, _ := json.Marshal(backup)
+		h.deliver(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypeWorkspaceBackup,
+			Timestamp:     time.Now(),
+			Payload:       payload,
+			CorrelationID: msg.ID,
+		})
+	}()
+}
+
+// offeredCapabilities lists the optional features the gateway can provide
+// over this session's transport
+func (h *UnifiedHandler) offeredCapabilities() []protocol.Capability {
+	var offered []protocol.Capability
+	if _, ok := h.transport.(BinaryTransport); ok {
+		offered = append(offered, protocol.CapabilityBinaryTerminal)
+	}
+	if _, ok := h.transport.(DictionaryTransport); ok {
+		offered = append(offered, protocol.CapabilityDictionary)
+	}
+	offered = append(offered, protocol.CapabilityChatPlans)
+	if h.guardrails != nil {
+		offered = append(offered, protocol.CapabilityCommandApprovals)
+	}
+	if h.sessions != nil {
+		offered = append(offered, protocol.CapabilityCollaboration, protocol.CapabilityNotifications)
+	}
+	return offered
+}
+
+// supports reports whether the client and gateway agreed on c. Clients that
+// sent no hello support nothing optional.
+func (h *UnifiedHandler) supports(c protocol.Capability) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.capabilities[c]
+}
+
+// protocolVersion returns the version messages to and from the client use
+func (h *UnifiedHandler) protocolVersion() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.version
+}
+
+// streamGranularity returns how chat replies are sliced for the client
+func (h *UnifiedHandler) streamGranularity() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.granularity
+}
+
 func (h *UnifiedHandler) handleAck(msg *protocol.Message) {
 	var ack protocol.AckMessage
 	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
@@ -336,23 +1106,38 @@ func (h *UnifiedHandler) sendPong() {
 }
 
 func (h *UnifiedHandler) sendError(messageID, code, error string, retryable bool) {
-	errData, _ := json.Marshal(protocol.ChatError{
+	h.sendErrorPayload(messageID, protocol.ChatError{
 		Error:     error,
 		Code:      code,
 		Retryable: retryable,
 	})
+}
+
+// clientError is implemented by errors that know how clients should see them
+type clientError interface {
+	error
+	ClientError() protocol.ChatError
+}
+
+func (h *UnifiedHandler) sendErrorPayload(messageID string, chatErr protocol.ChatError) {
+	select {
+	case h.send <- h.errorMessage(messageID, chatErr):
+	case <-h.ctx.Done():
+	}
+}
+
+// errorMessage records a chat error in the timeline and builds the message
+// reporting it to the client
+func (h *UnifiedHandler) errorMessage(messageID string, chatErr protocol.ChatError) *protocol.Message {
+	h.timeline.record(EventError, "code", chatErr.Code, "message", chatErr.Error)
 	
-	errMsg := &protocol.Message{
+	errData, _ := json.Marshal(chatErr)
+	return &protocol.Message{
 		ID:        messageID,
 		Type:      protocol.TypeChatError,
 		Timestamp: time.Now(),
 		Payload:   errData,
 	}
-	
-	select {
-	case h.send <- errMsg:
-	case <-h.ctx.Done():
-	}
 }
 
 func (h *UnifiedHandler) updateActivity() {
@@ -361,6 +1146,93 @@ func (h *UnifiedHandler) updateActivity() {
 	h.mu.Unlock()
 }
 
+// Revoke ends the session after telling the client why. Queued messages are
+// discarded; the client must reconnect with a new token.
+func (h *UnifiedHandler) Revoke(reason string) {
+	payload, _ := json.Marshal(protocol.SessionRevoked{Reason: reason})
+	msg := &protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeSessionRevoked,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+
+	select {
+	case h.terminate <- msg:
+		h.timeline.record(EventRevoked, "reason", reason)
+		h.end("revoked: " + reason)
+	default:
+		// Already terminating
+	}
+}
+
+// Announce sends an operator announcement to the client. Clients that resume
+// a session may see one again, and are expected to show each ID once.
+func (h *UnifiedHandler) Announce(a protocol.Announcement) {
+	payload, _ := json.Marshal(a)
+	if h.deliverReliable(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeAnnouncement,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}) {
+		h.timeline.record(EventAnnounced, "announcement_id", a.ID, "kind", string(a.Kind))
+	}
+}
+
+// lastHeartbeat returns when the client was last heard from, by message or
+// transport heartbeat. It reports false if the transport has no heartbeats,
+// in which case silence proves nothing.
+func (h *UnifiedHandler) lastHeartbeat() (time.Time, bool) {
+	hb, ok := h.transport.(HeartbeatTransport)
+	if !ok {
+		return time.Time{}, false
+	}
+	last := hb.LastHeartbeat()
+	if last.IsZero() {
+		return time.Time{}, false
+	}
+	if activity := h.GetLastActivity(); activity.After(last) {
+		last = activity
+	}
+	return last, true
+}
+
+// reap ends a session whose client stopped answering, releasing its queue
+// and terminal attachments. It reports how many of each were released, and
+// false if the session was already reaped.
+func (h *UnifiedHandler) reap(idle time.Duration) (terminals, messages int, ok bool) {
+	if !h.reaped.CompareAndSwap(false, true) {
+		return 0, 0, false
+	}
+
+	reason := "no heartbeat for " + idle.Round(time.Second).String()
+	h.timeline.record(EventReaped, "reason", reason)
+	h.end("reaped: " + reason)
+
+	// Cancel first so forwarders blocked on delivery give up
+	terminals = len(h.terminals.attached())
+	h.cancel()
+	h.transport.Close()
+	h.terminals.closeAll()
+	h.keepUnacked()
+	messages = h.queue.Clear()
+	return terminals, messages, true
+}
+
+// Grant returns the token the session was authorized with, or last
+// re-authenticated with
+func (h *UnifiedHandler) Grant() Grant {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.grant
+}
+
+// SessionID returns the identifier clients use to resume this session
+func (h *UnifiedHandler) SessionID() string {
+	return h.sessionID
+}
+
 func (h *UnifiedHandler) GetLastActivity() time.Time {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
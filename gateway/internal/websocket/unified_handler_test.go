@@ -0,0 +1,587 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+func startTestHandler(t *testing.T) *httpTransport {
+	t.Helper()
+	return startTestHandlerWithChat(t, echoChat{})
+}
+
+func startTestHandlerWithChat(t *testing.T, chatHandler ChatHandler) *httpTransport {
+	t.Helper()
+
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, chatHandler, manager)
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func nextOutbound(t *testing.T, transport *httpTransport) *protocol.Message {
+	t.Helper()
+
+	select {
+	case msg := <-transport.outbound:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message from the gateway")
+		return nil
+	}
+}
+
+func TestHelloNegotiatesVersion(t *testing.T) {
+	transport := startTestHandler(t)
+
+	payload, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.CurrentVersion + 1, Client: "ios/9.9"})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: payload})
+
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeHello || reply.CorrelationID != "h1" {
+		t.Fatalf("expected a hello reply, got %+v", reply)
+	}
+	var hello protocol.Hello
+	if err := json.Unmarshal(reply.Payload, &hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.ProtocolVersion != protocol.CurrentVersion || hello.MaxVersion != protocol.CurrentVersion || hello.SessionID == "" {
+		t.Fatalf("unexpected hello %+v", hello)
+	}
+
+	transport.push(&protocol.Message{ID: "p1", Type: protocol.TypePing, Timestamp: time.Now()})
+	if pong := nextOutbound(t, transport); pong.Type != protocol.TypePong || pong.ProtocolVersion != protocol.CurrentVersion {
+		t.Fatalf("expected a versioned pong, got %+v", pong)
+	}
+}
+
+func TestLegacyClientsGetVersion1(t *testing.T) {
+	transport := startTestHandler(t)
+
+	transport.push(&protocol.Message{ID: "p1", Type: protocol.TypePing, Timestamp: time.Now()})
+	if pong := nextOutbound(t, transport); pong.Type != protocol.TypePong || pong.ProtocolVersion != 0 {
+		t.Fatalf("expected an unversioned pong, got %+v", pong)
+	}
+}
+
+// binaryTransport is an HTTP transport that also takes binary frames
+type binaryTransport struct {
+	*httpTransport
+	frames chan []byte
+}
+
+func (t *binaryTransport) WriteBinary(data []byte) error {
+	t.frames <- data
+	return nil
+}
+
+func helloWith(t *testing.T, transport *httpTransport, capabilities ...protocol.Capability) protocol.Hello {
+	t.Helper()
+
+	payload, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.CurrentVersion, Capabilities: capabilities})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: payload})
+
+	var hello protocol.Hello
+	if err := json.Unmarshal(nextOutbound(t, transport).Payload, &hello); err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
+
+func TestBinaryTerminalCapability(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := &binaryTransport{httpTransport: newHTTPTransport(), frames: make(chan []byte, 1)}
+	h := NewTransportHandler(transport, echoChat{}, manager)
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	hello := helloWith(t, transport.httpTransport, protocol.CapabilityProtobuf, protocol.CapabilityBinaryTerminal)
+	if len(hello.Capabilities) != 1 || hello.Capabilities[0] != protocol.CapabilityBinaryTerminal {
+		t.Fatalf("expected only binary_terminal to be agreed, got %v", hello.Capabilities)
+	}
+
+	output, _ := json.Marshal(terminal.TerminalOutputMessage{TerminalID: "t1", Data: "aGVsbG8="})
+	h.deliver(&protocol.Message{ID: "o1", Type: "terminal_output", Timestamp: time.Now(), Payload: output})
+
+	select {
+	case frame := <-transport.frames:
+		id, data, err := protocol.DecodeTerminalFrame(frame)
+		if err != nil || id != "t1" || string(data) != "hello" {
+			t.Fatalf("unexpected frame %q %q %v", id, data, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("terminal output was not sent as a binary frame")
+	}
+}
+
+func TestCapabilitiesNeedTransportSupport(t *testing.T) {
+	transport := startTestHandler(t)
+
+	// The HTTP fallback has no binary frames, so terminal output stays JSON
+	if hello := helloWith(t, transport, protocol.CapabilityBinaryTerminal); len(hello.Capabilities) != 0 {
+		t.Fatalf("expected no capabilities over HTTP, got %v", hello.Capabilities)
+	}
+}
+
+// recoveringChat restarts its backend once before answering
+type recoveringChat struct{}
+
+func (recoveringChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 3)
+	started := protocol.BackendRecovery{Phase: protocol.RecoveryStarted, ErrorType: "process", Action: "restart_process", Attempt: 1}
+	succeeded := started
+	succeeded.Phase = protocol.RecoverySucceeded
+	replies <- &protocol.ChatReply{Recovery: &started}
+	replies <- &protocol.ChatReply{Recovery: &succeeded}
+	replies <- &protocol.ChatReply{Content: msg.Content, Finished: true}
+	close(replies)
+	return replies, nil
+}
+
+func TestChatForwardsBackendRecovery(t *testing.T) {
+	transport := startTestHandlerWithChat(t, recoveringChat{})
+
+	hello, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.Version2})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: hello})
+	nextOutbound(t, transport)
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hi"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+
+	for _, want := range []protocol.MessageType{protocol.TypeBackendRecoveryStarted, protocol.TypeBackendRecoverySucceeded} {
+		msg := nextOutbound(t, transport)
+		if msg.Type != want || msg.CorrelationID != "c1" || !msg.RequiresAck {
+			t.Fatalf("expected a reliable %s, got %+v", want, msg)
+		}
+		var recovery protocol.BackendRecovery
+		if err := json.Unmarshal(msg.Payload, &recovery); err != nil {
+			t.Fatal(err)
+		}
+		if recovery.ErrorType != "process" || recovery.Action != "restart_process" {
+			t.Fatalf("unexpected recovery %+v", recovery)
+		}
+	}
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeChatStream {
+		t.Fatalf("expected the reply after recovery, got %+v", msg)
+	}
+}
+
+func TestLegacyClientsDoNotGetBackendRecovery(t *testing.T) {
+	transport := startTestHandlerWithChat(t, recoveringChat{})
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hi"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeChatStream {
+		t.Fatalf("expected only the chat reply, got %+v", msg)
+	}
+}
+
+func TestDiagnosticsRequest(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithDiagnostics(func(ctx context.Context) protocol.Diagnostics {
+		return protocol.Diagnostics{
+			Status: protocol.DiagnosticFail,
+			Checks: []protocol.DiagnosticCheck{{Name: "api_key", Status: protocol.DiagnosticFail, Detail: "no API key found"}},
+		}
+	}))
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	transport.push(&protocol.Message{ID: "d1", Type: protocol.TypeDiagnostics, Timestamp: time.Now()})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeDiagnostics || reply.CorrelationID != "d1" {
+		t.Fatalf("expected a diagnostics reply, got %+v", reply)
+	}
+	var report protocol.Diagnostics
+	if err := json.Unmarshal(reply.Payload, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != protocol.DiagnosticFail || len(report.Checks) != 1 || report.Checks[0].Name != "api_key" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestChatConfigRequest(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	var applied protocol.ChatConfig
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithChatConfig(func(change protocol.ChatConfig) (protocol.ChatConfigStatus, error) {
+		if change.Backend == "bogus" {
+			return protocol.ChatConfigStatus{}, errors.New("unknown chat backend")
+		}
+		applied = change
+		return protocol.ChatConfigStatus{Backend: change.Backend, Model: change.Model}, nil
+	}))
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	payload, _ := json.Marshal(protocol.ChatConfig{Backend: protocol.BackendAider, Model: "gpt-4o"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChatConfig, Timestamp: time.Now(), Payload: payload})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeChatConfig || reply.CorrelationID != "c1" || applied.Model != "gpt-4o" {
+		t.Fatalf("expected the config to be applied, got %+v", reply)
+	}
+
+	payload, _ = json.Marshal(protocol.ChatConfig{Backend: "bogus"})
+	transport.push(&protocol.Message{ID: "c2", Type: protocol.TypeChatConfig, Timestamp: time.Now(), Payload: payload})
+	if reply := nextOutbound(t, transport); reply.Type != protocol.TypeChatError || reply.ID != "c2" {
+		t.Fatalf("expected an error for an invalid config, got %+v", reply)
+	}
+}
+
+func TestWorkspacesRequest(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithWorkspaces(func() []protocol.Workspace {
+		return []protocol.Workspace{{Name: "api", Root: "/src/api"}, {Name: "default", Root: "/src/web", Default: true}}
+	}))
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	transport.push(&protocol.Message{ID: "w1", Type: protocol.TypeWorkspaces, Timestamp: time.Now()})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeWorkspaces || reply.CorrelationID != "w1" {
+		t.Fatalf("expected a workspaces reply, got %+v", reply)
+	}
+	var list protocol.WorkspaceList
+	if err := json.Unmarshal(reply.Payload, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Workspaces) != 2 || list.Workspaces[0].Name != "api" || !list.Workspaces[1].Default {
+		t.Fatalf("unexpected workspaces %+v", list.Workspaces)
+	}
+}
+
+func TestWorkspaceBackupRequest(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithBackups(func(ctx context.Context, workspace string) (protocol.WorkspaceBackup, error) {
+		if workspace == "missing" {
+			return protocol.WorkspaceBackup{}, errors.New(`unknown workspace "missing"`)
+		}
+		return protocol.WorkspaceBackup{ID: 7, Workspace: "default", SizeBytes: 1024}, nil
+	}))
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	transport.push(&protocol.Message{ID: "b1", Type: protocol.TypeWorkspaceBackup, Timestamp: time.Now()})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeWorkspaceBackup || reply.CorrelationID != "b1" {
+		t.Fatalf("expected a workspace_backup reply, got %+v", reply)
+	}
+	var backup protocol.WorkspaceBackup
+	if err := json.Unmarshal(reply.Payload, &backup); err != nil {
+		t.Fatal(err)
+	}
+	if backup.ID != 7 || backup.Workspace != "default" {
+		t.Fatalf("unexpected backup %+v", backup)
+	}
+
+	payload, _ := json.Marshal(protocol.WorkspaceBackupRequest{Workspace: "missing"})
+	transport.push(&protocol.Message{ID: "b2", Type: protocol.TypeWorkspaceBackup, Timestamp: time.Now(), Payload: payload})
+	if reply := nextOutbound(t, transport); reply.Type != protocol.TypeChatError || reply.ID != "b2" {
+		t.Fatalf("expected an error for an unknown workspace, got %+v", reply)
+	}
+}
+
+func TestSessionEnv(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	root := t.TempDir()
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithWorkspaces(func() []protocol.Workspace {
+		return []protocol.Workspace{{Name: "default", Root: root, Default: true}}
+	}))
+	go h.Run()
+	t.Cleanup(func() { transport.Close() })
+
+	payload, _ := json.Marshal(protocol.EnvSet{Vars: map[string]string{"API_TOKEN": "s3cret", "REGION": "eu"}, Persist: true})
+	transport.push(&protocol.Message{ID: "e1", Type: protocol.TypeEnvSet, Timestamp: time.Now(), Payload: payload})
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeEnvSet || reply.CorrelationID != "e1" || strings.Contains(string(reply.Payload), "s3cret") {
+		t.Fatalf("expected the names only, got %+v", reply)
+	}
+	var env protocol.SessionEnv
+	json.Unmarshal(reply.Payload, &env)
+	if len(env.Names) != 2 || env.Names[0] != "API_TOKEN" {
+		t.Fatalf("unexpected names %v", env.Names)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, ".env")); string(data) != "API_TOKEN=s3cret\nREGION=eu\n" {
+		t.Fatalf("expected the variables in .env, got %q", data)
+	}
+
+	// New terminals get the variables; the request's own win
+	create, _ := json.Marshal(terminal.TerminalCreateRequest{Env: []string{"REGION=us"}})
+	withEnv := h.withSessionEnv(&protocol.Message{ID: "t1", Type: "terminal_create", Payload: create})
+	var req terminal.TerminalCreateRequest
+	json.Unmarshal(withEnv.Payload, &req)
+	if strings.Join(req.Env, " ") != "API_TOKEN=s3cret REGION=eu REGION=us" {
+		t.Fatalf("unexpected terminal env %v", req.Env)
+	}
+
+	payload, _ = json.Marshal(protocol.EnvUnset{Names: []string{"API_TOKEN"}, Persist: true})
+	transport.push(&protocol.Message{ID: "e2", Type: protocol.TypeEnvUnset, Timestamp: time.Now(), Payload: payload})
+	nextOutbound(t, transport)
+	transport.push(&protocol.Message{ID: "e3", Type: protocol.TypeEnvList, Timestamp: time.Now()})
+	reply = nextOutbound(t, transport)
+	json.Unmarshal(reply.Payload, &env)
+	if reply.CorrelationID != "e3" || len(env.Names) != 1 || env.Names[0] != "REGION" {
+		t.Fatalf("expected only REGION left, got %+v", env)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, ".env")); string(data) != "REGION=eu\n" {
+		t.Fatalf("expected API_TOKEN removed from .env, got %q", data)
+	}
+
+	payload, _ = json.Marshal(protocol.EnvSet{Vars: map[string]string{"1BAD": "x"}})
+	transport.push(&protocol.Message{ID: "e4", Type: protocol.TypeEnvSet, Timestamp: time.Now(), Payload: payload})
+	if reply := nextOutbound(t, transport); reply.Type != protocol.TypeChatError || reply.ID != "e4" {
+		t.Fatalf("expected an invalid name to be rejected, got %+v", reply)
+	}
+}
+
+func TestFileChangesArePushed(t *testing.T) {
+	manager := terminal.NewManager()
+	t.Cleanup(func() { manager.Close() })
+
+	changes := make(chan protocol.WorkspaceFileChanged, 1)
+	unsubscribed := make(chan struct{})
+	transport := newHTTPTransport()
+	h := NewTransportHandler(transport, echoChat{}, manager, WithFileChanges(func() (<-chan protocol.WorkspaceFileChanged, func()) {
+		return changes, func() { close(unsubscribed) }
+	}))
+	done := make(chan struct{})
+	go func() {
+		h.Run()
+		close(done)
+	}()
+
+	hello, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.Version2})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: hello})
+	nextOutbound(t, transport)
+
+	changes <- protocol.WorkspaceFileChanged{Workspace: "default", Path: "src/main.go", Operation: protocol.FileWritten, Size: 42}
+	reply := nextOutbound(t, transport)
+	if reply.Type != protocol.TypeWorkspaceFileChanged {
+		t.Fatalf("expected a file change, got %+v", reply)
+	}
+	var change protocol.WorkspaceFileChanged
+	json.Unmarshal(reply.Payload, &change)
+	if change.Path != "src/main.go" || change.Size != 42 {
+		t.Fatalf("unexpected change %+v", change)
+	}
+
+	transport.Close()
+	<-done
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("subscription not ended with the session")
+	}
+}
+
+// queuedChat waits behind another request before failing
+type queuedChat struct{}
+
+func (queuedChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	replies := make(chan *protocol.ChatReply, 2)
+	replies <- &protocol.ChatReply{Queued: &protocol.ChatQueued{Position: 1}}
+	replies <- &protocol.ChatReply{Finished: true, Error: &protocol.ChatError{Error: "no API key", Code: "backend_unconfigured"}}
+	close(replies)
+	return replies, nil
+}
+
+func TestChatForwardsQueuePositionsAndQueuedErrors(t *testing.T) {
+	transport := startTestHandlerWithChat(t, queuedChat{})
+
+	hello, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.Version2})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: hello})
+	nextOutbound(t, transport)
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hi"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+
+	queued := nextOutbound(t, transport)
+	if queued.Type != protocol.TypeChatQueued || queued.CorrelationID != "c1" {
+		t.Fatalf("expected chat_queued, got %+v", queued)
+	}
+	failed := nextOutbound(t, transport)
+	var chatErr protocol.ChatError
+	json.Unmarshal(failed.Payload, &chatErr)
+	if failed.Type != protocol.TypeChatError || failed.ID != "c1" || chatErr.Code != "backend_unconfigured" {
+		t.Fatalf("expected the queued request's error, got %+v", failed)
+	}
+}
+
+// streamingChat streams the replies the test feeds it
+type streamingChat struct {
+	replies chan *protocol.ChatReply
+	ctx     chan context.Context
+}
+
+func (c streamingChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	c.ctx <- ctx
+	return c.replies, nil
+}
+
+func TestChatOutlivesTheConnection(t *testing.T) {
+	chat := streamingChat{replies: make(chan *protocol.ChatReply), ctx: make(chan context.Context, 1)}
+	transport := startTestHandlerWithChat(t, chat)
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "refactor everything"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	ctx := <-chat.ctx
+
+	chat.replies <- &protocol.ChatReply{Content: "working"}
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeChatStream {
+		t.Fatalf("expected chat_stream, got %+v", msg)
+	}
+	transport.Close()
+
+	// The backend is never left blocked on a reply nobody reads
+	for _, reply := range []*protocol.ChatReply{{Content: "still"}, {Content: "working"}, {Finished: true}} {
+		select {
+		case chat.replies <- reply:
+		case <-time.After(5 * time.Second):
+			t.Fatal("replies stopped being read after the client disconnected")
+		}
+	}
+	close(chat.replies)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("chat request was cancelled with the connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestChatRepliesFollowStreamGranularity(t *testing.T) {
+	chat := streamingChat{replies: make(chan *protocol.ChatReply, 8), ctx: make(chan context.Context, 1)}
+	transport := startTestHandlerWithChat(t, chat)
+
+	hello, _ := json.Marshal(protocol.Hello{ProtocolVersion: protocol.CurrentVersion, StreamGranularity: protocol.GranularitySentence})
+	transport.push(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: hello})
+	var agreed protocol.Hello
+	json.Unmarshal(nextOutbound(t, transport).Payload, &agreed)
+	if agreed.StreamGranularity != protocol.GranularitySentence {
+		t.Fatalf("expected sentence granularity, got %+v", agreed)
+	}
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hi"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	<-chat.ctx
+	for _, content := range []string{"Fixed ", "the bug", ". Tests ", "pass"} {
+		chat.replies <- &protocol.ChatReply{Content: content}
+	}
+	chat.replies <- &protocol.ChatReply{Finished: true}
+	close(chat.replies)
+
+	for _, want := range []protocol.ChatReply{
+		{Content: "Fixed the bug. ", Block: protocol.BlockProse},
+		{Content: "Tests pass", Finished: true, Block: protocol.BlockProse},
+	} {
+		var reply protocol.ChatReply
+		json.Unmarshal(nextOutbound(t, transport).Payload, &reply)
+		if !reflect.DeepEqual(reply, want) {
+			t.Fatalf("expected %+v, got %+v", want, reply)
+		}
+	}
+}
+
+func TestChatRepliesCarryCodeBlocks(t *testing.T) {
+	chat := streamingChat{replies: make(chan *protocol.ChatReply, 8), ctx: make(chan context.Context, 1)}
+	transport := startTestHandlerWithChat(t, chat)
+
+	payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: "hi"})
+	transport.push(&protocol.Message{ID: "c1", Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload})
+	<-chat.ctx
+	for _, content := range []string{"main.go\n```go\npackage ", "main\n``", "`\nDone"} {
+		chat.replies <- &protocol.ChatReply{Content: content}
+	}
+	chat.replies <- &protocol.ChatReply{Finished: true}
+	close(chat.replies)
+
+	var blocks [][]protocol.CodeBlock
+	for i := 0; i < 4; i++ {
+		var reply protocol.ChatReply
+		json.Unmarshal(nextOutbound(t, transport).Payload, &reply)
+		blocks = append(blocks, reply.CodeBlocks)
+	}
+	want := protocol.CodeBlock{Language: "go", Content: "package main\n", File: "main.go"}
+	if len(blocks[2]) != 1 || blocks[2][0] != want || blocks[0] != nil || blocks[1] != nil || blocks[3] != nil {
+		t.Fatalf("expected the block on the part closing it, got %+v", blocks)
+	}
+}
+
+// branchingChat answers every message with its branch point and remembers
+// what it was asked
+type branchingChat struct {
+	asked chan protocol.ChatMessage
+}
+
+func (c branchingChat) HandleChatMessage(ctx context.Context, msg *protocol.ChatMessage) (<-chan *protocol.ChatReply, error) {
+	c.asked <- *msg
+	replies := make(chan *protocol.ChatReply, 1)
+	replies <- &protocol.ChatReply{Content: "again", Finished: true, MessageID: "msg-2"}
+	close(replies)
+	return replies, nil
+}
+
+func TestChatBranchAndRegenerate(t *testing.T) {
+	chat := branchingChat{asked: make(chan protocol.ChatMessage, 1)}
+	transport := startTestHandlerWithChat(t, chat)
+
+	regenerate, _ := json.Marshal(protocol.ChatRegenerate{MessageID: "msg-1", WorkDir: "api"})
+	transport.push(&protocol.Message{ID: "r1", Type: protocol.TypeChatRegenerate, Timestamp: time.Now(), Payload: regenerate})
+	if asked := <-chat.asked; !asked.Regenerate || asked.BranchFrom != "msg-1" || asked.WorkDir != "api" {
+		t.Fatalf("expected a regenerate chat, got %+v", asked)
+	}
+	msg := nextOutbound(t, transport)
+	var reply protocol.ChatReply
+	json.Unmarshal(msg.Payload, &reply)
+	if msg.Type != protocol.TypeChatStream || msg.CorrelationID != "r1" || !reply.Finished || reply.MessageID != "msg-2" {
+		t.Fatalf("expected the reply with its message ID, got %+v %+v", msg, reply)
+	}
+
+	branch, _ := json.Marshal(protocol.ChatBranch{MessageID: "msg-2", Content: "try it with channels"})
+	transport.push(&protocol.Message{ID: "b1", Type: protocol.TypeChatBranch, Timestamp: time.Now(), Payload: branch})
+	if asked := <-chat.asked; asked.Regenerate || asked.BranchFrom != "msg-2" || asked.Content != "try it with channels" {
+		t.Fatalf("expected a chat branching from msg-2, got %+v", asked)
+	}
+	if msg := nextOutbound(t, transport); msg.CorrelationID != "b1" {
+		t.Fatalf("expected the branch's reply, got %+v", msg)
+	}
+
+	// A branch needs somewhere to branch from
+	branch, _ = json.Marshal(protocol.ChatBranch{Content: "try it with channels"})
+	transport.push(&protocol.Message{ID: "b2", Type: protocol.TypeChatBranch, Timestamp: time.Now(), Payload: branch})
+	if msg := nextOutbound(t, transport); msg.Type != protocol.TypeChatError || msg.ID != "b2" {
+		t.Fatalf("expected a chat_error, got %+v", msg)
+	}
+}
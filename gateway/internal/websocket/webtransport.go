@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"github.com/rs/zerolog/log"
+)
+
+// streamAcceptTimeout is how long a new WebTransport session has to open its
+// message stream
+const streamAcceptTimeout = 10 * time.Second
+
+// Session error codes sent when the gateway closes a WebTransport session
+const (
+	wtErrNoStream      webtransport.SessionErrorCode = 1
+	wtErrLimitExceeded webtransport.SessionErrorCode = 2
+)
+
+// wtTransport carries codec-framed protobuf messages over the first
+// bidirectional stream the client opens on a WebTransport session. QUIC
+// avoids TCP head-of-line blocking, which helps mobile clients on lossy links.
+type wtTransport struct {
+	session   *webtransport.Session
+	stream    webtransport.Stream
+	codec     *protocol.Codec
+	reader    *protocol.MessageReader
+	writer    *protocol.MessageWriter
+	closeOnce sync.Once
+}
+
+func (t *wtTransport) ReadMessage() (*protocol.Message, error) {
+	msg, err := t.reader.ReadMessage()
+	if err != nil {
+		if t.session.Context().Err() != nil {
+			return nil, io.EOF
+		}
+		if errors.Is(err, protocol.ErrLimitExceeded) {
+			t.closeOnce.Do(func() {
+				t.session.CloseWithError(wtErrLimitExceeded, err.Error())
+			})
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (t *wtTransport) WriteMessage(msg *protocol.Message) error {
+	t.stream.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return t.writer.WriteMessage(msg)
+}
+
+func (t *wtTransport) UseDictionary() {
+	t.codec.UseDictionary(true)
+}
+
+// Keepalive only reports session loss; QUIC sends its own keepalives
+func (t *wtTransport) Keepalive() error {
+	return t.session.Context().Err()
+}
+
+func (t *wtTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.stream.Close()
+		err = t.session.CloseWithError(0, "")
+	})
+	return err
+}
+
+// WebTransportServer serves the gateway protocol over HTTP/3 WebTransport.
+// It is experimental: clients connect to https://host:port/wt and open one
+// bidirectional stream carrying the same framed protobuf messages as binary
+// WebSocket frames.
+type WebTransportServer struct {
+	server       *webtransport.Server
+	newHandler   HandlerFactory
+	limiter      *ConnLimiter
+	authenticate Authenticator
+	certFile     string
+	keyFile      string
+}
+
+// NewWebTransportServer creates a WebTransport listener on addr (UDP).
+// QUIC requires TLS, so a certificate and key are mandatory. A nil
+// checkOrigin allows only same-origin browser sessions.
+func NewWebTransportServer(addr, certFile, keyFile string, newHandler HandlerFactory, checkOrigin func(r *http.Request) bool, opts ...ServerOption) (*WebTransportServer, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("webtransport requires a TLS certificate and key")
+	}
+
+	config := newServerConfig(opts)
+	s := &WebTransportServer{
+		newHandler:   newHandler,
+		limiter:      config.limiter,
+		authenticate: config.authenticate,
+		certFile:     certFile,
+		keyFile:      keyFile,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wt", s.handleSession)
+
+	s.server = &webtransport.Server{
+		CheckOrigin: checkOrigin,
+		H3: http3.Server{
+			Addr:    addr,
+			Handler: mux,
+			QUICConfig: &quic.Config{
+				MaxIdleTimeout:  pongTimeout,
+				KeepAlivePeriod: pingInterval,
+			},
+		},
+	}
+
+	return s, nil
+}
+
+// ListenAndServe blocks serving WebTransport sessions until Close is called
+func (s *WebTransportServer) ListenAndServe() error {
+	return s.server.ListenAndServeTLS(s.certFile, s.keyFile)
+}
+
+// Close stops the listener and ends all sessions
+func (s *WebTransportServer) Close() error {
+	return s.server.Close()
+}
+
+func (s *WebTransportServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	grant, err := s.authenticate.check(RequestToken(r))
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("unauthorized webtransport session")
+		RejectUnauthorized(w, err)
+		return
+	}
+
+	release, err := s.limiter.Acquire(ClientKey(r))
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected webtransport session")
+		RejectHTTP(w, err)
+		return
+	}
+	defer release()
+
+	session, err := s.server.Upgrade(w, r)
+	if err != nil {
+		log.Error().Err(err).Str("remote", r.RemoteAddr).Msg("webtransport upgrade failed")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(session.Context(), streamAcceptTimeout)
+	stream, err := session.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		log.Error().Err(err).Str("remote", r.RemoteAddr).Msg("webtransport client opened no stream")
+		session.CloseWithError(wtErrNoStream, "no message stream")
+		return
+	}
+
+	// Each session gets its own codec, so its decode budget is per client
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		log.Error().Err(err).Msg("create codec failed")
+		session.CloseWithError(0, "")
+		return
+	}
+
+	handler := s.newHandler(&wtTransport{
+		session: session,
+		stream:  stream,
+		codec:   codec,
+		reader:  codec.Reader(stream),
+		writer:  codec.Writer(stream),
+	}, WithGrant(grant), WithClient(ClientInfo{
+		Transport:  "webtransport",
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}))
+
+	log.Info().
+		Str("remote", r.RemoteAddr).
+		Str("session_id", handler.SessionID()).
+		Msg("new webtransport session")
+
+	handler.Run()
+
+	log.Info().
+		Str("remote", r.RemoteAddr).
+		Str("session_id", handler.SessionID()).
+		Msg("webtransport session closed")
+}
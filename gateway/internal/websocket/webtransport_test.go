@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/internal/terminal"
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/quic-go/webtransport-go"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("udp not available: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestWebTransportPingPong(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	addr := freeUDPAddr(t)
+
+	manager := terminal.NewManager()
+	defer manager.Close()
+
+	server, err := NewWebTransportServer(addr, certFile, keyFile, func(transport Transport, opts ...UnifiedHandlerOption) *UnifiedHandler {
+		return NewTransportHandler(transport, echoChat{}, manager, opts...)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	dialer := webtransport.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer dialer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var session *webtransport.Session
+	for {
+		_, session, err = dialer.Dial(ctx, "https://"+addr+"/wt", nil)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer session.CloseWithError(0, "")
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codec.Writer(stream).WriteMessage(&protocol.Message{ID: "p1", Type: protocol.TypePing, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := codec.Reader(stream).ReadMessage()
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply.Type != protocol.TypePong {
+		t.Fatalf("expected pong, got %q", reply.Type)
+	}
+
+	// The dictionary is offered here but binary terminal frames are not;
+	// the reply is already compressed with it
+	hello, _ := json.Marshal(protocol.Hello{
+		ProtocolVersion: protocol.CurrentVersion,
+		Capabilities:    []protocol.Capability{protocol.CapabilityBinaryTerminal, protocol.CapabilityDictionary},
+	})
+	if err := codec.Writer(stream).WriteMessage(&protocol.Message{ID: "h1", Type: protocol.TypeHello, Timestamp: time.Now(), Payload: hello}); err != nil {
+		t.Fatalf("write hello: %v", err)
+	}
+	if reply, err = codec.Reader(stream).ReadMessage(); err != nil {
+		t.Fatalf("read hello: %v", err)
+	}
+	var agreed protocol.Hello
+	if err := json.Unmarshal(reply.Payload, &agreed); err != nil {
+		t.Fatal(err)
+	}
+	if len(agreed.Capabilities) != 1 || agreed.Capabilities[0] != protocol.CapabilityDictionary {
+		t.Fatalf("expected only the dictionary to be agreed, got %v", agreed.Capabilities)
+	}
+}
@@ -0,0 +1,144 @@
+package workspace
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DotEnvFile is the file in a workspace root that holds its variables
+const DotEnvFile = ".env"
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidEnvName reports whether name can be an environment variable
+func ValidEnvName(name string) bool {
+	return envName.MatchString(name)
+}
+
+// SetDotEnv writes vars to the .env file in root. Existing assignments are
+// replaced in place, others are appended; comments and other lines are kept.
+func SetDotEnv(root string, vars map[string]string) error {
+	for name, value := range vars {
+		if !ValidEnvName(name) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+		if strings.ContainsAny(value, "\n\r\x00") {
+			return fmt.Errorf("variable %s: values written to %s must be a single line", name, DotEnvFile)
+		}
+	}
+
+	return editDotEnv(root, func(lines []string) []string {
+		written := make(map[string]bool, len(vars))
+		for i, line := range lines {
+			if name, ok := dotEnvName(line); ok {
+				if value, set := vars[name]; set {
+					lines[i] = dotEnvLine(name, value)
+					written[name] = true
+				}
+			}
+		}
+
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			if !written[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, dotEnvLine(name, vars[name]))
+		}
+		return lines
+	})
+}
+
+// UnsetDotEnv removes the assignments of names from the .env file in root
+func UnsetDotEnv(root string, names []string) error {
+	remove := make(map[string]bool, len(names))
+	for _, name := range names {
+		remove[name] = true
+	}
+
+	return editDotEnv(root, func(lines []string) []string {
+		kept := lines[:0]
+		for _, line := range lines {
+			if name, ok := dotEnvName(line); ok && remove[name] {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		return kept
+	})
+}
+
+// editDotEnv rewrites the .env file in root through edit. The file is
+// replaced atomically and readable only by its owner, since it holds secrets.
+func editDotEnv(root string, edit func(lines []string) []string) error {
+	path := filepath.Join(root, DotEnvFile)
+
+	var lines []string
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read %s: %w", DotEnvFile, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	lines = edit(lines)
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(root, DotEnvFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write %s: %w", DotEnvFile, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", DotEnvFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", DotEnvFile, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write %s: %w", DotEnvFile, err)
+	}
+	return nil
+}
+
+// dotEnvName returns the variable a NAME=value or export NAME=value line
+// assigns
+func dotEnvName(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "export ")
+	name, _, ok := strings.Cut(line, "=")
+	name = strings.TrimSpace(name)
+	return name, ok && ValidEnvName(name)
+}
+
+// dotEnvLine quotes values that a shell or dotenv parser would otherwise
+// split or expand: in single quotes, or double quotes with escapes if the
+// value holds a single quote
+func dotEnvLine(name, value string) string {
+	switch {
+	case strings.Contains(value, "'"):
+		value = `"` + dotEnvEscaper.Replace(value) + `"`
+	case value == "" || strings.ContainsAny(value, " \t#\"$\\`"):
+		value = "'" + value + "'"
+	}
+	return name + "=" + value
+}
+
+var dotEnvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
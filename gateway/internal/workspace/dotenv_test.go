@@ -0,0 +1,44 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDotEnv(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, DotEnvFile)
+	os.WriteFile(path, []byte("# staging\nexport DB_HOST=db.internal\nDEBUG=1\n"), 0644)
+
+	err := SetDotEnv(root, map[string]string{
+		"DB_HOST":  "localhost",
+		"GREETING": "hello world",
+		"QUOTE":    "it's $HOME",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# staging\nDB_HOST=localhost\nDEBUG=1\nGREETING='hello world'\nQUOTE=\"it's \\$HOME\"\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("expected .env to be private, got %v", info.Mode().Perm())
+	}
+
+	if err := UnsetDotEnv(root, []string{"DEBUG", "QUOTE", "MISSING"}); err != nil {
+		t.Fatal(err)
+	}
+	want = "# staging\nDB_HOST=localhost\nGREETING='hello world'\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Fatalf("got %q, want %q", data, want)
+	}
+
+	if err := SetDotEnv(root, map[string]string{"BAD-NAME": "x"}); err == nil {
+		t.Error("expected an invalid name to be rejected")
+	}
+	if err := SetDotEnv(root, map[string]string{"MULTI": "a\nb"}); err == nil {
+		t.Error("expected a multi-line value to be rejected")
+	}
+}
@@ -0,0 +1,169 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// DefaultName names the workspace --workdir sets up
+const DefaultName = "default"
+
+// ErrNotFound is returned for a workspace name the registry does not know
+var ErrNotFound = errors.New("unknown workspace")
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Registry holds the named project roots on the VM. Terminals and chats bind
+// to one of them instead of a single gateway-wide working directory, so
+// several repositories can be worked on from one VM.
+type Registry struct {
+	mu          sync.RWMutex
+	workspaces  map[string]protocol.Workspace
+	defaultName string
+}
+
+// NewRegistry creates an empty registry. The first workspace added is the
+// default.
+func NewRegistry() *Registry {
+	return &Registry{workspaces: make(map[string]protocol.Workspace)}
+}
+
+// Add registers root under name. root must be an existing directory; it is
+// stored with symlinks resolved.
+func (r *Registry) Add(name, root string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid workspace name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("workspace %s: %w", name, err)
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return fmt.Errorf("workspace %s: %w", name, err)
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return fmt.Errorf("workspace %s: %w", name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("workspace %s: %s is not a directory", name, root)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.workspaces[name]; ok {
+		return fmt.Errorf("workspace %s is already registered", name)
+	}
+	r.workspaces[name] = protocol.Workspace{Name: name, Root: real}
+	if r.defaultName == "" {
+		r.defaultName = name
+	}
+	return nil
+}
+
+// Get returns the workspace called name, or the default for ""
+func (r *Registry) Get(name string) (protocol.Workspace, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if name == "" {
+		name = r.defaultName
+	}
+	ws, ok := r.workspaces[name]
+	if !ok {
+		return protocol.Workspace{}, fmt.Errorf("%w %q", ErrNotFound, name)
+	}
+	ws.Default = name == r.defaultName
+	return ws, nil
+}
+
+// Default returns the default workspace
+func (r *Registry) Default() protocol.Workspace {
+	ws, _ := r.Get("")
+	return ws
+}
+
+// List returns every workspace, sorted by name
+func (r *Registry) List() []protocol.Workspace {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]protocol.Workspace, 0, len(r.workspaces))
+	for name, ws := range r.workspaces {
+		ws.Default = name == r.defaultName
+		list = append(list, ws)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Resolve returns the directory dir names inside the workspace called name.
+// See Within.
+func (r *Registry) Resolve(name, dir string) (string, error) {
+	ws, err := r.Get(name)
+	if err != nil {
+		return "", err
+	}
+	return Within(ws.Root, dir)
+}
+
+// Within returns the directory dir names under root. dir is relative to
+// root; an absolute dir must lie under root. Symlinks are followed, so a link
+// cannot lead out of the workspace.
+func Within(root, dir string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return "", err
+	}
+
+	if dir == "" {
+		return realRoot, nil
+	}
+	path := dir
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(absRoot, path)
+	}
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", &PathError{Dir: dir, Reason: "does not exist"}
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &PathError{Dir: dir, Reason: "is outside the workspace"}
+	}
+
+	info, err := os.Stat(realPath)
+	if err != nil {
+		return "", &PathError{Dir: dir, Reason: "does not exist"}
+	}
+	if !info.IsDir() {
+		return "", &PathError{Dir: dir, Reason: "is not a directory"}
+	}
+	return realPath, nil
+}
+
+// PathError reports a directory Within rejected
+type PathError struct {
+	Dir    string
+	Reason string
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%q %s", e.Dir, e.Reason)
+}
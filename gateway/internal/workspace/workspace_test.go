@@ -0,0 +1,75 @@
+package workspace
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	web, api := t.TempDir(), t.TempDir()
+
+	r := NewRegistry()
+	if err := r.Add(DefaultName, web); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("api", api); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []struct{ name, root string }{
+		{"api", api},
+		{"../api", api},
+		{"", api},
+		{"missing", filepath.Join(api, "missing")},
+	} {
+		if err := r.Add(bad.name, bad.root); err == nil {
+			t.Errorf("Add(%q, %q) succeeded", bad.name, bad.root)
+		}
+	}
+
+	realWeb, _ := filepath.EvalSymlinks(web)
+	if def := r.Default(); def.Name != DefaultName || def.Root != realWeb || !def.Default {
+		t.Fatalf("unexpected default workspace %+v", def)
+	}
+
+	list := r.List()
+	if len(list) != 2 || list[0].Name != "api" || list[0].Default || list[1].Name != DefaultName {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	if _, err := r.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	root, other := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(root, "cmd"), 0755)
+	os.WriteFile(filepath.Join(root, "go.mod"), nil, 0644)
+	os.Symlink(other, filepath.Join(root, "escape"))
+
+	r := NewRegistry()
+	r.Add(DefaultName, root)
+	r.Add("other", other)
+
+	realRoot, _ := filepath.EvalSymlinks(root)
+	if dir, err := r.Resolve("", "cmd"); err != nil || dir != filepath.Join(realRoot, "cmd") {
+		t.Fatalf("Resolve(cmd) = %q, %v", dir, err)
+	}
+	realOther, _ := filepath.EvalSymlinks(other)
+	if dir, err := r.Resolve("other", ""); err != nil || dir != realOther {
+		t.Fatalf("Resolve(other) = %q, %v", dir, err)
+	}
+
+	for _, dir := range []string{"..", other, "escape", "go.mod", "missing"} {
+		var pathErr *PathError
+		if _, err := r.Resolve("", dir); !errors.As(err, &pathErr) {
+			t.Errorf("Resolve(%q): expected a PathError, got %v", dir, err)
+		}
+	}
+	if _, err := r.Resolve("missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
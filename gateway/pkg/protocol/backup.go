@@ -0,0 +1,24 @@
+package protocol
+
+import "time"
+
+// TypeWorkspaceBackup asks the gateway to back up a workspace now; the reply
+// is a workspace_backup message carrying a WorkspaceBackup payload once the
+// archive is stored
+const TypeWorkspaceBackup MessageType = "workspace_backup"
+
+// WorkspaceBackupRequest is the payload of a workspace_backup request. An
+// empty workspace means the default one.
+type WorkspaceBackupRequest struct {
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// WorkspaceBackup describes a stored backup. Its ID can be passed as
+// restore_backup_id when creating a VM on the control plane.
+type WorkspaceBackup struct {
+	ID        int64     `json:"id"`
+	Workspace string    `json:"workspace"`
+	SizeBytes int64     `json:"size_bytes"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
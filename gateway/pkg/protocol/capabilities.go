@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"errors"
+	"slices"
+)
+
+// Capability names an optional feature. Clients list the ones they support
+// in their hello; the gateway answers with the ones the session will use, so
+// it can adapt to each client instead of assuming the newest app.
+type Capability string
+
+const (
+	// CapabilityBinaryTerminal sends terminal output as binary frames,
+	// see EncodeTerminalFrame, instead of base64 in terminal_output
+	CapabilityBinaryTerminal Capability = "binary_terminal"
+
+	// CapabilityFileTransfer allows uploading and downloading files
+	CapabilityFileTransfer Capability = "file_transfer"
+
+	// CapabilityFlowControl lets the client pause and resume output
+	CapabilityFlowControl Capability = "flow_control"
+
+	// CapabilityProtobuf encodes messages as Protocol Buffers
+	CapabilityProtobuf Capability = "protobuf"
+
+	// CapabilityDictionary compresses small protobuf frames against the
+	// shared Dictionary
+	CapabilityDictionary Capability = "zstd_dictionary"
+
+	// CapabilityChatPlans puts the plans of planning backends to the client
+	// for approval as chat_plan messages; without it they run as drafted
+	CapabilityChatPlans Capability = "chat_plans"
+
+	// CapabilityCommandApprovals asks the client to approve commands the
+	// gateway's guardrails want confirmed, as command_approval messages;
+	// without it such commands are refused
+	CapabilityCommandApprovals Capability = "command_approvals"
+
+	// CapabilityCollaboration shows the client the prompts other
+	// participants send to the assistant, and its replies, as chat_shared
+	// messages
+	CapabilityCollaboration Capability = "collaboration"
+
+	// CapabilityNotifications passes the client the desktop notifications
+	// programs in terminals ask for, as notification messages
+	CapabilityNotifications Capability = "notifications"
+)
+
+// NegotiateCapabilities returns the capabilities both sides support, in the
+// gateway's order. Names the gateway does not know are ignored.
+func NegotiateCapabilities(client, gateway []Capability) []Capability {
+	offered := make(map[Capability]bool, len(client))
+	for _, c := range client {
+		offered[c] = true
+	}
+
+	var agreed []Capability
+	for _, c := range gateway {
+		if offered[c] {
+			agreed = append(agreed, c)
+			offered[c] = false
+		}
+	}
+	return agreed
+}
+
+// maxTerminalIDLen is the longest terminal ID a binary frame can carry
+const maxTerminalIDLen = 255
+
+// EncodeTerminalFrame builds the binary frame carrying a chunk of terminal
+// output for clients with CapabilityBinaryTerminal:
+// [1 byte ID length][terminal ID][output]
+func EncodeTerminalFrame(terminalID string, data []byte) ([]byte, error) {
+	return AppendTerminalFrame(nil, terminalID, data)
+}
+
+// AppendTerminalFrame appends the frame EncodeTerminalFrame builds to dst
+func AppendTerminalFrame(dst []byte, terminalID string, data []byte) ([]byte, error) {
+	if len(terminalID) == 0 || len(terminalID) > maxTerminalIDLen {
+		return dst, errors.New("terminal ID must be 1 to 255 bytes")
+	}
+	dst = slices.Grow(dst, 1+len(terminalID)+len(data))
+	dst = append(dst, byte(len(terminalID)))
+	dst = append(dst, terminalID...)
+	return append(dst, data...), nil
+}
+
+// DecodeTerminalFrame splits a frame built by EncodeTerminalFrame
+func DecodeTerminalFrame(frame []byte) (terminalID string, data []byte, err error) {
+	if len(frame) == 0 || frame[0] == 0 || len(frame) < 1+int(frame[0]) {
+		return "", nil, errors.New("truncated terminal frame")
+	}
+	n := 1 + int(frame[0])
+	return string(frame[1:n]), frame[n:], nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	gateway := []Capability{CapabilityBinaryTerminal, CapabilityFlowControl}
+	client := []Capability{CapabilityProtobuf, CapabilityFlowControl, "teleport", CapabilityBinaryTerminal, CapabilityFlowControl}
+
+	got := NegotiateCapabilities(client, gateway)
+	if want := []Capability{CapabilityBinaryTerminal, CapabilityFlowControl}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := NegotiateCapabilities(nil, gateway); len(got) != 0 {
+		t.Fatalf("a client without capabilities got %v", got)
+	}
+}
+
+func TestTerminalFrame(t *testing.T) {
+	frame, err := EncodeTerminalFrame("term-1", []byte("ls\r\n\x1b[0m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, data, err := DecodeTerminalFrame(frame)
+	if err != nil || id != "term-1" || !bytes.Equal(data, []byte("ls\r\n\x1b[0m")) {
+		t.Fatalf("round trip gave %q %q %v", id, data, err)
+	}
+
+	if _, err := EncodeTerminalFrame(string(make([]byte, 256)), nil); err == nil {
+		t.Fatal("expected an error for a 256 byte ID")
+	}
+	for _, frame := range [][]byte{nil, {0}, {5, 'a', 'b'}} {
+		if _, _, err := DecodeTerminalFrame(frame); err == nil {
+			t.Fatalf("expected an error for %v", frame)
+		}
+	}
+}
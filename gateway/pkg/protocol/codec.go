@@ -1,11 +1,13 @@
 package protocol
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/klauspost/compress/zstd"
 	"google.golang.org/protobuf/proto"
@@ -23,21 +25,45 @@ const (
 	// Flags
 	flagCompressed = 0x01
 	flagBatch      = 0x02
+	flagDictionary = 0x04 // compressed against Dictionary
 	
 	// Limits
 	maxFrameSize = 1 << 20 // 1MB
 	minCompressSize = 1024 // Don't compress small messages
+
+	// maxPooledBuffer is the largest scratch buffer kept for reuse, so one
+	// large message does not pin its memory
+	maxPooledBuffer = 64 << 10
 )
 
 // Codec handles Protocol Buffer encoding/decoding with compression
 type Codec struct {
 	encoder *zstd.Encoder
 	decoder *zstd.Decoder
-	pool    sync.Pool
+	pool    sync.Pool // *[]byte scratch for marshalled and compressed messages
+
+	// dictEncoder compresses small messages against Dictionary, once the
+	// peer has said it has it
+	dictEncoder   *zstd.Encoder
+	useDictionary atomic.Bool
+
+	maxDecompressedSize int
+	budget              *decodeBudget
 }
 
-// NewCodec creates a new Protocol Buffer codec
-func NewCodec() (*Codec, error) {
+// NewCodec creates a new Protocol Buffer codec. Decoding is limited to
+// DefaultMaxDecompressedSize per frame and DefaultDecodeBudget per
+// DefaultDecodeBudgetWindow unless options say otherwise.
+func NewCodec(opts ...CodecOption) (*Codec, error) {
+	config := codecConfig{
+		maxDecompressedSize: DefaultMaxDecompressedSize,
+		budget:              DefaultDecodeBudget,
+		budgetWindow:        DefaultDecodeBudgetWindow,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
 	encoder, err := zstd.NewWriter(nil,
 		zstd.WithEncoderLevel(zstd.SpeedFastest),
 		zstd.WithEncoderConcurrency(1),
@@ -46,41 +72,78 @@ func NewCodec() (*Codec, error) {
 		return nil, fmt.Errorf("create zstd encoder: %w", err)
 	}
 
+	// Small frames are cheap to compress hard, and skip the checksum
+	// since the transport already has one
+	dictEncoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedBetterCompression),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderDict(Dictionary),
+		zstd.WithEncoderCRC(false),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create zstd dictionary encoder: %w", err)
+	}
+
+	// Frames name their dictionary, so one decoder reads both kinds
 	decoder, err := zstd.NewReader(nil,
 		zstd.WithDecoderConcurrency(1),
-		zstd.WithDecoderMaxMemory(32<<20), // 32MB max
+		zstd.WithDecoderMaxMemory(uint64(config.maxDecompressedSize)),
+		zstd.WithDecoderDicts(Dictionary),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("create zstd decoder: %w", err)
 	}
 
-	return &Codec{
-		encoder: encoder,
-		decoder: decoder,
+	c := &Codec{
+		encoder:     encoder,
+		decoder:     decoder,
+		dictEncoder: dictEncoder,
 		pool: sync.Pool{
 			New: func() interface{} {
-				return new(bytes.Buffer)
+				return new([]byte)
 			},
 		},
-	}, nil
+		maxDecompressedSize: config.maxDecompressedSize,
+		budget:              newDecodeBudget(config.budget, config.budgetWindow),
+	}
+	c.useDictionary.Store(config.dictionary)
+	return c, nil
+}
+
+// UseDictionary turns compressing small messages against Dictionary on or
+// off. Only turn it on once the peer has the dictionary, e.g. after it
+// announced CapabilityDictionary. Frames compressed with it are always
+// decoded.
+func (c *Codec) UseDictionary(on bool) {
+	c.useDictionary.Store(on)
 }
 
 // EncodeMessage encodes a message to wire format
 func (c *Codec) EncodeMessage(msg *Message) ([]byte, error) {
+	return c.AppendMessage(nil, msg)
+}
+
+// AppendMessage appends a message in wire format to dst and returns the
+// extended slice. Writers that reuse dst encode without allocating a frame
+// per message.
+func (c *Codec) AppendMessage(dst []byte, msg *Message) ([]byte, error) {
 	// Convert to protobuf
 	pbMsg, err := c.messageToProto(msg)
 	if err != nil {
-		return nil, fmt.Errorf("convert to proto: %w", err)
+		return dst, fmt.Errorf("convert to proto: %w", err)
 	}
 
-	// Marshal to bytes
-	data, err := proto.Marshal(pbMsg)
+	// Marshal into scratch space; the frame copies it
+	scratch := c.getBuffer()
+	defer c.putBuffer(scratch)
+	data, err := proto.MarshalOptions{}.MarshalAppend((*scratch)[:0], pbMsg)
 	if err != nil {
-		return nil, fmt.Errorf("marshal proto: %w", err)
+		return dst, fmt.Errorf("marshal proto: %w", err)
 	}
+	*scratch = data
 
 	// Frame the message
-	return c.frameMessage(data)
+	return c.appendFrame(dst, data)
 }
 
 // DecodeMessage decodes a message from wire format
@@ -100,6 +163,10 @@ func (c *Codec) DecodeMessage(data []byte) (*Message, error) {
 		payload = decompressed
 	}
 
+	if err := c.budget.spend(len(payload)); err != nil {
+		return nil, err
+	}
+
 	// Unmarshal protobuf
 	var pbMsg pb.Message
 	if err := proto.Unmarshal(payload, &pbMsg); err != nil {
@@ -110,6 +177,47 @@ func (c *Codec) DecodeMessage(data []byte) (*Message, error) {
 	return c.protoToMessage(&pbMsg)
 }
 
+// DecodeFrame decodes every message in a frame: one message, or several
+// from EncodeBatch
+func (c *Codec) DecodeFrame(data []byte) ([]*Message, error) {
+	if len(data) == 0 || data[0]&flagBatch == 0 {
+		msg, err := c.DecodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*Message{msg}, nil
+	}
+
+	payload, compressed, err := c.unframeMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("unframe batch: %w", err)
+	}
+	if compressed {
+		payload, err = c.decompress(payload)
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+	}
+	if err := c.budget.spend(len(payload)); err != nil {
+		return nil, err
+	}
+
+	var batch pb.BatchMessage
+	if err := proto.Unmarshal(payload, &batch); err != nil {
+		return nil, fmt.Errorf("unmarshal batch: %w", err)
+	}
+
+	messages := make([]*Message, len(batch.Messages))
+	for i, pbMsg := range batch.Messages {
+		msg, err := c.protoToMessage(pbMsg)
+		if err != nil {
+			return nil, fmt.Errorf("convert message %d: %w", i, err)
+		}
+		messages[i] = msg
+	}
+	return messages, nil
+}
+
 // EncodeBatch encodes multiple messages into a single frame
 func (c *Codec) EncodeBatch(messages []*Message) ([]byte, error) {
 	batch := &pb.BatchMessage{
@@ -124,18 +232,23 @@ func (c *Codec) EncodeBatch(messages []*Message) ([]byte, error) {
 		batch.Messages[i] = pbMsg
 	}
 
-	data, err := proto.Marshal(batch)
+	scratch := c.getBuffer()
+	defer c.putBuffer(scratch)
+	data, err := proto.MarshalOptions{}.MarshalAppend((*scratch)[:0], batch)
 	if err != nil {
 		return nil, fmt.Errorf("marshal batch: %w", err)
 	}
+	*scratch = data
+	if len(data) > c.maxDecompressedSize {
+		return nil, fmt.Errorf("batch too large: %d bytes", len(data))
+	}
 
 	// Always compress batches
-	compressed, err := c.compress(data)
-	if err != nil {
-		return nil, fmt.Errorf("compress batch: %w", err)
-	}
+	compressed := c.getBuffer()
+	defer c.putBuffer(compressed)
+	*compressed = c.encoder.EncodeAll(data, (*compressed)[:0])
 
-	return c.frameMessageWithFlags(compressed, flagBatch|flagCompressed)
+	return appendRawFrame(nil, *compressed, flagBatch|flagCompressed)
 }
 
 // Reader creates a message reader for streaming
@@ -154,45 +267,77 @@ func (c *Codec) Writer(w io.Writer) *MessageWriter {
 	}
 }
 
+// ToProto converts a message to its protobuf form without framing, for
+// transports such as gRPC that frame messages themselves
+func (c *Codec) ToProto(msg *Message) (*pb.Message, error) {
+	return c.messageToProto(msg)
+}
+
+// FromProto converts a protobuf message back to a domain message
+func (c *Codec) FromProto(pbMsg *pb.Message) (*Message, error) {
+	return c.protoToMessage(pbMsg)
+}
+
 // Internal methods
 
-func (c *Codec) frameMessage(data []byte) ([]byte, error) {
+// appendFrame frames a marshalled message, compressing it if that saves
+// enough, and appends the frame to dst
+func (c *Codec) appendFrame(dst, data []byte) ([]byte, error) {
+	if len(data) > c.maxDecompressedSize {
+		return dst, fmt.Errorf("message too large: %d bytes", len(data))
+	}
+
 	flags := byte(0)
 	payload := data
 
 	// Compress if beneficial
-	if len(data) > minCompressSize {
-		compressed, err := c.compress(data)
-		if err != nil {
-			return nil, err
-		}
-		if len(compressed) < len(data)*9/10 { // 10% savings
+	switch {
+	case len(data) > minCompressSize:
+		compressed := c.getBuffer()
+		defer c.putBuffer(compressed)
+		*compressed = c.encoder.EncodeAll(data, (*compressed)[:0])
+		if len(*compressed) < len(data)*9/10 { // 10% savings
 			flags |= flagCompressed
-			payload = compressed
+			payload = *compressed
+		}
+	case len(data) >= minDictionarySize && c.useDictionary.Load():
+		// Small messages share most of their bytes with the dictionary,
+		// so any saving is worth taking
+		compressed := c.getBuffer()
+		defer c.putBuffer(compressed)
+		*compressed = c.dictEncoder.EncodeAll(data, (*compressed)[:0])
+		if len(*compressed) < len(data) {
+			flags |= flagCompressed | flagDictionary
+			payload = *compressed
 		}
 	}
 
-	return c.frameMessageWithFlags(payload, flags)
+	return appendRawFrame(dst, payload, flags)
 }
 
-func (c *Codec) frameMessageWithFlags(payload []byte, flags byte) ([]byte, error) {
+// appendRawFrame appends the frame header and payload to dst, growing it at
+// most once
+func appendRawFrame(dst, payload []byte, flags byte) ([]byte, error) {
 	if len(payload) > maxFrameSize {
-		return nil, fmt.Errorf("message too large: %d bytes", len(payload))
+		return dst, fmt.Errorf("message too large: %d bytes", len(payload))
 	}
 
-	buf := c.pool.Get().(*bytes.Buffer)
-	defer c.pool.Put(buf)
-	buf.Reset()
+	dst = slices.Grow(dst, frameHeaderSize+len(payload))
+	dst = append(dst, flags)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	return append(dst, payload...), nil
+}
 
-	// Write header
-	buf.WriteByte(flags)
-	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
-	buf.Write(payload)
+// getBuffer returns scratch space from the pool; return it with putBuffer
+// once nothing refers to its contents
+func (c *Codec) getBuffer() *[]byte {
+	return c.pool.Get().(*[]byte)
+}
 
-	// Copy to new slice
-	result := make([]byte, buf.Len())
-	copy(result, buf.Bytes())
-	return result, nil
+func (c *Codec) putBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBuffer {
+		c.pool.Put(b)
+	}
 }
 
 func (c *Codec) unframeMessage(data []byte) (payload []byte, compressed bool, err error) {
@@ -204,7 +349,7 @@ func (c *Codec) unframeMessage(data []byte) (payload []byte, compressed bool, er
 	length := binary.BigEndian.Uint32(data[1:5])
 
 	if length > maxFrameSize {
-		return nil, false, fmt.Errorf("frame too large: %d bytes", length)
+		return nil, false, fmt.Errorf("%w: frame too large: %d bytes", ErrLimitExceeded, length)
 	}
 
 	if len(data) != int(frameHeaderSize+length) {
@@ -217,12 +362,12 @@ func (c *Codec) unframeMessage(data []byte) (payload []byte, compressed bool, er
 	return payload, compressed, nil
 }
 
-func (c *Codec) compress(data []byte) ([]byte, error) {
-	return c.encoder.EncodeAll(data, nil), nil
-}
-
 func (c *Codec) decompress(data []byte) ([]byte, error) {
-	return c.decoder.DecodeAll(data, nil)
+	decompressed, err := c.decoder.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w: decompressed frame exceeds %d bytes", ErrLimitExceeded, c.maxDecompressedSize)
+	}
+	return decompressed, err
 }
 
 func (c *Codec) messageToProto(msg *Message) (*pb.Message, error) {
@@ -234,10 +379,12 @@ func (c *Codec) messageToProto(msg *Message) (*pb.Message, error) {
 		RequiresAck:  msg.RequiresAck,
 		RetryCount:   int32(msg.RetryCount),
 		CorrelationId: msg.CorrelationID,
+		ProtocolVersion: uint32(msg.ProtocolVersion),
 	}
 
-	// Convert payload based on type
-	if msg.Payload != nil {
+	// Convert payload based on type. Types without an enum value travel in
+	// the payload's type URL, so they need a payload even when empty.
+	if msg.Payload != nil || pbMsg.Type == pb.MessageType_MESSAGE_TYPE_UNKNOWN {
 		any, err := c.payloadToAny(msg.Type, msg.Payload)
 		if err != nil {
 			return nil, fmt.Errorf("convert payload: %w", err)
@@ -257,15 +404,22 @@ func (c *Codec) protoToMessage(pbMsg *pb.Message) (*Message, error) {
 		RequiresAck:   pbMsg.RequiresAck,
 		RetryCount:    int(pbMsg.RetryCount),
 		CorrelationID: pbMsg.CorrelationId,
+		ProtocolVersion: int(pbMsg.ProtocolVersion),
 	}
 
 	// Convert payload based on type
 	if pbMsg.Payload != nil {
+		if pbMsg.Type == pb.MessageType_MESSAGE_TYPE_UNKNOWN && pbMsg.Payload.TypeUrl != "" {
+			msg.Type = MessageType(pbMsg.Payload.TypeUrl)
+		}
+		
 		payload, err := c.anyToPayload(msg.Type, pbMsg.Payload)
 		if err != nil {
 			return nil, fmt.Errorf("convert payload: %w", err)
 		}
-		msg.Payload = payload
+		if len(payload) > 0 {
+			msg.Payload = payload
+		}
 	}
 
 	return msg, nil
@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -228,4 +231,68 @@ func TestMessageSizeComparison(t *testing.T) {
 	t.Logf("JSON size: %d bytes", len(jsonData))
 	t.Logf("Protobuf size: %d bytes", len(protoData))
 	t.Logf("Size reduction: %.1f%%", (1-float64(len(protoData))/float64(len(jsonData)))*100)
-}
\ No newline at end of file
+}
+
+// BenchmarkStreamWriter writes terminal-sized messages through a
+// MessageWriter, which reuses its frame buffer and the codec's scratch
+// space, and through EncodeMessage, which allocates each frame
+func BenchmarkStreamWriter(b *testing.B) {
+	codec, err := NewCodec()
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := &Message{
+		ID:        uuid.New().String(),
+		Type:      "terminal_output",
+		Timestamp: time.Now(),
+		Payload:   []byte(`{"terminal_id":"3f1c9a4e","data":"` + strings.Repeat("bHMgLWxhDQo=", 40) + `"}`),
+	}
+
+	b.Run("encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := codec.EncodeMessage(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Discard.Write(data)
+		}
+	})
+	b.Run("writer", func(b *testing.B) {
+		w := codec.Writer(io.Discard)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := w.WriteMessage(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkStreamReader reads frames through one MessageReader, which reuses
+// its header and frame buffers
+func BenchmarkStreamReader(b *testing.B) {
+	codec, err := NewCodec()
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame, err := codec.EncodeMessage(&Message{
+		ID:        uuid.New().String(),
+		Type:      TypeChatStream,
+		Timestamp: time.Now(),
+		Payload:   []byte(`{"content": " fibonacci", "finished": false}`),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	stream := bytes.NewReader(nil)
+	r := codec.Reader(stream)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		stream.Reset(frame)
+		if _, err := r.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCodecPreservesTypesWithoutEnum(t *testing.T) {
+	codec, err := NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []*Message{
+		{ID: "1", Type: "terminal_output", Timestamp: time.Now(), Payload: []byte(`{"terminal_id":"t1"}`)},
+		{ID: "2", Type: "terminal_list", Timestamp: time.Now()},
+		{ID: "3", Type: TypePing, Timestamp: time.Now()},
+	}
+
+	for _, msg := range tests {
+		data, err := codec.EncodeMessage(msg)
+		if err != nil {
+			t.Fatalf("encode %s: %v", msg.Type, err)
+		}
+		decoded, err := codec.DecodeMessage(data)
+		if err != nil {
+			t.Fatalf("decode %s: %v", msg.Type, err)
+		}
+		if decoded.Type != msg.Type {
+			t.Errorf("type %q decoded as %q", msg.Type, decoded.Type)
+		}
+		if string(decoded.Payload) != string(msg.Payload) {
+			t.Errorf("%s payload %q decoded as %q", msg.Type, msg.Payload, decoded.Payload)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import "time"
+
+// Collaboration messages. Several users may be connected to one gateway;
+// they share its terminals and, per workspace, the assistant's
+// conversation.
+const (
+	// TypeParticipants asks who is connected; the gateway replies with
+	// Participants
+	TypeParticipants MessageType = "participants"
+	// TypeChatShared shows a prompt another participant sent, or the
+	// assistant's reply to it
+	TypeChatShared MessageType = "chat_shared"
+
+	// TypePresence tells the gateway what the user is doing: typing in a
+	// chat, or working in a terminal
+	TypePresence MessageType = "presence"
+	// TypePresenceChanged tells the other participants a session joined,
+	// left or changed its presence
+	TypePresenceChanged MessageType = "presence_changed"
+)
+
+// Presence events
+const (
+	PresenceJoined  = "joined"
+	PresenceLeft    = "left"
+	PresenceUpdated = "updated"
+)
+
+// Participant is one connected session. ID tells apart sessions of the
+// same user; User is the user its connect token was issued to, empty on
+// gateways that require no token.
+type Participant struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user,omitempty"`
+	Transport   string    `json:"transport"`
+	ReadOnly    bool      `json:"read_only,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+
+	// Terminals the session is attached to
+	Terminals []string `json:"terminals,omitempty"`
+
+	// Self marks the session that asked
+	Self bool `json:"self,omitempty"`
+
+	PresenceUpdate
+}
+
+// PresenceUpdate is what a participant is doing. Each update replaces the
+// previous one.
+type PresenceUpdate struct {
+	// Typing says the user is writing a chat message in Workspace. It is
+	// cleared when the message is sent.
+	Typing    bool   `json:"typing,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+
+	// ActiveTerminal is the terminal the user is looking at. Typing into
+	// a terminal makes it the active one.
+	ActiveTerminal string `json:"active_terminal,omitempty"`
+}
+
+// PresenceChanged is a participant that joined, left or was updated
+type PresenceChanged struct {
+	Event       string      `json:"event"`
+	Participant Participant `json:"participant"`
+}
+
+// Participants lists the connected sessions, in the order they connected
+type Participants struct {
+	Participants []Participant `json:"participants"`
+}
+
+// ChatShared is a prompt another participant sent to the assistant, with
+// Role user, or the assistant's finished reply to it. Both carry the
+// prompt's request ID as their correlation ID.
+type ChatShared struct {
+	Author    string `json:"author,omitempty"`
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	Workspace string `json:"workspace,omitempty"`
+	WorkDir   string `json:"work_dir,omitempty"`
+
+	// MessageID identifies the reply in the conversation, for branching
+	MessageID string `json:"message_id,omitempty"`
+
+	// Error is why the reply failed, if it did
+	Error string `json:"error,omitempty"`
+}
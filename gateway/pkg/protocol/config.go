@@ -0,0 +1,40 @@
+package protocol
+
+// TypeChatConfig changes the chat backend at runtime. The gateway replies
+// with a chat_config message carrying a ChatConfigStatus, or a chat_error if
+// the change is invalid.
+const TypeChatConfig MessageType = "chat_config"
+
+// Chat backends
+const (
+	BackendAider        = "aider"
+	BackendMock         = "mock"
+	BackendUnconfigured = "unconfigured"
+)
+
+// ChatConfig selects and configures the chat backend. In a chat_config
+// message only the fields that are set change; an empty API key removes it.
+type ChatConfig struct {
+	Backend string            `json:"backend,omitempty"`  // aider or mock
+	Model   string            `json:"model,omitempty"`    // default depends on the API keys
+	APIKeys map[string]string `json:"api_keys,omitempty"` // by environment variable, e.g. ANTHROPIC_API_KEY
+
+	// Parallelism is how many chat requests the backend serves at once, if
+	// it can serve more than one. Aider, behind a single PTY, cannot.
+	Parallelism int `json:"parallelism,omitempty"`
+
+	// PlannerModel, if set, has a second aider with this model draft a
+	// plan for each request, which the backend's model then carries out
+	// step by step once the user approves it
+	PlannerModel string `json:"planner_model,omitempty"`
+}
+
+// ChatConfigStatus describes the backend after a change. It never includes
+// API keys.
+type ChatConfigStatus struct {
+	Backend      string   `json:"backend"` // aider, mock or unconfigured
+	Model        string   `json:"model,omitempty"`
+	PlannerModel string   `json:"planner_model,omitempty"`
+	APIKeys      []string `json:"api_keys,omitempty"` // names of the keys that are set
+	Problems     []string `json:"problems,omitempty"` // why the backend is unconfigured
+}
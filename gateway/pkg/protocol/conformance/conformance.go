@@ -0,0 +1,82 @@
+// Package conformance lets client implementations check that they speak the
+// gateway protocol correctly. It has golden encodings of each message type
+// (see Fixtures) and a Server that runs scripted scenarios over a WebSocket
+// and reports whether the client behaved.
+//
+// A client connects to /ws?scenario=<name>&encoding=<json|protobuf>. The
+// server first sends a conformance_hello naming the scenario and session,
+// runs the scenario, then sends a conformance_result and closes the
+// connection. In every scenario the client must:
+//
+//   - acknowledge each message with requires_ack set, including
+//     retransmissions, with an ack whose message_id and seq_num match it
+//   - deliver chat_stream messages to the application in seq_num order,
+//     once each, however they arrive
+//   - when a chat_stream with finished set is delivered, reply with a chat
+//     message whose content lists the content of every chat_stream
+//     delivered in the session so far, comma separated
+//   - answer ping with pong
+//
+// With the json encoding every WebSocket text frame holds one message or a
+// JSON array of messages. With protobuf every binary frame is framed by
+// protocol.Codec and holds one message or a batch.
+package conformance
+
+import (
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// Encoding is how messages are written on the WebSocket
+type Encoding string
+
+const (
+	// EncodingJSON sends JSON text frames, as the gateway's /ws endpoint does
+	EncodingJSON Encoding = "json"
+
+	// EncodingProtobuf sends binary frames encoded by protocol.Codec
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Scenarios
+const (
+	// ScenarioOrdering sends messages out of order and repeats one; the
+	// client must deliver each once, in seq_num order
+	ScenarioOrdering = "ordering"
+
+	// ScenarioAcks withholds progress until every reliable message is
+	// acknowledged, retransmitting ones that are not
+	ScenarioAcks = "acks"
+
+	// ScenarioReconnect drops the connection mid-stream. The client must
+	// reconnect with ?session=<id>, send a reconnect message carrying the
+	// highest seq_num it delivered, and receive the rest without duplicates.
+	ScenarioReconnect = "reconnect"
+
+	// ScenarioBatching sends several messages in one frame
+	ScenarioBatching = "batching"
+)
+
+// Scenarios lists every scenario the server runs
+var Scenarios = []string{ScenarioOrdering, ScenarioAcks, ScenarioReconnect, ScenarioBatching}
+
+// Message types used only by the conformance server
+const (
+	TypeHello  protocol.MessageType = "conformance_hello"
+	TypeResult protocol.MessageType = "conformance_result"
+)
+
+// Hello opens every conformance connection
+type Hello struct {
+	Scenario  string `json:"scenario"`
+	SessionID string `json:"session_id"`
+	Resumed   bool   `json:"resumed,omitempty"`
+}
+
+// Result reports whether the client passed a scenario
+type Result struct {
+	Scenario  string   `json:"scenario"`
+	Encoding  Encoding `json:"encoding"`
+	SessionID string   `json:"session_id"`
+	Passed    bool     `json:"passed"`
+	Failures  []string `json:"failures,omitempty"`
+}
@@ -0,0 +1,181 @@
+package conformance
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// Golden files live in fixtures/<name>.json and fixtures/<name>.bin, so
+// client test suites in other languages can load them directly
+//
+//go:embed fixtures
+var fixtureFiles embed.FS
+
+// Fixture is a message, or a batch of messages, with its golden encodings
+type Fixture struct {
+	Name     string
+	Messages []*protocol.Message
+
+	// JSON is one message object, or an array for a batch
+	JSON []byte
+
+	// Protobuf is a frame as written by protocol.Codec. Batch frames are
+	// compressed, so encoders may produce different bytes that decode to
+	// the same messages.
+	Protobuf []byte
+}
+
+// Batch reports whether the fixture holds several messages in one frame
+func (f Fixture) Batch() bool {
+	return len(f.Messages) > 1
+}
+
+// fixtureTime keeps golden encodings stable
+var fixtureTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fixtureMessages defines every fixture, in the order Fixtures returns them
+func fixtureMessages() []struct {
+	name     string
+	messages []*protocol.Message
+} {
+	payload := func(v interface{}) json.RawMessage {
+		data, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+	maintenanceStart := time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC)
+	maintenanceEnd := maintenanceStart.Add(30 * time.Minute)
+	stream := func(seq uint64, content string, finished bool) *protocol.Message {
+		return &protocol.Message{
+			ID:            fmt.Sprintf("stream-%d", seq),
+			Type:          protocol.TypeChatStream,
+			Timestamp:     fixtureTime,
+			Payload:       payload(protocol.ChatReply{Content: content, Finished: finished}),
+			SeqNum:        seq,
+			RequiresAck:   true,
+			CorrelationID: "chat-1",
+		}
+	}
+
+	return []struct {
+		name     string
+		messages []*protocol.Message
+	}{
+		{"ping", []*protocol.Message{{ID: "ping-1", Type: protocol.TypePing, Timestamp: fixtureTime}}},
+		{"pong", []*protocol.Message{{ID: "pong-1", Type: protocol.TypePong, Timestamp: fixtureTime}}},
+		{"chat", []*protocol.Message{{
+			ID:          "chat-1",
+			Type:        protocol.TypeChat,
+			Timestamp:   fixtureTime,
+			Payload:     payload(protocol.ChatMessage{Role: "user", Content: "list the files"}),
+			RequiresAck: true,
+		}}},
+		{"chat_stream", []*protocol.Message{stream(7, "Here are the files", false)}},
+		{"chat_error", []*protocol.Message{{
+			ID:        "chat-1",
+			Type:      protocol.TypeChatError,
+			Timestamp: fixtureTime,
+			Payload:   payload(protocol.ChatError{Error: "aider is not running", Code: "chat_error", Retryable: true}),
+		}}},
+		{"ack", []*protocol.Message{{
+			ID:            "ack-1",
+			Type:          protocol.TypeAck,
+			Timestamp:     fixtureTime,
+			Payload:       payload(protocol.AckMessage{MessageID: "stream-7", SeqNum: 7}),
+			CorrelationID: "stream-7",
+		}}},
+		{"reconnect", []*protocol.Message{{
+			ID:        "reconnect-1",
+			Type:      protocol.TypeReconnect,
+			Timestamp: fixtureTime,
+			Payload:   payload(protocol.ReconnectMessage{LastSeqNum: 42, SessionID: "session-1"}),
+		}}},
+		{"queue_stats", []*protocol.Message{{
+			ID:        "stats-1",
+			Type:      protocol.TypeQueueStats,
+			Timestamp: fixtureTime,
+			Payload: payload(protocol.QueueStats{
+				SessionID:        "session-1",
+				Pending:          2,
+				InFlight:         1,
+				Retries:          3,
+				OldestInFlightMs: 1500,
+			}),
+		}}},
+		{"session_revoked", []*protocol.Message{{
+			ID:        "revoked-1",
+			Type:      protocol.TypeSessionRevoked,
+			Timestamp: fixtureTime,
+			Payload:   payload(protocol.SessionRevoked{Reason: "connect token revoked"}),
+		}}},
+		{"announcement", []*protocol.Message{{
+			ID:          "announcement-1",
+			Type:        protocol.TypeAnnouncement,
+			Timestamp:   fixtureTime,
+			RequiresAck: true,
+			Payload: payload(protocol.Announcement{
+				ID:        "a1b2c3",
+				Kind:      protocol.AnnouncementMaintenance,
+				Message:   "Gateways restart on Saturday from 02:00 to 02:30 UTC",
+				StartsAt:  &maintenanceStart,
+				EndsAt:    &maintenanceEnd,
+				ExpiresAt: maintenanceEnd,
+			}),
+		}}},
+		{"suspend_scheduled", []*protocol.Message{{
+			ID:          "suspend-1",
+			Type:        protocol.TypeSuspendScheduled,
+			Timestamp:   fixtureTime,
+			RequiresAck: true,
+			Payload: payload(protocol.SuspendScheduled{
+				ID:          "d4e5f6",
+				Reason:      protocol.SuspendIdle,
+				SuspendAt:   fixtureTime.Add(5 * time.Minute),
+				SecondsLeft: 300,
+				ResumeHint:  "Open the VM in the dashboard to resume it",
+			}),
+		}}},
+		{"terminal_output", []*protocol.Message{{
+			ID:        "output-1",
+			Type:      "terminal_output",
+			Timestamp: fixtureTime,
+			Payload:   json.RawMessage(`{"terminal_id":"term-1","data":"bHMK"}`),
+		}}},
+		{"batch", []*protocol.Message{
+			stream(1, "first", false),
+			stream(2, "second", false),
+			stream(3, "third", true),
+		}},
+	}
+}
+
+// Fixtures returns every golden fixture
+func Fixtures() ([]Fixture, error) {
+	defs := fixtureMessages()
+	fixtures := make([]Fixture, 0, len(defs))
+
+	for _, def := range defs {
+		jsonData, err := fixtureFiles.ReadFile("fixtures/" + def.name + ".json")
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", def.name, err)
+		}
+		protoData, err := fixtureFiles.ReadFile("fixtures/" + def.name + ".bin")
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", def.name, err)
+		}
+
+		fixtures = append(fixtures, Fixture{
+			Name:     def.name,
+			Messages: def.messages,
+			JSON:     jsonData,
+			Protobuf: protoData,
+		})
+	}
+	return fixtures, nil
+}
@@ -0,0 +1,107 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden fixtures")
+
+func TestFixtures(t *testing.T) {
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		for _, def := range fixtureMessages() {
+			jsonData, protoData, err := encodeFixture(codec, def.messages)
+			if err != nil {
+				t.Fatalf("encode %s: %v", def.name, err)
+			}
+			if err := os.WriteFile(filepath.Join("fixtures", def.name+".json"), jsonData, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join("fixtures", def.name+".bin"), protoData, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Skip("fixtures updated; rerun without -update")
+	}
+
+	fixtures, err := Fixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			jsonData, protoData, err := encodeFixture(codec, f.Messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(jsonData, f.JSON) {
+				t.Errorf("JSON encoding changed:\n got %s\nwant %s", jsonData, f.JSON)
+			}
+			// Compressed batches may differ between encoder versions
+			if !f.Batch() && !bytes.Equal(protoData, f.Protobuf) {
+				t.Errorf("protobuf encoding changed:\n got %x\nwant %x", protoData, f.Protobuf)
+			}
+
+			var fromJSON []*protocol.Message
+			if f.Batch() {
+				err = json.Unmarshal(f.JSON, &fromJSON)
+			} else {
+				var msg protocol.Message
+				err = json.Unmarshal(f.JSON, &msg)
+				fromJSON = []*protocol.Message{&msg}
+			}
+			if err != nil {
+				t.Fatalf("decode JSON: %v", err)
+			}
+			assertMessages(t, "JSON", fromJSON, f.Messages)
+
+			fromProto, err := codec.DecodeFrame(f.Protobuf)
+			if err != nil {
+				t.Fatalf("decode protobuf: %v", err)
+			}
+			assertMessages(t, "protobuf", fromProto, f.Messages)
+		})
+	}
+}
+
+func assertMessages(t *testing.T, encoding string, got, want []*protocol.Message) {
+	t.Helper()
+
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("%s fixture decoded to\n %s\nwant\n %s", encoding, gotJSON, wantJSON)
+	}
+}
+
+// encodeFixture produces a fixture's golden files
+func encodeFixture(codec *protocol.Codec, messages []*protocol.Message) (jsonData, protoData []byte, err error) {
+	if len(messages) == 1 {
+		jsonData, err = json.Marshal(messages[0])
+		if err == nil {
+			protoData, err = codec.EncodeMessage(messages[0])
+		}
+	} else {
+		jsonData, err = json.Marshal(messages)
+		if err == nil {
+			protoData, err = codec.EncodeBatch(messages)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(jsonData, '\n'), protoData, nil
+}
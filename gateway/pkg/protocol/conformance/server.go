@@ -0,0 +1,687 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultStepTimeout bounds each step the client must take, such as
+	// acknowledging a message or reconnecting
+	DefaultStepTimeout = 5 * time.Second
+
+	// DefaultAckTimeout is how long the server waits for an ack before
+	// retransmitting, as the gateway's queue does
+	DefaultAckTimeout = time.Second
+
+	writeTimeout = 10 * time.Second
+)
+
+// errResumeLater ends the first connection of the reconnect scenario
+var errResumeLater = errors.New("waiting for the client to reconnect")
+
+// Server runs conformance scenarios against clients. It is an http.Handler
+// for the /ws endpoint.
+type Server struct {
+	codec       *protocol.Codec
+	upgrader    websocket.Upgrader
+	stepTimeout time.Duration
+	ackTimeout  time.Duration
+	onResult    func(Result)
+
+	mu       sync.Mutex
+	sessions map[string]*session // waiting for a reconnect
+	results  []Result
+}
+
+// ServerOption configures a Server
+type ServerOption func(*Server)
+
+// WithStepTimeout sets how long the client has for each step
+func WithStepTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.stepTimeout = d
+	}
+}
+
+// WithAckTimeout sets how long the server waits before retransmitting
+func WithAckTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ackTimeout = d
+	}
+}
+
+// WithResultHandler calls fn with each scenario's result as it finishes
+func WithResultHandler(fn func(Result)) ServerOption {
+	return func(s *Server) {
+		s.onResult = fn
+	}
+}
+
+// NewServer creates a conformance server
+func NewServer(opts ...ServerOption) (*Server, error) {
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		codec:       codec,
+		stepTimeout: DefaultStepTimeout,
+		ackTimeout:  DefaultAckTimeout,
+		sessions:    make(map[string]*session),
+		upgrader: websocket.Upgrader{
+			// Test clients connect from anywhere
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Results returns the result of every scenario run so far
+func (s *Server) Results() []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Result(nil), s.results...)
+}
+
+func (s *Server) record(result Result) {
+	s.mu.Lock()
+	s.results = append(s.results, result)
+	s.mu.Unlock()
+
+	if s.onResult != nil {
+		s.onResult(result)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	scenario := query.Get("scenario")
+	if !validScenario(scenario) {
+		http.Error(w, fmt.Sprintf("unknown scenario %q, use one of %s", scenario, strings.Join(Scenarios, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	encoding := Encoding(query.Get("encoding"))
+	switch encoding {
+	case "":
+		encoding = EncodingJSON
+	case EncodingJSON, EncodingProtobuf:
+	default:
+		http.Error(w, fmt.Sprintf("unknown encoding %q, use json or protobuf", encoding), http.StatusBadRequest)
+		return
+	}
+
+	st := &session{
+		id:       uuid.New().String(),
+		scenario: scenario,
+		encoding: encoding,
+		acks:     make(map[string]int),
+	}
+	if id := query.Get("session"); id != "" {
+		if st = s.resume(id, scenario); st == nil {
+			http.Error(w, "no session waiting to be resumed", http.StatusNotFound)
+			return
+		}
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := newConn(ws, st.encoding, s.codec, st)
+	defer c.close()
+
+	s.run(c, st)
+}
+
+func validScenario(name string) bool {
+	for _, scenario := range Scenarios {
+		if name == scenario {
+			return true
+		}
+	}
+	return false
+}
+
+// resume takes a session waiting for its client to reconnect
+func (s *Server) resume(id, scenario string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.sessions[id]
+	if !ok || st.scenario != scenario {
+		return nil
+	}
+	delete(s.sessions, id)
+	st.resumeTimer.Stop()
+	st.resumed = true
+	return st
+}
+
+// awaitResume keeps the session for the client's reconnect, failing the
+// scenario if it does not come in time
+func (s *Server) awaitResume(st *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[st.id] = st
+	st.resumeTimer = time.AfterFunc(s.stepTimeout, func() {
+		s.mu.Lock()
+		_, waiting := s.sessions[st.id]
+		delete(s.sessions, st.id)
+		s.mu.Unlock()
+
+		if waiting {
+			st.fail("client did not reconnect within %s", s.stepTimeout)
+			s.record(st.result())
+		}
+	})
+}
+
+func (s *Server) run(c *conn, st *session) {
+	hello, _ := json.Marshal(Hello{Scenario: st.scenario, SessionID: st.id, Resumed: st.resumed})
+	if err := c.send(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      TypeHello,
+		Timestamp: time.Now(),
+		Payload:   hello,
+	}); err != nil {
+		return
+	}
+
+	var err error
+	switch st.scenario {
+	case ScenarioOrdering:
+		err = s.runOrdering(c, st)
+	case ScenarioAcks:
+		err = s.runAcks(c, st)
+	case ScenarioReconnect:
+		err = s.runReconnect(c, st)
+	case ScenarioBatching:
+		err = s.runBatching(c, st)
+	}
+	if err == errResumeLater {
+		return
+	}
+	if err != nil {
+		st.fail("%v", err)
+	}
+
+	result := st.result()
+	s.record(result)
+
+	payload, _ := json.Marshal(result)
+	c.send(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      TypeResult,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+// runOrdering sends 1, 2, 4, 3, a retransmission of 3, then 5
+func (s *Server) runOrdering(c *conn, st *session) error {
+	messages := st.newStream(5, true)
+
+	retry := *messages[2]
+	retry.RetryCount = 1
+
+	for _, msg := range []*protocol.Message{messages[0], messages[1], messages[3], messages[2], &retry, messages[4]} {
+		if err := c.send(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := s.expectEcho(c, st); err != nil {
+		return err
+	}
+	return s.expectAcked(c, st, messages)
+}
+
+// runAcks retransmits whatever is not acknowledged in time, and message 2
+// regardless, which the client must acknowledge again
+func (s *Server) runAcks(c *conn, st *session) error {
+	messages := st.newStream(3, false)
+	for _, msg := range messages {
+		if err := c.send(msg); err != nil {
+			return err
+		}
+	}
+
+	if err := c.await(s.ackTimeout, func(*protocol.Message) bool { return st.allAcked(messages) }); err != nil && !errors.Is(err, errTimeout) {
+		return err
+	}
+
+	retransmit := []*protocol.Message{messages[1]}
+	for _, msg := range messages {
+		if msg != messages[1] && st.acks[msg.ID] == 0 {
+			retransmit = append(retransmit, msg)
+		}
+	}
+	for _, msg := range retransmit {
+		retry := *msg
+		retry.RetryCount++
+		if err := c.send(&retry); err != nil {
+			return err
+		}
+	}
+
+	secondAck := func(*protocol.Message) bool {
+		return st.allAcked(messages) && st.acks[messages[1].ID] >= 2
+	}
+	if err := c.await(s.stepTimeout, secondAck); err != nil {
+		if errors.Is(err, errTimeout) {
+			if st.acks[messages[1].ID] < 2 {
+				st.fail("retransmission of %s was not acknowledged again", messages[1].ID)
+			}
+			return s.expectAcked(c, st, messages)
+		}
+		return err
+	}
+
+	final := st.newMessage(true)
+	if err := c.send(final); err != nil {
+		return err
+	}
+	if err := s.expectEcho(c, st); err != nil {
+		return err
+	}
+	return s.expectAcked(c, st, st.stream)
+}
+
+// runReconnect drops the connection after sending 5 messages, of which
+// the client has acknowledged at least 3, then resumes on a new connection
+func (s *Server) runReconnect(c *conn, st *session) error {
+	if !st.resumed {
+		first := st.newStream(3, false)
+		for _, msg := range first {
+			if err := c.send(msg); err != nil {
+				return err
+			}
+		}
+		if err := s.expectAcked(c, st, first); err != nil {
+			return err
+		}
+
+		for _, msg := range []*protocol.Message{st.newMessage(false), st.newMessage(false)} {
+			if err := c.send(msg); err != nil {
+				return err
+			}
+		}
+
+		// Drop the connection without a close frame, like a network change
+		s.awaitResume(st)
+		c.ws.Close()
+		return errResumeLater
+	}
+
+	var reconnect protocol.ReconnectMessage
+	err := c.await(s.stepTimeout, func(msg *protocol.Message) bool {
+		if msg == nil || msg.Type != protocol.TypeReconnect {
+			return false
+		}
+		if err := json.Unmarshal(msg.Payload, &reconnect); err != nil {
+			st.fail("invalid reconnect payload: %v", err)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("no reconnect message after resuming: %w", err)
+	}
+
+	if reconnect.SessionID != st.id {
+		st.fail("reconnect names session %q, want %q", reconnect.SessionID, st.id)
+	}
+	if reconnect.LastSeqNum < 3 || reconnect.LastSeqNum > 5 {
+		st.fail("reconnect carries last_seq_num %d, want the last delivered message, between 3 and 5", reconnect.LastSeqNum)
+	}
+
+	// Everything up to last_seq_num is acknowledged by the reconnect
+	var replay []*protocol.Message
+	for _, msg := range st.stream {
+		if msg.SeqNum <= reconnect.LastSeqNum {
+			st.acks[msg.ID]++
+			continue
+		}
+		retry := *msg
+		retry.RetryCount++
+		replay = append(replay, &retry)
+	}
+	replay = append(replay, st.newMessage(true))
+
+	for _, msg := range replay {
+		if err := c.send(msg); err != nil {
+			return err
+		}
+	}
+	if err := s.expectEcho(c, st); err != nil {
+		return err
+	}
+	return s.expectAcked(c, st, st.stream)
+}
+
+// runBatching sends five messages in one frame
+func (s *Server) runBatching(c *conn, st *session) error {
+	messages := st.newStream(5, true)
+	if err := c.send(messages...); err != nil {
+		return err
+	}
+	if err := s.expectEcho(c, st); err != nil {
+		return err
+	}
+	return s.expectAcked(c, st, messages)
+}
+
+// expectEcho waits for the chat listing every delivered message
+func (s *Server) expectEcho(c *conn, st *session) error {
+	want := make([]string, len(st.stream))
+	for i, msg := range st.stream {
+		want[i] = strconv.FormatUint(msg.SeqNum, 10)
+	}
+
+	var got protocol.ChatMessage
+	err := c.await(s.stepTimeout, func(msg *protocol.Message) bool {
+		if msg == nil || msg.Type != protocol.TypeChat {
+			return false
+		}
+		if err := json.Unmarshal(msg.Payload, &got); err != nil {
+			st.fail("invalid chat payload: %v", err)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("no chat listing the delivered messages: %w", err)
+	}
+
+	if got.Content != strings.Join(want, ",") {
+		st.fail("client delivered %q, want %q", got.Content, strings.Join(want, ","))
+	}
+	return nil
+}
+
+// expectAcked waits for every message to be acknowledged
+func (s *Server) expectAcked(c *conn, st *session, messages []*protocol.Message) error {
+	err := c.await(s.stepTimeout, func(*protocol.Message) bool { return st.allAcked(messages) })
+	if errors.Is(err, errTimeout) {
+		var missing []string
+		for _, msg := range messages {
+			if st.acks[msg.ID] == 0 {
+				missing = append(missing, msg.ID)
+			}
+		}
+		st.fail("messages never acknowledged: %s", strings.Join(missing, ", "))
+		return nil
+	}
+	return err
+}
+
+// session is one scenario run, which may span connections
+type session struct {
+	id       string
+	scenario string
+	encoding Encoding
+	resumed  bool
+
+	stream   []*protocol.Message // chat_stream messages sent, by seq_num
+	acks     map[string]int      // acks received, by message ID
+	failures []string
+
+	resumeTimer *time.Timer
+}
+
+func (st *session) fail(format string, args ...interface{}) {
+	st.failures = append(st.failures, fmt.Sprintf(format, args...))
+}
+
+func (st *session) result() Result {
+	return Result{
+		Scenario:  st.scenario,
+		Encoding:  st.encoding,
+		SessionID: st.id,
+		Passed:    len(st.failures) == 0,
+		Failures:  st.failures,
+	}
+}
+
+// newStream creates n chat_stream messages, finishing the stream with the
+// last one if finish is set
+func (st *session) newStream(n int, finish bool) []*protocol.Message {
+	messages := make([]*protocol.Message, n)
+	for i := range messages {
+		messages[i] = st.newMessage(finish && i == n-1)
+	}
+	return messages
+}
+
+// newMessage creates the next chat_stream message. Its content is its
+// seq_num, so the client's echo shows what it delivered.
+func (st *session) newMessage(finished bool) *protocol.Message {
+	seq := uint64(len(st.stream) + 1)
+	payload, _ := json.Marshal(protocol.ChatReply{
+		Content:  strconv.FormatUint(seq, 10),
+		Finished: finished,
+	})
+
+	msg := &protocol.Message{
+		ID:            fmt.Sprintf("%s-%d", st.scenario, seq),
+		Type:          protocol.TypeChatStream,
+		Timestamp:     time.Now(),
+		Payload:       payload,
+		SeqNum:        seq,
+		RequiresAck:   true,
+		CorrelationID: st.id,
+	}
+	st.stream = append(st.stream, msg)
+	return msg
+}
+
+func (st *session) allAcked(messages []*protocol.Message) bool {
+	for _, msg := range messages {
+		if st.acks[msg.ID] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// handleAck checks an ack against the message it acknowledges
+func (st *session) handleAck(msg *protocol.Message) {
+	var ack protocol.AckMessage
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		st.fail("invalid ack payload: %v", err)
+		return
+	}
+
+	i := 0
+	for ; i < len(st.stream); i++ {
+		if st.stream[i].ID == ack.MessageID {
+			break
+		}
+	}
+	if i == len(st.stream) {
+		st.fail("ack for unknown message %q", ack.MessageID)
+		return
+	}
+
+	if sent := st.stream[i]; ack.SeqNum != sent.SeqNum {
+		st.fail("ack for %s carries seq_num %d, want %d", sent.ID, ack.SeqNum, sent.SeqNum)
+	}
+	st.acks[ack.MessageID]++
+}
+
+var errTimeout = errors.New("timed out")
+
+// conn reads and writes protocol messages on one WebSocket connection
+type conn struct {
+	ws       *websocket.Conn
+	encoding Encoding
+	codec    *protocol.Codec
+	st       *session
+
+	inbound chan *protocol.Message
+	readErr error // set before inbound is closed
+}
+
+func newConn(ws *websocket.Conn, encoding Encoding, codec *protocol.Codec, st *session) *conn {
+	c := &conn{
+		ws:       ws,
+		encoding: encoding,
+		codec:    codec,
+		st:       st,
+		inbound:  make(chan *protocol.Message, 64),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *conn) readLoop() {
+	defer close(c.inbound)
+
+	for {
+		frameType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+
+		messages, err := c.decode(frameType, data)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		for _, msg := range messages {
+			c.inbound <- msg
+		}
+	}
+}
+
+func (c *conn) decode(frameType int, data []byte) ([]*protocol.Message, error) {
+	switch c.encoding {
+	case EncodingProtobuf:
+		if frameType != websocket.BinaryMessage {
+			return nil, fmt.Errorf("protobuf encoding needs binary frames, got a text frame")
+		}
+		return c.codec.DecodeFrame(data)
+
+	default:
+		if frameType != websocket.TextMessage {
+			return nil, fmt.Errorf("json encoding needs text frames, got a binary frame")
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			var messages []*protocol.Message
+			if err := json.Unmarshal(trimmed, &messages); err != nil {
+				return nil, fmt.Errorf("invalid message array: %w", err)
+			}
+			return messages, nil
+		}
+		var msg protocol.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("invalid message: %w", err)
+		}
+		return []*protocol.Message{&msg}, nil
+	}
+}
+
+// send writes one message, or several as a batch in one frame
+func (c *conn) send(messages ...*protocol.Message) error {
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if c.encoding == EncodingProtobuf {
+		var data []byte
+		var err error
+		if len(messages) == 1 {
+			data, err = c.codec.EncodeMessage(messages[0])
+		} else {
+			data, err = c.codec.EncodeBatch(messages)
+		}
+		if err != nil {
+			return err
+		}
+		return c.ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+
+	if len(messages) == 1 {
+		return c.ws.WriteJSON(messages[0])
+	}
+	return c.ws.WriteJSON(messages)
+}
+
+// await handles inbound messages until done reports true, checking acks
+// and answering pings and reliable messages along the way. done is first
+// called with nil, for conditions that may already hold.
+func (c *conn) await(timeout time.Duration, done func(msg *protocol.Message) bool) error {
+	if done(nil) {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.inbound:
+			if !ok {
+				return fmt.Errorf("connection closed: %v", c.readErr)
+			}
+			if err := c.handle(msg); err != nil {
+				return err
+			}
+			if done(msg) {
+				return nil
+			}
+		case <-timer.C:
+			return errTimeout
+		}
+	}
+}
+
+func (c *conn) handle(msg *protocol.Message) error {
+	if msg.RequiresAck {
+		payload, _ := json.Marshal(protocol.AckMessage{MessageID: msg.ID, SeqNum: msg.SeqNum})
+		if err := c.send(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypeAck,
+			Timestamp:     time.Now(),
+			Payload:       payload,
+			CorrelationID: msg.ID,
+		}); err != nil {
+			return err
+		}
+	}
+
+	switch msg.Type {
+	case protocol.TypeAck:
+		c.st.handleAck(msg)
+	case protocol.TypePing:
+		return c.send(&protocol.Message{
+			ID:            uuid.New().String(),
+			Type:          protocol.TypePong,
+			Timestamp:     time.Now(),
+			CorrelationID: msg.ID,
+		})
+	}
+	return nil
+}
+
+func (c *conn) close() {
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.ws.Close()
+}
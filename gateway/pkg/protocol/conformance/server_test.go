@@ -0,0 +1,250 @@
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// testClient follows the rules in the package doc, unless told to break one
+type testClient struct {
+	baseURL  string
+	encoding Encoding
+	codec    *protocol.Codec
+	skipAcks bool
+
+	ws        *websocket.Conn
+	sessionID string
+	nextSeq   uint64
+	pending   map[uint64]*protocol.Message
+	delivered []string
+}
+
+func (c *testClient) run(scenario string) (*Result, error) {
+	c.nextSeq = 1
+	c.pending = make(map[uint64]*protocol.Message)
+
+	if err := c.dial(scenario, ""); err != nil {
+		return nil, err
+	}
+	defer func() { c.ws.Close() }()
+
+	resumed := false
+	for {
+		result, err := c.receive()
+		if err == nil && result == nil {
+			continue
+		}
+		if err == nil || resumed || c.sessionID == "" || scenario != ScenarioReconnect {
+			return result, err
+		}
+
+		// The connection dropped: resume from the last delivered message
+		resumed = true
+		c.ws.Close()
+		if err := c.dial(scenario, c.sessionID); err != nil {
+			return nil, err
+		}
+		if err := c.sendReconnect(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// receive handles one frame, returning the result once the server sends it
+func (c *testClient) receive() (*Result, error) {
+	messages, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		result, err := c.handle(msg)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+func (c *testClient) dial(scenario, session string) error {
+	url := fmt.Sprintf("%s/ws?scenario=%s&encoding=%s", c.baseURL, scenario, c.encoding)
+	if session != "" {
+		url += "&session=" + session
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	c.ws = ws
+	return nil
+}
+
+func (c *testClient) read() ([]*protocol.Message, error) {
+	c.ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.encoding == EncodingProtobuf {
+		return c.codec.DecodeFrame(data)
+	}
+	if strings.HasPrefix(string(data), "[") {
+		var messages []*protocol.Message
+		err := json.Unmarshal(data, &messages)
+		return messages, err
+	}
+	var msg protocol.Message
+	err = json.Unmarshal(data, &msg)
+	return []*protocol.Message{&msg}, err
+}
+
+func (c *testClient) send(msg *protocol.Message) error {
+	if c.encoding == EncodingProtobuf {
+		data, err := c.codec.EncodeMessage(msg)
+		if err != nil {
+			return err
+		}
+		return c.ws.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.ws.WriteJSON(msg)
+}
+
+func (c *testClient) handle(msg *protocol.Message) (*Result, error) {
+	if msg.RequiresAck && !c.skipAcks {
+		payload, _ := json.Marshal(protocol.AckMessage{MessageID: msg.ID, SeqNum: msg.SeqNum})
+		if err := c.send(&protocol.Message{ID: uuid.New().String(), Type: protocol.TypeAck, Timestamp: time.Now(), Payload: payload}); err != nil {
+			return nil, err
+		}
+	}
+
+	switch msg.Type {
+	case TypeHello:
+		var hello Hello
+		if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+			return nil, err
+		}
+		c.sessionID = hello.SessionID
+
+	case TypeResult:
+		var result Result
+		err := json.Unmarshal(msg.Payload, &result)
+		return &result, err
+
+	case protocol.TypeChatStream:
+		if msg.SeqNum >= c.nextSeq {
+			c.pending[msg.SeqNum] = msg
+		}
+		for {
+			next, ok := c.pending[c.nextSeq]
+			if !ok {
+				break
+			}
+			delete(c.pending, c.nextSeq)
+			c.nextSeq++
+
+			var reply protocol.ChatReply
+			if err := json.Unmarshal(next.Payload, &reply); err != nil {
+				return nil, err
+			}
+			c.delivered = append(c.delivered, reply.Content)
+			if reply.Finished {
+				payload, _ := json.Marshal(protocol.ChatMessage{Role: "user", Content: strings.Join(c.delivered, ",")})
+				if err := c.send(&protocol.Message{ID: uuid.New().String(), Type: protocol.TypeChat, Timestamp: time.Now(), Payload: payload}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (c *testClient) sendReconnect() error {
+	payload, _ := json.Marshal(protocol.ReconnectMessage{SessionID: c.sessionID, LastSeqNum: c.nextSeq - 1})
+	return c.send(&protocol.Message{
+		ID:        uuid.New().String(),
+		Type:      protocol.TypeReconnect,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	})
+}
+
+func startServer(t *testing.T, opts ...ServerOption) (*Server, string) {
+	t.Helper()
+
+	server, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+func TestServerScenarios(t *testing.T) {
+	_, url := startServer(t, WithAckTimeout(100*time.Millisecond))
+
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []Encoding{EncodingJSON, EncodingProtobuf} {
+		for _, scenario := range Scenarios {
+			t.Run(string(encoding)+"/"+scenario, func(t *testing.T) {
+				client := &testClient{baseURL: url, encoding: encoding, codec: codec}
+				result, err := client.run(scenario)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Passed {
+					t.Fatalf("conforming client failed: %v", result.Failures)
+				}
+			})
+		}
+	}
+}
+
+func TestServerReportsMissingAcks(t *testing.T) {
+	server, url := startServer(t, WithAckTimeout(50*time.Millisecond), WithStepTimeout(200*time.Millisecond))
+
+	codec, err := protocol.NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testClient{baseURL: url, encoding: EncodingJSON, codec: codec, skipAcks: true}
+	result, err := client.run(ScenarioAcks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Passed {
+		t.Fatal("client that never acknowledges passed the acks scenario")
+	}
+	if !strings.Contains(strings.Join(result.Failures, "\n"), "never acknowledged") {
+		t.Fatalf("failures do not mention the missing acks: %v", result.Failures)
+	}
+
+	if results := server.Results(); len(results) != 1 || results[0].SessionID != result.SessionID {
+		t.Fatalf("server did not record the result: %+v", results)
+	}
+}
+
+func TestServerRejectsUnknownScenario(t *testing.T) {
+	_, url := startServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/ws?scenario=chaos", nil)
+	if err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if resp == nil || resp.StatusCode != 400 {
+		t.Fatalf("expected 400, got %v", resp)
+	}
+}
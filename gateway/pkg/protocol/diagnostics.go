@@ -0,0 +1,31 @@
+package protocol
+
+import "time"
+
+// TypeDiagnostics asks the gateway to check its environment; the reply is a
+// diagnostics message carrying a Diagnostics payload
+const TypeDiagnostics MessageType = "diagnostics"
+
+// Diagnostic check statuses, from best to worst
+const (
+	DiagnosticOK   = "ok"
+	DiagnosticWarn = "warn"
+	DiagnosticFail = "fail"
+)
+
+// DiagnosticCheck is the result of one check
+type DiagnosticCheck struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Diagnostics reports whether the gateway can serve chat: whether aider is
+// installed, the API key works, git is available and the workspace is
+// writable. Status is the worst status of any check.
+type Diagnostics struct {
+	Status    string            `json:"status"`
+	Checks    []DiagnosticCheck `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	_ "embed"
+)
+
+// Dictionary is a zstd dictionary trained on typical protocol traffic:
+// streamed chat tokens, acks, pings and terminal output. Messages that small
+// rarely reach the compression threshold, but compress well against it.
+// Clients ship the same file, dictionary/protocol.zdict; regenerate it with
+// go test ./pkg/protocol -run TestDictionary -update-dictionary and release
+// it under a new DictionaryID.
+//
+//go:embed dictionary/protocol.zdict
+var Dictionary []byte
+
+// DictionaryID identifies Dictionary inside compressed frames, so a peer
+// with a different dictionary fails to decode instead of producing garbage
+const DictionaryID = 1
+
+const (
+	// minDictionarySize is the smallest message worth compressing with the
+	// dictionary; below it the zstd frame header outweighs the savings
+	minDictionarySize = 48
+)
@@ -0,0 +1,196 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+var updateDictionary = flag.Bool("update-dictionary", false, "retrain dictionary/protocol.zdict")
+
+// trafficSamples returns encoded messages resembling a session's traffic:
+// mostly streamed chat tokens, with acks, pings and terminal output. It is
+// seeded, so training is reproducible.
+func trafficSamples(t testing.TB, n int) [][]byte {
+	t.Helper()
+
+	// ToProto needs no compressor, so this works before a dictionary exists
+	codec := new(Codec)
+	rng := rand.New(rand.NewSource(int64(n)))
+	id := func() string {
+		b := make([]byte, 16)
+		rng.Read(b)
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	}
+	tokens := []string{"The", " function", " returns", " an", " error", " if", " the", " file", " does", " not",
+		" exist", ".\n\n", "```go\n", "func ", "(", ")", " {\n", "\t", "return", " nil", "\n}\n", "```",
+		" I", "'ll", " update", " `main.go`", " to", " handle", " this", " case", ":", "\n- ", " err", " :=",
+		" if err != nil", " test", " passes", " now", ",", " so", " we", " can", " commit"}
+	shell := []string{"$ ", "ls -la\r\n", "total 48\r\n", "drwxr-xr-x  5 dev dev 4096 ", "go test ./...\r\n",
+		"ok  \tgithub.com/example/app\t0.012s\r\n", "\x1b[32m", "\x1b[0m", "\x1b[1;34m", "git status\r\n",
+		"On branch main\r\n", "nothing to commit, working tree clean\r\n", "\r\n"}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var seq uint64
+	message := func(msgType MessageType, payload interface{}) *Message {
+		seq++
+		now = now.Add(time.Duration(rng.Intn(200)) * time.Millisecond)
+		msg := &Message{ID: id(), Type: msgType, Timestamp: now, SeqNum: seq, ProtocolVersion: CurrentVersion}
+		if payload != nil {
+			msg.Payload, _ = json.Marshal(payload)
+		}
+		return msg
+	}
+
+	samples := make([][]byte, 0, n)
+	for len(samples) < n {
+		var msg *Message
+		switch r := rng.Intn(100); {
+		case r < 60:
+			content := ""
+			for i := rng.Intn(4); i >= 0; i-- {
+				content += tokens[rng.Intn(len(tokens))]
+			}
+			msg = message(TypeChatStream, ChatReply{Content: content, Finished: rng.Intn(40) == 0})
+			msg.CorrelationID = id()
+		case r < 75:
+			msg = message(TypeAck, AckMessage{MessageID: id(), SeqNum: uint64(rng.Intn(5000))})
+		case r < 85:
+			msg = message(TypePing, nil)
+			if rng.Intn(2) == 0 {
+				msg.Type = TypePong
+			}
+		default:
+			out := ""
+			for i := rng.Intn(3); i >= 0; i-- {
+				out += shell[rng.Intn(len(shell))]
+			}
+			msg = message("terminal_output", map[string]string{
+				"terminal_id": id(),
+				"data":        base64.StdEncoding.EncodeToString([]byte(out)),
+			})
+		}
+
+		pbMsg, err := codec.ToProto(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(pbMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, data)
+	}
+	return samples
+}
+
+// trainDictionary builds a dictionary from the first samples, using the
+// most recent ones as its history
+func trainDictionary(t *testing.T) []byte {
+	samples := trafficSamples(t, 5000)
+
+	var history []byte
+	for i := len(samples) - 1; i >= 0 && len(history) < 16<<10; i-- {
+		history = append(history, samples[i]...)
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       DictionaryID,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedFastest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dict
+}
+
+func TestDictionary(t *testing.T) {
+	if *updateDictionary {
+		dict := trainDictionary(t)
+		if err := os.WriteFile(filepath.Join("dictionary", "protocol.zdict"), dict, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Skip("dictionary retrained; rerun without -update-dictionary")
+	}
+
+	// Samples from a different seed than training
+	samples := trafficSamples(t, 500)
+
+	codec, err := NewCodec(WithDictionary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, framed := 0, 0
+	for _, data := range samples {
+		frame, err := codec.appendFrame(nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw += len(data)
+		framed += len(frame) - frameHeaderSize
+
+		// Decoders read dictionary frames whether or not they send them
+		payload, compressed, err := plain.unframeMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed {
+			if payload, err = plain.decompress(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(payload) != string(data) {
+			t.Fatal("payload changed in a round trip")
+		}
+	}
+	// Random message IDs limit the savings; losing them means the
+	// dictionary no longer matches the traffic
+	if framed > raw*4/5 {
+		t.Fatalf("dictionary saved too little: %d bytes down to %d", raw, framed)
+	}
+	t.Logf("dictionary compression: %d bytes down to %d", raw, framed)
+}
+
+func TestDictionaryNeedsOptIn(t *testing.T) {
+	codec, err := NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{ID: "m1", Type: TypeChatStream, Timestamp: time.Now(), Payload: []byte(`{"content":" the function returns","finished":false}`)}
+
+	frame, err := codec.EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame[0]&flagCompressed != 0 {
+		t.Fatal("small message compressed without the peer's consent")
+	}
+
+	codec.UseDictionary(true)
+	if frame, err = codec.EncodeMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != flagCompressed|flagDictionary {
+		t.Fatalf("expected a dictionary frame, got flags %#x", frame[0])
+	}
+	decoded, err := codec.DecodeMessage(frame)
+	if err != nil || string(decoded.Payload) != string(msg.Payload) {
+		t.Fatalf("round trip gave %+v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,33 @@
+package protocol
+
+// Session environment requests. Variables apply to terminals the session
+// creates afterwards; each request is answered with a message of the same
+// type carrying a SessionEnv payload.
+const (
+	TypeEnvSet   MessageType = "env_set"
+	TypeEnvUnset MessageType = "env_unset"
+	TypeEnvList  MessageType = "env_list"
+)
+
+// EnvSet is the payload of an env_set request. With Persist the variables
+// are also written to the .env file of the workspace, or of the default
+// workspace if Workspace is empty.
+type EnvSet struct {
+	Vars      map[string]string `json:"vars"`
+	Persist   bool              `json:"persist,omitempty"`
+	Workspace string            `json:"workspace,omitempty"`
+}
+
+// EnvUnset is the payload of an env_unset request. With Persist the
+// variables are also removed from the workspace's .env file.
+type EnvUnset struct {
+	Names     []string `json:"names"`
+	Persist   bool     `json:"persist,omitempty"`
+	Workspace string   `json:"workspace,omitempty"`
+}
+
+// SessionEnv lists the names of the session's variables, sorted. Values are
+// never sent back, since they are often secrets.
+type SessionEnv struct {
+	Names []string `json:"names"`
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzzSeeds returns valid frames plus a few malformed ones for the fuzzers
+// to mutate
+func fuzzSeeds(t testing.TB, codec *Codec) [][]byte {
+	t.Helper()
+
+	messages := []*Message{
+		{ID: "1", Type: TypePing, Timestamp: time.Unix(0, 0)},
+		{ID: "2", Type: TypeChat, Timestamp: time.Unix(0, 0), Payload: []byte(`{"role":"user","content":"hi"}`), RequiresAck: true},
+		{ID: "3", Type: "terminal_output", Timestamp: time.Unix(0, 0), Payload: []byte(`{"terminal_id":"t1"}`)},
+		// Large enough to be compressed
+		{ID: "4", Type: TypeChatStream, Timestamp: time.Unix(0, 0), Payload: []byte(`{"content":"` + strings.Repeat("a", 4096) + `"}`), SeqNum: 9},
+	}
+
+	var seeds [][]byte
+	for _, msg := range messages {
+		data, err := codec.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	batch, err := codec.EncodeBatch(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeds = append(seeds, batch)
+
+	// Header only, a length past the end, and a compressed flag on garbage
+	seeds = append(seeds,
+		[]byte{0, 0, 0, 0, 0},
+		[]byte{0, 0, 0x10, 0, 0, 1},
+		[]byte{flagCompressed, 0, 0, 0, 4, 0x28, 0xb5, 0x2f, 0xfd},
+	)
+	return seeds
+}
+
+func newFuzzCodec(f *testing.F) *Codec {
+	codec, err := NewCodec()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range fuzzSeeds(f, codec) {
+		f.Add(seed)
+	}
+	return codec
+}
+
+func FuzzUnframeMessage(f *testing.F) {
+	codec := newFuzzCodec(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		payload, compressed, err := codec.unframeMessage(data)
+		if err != nil {
+			return
+		}
+		if len(data) < frameHeaderSize {
+			t.Fatalf("accepted a %d byte frame", len(data))
+		}
+		if len(payload) != int(binary.BigEndian.Uint32(data[1:5])) {
+			t.Fatalf("payload is %d bytes, header says %d", len(payload), binary.BigEndian.Uint32(data[1:5]))
+		}
+		if len(payload) > maxFrameSize {
+			t.Fatalf("accepted a %d byte payload", len(payload))
+		}
+		if compressed != (data[0]&flagCompressed != 0) {
+			t.Fatalf("compressed = %v for flags %#x", compressed, data[0])
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	codec := newFuzzCodec(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := codec.DecodeMessage(data)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			t.Fatal("nil message without an error")
+		}
+
+		// Anything we accept must survive a round trip
+		encoded, err := codec.EncodeMessage(msg)
+		if err != nil {
+			t.Fatalf("re-encode decoded message: %v", err)
+		}
+		again, err := codec.DecodeMessage(encoded)
+		if err != nil {
+			t.Fatalf("decode re-encoded message: %v", err)
+		}
+		if again.ID != msg.ID || again.Type != msg.Type || !bytes.Equal(again.Payload, msg.Payload) {
+			t.Fatalf("round trip changed the message: %+v != %+v", again, msg)
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	codec := newFuzzCodec(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		messages, err := codec.DecodeFrame(data)
+		if err != nil {
+			return
+		}
+		for i, msg := range messages {
+			if msg == nil {
+				t.Fatalf("message %d is nil", i)
+			}
+		}
+	})
+}
+
+func FuzzMessageReader(f *testing.F) {
+	codec := newFuzzCodec(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := codec.Reader(bytes.NewReader(data))
+
+		// Every message read consumes at least a header, so a stream can
+		// never yield more messages than this
+		limit := len(data)/frameHeaderSize + 1
+		for i := 0; ; i++ {
+			if i > limit {
+				t.Fatalf("read more than %d messages from %d bytes", limit, len(data))
+			}
+			msg, err := reader.ReadMessage()
+			if err != nil {
+				if errors.Is(err, io.EOF) && i == 0 && len(data) > 0 {
+					t.Fatalf("EOF on a non-empty stream")
+				}
+				return
+			}
+			if msg == nil {
+				t.Fatal("nil message without an error")
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import "time"
+
+// Guardrail messages. With guardrails on, commands the policy wants
+// confirmed wait for a command_approval to be answered with a
+// command_decision, and denied commands are reported instead of run.
+const (
+	// TypeCommandApproval asks the user to approve a command; it must be
+	// acknowledged
+	TypeCommandApproval MessageType = "command_approval"
+	// TypeCommandDecision approves or rejects a command
+	TypeCommandDecision MessageType = "command_decision"
+	// TypeCommandBlocked reports a terminal command that was not run
+	TypeCommandBlocked MessageType = "command_blocked"
+)
+
+// Where a guarded command came from
+const (
+	CommandSourceTerminal = "terminal"
+	CommandSourceChat     = "chat"
+	CommandSourceTask     = "task"
+)
+
+// CommandApproval is a command waiting for the user's approval. Rule is the
+// policy pattern that matched and Reason why it is guarded. It is refused
+// if not approved by ExpiresAt.
+type CommandApproval struct {
+	ID         string    `json:"id"`
+	Command    string    `json:"command"`
+	Source     string    `json:"source"`
+	TerminalID string    `json:"terminal_id,omitempty"`
+	Rule       string    `json:"rule"`
+	Reason     string    `json:"reason,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// CommandDecision is the payload of a command_decision request
+type CommandDecision struct {
+	ID       string `json:"id"`
+	Approved bool   `json:"approved"`
+}
+
+// CommandBlocked reports a terminal command the guardrails refused: denied
+// by the policy, rejected or not approved in time
+type CommandBlocked struct {
+	Command    string `json:"command"`
+	TerminalID string `json:"terminal_id"`
+	Rule       string `json:"rule,omitempty"`
+	Reason     string `json:"reason"`
+}
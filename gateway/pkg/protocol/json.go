@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Hand-written JSON encoders for what the gateway sends most: the envelope
+// of every message, and chat_stream replies. They write what encoding/json
+// writes, without reflection or intermediate allocations;
+// TestAppendJSONMatchesEncodingJSON keeps them in step.
+
+var errJSONTime = errors.New("timestamp year outside of range [0,9999]")
+
+// AppendJSON appends the message to dst as json.Marshal would encode it
+func (m *Message) AppendJSON(dst []byte) ([]byte, error) {
+	if y := m.Timestamp.Year(); y < 0 || y >= 10000 {
+		return dst, errJSONTime
+	}
+	payload := m.Payload
+	if len(payload) > 0 {
+		if !payloadIsCanonical(payload) {
+			// json.Marshal compacts and HTML-escapes embedded JSON; payloads
+			// the gateway builds never need it, so the slow path is rare
+			var err error
+			if payload, err = json.Marshal(json.RawMessage(payload)); err != nil {
+				return dst, err
+			}
+		} else if !json.Valid(payload) {
+			return dst, errors.New("invalid JSON payload")
+		}
+	}
+
+	// Room for the fields and a few escapes, so nil grows once
+	dst = slices.Grow(dst, len(m.ID)+len(m.Type)+len(payload)+len(m.CorrelationID)+160)
+	dst = append(dst, `{"id":`...)
+	dst = appendJSONString(dst, m.ID)
+	dst = append(dst, `,"type":`...)
+	dst = appendJSONString(dst, string(m.Type))
+	dst = append(dst, `,"timestamp":"`...)
+	dst = m.Timestamp.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, '"')
+	if len(payload) > 0 {
+		dst = append(dst, `,"payload":`...)
+		dst = append(dst, payload...)
+	}
+	if m.SeqNum != 0 {
+		dst = append(dst, `,"seq_num":`...)
+		dst = strconv.AppendUint(dst, m.SeqNum, 10)
+	}
+	if m.RequiresAck {
+		dst = append(dst, `,"requires_ack":true`...)
+	}
+	if m.RetryCount != 0 {
+		dst = append(dst, `,"retry_count":`...)
+		dst = strconv.AppendInt(dst, int64(m.RetryCount), 10)
+	}
+	if m.CorrelationID != "" {
+		dst = append(dst, `,"correlation_id":`...)
+		dst = appendJSONString(dst, m.CorrelationID)
+	}
+	if m.ProtocolVersion != 0 {
+		dst = append(dst, `,"protocol_version":`...)
+		dst = strconv.AppendInt(dst, int64(m.ProtocolVersion), 10)
+	}
+	return append(dst, '}'), nil
+}
+
+// AppendJSON appends the reply as JSON to dst
+func (r *ChatReply) AppendJSON(dst []byte) []byte {
+	dst = slices.Grow(dst, len(r.Content)+len(r.Block)+44)
+	dst = append(dst, `{"content":`...)
+	dst = appendJSONString(dst, r.Content)
+	if r.Finished {
+		dst = append(dst, `,"finished":true`...)
+	} else {
+		dst = append(dst, `,"finished":false`...)
+	}
+	if r.Block != "" {
+		dst = append(dst, `,"block":`...)
+		dst = appendJSONString(dst, r.Block)
+	}
+	if len(r.CodeBlocks) > 0 {
+		// Rare enough not to need a fast path
+		blocks, _ := json.Marshal(r.CodeBlocks)
+		dst = append(dst, `,"code_blocks":`...)
+		dst = append(dst, blocks...)
+	}
+	if r.MessageID != "" {
+		dst = append(dst, `,"message_id":`...)
+		dst = appendJSONString(dst, r.MessageID)
+	}
+	return append(dst, '}')
+}
+
+// payloadIsCanonical reports whether json.Marshal would leave payload as it
+// is: no whitespace outside strings, and nothing it escapes inside them. It
+// errs on the side of false, 0xE2 being the first byte of U+2028 and U+2029
+// among others.
+func payloadIsCanonical(payload []byte) bool {
+	inString, escaped := false, false
+	for _, b := range payload {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			case '<', '>', '&', 0xE2:
+				return false
+			}
+		case b == '"':
+			inString = true
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			return false
+		}
+	}
+	return true
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON string, escaped as encoding/json does
+// by default: HTML characters, control characters, U+2028 and U+2029 are
+// escaped, and invalid UTF-8 becomes U+FFFD
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+		case r == '\u2028' || r == '\u2029':
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func jsonMessages() []*Message {
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	return []*Message{
+		{ID: "1", Type: TypePing, Timestamp: ts},
+		{ID: "", Type: "", Timestamp: time.Time{}},
+		{ID: "2", Type: TypeChatStream, Timestamp: ts.UTC(), Payload: []byte(`{"content":" the function","finished":false}`),
+			SeqNum: 1 << 63, CorrelationID: "c1", ProtocolVersion: CurrentVersion},
+		{ID: "3", Type: TypeChat, Timestamp: ts, Payload: []byte(`{
+			"role": "user",
+			"content": "x < y && y > z"
+		}`), RequiresAck: true, RetryCount: -2},
+		{ID: "4", Type: "terminal_output", Timestamp: ts, Payload: []byte(`{"data":"G1szMm0=","terminal_id":"t\u2028"}`)},
+		{ID: "5", Type: TypeChatStream, Timestamp: ts, Payload: []byte(`{"content":"\u003c\"quoted\"\\ line\u2029"}`)},
+		{ID: "\x00\x1f\b\f\n\r\t\"\\<>&\u2028\u2029\xff\xc3 é 日本 🙂", Type: "odd", Timestamp: ts, CorrelationID: "\x7f"},
+		{ID: "6", Type: TypeAck, Timestamp: ts, Payload: []byte(`[1, 2.5e3, true, null, "a"]`)},
+		{ID: "7", Type: TypeAck, Timestamp: ts, Payload: []byte(`"<&>"`)},
+	}
+}
+
+func TestAppendJSONMatchesEncodingJSON(t *testing.T) {
+	for _, msg := range jsonMessages() {
+		want, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := msg.AppendJSON([]byte("prefix"))
+		if err != nil {
+			t.Fatalf("message %q: %v", msg.ID, err)
+		}
+		if string(got) != "prefix"+string(want) {
+			t.Errorf("message %q:\n got %s\nwant prefix%s", msg.ID, got, want)
+		}
+	}
+
+	for _, reply := range []ChatReply{{}, {Content: "```go\nfunc <T>() {}\n```", Finished: true, Block: BlockCode,
+		CodeBlocks: []CodeBlock{{Language: "go", Content: "func <T>() {}\n", File: "a&b.go"}}, MessageID: "msg-1"}} {
+		want, _ := json.Marshal(reply)
+		if got := reply.AppendJSON(nil); string(got) != string(want) {
+			t.Errorf("reply: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestAppendJSONErrors(t *testing.T) {
+	for _, msg := range []*Message{
+		{ID: "1", Timestamp: time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "2", Timestamp: time.Now(), Payload: []byte(`{"content":`)},
+		{ID: "3", Timestamp: time.Now(), Payload: []byte(`{"a": 1`)},
+	} {
+		if _, jsonErr := json.Marshal(msg); jsonErr == nil {
+			t.Fatalf("message %q: json.Marshal accepted it", msg.ID)
+		}
+		if _, err := msg.AppendJSON(nil); err == nil {
+			t.Errorf("message %q: expected an error", msg.ID)
+		}
+	}
+}
+
+func FuzzAppendJSON(f *testing.F) {
+	for _, msg := range jsonMessages() {
+		f.Add(msg.ID, []byte(msg.Payload))
+	}
+	f.Fuzz(func(t *testing.T, s string, payload []byte) {
+		msg := &Message{ID: s, Type: TypeChatStream, CorrelationID: s, Timestamp: time.Unix(0, 0), Payload: payload}
+		want, jsonErr := json.Marshal(msg)
+		got, err := msg.AppendJSON(nil)
+		if (err != nil) != (jsonErr != nil) {
+			t.Fatalf("AppendJSON error %v, json.Marshal error %v", err, jsonErr)
+		}
+		if err == nil && string(got) != string(want) {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	})
+}
+
+// streamMessages returns a chat_stream token and a chunk of terminal output,
+// the messages sent most often
+func streamMessages() []*Message {
+	ts := time.Now()
+	return []*Message{
+		{ID: "6f1c9b9e-2f4a-4b53-9a8e-0d1f2c3b4a59", Type: TypeChatStream, Timestamp: ts, SeqNum: 1042,
+			Payload: []byte(`{"content":" the function returns","finished":false}`), CorrelationID: "0b7e4c1a-5d2f-4e8b-9c3a-7f6e5d4c3b2a"},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", Type: "terminal_output", Timestamp: ts, SeqNum: 1043,
+			Payload: []byte(`{"terminal_id":"term-1","data":"` + strings.Repeat("G1szMm1vayAgCWdpdGh1Yi5jb20vZXhhbXBsZQ==", 8) + `"}`)},
+	}
+}
+
+func BenchmarkMessageJSON(b *testing.B) {
+	for _, msg := range streamMessages() {
+		b.Run(string(msg.Type)+"/encoding_json", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := json.Marshal(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(string(msg.Type)+"/append", func(b *testing.B) {
+			b.ReportAllocs()
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if buf, err = msg.AppendJSON(buf[:0]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChatReplyJSON(b *testing.B) {
+	reply := ChatReply{Content: " the function returns"}
+	b.Run("encoding_json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			json.Marshal(reply)
+		}
+	})
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reply.AppendJSON(nil)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxDecompressedSize bounds what one frame may expand to, so a
+	// small compressed frame cannot claim a large allocation
+	DefaultMaxDecompressedSize = 4 * maxFrameSize
+
+	// DefaultDecodeBudget is how many decoded bytes one codec, and so one
+	// connection, may produce per DefaultDecodeBudgetWindow
+	DefaultDecodeBudget       = 64 << 20
+	DefaultDecodeBudgetWindow = time.Minute
+)
+
+// ErrLimitExceeded is returned when a frame or a connection goes over a
+// decoding limit. The peer is misbehaving, so callers should close the
+// connection rather than skip the message.
+var ErrLimitExceeded = errors.New("protocol limit exceeded")
+
+// CodecOption configures a Codec
+type CodecOption func(*codecConfig)
+
+type codecConfig struct {
+	maxDecompressedSize int
+	budget              int
+	budgetWindow        time.Duration
+	dictionary          bool
+}
+
+// WithMaxDecompressedSize sets how large one frame may be once decompressed
+func WithMaxDecompressedSize(n int) CodecOption {
+	return func(c *codecConfig) {
+		c.maxDecompressedSize = n
+	}
+}
+
+// WithDecodeBudget lets the codec decode at most n bytes per window, refilled
+// gradually. Use one codec per connection so the budget applies to each
+// peer. n of 0 disables the budget.
+func WithDecodeBudget(n int, window time.Duration) CodecOption {
+	return func(c *codecConfig) {
+		c.budget = n
+		c.budgetWindow = window
+	}
+}
+
+// WithDictionary compresses small messages against Dictionary from the
+// start, for peers known to have it; see Codec.UseDictionary
+func WithDictionary() CodecOption {
+	return func(c *codecConfig) {
+		c.dictionary = true
+	}
+}
+
+// decodeBudget is a token bucket of decoded bytes
+type decodeBudget struct {
+	mu        sync.Mutex
+	capacity  float64
+	perSecond float64
+	available float64
+	last      time.Time
+	now       func() time.Time
+}
+
+func newDecodeBudget(n int, window time.Duration) *decodeBudget {
+	if n <= 0 || window <= 0 {
+		return nil
+	}
+	return &decodeBudget{
+		capacity:  float64(n),
+		perSecond: float64(n) / window.Seconds(),
+		available: float64(n),
+		last:      time.Now(),
+		now:       time.Now,
+	}
+}
+
+// spend takes n bytes from the budget, failing without taking any if there
+// are not enough. A nil budget is unlimited.
+func (b *decodeBudget) spend(n int) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.available += now.Sub(b.last).Seconds() * b.perSecond
+	if b.available > b.capacity {
+		b.available = b.capacity
+	}
+	b.last = now
+
+	if float64(n) > b.available {
+		return fmt.Errorf("%w: decode budget of %.0f bytes exhausted", ErrLimitExceeded, b.capacity)
+	}
+	b.available -= float64(n)
+	return nil
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bombFrame compresses size zero bytes into a single frame. Streamed frames
+// omit the content size, so the decoder only finds out while decoding.
+func bombFrame(t *testing.T, size int, streamed bool) []byte {
+	t.Helper()
+
+	zeros := make([]byte, size)
+	var compressed []byte
+	if streamed {
+		var buf bytes.Buffer
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(zeros)
+		w.Close()
+		compressed = buf.Bytes()
+	} else {
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed = w.EncodeAll(zeros, nil)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(compressed))
+	frame[0] = flagCompressed
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(compressed)))
+	copy(frame[frameHeaderSize:], compressed)
+	return frame
+}
+
+func TestDecodeRejectsDecompressionBombs(t *testing.T) {
+	codec, err := NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, streamed := range []bool{false, true} {
+		frame := bombFrame(t, 64<<20, streamed)
+		if len(frame) > 64<<10 {
+			t.Fatalf("bomb frame is %d bytes, expected it to compress well", len(frame))
+		}
+
+		if _, err := codec.DecodeMessage(frame); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("streamed=%v: expected ErrLimitExceeded, got %v", streamed, err)
+		}
+		if _, err := codec.DecodeFrame(frame); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("streamed=%v: DecodeFrame: expected ErrLimitExceeded, got %v", streamed, err)
+		}
+	}
+}
+
+func TestDecodeRejectsOversizedFrameHeader(t *testing.T) {
+	codec, err := NewCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	if _, err := codec.DecodeMessage(header); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got %v", err)
+	}
+	if _, err := codec.Reader(bytes.NewReader(header)).ReadMessage(); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("reader: expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestDecodeBudget(t *testing.T) {
+	codec, err := NewCodec(WithDecodeBudget(10<<10, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	codec.budget.now = func() time.Time { return now }
+	codec.budget.last = now
+
+	data, err := codec.EncodeMessage(&Message{
+		ID:        "1",
+		Type:      TypeChat,
+		Timestamp: now,
+		Payload:   []byte(`"` + strings.Repeat("x", 4<<10) + `"`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := codec.DecodeMessage(data); err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+	}
+	if _, err := codec.DecodeMessage(data); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected the budget to run out, got %v", err)
+	}
+
+	// Half a window refills half the budget
+	now = now.Add(30 * time.Second)
+	if _, err := codec.DecodeMessage(data); err != nil {
+		t.Fatalf("decode after refill: %v", err)
+	}
+}
+
+func TestDecodeBudgetDisabled(t *testing.T) {
+	codec, err := NewCodec(WithDecodeBudget(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.EncodeMessage(&Message{ID: "1", Type: TypePing, Timestamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := codec.DecodeMessage(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeRejectsMessagesPeersCannotDecode(t *testing.T) {
+	codec, err := NewCodec(WithMaxDecompressedSize(4 << 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{ID: "1", Type: TypeChat, Timestamp: time.Now(), Payload: []byte(`"` + strings.Repeat("x", 8<<10) + `"`)}
+	if _, err := codec.EncodeMessage(msg); err == nil {
+		t.Error("EncodeMessage accepted a message larger than the decompressed limit")
+	}
+	if _, err := codec.EncodeBatch([]*Message{msg, msg}); err == nil {
+		t.Error("EncodeBatch accepted a batch larger than the decompressed limit")
+	}
+}
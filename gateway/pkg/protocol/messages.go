@@ -16,6 +16,53 @@ const (
 	TypePong       MessageType = "pong"
 	TypeReconnect  MessageType = "reconnect"
 	TypeAck        MessageType = "ack"
+	TypeQueueStats MessageType = "queue_stats"
+
+	// Sent before the gateway ends a session whose token was revoked
+	TypeSessionRevoked MessageType = "session_revoked"
+
+	// Token expiry: the gateway asks for a fresh connect token before the
+	// session's one expires, the client sends one in a reauth message, and
+	// sessions that don't are ended with session_expired
+	TypeReauthRequired MessageType = "reauth_required"
+	TypeReauth         MessageType = "reauth"
+	TypeSessionExpired MessageType = "session_expired"
+
+	// Sent to every session when the operators announce something
+	TypeAnnouncement MessageType = "announcement"
+
+	// Suspension: the gateway warns with suspend_scheduled before the
+	// control plane suspends an idle VM, a client answers keep_alive to stop
+	// it, and sessions end with vm_suspended if none does
+	TypeSuspendScheduled MessageType = "suspend_scheduled"
+	TypeKeepAlive        MessageType = "keep_alive"
+	TypeSuspendCancelled MessageType = "suspend_cancelled"
+	TypeVMSuspended      MessageType = "vm_suspended"
+
+	// Relay mode: one client connection reaching several VM gateways
+	TypeRelayAttach   MessageType = "relay_attach"
+	TypeRelayAttached MessageType = "relay_attached"
+	TypeRelayDetach   MessageType = "relay_detach"
+	TypeRelayDetached MessageType = "relay_detached"
+	TypeRelay         MessageType = "relay"
+
+	// The AI backend is recovering from an error; see BackendRecovery
+	TypeBackendRecoveryStarted   MessageType = "backend_recovery_started"
+	TypeBackendRecoverySucceeded MessageType = "backend_recovery_succeeded"
+	TypeBackendRecoveryFailed    MessageType = "backend_recovery_failed"
+
+	// A chat request is waiting behind others; see ChatQueued
+	TypeChatQueued MessageType = "chat_queued"
+
+	// Retry a reply, or continue from an earlier message; see
+	// ChatRegenerate and ChatBranch
+	TypeChatRegenerate MessageType = "chat_regenerate"
+	TypeChatBranch     MessageType = "chat_branch"
+
+	// A planning backend's steps for a chat, and the user's answer; see
+	// ChatPlan
+	TypeChatPlan         MessageType = "chat_plan"
+	TypeChatPlanDecision MessageType = "chat_plan_decision"
 )
 
 type Message struct {
@@ -27,22 +74,179 @@ type Message struct {
 	RequiresAck   bool            `json:"requires_ack,omitempty"`
 	RetryCount    int             `json:"retry_count,omitempty"`
 	CorrelationID string          `json:"correlation_id,omitempty"`
+
+	// ProtocolVersion is the version the message is written in. Zero means
+	// the session's negotiated version; see Upgrade and Downgrade.
+	ProtocolVersion int `json:"protocol_version,omitempty"`
 }
 
 type ChatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+
+	// Workspace names the project root the chat works in; empty means
+	// the gateway's default workspace
+	Workspace string `json:"workspace,omitempty"`
+
+	// WorkDir scopes the assistant to a directory under the workspace
+	// root, such as one project in a monorepo. Empty means the root.
+	WorkDir string `json:"work_dir,omitempty"`
+
+	// BranchFrom is the ID of an earlier message, in this branch of the
+	// conversation or another, to continue from instead of the latest one.
+	// Set from chat_branch and chat_regenerate.
+	BranchFrom string `json:"-"`
+
+	// Regenerate asks for another answer to the user message BranchFrom
+	// names or that its reply answered, or to the latest one; Content is
+	// ignored
+	Regenerate bool `json:"-"`
+
+	// Author is the user who sent the message, set by the gateway from
+	// the session's connect token
+	Author string `json:"-"`
+}
+
+// ChatRegenerate asks for another answer to an earlier prompt. The
+// conversation continues on a new branch from just before the prompt; the
+// reply streams as for a chat message.
+type ChatRegenerate struct {
+	// MessageID is the reply to replace, or the user message to answer
+	// again. Empty means the latest reply.
+	MessageID string `json:"message_id,omitempty"`
+
+	Workspace string `json:"workspace,omitempty"`
+	WorkDir   string `json:"work_dir,omitempty"`
+}
+
+// ChatBranch sends a prompt that continues the conversation from an
+// earlier message rather than the latest one, on a new branch. The branch
+// left behind is kept, so a later chat_branch can return to it.
+type ChatBranch struct {
+	MessageID string `json:"message_id"` // the last message the branch keeps
+	Content   string `json:"content"`
+
+	Workspace string `json:"workspace,omitempty"`
+	WorkDir   string `json:"work_dir,omitempty"`
 }
 
 type ChatReply struct {
 	Content  string `json:"content"`
 	Finished bool   `json:"finished"`
+
+	// Block is the kind of markdown block the content is part of, code or
+	// prose, for sessions streaming by sentence or paragraph. Code blocks
+	// arrive whole, fences included.
+	Block string `json:"block,omitempty"`
+
+	// CodeBlocks are the fenced code blocks of the reply that ended in this
+	// part or just before it, parsed so clients can copy or apply them
+	// without parsing markdown themselves
+	CodeBlocks []CodeBlock `json:"code_blocks,omitempty"`
+
+	// MessageID identifies the reply in the conversation, for branching from
+	// it or regenerating it later. Only the final part carries it, and only
+	// from backends that keep the conversation.
+	MessageID string `json:"message_id,omitempty"`
+
+	// Plan is set on replies that carry no content but the steps the
+	// planner drafted, sent as chat_plan messages
+	Plan *ChatPlan `json:"-"`
+
+	// Recovery is set on replies that carry no content but report the
+	// backend recovering; the gateway sends them as backend_recovery_*
+	// messages rather than chat_stream
+	Recovery *BackendRecovery `json:"-"`
+
+	// Queued is set on replies that report the request's place in the
+	// backend's queue, sent as chat_queued messages
+	Queued *ChatQueued `json:"-"`
+
+	// Error is set on the final reply of a queued request the backend
+	// failed, sent as a chat_error message
+	Error *ChatError `json:"-"`
+}
+
+// Stream granularities say how much of a reply each chat_stream message
+// carries. A session picks one in its hello; token is the default.
+const (
+	GranularityToken     = "token"     // as the backend produces it
+	GranularitySentence  = "sentence"  // whole sentences and lines
+	GranularityParagraph = "paragraph" // text up to a blank line
+)
+
+// CodeBlock is a fenced code block from a chat reply
+type CodeBlock struct {
+	Language string `json:"language,omitempty"` // from the fence's info string
+	Content  string `json:"content"`            // without the fences
+	File     string `json:"file,omitempty"`     // the file it is for, if the reply names one
+}
+
+// Markdown block kinds of a ChatReply
+const (
+	BlockProse = "prose"
+	BlockCode  = "code"
+)
+
+// ChatPlan is the steps a planning backend drafted for a chat request. They
+// are carried out by the editing backend once the client approves them
+// with a ChatPlanDecision.
+type ChatPlan struct {
+	ID    string     `json:"id"`
+	Steps []PlanStep `json:"steps"`
+}
+
+// PlanStep is one step of a ChatPlan
+type PlanStep struct {
+	Description string `json:"description"`
+	File        string `json:"file,omitempty"` // the file it changes, if the planner named one
+}
+
+// ChatPlanDecision approves or rejects a ChatPlan. Steps, if set, are run
+// instead of the drafted ones, so the user can edit, drop or reorder them.
+type ChatPlanDecision struct {
+	PlanID   string     `json:"plan_id"`
+	Approved bool       `json:"approved"`
+	Steps    []PlanStep `json:"steps,omitempty"`
+}
+
+// ChatQueued tells the client its chat request is waiting for the backend
+type ChatQueued struct {
+	Position int `json:"position"` // 1 when the request runs next
 }
 
 type ChatError struct {
 	Error   string `json:"error"`
 	Code    string `json:"code,omitempty"`
 	Retryable bool `json:"retryable"`
+
+	// Set when the error comes from the AI backend
+	ErrorType    string `json:"error_type,omitempty"`     // classification, e.g. process or auth
+	Cause        string `json:"cause,omitempty"`          // underlying failure
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // when trying again may help
+}
+
+// Backend recovery phases
+const (
+	RecoveryStarted   = "started"
+	RecoverySucceeded = "succeeded"
+	RecoveryFailed    = "failed"
+)
+
+// BackendRecovery describes the AI backend recovering from an error, so
+// clients can show that the assistant is restarting instead of silence
+type BackendRecovery struct {
+	Phase        string `json:"phase"`                    // started, succeeded or failed
+	ErrorType    string `json:"error_type"`               // classification, e.g. process or timeout
+	Action       string `json:"action"`                   // restart_process, reset_connection, cleanup or wait
+	Attempt      int    `json:"attempt"`                  // 1 for the first recovery of this error type
+	Error        string `json:"error,omitempty"`          // what went wrong, and on failure why recovery did not help
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // backoff before the attempt, on started
+}
+
+// MessageType returns the message type the recovery is sent as
+func (r *BackendRecovery) MessageType() MessageType {
+	return MessageType("backend_recovery_" + r.Phase)
 }
 
 type ReconnectMessage struct {
@@ -55,6 +259,130 @@ type AckMessage struct {
 	SeqNum    uint64 `json:"seq_num"`
 }
 
+// QueueStats reports the health of a session's outbound message queue. A
+// growing OldestInFlightMs means the client has stopped acknowledging.
+type QueueStats struct {
+	SessionID        string `json:"session_id"`
+	Pending          int    `json:"pending"`
+	InFlight         int    `json:"in_flight"`
+	Retries          uint64 `json:"retries"`
+	Expired          uint64 `json:"expired"`
+	Dropped          uint64 `json:"dropped"`
+	OldestPendingMs  int64  `json:"oldest_pending_ms"`
+	OldestInFlightMs int64  `json:"oldest_in_flight_ms"`
+	Stale            bool   `json:"stale"`
+}
+
+// SessionRevoked tells the client why its session was ended
+type SessionRevoked struct {
+	Reason string `json:"reason"`
+}
+
+// Reasons a session expires
+const (
+	ExpiryTokenExpired = "token_expired" // not re-authenticated in time
+	ExpiryMaxLifetime  = "max_lifetime"
+)
+
+// SessionExpired tells the client why the gateway ended its session. The
+// client may reconnect with a fresh connect URL.
+type SessionExpired struct {
+	Reason string `json:"reason"`
+}
+
+// Reauth carries a fresh connect token from the client, fetched from the
+// control plane as for a reconnect
+type Reauth struct {
+	Token string `json:"token"`
+}
+
+// TokenExpiry is when the session's connect token expires: the payload of
+// reauth_required, and of the reply to a reauth once the new token is in use
+type TokenExpiry struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AnnouncementKind tells clients how to present an announcement
+type AnnouncementKind string
+
+const (
+	AnnouncementInfo        AnnouncementKind = "info"
+	AnnouncementMaintenance AnnouncementKind = "maintenance" // StartsAt and EndsAt bound the window
+	AnnouncementUpgrade     AnnouncementKind = "upgrade"     // clients older than MinClientVersion must update
+)
+
+// Announcement is a notice from the operators, such as a maintenance window
+// or a forced upgrade. It reaches every live session and sessions opened
+// until ExpiresAt. The ID is the same on every gateway, so clients connected
+// to several show it once.
+type Announcement struct {
+	ID               string           `json:"id"`
+	Kind             AnnouncementKind `json:"kind"`
+	Message          string           `json:"message"`
+	URL              string           `json:"url,omitempty"`
+	StartsAt         *time.Time       `json:"starts_at,omitempty"`
+	EndsAt           *time.Time       `json:"ends_at,omitempty"`
+	MinClientVersion string           `json:"min_client_version,omitempty"`
+	ExpiresAt        time.Time        `json:"expires_at"`
+}
+
+// Reasons the control plane suspends a VM
+const (
+	SuspendIdle     = "idle"     // no activity for the configured time
+	SuspendOperator = "operator" // an administrator asked for it
+)
+
+// Reasons a scheduled suspension is called off
+const (
+	SuspendCancelledKeepAlive    = "keep_alive"    // a client answered keep_alive
+	SuspendCancelledActivity     = "activity"      // a client typed or chatted
+	SuspendCancelledControlPlane = "control_plane" // the VM was busy after all
+	SuspendCancelledExpired      = "expired"       // the control plane never followed up
+)
+
+// SuspendScheduled warns that the VM will be suspended at SuspendAt unless
+// a client sends keep_alive first. It reaches every live session and
+// sessions opened before the suspension, with SecondsLeft counted from when
+// it was sent.
+type SuspendScheduled struct {
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason"`
+	SuspendAt   time.Time `json:"suspend_at"`
+	SecondsLeft int       `json:"seconds_left"`
+	ResumeHint  string    `json:"resume_hint,omitempty"`
+}
+
+// SuspendCancelled tells clients the suspension with ID will not happen
+type SuspendCancelled struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// VMSuspended is sent before the gateway ends every session because the
+// VM is being suspended. ResumeHint tells the user how to start it again;
+// reconnecting fails until they do.
+type VMSuspended struct {
+	ID         string `json:"id"`
+	Reason     string `json:"reason"`
+	ResumeHint string `json:"resume_hint,omitempty"`
+}
+
+// RelayTarget names the VM a relay_attach or relay_detach applies to. In
+// relay_attach it may carry the VM's connect token; in relay_detached it
+// carries why the upstream connection ended.
+type RelayTarget struct {
+	VMID   string `json:"vm_id"`
+	Token  string `json:"token,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RelayEnvelope wraps a protocol message travelling between a client and
+// one VM's gateway through a relay
+type RelayEnvelope struct {
+	VMID    string   `json:"vm_id"`
+	Message *Message `json:"message"`
+}
+
 // Now returns the current time for use in messages
 func Now() time.Time {
 	return time.Now()
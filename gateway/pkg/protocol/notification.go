@@ -0,0 +1,21 @@
+package protocol
+
+import "time"
+
+// TypeNotification carries a desktop notification for the client to show,
+// to clients with CapabilityNotifications
+const TypeNotification MessageType = "notification"
+
+// NotificationSourceTerminal is the source of notifications programs in a
+// terminal ask for
+const NotificationSourceTerminal = "terminal"
+
+// Notification is the payload of a notification message. TerminalID names
+// the terminal of a notification from one.
+type Notification struct {
+	Source     string    `json:"source"`
+	TerminalID string    `json:"terminal_id,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Time       time.Time `json:"time"`
+}
@@ -0,0 +1,236 @@
+// Package schema describes the gateway's message protocol as JSON Schema
+// (draft 2020-12), generated from the Go types of each message's payload so
+// the description cannot drift from what the gateway sends and accepts.
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+// Draft is the JSON Schema dialect of generated documents
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Direction says which side of a connection sends a message
+type Direction string
+
+const (
+	FromClient  Direction = "client"
+	FromGateway Direction = "gateway"
+)
+
+// Message documents one message of the protocol. A type used in both
+// directions with different payloads, such as a request and its reply, has
+// one Message per direction.
+type Message struct {
+	Type        protocol.MessageType
+	Direction   Direction
+	Description string
+	// Payload is a value of the payload's Go type; nil means none
+	Payload interface{}
+}
+
+// Schema is the subset of JSON Schema the generator emits. Keywords starting
+// with x- are annotations for clients; validators ignore them.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"` // a name, or a list for nullable values
+	Format               string             `json:"format,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+
+	Direction       Direction `json:"x-direction,omitempty"`
+	Since           int       `json:"x-since,omitempty"`
+	ProtocolVersion int       `json:"x-protocol-version,omitempty"`
+	MinVersion      int       `json:"x-min-protocol-version,omitempty"`
+}
+
+// Generate builds one document describing every message: the envelope, and
+// for each message the payload its type carries. A message matches the
+// document if it matches any of the messages.
+func Generate(messages []Message) *Schema {
+	g := &generator{defs: make(map[string]*Schema)}
+	envelope := g.schema(reflect.TypeOf(protocol.Message{}))
+
+	doc := &Schema{
+		Schema:          Draft,
+		Title:           "devtail gateway protocol",
+		Description:     "Messages exchanged over the gateway's WebSocket, HTTP fallback, WebTransport and gRPC transports",
+		ProtocolVersion: protocol.CurrentVersion,
+		MinVersion:      protocol.MinVersion,
+		Defs:            g.defs,
+	}
+	for _, m := range messages {
+		payload := &Schema{Description: "No payload"}
+		if m.Payload != nil {
+			payload = g.schema(reflect.TypeOf(m.Payload))
+		}
+		doc.AnyOf = append(doc.AnyOf, &Schema{
+			Title:       string(m.Type),
+			Description: m.Description,
+			Direction:   m.Direction,
+			Since:       protocol.Introduced(m.Type),
+			AllOf:       []*Schema{envelope},
+			Properties: map[string]*Schema{
+				"type":    {Const: m.Type},
+				"payload": payload,
+			},
+			Required: []string{"type"},
+		})
+	}
+	return doc
+}
+
+// ForType returns a document describing only the messages of type t, or
+// false if there are none. It keeps every definition, so references
+// resolve.
+func ForType(doc *Schema, t protocol.MessageType) (*Schema, bool) {
+	out := *doc
+	out.AnyOf = nil
+	for _, m := range doc.AnyOf {
+		if m.Title == string(t) {
+			out.AnyOf = append(out.AnyOf, m)
+		}
+	}
+	out.Title = doc.Title + ": " + string(t)
+	return &out, len(out.AnyOf) > 0
+}
+
+// Types lists the message types doc describes, sorted
+func Types(doc *Schema) []protocol.MessageType {
+	seen := make(map[protocol.MessageType]bool)
+	var types []protocol.MessageType
+	for _, m := range doc.AnyOf {
+		t := protocol.MessageType(m.Title)
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+type generator struct {
+	defs map[string]*Schema
+}
+
+// schema returns the schema for t. Named structs go in $defs and are
+// referenced, so each appears once.
+func (g *generator) schema(t reflect.Type) *Schema {
+	nullable := false
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		nullable = true
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawType, t.Kind() == reflect.Interface:
+		// Any JSON value
+		return &Schema{}
+	}
+
+	var s *Schema
+	switch t.Kind() {
+	case reflect.String:
+		s = &Schema{Type: "string"}
+	case reflect.Bool:
+		s = &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s = &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = &Schema{Type: "integer", Minimum: bound(0)}
+		if t.Kind() == reflect.Uint16 {
+			s.Maximum = bound(1<<16 - 1)
+		}
+	case reflect.Float32, reflect.Float64:
+		s = &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json sends byte slices as base64
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		s = &Schema{Type: "array", Items: g.schema(t.Elem())}
+		nullable = t.Kind() == reflect.Slice
+	case reflect.Map:
+		s = &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+		nullable = true
+	case reflect.Struct:
+		if t.Name() == "" {
+			s = g.object(t)
+			break
+		}
+		if _, ok := g.defs[t.Name()]; !ok {
+			// Registered before its fields, so recursive types terminate
+			g.defs[t.Name()] = &Schema{}
+			*g.defs[t.Name()] = *g.object(t)
+		}
+		return &Schema{Ref: "#/$defs/" + t.Name()}
+	default:
+		return &Schema{}
+	}
+
+	if nullable {
+		s.Type = []interface{}{s.Type, "null"}
+	}
+	return s
+}
+
+// object builds a struct's schema from its json tags. Embedded structs
+// without a json name are flattened, as encoding/json does.
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for prop, ps := range g.object(ft).Properties {
+					s.Properties[prop] = ps
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+	}
+	return s
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
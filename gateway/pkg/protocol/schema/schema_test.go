@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devtail/gateway/pkg/protocol"
+)
+
+type nested struct {
+	Names   []string          `json:"names"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Next    *nested           `json:"next,omitempty"`
+	Hidden  string            `json:"-"`
+	Rows    uint16            `json:"rows"`
+	Started time.Time         `json:"started"`
+}
+
+type embedding struct {
+	*protocol.AckMessage
+	Extra bool `json:"extra"`
+}
+
+func TestGenerate(t *testing.T) {
+	doc := Generate([]Message{
+		{Type: protocol.TypeChat, Direction: FromClient, Payload: protocol.ChatMessage{}},
+		{Type: "tree", Direction: FromGateway, Payload: nested{}},
+		{Type: "tree", Direction: FromClient, Payload: embedding{}},
+		{Type: protocol.TypeHello, Direction: FromClient},
+	})
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every reference must resolve within the document
+	for _, ref := range strings.Split(string(data), `"$ref":"#/$defs/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if doc.Defs[name] == nil {
+			t.Errorf("unresolved reference to %s", name)
+		}
+	}
+
+	chat := doc.Defs["ChatMessage"]
+	if chat == nil || chat.Properties["content"].Type != "string" || chat.Properties["work_dir"] == nil {
+		t.Fatalf("unexpected ChatMessage schema %+v", chat)
+	}
+	if doc.Defs["Message"].Properties["timestamp"].Format != "date-time" {
+		t.Error("expected the envelope's timestamp to be a date-time")
+	}
+
+	tree := doc.Defs["nested"]
+	if _, ok := tree.Properties["Hidden"]; ok {
+		t.Error("expected fields tagged json:\"-\" to be left out")
+	}
+	if got, _ := json.Marshal(tree.Properties["names"].Type); string(got) != `["array","null"]` {
+		t.Errorf("expected slices to be nullable, got %s", got)
+	}
+	if tree.Properties["next"].Ref != "#/$defs/nested" {
+		t.Errorf("expected a recursive reference, got %+v", tree.Properties["next"])
+	}
+	if rows := tree.Properties["rows"]; *rows.Minimum != 0 || *rows.Maximum != 65535 {
+		t.Errorf("expected uint16 bounds, got %v..%v", *rows.Minimum, *rows.Maximum)
+	}
+	if emb := doc.Defs["embedding"]; emb.Properties["message_id"] == nil || emb.Properties["extra"] == nil {
+		t.Errorf("expected embedded fields to be flattened, got %+v", emb.Properties)
+	}
+
+	if doc.AnyOf[0].Properties["type"].Const != protocol.TypeChat || doc.AnyOf[0].Direction != FromClient {
+		t.Errorf("unexpected chat message %+v", doc.AnyOf[0])
+	}
+	if hello := doc.AnyOf[3]; hello.Since != protocol.Version2 || hello.Properties["payload"].Type != nil {
+		t.Errorf("expected hello to be version 2 with no payload, got %+v", hello)
+	}
+
+	one, ok := ForType(doc, "tree")
+	if !ok || len(one.AnyOf) != 2 || len(doc.AnyOf) != 4 || one.Defs["nested"] == nil {
+		t.Fatalf("ForType(tree) gave %d messages, %v", len(one.AnyOf), ok)
+	}
+	if _, ok := ForType(doc, "missing"); ok {
+		t.Error("expected no document for an unknown type")
+	}
+
+	types := Types(doc)
+	if len(types) != 3 || types[0] != protocol.TypeChat || types[2] != "tree" {
+		t.Errorf("unexpected types %v", types)
+	}
+}
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,7 +13,8 @@ type MessageReader struct {
 	reader io.Reader
 	codec  *Codec
 	mu     sync.Mutex
-	buf    []byte
+	header [frameHeaderSize]byte
+	buf    []byte // reused for frames up to maxPooledBuffer
 }
 
 // ReadMessage reads the next message from the stream
@@ -21,7 +23,7 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 	defer r.mu.Unlock()
 
 	// Read frame header
-	header := make([]byte, frameHeaderSize)
+	header := r.header[:]
 	if _, err := io.ReadFull(r.reader, header); err != nil {
 		if err == io.EOF {
 			return nil, io.EOF
@@ -34,27 +36,36 @@ func (r *MessageReader) ReadMessage() (*Message, error) {
 	length := binary.BigEndian.Uint32(header[1:5])
 
 	if length > maxFrameSize {
-		return nil, fmt.Errorf("frame too large: %d bytes", length)
+		return nil, fmt.Errorf("%w: frame too large: %d bytes", ErrLimitExceeded, length)
 	}
 
-	// Read payload
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(r.reader, payload); err != nil {
+	// Read payload. The buffer grows as data arrives rather than trusting
+	// the header, so a peer claiming a large frame and sending nothing
+	// costs nothing.
+	// Decoding copies what it keeps, so the buffer is reused.
+	if r.buf == nil {
+		r.buf = make([]byte, 0, frameHeaderSize+bytes.MinRead)
+	}
+	frame := bytes.NewBuffer(r.buf[:0])
+	frame.Write(header)
+	_, err := io.CopyN(frame, r.reader, int64(length))
+	if frame.Cap() <= maxPooledBuffer {
+		r.buf = frame.Bytes()[:0]
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, fmt.Errorf("read payload: %w", err)
 	}
 
-	// Reconstruct frame
-	frame := make([]byte, frameHeaderSize+length)
-	copy(frame[:frameHeaderSize], header)
-	copy(frame[frameHeaderSize:], payload)
-
 	// Handle batch messages
 	if (flags & flagBatch) != 0 {
 		return nil, fmt.Errorf("batch messages not supported in streaming mode")
 	}
 
 	// Decode message
-	return r.codec.DecodeMessage(frame)
+	return r.codec.DecodeMessage(frame.Bytes())
 }
 
 // MessageWriter writes framed messages to a stream
@@ -62,6 +73,7 @@ type MessageWriter struct {
 	writer io.Writer
 	codec  *Codec
 	mu     sync.Mutex
+	buf    []byte // reused for frames up to maxPooledBuffer
 }
 
 // WriteMessage writes a message to the stream
@@ -69,11 +81,20 @@ func (w *MessageWriter) WriteMessage(msg *Message) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	return w.writeMessage(msg)
+}
+
+// writeMessage encodes into the writer's buffer, which io.Writer
+// implementations must not retain
+func (w *MessageWriter) writeMessage(msg *Message) error {
 	// Encode message
-	data, err := w.codec.EncodeMessage(msg)
+	data, err := w.codec.AppendMessage(w.buf[:0], msg)
 	if err != nil {
 		return fmt.Errorf("encode message: %w", err)
 	}
+	if cap(data) <= maxPooledBuffer {
+		w.buf = data[:0]
+	}
 
 	// Write to stream
 	if _, err := w.writer.Write(data); err != nil {
@@ -94,7 +115,7 @@ func (w *MessageWriter) WriteBatch(messages []*Message) error {
 
 	// For single message, just write it normally
 	if len(messages) == 1 {
-		return w.WriteMessage(messages[0])
+		return w.writeMessage(messages[0])
 	}
 
 	// Encode batch
@@ -117,4 +138,4 @@ func (w *MessageWriter) Flush() error {
 		return flusher.Flush()
 	}
 	return nil
-}
\ No newline at end of file
+}
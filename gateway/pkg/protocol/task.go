@@ -0,0 +1,95 @@
+package protocol
+
+import "time"
+
+// Background task messages. A task is a longer instruction, such as
+// "upgrade all deps and fix breakages", that the gateway carries out on its
+// own: it keeps running when the client disconnects, and a client can watch
+// it again from where it left off.
+const (
+	// TypeTaskSubmit starts a task; the reply is a task_status message
+	TypeTaskSubmit MessageType = "task_submit"
+	// TypeTaskStatus reports a task's state. Watched tasks send one on every
+	// change, the last once the task has ended.
+	TypeTaskStatus MessageType = "task_status"
+	// TypeTaskProgress carries part of the assistant's output for a task
+	TypeTaskProgress MessageType = "task_progress"
+	// TypeTaskList asks for the user's tasks; the reply is a task_list
+	// message carrying a TaskList payload
+	TypeTaskList MessageType = "task_list"
+	// TypeTaskWatch streams a task's progress and status changes to the
+	// session until the task ends
+	TypeTaskWatch MessageType = "task_watch"
+	// TypeTaskCancel stops a task; the reply is its task_status
+	TypeTaskCancel MessageType = "task_cancel"
+)
+
+// Task states
+const (
+	TaskQueued    = "queued"
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled"
+)
+
+// TaskSubmit is the payload of a task_submit request. Watch streams the
+// task to the submitting session straight away.
+type TaskSubmit struct {
+	Instruction string `json:"instruction"`
+	Workspace   string `json:"workspace,omitempty"`
+	WorkDir     string `json:"work_dir,omitempty"`
+	Watch       bool   `json:"watch,omitempty"`
+}
+
+// TaskStatus describes a task. Seq is the number of the last task_progress
+// message so far. Once the task has ended Summary holds the assistant's
+// account of what it did and Diff the changes it made to tracked files, cut
+// at a size limit if DiffTruncated is set; files it created are listed in
+// NewFiles.
+type TaskStatus struct {
+	ID            string     `json:"id"`
+	Instruction   string     `json:"instruction"`
+	Workspace     string     `json:"workspace,omitempty"`
+	WorkDir       string     `json:"work_dir,omitempty"`
+	State         string     `json:"state"`
+	Seq           int64      `json:"seq"`
+	CreatedAt     time.Time  `json:"created_at"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	Summary       string     `json:"summary,omitempty"`
+	Diff          string     `json:"diff,omitempty"`
+	DiffTruncated bool       `json:"diff_truncated,omitempty"`
+	NewFiles      []string   `json:"new_files,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// Ended reports whether the task has stopped for good
+func (s TaskStatus) Ended() bool {
+	return s.State == TaskSucceeded || s.State == TaskFailed || s.State == TaskCancelled
+}
+
+// TaskProgress is part of the assistant's output for a task. Seq numbers a
+// task's progress messages from 1.
+type TaskProgress struct {
+	TaskID  string `json:"task_id"`
+	Seq     int64  `json:"seq"`
+	Content string `json:"content"`
+}
+
+// TaskList lists the user's tasks, newest first
+type TaskList struct {
+	Tasks []TaskStatus `json:"tasks"`
+}
+
+// TaskWatch is the payload of a task_watch request. Progress up to AfterSeq
+// is skipped, so a client that reconnects passes the last seq it saw.
+type TaskWatch struct {
+	TaskID   string `json:"task_id"`
+	AfterSeq int64  `json:"after_seq,omitempty"`
+}
+
+// TaskCancel is the payload of a task_cancel request
+type TaskCancel struct {
+	TaskID string `json:"task_id"`
+}
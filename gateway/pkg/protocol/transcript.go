@@ -0,0 +1,28 @@
+package protocol
+
+// TypeChatExport asks for the transcript of the conversation in a
+// workspace and work_dir; the reply is a chat_transcript message
+const TypeChatExport MessageType = "chat_export"
+
+// TypeChatTranscript carries an exported conversation
+const TypeChatTranscript MessageType = "chat_transcript"
+
+// ChatExport is the payload of a chat_export request. Format is "markdown",
+// the default, or "json".
+type ChatExport struct {
+	Workspace string `json:"workspace,omitempty"`
+	WorkDir   string `json:"work_dir,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// ChatTranscript is an exported conversation: its messages, the commands
+// they ran and the diffs of the commits the assistant made. Content is the
+// file to save as Filename.
+type ChatTranscript struct {
+	Workspace   string `json:"workspace,omitempty"`
+	WorkDir     string `json:"work_dir,omitempty"`
+	Format      string `json:"format"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// Protocol versions. Clients announce theirs in a hello message, or in the
+// protocol_version field of each message; clients that do neither predate
+// versioning and speak version 1.
+const (
+	// Version1 is the protocol before versioning
+	Version1 = 1
+
+	// Version2 adds the hello handshake, the protocol_version field,
+	// backend recovery events, chat queue positions and file change
+	// notifications
+	Version2 = 2
+
+	// CurrentVersion is what the gateway speaks internally
+	CurrentVersion = Version2
+
+	// MinVersion is the oldest version the gateway still converts to
+	MinVersion = Version1
+)
+
+// TypeHello opens a versioned session. The client sends its version; the
+// gateway answers with the version the session will use.
+const TypeHello MessageType = "hello"
+
+// Hello is the payload of a hello message in either direction
+type Hello struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	MinVersion      int    `json:"min_version,omitempty"`
+	MaxVersion      int    `json:"max_version,omitempty"`
+	SessionID       string `json:"session_id,omitempty"`
+	Client          string `json:"client,omitempty"`
+
+	// Capabilities are the optional features the client supports; the
+	// gateway's reply lists the ones the session uses
+	Capabilities []Capability `json:"capabilities,omitempty"`
+
+	// StreamGranularity is how the client wants chat replies sliced into
+	// chat_stream messages, such as sentence on slow links; the gateway's
+	// reply gives the one the session uses
+	StreamGranularity string `json:"stream_granularity,omitempty"`
+
+	// ReadOnly asks for a session that cannot change the workspace, for
+	// demos; the gateway's reply says whether the session is read-only,
+	// which the gateway or the connect token may also decide
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// NegotiateVersion picks the version for a client that speaks up to
+// clientVersion. Clients newer than the gateway are expected to fall back
+// to CurrentVersion.
+func NegotiateVersion(clientVersion int) (int, error) {
+	switch {
+	case clientVersion <= 0:
+		return Version1, nil
+	case clientVersion < MinVersion:
+		return 0, fmt.Errorf("protocol version %d is no longer supported, minimum is %d", clientVersion, MinVersion)
+	case clientVersion > CurrentVersion:
+		return CurrentVersion, nil
+	default:
+		return clientVersion, nil
+	}
+}
+
+// versionChange describes how version differs from the one before it
+type versionChange struct {
+	version int
+
+	// renamed maps message types from the previous version to their names
+	// in this one
+	renamed map[MessageType]MessageType
+
+	// added lists message types older clients do not understand; they are
+	// not sent to them
+	added []MessageType
+
+	// upgrade and downgrade convert payloads whose shape changed. They
+	// work on a copy of the message and run after renames going up and
+	// before them going down, so they always see this version's type names.
+	upgrade   func(msg *Message)
+	downgrade func(msg *Message)
+}
+
+// versionChanges lists every change since Version1, oldest first
+var versionChanges = []versionChange{
+	{
+		version: Version2,
+		added: []MessageType{
+			TypeHello,
+			TypeBackendRecoveryStarted,
+			TypeBackendRecoverySucceeded,
+			TypeBackendRecoveryFailed,
+			TypeChatQueued,
+			TypeWorkspaceFileChanged,
+		},
+	},
+}
+
+// Introduced returns the protocol version that added message type t
+func Introduced(t MessageType) int {
+	for _, change := range versionChanges {
+		for _, added := range change.added {
+			if added == t {
+				return change.version
+			}
+		}
+	}
+	return Version1
+}
+
+// Upgrade converts a message from a client speaking version to the current
+// version. A message's own protocol_version takes precedence over version.
+func Upgrade(msg *Message, version int) *Message {
+	return upgrade(versionChanges, msg, version)
+}
+
+// Downgrade converts a message to what a client speaking version expects.
+// It reports false if the message has no equivalent in that version and
+// should not be sent.
+func Downgrade(msg *Message, version int) (*Message, bool) {
+	return downgrade(versionChanges, msg, version)
+}
+
+func upgrade(changes []versionChange, msg *Message, version int) *Message {
+	if msg.ProtocolVersion != 0 {
+		version = msg.ProtocolVersion
+	}
+
+	out := *msg
+	for _, change := range changes {
+		if change.version <= version {
+			continue
+		}
+		if renamed, ok := change.renamed[out.Type]; ok {
+			out.Type = renamed
+		}
+		if change.upgrade != nil {
+			change.upgrade(&out)
+		}
+	}
+	return &out
+}
+
+func downgrade(changes []versionChange, msg *Message, version int) (*Message, bool) {
+	if version < Version1 {
+		version = Version1
+	}
+
+	out := *msg
+	for i := len(changes) - 1; i >= 0 && changes[i].version > version; i-- {
+		change := changes[i]
+		for _, added := range change.added {
+			if out.Type == added {
+				return nil, false
+			}
+		}
+		if change.downgrade != nil {
+			change.downgrade(&out)
+		}
+		for old, renamed := range change.renamed {
+			if out.Type == renamed {
+				out.Type = old
+				break
+			}
+		}
+	}
+
+	// Version 1 clients do not know the field
+	out.ProtocolVersion = version
+	if version < Version2 {
+		out.ProtocolVersion = 0
+	}
+	return &out, true
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		client int
+		want   int
+	}{
+		{0, Version1},
+		{Version1, Version1},
+		{Version2, Version2},
+		{CurrentVersion + 5, CurrentVersion},
+	}
+	for _, tt := range tests {
+		got, err := NegotiateVersion(tt.client)
+		if err != nil {
+			t.Fatalf("NegotiateVersion(%d): %v", tt.client, err)
+		}
+		if got != tt.want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestDowngradeToVersion1(t *testing.T) {
+	msg := &Message{ID: "1", Type: TypePong, Timestamp: time.Now(), ProtocolVersion: CurrentVersion}
+
+	out, ok := Downgrade(msg, Version1)
+	if !ok {
+		t.Fatal("pong dropped for a version 1 client")
+	}
+	if out.ProtocolVersion != 0 {
+		t.Errorf("version 1 client sent protocol_version %d", out.ProtocolVersion)
+	}
+	if msg.ProtocolVersion != CurrentVersion {
+		t.Error("Downgrade modified its argument")
+	}
+
+	if _, ok := Downgrade(&Message{ID: "2", Type: TypeHello}, Version1); ok {
+		t.Error("hello sent to a version 1 client")
+	}
+
+	out, ok = Downgrade(&Message{ID: "3", Type: TypePong}, Version2)
+	if !ok || out.ProtocolVersion != Version2 {
+		t.Errorf("version 2 client got %+v, %v", out, ok)
+	}
+}
+
+func TestVersionChangesRenameTypes(t *testing.T) {
+	// A version 3 that renames terminal_list, with a payload conversion
+	changes := append(append([]versionChange(nil), versionChanges...), versionChange{
+		version: 3,
+		renamed: map[MessageType]MessageType{"terminal_list": "terminal_sessions"},
+		upgrade: func(msg *Message) {
+			if msg.Type == "terminal_sessions" && msg.Payload == nil {
+				msg.Payload = []byte(`{"terminals":[]}`)
+			}
+		},
+		downgrade: func(msg *Message) {
+			if msg.Type == "terminal_sessions" {
+				msg.Payload = nil
+			}
+		},
+	})
+
+	old := &Message{ID: "1", Type: "terminal_list"}
+	up := upgrade(changes, old, Version1)
+	if up.Type != "terminal_sessions" || string(up.Payload) != `{"terminals":[]}` {
+		t.Fatalf("upgrade from version 1 gave %+v", up)
+	}
+	if old.Type != "terminal_list" {
+		t.Error("upgrade modified its argument")
+	}
+
+	// Clients that already speak version 3 are left alone
+	current := &Message{ID: "2", Type: "terminal_sessions", ProtocolVersion: 3}
+	if got := upgrade(changes, current, Version1); got.Type != "terminal_sessions" || got.Payload != nil {
+		t.Fatalf("upgrade of a version 3 message gave %+v", got)
+	}
+
+	down, ok := downgrade(changes, up, Version2)
+	if !ok || down.Type != "terminal_list" || down.Payload != nil || down.ProtocolVersion != Version2 {
+		t.Fatalf("downgrade to version 2 gave %+v, %v", down, ok)
+	}
+	if down, _ := downgrade(changes, up, 3); down.Type != "terminal_sessions" {
+		t.Fatalf("downgrade to version 3 renamed the message: %+v", down)
+	}
+}
+
+func TestIntroduced(t *testing.T) {
+	if got := Introduced(TypeChat); got != Version1 {
+		t.Errorf("Introduced(chat) = %d, want %d", got, Version1)
+	}
+	if got := Introduced(TypeWorkspaceFileChanged); got != Version2 {
+		t.Errorf("Introduced(workspace_file_changed) = %d, want %d", got, Version2)
+	}
+}
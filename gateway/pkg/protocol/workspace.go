@@ -0,0 +1,39 @@
+package protocol
+
+// TypeWorkspaces asks the gateway which workspaces it serves; the reply is a
+// workspaces message carrying a WorkspaceList payload
+const TypeWorkspaces MessageType = "workspaces"
+
+// Workspace is a named project root on the VM. Chats and terminals name the
+// one they work in; without a name they use the default.
+type Workspace struct {
+	Name    string `json:"name"`
+	Root    string `json:"root"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// WorkspaceList is the payload of a workspaces reply
+type WorkspaceList struct {
+	Workspaces []Workspace `json:"workspaces"`
+}
+
+// TypeWorkspaceFileChanged tells clients a file in a workspace changed, so
+// open editors and file browsers can refresh
+const TypeWorkspaceFileChanged MessageType = "workspace_file_changed"
+
+// File change operations
+const (
+	FileCreated = "create"
+	FileWritten = "write"
+	FileRemoved = "remove"
+	FileRenamed = "rename"
+)
+
+// WorkspaceFileChanged is the payload of a workspace_file_changed message.
+// Path is relative to the workspace root, with forward slashes.
+type WorkspaceFileChanged struct {
+	Workspace string `json:"workspace"`
+	Path      string `json:"path"`
+	Operation string `json:"operation"`
+	Size      int64  `json:"size,omitempty"`
+}